@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Socket of the journald native protocol
+const journaldSocket = "/run/systemd/journal/socket"
+
+// AccessLogConfig selects how requests are logged. Format, exclusions, and the slow
+// threshold apply on reload; the destination needs a restart.
+type AccessLogConfig struct {
+	// Format is text (the default), json, combined, or common
+	Format string `yaml:"format"`
+	// Destination is stdout (the default), journald, or an absolute file path. A file
+	// is reopened on SIGUSR1, after logrotate has moved it.
+	Destination string `yaml:"destination"`
+	// Exclude lists routes or paths, like /version, that aren't logged
+	Exclude []string `yaml:"exclude"`
+	// SlowThreshold logs a warning for requests taking longer, excluded or not
+	SlowThreshold time.Duration `yaml:"slow_threshold"`
+}
+
+// Function to check the access log settings
+func (c AccessLogConfig) validate() error {
+	switch c.Format {
+	case "", "text", "json", "combined", "common":
+	default:
+		return fmt.Errorf("access_log.format must be text, json, combined, or common")
+	}
+	switch {
+	case c.Destination == "", c.Destination == "stdout", c.Destination == "journald":
+	case !filepath.IsAbs(c.Destination):
+		return fmt.Errorf("access_log.destination must be stdout, journald, or an absolute path")
+	}
+	if c.SlowThreshold < 0 {
+		return fmt.Errorf("access_log.slow_threshold must not be negative")
+	}
+	return nil
+}
+
+// Helper function to check if a request is excluded from the access log
+func (c AccessLogConfig) excludes(route, path string) bool {
+	for _, excluded := range c.Exclude {
+		if excluded == route || excluded == path {
+			return true
+		}
+	}
+	return false
+}
+
+// accessEntry is one request as written to the access log
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	Client     string    `json:"client"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Route      string    `json:"route,omitempty"`
+	Protocol   string    `json:"protocol"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	DurationMS float64   `json:"duration_ms"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// Function to format an entry as one line, without the trailing newline
+func (e accessEntry) format(format string) string {
+	dash := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+		return value
+	}
+	switch format {
+	case "json":
+		data, _ := json.Marshal(e)
+		return string(data)
+	case "common", "combined":
+		size := "-"
+		if e.Bytes > 0 {
+			size = strconv.Itoa(e.Bytes)
+		}
+		line := fmt.Sprintf("%s - %s [%s] %q %d %s", e.Client, dash(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			e.Method+" "+e.Path+" "+e.Protocol, e.Status, size)
+		if format == "combined" {
+			line += fmt.Sprintf(" %q %q", dash(e.Referer), dash(e.UserAgent))
+		}
+		return line
+	default:
+		return fmt.Sprintf("[GIN] %s | %3d | %13v | %15s | %-7s %q | %s", e.Time.Format("2006/01/02 - 15:04:05"), e.Status,
+			time.Duration(e.DurationMS*float64(time.Millisecond)), e.Client, e.Method, e.Path, e.RequestID)
+	}
+}
+
+// accessLogSink is where access log lines go. File sinks can be reopened.
+type accessLogSink struct {
+	mu      sync.Mutex
+	out     io.Writer
+	path    string
+	file    *os.File
+	journal *net.UnixConn
+}
+
+var accessLog = &accessLogSink{out: os.Stdout}
+
+// Function to open the configured access log destination. When journald can't be
+// reached the log falls back to stdout.
+func openAccessLog(cfg AccessLogConfig) error {
+	accessLog.mu.Lock()
+	defer accessLog.mu.Unlock()
+	switch cfg.Destination {
+	case "", "stdout":
+		return nil
+	case "journald":
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+		if err != nil {
+			return fmt.Errorf("journald is not available, logging requests to stdout: %w", err)
+		}
+		accessLog.journal = conn
+		return nil
+	default:
+		accessLog.path = cfg.Destination
+		if err := accessLog.reopen(); err != nil {
+			return fmt.Errorf("unable to open the access log, logging requests to stdout: %w", err)
+		}
+		return nil
+	}
+}
+
+// reopen opens the log file again, so logs go to a new file after rotation. Callers
+// must hold s.mu.
+func (s *accessLogSink) reopen() error {
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, s.out = file, file
+	return nil
+}
+
+// Function to reopen the access log file whenever the agent receives SIGUSR1
+func watchReopenSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			accessLog.mu.Lock()
+			if accessLog.path != "" {
+				if err := accessLog.reopen(); err != nil {
+					log.Printf("Warning: unable to reopen the access log %s: %v", accessLog.path, err)
+				}
+			}
+			accessLog.mu.Unlock()
+		}
+	}()
+}
+
+// Write logs one entry, as a journal entry with structured fields under journald
+func (s *accessLogSink) Write(entry accessEntry, line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil {
+		fmt.Fprintln(s.out, line)
+		return
+	}
+
+	var message bytes.Buffer
+	fields := [][2]string{
+		{"MESSAGE", line},
+		{"PRIORITY", "6"},
+		{"SYSLOG_IDENTIFIER", "cosi"},
+		{"REQUEST_ID", entry.RequestID},
+		{"HTTP_METHOD", entry.Method},
+		{"HTTP_PATH", entry.Path},
+		{"HTTP_STATUS", strconv.Itoa(entry.Status)},
+		{"CLIENT_ADDRESS", entry.Client},
+	}
+	for _, field := range fields {
+		writeJournalField(&message, field[0], field[1])
+	}
+	if _, err := s.journal.Write(message.Bytes()); err != nil {
+		fmt.Fprintln(os.Stdout, line)
+	}
+}
+
+// Helper function to encode a journald field. Values with newlines use the
+// length-prefixed form of the native protocol.
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+	buf.WriteString(name + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+// Middleware to give every request an ID, taken from X-Request-Id when the client
+// sent a usable one, and echo it in the response
+func assignRequestID(c *gin.Context) {
+	id := c.GetHeader("X-Request-Id")
+	if !validRequestID(id) {
+		id = newID()
+	}
+	c.Set("request_id", id)
+	c.Header("X-Request-Id", id)
+	// Jobs record the request that created them from its context
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDKey{}, id))
+	c.Next()
+}
+
+// Helper function to check if a request ID sent by a client is usable: short and printable
+func validRequestID(id string) bool {
+	return id != "" && len(id) <= 128 && !strings.ContainsFunc(id, func(r rune) bool { return r <= ' ' || r > '~' })
+}
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// Helper function to return the ID of the request ctx belongs to, or "" outside of requests
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Middleware to write the access log and warn about slow requests
+func logRequests(c *gin.Context) {
+	start := time.Now()
+	path := c.Request.URL.RequestURI()
+	c.Next()
+
+	cfg := currentConfig().AccessLog
+	duration := time.Since(start)
+	entry := accessEntry{
+		Time:       start,
+		RequestID:  c.GetString("request_id"),
+		Client:     c.ClientIP(),
+		User:       c.GetString("token_name"),
+		Method:     c.Request.Method,
+		Path:       path,
+		Route:      c.FullPath(),
+		Protocol:   c.Request.Proto,
+		Status:     c.Writer.Status(),
+		Bytes:      max(c.Writer.Size(), 0),
+		DurationMS: float64(duration.Microseconds()) / 1000,
+		Referer:    c.Request.Referer(),
+		UserAgent:  c.Request.UserAgent(),
+	}
+	if cfg.SlowThreshold > 0 && duration > cfg.SlowThreshold {
+		log.Printf("Warning: slow request %s: %s %s took %s (status %d)", entry.RequestID, entry.Method, entry.Path, duration.Round(time.Millisecond), entry.Status)
+	}
+	if !cfg.excludes(entry.Route, c.Request.URL.Path) {
+		accessLog.Write(entry, entry.format(cfg.Format))
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// First file descriptor passed by systemd socket activation (SD_LISTEN_FDS_START)
+const listenFDsStart = 3
+
+// File descriptor inherited from systemd, or -1 when the agent opened its own socket
+var activationFD = -1
+
+// Function to return the socket systemd passed through LISTEN_FDS, or nil when
+// the agent wasn't socket activated
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	if count > 1 {
+		return nil, fmt.Errorf("expected one socket from systemd, got %d", count)
+	}
+
+	file := os.NewFile(listenFDsStart, "systemd-socket")
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("using socket from systemd: %w", err)
+	}
+	// FileListener works on a duplicate; keep the original open but out of exec'd children
+	syscall.CloseOnExec(listenFDsStart)
+	activationFD = listenFDsStart
+	return listener, nil
+}
+
+// Function to open the listener for the HTTP server, preferring a socket from systemd
+func agentListener(addr string) (net.Listener, error) {
+	listener, err := systemdListener()
+	if err != nil || listener != nil {
+		return listener, err
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Helper function to let the systemd socket survive a re-exec, so the new binary
+// picks it up again without ever closing the port
+func inheritActivationSocket() {
+	if activationFD < 0 {
+		return
+	}
+	syscall.Syscall(syscall.SYS_FCNTL, uintptr(activationFD), syscall.F_SETFD, 0)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The test binary re-runs itself with this set to act as the socket activated agent
+const activationChildEnv = "COSI_TEST_ACTIVATION_CHILD"
+
+// Helper function run in the child: pick up fd 3 like systemd passed it and greet one client
+func activationChild() {
+	// systemd sets LISTEN_PID to the pid it starts, which only the child knows
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	listener, err := agentListener("127.0.0.1:0")
+	if err != nil {
+		fmt.Println("agentListener:", err)
+		os.Exit(1)
+	}
+	if listener.Addr().Network() != "unix" || activationFD != listenFDsStart {
+		fmt.Printf("opened its own %s listener, activation fd %d\n", listener.Addr().Network(), activationFD)
+		os.Exit(1)
+	}
+	// The socket stays out of exec'd commands, except for the agent's own re-exec
+	if fdFlags(listenFDsStart)&syscall.FD_CLOEXEC == 0 {
+		fmt.Println("activation socket would leak into commands")
+		os.Exit(1)
+	}
+	inheritActivationSocket()
+	if fdFlags(listenFDsStart)&syscall.FD_CLOEXEC != 0 {
+		fmt.Println("activation socket would be closed by a re-exec")
+		os.Exit(1)
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		fmt.Println("accept:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintln(conn, "activated")
+	conn.Close()
+	os.Exit(0)
+}
+
+// Helper function to read the descriptor flags of fd
+func fdFlags(fd int) uintptr {
+	flags, _, _ := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0)
+	return flags
+}
+
+func TestSystemdListener(t *testing.T) {
+	if os.Getenv(activationChildEnv) != "" {
+		activationChild()
+	}
+
+	// systemd holds the listening socket and hands it to the agent as fd 3
+	path := filepath.Join(t.TempDir(), "cosi.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	file, err := listener.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	child := exec.Command(os.Args[0], "-test.run=^TestSystemdListener$")
+	child.Env = append(os.Environ(), activationChildEnv+"=1")
+	child.ExtraFiles = []*os.File{file}
+	output, err := child.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	greeting, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || greeting != "activated\n" {
+		rest, _ := bufio.NewReader(output).ReadString(0)
+		t.Errorf("greeting %q (%v); child said %q", greeting, err, rest)
+	}
+	if err := child.Wait(); err != nil {
+		t.Errorf("child: %v", err)
+	}
+}
+
+func TestSystemdListenerNotActivated(t *testing.T) {
+	tests := []struct {
+		pid, fds string
+		wantErr  bool
+	}{
+		{"", "", false},
+		// Variables meant for another process, like a parent that was activated itself
+		{"1", "1", false},
+		{strconv.Itoa(os.Getpid()), "0", false},
+		{strconv.Itoa(os.Getpid()), "2", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("LISTEN_PID", tt.pid)
+		t.Setenv("LISTEN_FDS", tt.fds)
+		listener, err := systemdListener()
+		if listener != nil {
+			listener.Close()
+			t.Errorf("LISTEN_PID=%q LISTEN_FDS=%q: used an inherited socket", tt.pid, tt.fds)
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("LISTEN_PID=%q LISTEN_FDS=%q: err = %v, want error %v", tt.pid, tt.fds, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AllowlistConfig limits the addresses the agent answers. Without CIDRs every address
+// is allowed.
+type AllowlistConfig struct {
+	// CIDRs are the allowed networks, IPv4 or IPv6; a bare address allows just itself
+	CIDRs []string `yaml:"cidrs"`
+	// TrustForwardedFor takes the client address from X-Forwarded-For or X-Real-IP, but
+	// only on requests whose peer is one of TrustedProxies. Changing either needs a restart.
+	TrustForwardedFor bool     `yaml:"trust_forwarded_for"`
+	TrustedProxies    []string `yaml:"trusted_proxies"`
+
+	prefixes []netip.Prefix
+}
+
+// Requests refused by the allowlist since the agent started, reported by /debug/runtime
+var deniedRequests atomic.Int64
+
+// Function to check the allowlist and parse its networks
+func (a *AllowlistConfig) validate() error {
+	a.prefixes = nil
+	for _, cidr := range a.CIDRs {
+		prefix, err := parsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("allowlist.cidrs: %w", err)
+		}
+		a.prefixes = append(a.prefixes, prefix)
+	}
+	for _, cidr := range a.TrustedProxies {
+		if _, err := parsePrefix(cidr); err != nil {
+			return fmt.Errorf("allowlist.trusted_proxies: %w", err)
+		}
+	}
+	if a.TrustForwardedFor && len(a.TrustedProxies) == 0 {
+		return fmt.Errorf("allowlist.trust_forwarded_for needs allowlist.trusted_proxies")
+	}
+	return nil
+}
+
+// Helper function to parse a CIDR or a single address
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", value)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %q", value)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Helper function to check if an address is in one of the allowed networks
+func (a AllowlistConfig) allows(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range a.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to set which peers gin takes X-Forwarded-For and X-Real-IP from. gin trusts
+// every peer by default, which would let any client pick the address it is checked as.
+func configureTrustedProxies(r *gin.Engine, allowlist AllowlistConfig) error {
+	if !allowlist.TrustForwardedFor {
+		return r.SetTrustedProxies(nil)
+	}
+	return r.SetTrustedProxies(allowlist.TrustedProxies)
+}
+
+// Middleware to refuse requests from addresses outside the allowlist before any other
+// handler sees them
+func enforceAllowlist(c *gin.Context) {
+	allowlist := currentConfig().Allowlist
+	if len(allowlist.prefixes) == 0 {
+		c.Next()
+		return
+	}
+	ip := c.ClientIP()
+	if !allowlist.allows(ip) {
+		deniedRequests.Add(1)
+		log.Printf("Denied %s %s from %s (peer %s): address not in the allowlist", c.Request.Method, c.Request.URL.Path, ip, c.RemoteIP())
+		c.AbortWithStatusJSON(403, gin.H{"error": "Requests from " + ip + " are not allowed", "code": "address_not_allowed"})
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,302 @@
+package api
+
+import (
+	"fmt"
+	"time"
+)
+
+// VersionInfo describes the running build of the agent
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+}
+
+// String formats the build information for --version and the startup log
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("cosi %s (commit %s, built %s, %s %s/%s)", v.Version, v.Commit, v.BuildDate, v.GoVersion, v.OS, v.Arch)
+}
+
+// OSRelease is the /etc/os-release of a host, as served by GET /os
+type OSRelease map[string]string
+
+// Uname is the output of uname by field, like kernel_release, as served by GET /uname
+type Uname map[string]string
+
+// Statuses of a job
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	// JobInterrupted marks jobs that were queued or running when the agent stopped
+	JobInterrupted = "interrupted"
+	JobCancelled   = "cancelled"
+	// JobVerificationFailed marks package jobs whose transaction succeeded but whose
+	// verification checks failed
+	JobVerificationFailed = "succeeded_with_failed_verification"
+	// JobPartiallySucceeded marks fleet jobs where some agents succeeded and others failed
+	JobPartiallySucceeded = "partially_succeeded"
+)
+
+// Job records a long-running operation such as a package transaction or Kubernetes bootstrap
+type Job struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	Status     string      `json:"status"`
+	Summary    string      `json:"summary,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	StartedAt  *time.Time  `json:"started_at,omitempty"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+	// OutputPath is the file on the host that receives the job's output as it runs
+	OutputPath string `json:"output_path,omitempty"`
+	// OutputBytes is the size of the output file so far
+	OutputBytes int64 `json:"output_bytes"`
+	// OutputPruned is set once the output file was removed to stay within the output budget
+	OutputPruned bool `json:"output_pruned,omitempty"`
+	// ScheduleID names the schedule that created the job, if any
+	ScheduleID string `json:"schedule_id,omitempty"`
+	// QueuePosition is the place of a queued job in the queue, counting from 1
+	QueuePosition int `json:"queue_position,omitempty"`
+	// Cancellation is set once DELETE /jobs/:id was requested for the job
+	Cancellation *JobCancellation `json:"cancellation,omitempty"`
+	// RollbackAvailable is set for package jobs whose snapshot allows POST /packages/rollback
+	RollbackAvailable bool `json:"rollback_available,omitempty"`
+	// RequestID is the X-Request-Id of the request that created the job, so a client can
+	// find the job of a request that is still running
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Finished reports whether the job has reached a final status
+func (j *Job) Finished() bool {
+	return j.Status != JobQueued && j.Status != JobRunning
+}
+
+// CommandResult holds the separated and merged output of one or more commands
+type CommandResult struct {
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+	Output string `json:"output"` // Merged, line-ordered transcript of stdout and stderr
+	// ExitCode of the last command run, -1 when it did not exit normally
+	ExitCode int `json:"exit_code"`
+	// Truncated is set when only the end of the output is kept; the job's output file,
+	// served by GET /jobs/:id/output, has all of it
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// LockHolder is a process of another package manager that would block a transaction
+type LockHolder struct {
+	PID     int    `json:"pid"`
+	Command string `json:"command"`
+	// RunningSeconds is how long the process has been running
+	RunningSeconds float64 `json:"running_seconds"`
+	// Lock is the lock file the process holds, when it was found through one
+	Lock string `json:"lock,omitempty"`
+}
+
+// LockWait records a transaction that had to wait for another package manager
+type LockWait struct {
+	Holders       []LockHolder `json:"holders"`
+	WaitedSeconds float64      `json:"waited_seconds"`
+}
+
+// JobCancellation records a cancel request and how far the job had got
+type JobCancellation struct {
+	RequestedAt time.Time `json:"requested_at"`
+	// Stage is queued or running, depending on when the request arrived
+	Stage string `json:"stage"`
+	// Command is the one that was running when the request arrived
+	Command string `json:"command,omitempty"`
+	// Signal is the last signal sent to the command, SIGTERM or SIGKILL
+	Signal string `json:"signal,omitempty"`
+	Note   string `json:"note,omitempty"`
+}
+
+// InstalledPackage is a package reported by GET /packages with a manager other than the system one
+type InstalledPackage struct {
+	Name      string `json:"name"`
+	Manager   string `json:"manager"`
+	Version   string `json:"version,omitempty"`
+	Revision  string `json:"revision,omitempty"`
+	Channel   string `json:"channel,omitempty"` // snap tracking channel or flatpak branch
+	Publisher string `json:"publisher,omitempty"`
+	Origin    string `json:"origin,omitempty"` // flatpak remote
+	Arch      string `json:"arch,omitempty"`
+	Ref       string `json:"ref,omitempty"`
+	Notes     string `json:"notes,omitempty"`
+}
+
+// PackageStep is the output of one snap or flatpak command run for a manifest
+type PackageStep struct {
+	Manager string        `json:"manager"`
+	Action  string        `json:"action"` // install or remove
+	Target  string        `json:"target"`
+	Result  CommandResult `json:"result"`
+}
+
+// PackageOutcome is what applying a manifest did to one package
+type PackageOutcome struct {
+	Name string `json:"name"`
+	// Action is install, remove, purge, or autoremove
+	Action string `json:"action"`
+	// Version is the version an autoremoved package had
+	Version string `json:"version,omitempty"`
+	// Options are the manifest options that were applied to the package
+	Options []string `json:"options,omitempty"`
+	// IgnoredOptions are the options that would have applied but that the package
+	// manager has no equivalent for
+	IgnoredOptions []string `json:"ignored_options,omitempty"`
+}
+
+// SkippedEntry is a manifest entry left out on this host
+type SkippedEntry struct {
+	Field  string `json:"field"`
+	Entry  string `json:"entry"`
+	Reason string `json:"reason"`
+}
+
+// HTTPProbeResult is the outcome of an HTTP probe. Matched is set when the service
+// answered and met every expectation; Error says why it couldn't be asked.
+type HTTPProbeResult struct {
+	URL        string  `json:"url"`
+	Method     string  `json:"method"`
+	StatusCode int     `json:"status_code,omitempty"`
+	LatencyMS  float64 `json:"latency_ms,omitempty"`
+	// SizeBytes is the size of the body read, which stops at one megabyte (Truncated)
+	SizeBytes int64 `json:"size_bytes"`
+	Truncated bool  `json:"truncated,omitempty"`
+	// TLSExpiresAt is when the certificate of an https service expires
+	TLSExpiresAt *time.Time `json:"tls_expires_at,omitempty"`
+	Matched      bool       `json:"matched"`
+	// StatusMatched and BodyMatched report the expectations one by one; BodyMatched is
+	// left out without an expected_body_substring
+	StatusMatched bool   `json:"status_matched"`
+	BodyMatched   *bool  `json:"body_matched,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// VerifyResult is the outcome of one verification check
+type VerifyResult struct {
+	Check      string  `json:"check"`
+	Target     string  `json:"target"`
+	Passed     bool    `json:"passed"`
+	Detail     string  `json:"detail,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+	// HTTPProbe is the full result of an http_probe check
+	HTTPProbe *HTTPProbeResult `json:"http_probe,omitempty"`
+}
+
+// ManifestSource points POST /packages at a manifest stored elsewhere instead of the inline YAML
+type ManifestSource struct {
+	URL    string `yaml:"source_url" json:"url"`
+	SHA256 string `yaml:"sha256" json:"sha256,omitempty"`
+	// SignatureURL is a minisign signature of the manifest, checked against the trusted keys
+	SignatureURL string `yaml:"signature_url" json:"signature_url,omitempty"`
+}
+
+// PackageApplyResult holds the output of applying a manifest
+type PackageApplyResult struct {
+	Install    CommandResult `json:"install"`
+	Uninstall  CommandResult `json:"uninstall"`
+	FailedStep string        `json:"failed_step,omitempty"` // "refresh", "install", "uninstall", "autoremove", or "remove" when a step failed
+	// Refresh is the output of updating the package lists, run first when update_cache is set
+	Refresh *CommandResult `json:"refresh,omitempty"`
+	// Autoremove is the output of the autoremove run last when autoremove is set, and
+	// Autoremoved the packages it removed
+	Autoremove  *CommandResult   `json:"autoremove,omitempty"`
+	Autoremoved []PackageOutcome `json:"autoremoved,omitempty"`
+	// Packages says what was done to each package of the manifest's lists
+	Packages []PackageOutcome `json:"packages,omitempty"`
+	// Steps run for the snaps and flatpaks sections
+	Steps    []PackageStep `json:"steps,omitempty"`
+	Warnings []string      `json:"warnings,omitempty"`
+	// Skipped lists the manifest entries that don't apply to this host
+	Skipped []SkippedEntry `json:"skipped,omitempty"`
+	// Verification holds the outcome of the manifest's verify checks
+	Verification []VerifyResult `json:"verification,omitempty"`
+}
+
+// Event is an entry of the host timeline. IDs increase by one with every event and
+// carry on across restarts, so clients can resume from the last one they saw.
+type Event struct {
+	ID   int64     `json:"id"`
+	Time time.Time `json:"time"`
+	// Type is a category and action, like job.finished or config.reload
+	Type    string                 `json:"type"`
+	Message string                 `json:"message"`
+	Outcome string                 `json:"outcome,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// ApplyPackagesResponse is the response of POST /packages
+type ApplyPackagesResponse struct {
+	JobID string `json:"job_id"`
+	// InstallOutput and UninstallOutput repeat Install.Output and Uninstall.Output
+	InstallOutput   string        `json:"install_output"`
+	UninstallOutput string        `json:"uninstall_output"`
+	Install         CommandResult `json:"install"`
+	Uninstall       CommandResult `json:"uninstall"`
+	// Packages says what was done to each package of the manifest's lists
+	Packages []PackageOutcome `json:"packages,omitempty"`
+	// LockWait is set when the transaction waited for another package manager
+	LockWait    *LockWait        `json:"lock_wait,omitempty"`
+	UpdateCache *CommandResult   `json:"update_cache,omitempty"`
+	Autoremove  *CommandResult   `json:"autoremove,omitempty"`
+	Autoremoved []PackageOutcome `json:"autoremoved,omitempty"`
+	Steps       []PackageStep    `json:"steps,omitempty"`
+	Warnings    []string         `json:"warnings,omitempty"`
+	Skipped     []SkippedEntry   `json:"skipped,omitempty"`
+	// Verification and Status are set for manifests with verify checks; Status is
+	// JobSucceeded or JobVerificationFailed
+	Verification []VerifyResult `json:"verification,omitempty"`
+	Status       string         `json:"status,omitempty"`
+	// EffectiveManifest is the merged manifest of a request with several YAML documents
+	EffectiveManifest interface{} `json:"effective_manifest,omitempty"`
+	// Source is the remote manifest that was applied, with its hash
+	Source *ManifestSource `json:"source,omitempty"`
+}
+
+// PackageList is the response of GET /packages
+type PackageList struct {
+	// InstalledPackages are the names of the system packages
+	InstalledPackages []string `json:"installed_packages,omitempty"`
+	// InstalledGroups, or GroupsWarning when they can't be listed, answer groups=true
+	InstalledGroups []string `json:"installed_groups,omitempty"`
+	GroupsWarning   string   `json:"groups_warning,omitempty"`
+	// Manager and Packages answer a request for the snap or flatpak packages alone
+	Manager  string             `json:"manager,omitempty"`
+	Packages []InstalledPackage `json:"packages,omitempty"`
+	// Snaps and Flatpaks are listed next to the system packages for manager=all
+	Snaps    []InstalledPackage `json:"snaps,omitempty"`
+	Flatpaks []InstalledPackage `json:"flatpaks,omitempty"`
+	Warnings []string           `json:"warnings,omitempty"`
+}
+
+// KubernetesStatus is the response of GET /kubernetes
+type KubernetesStatus struct {
+	Installed bool `json:"installed"`
+}
+
+// BootstrapResult is the response of POST /kubernetes
+type BootstrapResult struct {
+	JobID    string    `json:"job_id"`
+	Message  string    `json:"message"`
+	Output   string    `json:"output"`
+	Stdout   string    `json:"stdout"`
+	Stderr   string    `json:"stderr"`
+	LockWait *LockWait `json:"lock_wait,omitempty"`
+}
+
+// ErrorResponse is the body of the agent's error responses. Some carry more fields, like
+// the holders of a package_manager_busy error.
+type ErrorResponse struct {
+	Error string `json:"error"`
+	// Code is a stable identifier of the error, for the errors that have one
+	Code    string `json:"code,omitempty"`
+	Details string `json:"details,omitempty"`
+}
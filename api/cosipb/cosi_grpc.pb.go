@@ -0,0 +1,342 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: cosi.proto
+
+package cosipb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Cosi_GetOS_FullMethodName               = "/cosi.v1.Cosi/GetOS"
+	Cosi_GetUname_FullMethodName            = "/cosi.v1.Cosi/GetUname"
+	Cosi_ListPackages_FullMethodName        = "/cosi.v1.Cosi/ListPackages"
+	Cosi_ApplyPackages_FullMethodName       = "/cosi.v1.Cosi/ApplyPackages"
+	Cosi_GetKubernetesStatus_FullMethodName = "/cosi.v1.Cosi/GetKubernetesStatus"
+	Cosi_BootstrapKubernetes_FullMethodName = "/cosi.v1.Cosi/BootstrapKubernetes"
+)
+
+// CosiClient is the client API for Cosi service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Cosi is the gRPC API of the agent, served next to the REST endpoints when grpc.listen
+// is set. Each RPC does what the REST endpoint of the same name does. Calls carry one of
+// the agent's bearer tokens, with the grpc scope, in the authorization metadata.
+type CosiClient interface {
+	// GetOS returns the fields of the host's /etc/os-release, like GET /os
+	GetOS(ctx context.Context, in *GetOSRequest, opts ...grpc.CallOption) (*GetOSResponse, error)
+	// GetUname returns the output of uname by field, like GET /uname
+	GetUname(ctx context.Context, in *GetUnameRequest, opts ...grpc.CallOption) (*GetUnameResponse, error)
+	// ListPackages returns the installed packages, like GET /packages
+	ListPackages(ctx context.Context, in *ListPackagesRequest, opts ...grpc.CallOption) (*ListPackagesResponse, error)
+	// ApplyPackages applies a package manifest, like POST /packages, streaming the job's
+	// progress until the transaction is done
+	ApplyPackages(ctx context.Context, in *ApplyPackagesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[JobProgress], error)
+	// GetKubernetesStatus reports whether Kubernetes is installed, like GET /kubernetes
+	GetKubernetesStatus(ctx context.Context, in *GetKubernetesStatusRequest, opts ...grpc.CallOption) (*GetKubernetesStatusResponse, error)
+	// BootstrapKubernetes installs Kubernetes and bootstraps a cluster, like
+	// POST /kubernetes, streaming the job's progress until it is done
+	BootstrapKubernetes(ctx context.Context, in *BootstrapKubernetesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[JobProgress], error)
+}
+
+type cosiClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCosiClient(cc grpc.ClientConnInterface) CosiClient {
+	return &cosiClient{cc}
+}
+
+func (c *cosiClient) GetOS(ctx context.Context, in *GetOSRequest, opts ...grpc.CallOption) (*GetOSResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetOSResponse)
+	err := c.cc.Invoke(ctx, Cosi_GetOS_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cosiClient) GetUname(ctx context.Context, in *GetUnameRequest, opts ...grpc.CallOption) (*GetUnameResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetUnameResponse)
+	err := c.cc.Invoke(ctx, Cosi_GetUname_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cosiClient) ListPackages(ctx context.Context, in *ListPackagesRequest, opts ...grpc.CallOption) (*ListPackagesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListPackagesResponse)
+	err := c.cc.Invoke(ctx, Cosi_ListPackages_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cosiClient) ApplyPackages(ctx context.Context, in *ApplyPackagesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[JobProgress], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Cosi_ServiceDesc.Streams[0], Cosi_ApplyPackages_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ApplyPackagesRequest, JobProgress]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Cosi_ApplyPackagesClient = grpc.ServerStreamingClient[JobProgress]
+
+func (c *cosiClient) GetKubernetesStatus(ctx context.Context, in *GetKubernetesStatusRequest, opts ...grpc.CallOption) (*GetKubernetesStatusResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetKubernetesStatusResponse)
+	err := c.cc.Invoke(ctx, Cosi_GetKubernetesStatus_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cosiClient) BootstrapKubernetes(ctx context.Context, in *BootstrapKubernetesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[JobProgress], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Cosi_ServiceDesc.Streams[1], Cosi_BootstrapKubernetes_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[BootstrapKubernetesRequest, JobProgress]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Cosi_BootstrapKubernetesClient = grpc.ServerStreamingClient[JobProgress]
+
+// CosiServer is the server API for Cosi service.
+// All implementations must embed UnimplementedCosiServer
+// for forward compatibility.
+//
+// Cosi is the gRPC API of the agent, served next to the REST endpoints when grpc.listen
+// is set. Each RPC does what the REST endpoint of the same name does. Calls carry one of
+// the agent's bearer tokens, with the grpc scope, in the authorization metadata.
+type CosiServer interface {
+	// GetOS returns the fields of the host's /etc/os-release, like GET /os
+	GetOS(context.Context, *GetOSRequest) (*GetOSResponse, error)
+	// GetUname returns the output of uname by field, like GET /uname
+	GetUname(context.Context, *GetUnameRequest) (*GetUnameResponse, error)
+	// ListPackages returns the installed packages, like GET /packages
+	ListPackages(context.Context, *ListPackagesRequest) (*ListPackagesResponse, error)
+	// ApplyPackages applies a package manifest, like POST /packages, streaming the job's
+	// progress until the transaction is done
+	ApplyPackages(*ApplyPackagesRequest, grpc.ServerStreamingServer[JobProgress]) error
+	// GetKubernetesStatus reports whether Kubernetes is installed, like GET /kubernetes
+	GetKubernetesStatus(context.Context, *GetKubernetesStatusRequest) (*GetKubernetesStatusResponse, error)
+	// BootstrapKubernetes installs Kubernetes and bootstraps a cluster, like
+	// POST /kubernetes, streaming the job's progress until it is done
+	BootstrapKubernetes(*BootstrapKubernetesRequest, grpc.ServerStreamingServer[JobProgress]) error
+	mustEmbedUnimplementedCosiServer()
+}
+
+// UnimplementedCosiServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedCosiServer struct{}
+
+func (UnimplementedCosiServer) GetOS(context.Context, *GetOSRequest) (*GetOSResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetOS not implemented")
+}
+func (UnimplementedCosiServer) GetUname(context.Context, *GetUnameRequest) (*GetUnameResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUname not implemented")
+}
+func (UnimplementedCosiServer) ListPackages(context.Context, *ListPackagesRequest) (*ListPackagesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPackages not implemented")
+}
+func (UnimplementedCosiServer) ApplyPackages(*ApplyPackagesRequest, grpc.ServerStreamingServer[JobProgress]) error {
+	return status.Errorf(codes.Unimplemented, "method ApplyPackages not implemented")
+}
+func (UnimplementedCosiServer) GetKubernetesStatus(context.Context, *GetKubernetesStatusRequest) (*GetKubernetesStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetKubernetesStatus not implemented")
+}
+func (UnimplementedCosiServer) BootstrapKubernetes(*BootstrapKubernetesRequest, grpc.ServerStreamingServer[JobProgress]) error {
+	return status.Errorf(codes.Unimplemented, "method BootstrapKubernetes not implemented")
+}
+func (UnimplementedCosiServer) mustEmbedUnimplementedCosiServer() {}
+func (UnimplementedCosiServer) testEmbeddedByValue()              {}
+
+// UnsafeCosiServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CosiServer will
+// result in compilation errors.
+type UnsafeCosiServer interface {
+	mustEmbedUnimplementedCosiServer()
+}
+
+func RegisterCosiServer(s grpc.ServiceRegistrar, srv CosiServer) {
+	// If the following call pancis, it indicates UnimplementedCosiServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Cosi_ServiceDesc, srv)
+}
+
+func _Cosi_GetOS_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetOSRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CosiServer).GetOS(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cosi_GetOS_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CosiServer).GetOS(ctx, req.(*GetOSRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cosi_GetUname_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUnameRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CosiServer).GetUname(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cosi_GetUname_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CosiServer).GetUname(ctx, req.(*GetUnameRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cosi_ListPackages_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPackagesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CosiServer).ListPackages(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cosi_ListPackages_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CosiServer).ListPackages(ctx, req.(*ListPackagesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cosi_ApplyPackages_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ApplyPackagesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CosiServer).ApplyPackages(m, &grpc.GenericServerStream[ApplyPackagesRequest, JobProgress]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Cosi_ApplyPackagesServer = grpc.ServerStreamingServer[JobProgress]
+
+func _Cosi_GetKubernetesStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetKubernetesStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CosiServer).GetKubernetesStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cosi_GetKubernetesStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CosiServer).GetKubernetesStatus(ctx, req.(*GetKubernetesStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cosi_BootstrapKubernetes_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(BootstrapKubernetesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CosiServer).BootstrapKubernetes(m, &grpc.GenericServerStream[BootstrapKubernetesRequest, JobProgress]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Cosi_BootstrapKubernetesServer = grpc.ServerStreamingServer[JobProgress]
+
+// Cosi_ServiceDesc is the grpc.ServiceDesc for Cosi service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Cosi_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cosi.v1.Cosi",
+	HandlerType: (*CosiServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetOS",
+			Handler:    _Cosi_GetOS_Handler,
+		},
+		{
+			MethodName: "GetUname",
+			Handler:    _Cosi_GetUname_Handler,
+		},
+		{
+			MethodName: "ListPackages",
+			Handler:    _Cosi_ListPackages_Handler,
+		},
+		{
+			MethodName: "GetKubernetesStatus",
+			Handler:    _Cosi_GetKubernetesStatus_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ApplyPackages",
+			Handler:       _Cosi_ApplyPackages_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "BootstrapKubernetes",
+			Handler:       _Cosi_BootstrapKubernetes_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "cosi.proto",
+}
@@ -0,0 +1,4 @@
+// Package cosipb holds the gRPC API of the agent, generated from cosi.proto
+package cosipb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative cosi.proto
@@ -0,0 +1,61 @@
+// Package api holds the payloads the agent exchanges with a central controller and
+// serves to its clients, so the controller side and the client package import the
+// same types.
+package api
+
+import "time"
+
+// Registration is POSTed to <controller>/register when the agent starts
+type Registration struct {
+	Hostname      string `json:"hostname"`
+	MachineID     string `json:"machine_id"`
+	OS            OSInfo `json:"os"`
+	AgentVersion  string `json:"agent_version"`
+	ListenAddress string `json:"listen_address"`
+}
+
+// OSInfo is the summary of /etc/os-release sent with a registration
+type OSInfo struct {
+	ID         string `json:"id"`
+	VersionID  string `json:"version_id,omitempty"`
+	PrettyName string `json:"pretty_name,omitempty"`
+}
+
+// RegistrationResponse is the optional body the controller answers a registration with
+type RegistrationResponse struct {
+	// HeartbeatInterval overrides the configured heartbeat interval when set, e.g. "30s"
+	HeartbeatInterval string `json:"heartbeat_interval,omitempty"`
+}
+
+// Heartbeat is POSTed to <controller>/heartbeat periodically after registering
+type Heartbeat struct {
+	MachineID    string    `json:"machine_id"`
+	Hostname     string    `json:"hostname"`
+	AgentVersion string    `json:"agent_version"`
+	Timestamp    time.Time `json:"timestamp"`
+	Health       Health    `json:"health"`
+}
+
+// Health is the basic host health reported with every heartbeat
+type Health struct {
+	UptimeSeconds  int64       `json:"uptime_seconds"`
+	MemoryTotal    uint64      `json:"memory_total_bytes"`
+	MemoryAvail    uint64      `json:"memory_available_bytes"`
+	Disks          []DiskUsage `json:"disks"`
+	LastPackageJob *JobStatus  `json:"last_package_job,omitempty"`
+}
+
+// DiskUsage is the usage of one mounted filesystem
+type DiskUsage struct {
+	MountPoint string `json:"mount_point"`
+	TotalBytes uint64 `json:"total_bytes"`
+	FreeBytes  uint64 `json:"free_bytes"`
+}
+
+// JobStatus is the outcome of the most recent package job
+type JobStatus struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/rothgar/cosi/api"
+)
+
+// Remote flatpaks are installed from
+const flatpakRemote = "flathub"
+
+var (
+	snapName       = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+	snapChannel    = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+	flatpakRefName = regexp.MustCompile(`^[A-Za-z0-9_.-]+(/[A-Za-z0-9_.-]*){0,3}$`)
+)
+
+// AppSection lists the snaps or flatpaks a manifest installs and removes
+type AppSection struct {
+	Install []string `yaml:"install,omitempty" json:"install,omitempty"`
+	Remove  []string `yaml:"remove,omitempty" json:"remove,omitempty"`
+}
+
+// Helper function to check if the section has anything to do
+func (s AppSection) empty() bool {
+	return len(s.Install) == 0 && len(s.Remove) == 0
+}
+
+// InstalledPackage is a package reported by GET /packages with a manager other than the system one
+type InstalledPackage = api.InstalledPackage
+
+// PackageStep is the output of one snap or flatpak command run for a manifest
+type PackageStep = api.PackageStep
+
+// appManager installs self-contained application packages next to the system package manager
+type appManager interface {
+	Name() string
+	// Available reports whether the manager is installed and usable on this host
+	Available() bool
+	List(ctx context.Context) ([]InstalledPackage, error)
+	// Section returns the part of a manifest handled by this manager
+	Section(config PackageConfig) AppSection
+	InstallCommand(entry string) *exec.Cmd
+	RemoveCommand(entry string) *exec.Cmd
+	ValidateEntry(entry string) error
+}
+
+// Managers checked for GET /packages?manager=all and the snaps and flatpaks manifest sections
+var appManagers = []appManager{snapManager{}, flatpakManager{}}
+
+// Function to look up an app manager by name
+func appManagerNamed(name string) appManager {
+	for _, m := range appManagers {
+		if m.Name() == name {
+			return m
+		}
+	}
+	return nil
+}
+
+type snapManager struct{}
+
+func (snapManager) Name() string { return "snap" }
+
+func (snapManager) Available() bool {
+	if _, err := exec.LookPath("snap"); err != nil {
+		return false
+	}
+	_, err := os.Stat("/run/snapd.socket")
+	return err == nil
+}
+
+func (snapManager) Section(config PackageConfig) AppSection { return config.Snaps }
+
+// parseSnapEntry splits "name", "name/channel", "name/classic", or
+// "name/classic/channel"; channels may contain slashes themselves (latest/stable)
+func parseSnapEntry(entry string) (name, channel string, classic bool) {
+	name, rest, _ := strings.Cut(entry, "/")
+	if rest == "classic" || strings.HasPrefix(rest, "classic/") {
+		classic = true
+		rest = strings.TrimPrefix(strings.TrimPrefix(rest, "classic"), "/")
+	}
+	return name, rest, classic
+}
+
+func (snapManager) ValidateEntry(entry string) error {
+	name, channel, _ := parseSnapEntry(entry)
+	if !snapName.MatchString(name) || (channel != "" && !snapChannel.MatchString(channel)) {
+		return fmt.Errorf("invalid snap %q: expected name, name/channel, or name/classic/channel", entry)
+	}
+	return nil
+}
+
+func (snapManager) InstallCommand(entry string) *exec.Cmd {
+	name, channel, classic := parseSnapEntry(entry)
+	args := []string{"install", name}
+	if classic {
+		args = append(args, "--classic")
+	}
+	if channel != "" {
+		args = append(args, "--channel="+channel)
+	}
+	return newPrivilegedCommand(nil, "snap", args...)
+}
+
+func (snapManager) RemoveCommand(entry string) *exec.Cmd {
+	name, _, _ := parseSnapEntry(entry)
+	return newPrivilegedCommand(nil, "snap", "remove", name)
+}
+
+func (snapManager) List(ctx context.Context) ([]InstalledPackage, error) {
+	cmd := newCommand("snap", "list", "--unicode=never", "--color=never")
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: "snap", Result: result, Err: err}
+	}
+	return parseSnapList(result.Stdout), nil
+}
+
+// Function to parse the table printed by `snap list`:
+// Name  Version  Rev  Tracking  Publisher  Notes
+func parseSnapList(output string) []InstalledPackage {
+	packages := []InstalledPackage{}
+	for i, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) < 5 {
+			continue // header or "No snaps are installed yet"
+		}
+		pkg := InstalledPackage{
+			Name:      fields[0],
+			Manager:   "snap",
+			Version:   fields[1],
+			Revision:  fields[2],
+			Channel:   fields[3],
+			Publisher: strings.TrimRight(fields[4], "*✓"),
+		}
+		if pkg.Channel == "-" {
+			pkg.Channel = ""
+		}
+		if len(fields) > 5 && fields[5] != "-" {
+			pkg.Notes = fields[5]
+		}
+		packages = append(packages, pkg)
+	}
+	return packages
+}
+
+type flatpakManager struct{}
+
+func (flatpakManager) Name() string { return "flatpak" }
+
+func (flatpakManager) Available() bool {
+	_, err := exec.LookPath("flatpak")
+	return err == nil
+}
+
+func (flatpakManager) Section(config PackageConfig) AppSection { return config.Flatpaks }
+
+func (flatpakManager) ValidateEntry(entry string) error {
+	if !flatpakRefName.MatchString(entry) {
+		return fmt.Errorf("invalid flatpak %q: expected an application ID or ref", entry)
+	}
+	return nil
+}
+
+func (flatpakManager) InstallCommand(entry string) *exec.Cmd {
+	return newPrivilegedCommand(nil, "flatpak", "install", "-y", "--noninteractive", flatpakRemote, entry)
+}
+
+func (flatpakManager) RemoveCommand(entry string) *exec.Cmd {
+	return newPrivilegedCommand(nil, "flatpak", "uninstall", "-y", "--noninteractive", entry)
+}
+
+func (flatpakManager) List(ctx context.Context) ([]InstalledPackage, error) {
+	cmd := newCommand("flatpak", "list", "--columns=application,version,branch,arch,origin,ref")
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: "flatpak", Result: result, Err: err}
+	}
+	return parseFlatpakList(result.Stdout), nil
+}
+
+// Function to parse the tab separated output of `flatpak list --columns=...`
+func parseFlatpakList(output string) []InstalledPackage {
+	packages := []InstalledPackage{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 6 {
+			continue
+		}
+		packages = append(packages, InstalledPackage{
+			Name:    fields[0],
+			Manager: "flatpak",
+			Version: fields[1],
+			Channel: fields[2],
+			Arch:    fields[3],
+			Origin:  fields[4],
+			Ref:     fields[5],
+		})
+	}
+	return packages
+}
+
+// Helper function to check if a flatpak entry, an application ID or a ref, is installed
+func flatpakInstalled(installed []InstalledPackage, entry string) bool {
+	for _, pkg := range installed {
+		if pkg.Name == entry || pkg.Ref == entry || strings.HasPrefix(pkg.Ref, "app/"+entry+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to apply the snaps and flatpaks sections of a manifest. Hosts without a
+// manager skip its section with a warning instead of failing the request.
+func applyAppSections(config PackageConfig, result *PackageApplyResult, job *jobControl) error {
+	for _, manager := range appManagers {
+		section := manager.Section(config)
+		if section.empty() {
+			continue
+		}
+		if !manager.Available() {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s is not available on this host; skipped the %ss section", manager.Name(), manager.Name()))
+			continue
+		}
+
+		var installed []InstalledPackage
+		if manager.Name() == "flatpak" && len(section.Remove) > 0 {
+			// flatpak uninstall fails for refs that aren't installed, so those are skipped
+			var err error
+			if installed, err = manager.List(job.context()); err != nil {
+				return err
+			}
+		}
+
+		steps := []struct {
+			action  string
+			entries []string
+			command func(string) *exec.Cmd
+		}{
+			{"install", section.Install, manager.InstallCommand},
+			{"remove", section.Remove, manager.RemoveCommand},
+		}
+		for _, step := range steps {
+			for _, entry := range step.entries {
+				if step.action == "remove" && installed != nil && !flatpakInstalled(installed, entry) {
+					continue
+				}
+				cmd := step.command(entry)
+				output, err := runJobCommand(cmd, job)
+				result.Steps = append(result.Steps, PackageStep{Manager: manager.Name(), Action: step.action, Target: entry, Result: output})
+				if err != nil {
+					result.FailedStep = step.action
+					return &commandError{Tool: commandTool(cmd), Result: output, Err: err}
+				}
+			}
+		}
+	}
+	return nil
+}
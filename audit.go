@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Directory where the agent keeps state that survives restarts, set with --state-dir
+var stateDir = "/var/lib/cosi"
+
+// AuditEntry records one state-changing operation
+type AuditEntry struct {
+	Time    time.Time              `json:"time"`
+	Action  string                 `json:"action"`
+	Client  string                 `json:"client,omitempty"`
+	Outcome string                 `json:"outcome"` // requested, succeeded, or failed
+	Error   string                 `json:"error,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// auditLog appends entries as JSON lines to <state dir>/audit.log
+type auditLog struct {
+	mu sync.Mutex
+}
+
+var audit = &auditLog{}
+
+// Record appends an entry and syncs it to disk. Failures to write are returned
+// so callers can decide whether the operation may proceed unaudited. Every entry
+// also goes to the event history, which keeps its own copy.
+func (a *auditLog) Record(entry AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	entry.Error = redactText(entry.Error)
+	entry.Details = redactDetails(entry.Details)
+	events.Emit(auditEvent(entry))
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(stateDir, "audit.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Helper function to describe an audit entry as an event
+func auditEvent(entry AuditEntry) Event {
+	event := Event{Time: entry.Time, Type: entry.Action, Message: entry.Action + " " + entry.Outcome, Outcome: entry.Outcome, Details: map[string]interface{}{}}
+	for k, v := range entry.Details {
+		event.Details[k] = v
+	}
+	if entry.Client != "" {
+		event.Message += " for " + entry.Client
+		event.Details["client"] = entry.Client
+	}
+	if entry.Error != "" {
+		event.Details["error"] = entry.Error
+	}
+	return event
+}
+
+// Helper function to build an audit entry from the outcome of an operation
+func auditOutcome(action, client string, details map[string]interface{}, err error) AuditEntry {
+	entry := AuditEntry{Action: action, Client: client, Outcome: "succeeded", Details: details}
+	if err != nil {
+		entry.Outcome = "failed"
+		entry.Error = err.Error()
+	}
+	return entry
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scope that grants every other scope
+const scopeAdmin = "admin"
+
+// AuthConfig lists the bearer tokens accepted by endpoints that require a scope
+type AuthConfig struct {
+	Tokens []TokenConfig `yaml:"tokens"`
+	// HMAC accepts requests signed with a token's secret instead of bearing it
+	HMAC HMACConfig `yaml:"hmac"`
+}
+
+// TokenConfig is one bearer token and the scopes it grants
+type TokenConfig struct {
+	Name   string   `yaml:"name"`
+	Token  string   `yaml:"token"`
+	Scopes []string `yaml:"scopes"`
+}
+
+// Function to validate a token entry
+func (t TokenConfig) validate() error {
+	if t.Name == "" || t.Token == "" {
+		return fmt.Errorf("auth tokens need a name and a token")
+	}
+	if len(t.Scopes) == 0 {
+		return fmt.Errorf("auth token %q has no scopes", t.Name)
+	}
+	return nil
+}
+
+// Helper function to check if a token grants a scope
+func (t TokenConfig) allows(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to find the configured token that signed the request, or else the one
+// matching its Authorization header
+func authenticate(c *gin.Context) (*TokenConfig, bool) {
+	if signed, ok := c.Get("signed_token"); ok {
+		return signed.(*TokenConfig), true
+	}
+	return bearerToken(c.GetHeader("Authorization"))
+}
+
+// Function to find the configured token an Authorization header value bears
+func bearerToken(authorization string) (*TokenConfig, bool) {
+	presented, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok || presented == "" {
+		return nil, false
+	}
+	tokens := currentConfig().Auth.Tokens
+	for i := range tokens {
+		token := &tokens[i]
+		if subtle.ConstantTimeCompare([]byte(token.Token), []byte(presented)) == 1 {
+			return token, true
+		}
+	}
+	return nil, false
+}
+
+// Function to build middleware that only lets requests through with a token granting scope.
+// Without any configured tokens the endpoints behind it can't be reached at all.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authorizeScope(c, scope) {
+			c.Next()
+		}
+	}
+}
+
+// Function to check that the request bears a token granting scope, aborting it with the
+// error response otherwise. Handlers that only need a scope for some requests call it directly.
+func authorizeScope(c *gin.Context, scope string) bool {
+	if len(currentConfig().Auth.Tokens) == 0 {
+		c.AbortWithStatusJSON(403, gin.H{"error": "Authentication is not configured; add tokens to the auth section of the config", "code": "auth_not_configured"})
+		return false
+	}
+	token, ok := authenticate(c)
+	if !ok {
+		events.Emit(Event{Type: "auth.failure", Message: "rejected a request without a valid token", Outcome: "failed", Details: map[string]interface{}{"client": c.ClientIP(), "method": c.Request.Method, "path": c.Request.URL.Path}})
+		c.Header("WWW-Authenticate", `Bearer realm="cosi"`)
+		c.AbortWithStatusJSON(401, gin.H{"error": "A valid bearer token is required", "code": "unauthorized"})
+		return false
+	}
+	if !token.allows(scope) {
+		events.Emit(Event{Type: "auth.failure", Message: fmt.Sprintf("token %q lacks the %q scope", token.Name, scope), Outcome: "failed", Details: map[string]interface{}{"client": c.ClientIP(), "method": c.Request.Method, "path": c.Request.URL.Path, "token_name": token.Name}})
+		c.AbortWithStatusJSON(403, gin.H{"error": fmt.Sprintf("Token %q lacks the %q scope", token.Name, scope), "code": "insufficient_scope"})
+		return false
+	}
+	c.Set("token_name", token.Name)
+	return true
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+const (
+	// Most operations one batch may run
+	maxBatchOperations = 50
+	// Time a whole batch and each of its operations get unless the request says otherwise,
+	// and the most a request may ask for
+	defaultBatchTimeout     = time.Hour
+	defaultBatchItemTimeout = 30 * time.Minute
+	maxBatchTimeout         = 6 * time.Hour
+	// How often a running operation is checked for a cancelled batch
+	batchPollInterval = 250 * time.Millisecond
+)
+
+// States of one operation in a batch report
+const (
+	batchPending   = "pending"
+	batchRunning   = "running"
+	batchSucceeded = "succeeded"
+	batchFailed    = "failed"
+	batchSkipped   = "skipped"
+)
+
+// BatchRequest is the body of POST /batch
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations" binding:"required"`
+	// ContinueOnError runs the remaining operations after one fails instead of skipping them
+	ContinueOnError bool `json:"continue_on_error"`
+	// TimeoutSeconds bounds the whole batch and ItemTimeoutSeconds each operation
+	TimeoutSeconds     int `json:"timeout_seconds"`
+	ItemTimeoutSeconds int `json:"item_timeout_seconds"`
+	// WaitForLockSeconds is how long package operations wait for another package manager
+	WaitForLockSeconds int `json:"wait_for_lock_seconds"`
+}
+
+// BatchOperation is one operation of a batch: its name, like packages.apply, and the
+// body its endpoint takes, as JSON
+type BatchOperation struct {
+	Op   string          `json:"op" binding:"required"`
+	Body json.RawMessage `json:"body"`
+}
+
+// BatchItem is the outcome of one operation of a batch
+type BatchItem struct {
+	Index int    `json:"index"`
+	Op    string `json:"op"`
+	// Status is pending, running, succeeded, failed, or skipped once an earlier operation
+	// failed or the batch was cancelled or ran out of time
+	Status     string     `json:"status"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	DurationMS int64      `json:"duration_ms,omitempty"`
+	// JobID is the job the operation ran as, and OutputURL where its output is served
+	JobID     string `json:"job_id,omitempty"`
+	OutputURL string `json:"output_url,omitempty"`
+	// Result is the response of the operation's endpoint
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	Code   string      `json:"code,omitempty"`
+	// Failure is the response the operation's endpoint fails with
+	Failure gin.H `json:"failure,omitempty"`
+}
+
+// BatchReport is the result of a batch job, updated as its operations run
+type BatchReport struct {
+	// Status is running while operations are pending, then succeeded when every operation
+	// succeeded, failed when none did, and partial otherwise
+	Status          string      `json:"status"`
+	ContinueOnError bool        `json:"continue_on_error"`
+	Succeeded       int         `json:"succeeded"`
+	Failed          int         `json:"failed"`
+	Skipped         int         `json:"skipped"`
+	Pending         int         `json:"pending"`
+	Items           []BatchItem `json:"items"`
+}
+
+// Helper function to count the operations by status and derive the report's status
+func (r *BatchReport) tally() {
+	r.Succeeded, r.Failed, r.Skipped, r.Pending = 0, 0, 0, 0
+	for _, item := range r.Items {
+		switch item.Status {
+		case batchPending, batchRunning:
+			r.Pending++
+		case batchSucceeded:
+			r.Succeeded++
+		case batchSkipped:
+			r.Skipped++
+		default:
+			r.Failed++
+		}
+	}
+	switch {
+	case r.Pending > 0:
+		r.Status = jobRunning
+	case r.Failed == 0 && r.Skipped == 0:
+		r.Status = batchSucceeded
+	case r.Succeeded == 0:
+		r.Status = batchFailed
+	default:
+		r.Status = "partial"
+	}
+}
+
+// Helper function to return a copy of the report that later updates don't change
+func (r *BatchReport) copy() *BatchReport {
+	copied := *r
+	copied.Items = append([]BatchItem(nil), r.Items...)
+	return &copied
+}
+
+// batchFailureError reports a batch in which some or all operations failed or were skipped
+type batchFailureError struct {
+	Succeeded, Total int
+}
+
+func (e *batchFailureError) Error() string {
+	return fmt.Sprintf("%d of %d operations did not succeed", e.Total-e.Succeeded, e.Total)
+}
+
+// batchRun runs a prepared operation of a batch. started is called with the job of
+// operations that run as jobs as soon as it exists.
+type batchRun func(ctx context.Context, started func(*Job)) (interface{}, error)
+
+// batchOperation checks the body of an operation when the batch is submitted and returns
+// the function that runs it. client is who submitted the batch, for the audit log.
+type batchOperation func(body json.RawMessage, client string, lockWait time.Duration) (batchRun, error)
+
+// Operations a batch may run, by name. Each does what its endpoint does.
+var batchOperations = map[string]batchOperation{
+	"packages.apply":       prepareBatchApply,
+	"packages.repair":      prepareBatchRepair,
+	"kubernetes.bootstrap": prepareBatchBootstrap,
+	"files.write":          prepareBatchFileWrite,
+	"ssh.keys.add":         prepareBatchSSHKey,
+	"firewall.open_port":   prepareBatchFirewallRule,
+}
+
+// Scopes the batch's token needs for operations whose endpoint requires one
+var batchOperationScopes = map[string]string{
+	"files.write":  scopeFiles,
+	"ssh.keys.add": scopeSSH,
+}
+
+// Helper function to decode the body of an operation like its endpoint binds it
+func bindBatchBody(body json.RawMessage, obj interface{}) error {
+	if len(body) == 0 {
+		body = json.RawMessage("{}")
+	}
+	if err := binding.JSON.BindBody(body, obj); err != nil {
+		return &requestError{Status: 400, Code: "invalid_body", Message: "Invalid request format: " + err.Error()}
+	}
+	return nil
+}
+
+// Function to prepare a packages.apply operation. The body is the manifest as JSON, or a
+// string holding the YAML POST /packages takes.
+func prepareBatchApply(body json.RawMessage, client string, lockWait time.Duration) (batchRun, error) {
+	manifest := []byte(body)
+	var text string
+	if err := json.Unmarshal(body, &text); err == nil {
+		manifest = []byte(text)
+	}
+	data, err := readManifestBody(bytes.NewReader(manifest))
+	if err != nil {
+		return nil, &requestError{Status: 400, Message: "Unable to read manifest: " + err.Error()}
+	}
+	packageConfig, source, err := loadManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, started func(*Job)) (interface{}, error) {
+		response, _, err := applyManifestJob(ctx, packageConfig, source, lockWait, started)
+		if err != nil {
+			return nil, err
+		}
+		if response.Status == jobVerificationFailed {
+			return response, &requestError{Status: 422, Code: "verification_failed", Message: "The packages were applied but failed verification"}
+		}
+		return response, nil
+	}, nil
+}
+
+// Function to prepare a packages.repair operation, which takes no body
+func prepareBatchRepair(body json.RawMessage, client string, lockWait time.Duration) (batchRun, error) {
+	return func(ctx context.Context, started func(*Job)) (interface{}, error) {
+		steps, job, err := repairPackagesJob(ctx, started)
+		if err != nil {
+			return nil, err
+		}
+		return gin.H{"job_id": job.ID, "steps": steps}, nil
+	}, nil
+}
+
+// Function to prepare a kubernetes.bootstrap operation, which takes no body
+func prepareBatchBootstrap(body json.RawMessage, client string, lockWait time.Duration) (batchRun, error) {
+	return func(ctx context.Context, started func(*Job)) (interface{}, error) {
+		result, _, err := bootstrapKubernetesJob(ctx, lockWait, started)
+		if err != nil {
+			return nil, err
+		}
+		return result, nil
+	}, nil
+}
+
+// Function to prepare a files.write operation, with the body of PUT /files
+func prepareBatchFileWrite(body json.RawMessage, client string, lockWait time.Duration) (batchRun, error) {
+	var request FileWriteRequest
+	if err := bindBatchBody(body, &request); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, started func(*Job)) (interface{}, error) {
+		result, err := writeFile(request, client)
+		if err != nil {
+			return nil, err
+		}
+		return result, nil
+	}, nil
+}
+
+// Function to prepare an ssh.keys.add operation, with the body of POST /ssh/keys
+func prepareBatchSSHKey(body json.RawMessage, client string, lockWait time.Duration) (batchRun, error) {
+	var request SSHKeyRequest
+	if err := bindBatchBody(body, &request); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, started func(*Job)) (interface{}, error) {
+		change, err := addSSHKey(request, client)
+		if err != nil {
+			return nil, err
+		}
+		return change, nil
+	}, nil
+}
+
+// Function to prepare a firewall.open_port operation, with the body of POST /firewall/rules
+func prepareBatchFirewallRule(body json.RawMessage, client string, lockWait time.Duration) (batchRun, error) {
+	var request FirewallRuleRequest
+	if err := bindBatchBody(body, &request); err != nil {
+		return nil, err
+	}
+	if err := request.validate(); err != nil {
+		return nil, &requestError{Status: 400, Message: err.Error()}
+	}
+	return func(ctx context.Context, started func(*Job)) (interface{}, error) {
+		response, err := openFirewallPort(request, client)
+		if err != nil {
+			return nil, err
+		}
+		return response, nil
+	}, nil
+}
+
+// Helper function to read a duration in seconds from a batch request, defaulting when zero
+func batchSeconds(name string, seconds int, fallback, max time.Duration) (time.Duration, error) {
+	if seconds == 0 {
+		return fallback, nil
+	}
+	duration := time.Duration(seconds) * time.Second
+	if seconds < 0 || duration > max {
+		return 0, &requestError{Status: 400, Code: "invalid_parameter", Message: fmt.Sprintf("%s must be a number of seconds up to %d", name, int(max.Seconds()))}
+	}
+	return duration, nil
+}
+
+// Helper function to list the operations a batch may run
+func batchOperationNames() []string {
+	names := make([]string, 0, len(batchOperations))
+	for name := range batchOperations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Function to check a batch request and prepare its operations, so a batch with a bad
+// operation is refused before anything runs
+func prepareBatch(request BatchRequest, client string) ([]batchRun, time.Duration, time.Duration, error) {
+	if len(request.Operations) == 0 {
+		return nil, 0, 0, &requestError{Status: 400, Message: "operations must list at least one operation"}
+	}
+	if len(request.Operations) > maxBatchOperations {
+		return nil, 0, 0, &requestError{Status: 400, Code: "too_many_operations", Message: fmt.Sprintf("a batch may run at most %d operations", maxBatchOperations)}
+	}
+	timeout, err := batchSeconds("timeout_seconds", request.TimeoutSeconds, defaultBatchTimeout, maxBatchTimeout)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	itemTimeout, err := batchSeconds("item_timeout_seconds", request.ItemTimeoutSeconds, defaultBatchItemTimeout, maxBatchTimeout)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	lockWait, err := batchSeconds("wait_for_lock_seconds", request.WaitForLockSeconds, 0, maxLockWait)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	runs := make([]batchRun, len(request.Operations))
+	for i, operation := range request.Operations {
+		prepare, ok := batchOperations[operation.Op]
+		if !ok {
+			return nil, 0, 0, &responseError{400, gin.H{
+				"error":      fmt.Sprintf("operations[%d]: unknown batch operation %q", i, operation.Op),
+				"code":       "unknown_operation",
+				"index":      i,
+				"operations": batchOperationNames(),
+			}}
+		}
+		if runs[i], err = prepare(operation.Body, client, lockWait); err != nil {
+			status, response := failureResponse("Invalid operation", err)
+			response["error"] = fmt.Sprintf("operations[%d] (%s): %v", i, operation.Op, response["error"])
+			response["index"] = i
+			return nil, 0, 0, &responseError{status, response}
+		}
+	}
+	return runs, timeout, itemTimeout, nil
+}
+
+// Function to run the operations of a batch job one after the other, holding packageLock
+// throughout so no other package transaction runs in between. The report is updated as
+// each operation starts and finishes.
+func runBatch(job *Job, request BatchRequest, runs []batchRun, timeout, itemTimeout time.Duration) {
+	report := &BatchReport{ContinueOnError: request.ContinueOnError, Items: make([]BatchItem, len(runs))}
+	for i, operation := range request.Operations {
+		report.Items[i] = BatchItem{Index: i, Op: operation.Op, Status: batchPending}
+	}
+	report.tally()
+	jobs.SetResult(job, report.copy())
+
+	packageLock.Lock()
+	defer packageLock.Unlock()
+	if !jobs.Start(job) {
+		return
+	}
+	control := jobs.Control(job)
+	defer control.Close()
+	cancelled := func() bool {
+		cancelled, _ := control.state()
+		return cancelled
+	}
+	ctx := context.WithValue(control.context(), packageLockHeld{}, true)
+	deadline := time.Now().Add(timeout)
+
+	stopped := ""
+	for i, run := range runs {
+		item := &report.Items[i]
+		switch {
+		case stopped == "" && cancelled():
+			stopped = "the batch was cancelled"
+		case stopped == "" && !time.Now().Before(deadline):
+			stopped = "the batch ran out of time"
+		}
+		if stopped != "" {
+			item.Status, item.Error = batchSkipped, "skipped: "+stopped
+			continue
+		}
+
+		itemDeadline := time.Now().Add(itemTimeout)
+		if deadline.Before(itemDeadline) {
+			itemDeadline = deadline
+		}
+		started := time.Now().UTC()
+		item.Status, item.StartedAt = batchRunning, &started
+		report.tally()
+		jobs.SetResult(job, report.copy())
+		fmt.Fprintf(control, "==> [%d/%d] %s\n", i+1, len(runs), item.Op)
+
+		result, timedOut, err := runBatchItem(ctx, run, itemDeadline, cancelled, func(id string) {
+			item.JobID, item.OutputURL = id, "/jobs/"+id+"/output"
+			jobs.SetResult(job, report.copy())
+		})
+		finished := time.Now().UTC()
+		item.FinishedAt, item.DurationMS = &finished, finished.Sub(started).Milliseconds()
+		item.Result = result
+		if err == nil {
+			item.Status = batchSucceeded
+			fmt.Fprintf(control, "    succeeded in %s\n", finished.Sub(started).Round(time.Millisecond))
+		} else {
+			_, response := failureResponse("Failed to run "+item.Op, err)
+			if timedOut {
+				response["error"] = fmt.Sprintf("timed out after %s: %v", itemDeadline.Sub(started).Round(time.Second), response["error"])
+				response["code"] = "operation_timed_out"
+			}
+			item.Status, item.Failure = batchFailed, response
+			item.Error, _ = response["error"].(string)
+			item.Code, _ = response["code"].(string)
+			fmt.Fprintf(control, "    failed: %s\n", item.Error)
+			if !request.ContinueOnError {
+				stopped = fmt.Sprintf("operation %d (%s) failed", i, item.Op)
+			}
+		}
+		report.tally()
+		jobs.SetResult(job, report.copy())
+	}
+
+	report.tally()
+	var err error
+	if report.Succeeded < len(report.Items) {
+		err = &batchFailureError{Succeeded: report.Succeeded, Total: len(report.Items)}
+	}
+	jobs.Finish(job, report, fmt.Sprintf("batch of %d operations", len(runs)), err)
+}
+
+// Helper function to run one operation of a batch until it returns. When the operation
+// runs as a job, that job is cancelled once the deadline passes or the batch is
+// cancelled; other operations are quick and always run to the end. jobStarted is
+// called with the ID of the operation's job.
+func runBatchItem(ctx context.Context, run batchRun, deadline time.Time, cancelled func() bool, jobStarted func(string)) (interface{}, bool, error) {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	var result interface{}
+	var err error
+	ids := make(chan string, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result, err = run(ctx, func(job *Job) { ids <- job.ID })
+	}()
+
+	ticker := time.NewTicker(batchPollInterval)
+	defer ticker.Stop()
+	expired := ctx.Done()
+	jobID, timedOut, stopping := "", false, false
+	stop := func() {
+		if jobID != "" && !stopping {
+			stopping = true
+			jobs.Cancel(jobID)
+		}
+	}
+	for {
+		select {
+		case <-done:
+			return result, timedOut, err
+		case id := <-ids:
+			jobID = id
+			jobStarted(id)
+			if timedOut || cancelled() {
+				stop()
+			}
+		case <-expired:
+			expired, timedOut = nil, true
+			stop()
+		case <-ticker.C:
+			if cancelled() {
+				stop()
+			}
+		}
+	}
+}
+
+// Function to register the /batch endpoint
+func registerBatchRoutes(r *gin.Engine) {
+	// Define the /batch endpoint that runs a list of operations in order as one job,
+	// holding the package lock for its whole duration. The operations are checked before
+	// anything runs; the job's result reports each one as it finishes.
+	r.POST("/batch", func(c *gin.Context) {
+		var request BatchRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format: " + err.Error(), "operations": batchOperationNames()})
+			return
+		}
+		for _, operation := range request.Operations {
+			if scope, ok := batchOperationScopes[operation.Op]; ok && !authorizeScope(c, scope) {
+				return
+			}
+		}
+		runs, timeout, itemTimeout, err := prepareBatch(request, c.ClientIP())
+		if err != nil {
+			respondFailure(c, "Invalid batch", err)
+			return
+		}
+
+		ops := make([]string, len(request.Operations))
+		for i, operation := range request.Operations {
+			ops[i] = operation.Op
+		}
+		// The batch job outlives the request that started it
+		job := jobs.New(c.Request.Context(), "batch")
+		audit.Record(auditOutcome("batch", c.ClientIP(), map[string]interface{}{"job_id": job.ID, "operations": ops, "continue_on_error": request.ContinueOnError}, nil))
+		go runBatch(job, request, runs, timeout, itemTimeout)
+		c.Header("X-Cosi-Job-Id", job.ID)
+		c.JSON(202, gin.H{"job_id": job.ID, "status_url": "/jobs/" + job.ID, "operations": ops})
+	})
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Slowest units GET /boot/analyze lists unless limit asks for another number
+const defaultBlameLimit = 10
+
+var (
+	// A stage of `systemd-analyze time`, like "4.567s (firmware)"
+	bootStage = regexp.MustCompile(`([0-9][0-9a-zµ. ]*?) \((\w+)\)`)
+	// The duration after "=" in `systemd-analyze time`
+	bootTotal = regexp.MustCompile(`= ([0-9][0-9a-zµ. ]*)`)
+	// One value and unit of a systemd timespan
+	timespanPart = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)(y|month|w|d|h|min|s|ms|us|µs)$`)
+)
+
+// Units of the timespans systemd prints, as in format_timespan()
+var timespanUnits = map[string]time.Duration{
+	"y":     31557600 * time.Second,
+	"month": 2629800 * time.Second,
+	"w":     7 * 24 * time.Hour,
+	"d":     24 * time.Hour,
+	"h":     time.Hour,
+	"min":   time.Minute,
+	"s":     time.Second,
+	"ms":    time.Millisecond,
+	"us":    time.Microsecond,
+	"µs":    time.Microsecond,
+}
+
+// Function to parse a timespan as systemd prints it, like "1min 31.459s" or "812ms"
+func parseTimespan(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, fmt.Errorf("empty timespan")
+	}
+	var total time.Duration
+	for _, part := range strings.Fields(value) {
+		match := timespanPart.FindStringSubmatch(part)
+		if match == nil {
+			return 0, fmt.Errorf("invalid timespan %q", value)
+		}
+		amount, err := strconv.ParseFloat(match[1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timespan %q", value)
+		}
+		total += time.Duration(amount * float64(timespanUnits[match[2]]))
+	}
+	return total, nil
+}
+
+// BootTimes is the boot time of each stage from `systemd-analyze time`, in milliseconds.
+// Stages the machine doesn't report, like firmware on VMs, are left out.
+type BootTimes struct {
+	FirmwareMS  *int64 `json:"firmware_ms,omitempty"`
+	LoaderMS    *int64 `json:"loader_ms,omitempty"`
+	KernelMS    *int64 `json:"kernel_ms,omitempty"`
+	InitrdMS    *int64 `json:"initrd_ms,omitempty"`
+	UserspaceMS *int64 `json:"userspace_ms,omitempty"`
+	TotalMS     int64  `json:"total_ms"`
+	// Target is the default target and TargetMS when it was reached in userspace
+	Target   string `json:"target,omitempty"`
+	TargetMS *int64 `json:"target_ms,omitempty"`
+}
+
+// UnitBlame is the time one unit took to start
+type UnitBlame struct {
+	Unit string `json:"unit"`
+	MS   int64  `json:"ms"`
+}
+
+// ChainUnit is one unit of the critical chain, from the default target down
+type ChainUnit struct {
+	Unit string `json:"unit"`
+	// ActivatedMS is when the unit became active, relative to the start of userspace
+	ActivatedMS *int64 `json:"activated_ms,omitempty"`
+	// StartMS is how long the unit took to start, for units that took any time
+	StartMS *int64 `json:"start_ms,omitempty"`
+}
+
+// BootAnalysis is the response of GET /boot/analyze
+type BootAnalysis struct {
+	// Booting is set while systemd is still starting units; the sections it can't
+	// report yet are left out
+	Booting       bool        `json:"booting"`
+	Times         *BootTimes  `json:"times,omitempty"`
+	Slowest       []UnitBlame `json:"slowest"`
+	CriticalChain []ChainUnit `json:"critical_chain"`
+}
+
+// Helper function to run systemd-analyze. It reports whether the command only failed
+// because the boot hasn't finished.
+func systemdAnalyze(ctx context.Context, args ...string) (string, bool, error) {
+	cmd := newCommand("systemd-analyze", args...)
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		if strings.Contains(result.Output, "Bootup is not yet finished") {
+			return "", true, nil
+		}
+		return "", false, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	return result.Stdout, false, nil
+}
+
+// Function to analyze how long the last boot took, listing the limit slowest units
+func analyzeBoot(ctx context.Context, limit int) (*BootAnalysis, error) {
+	analysis := &BootAnalysis{Slowest: []UnitBlame{}, CriticalChain: []ChainUnit{}}
+
+	output, booting, err := systemdAnalyze(ctx, "time")
+	if err != nil {
+		return nil, err
+	}
+	analysis.Booting = booting
+	if !booting {
+		if analysis.Times, err = parseBootTimes(output); err != nil {
+			return nil, err
+		}
+	}
+
+	// blame lists the units started so far even during boot
+	output, booting, err = systemdAnalyze(ctx, "blame", "--no-pager")
+	if err != nil {
+		return nil, err
+	}
+	if !booting {
+		analysis.Slowest = parseBlame(output, limit)
+	}
+
+	output, booting, err = systemdAnalyze(ctx, "critical-chain", "--no-pager")
+	if err != nil {
+		return nil, err
+	}
+	if !booting {
+		analysis.CriticalChain = parseCriticalChain(output)
+	}
+	return analysis, nil
+}
+
+// Function to parse `systemd-analyze time`, e.g.
+//
+//	Startup finished in 2.4s (kernel) + 3.1s (initrd) + 1min 2.5s (userspace) = 1min 8.0s
+//	graphical.target reached after 1min 2.4s in userspace.
+func parseBootTimes(output string) (*BootTimes, error) {
+	times := &BootTimes{}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	first := lines[0]
+	stages := map[string]**int64{
+		"firmware":  &times.FirmwareMS,
+		"loader":    &times.LoaderMS,
+		"kernel":    &times.KernelMS,
+		"initrd":    &times.InitrdMS,
+		"userspace": &times.UserspaceMS,
+	}
+	before, _, _ := strings.Cut(first, "=")
+	for _, match := range bootStage.FindAllStringSubmatch(before, -1) {
+		field, ok := stages[match[2]]
+		if !ok {
+			continue
+		}
+		duration, err := parseTimespan(match[1])
+		if err != nil {
+			return nil, err
+		}
+		ms := duration.Milliseconds()
+		*field = &ms
+	}
+
+	match := bootTotal.FindStringSubmatch(first)
+	if match == nil {
+		return nil, fmt.Errorf("unexpected systemd-analyze time output: %q", first)
+	}
+	total, err := parseTimespan(match[1])
+	if err != nil {
+		return nil, err
+	}
+	times.TotalMS = total.Milliseconds()
+
+	for _, line := range lines[1:] {
+		target, after, ok := strings.Cut(strings.TrimSpace(line), " reached after ")
+		if !ok {
+			continue
+		}
+		// Older systemd doesn't end the line with a period
+		after = strings.TrimSuffix(strings.TrimSuffix(after, "."), " in userspace")
+		if duration, err := parseTimespan(after); err == nil {
+			ms := duration.Milliseconds()
+			times.Target, times.TargetMS = target, &ms
+		}
+	}
+	return times, nil
+}
+
+// Function to parse `systemd-analyze blame`, whose lines are a timespan and a unit, slowest
+// first. At most limit units are returned.
+func parseBlame(output string, limit int) []UnitBlame {
+	blame := []UnitBlame{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// The timespan can be several fields, like "1min 31.459s"
+		unit := fields[len(fields)-1]
+		duration, err := parseTimespan(strings.Join(fields[:len(fields)-1], " "))
+		if err != nil {
+			continue
+		}
+		blame = append(blame, UnitBlame{Unit: unit, MS: duration.Milliseconds()})
+	}
+	sort.SliceStable(blame, func(i, j int) bool { return blame[i].MS > blame[j].MS })
+	if limit > 0 && len(blame) > limit {
+		blame = blame[:limit]
+	}
+	return blame
+}
+
+// Function to parse `systemd-analyze critical-chain`, whose tree lines look like
+//
+//	└─docker.service @8.1s +4.2s
+func parseCriticalChain(output string) []ChainUnit {
+	chain := []ChainUnit{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimLeft(line, " │├└─")
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.Contains(fields[0], ".") || strings.HasPrefix(line, "The time") {
+			continue
+		}
+		unit := ChainUnit{Unit: fields[0]}
+		// Timespans can span fields, so each one runs up to the next marker
+		var current **int64
+		var parts []string
+		flush := func() {
+			if current == nil || len(parts) == 0 {
+				return
+			}
+			if duration, err := parseTimespan(strings.Join(parts, " ")); err == nil {
+				ms := duration.Milliseconds()
+				*current = &ms
+			}
+		}
+		for _, field := range fields[1:] {
+			switch {
+			case strings.HasPrefix(field, "@"):
+				flush()
+				current, parts = &unit.ActivatedMS, []string{strings.TrimPrefix(field, "@")}
+			case strings.HasPrefix(field, "+"):
+				flush()
+				current, parts = &unit.StartMS, []string{strings.TrimPrefix(field, "+")}
+			default:
+				parts = append(parts, field)
+			}
+		}
+		flush()
+		chain = append(chain, unit)
+	}
+	return chain
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Helper function to point at a millisecond value
+func ms(value int64) *int64 { return &value }
+
+// Helper function to show values with pointer fields in failures
+func toJSON(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func TestParseTimespan(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"1min 31.459s", time.Minute + 31459*time.Millisecond},
+		{"812ms", 812 * time.Millisecond},
+		{"23.977ms", 23977 * time.Microsecond},
+		{"911us", 911 * time.Microsecond},
+		{"57µs", 57 * time.Microsecond},
+		{" 4.112s ", 4112 * time.Millisecond},
+		{"2h 5min 3s", 2*time.Hour + 5*time.Minute + 3*time.Second},
+		{"1d 3h", 27 * time.Hour},
+		{"1w", 7 * 24 * time.Hour},
+		{"1y 2month", 31557600*time.Second + 2*2629800*time.Second},
+	}
+	for _, tt := range tests {
+		got, err := parseTimespan(tt.value)
+		// Fractions of a second may be off by rounding, but never by a microsecond
+		if err != nil || (got-tt.want).Abs() >= time.Microsecond {
+			t.Errorf("parseTimespan(%q) = %v, %v, want %v", tt.value, got, err, tt.want)
+		}
+	}
+
+	for _, value := range []string{"", "   ", "5", "5 s", "1.2.3s", "-1s", "3 parsecs", "1min31s", "12m"} {
+		if got, err := parseTimespan(value); err == nil {
+			t.Errorf("parseTimespan(%q) = %v, want an error", value, got)
+		}
+	}
+}
+
+func TestParseBootTimes(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    *BootTimes
+	}{
+		{"time.txt", &BootTimes{
+			FirmwareMS:  ms(4567),
+			LoaderMS:    ms(2081),
+			KernelMS:    ms(1932),
+			InitrdMS:    ms(3104),
+			UserspaceMS: ms(91459),
+			TotalMS:     103143,
+			Target:      "graphical.target",
+			TargetMS:    ms(91201),
+		}},
+		// VMs have no firmware or loader times, and older systemd ends the target line without a period
+		{"time-vm.txt", &BootTimes{
+			KernelMS:    ms(1126),
+			UserspaceMS: ms(12846),
+			TotalMS:     13972,
+			Target:      "multi-user.target",
+			TargetMS:    ms(12811),
+		}},
+	}
+	for _, tt := range tests {
+		got, err := parseBootTimes(string(readFixture(t, "boot", tt.fixture)))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.fixture, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n got %s\nwant %s", tt.fixture, toJSON(got), toJSON(tt.want))
+		}
+	}
+
+	if _, err := parseBootTimes(string(readFixture(t, "boot", "booting.txt"))); err == nil {
+		t.Error("parseBootTimes accepted the output of an unfinished boot")
+	}
+}
+
+func TestParseBlame(t *testing.T) {
+	output := string(readFixture(t, "boot", "blame.txt"))
+	want := []UnitBlame{
+		{"cloud-init.service", 62379},
+		{"kubelet.service", 31459},
+		{"containerd.service", 8204},
+		{"systemd-networkd-wait-online.service", 4112},
+		{"snapd.seeded.service", 812},
+		{"systemd-journal-flush.service", 345},
+		{"systemd-udev-trigger.service", 23},
+		{"sys-kernel-tracing.mount", 0},
+		{"proc-sys-fs-binfmt_misc.mount", 0},
+	}
+	if got := parseBlame(output, 0); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseBlame = %+v\nwant %+v", got, want)
+	}
+	if got := parseBlame(output, 3); !reflect.DeepEqual(got, want[:3]) {
+		t.Errorf("parseBlame(3) = %+v", got)
+	}
+	// Blame is sorted again in case the lines come out of order, and noise is skipped
+	if got := parseBlame("812ms b.service\n\nnot a line\n2.1s a.service\n", 0); !reflect.DeepEqual(got, []UnitBlame{{"a.service", 2100}, {"b.service", 812}}) {
+		t.Errorf("unsorted blame = %+v", got)
+	}
+}
+
+func TestParseCriticalChain(t *testing.T) {
+	want := []ChainUnit{
+		{Unit: "graphical.target", ActivatedMS: ms(91201)},
+		{Unit: "multi-user.target", ActivatedMS: ms(91200)},
+		{Unit: "kubelet.service", ActivatedMS: ms(59741), StartMS: ms(31459)},
+		{Unit: "containerd.service", ActivatedMS: ms(51502), StartMS: ms(8204)},
+		{Unit: "network-online.target", ActivatedMS: ms(51470)},
+		{Unit: "systemd-networkd-wait-online.service", ActivatedMS: ms(47356), StartMS: ms(4112)},
+		{Unit: "systemd-networkd.service", ActivatedMS: ms(1204), StartMS: ms(211)},
+		{Unit: "systemd-udevd.service", ActivatedMS: ms(987), StartMS: ms(0)},
+		{Unit: "systemd-tmpfiles-setup-dev.service", ActivatedMS: ms(941), StartMS: ms(42)},
+		{Unit: "-.slice", ActivatedMS: ms(521)},
+	}
+	if got := parseCriticalChain(string(readFixture(t, "boot", "critical-chain.txt"))); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCriticalChain:\n got %s\nwant %s", toJSON(got), toJSON(want))
+	}
+}
+
+// While the boot is still running, the sections systemd can't report are left out
+// instead of failing the request
+func TestAnalyzeBootWhileBooting(t *testing.T) {
+	dir := filepath.Join("testdata", "boot")
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeCommand(t, "systemd-analyze", `case "$1" in
+blame) cat `+abs+`/blame.txt ;;
+*) cat `+abs+`/booting.txt >&2; exit 1 ;;
+esac`)
+	analysis, err := analyzeBoot(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &BootAnalysis{
+		Booting:       true,
+		Slowest:       []UnitBlame{{"cloud-init.service", 62379}, {"kubelet.service", 31459}},
+		CriticalChain: []ChainUnit{},
+	}
+	if !reflect.DeepEqual(analysis, want) {
+		t.Errorf("analysis = %s, want %s", toJSON(analysis), toJSON(want))
+	}
+
+	// Other failures are still errors
+	fakeCommand(t, "systemd-analyze", `echo "Failed to connect to bus: No such file or directory" >&2; exit 1`)
+	if _, err := analyzeBoot(context.Background(), 10); err == nil {
+		t.Error("analyzeBoot without D-Bus succeeded")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rothgar/cosi/api"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Time a cancelled job's command gets to exit after SIGTERM before it is killed
+const defaultCancelGrace = 10 * time.Second
+
+var (
+	errJobCancelled = errors.New("job was cancelled")
+	errJobNotFound  = errors.New("job not found")
+	errJobNotActive = errors.New("job has already finished")
+)
+
+// JobCancellation records a cancel request and how far the job had got
+type JobCancellation = api.JobCancellation
+
+// jobControl runs the commands of a job, copying their output to the job's output file
+// and letting a cancel request stop them. A nil *jobControl runs commands plainly.
+type jobControl struct {
+	// ctx carries the job's span once it has started, and the span of its creator before
+	ctx       context.Context
+	span      trace.Span
+	mu        sync.Mutex
+	output    *os.File
+	process   *os.Process
+	command   string
+	cancelled bool
+	signal    string
+}
+
+// Write copies command output to the job's output file, when it has one
+func (c *jobControl) Write(p []byte) (int, error) {
+	if c == nil || c.output == nil {
+		return len(p), nil
+	}
+	return c.output.Write(p)
+}
+
+// Helper function to check if the job's output goes to its output file
+func (c *jobControl) spooled() bool {
+	return c != nil && c.output != nil
+}
+
+// Close closes the job's output file
+func (c *jobControl) Close() error {
+	if c == nil || c.output == nil {
+		return nil
+	}
+	return c.output.Close()
+}
+
+// Helper function to return the context of the job's span
+func (c *jobControl) context() context.Context {
+	if c == nil || c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// run starts cmd in a process group of its own, so a cancel reaches the children
+// it forks too, and waits for it. Once the job is cancelled no command starts.
+func (c *jobControl) run(cmd *exec.Cmd) error {
+	return c.runContext(c.context(), cmd)
+}
+
+// runContext is run with the command's span a child of the span in ctx
+func (c *jobControl) runContext(ctx context.Context, cmd *exec.Cmd) (err error) {
+	if c == nil {
+		return runTracked(cmd)
+	}
+
+	finish := startCommandSpan(ctx, cmd)
+	defer func() { finish(err) }()
+	processes.acquire()
+	defer processes.release()
+	c.mu.Lock()
+	if c.cancelled {
+		c.mu.Unlock()
+		return errJobCancelled
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	if err := cmd.Start(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.process = cmd.Process
+	c.command = strings.Join(cmd.Args, " ")
+	c.mu.Unlock()
+
+	err = waitTracked(cmd)
+	c.mu.Lock()
+	c.process = nil
+	c.mu.Unlock()
+	return err
+}
+
+// cancel stops the job from starting more commands and sends SIGTERM to the running
+// one, then SIGKILL when it is still running after grace. It returns the command
+// that was running, if any.
+func (c *jobControl) cancel(grace time.Duration) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancelled = true
+	if c.process == nil {
+		return ""
+	}
+
+	process := c.process
+	if err := syscall.Kill(-process.Pid, syscall.SIGTERM); err != nil {
+		log.Printf("Warning: unable to signal process group %d: %v", process.Pid, err)
+	}
+	c.signal = "SIGTERM"
+	time.AfterFunc(grace, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.process == process {
+			syscall.Kill(-process.Pid, syscall.SIGKILL)
+			c.signal = "SIGKILL"
+		}
+	})
+	return c.command
+}
+
+// Helper function to report whether a job was cancelled and the last signal it got
+func (c *jobControl) state() (bool, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cancelled, c.signal
+}
+
+// Control returns the control that runs the commands of a job, with its output file
+// opened. When the file can't be created the output is only kept in memory.
+func (s *jobStore) Control(job *Job) *jobControl {
+	path := jobFile(job.ID, ".log")
+	output, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if errors.Is(err, os.ErrNotExist) {
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+			output, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		log.Printf("Warning: unable to create the output file of job %s: %v", job.ID, err)
+		return job.control
+	}
+	job.control.output = output
+	job.OutputPath = path
+	s.persist(job)
+	return job.control
+}
+
+// Cancel cancels a queued job right away, or signals the command of a running job
+// and leaves Finish to mark it cancelled once the command has exited
+func (s *jobStore) Cancel(id string) (Job, error) {
+	grace := currentConfig().Jobs.cancelGrace()
+	s.mu.Lock()
+	job, ok := s.jobs[id]
+	if !ok {
+		s.mu.Unlock()
+		return Job{}, errJobNotFound
+	}
+	if job.Status != jobQueued && job.Status != jobRunning {
+		s.mu.Unlock()
+		return *job, errJobNotActive
+	}
+	if job.Cancellation != nil {
+		copied := *job
+		s.mu.Unlock()
+		return copied, nil
+	}
+
+	cancellation := &JobCancellation{RequestedAt: time.Now().UTC(), Stage: job.Status}
+	job.Cancellation = cancellation
+	if job.Status == jobQueued {
+		job.control.cancel(grace)
+		s.mu.Unlock()
+		s.Finish(job, nil, "cancelled before it started", errJobCancelled)
+		copied, _ := s.Get(id)
+		return copied, nil
+	}
+
+	cancellation.Command = job.control.cancel(grace)
+	if job.Type == "packages" {
+		cancellation.Note = "The package transaction was interrupted, so the package database may be left half-configured. " +
+			"POST /packages/repair runs the recovery command of the package manager (dpkg --configure -a on apt hosts)."
+	}
+	s.persist(job)
+	copied := *job
+	s.mu.Unlock()
+	return copied, nil
+}
+
+// Helper function to answer a request whose job was cancelled before it started
+func respondJobCancelled(c *gin.Context, job *Job) {
+	c.Header("X-Cosi-Job-Id", job.ID)
+	respondFailure(c, "", jobCancelledError(job))
+}
+
+// Helper function to return the error of a job that was cancelled before it started
+func jobCancelledError(job *Job) error {
+	return &responseError{409, gin.H{"error": "Job " + job.ID + " was cancelled before it started", "code": "job_cancelled", "job_id": job.ID}}
+}
+
+// PackageRepairStep is one recovery command run by POST /packages/repair
+type PackageRepairStep struct {
+	Command string        `json:"command"`
+	Result  CommandResult `json:"result"`
+}
+
+// Function to run the package manager's recovery commands, stopping at the first that
+// fails. Callers must hold packageLock.
+func repairPackages(pm packageManager, job *jobControl) ([]PackageRepairStep, error) {
+	defer installedPackages.Invalidate()
+	var steps []PackageRepairStep
+	for _, cmd := range pm.RepairCommands() {
+		result, err := runJobCommand(cmd, job)
+		steps = append(steps, PackageRepairStep{Command: strings.Join(cmd.Args, " "), Result: result})
+		if err != nil {
+			return steps, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+		}
+	}
+	return steps, nil
+}
+
+// Helper function to list the tools the repair commands run as root
+func repairTools(pm packageManager) []string {
+	var tools []string
+	for _, cmd := range pm.RepairCommands() {
+		tools = append(tools, commandTool(cmd))
+	}
+	return tools
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Capabilities describes what this host supports and what the agent is allowed to do on it
+type Capabilities struct {
+	Distro         string `json:"distro"`
+	DistroVersion  string `json:"distro_version"`
+	PackageManager string `json:"package_manager,omitempty"`
+	// PackagesReadOnly is set where packages can be listed but not changed, as on NixOS
+	PackagesReadOnly bool `json:"packages_read_only,omitempty"`
+	Systemd          bool `json:"systemd"`
+	// InitSystem is the init system detected at startup and why systemd can't be used
+	InitSystem InitSystem    `json:"init_system"`
+	Privileges privilegeInfo `json:"privileges"`
+	// Proxy is the effective proxy for the agent's outbound requests, when there is one
+	Proxy       *ProxyReport                   `json:"proxy,omitempty"`
+	Kubeadm     kubeadmPrerequisites           `json:"kubeadm"`
+	Endpoints   map[string]operationCapability `json:"endpoints"`
+	CollectedAt time.Time                      `json:"collected_at"`
+}
+
+// privilegeInfo describes the user the agent runs as
+type privilegeInfo struct {
+	User        string `json:"user"`
+	UID         int    `json:"uid"`
+	Root        bool   `json:"root"`
+	SudoMode    bool   `json:"sudo_mode"`
+	SudoWorking bool   `json:"sudo_working"`
+}
+
+// kubeadmPrerequisites summarizes whether `POST /kubernetes` is likely to succeed
+type kubeadmPrerequisites struct {
+	Met    bool           `json:"met"`
+	Checks []kubeadmCheck `json:"checks"`
+}
+
+type kubeadmCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// operationCapability reports whether an endpoint can be used on this host
+type operationCapability struct {
+	Available bool   `json:"available"`
+	Reason    string `json:"reason,omitempty"`
+	Sudoers   string `json:"sudoers,omitempty"` // Rule that would make the operation available
+}
+
+// capabilityCache holds the capabilities computed at startup until they are refreshed
+type capabilityCache struct {
+	mu   sync.RWMutex
+	caps *Capabilities
+}
+
+var capabilities capabilityCache
+
+// Get returns the cached capabilities, computing them on first use
+func (c *capabilityCache) Get() *Capabilities {
+	c.mu.RLock()
+	caps := c.caps
+	c.mu.RUnlock()
+	if caps != nil {
+		return caps
+	}
+	return c.Refresh()
+}
+
+// Refresh recomputes the capabilities and replaces the cached copy
+func (c *capabilityCache) Refresh() *Capabilities {
+	caps := detectCapabilities()
+	c.mu.Lock()
+	c.caps = caps
+	c.mu.Unlock()
+	return caps
+}
+
+// Function to check a privileged operation that needs the given tools
+func privilegedCapability(tools ...string) operationCapability {
+	for _, tool := range tools {
+		if !canRunPrivileged(tool) {
+			reason := "requires root"
+			if sudoMode {
+				reason = "passwordless sudo is not configured for " + tool
+			}
+			return operationCapability{Reason: reason, Sudoers: sudoersLine(tools...)}
+		}
+	}
+	return operationCapability{Available: true}
+}
+
+// Function to detect the host's capabilities and the endpoints they enable
+func detectCapabilities() *Capabilities {
+	host := detectInitSystem()
+	caps := &Capabilities{
+		Systemd:     host.Systemd,
+		InitSystem:  host,
+		Proxy:       proxyReport(),
+		Endpoints:   make(map[string]operationCapability),
+		CollectedAt: time.Now().UTC(),
+	}
+
+	caps.Privileges = privilegeInfo{
+		UID:      os.Geteuid(),
+		Root:     isRoot(),
+		SudoMode: sudoMode,
+	}
+	if u, err := user.Current(); err == nil {
+		caps.Privileges.User = u.Username
+	}
+	caps.Privileges.SudoWorking = !caps.Privileges.Root && sudoMode && runTracked(newCommand("sudo", "-n", "true")) == nil
+
+	osReleaseData, err := readOSReleaseFile("/etc/os-release")
+	if err == nil {
+		caps.Distro = osReleaseData["ID"]
+		caps.DistroVersion = osReleaseData["VERSION_ID"]
+	}
+	pm := packageManagerFor(osReleaseData)
+
+	available := operationCapability{Available: true}
+	caps.Endpoints["GET /os"] = available
+	caps.Endpoints["GET /uname"] = available
+	caps.Endpoints["GET /binaries"] = available
+	caps.Endpoints["GET /kubernetes"] = available
+	caps.Endpoints["GET /capabilities"] = available
+	caps.Endpoints["POST /refresh"] = available
+	caps.Endpoints["GET /inventory"] = available
+	caps.Endpoints["GET /hardware"] = available
+	caps.Endpoints["GET /cloud"] = available
+	caps.Endpoints["GET /identity"] = available
+	caps.Endpoints["GET /metrics/system"] = available
+	caps.Endpoints["GET /maintenance"] = available
+	caps.Endpoints["POST /maintenance"] = available
+	caps.Endpoints["GET /readyz"] = available
+	caps.Endpoints["GET /discover"] = available
+	caps.Endpoints["GET /gpu"] = available
+	caps.Endpoints["GET /sensors"] = available
+	caps.Endpoints["GET /storage/raid"] = available
+	if _, err := exec.LookPath("lvs"); err != nil {
+		caps.Endpoints["GET /storage/lvm"] = available // reports no volumes
+	} else {
+		caps.Endpoints["GET /storage/lvm"] = privilegedCapability("pvs", "vgs", "lvs")
+	}
+	if _, err := exec.LookPath("smartctl"); err != nil {
+		smartctlMissing := operationCapability{Reason: "smartctl_missing: install smartmontools"}
+		caps.Endpoints["GET /disk/smart"] = smartctlMissing
+		caps.Endpoints["POST /disk/smart/selftest"] = smartctlMissing
+	} else {
+		smart := privilegedCapability("smartctl")
+		caps.Endpoints["GET /disk/smart"] = smart
+		caps.Endpoints["POST /disk/smart/selftest"] = smart
+	}
+	caps.Endpoints["GET /version"] = available
+	caps.Endpoints["GET /registration"] = available
+	caps.Endpoints["POST /update"] = updateCapability()
+	switch {
+	case !debugEnabled:
+		caps.Endpoints["GET /debug/runtime"] = operationCapability{Reason: "started without --enable-debug"}
+	case len(currentConfig().Auth.Tokens) == 0:
+		caps.Endpoints["GET /debug/runtime"] = operationCapability{Reason: "no auth tokens are configured"}
+	default:
+		caps.Endpoints["GET /debug/runtime"] = available
+	}
+	switch {
+	case len(currentConfig().Fleet.Agents) == 0:
+		caps.Endpoints["POST /fleet/*operation"] = operationCapability{Reason: "no agents are configured in fleet.agents"}
+	case len(currentConfig().Auth.Tokens) == 0:
+		caps.Endpoints["POST /fleet/*operation"] = operationCapability{Reason: "no auth tokens are configured"}
+	default:
+		caps.Endpoints["POST /fleet/*operation"] = available
+	}
+	caps.Endpoints["POST /batch"] = available
+	osquery := available
+	if _, err := exec.LookPath("osqueryi"); err != nil {
+		osquery = operationCapability{Reason: "osquery_not_installed: install osquery"}
+	} else if len(currentConfig().Auth.Tokens) == 0 {
+		osquery = operationCapability{Reason: "no auth tokens are configured"}
+	}
+	caps.Endpoints["POST /osquery"] = osquery
+	caps.Endpoints["GET /osquery/tables"] = osquery
+	switch {
+	case currentConfig().GRPC.Listen == "":
+		caps.Endpoints["GRPC cosi.v1.Cosi"] = operationCapability{Reason: "grpc.listen is not set"}
+	case len(currentConfig().Auth.Tokens) == 0:
+		caps.Endpoints["GRPC cosi.v1.Cosi"] = operationCapability{Reason: "no auth tokens are configured"}
+	default:
+		caps.Endpoints["GRPC cosi.v1.Cosi"] = available
+	}
+
+	if readOnly, ok := pm.(readOnlyManager); ok {
+		caps.PackageManager = pm.Name()
+		caps.PackagesReadOnly = true
+		code, reason := readOnly.ReadOnly()
+		unsupported := operationCapability{Reason: code + ": " + reason}
+		caps.Endpoints["GET /packages"] = available
+		caps.Endpoints["GET /packages/manifest"] = unsupported
+		caps.Endpoints["POST /packages/diff"] = unsupported
+		caps.Endpoints["POST /packages"] = unsupported
+		caps.Endpoints["POST /packages/rollback/:job_id"] = unsupported
+		caps.Endpoints["POST /packages/repair"] = unsupported
+		caps.Endpoints["POST /packages/local"] = unsupported
+		caps.Endpoints["GET /power/reboot-required"] = available
+	} else if pm != nil {
+		caps.PackageManager = pm.Name()
+		caps.Endpoints["GET /packages"] = available
+		caps.Endpoints["GET /packages/manifest"] = available
+		caps.Endpoints["POST /packages/diff"] = available
+		caps.Endpoints["POST /packages"] = privilegedCapability(pm.PrivilegedTools()...)
+		caps.Endpoints["POST /packages/rollback/:job_id"] = privilegedCapability(pm.PrivilegedTools()...)
+		caps.Endpoints["POST /packages/repair"] = privilegedCapability(repairTools(pm)...)
+		switch _, ok := pm.(localInstaller); {
+		case !ok:
+			caps.Endpoints["POST /packages/local"] = operationCapability{Reason: "package files can't be installed with " + pm.Name()}
+		case len(currentConfig().Auth.Tokens) == 0:
+			caps.Endpoints["POST /packages/local"] = operationCapability{Reason: "no auth tokens are configured"}
+		default:
+			caps.Endpoints["POST /packages/local"] = privilegedCapability(pm.PrivilegedTools()...)
+		}
+		caps.Endpoints["GET /power/reboot-required"] = available
+	} else {
+		unsupported := operationCapability{Reason: "unsupported operating system"}
+		caps.Endpoints["GET /packages"] = unsupported
+		caps.Endpoints["GET /packages/manifest"] = unsupported
+		caps.Endpoints["POST /packages/diff"] = unsupported
+		caps.Endpoints["POST /packages"] = unsupported
+		caps.Endpoints["POST /packages/rollback/:job_id"] = unsupported
+		caps.Endpoints["POST /packages/repair"] = unsupported
+		caps.Endpoints["POST /packages/local"] = unsupported
+		caps.Endpoints["GET /power/reboot-required"] = unsupported
+	}
+	packageFiles := operationCapability{Reason: "unsupported operating system"}
+	if _, ok := pm.(fileQuerier); ok {
+		packageFiles = available
+	} else if pm != nil {
+		packageFiles = operationCapability{Reason: "package files can't be queried with " + pm.Name()}
+	}
+	caps.Endpoints["GET /packages/:name/files"] = packageFiles
+	caps.Endpoints["GET /packages/:name/verify"] = packageFiles
+	caps.Endpoints["GET /files/owner"] = packageFiles
+	snapshots := operationCapability{Reason: "unsupported operating system"}
+	if pm != nil {
+		snapshots = available
+	}
+	caps.Endpoints["POST /packages/snapshots"] = snapshots
+	caps.Endpoints["GET /packages/diff-since/:snapshot_id"] = snapshots
+	caps.Endpoints["GET /packages/snapshots"] = available
+	caps.Endpoints["DELETE /packages/snapshots/:id"] = available
+
+	noSystemd := operationCapability{Reason: host.Reason}
+	if caps.Systemd || host.ServiceCommand {
+		// Without systemd the service command lists the SysV services instead
+		caps.Endpoints["POST /systemctl/status"] = available
+	} else {
+		caps.Endpoints["POST /systemctl/status"] = noSystemd
+	}
+	if caps.Systemd {
+		caps.Endpoints["GET /boot/analyze"] = available
+	} else {
+		caps.Endpoints["GET /boot/analyze"] = noSystemd
+	}
+
+	caps.Endpoints["GET /power/pending"] = available
+	if caps.Systemd {
+		power := privilegedCapability("systemctl", "shutdown")
+		caps.Endpoints["POST /power/reboot"] = power
+		caps.Endpoints["POST /power/shutdown"] = power
+		caps.Endpoints["DELETE /power/pending"] = power
+	} else {
+		caps.Endpoints["POST /power/reboot"] = noSystemd
+		caps.Endpoints["POST /power/shutdown"] = noSystemd
+		caps.Endpoints["DELETE /power/pending"] = noSystemd
+	}
+
+	if backend := detectFirewall(); backend != nil {
+		firewall := privilegedCapability(backend.Tool())
+		caps.Endpoints["GET /firewall"] = firewall
+		caps.Endpoints["POST /firewall/rules"] = firewall
+	} else {
+		caps.Endpoints["GET /firewall"] = available
+		caps.Endpoints["POST /firewall/rules"] = operationCapability{Reason: "no firewall tooling is installed"}
+	}
+
+	caps.Endpoints["GET /locale"] = available
+	if caps.Systemd {
+		caps.Endpoints["POST /locale"] = privilegedCapability("localectl")
+	} else {
+		caps.Endpoints["POST /locale"] = noSystemd
+	}
+
+	caps.Endpoints["GET /time/sources"] = operationCapability{Reason: "none of chronyc, timedatectl or ntpq is installed"}
+	for _, tool := range []string{"chronyc", "timedatectl", "ntpq"} {
+		if _, err := exec.LookPath(tool); err == nil {
+			caps.Endpoints["GET /time/sources"] = available
+			break
+		}
+	}
+	caps.Endpoints["GET /limits"] = available
+	switch {
+	case !caps.Systemd:
+		caps.Endpoints["POST /limits/service/:name"] = noSystemd
+	case !caps.Privileges.Root:
+		caps.Endpoints["POST /limits/service/:name"] = operationCapability{Reason: "requires the agent to run as root"}
+	default:
+		caps.Endpoints["POST /limits/service/:name"] = available
+	}
+
+	caps.Endpoints["GET /security/mac"] = available
+	caps.Endpoints["GET /certificates"] = available
+	caps.Endpoints["GET /files"] = available
+	caps.Endpoints["GET /cron"] = available
+	caps.Endpoints["GET /logs/tail"] = available
+	caps.Endpoints["GET /plugins"] = available
+	if len(currentConfig().Plugins.Enabled) == 0 {
+		caps.Endpoints["GET /plugins/:name"] = operationCapability{Reason: "no plugins are enabled in plugins.enabled"}
+	} else {
+		caps.Endpoints["GET /plugins/:name"] = available
+	}
+	caps.Endpoints["GET /scripts"] = available
+	switch {
+	case len(currentConfig().Scripts.Registered) == 0:
+		caps.Endpoints["POST /scripts/:name"] = operationCapability{Reason: "no scripts are registered in scripts.registered"}
+	case len(currentConfig().Auth.Tokens) == 0:
+		caps.Endpoints["POST /scripts/:name"] = operationCapability{Reason: "no auth tokens are configured"}
+	default:
+		caps.Endpoints["POST /scripts/:name"] = available
+	}
+	caps.Endpoints["GET /kubernetes/kubelet"] = available
+	caps.Endpoints["GET /kubernetes/manifests"] = available
+	switch _, err := exec.LookPath("crictl"); {
+	case err != nil:
+		caps.Endpoints["PATCH /kubernetes/manifests/:name"] = operationCapability{Reason: "crictl is not installed, so a restarted pod can't be checked"}
+	case !caps.Privileges.Root:
+		caps.Endpoints["PATCH /kubernetes/manifests/:name"] = operationCapability{Reason: "requires the agent to run as root"}
+	case len(currentConfig().Auth.Tokens) == 0:
+		caps.Endpoints["PATCH /kubernetes/manifests/:name"] = operationCapability{Reason: "no auth tokens are configured"}
+	default:
+		caps.Endpoints["PATCH /kubernetes/manifests/:name"] = available
+	}
+	caps.Endpoints["GET /kubernetes/etcd"] = available
+	var nodeOperations operationCapability
+	switch _, err := exec.LookPath("kubectl"); {
+	case err != nil:
+		nodeOperations = operationCapability{Reason: "kubectl is not installed"}
+	case !caps.Privileges.Root:
+		// kubectl reads /etc/kubernetes/admin.conf, which only root may
+		nodeOperations = operationCapability{Reason: "requires the agent to run as root"}
+	case len(currentConfig().Auth.Tokens) == 0:
+		nodeOperations = operationCapability{Reason: "no auth tokens are configured"}
+	default:
+		nodeOperations = available
+	}
+	caps.Endpoints["POST /kubernetes/node/cordon"] = nodeOperations
+	caps.Endpoints["POST /kubernetes/node/uncordon"] = nodeOperations
+	caps.Endpoints["POST /kubernetes/node/drain"] = nodeOperations
+	if caps.Privileges.Root {
+		caps.Endpoints["POST /kubernetes/etcd/backup"] = available
+	} else {
+		caps.Endpoints["POST /kubernetes/etcd/backup"] = operationCapability{Reason: "requires the agent to run as root"}
+	}
+	caps.Endpoints["GET /ssh/keys"] = available
+	switch {
+	case !caps.Privileges.Root:
+		notRoot := operationCapability{Reason: "requires the agent to run as root"}
+		caps.Endpoints["POST /ssh/keys"] = notRoot
+		caps.Endpoints["DELETE /ssh/keys"] = notRoot
+	case len(currentConfig().Auth.Tokens) == 0:
+		noTokens := operationCapability{Reason: "no auth tokens are configured"}
+		caps.Endpoints["POST /ssh/keys"] = noTokens
+		caps.Endpoints["DELETE /ssh/keys"] = noTokens
+	default:
+		caps.Endpoints["POST /ssh/keys"] = available
+		caps.Endpoints["DELETE /ssh/keys"] = available
+	}
+	caps.Endpoints["GET /sudoers"] = available
+	caps.Endpoints["GET /sudoers/managed"] = available
+	switch _, err := exec.LookPath("visudo"); {
+	case err != nil:
+		noVisudo := operationCapability{Reason: "visudo is not installed"}
+		caps.Endpoints["PUT /sudoers/managed/:name"] = noVisudo
+		caps.Endpoints["DELETE /sudoers/managed/:name"] = noVisudo
+	case !caps.Privileges.Root:
+		notRoot := operationCapability{Reason: "requires the agent to run as root"}
+		caps.Endpoints["PUT /sudoers/managed/:name"] = notRoot
+		caps.Endpoints["DELETE /sudoers/managed/:name"] = notRoot
+	case len(currentConfig().Auth.Tokens) == 0:
+		noTokens := operationCapability{Reason: "no auth tokens are configured"}
+		caps.Endpoints["PUT /sudoers/managed/:name"] = noTokens
+		caps.Endpoints["DELETE /sudoers/managed/:name"] = noTokens
+	default:
+		caps.Endpoints["PUT /sudoers/managed/:name"] = available
+		caps.Endpoints["DELETE /sudoers/managed/:name"] = available
+	}
+	for endpoint, tool := range map[string]string{"POST /users": "useradd", "PATCH /users/:name": "usermod", "DELETE /users/:name": "userdel"} {
+		users := privilegedCapability(tool)
+		if users.Available && len(currentConfig().Auth.Tokens) == 0 {
+			users = operationCapability{Reason: "no auth tokens are configured"}
+		}
+		caps.Endpoints[endpoint] = users
+	}
+	switch {
+	case !caps.Privileges.Root:
+		caps.Endpoints["PUT /files"] = operationCapability{Reason: "requires the agent to run as root"}
+	case len(currentConfig().Auth.Tokens) == 0:
+		caps.Endpoints["PUT /files"] = operationCapability{Reason: "no auth tokens are configured"}
+	default:
+		caps.Endpoints["PUT /files"] = available
+	}
+	if mac := macStatus(context.Background()); mac.System == "selinux" && mac.Mode != "disabled" {
+		caps.Endpoints["POST /security/mac/selinux"] = privilegedCapability("setenforce")
+	} else {
+		caps.Endpoints["POST /security/mac/selinux"] = operationCapability{Reason: "SELinux is not enabled"}
+	}
+
+	caps.Endpoints["GET /reconcile/status"] = available
+	if reconcileLoop != nil {
+		caps.Endpoints["POST /reconcile/run"] = available
+	} else {
+		caps.Endpoints["POST /reconcile/run"] = operationCapability{Reason: "reconciliation is not configured"}
+	}
+
+	caps.Kubeadm = checkKubeadmPrerequisites(caps)
+	if caps.Kubeadm.Met {
+		caps.Endpoints["POST /kubernetes"] = privilegedCapability(kubernetesPrivilegedTools()...)
+	} else {
+		caps.Endpoints["POST /kubernetes"] = operationCapability{Reason: "kubeadm prerequisites are not met"}
+	}
+
+	return caps
+}
+
+// Function to check the host against the requirements of the Kubernetes installer
+func checkKubeadmPrerequisites(caps *Capabilities) kubeadmPrerequisites {
+	var checks []kubeadmCheck
+
+	// The installer knows the apt and dnf/yum paths
+	supported := caps.PackageManager == "apt" || caps.PackageManager == "dnf" || caps.PackageManager == "yum"
+	checks = append(checks, kubeadmCheck{Name: "supported_distro", Passed: supported, Detail: caps.Distro})
+
+	checks = append(checks, kubeadmCheck{Name: "systemd", Passed: caps.Systemd})
+
+	environment := runtimeEnvironment()
+	host := kubeadmCheck{Name: "host_systemd", Passed: checkKubernetesEnvironment(environment) == nil, Detail: "cgroup " + environment.CgroupVersion}
+	if !host.Passed {
+		host.Detail = "in a container without the host's systemd: " + strings.Join(environment.Evidence, "; ")
+	}
+	checks = append(checks, host)
+
+	cpus := runtime.NumCPU()
+	checks = append(checks, kubeadmCheck{Name: "cpus", Passed: cpus >= 2, Detail: fmt.Sprintf("%d CPUs, 2 required", cpus)})
+
+	memoryMB, err := memTotalMB()
+	memory := kubeadmCheck{Name: "memory", Passed: memoryMB >= 1700, Detail: fmt.Sprintf("%d MB, 1700 MB required", memoryMB)}
+	if err != nil {
+		memory.Detail = err.Error()
+	}
+	checks = append(checks, memory)
+
+	runtimeSocket := ""
+	for _, socket := range []string{"/run/containerd/containerd.sock", "/var/run/crio/crio.sock", "/var/run/cri-dockerd.sock"} {
+		if _, err := os.Stat(socket); err == nil {
+			runtimeSocket = socket
+			break
+		}
+	}
+	checks = append(checks, kubeadmCheck{Name: "container_runtime", Passed: runtimeSocket != "", Detail: runtimeSocket})
+
+	port := kubeadmCheck{Name: "port_6443", Passed: true}
+	if l, err := net.Listen("tcp", ":6443"); err != nil {
+		port.Passed = false
+		port.Detail = "port 6443 is in use"
+	} else {
+		l.Close()
+	}
+	checks = append(checks, port)
+
+	if url := kubernetesRepositoryURL(caps.PackageManager); url != "" {
+		checks = append(checks, checkRepositoryReachable(url))
+	}
+
+	met := true
+	for _, check := range checks {
+		met = met && check.Passed
+	}
+	return kubeadmPrerequisites{Met: met, Checks: checks}
+}
+
+// Helper function to check the installer can reach the Kubernetes package repository at
+// url. It is probed the same way POST /network/probe probes an http target, or through
+// the proxy the installer's downloads take when one is configured.
+func checkRepositoryReachable(url string) kubeadmCheck {
+	check := kubeadmCheck{Name: "repository_reachable", Passed: true, Detail: url}
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return kubeadmCheck{Name: check.Name, Detail: err.Error()}
+	}
+	if proxy, _ := agentProxy(request); proxy != nil {
+		check.Detail = url + " through proxy " + redactProxy(proxy.String())
+		if err := probeThroughProxy(context.Background(), url, defaultProbeTimeout); err != nil {
+			check.Passed = false
+			check.Detail += ": " + err.Error()
+		}
+		return check
+	}
+	if probe := runProbe(context.Background(), ProbeTarget{Type: "http", Target: url}, false); probe.Status != "ok" {
+		check.Passed = false
+		check.Detail = url + ": " + probe.Error
+	}
+	return check
+}
+
+// Function to read the total memory from /proc/meminfo in megabytes
+func memTotalMB() (int, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return 0, err
+			}
+			return kb / 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("MemTotal not found in /proc/meminfo")
+}
+
+// Function to check that POST /update has a key to verify updates with, and that the
+// directory of the running binary can be written
+func updateCapability() operationCapability {
+	if currentConfig().Update.PublicKey == "" && currentConfig().Signatures.keysDir() == "" {
+		return operationCapability{Reason: "no key to verify updates with; configure update.public_key or signatures.trusted_keys_dir"}
+	}
+	exe, err := executablePath()
+	if err != nil {
+		return operationCapability{Reason: "unable to locate the running binary"}
+	}
+	if err := syscall.Access(filepath.Dir(exe), 2); err != nil { // W_OK
+		return operationCapability{Reason: filepath.Dir(exe) + " is not writable"}
+	}
+	return operationCapability{Available: true}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Files larger than this are skipped; certificates and bundles are far smaller
+	maxCertificateFileBytes = 1 << 20
+	// Directories deeper than this below a requested path are not walked
+	maxCertificateDepth = 8
+	// Stop after this many files so a misdirected path can't walk a whole tree
+	maxCertificateFiles = 10000
+)
+
+// Directories GET /certificates may inspect when certificates.allowed_paths isn't configured
+var defaultCertificatePaths = []string{"/etc/kubernetes/pki", "/etc/ssl", "/etc/pki", "/etc/letsencrypt"}
+
+// CertificatesConfig restricts the directories GET /certificates may walk
+type CertificatesConfig struct {
+	AllowedPaths []string `yaml:"allowed_paths"`
+}
+
+// CertificateInfo describes one certificate found on disk
+type CertificateInfo struct {
+	Path            string    `json:"path"`
+	Index           int       `json:"index"` // position within a bundle
+	Subject         string    `json:"subject"`
+	Issuer          string    `json:"issuer"`
+	Serial          string    `json:"serial"`
+	DNSNames        []string  `json:"dns_names,omitempty"`
+	IPAddresses     []string  `json:"ip_addresses,omitempty"`
+	NotBefore       time.Time `json:"not_before"`
+	NotAfter        time.Time `json:"not_after"`
+	DaysUntilExpiry int       `json:"days_until_expiry"`
+	Expired         bool      `json:"expired"`
+	IsCA            bool      `json:"is_ca"`
+	KeyType         string    `json:"key_type"`
+}
+
+// CertificateFileNote explains why a file produced no certificates
+type CertificateFileNote struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// CertificateReport is the response of GET /certificates
+type CertificateReport struct {
+	Paths        []string              `json:"paths"`
+	Certificates []CertificateInfo     `json:"certificates"`
+	Skipped      []CertificateFileNote `json:"skipped"`
+	Errors       []CertificateFileNote `json:"errors"`
+	Truncated    bool                  `json:"truncated,omitempty"`
+}
+
+// Function to return the directories certificates may be read from
+func certificateRoots() []string {
+	if paths := currentConfig().Certificates.AllowedPaths; len(paths) > 0 {
+		return paths
+	}
+	return defaultCertificatePaths
+}
+
+// Function to check that a requested path lies inside one of the allowed roots
+func allowedCertificatePath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("%s is not an absolute path", path)
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return "", err
+	}
+	for _, root := range certificateRoots() {
+		if resolvedRoot, err := filepath.EvalSymlinks(root); err == nil && withinDir(resolvedRoot, resolved) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("%s is outside the allowed certificate paths", path)
+}
+
+// Helper function to check if path is dir or below it
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// Function to walk the given directories and parse every certificate found. Symlinked
+// files are followed but symlinked directories are not, so loops can't occur.
+func inspectCertificates(paths []string, expiringWithin time.Duration) *CertificateReport {
+	report := &CertificateReport{
+		Paths:        paths,
+		Certificates: []CertificateInfo{},
+		Skipped:      []CertificateFileNote{},
+		Errors:       []CertificateFileNote{},
+	}
+	now := time.Now()
+	files := 0
+
+	for _, root := range paths {
+		rootDepth := strings.Count(root, string(filepath.Separator))
+		filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				report.Errors = append(report.Errors, CertificateFileNote{Path: path, Reason: err.Error()})
+				return nil
+			}
+			if entry.IsDir() {
+				if strings.Count(path, string(filepath.Separator))-rootDepth >= maxCertificateDepth {
+					report.Skipped = append(report.Skipped, CertificateFileNote{Path: path, Reason: "too deep"})
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if files++; files > maxCertificateFiles {
+				report.Truncated = true
+				return filepath.SkipAll
+			}
+
+			certs, note, err := readCertificateFile(path)
+			switch {
+			case err != nil:
+				report.Errors = append(report.Errors, CertificateFileNote{Path: path, Reason: err.Error()})
+			case note != "":
+				report.Skipped = append(report.Skipped, CertificateFileNote{Path: path, Reason: note})
+			}
+			for i, cert := range certs {
+				info := certificateInfo(path, i, cert, now)
+				if expiringWithin > 0 && cert.NotAfter.After(now.Add(expiringWithin)) {
+					continue
+				}
+				report.Certificates = append(report.Certificates, info)
+			}
+			return nil
+		})
+		if report.Truncated {
+			break
+		}
+	}
+	return report
+}
+
+// Function to parse the certificates in a file. note explains files that were
+// deliberately skipped, such as private keys or files that aren't certificates.
+func readCertificateFile(path string) ([]*x509.Certificate, string, error) {
+	info, err := os.Stat(path) // follows a symlinked file
+	if err != nil {
+		return nil, "", err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, "not a regular file", nil
+	}
+	if info.Size() > maxCertificateFileBytes {
+		return nil, fmt.Sprintf("larger than %d bytes", maxCertificateFileBytes), nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxCertificateFileBytes))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var certs []*x509.Certificate
+	sawKey := false
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return certs, "", fmt.Errorf("certificate %d: %w", len(certs), err)
+			}
+			certs = append(certs, cert)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			sawKey = true
+		}
+	}
+
+	switch {
+	case len(certs) > 0:
+		return certs, "", nil
+	case sawKey:
+		return nil, "private key", nil
+	}
+	// Binary DER certificates only get a try when the extension says so
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".der", ".cer", ".crt":
+		if cert, err := x509.ParseCertificate(data); err == nil {
+			return []*x509.Certificate{cert}, "", nil
+		}
+		return nil, "", errors.New("not a PEM or DER certificate")
+	}
+	return nil, "no certificates", nil
+}
+
+// Helper function to summarize a certificate
+func certificateInfo(path string, index int, cert *x509.Certificate, now time.Time) CertificateInfo {
+	info := CertificateInfo{
+		Path:            path,
+		Index:           index,
+		Subject:         cert.Subject.String(),
+		Issuer:          cert.Issuer.String(),
+		Serial:          cert.SerialNumber.Text(16),
+		DNSNames:        cert.DNSNames,
+		NotBefore:       cert.NotBefore.UTC(),
+		NotAfter:        cert.NotAfter.UTC(),
+		DaysUntilExpiry: int(cert.NotAfter.Sub(now).Hours() / 24),
+		Expired:         now.After(cert.NotAfter),
+		IsCA:            cert.IsCA,
+		KeyType:         certificateKeyType(cert),
+	}
+	for _, ip := range cert.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	return info
+}
+
+// Helper function to describe a certificate's public key, e.g. "RSA 2048" or "ECDSA P-256"
+func certificateKeyType(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA " + strconv.Itoa(key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + key.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return cert.PublicKeyAlgorithm.String()
+}
+
+// Function to parse a duration that may use a day suffix, such as 30d
+func parseDays(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,710 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rothgar/cosi/api"
+	"github.com/rothgar/cosi/client"
+	"gopkg.in/yaml.v3"
+)
+
+// Exit codes of "cosi client"
+const (
+	clientExitOK = 0
+	// clientExitFailed is returned when the agent refused a call or a job didn't succeed
+	clientExitFailed = 1
+	clientExitUsage  = 2
+)
+
+// Interval at which --watch and --follow poll a job's output
+const clientFollowInterval = 500 * time.Millisecond
+
+const clientUsage = `Usage: cosi client [flags] <command> [flags]
+
+Commands:
+  version                        Show the build of the agent
+  os                             Show the host's /etc/os-release
+  uname                          Show the host's uname
+  packages list                  List installed packages (--manager, --groups)
+  packages apply -f FILE         Apply a package manifest (--watch, --wait-for-lock)
+  kubernetes status              Show whether Kubernetes is installed
+  kubernetes bootstrap           Install Kubernetes and bootstrap a cluster (--follow, --wait-for-lock)
+  jobs list                      List recent jobs
+  jobs get ID                    Show a job
+  jobs wait ID                   Wait for a job to finish
+  jobs logs ID                   Print the output of a job (--follow)
+  jobs cancel ID                 Cancel a job
+
+The server and credentials come from the flags, then COSI_SERVER, COSI_TOKEN, COSI_KEY_ID
+and COSI_CA_CERT, then the server, token, key_id, ca_cert and insecure_skip_verify keys of
+$XDG_CONFIG_HOME/cosi/config (~/.config/cosi/config).
+
+Flags, accepted before or after the command:
+`
+
+// clientSettings are the connection settings of the client config file
+type clientSettings struct {
+	Server             string `yaml:"server"`
+	Token              string `yaml:"token"`
+	KeyID              string `yaml:"key_id"`
+	CACert             string `yaml:"ca_cert"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// clientCLI holds the global flags of "cosi client"
+type clientCLI struct {
+	server   string
+	token    string
+	keyID    string
+	caCert   string
+	insecure bool
+	output   string
+}
+
+// usageError is a mistake in the command line, reported with clientExitUsage
+type usageError struct {
+	message string
+}
+
+func (e *usageError) Error() string {
+	return e.message
+}
+
+// Function to handle "cosi client", a command-line client of another agent. It returns
+// the process's exit code.
+func runClient(args []string) int {
+	cli := &clientCLI{output: "table"}
+	fs := cli.flags("client")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return clientExitOK
+		}
+		return clientExitUsage
+	}
+	rest := fs.Args()
+	if len(rest) == 0 {
+		fs.Usage()
+		return clientExitUsage
+	}
+
+	name, rest := rest[0], rest[1:]
+	if _, grouped := clientCommands[name]; !grouped && len(rest) > 0 {
+		name, rest = name+" "+rest[0], rest[1:]
+	}
+	command, ok := clientCommands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "cosi client: unknown command %q\n", name)
+		fs.Usage()
+		return clientExitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := command(ctx, cli, name, rest)
+	var usage *usageError
+	switch {
+	case err == nil:
+		return clientExitOK
+	case errors.Is(err, flag.ErrHelp):
+		return clientExitOK
+	case errors.As(err, &usage):
+		fmt.Fprintf(os.Stderr, "cosi client %s: %v\n", name, err)
+		return clientExitUsage
+	}
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) && apiErr.JobID != "" {
+		fmt.Fprintf(os.Stderr, "%v\nThe job's output: cosi client jobs logs %s\n", err, apiErr.JobID)
+	} else {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return clientExitFailed
+}
+
+// clientCommands are the commands of "cosi client" by name
+var clientCommands = map[string]func(ctx context.Context, cli *clientCLI, name string, args []string) error{
+	"version":              clientVersion,
+	"os":                   clientOS,
+	"uname":                clientUname,
+	"packages list":        clientPackagesList,
+	"packages apply":       clientPackagesApply,
+	"kubernetes status":    clientKubernetesStatus,
+	"kubernetes bootstrap": clientKubernetesBootstrap,
+	"jobs list":            clientJobsList,
+	"jobs get":             clientJobsGet,
+	"jobs wait":            clientJobsWait,
+	"jobs logs":            clientJobsLogs,
+	"jobs cancel":          clientJobsCancel,
+}
+
+// Helper function to create the flag set of a command, with the global flags on it.
+// Their defaults are the values parsed so far, so they can be given before or after the
+// command.
+func (cli *clientCLI) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&cli.server, "server", cli.server, "URL of the agent, like https://host:8080")
+	fs.StringVar(&cli.token, "token", cli.token, "API token, or the secret of the key with -key-id")
+	fs.StringVar(&cli.keyID, "key-id", cli.keyID, "Sign requests as this key instead of sending the token")
+	fs.StringVar(&cli.caCert, "ca-cert", cli.caCert, "CA certificate (PEM) that signed the agent's certificate")
+	fs.BoolVar(&cli.insecure, "insecure-skip-verify", cli.insecure, "Don't verify the agent's certificate")
+	fs.StringVar(&cli.output, "o", cli.output, "Output format: table, json, or yaml")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), clientUsage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// Helper function to parse the flags of a command that takes exactly nargs arguments
+func (cli *clientCLI) parse(fs *flag.FlagSet, args []string, nargs int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+		return nil, &usageError{err.Error()}
+	}
+	// Flags may follow the arguments too, like "jobs logs ID --follow"
+	var positional []string
+	for rest := fs.Args(); len(rest) > 0; rest = fs.Args() {
+		positional = append(positional, rest[0])
+		if err := fs.Parse(rest[1:]); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, &usageError{err.Error()}
+		}
+	}
+	if len(positional) != nargs {
+		return nil, &usageError{fmt.Sprintf("expected %d argument(s), got %d", nargs, len(positional))}
+	}
+	switch cli.output {
+	case "table", "json", "yaml":
+	default:
+		return nil, &usageError{fmt.Sprintf("unknown output format %q; use table, json, or yaml", cli.output)}
+	}
+	return positional, nil
+}
+
+// Helper function to return the path of the client config file
+func clientConfigPath() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "cosi", "config")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "cosi", "config")
+}
+
+// Helper function to read the client config file; a missing file holds no settings
+func loadClientSettings(path string) (clientSettings, error) {
+	var settings clientSettings
+	if path == "" {
+		return settings, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return settings, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return settings, nil
+}
+
+// Helper function to return the first value that is set
+func firstSet(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Function to build the SDK client from the flags, the environment, and the config file,
+// in that order of precedence
+func (cli *clientCLI) client() (*client.Client, error) {
+	path := clientConfigPath()
+	settings, err := loadClientSettings(path)
+	if err != nil {
+		return nil, err
+	}
+	server := firstSet(cli.server, os.Getenv("COSI_SERVER"), settings.Server)
+	if server == "" {
+		return nil, &usageError{fmt.Sprintf("no agent to talk to; set -server, COSI_SERVER, or server in %s", path)}
+	}
+	token := firstSet(cli.token, os.Getenv("COSI_TOKEN"), settings.Token)
+	keyID := firstSet(cli.keyID, os.Getenv("COSI_KEY_ID"), settings.KeyID)
+	caCert := firstSet(cli.caCert, os.Getenv("COSI_CA_CERT"), settings.CACert)
+
+	options := []client.Option{client.WithUserAgent("cosi-client/" + version)}
+	switch {
+	case keyID != "":
+		options = append(options, client.WithHMAC(keyID, token))
+	case token != "":
+		options = append(options, client.WithToken(token))
+	}
+	if caCert != "" || cli.insecure || settings.InsecureSkipVerify {
+		config := &tls.Config{InsecureSkipVerify: cli.insecure || settings.InsecureSkipVerify}
+		if caCert != "" {
+			pem, err := os.ReadFile(caCert)
+			if err != nil {
+				return nil, err
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%s holds no PEM certificates", caCert)
+			}
+		}
+		options = append(options, client.WithTLSConfig(config))
+	}
+	c, err := client.New(server, options...)
+	if err != nil {
+		return nil, &usageError{err.Error()}
+	}
+	return c, nil
+}
+
+// Helper function to print a response in the chosen format. table writes the table
+// format; YAML is produced from the JSON encoding so both formats use the same keys.
+func (cli *clientCLI) print(obj interface{}, table func(w io.Writer)) error {
+	switch cli.output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(obj)
+	case "yaml":
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		var generic interface{}
+		if err := yaml.Unmarshal(data, &generic); err != nil {
+			return err
+		}
+		encoder := yaml.NewEncoder(os.Stdout)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(generic); err != nil {
+			return err
+		}
+		return encoder.Close()
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+// Helper function to write the rows of a table, separating the cells with tabs
+func writeRows(w io.Writer, rows ...[]string) {
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+}
+
+// Helper function to write a map as a sorted KEY VALUE table
+func writeFields(w io.Writer, fields map[string]string) {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	writeRows(w, []string{"KEY", "VALUE"})
+	for _, key := range keys {
+		writeRows(w, []string{key, fields[key]})
+	}
+}
+
+// Helper function to format an optional time of a job
+func formatJobTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+// Helper function to write the table of a single job
+func writeJob(w io.Writer, job *api.Job) {
+	writeRows(w,
+		[]string{"ID", job.ID},
+		[]string{"TYPE", job.Type},
+		[]string{"STATUS", job.Status},
+		[]string{"CREATED", formatJobTime(&job.CreatedAt)},
+		[]string{"STARTED", formatJobTime(job.StartedAt)},
+		[]string{"FINISHED", formatJobTime(job.FinishedAt)},
+	)
+	if job.Summary != "" {
+		writeRows(w, []string{"SUMMARY", job.Summary})
+	}
+	if job.Error != "" {
+		writeRows(w, []string{"ERROR", job.Error})
+	}
+}
+
+// Helper function to turn the final status of a job into the command's error
+func jobStatusError(id, status string) error {
+	if status == api.JobSucceeded {
+		return nil
+	}
+	return fmt.Errorf("job %s %s", id, strings.ReplaceAll(status, "_", " "))
+}
+
+func clientVersion(ctx context.Context, cli *clientCLI, name string, args []string) error {
+	fs := cli.flags(name)
+	if _, err := cli.parse(fs, args, 0); err != nil {
+		return err
+	}
+	c, err := cli.client()
+	if err != nil {
+		return err
+	}
+	info, err := c.Version(ctx)
+	if err != nil {
+		return err
+	}
+	return cli.print(info, func(w io.Writer) {
+		fmt.Fprintln(w, info.String())
+	})
+}
+
+func clientOS(ctx context.Context, cli *clientCLI, name string, args []string) error {
+	fs := cli.flags(name)
+	if _, err := cli.parse(fs, args, 0); err != nil {
+		return err
+	}
+	c, err := cli.client()
+	if err != nil {
+		return err
+	}
+	release, err := c.OSInfo(ctx)
+	if err != nil {
+		return err
+	}
+	return cli.print(release, func(w io.Writer) { writeFields(w, release) })
+}
+
+func clientUname(ctx context.Context, cli *clientCLI, name string, args []string) error {
+	fs := cli.flags(name)
+	if _, err := cli.parse(fs, args, 0); err != nil {
+		return err
+	}
+	c, err := cli.client()
+	if err != nil {
+		return err
+	}
+	uname, err := c.Uname(ctx)
+	if err != nil {
+		return err
+	}
+	return cli.print(uname, func(w io.Writer) { writeFields(w, uname) })
+}
+
+func clientPackagesList(ctx context.Context, cli *clientCLI, name string, args []string) error {
+	fs := cli.flags(name)
+	manager := fs.String("manager", "", "Package manager to list: system (default), snap, flatpak, or all")
+	groups := fs.Bool("groups", false, "Also list the installed package groups on RPM hosts")
+	if _, err := cli.parse(fs, args, 0); err != nil {
+		return err
+	}
+	c, err := cli.client()
+	if err != nil {
+		return err
+	}
+	list, err := c.ListPackages(ctx, client.ListPackagesOptions{Manager: *manager, Groups: *groups})
+	if err != nil {
+		return err
+	}
+	for _, warning := range append(list.Warnings, list.GroupsWarning) {
+		if warning != "" {
+			fmt.Fprintln(os.Stderr, "warning:", warning)
+		}
+	}
+	return cli.print(list, func(w io.Writer) {
+		writeRows(w, []string{"NAME", "MANAGER", "VERSION"})
+		for _, pkg := range list.InstalledPackages {
+			writeRows(w, []string{pkg, "system", ""})
+		}
+		for _, group := range list.InstalledGroups {
+			writeRows(w, []string{group, "group", ""})
+		}
+		for _, packages := range [][]api.InstalledPackage{list.Packages, list.Snaps, list.Flatpaks} {
+			for _, pkg := range packages {
+				writeRows(w, []string{pkg.Name, pkg.Manager, pkg.Version})
+			}
+		}
+	})
+}
+
+func clientPackagesApply(ctx context.Context, cli *clientCLI, name string, args []string) error {
+	fs := cli.flags(name)
+	file := fs.String("f", "", "Manifest to apply, or - for standard input")
+	watch := fs.Bool("watch", false, "Stream the transaction's output to standard error as it runs")
+	lockWait := fs.Duration("wait-for-lock", 0, "How long the agent waits for another package manager to finish")
+	if _, err := cli.parse(fs, args, 0); err != nil {
+		return err
+	}
+	if *file == "" {
+		return &usageError{"-f is required"}
+	}
+	var manifest []byte
+	var err error
+	if *file == "-" {
+		manifest, err = io.ReadAll(os.Stdin)
+	} else {
+		manifest, err = os.ReadFile(*file)
+	}
+	if err != nil {
+		return err
+	}
+	c, err := cli.client()
+	if err != nil {
+		return err
+	}
+
+	var result *api.ApplyPackagesResponse
+	call := func(ctx context.Context) error {
+		result, err = c.ApplyPackages(ctx, manifest, client.ApplyOptions{WaitForLock: *lockWait})
+		return err
+	}
+	if *watch {
+		err = followJobCall(ctx, c, call)
+	} else {
+		err = call(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	// The agent answers 200 when only the manifest's verify checks failed
+	status := api.JobSucceeded
+	for _, check := range result.Verification {
+		if !check.Passed {
+			status = api.JobVerificationFailed
+		}
+	}
+	err = cli.print(result, func(w io.Writer) {
+		writeRows(w, []string{"PACKAGE", "ACTION", "OPTIONS"})
+		for _, outcome := range append(result.Packages, result.Autoremoved...) {
+			writeRows(w, []string{outcome.Name, outcome.Action, strings.Join(outcome.Options, ",")})
+		}
+		for _, check := range result.Verification {
+			if !check.Passed {
+				fmt.Fprintf(w, "\nCheck %s %s failed: %s", check.Check, check.Target, check.Detail)
+			}
+		}
+		fmt.Fprintf(w, "\nJob %s %s\n", result.JobID, strings.ReplaceAll(status, "_", " "))
+	})
+	if err != nil {
+		return err
+	}
+	return jobStatusError(result.JobID, status)
+}
+
+func clientKubernetesStatus(ctx context.Context, cli *clientCLI, name string, args []string) error {
+	fs := cli.flags(name)
+	if _, err := cli.parse(fs, args, 0); err != nil {
+		return err
+	}
+	c, err := cli.client()
+	if err != nil {
+		return err
+	}
+	status, err := c.KubernetesStatus(ctx)
+	if err != nil {
+		return err
+	}
+	return cli.print(status, func(w io.Writer) {
+		writeRows(w, []string{"INSTALLED"}, []string{fmt.Sprint(status.Installed)})
+	})
+}
+
+func clientKubernetesBootstrap(ctx context.Context, cli *clientCLI, name string, args []string) error {
+	fs := cli.flags(name)
+	follow := fs.Bool("follow", false, "Stream the bootstrap's output to standard error as it runs")
+	lockWait := fs.Duration("wait-for-lock", 0, "How long the agent waits for another package manager to finish")
+	if _, err := cli.parse(fs, args, 0); err != nil {
+		return err
+	}
+	c, err := cli.client()
+	if err != nil {
+		return err
+	}
+
+	var result *api.BootstrapResult
+	call := func(ctx context.Context) error {
+		result, err = c.BootstrapKubernetes(ctx, client.ApplyOptions{WaitForLock: *lockWait})
+		return err
+	}
+	if *follow {
+		err = followJobCall(ctx, c, call)
+	} else {
+		err = call(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	return cli.print(result, func(w io.Writer) {
+		fmt.Fprintf(w, "%s (job %s)\n", result.Message, result.JobID)
+	})
+}
+
+func clientJobsList(ctx context.Context, cli *clientCLI, name string, args []string) error {
+	fs := cli.flags(name)
+	if _, err := cli.parse(fs, args, 0); err != nil {
+		return err
+	}
+	c, err := cli.client()
+	if err != nil {
+		return err
+	}
+	list, err := c.Jobs(ctx)
+	if err != nil {
+		return err
+	}
+	return cli.print(list, func(w io.Writer) {
+		writeRows(w, []string{"ID", "TYPE", "STATUS", "CREATED", "SUMMARY"})
+		for _, job := range list {
+			writeRows(w, []string{job.ID, job.Type, job.Status, formatJobTime(&job.CreatedAt), job.Summary})
+		}
+	})
+}
+
+func clientJobsGet(ctx context.Context, cli *clientCLI, name string, args []string) error {
+	fs := cli.flags(name)
+	ids, err := cli.parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	c, err := cli.client()
+	if err != nil {
+		return err
+	}
+	job, err := c.Job(ctx, ids[0])
+	if err != nil {
+		return err
+	}
+	return cli.print(job, func(w io.Writer) { writeJob(w, job) })
+}
+
+func clientJobsWait(ctx context.Context, cli *clientCLI, name string, args []string) error {
+	fs := cli.flags(name)
+	ids, err := cli.parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	c, err := cli.client()
+	if err != nil {
+		return err
+	}
+	job, err := c.WaitJob(ctx, ids[0], 0)
+	if err != nil {
+		return err
+	}
+	if err := cli.print(job, func(w io.Writer) { writeJob(w, job) }); err != nil {
+		return err
+	}
+	return jobStatusError(job.ID, job.Status)
+}
+
+func clientJobsLogs(ctx context.Context, cli *clientCLI, name string, args []string) error {
+	fs := cli.flags(name)
+	follow := fs.Bool("follow", false, "Keep printing output until the job finishes")
+	ids, err := cli.parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	c, err := cli.client()
+	if err != nil {
+		return err
+	}
+	if !*follow {
+		_, err := c.JobOutput(ctx, ids[0], os.Stdout)
+		return err
+	}
+	status, err := c.FollowJobOutput(ctx, ids[0], os.Stdout, clientFollowInterval)
+	if err != nil {
+		return err
+	}
+	return jobStatusError(ids[0], status)
+}
+
+func clientJobsCancel(ctx context.Context, cli *clientCLI, name string, args []string) error {
+	fs := cli.flags(name)
+	ids, err := cli.parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	c, err := cli.client()
+	if err != nil {
+		return err
+	}
+	job, err := c.CancelJob(ctx, ids[0])
+	if err != nil {
+		return err
+	}
+	return cli.print(job, func(w io.Writer) { writeJob(w, job) })
+}
+
+// Function to run a call that creates a job while streaming the job's output to standard
+// error. The operation endpoints only answer once the job is done, so the job is found
+// in the agent's job.started events by the request ID the call is sent with.
+func followJobCall(ctx context.Context, c *client.Client, call func(ctx context.Context) error) error {
+	requestID := newID()
+	stream, err := c.OpenEvents(ctx, client.EventOptions{Types: []string{"job.started"}})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: not following the job's output: %v\n", err)
+		return call(ctx)
+	}
+	defer stream.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- call(client.WithRequestID(ctx, requestID))
+	}()
+	found := make(chan string, 1)
+	go func() {
+		for {
+			event, err := stream.Next()
+			if err != nil {
+				return
+			}
+			if event.Details["request_id"] == requestID {
+				if id, ok := event.Details["job_id"].(string); ok {
+					found <- id
+				}
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-done:
+		// The call returned before its job was seen, like a refused manifest, so there
+		// is nothing left to follow
+		return err
+	case id := <-found:
+		stream.Close()
+		fmt.Fprintf(os.Stderr, "Following job %s\n", id)
+		if _, err := c.FollowJobOutput(ctx, id, os.Stderr, clientFollowInterval); err != nil && ctx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "warning: following job %s: %v\n", id, err)
+		}
+		return <-done
+	}
+}
@@ -0,0 +1,318 @@
+// Package client is a typed Go client of the cosi agent's HTTP API. Its methods return
+// the payload types of the api package, which the agent itself serves.
+//
+//	c, err := client.New("http://host:8080", client.WithToken(token))
+//	if err != nil {
+//		return err
+//	}
+//	result, err := c.ApplyPackages(ctx, manifest, client.ApplyOptions{})
+//	var apiErr *client.Error
+//	if errors.As(err, &apiErr) && apiErr.Code == "package_manager_busy" {
+//		// retry later
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rothgar/cosi/api"
+	"github.com/rothgar/cosi/signing"
+)
+
+// Header the agent names the job of an operation in, on failures too
+const jobIDHeader = "X-Cosi-Job-Id"
+
+// Client calls one agent. It is safe for concurrent use.
+type Client struct {
+	baseURL *url.URL
+	http    *http.Client
+	// token is sent as a bearer token, or signs requests when keyID is set
+	token string
+	keyID string
+	// tlsConfig is applied to the transport of the default HTTP client
+	tlsConfig *tls.Config
+	userAgent string
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithToken authenticates requests with a bearer token of the agent's auth.tokens
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+		c.keyID = ""
+	}
+}
+
+// WithHMAC signs requests with the secret of the token named keyID instead of sending it,
+// for agents that accept signed requests
+func WithHMAC(keyID, secret string) Option {
+	return func(c *Client) {
+		c.token = secret
+		c.keyID = keyID
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used to reach an https agent, like the CA
+// that signed its certificate or a client certificate
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = config
+	}
+}
+
+// WithHTTPClient sends requests with httpClient instead of a client of the package's own.
+// WithTLSConfig doesn't apply to it.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.http = httpClient
+	}
+}
+
+// WithUserAgent sets the User-Agent header of requests
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
+}
+
+// New returns a client of the agent at baseURL, like http://host:8080
+func New(baseURL string, options ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("base URL %q must be an http or https URL", baseURL)
+	}
+	c := &Client{baseURL: u, userAgent: "cosi-client"}
+	for _, option := range options {
+		option(c)
+	}
+	if c.http == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if c.tlsConfig != nil {
+			transport.TLSClientConfig = c.tlsConfig
+		}
+		// Package transactions and bootstraps answer once they are done, so there is no
+		// overall timeout; contexts bound each call instead
+		c.http = &http.Client{Transport: transport}
+	}
+	return c, nil
+}
+
+// Error is an error response of the agent. Code is the agent's stable identifier of the
+// error, empty for the errors that have none.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// JobID is the job the failed operation ran as, when it got that far
+	JobID string
+	// Body is the full response, for the fields some errors add, like the holders of
+	// a package_manager_busy error
+	Body json.RawMessage
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("cosi: %s (%d %s)", e.Message, e.StatusCode, e.Code)
+	}
+	return fmt.Sprintf("cosi: %s (%d)", e.Message, e.StatusCode)
+}
+
+// IsCode reports whether err is an Error of the agent with the given code
+func IsCode(err error, code string) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+// Helper function to build a request to path, relative to the base URL
+func (c *Client) newRequest(ctx context.Context, method, path string, query url.Values, body []byte, contentType string) (*http.Request, error) {
+	u := *c.baseURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = query.Encode()
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	req.Header.Set("Accept", "application/json")
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok && id != "" {
+		req.Header.Set("X-Request-Id", id)
+	}
+	if body != nil && contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	switch {
+	case c.keyID != "":
+		if err := signing.SignRequest(req, c.keyID, []byte(c.token), time.Now()); err != nil {
+			return nil, err
+		}
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// Helper function to send a request, turning error statuses into an *Error. The caller
+// must close the body of the response.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// Helper function to read the error of a failed response
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	apiErr := &Error{StatusCode: resp.StatusCode, JobID: resp.Header.Get(jobIDHeader), Message: http.StatusText(resp.StatusCode)}
+	var payload api.ErrorResponse
+	if json.Unmarshal(body, &payload) == nil {
+		apiErr.Body = body
+		if payload.Error != "" {
+			apiErr.Message = payload.Error
+		}
+		apiErr.Code = payload.Code
+	} else if text := strings.TrimSpace(string(body)); text != "" {
+		apiErr.Message = text
+	}
+	return apiErr
+}
+
+// Helper function to call an endpoint and decode its JSON response into out
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body []byte, contentType string, out interface{}) error {
+	req, err := c.newRequest(ctx, method, path, query, body, contentType)
+	if err != nil {
+		return err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding the response of %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// Version returns the build of the agent
+func (c *Client) Version(ctx context.Context) (*api.VersionInfo, error) {
+	var info api.VersionInfo
+	if err := c.do(ctx, http.MethodGet, "/version", nil, nil, "", &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// OSInfo returns the host's /etc/os-release
+func (c *Client) OSInfo(ctx context.Context) (api.OSRelease, error) {
+	var release api.OSRelease
+	if err := c.do(ctx, http.MethodGet, "/os", nil, nil, "", &release); err != nil {
+		return nil, err
+	}
+	return release, nil
+}
+
+// Uname returns the fields of the host's uname
+func (c *Client) Uname(ctx context.Context) (api.Uname, error) {
+	var uname api.Uname
+	if err := c.do(ctx, http.MethodGet, "/uname", nil, nil, "", &uname); err != nil {
+		return nil, err
+	}
+	return uname, nil
+}
+
+// ListPackagesOptions selects what ListPackages returns
+type ListPackagesOptions struct {
+	// Manager is system, the default, snap, flatpak, or all
+	Manager string
+	// Groups adds the installed package groups on RPM hosts
+	Groups bool
+}
+
+// ListPackages returns the installed packages
+func (c *Client) ListPackages(ctx context.Context, options ListPackagesOptions) (*api.PackageList, error) {
+	query := url.Values{}
+	if options.Manager != "" {
+		query.Set("manager", options.Manager)
+	}
+	if options.Groups {
+		query.Set("groups", "true")
+	}
+	var list api.PackageList
+	if err := c.do(ctx, http.MethodGet, "/packages", query, nil, "", &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// ApplyOptions are the options of ApplyPackages and BootstrapKubernetes
+type ApplyOptions struct {
+	// WaitForLock is how long the agent waits for another package manager, like
+	// unattended-upgrades, to release its locks before giving up
+	WaitForLock time.Duration
+}
+
+func (o ApplyOptions) query() url.Values {
+	query := url.Values{}
+	if o.WaitForLock > 0 {
+		query.Set("wait_for_lock_seconds", strconv.Itoa(int(o.WaitForLock.Seconds())))
+	}
+	return query
+}
+
+// ApplyPackages applies a YAML package manifest and returns once the transaction is done.
+// The transaction runs as a job, whose output can be followed with FollowJobOutput.
+func (c *Client) ApplyPackages(ctx context.Context, manifest []byte, options ApplyOptions) (*api.ApplyPackagesResponse, error) {
+	var result api.ApplyPackagesResponse
+	if err := c.do(ctx, http.MethodPost, "/packages", options.query(), manifest, "application/yaml", &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// KubernetesStatus reports whether Kubernetes is installed on the host
+func (c *Client) KubernetesStatus(ctx context.Context) (*api.KubernetesStatus, error) {
+	var status api.KubernetesStatus
+	if err := c.do(ctx, http.MethodGet, "/kubernetes", nil, nil, "", &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// BootstrapKubernetes installs Kubernetes and bootstraps a cluster on the host, returning
+// once it is done
+func (c *Client) BootstrapKubernetes(ctx context.Context, options ApplyOptions) (*api.BootstrapResult, error) {
+	var result api.BootstrapResult
+	if err := c.do(ctx, http.MethodPost, "/kubernetes", options.query(), []byte{}, "", &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
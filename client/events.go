@@ -0,0 +1,99 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rothgar/cosi/api"
+)
+
+// requestIDKey is the context key of WithRequestID
+type requestIDKey struct{}
+
+// WithRequestID returns a context whose requests carry id as their X-Request-Id. The agent
+// logs it and records it on the jobs the request creates, which lets a client find the
+// job of a call that hasn't returned yet in the job.started events.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// EventOptions selects the events OpenEvents streams
+type EventOptions struct {
+	// Types are categories like job or full types like job.finished; empty for all events
+	Types []string
+	// Since is an event ID or an RFC 3339 time; the stream starts with the stored events
+	// after it. Empty means all stored events.
+	Since string
+}
+
+// EventStream is an open stream of events, read with Next
+type EventStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+}
+
+// OpenEvents opens the agent's event stream. It returns once the agent has accepted it;
+// read the events with Next and Close the stream when done.
+func (c *Client) OpenEvents(ctx context.Context, options EventOptions) (*EventStream, error) {
+	query := url.Values{}
+	if len(options.Types) > 0 {
+		query.Set("type", strings.Join(options.Types, ","))
+	}
+	if options.Since != "" {
+		query.Set("since", options.Since)
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, "/events/stream", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	return &EventStream{body: resp.Body, scanner: scanner}, nil
+}
+
+// Next blocks until the next event arrives. It returns io.EOF once the agent has closed
+// the stream, and an error once the stream's context is done.
+func (s *EventStream) Next() (api.Event, error) {
+	var data strings.Builder
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		switch {
+		case line == "":
+			// A blank line ends an event; keepalive comments leave no data behind
+			if data.Len() == 0 {
+				continue
+			}
+			var event api.Event
+			if err := json.Unmarshal([]byte(data.String()), &event); err != nil {
+				return event, fmt.Errorf("decoding an event: %w", err)
+			}
+			return event, nil
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// id and event fields repeat what the data holds; comments are skipped
+	}
+	if err := s.scanner.Err(); err != nil {
+		return api.Event{}, err
+	}
+	return api.Event{}, io.EOF
+}
+
+// Close closes the stream
+func (s *EventStream) Close() error {
+	return s.body.Close()
+}
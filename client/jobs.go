@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rothgar/cosi/api"
+)
+
+// Interval WaitJob and FollowJobOutput poll at unless told otherwise
+const defaultPollInterval = time.Second
+
+// Job returns a job by its ID
+func (c *Client) Job(ctx context.Context, id string) (*api.Job, error) {
+	var job api.Job
+	if err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id), nil, nil, "", &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Jobs returns the recent jobs of the agent
+func (c *Client) Jobs(ctx context.Context) ([]api.Job, error) {
+	var response struct {
+		Jobs []api.Job `json:"jobs"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/jobs", nil, nil, "", &response); err != nil {
+		return nil, err
+	}
+	return response.Jobs, nil
+}
+
+// CancelJob cancels a queued or running job. A running job is reported as it is when the
+// request arrives; WaitJob returns it once it has stopped.
+func (c *Client) CancelJob(ctx context.Context, id string) (*api.Job, error) {
+	var job api.Job
+	if err := c.do(ctx, http.MethodDelete, "/jobs/"+url.PathEscape(id), nil, nil, "", &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// WaitJob polls a job every interval, or every second when interval is 0, until it has
+// finished or ctx is done
+func (c *Client) WaitJob(ctx context.Context, id string, interval time.Duration) (*api.Job, error) {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	for {
+		job, err := c.Job(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if job.Finished() {
+			return job, nil
+		}
+		select {
+		case <-ctx.Done():
+			return job, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// FollowJobOutput copies the output of a job to w as it is written, polling every
+// interval, or every second when interval is 0. It returns the job's final status once
+// the job has finished and its output is copied.
+func (c *Client) FollowJobOutput(ctx context.Context, id string, w io.Writer, interval time.Duration) (string, error) {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	var offset int64
+	for {
+		n, status, err := c.readJobOutput(ctx, id, offset, w)
+		offset += n
+		if err != nil {
+			return status, err
+		}
+		if status != api.JobQueued && status != api.JobRunning {
+			return status, nil
+		}
+		// More may have arrived while reading; poll again right away if so
+		if n > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// JobOutput copies the output a job has written so far to w and returns the job's status
+func (c *Client) JobOutput(ctx context.Context, id string, w io.Writer) (string, error) {
+	_, status, err := c.readJobOutput(ctx, id, 0, w)
+	return status, err
+}
+
+// Helper function to copy the output of a job from offset on, returning how much was
+// copied and the status the job had when it was read
+func (c *Client) readJobOutput(ctx context.Context, id string, offset int64, w io.Writer) (int64, string, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id)+"/output", nil, nil, "")
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Accept", "text/plain")
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	status := resp.Header.Get("X-Cosi-Job-Status")
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		n, err := io.Copy(w, resp.Body)
+		return n, status, err
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Nothing was written since the last read
+		return 0, status, nil
+	}
+	return 0, status, responseError(resp)
+}
+
+// DecodeResult decodes the result of a finished job into out, like an
+// *api.PackageApplyResult for a packages job
+func DecodeResult(job *api.Job, out interface{}) error {
+	data, err := json.Marshal(job.Result)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
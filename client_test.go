@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rothgar/cosi/api"
+	"github.com/rothgar/cosi/client"
+)
+
+// Helper function to serve the job endpoints behind the agent's signature check, and
+// return a client of the server with options
+func clientServer(t *testing.T, options ...client.Option) *client.Client {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(limitRequestBody)
+	r.Use(verifySignature)
+	r.GET("/version", func(c *gin.Context) {
+		c.JSON(200, versionInfo())
+	})
+	registerJobRoutes(r)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	c, err := client.New(server.URL, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Helper function to run a job whose command is script, finishing it with result. The
+// test waits for the job to finish before it ends.
+func runClientJob(t *testing.T, script string, result interface{}) *Job {
+	t.Helper()
+	fakeCommand(t, "kubeadm", script)
+	job := jobs.New(context.Background(), "kubernetes")
+	control := jobs.Control(job)
+	jobs.Start(job)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer control.Close()
+		_, err := runJobCommand(newCommand("kubeadm", "init"), control)
+		jobs.Finish(job, result, "done", err)
+	}()
+	t.Cleanup(func() { <-done })
+	return job
+}
+
+func TestClientFollowsJob(t *testing.T) {
+	withJobStore(t)
+	withConfig(t, &Config{})
+	ctx := context.Background()
+	c := clientServer(t)
+
+	info, err := c.Version(ctx)
+	if err != nil || info.Version != version {
+		t.Fatalf("Version = %+v, %v", info, err)
+	}
+
+	job := runClientJob(t, `for i in 1 2 3 4 5; do echo "[init] step $i"; sleep 0.05; done`, map[string]int{"steps": 5})
+	var output bytes.Buffer
+	status, err := c.FollowJobOutput(ctx, job.ID, &output, 10*time.Millisecond)
+	if err != nil || status != api.JobSucceeded {
+		t.Fatalf("FollowJobOutput = %s, %v", status, err)
+	}
+	if want := "[init] step 1\n[init] step 2\n[init] step 3\n[init] step 4\n[init] step 5\n"; output.String() != want {
+		t.Errorf("followed output = %q, want %q", output.String(), want)
+	}
+
+	finished, err := c.WaitJob(ctx, job.ID, 10*time.Millisecond)
+	if err != nil || finished.Status != api.JobSucceeded || finished.Summary != "done" {
+		t.Fatalf("WaitJob = %+v, %v", finished, err)
+	}
+	var result struct{ Steps int }
+	if err := client.DecodeResult(finished, &result); err != nil || result.Steps != 5 {
+		t.Errorf("DecodeResult = %+v, %v", result, err)
+	}
+
+	listed, err := c.Jobs(ctx)
+	if err != nil || len(listed) != 1 || listed[0].ID != job.ID || listed[0].OutputBytes != int64(output.Len()) {
+		t.Errorf("Jobs = %+v, %v", listed, err)
+	}
+}
+
+func TestClientCancelsJob(t *testing.T) {
+	withJobStore(t)
+	withConfig(t, &Config{})
+	ctx := context.Background()
+	c := clientServer(t)
+
+	job := runClientJob(t, `echo started; exec sleep 30`, nil)
+	var output bytes.Buffer
+	for deadline := time.Now().Add(5 * time.Second); output.Len() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the job never started")
+		}
+		c.JobOutput(ctx, job.ID, &output)
+	}
+
+	cancelled, err := c.CancelJob(ctx, job.ID)
+	if err != nil || cancelled.Status != api.JobRunning {
+		t.Fatalf("CancelJob = %+v, %v; want the job still running", cancelled, err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	finished, err := c.WaitJob(waitCtx, job.ID, 10*time.Millisecond)
+	if err != nil || finished.Status != api.JobCancelled || finished.Cancellation == nil {
+		t.Fatalf("WaitJob = %+v, %v", finished, err)
+	}
+
+	// Cancelling it again is refused with the agent's error code
+	_, err = c.CancelJob(ctx, job.ID)
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 409 || apiErr.Code != "job_finished" || !client.IsCode(err, "job_finished") {
+		t.Errorf("second CancelJob = %v, want 409 job_finished", err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	withJobStore(t)
+	withConfig(t, &Config{})
+	ctx := context.Background()
+	c := clientServer(t)
+
+	_, err := c.Job(ctx, "missing")
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 404 || apiErr.Message != "Job not found" || apiErr.Code != "" {
+		t.Errorf("Job(missing) = %v", err)
+	}
+
+	// A job without an output file, like one whose file couldn't be created
+	job := jobs.New(ctx, "packages")
+	jobs.Finish(job, nil, "done", nil)
+	if _, err := c.JobOutput(ctx, job.ID, &bytes.Buffer{}); !client.IsCode(err, "output_not_found") {
+		t.Errorf("JobOutput without a file = %v, want output_not_found", err)
+	}
+}
+
+// The client signs requests the way the agent checks them
+func TestClientSignsRequests(t *testing.T) {
+	withJobStore(t)
+	withConfig(t, &Config{Auth: AuthConfig{
+		Tokens: []TokenConfig{{Name: "ci", Token: "node-secret", Scopes: []string{scopeAdmin}}},
+		HMAC:   HMACConfig{Required: true},
+	}})
+	withFreshSignatures(t)
+	ctx := context.Background()
+
+	if _, err := clientServer(t, client.WithHMAC("ci", "node-secret")).Jobs(ctx); err != nil {
+		t.Errorf("signed Jobs = %v", err)
+	}
+	job := jobs.New(ctx, "packages")
+	if got, err := clientServer(t, client.WithHMAC("ci", "node-secret")).Job(ctx, job.ID); err != nil || got.ID != job.ID {
+		t.Errorf("signed Job = %+v, %v", got, err)
+	}
+
+	for name, tt := range map[string]struct {
+		option client.Option
+		code   string
+	}{
+		"unsigned":     {client.WithToken("node-secret"), "signature_required"},
+		"wrong secret": {client.WithHMAC("ci", "other-secret"), "invalid_signature"},
+	} {
+		_, err := clientServer(t, tt.option).Jobs(ctx)
+		if !client.IsCode(err, tt.code) || !strings.Contains(err.Error(), "401") {
+			t.Errorf("%s Jobs = %v, want 401 %s", name, err, tt.code)
+		}
+	}
+}
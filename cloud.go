@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	metadataAddress = "169.254.169.254"
+	// Budget for a whole GET /cloud, and for the probe deciding whether there is a metadata service at all
+	cloudTimeout         = 3 * time.Second
+	metadataProbeTimeout = 300 * time.Millisecond
+	// Largest metadata document read
+	maxMetadataBytes = 64 << 10
+	// Asset tag Azure sets on every VM
+	azureAssetTag = "7783-7084-3265-9085-8269-3286-77"
+)
+
+// Client for the link-local metadata services. Proxies from the environment are
+// ignored since they can't reach a link-local address, and redirects aren't followed.
+var metadataClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:       nil,
+		DialContext: (&net.Dialer{Timeout: time.Second}).DialContext,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// CloudInfo identifies the cloud platform and instance. Only this fixed set of
+// fields is read from the metadata service; arbitrary paths are never fetched.
+type CloudInfo struct {
+	Platform      string `json:"platform"` // aws, gcp, azure, or none
+	DetectedBy    string `json:"detected_by,omitempty"`
+	InstanceID    string `json:"instance_id,omitempty"`
+	InstanceType  string `json:"instance_type,omitempty"`
+	Region        string `json:"region,omitempty"`
+	Zone          string `json:"zone,omitempty"`
+	PrivateIP     string `json:"private_ip,omitempty"`
+	PublicIP      string `json:"public_ip,omitempty"`
+	Account       string `json:"account,omitempty"` // AWS account or GCP project
+	MetadataError string `json:"metadata_error,omitempty"`
+}
+
+// Function to detect the cloud platform and read the instance identity
+func detectCloud(ctx context.Context) *CloudInfo {
+	ctx, cancel := context.WithTimeout(ctx, cloudTimeout)
+	defer cancel()
+
+	info := &CloudInfo{Platform: cloudFromDMI()}
+	if info.Platform != "none" {
+		info.DetectedBy = "dmi"
+	} else {
+		// Without DMI hints, a metadata service is only worth asking when something listens on its address
+		conn, err := net.DialTimeout("tcp", metadataAddress+":80", metadataProbeTimeout)
+		if err != nil {
+			return info
+		}
+		conn.Close()
+		for _, platform := range []string{"aws", "gcp", "azure"} {
+			if err := readMetadata(ctx, platform, info); err == nil {
+				info.Platform = platform
+				info.DetectedBy = "metadata"
+				return info
+			}
+		}
+		return info
+	}
+
+	if err := readMetadata(ctx, info.Platform, info); err != nil {
+		info.MetadataError = err.Error()
+	}
+	return info
+}
+
+// Function to recognize the platform from the DMI strings the hypervisors set
+func cloudFromDMI() string {
+	vendor, _ := readDMIFile("sys_vendor")
+	product, _ := readDMIFile("product_name")
+	bios, _ := readDMIFile("bios_vendor")
+	assetTag, _ := readDMIFile("chassis_asset_tag")
+	switch {
+	case strings.HasPrefix(vendor, "Amazon EC2") || strings.HasPrefix(bios, "Amazon EC2"):
+		return "aws"
+	case vendor == "Google" || product == "Google Compute Engine":
+		return "gcp"
+	case assetTag == azureAssetTag || (vendor == "Microsoft Corporation" && product == "Virtual Machine"):
+		return "azure"
+	}
+	// Older Xen based EC2 instances only show in the hypervisor UUID
+	if data, err := os.ReadFile("/sys/hypervisor/uuid"); err == nil && strings.HasPrefix(strings.ToLower(string(data)), "ec2") {
+		return "aws"
+	}
+	return "none"
+}
+
+// Function to read the instance identity from a platform's metadata service
+func readMetadata(ctx context.Context, platform string, info *CloudInfo) error {
+	switch platform {
+	case "aws":
+		return readAWSMetadata(ctx, info)
+	case "gcp":
+		return readGCPMetadata(ctx, info)
+	case "azure":
+		return readAzureMetadata(ctx, info)
+	}
+	return fmt.Errorf("unknown platform %s", platform)
+}
+
+// Helper function to make one metadata request and return the body of a 200 response
+func metadataRequest(ctx context.Context, method, path string, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+metadataAddress+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxMetadataBytes))
+}
+
+// Function to read EC2 metadata with an IMDSv2 session token
+func readAWSMetadata(ctx context.Context, info *CloudInfo) error {
+	token, err := metadataRequest(ctx, "PUT", "/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{"X-aws-ec2-metadata-token": string(token)}
+	body, err := metadataRequest(ctx, "GET", "/latest/dynamic/instance-identity/document", headers)
+	if err != nil {
+		return err
+	}
+	var document struct {
+		InstanceID       string `json:"instanceId"`
+		InstanceType     string `json:"instanceType"`
+		Region           string `json:"region"`
+		AvailabilityZone string `json:"availabilityZone"`
+		PrivateIP        string `json:"privateIp"`
+		AccountID        string `json:"accountId"`
+	}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return err
+	}
+	info.InstanceID = document.InstanceID
+	info.InstanceType = document.InstanceType
+	info.Region = document.Region
+	info.Zone = document.AvailabilityZone
+	info.PrivateIP = document.PrivateIP
+	info.Account = document.AccountID
+	// Instances without a public address get a 404 here
+	if publicIP, err := metadataRequest(ctx, "GET", "/latest/meta-data/public-ipv4", headers); err == nil {
+		info.PublicIP = string(publicIP)
+	}
+	return nil
+}
+
+// Function to read GCE metadata
+func readGCPMetadata(ctx context.Context, info *CloudInfo) error {
+	headers := map[string]string{"Metadata-Flavor": "Google"}
+	body, err := metadataRequest(ctx, "GET", "/computeMetadata/v1/instance/?recursive=true", headers)
+	if err != nil {
+		return err
+	}
+	var instance struct {
+		ID                json.Number `json:"id"`
+		MachineType       string      `json:"machineType"` // projects/123/machineTypes/e2-medium
+		Zone              string      `json:"zone"`        // projects/123/zones/us-central1-a
+		NetworkInterfaces []struct {
+			IP            string `json:"ip"`
+			AccessConfigs []struct {
+				ExternalIP string `json:"externalIp"`
+			} `json:"accessConfigs"`
+		} `json:"networkInterfaces"`
+	}
+	if err := json.Unmarshal(body, &instance); err != nil {
+		return err
+	}
+	info.InstanceID = instance.ID.String()
+	info.InstanceType = lastPathSegment(instance.MachineType)
+	info.Zone = lastPathSegment(instance.Zone)
+	if i := strings.LastIndex(info.Zone, "-"); i > 0 {
+		info.Region = info.Zone[:i]
+	}
+	if parts := strings.Split(instance.Zone, "/"); len(parts) >= 2 && parts[0] == "projects" {
+		info.Account = parts[1]
+	}
+	if len(instance.NetworkInterfaces) > 0 {
+		nic := instance.NetworkInterfaces[0]
+		info.PrivateIP = nic.IP
+		if len(nic.AccessConfigs) > 0 {
+			info.PublicIP = nic.AccessConfigs[0].ExternalIP
+		}
+	}
+	return nil
+}
+
+// Function to read Azure Instance Metadata Service data
+func readAzureMetadata(ctx context.Context, info *CloudInfo) error {
+	headers := map[string]string{"Metadata": "true"}
+	body, err := metadataRequest(ctx, "GET", "/metadata/instance?api-version=2021-02-01", headers)
+	if err != nil {
+		return err
+	}
+	var instance struct {
+		Compute struct {
+			VMID           string `json:"vmId"`
+			VMSize         string `json:"vmSize"`
+			Location       string `json:"location"`
+			Zone           string `json:"zone"`
+			SubscriptionID string `json:"subscriptionId"`
+		} `json:"compute"`
+		Network struct {
+			Interface []struct {
+				IPv4 struct {
+					IPAddress []struct {
+						PrivateIPAddress string `json:"privateIpAddress"`
+						PublicIPAddress  string `json:"publicIpAddress"`
+					} `json:"ipAddress"`
+				} `json:"ipv4"`
+			} `json:"interface"`
+		} `json:"network"`
+	}
+	if err := json.Unmarshal(body, &instance); err != nil {
+		return err
+	}
+	info.InstanceID = instance.Compute.VMID
+	info.InstanceType = instance.Compute.VMSize
+	info.Region = instance.Compute.Location
+	info.Zone = instance.Compute.Zone
+	info.Account = instance.Compute.SubscriptionID
+	if nics := instance.Network.Interface; len(nics) > 0 && len(nics[0].IPv4.IPAddress) > 0 {
+		info.PrivateIP = nics[0].IPv4.IPAddress[0].PrivateIPAddress
+		info.PublicIP = nics[0].IPv4.IPAddress[0].PublicIPAddress
+	}
+	return nil
+}
+
+// Helper function to return what follows the last slash
+func lastPathSegment(value string) string {
+	return value[strings.LastIndex(value, "/")+1:]
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Parameters the bootloader adds on its own, which never appear in the configured cmdline
+var bootloaderParams = map[string]bool{"BOOT_IMAGE": true, "initrd": true}
+
+// Kernel parameters that change how containers and Kubernetes behave, and why
+var notableParams = map[string]string{
+	"systemd.unified_cgroup_hierarchy":         "selects cgroup v2 (1) or v1 (0) under systemd",
+	"systemd.legacy_systemd_cgroup_controller": "keeps systemd's own hierarchy on cgroup v1",
+	"cgroup_no_v1":         "disables cgroup v1 controllers",
+	"cgroup_enable":        "enables cgroup controllers, like memory on some ARM boards",
+	"cgroup_disable":       "disables cgroup controllers",
+	"swapaccount":          "toggles swap accounting in the memory controller",
+	"hugepages":            "reserves huge pages at boot",
+	"hugepagesz":           "sets the size of the huge pages reserved after it",
+	"default_hugepagesz":   "sets the default huge page size",
+	"transparent_hugepage": "sets the transparent huge page mode",
+	"isolcpus":             "keeps the scheduler off these CPUs",
+	"nohz_full":            "stops the scheduler tick on these CPUs",
+	"rcu_nocbs":            "offloads RCU callbacks from these CPUs",
+	"selinux":              "selinux=0 disables SELinux",
+	"enforcing":            "enforcing=0 boots SELinux permissive",
+	"apparmor":             "apparmor=0 disables AppArmor",
+	"security":             "selects the security module",
+	"lsm":                  "orders the security modules",
+	"psi":                  "toggles pressure stall information",
+	"numa_balancing":       "toggles automatic NUMA balancing",
+}
+
+// KernelParam is one parameter of a kernel command line. Flags have no value.
+type KernelParam struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	Flag  bool   `json:"flag,omitempty"`
+}
+
+func (p KernelParam) String() string {
+	if p.Flag {
+		return p.Key
+	}
+	return p.Key + "=" + p.Value
+}
+
+// NotableParam is a parameter that matters for containers
+type NotableParam struct {
+	KernelParam
+	Note string `json:"note"`
+}
+
+// BootEntry is the cmdline the default boot entry is configured with
+type BootEntry struct {
+	// Source is the file it was read from
+	Source     string        `json:"source"`
+	Title      string        `json:"title,omitempty"`
+	Cmdline    string        `json:"cmdline"`
+	Parameters []KernelParam `json:"parameters"`
+}
+
+// CmdlineDrift lists how the running cmdline differs from the configured one
+type CmdlineDrift struct {
+	// OnlyRunning are parameters the kernel runs with that aren't configured, and
+	// OnlyConfigured the ones that take effect at the next boot
+	OnlyRunning    []KernelParam   `json:"only_running"`
+	OnlyConfigured []KernelParam   `json:"only_configured"`
+	Changed        []ChangedParams `json:"changed"`
+}
+
+// ChangedParams is a parameter with different values running and configured
+type ChangedParams struct {
+	Key        string `json:"key"`
+	Running    string `json:"running"`
+	Configured string `json:"configured"`
+}
+
+// KernelCmdline is the response of GET /kernel/cmdline
+type KernelCmdline struct {
+	KernelRelease string         `json:"kernel_release"`
+	Cmdline       string         `json:"cmdline"`
+	Parameters    []KernelParam  `json:"parameters"`
+	Notable       []NotableParam `json:"notable"`
+	// Configured is unset when no boot entry could be read, with the reason in ConfiguredError
+	Configured      *BootEntry `json:"configured,omitempty"`
+	ConfiguredError string     `json:"configured_error,omitempty"`
+	// Drift is unset when the configured cmdline is unknown or matches the running one
+	Drift *CmdlineDrift `json:"drift,omitempty"`
+}
+
+// Function to split a kernel command line into parameters. Double quotes let a value hold
+// spaces, as in foo="bar baz", and are removed like the kernel does. The arguments after
+// "--" are passed to init and left out.
+func parseCmdline(cmdline string) []KernelParam {
+	var params []KernelParam
+	var token strings.Builder
+	quoted, started, done := false, false, false
+	flush := func() {
+		if started && token.String() == "--" {
+			done = true
+		} else if started {
+			key, value, ok := strings.Cut(token.String(), "=")
+			params = append(params, KernelParam{Key: key, Value: value, Flag: !ok})
+		}
+		token.Reset()
+		started = false
+	}
+	for _, r := range cmdline {
+		switch {
+		case r == '"':
+			quoted, started = !quoted, true
+		case (r == ' ' || r == '\t' || r == '\n') && !quoted:
+			if flush(); done {
+				return params
+			}
+		default:
+			token.WriteRune(r)
+			started = true
+		}
+	}
+	flush()
+	return params
+}
+
+// Function to read the running kernel's cmdline and compare it with the default boot entry
+func kernelCmdline() (*KernelCmdline, error) {
+	data, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return nil, err
+	}
+	release, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return nil, err
+	}
+	report := &KernelCmdline{
+		KernelRelease: strings.TrimSpace(string(release)),
+		Cmdline:       strings.TrimSpace(string(data)),
+		Notable:       []NotableParam{},
+	}
+	report.Parameters = parseCmdline(report.Cmdline)
+	for _, param := range report.Parameters {
+		if note, ok := notableParams[param.Key]; ok {
+			report.Notable = append(report.Notable, NotableParam{KernelParam: param, Note: note})
+		}
+	}
+
+	entry, err := defaultBootEntry(report.KernelRelease)
+	if err != nil {
+		report.ConfiguredError = err.Error()
+		return report, nil
+	}
+	report.Configured = entry
+	report.Drift = cmdlineDrift(report.Parameters, entry.Parameters)
+	return report, nil
+}
+
+// Function to compare two parameter lists, ignoring what the bootloader adds. It returns
+// nil when they match.
+func cmdlineDrift(running, configured []KernelParam) *CmdlineDrift {
+	index := func(params []KernelParam) map[string]KernelParam {
+		byKey := make(map[string]KernelParam)
+		for _, param := range params {
+			if !bootloaderParams[param.Key] {
+				// A repeated key takes its last value, as it does for most parameters
+				byKey[param.Key] = param
+			}
+		}
+		return byKey
+	}
+	runningKeys, configuredKeys := index(running), index(configured)
+	drift := &CmdlineDrift{OnlyRunning: []KernelParam{}, OnlyConfigured: []KernelParam{}, Changed: []ChangedParams{}}
+	for key, param := range runningKeys {
+		other, ok := configuredKeys[key]
+		switch {
+		case !ok:
+			drift.OnlyRunning = append(drift.OnlyRunning, param)
+		case other.String() != param.String():
+			drift.Changed = append(drift.Changed, ChangedParams{Key: key, Running: param.Value, Configured: other.Value})
+		}
+	}
+	for key, param := range configuredKeys {
+		if _, ok := runningKeys[key]; !ok {
+			drift.OnlyConfigured = append(drift.OnlyConfigured, param)
+		}
+	}
+	if len(drift.OnlyRunning) == 0 && len(drift.OnlyConfigured) == 0 && len(drift.Changed) == 0 {
+		return nil
+	}
+	sort.Slice(drift.OnlyRunning, func(i, j int) bool { return drift.OnlyRunning[i].Key < drift.OnlyRunning[j].Key })
+	sort.Slice(drift.OnlyConfigured, func(i, j int) bool { return drift.OnlyConfigured[i].Key < drift.OnlyConfigured[j].Key })
+	sort.Slice(drift.Changed, func(i, j int) bool { return drift.Changed[i].Key < drift.Changed[j].Key })
+	return drift
+}
+
+// Function to find the cmdline of the default boot entry: a Boot Loader Specification
+// entry where the distribution uses them (Fedora, RHEL), else the default menuentry of
+// grub.cfg (Debian, Ubuntu)
+func defaultBootEntry(release string) (*BootEntry, error) {
+	grubenv := readGrubenv()
+	if entry, err := blsBootEntry(release, grubenv); entry != nil || err != nil {
+		return entry, err
+	}
+	for _, path := range []string{"/boot/grub/grub.cfg", "/boot/grub2/grub.cfg"} {
+		entry, err := grubBootEntry(path, grubenv)
+		if os.IsNotExist(err) {
+			continue
+		}
+		return entry, err
+	}
+	return nil, fmt.Errorf("no boot loader entries or grub.cfg found under /boot")
+}
+
+// Helper function to read the variables of the grub environment block
+func readGrubenv() map[string]string {
+	env := make(map[string]string)
+	for _, path := range []string{"/boot/grub2/grubenv", "/boot/grub/grubenv"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if key, value, ok := strings.Cut(line, "="); ok && !strings.HasPrefix(line, "#") {
+				env[key] = value
+			}
+		}
+		break
+	}
+	return env
+}
+
+// Function to read the default Boot Loader Specification entry. It is the saved_entry of
+// grubenv or the default of loader.conf, else the entry of the running kernel. It returns
+// nil when there are no entries.
+func blsBootEntry(release string, grubenv map[string]string) (*BootEntry, error) {
+	paths, _ := filepath.Glob("/boot/loader/entries/*.conf")
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	defaultID := grubenv["saved_entry"]
+	if data, err := os.ReadFile("/boot/loader/loader.conf"); err == nil && defaultID == "" {
+		for _, line := range strings.Split(string(data), "\n") {
+			if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "default" {
+				defaultID = strings.TrimSuffix(fields[1], ".conf")
+			}
+		}
+	}
+
+	var fallback *BootEntry
+	for _, path := range paths {
+		entry, version, err := readBLSEntry(path, grubenv)
+		if err != nil {
+			continue
+		}
+		id := strings.TrimSuffix(filepath.Base(path), ".conf")
+		if defaultID != "" && id == defaultID {
+			return entry, nil
+		}
+		if fallback == nil && version == release {
+			fallback = entry
+		}
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("no boot loader entry is the default or boots kernel %s", release)
+	}
+	return fallback, nil
+}
+
+// Helper function to read the title, kernel version, and options of a BLS entry. Options
+// may refer to grubenv variables, like $kernelopts on RHEL 8.
+func readBLSEntry(path string, grubenv map[string]string) (*BootEntry, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	entry := &BootEntry{Source: path}
+	version := ""
+	var options []string
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), " ")
+		value = strings.TrimSpace(value)
+		switch key {
+		case "title":
+			entry.Title = value
+		case "version":
+			version = value
+		case "options":
+			options = append(options, os.Expand(value, func(name string) string { return grubenv[name] }))
+		}
+	}
+	entry.Cmdline = strings.Join(options, " ")
+	entry.Parameters = parseCmdline(entry.Cmdline)
+	return entry, version, nil
+}
+
+// Function to read the cmdline of the default menuentry of a grub.cfg: the saved_entry
+// of grubenv, or `set default` when it is a number or title, else the first entry.
+// Submenus are searched too.
+func grubBootEntry(path string, grubenv map[string]string) (*BootEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	type menuEntry struct {
+		title, id, cmdline string
+	}
+	var entries []menuEntry
+	defaultEntry := ""
+	variables := make(map[string]string)
+	current := -1
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "set default="):
+			defaultEntry = strings.Trim(strings.TrimPrefix(line, "set default="), `"'`)
+		case strings.HasPrefix(line, "set ") && current < 0:
+			// Variables like vt_handoff that the linux lines refer to
+			if name, value, ok := strings.Cut(strings.TrimPrefix(line, "set "), "="); ok {
+				variables[name] = strings.Trim(value, `"'`)
+			}
+		case strings.HasPrefix(line, "menuentry "):
+			words := grubWords(strings.TrimPrefix(line, "menuentry "))
+			entry := menuEntry{}
+			for i, word := range words {
+				if i == 0 {
+					entry.title = word
+				}
+				if word == "$menuentry_id_option" && i+1 < len(words) {
+					entry.id = words[i+1]
+				}
+			}
+			entries = append(entries, entry)
+			current = len(entries) - 1
+		case current >= 0 && entries[current].cmdline == "" && grubKernelLine(line):
+			// The first word is the kernel image
+			if words := grubWords(line); len(words) > 2 {
+				cmdline := os.Expand(strings.Join(words[2:], " "), func(name string) string { return variables[name] })
+				entries[current].cmdline = strings.Join(strings.Fields(cmdline), " ")
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s has no menu entries", path)
+	}
+
+	if saved := grubenv["saved_entry"]; defaultEntry == "${saved_entry}" || (defaultEntry == "" && saved != "") {
+		defaultEntry = saved
+	}
+	// A saved entry inside a submenu is "submenu>entry"
+	if i := strings.LastIndexByte(defaultEntry, '>'); i >= 0 {
+		defaultEntry = defaultEntry[i+1:]
+	}
+	chosen := entries[0]
+	// Numbers count the entries flat, which is only right outside submenus
+	if n, err := strconv.Atoi(defaultEntry); err == nil && n >= 0 && n < len(entries) {
+		chosen = entries[n]
+	} else {
+		for _, entry := range entries {
+			if entry.title == defaultEntry || (entry.id != "" && entry.id == defaultEntry) {
+				chosen = entry
+				break
+			}
+		}
+	}
+	return &BootEntry{Source: path, Title: chosen.title, Cmdline: chosen.cmdline, Parameters: parseCmdline(chosen.cmdline)}, nil
+}
+
+// Helper function to check if a line of grub.cfg loads the kernel
+func grubKernelLine(line string) bool {
+	fields := strings.Fields(line)
+	return len(fields) > 0 && (fields[0] == "linux" || fields[0] == "linuxefi" || fields[0] == "linux16")
+}
+
+// Helper function to split a line of grub.cfg into words, removing single and double quotes
+func grubWords(line string) []string {
+	var words []string
+	var word strings.Builder
+	quote, started := rune(0), false
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '\'' || r == '"'):
+			quote, started = r, true
+		case quote == 0 && (r == ' ' || r == '\t'):
+			if started {
+				words = append(words, word.String())
+			}
+			word.Reset()
+			started = false
+		default:
+			word.WriteRune(r)
+			started = true
+		}
+	}
+	if started {
+		words = append(words, word.String())
+	}
+	return words
+}
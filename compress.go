@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Responses smaller than this are sent uncompressed unless compression.min_bytes says otherwise
+const defaultCompressMinBytes = 1024
+
+// CompressionConfig controls gzip compression of responses
+type CompressionConfig struct {
+	Disabled bool `yaml:"disabled"`
+	// MinBytes is the smallest response body that gets compressed
+	MinBytes int `yaml:"min_bytes"`
+}
+
+// Content types sent as they are: streams must reach the client event by event, and
+// compressed formats don't shrink any further
+var uncompressedTypes = []string{
+	"text/event-stream",
+	"application/x-ndjson",
+	"application/gzip",
+	"application/zip",
+	"application/octet-stream",
+	"image/",
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+	return w
+}}
+
+// Middleware to gzip responses for clients that accept it. The body is held back until
+// it reaches the size threshold, so small responses keep their Content-Length and skip
+// the gzip overhead.
+func compressResponses(c *gin.Context) {
+	cfg := currentConfig().Compression
+	if cfg.Disabled || c.Request.Method == "HEAD" || !acceptsGzip(c.GetHeader("Accept-Encoding")) {
+		c.Next()
+		return
+	}
+	minBytes := cfg.MinBytes
+	if minBytes <= 0 {
+		minBytes = defaultCompressMinBytes
+	}
+
+	writer := &gzipResponseWriter{ResponseWriter: c.Writer, minBytes: minBytes}
+	c.Writer = writer
+	defer writer.finish()
+	c.Next()
+}
+
+// gzipResponseWriter buffers the start of a response until it knows whether to compress it
+type gzipResponseWriter struct {
+	gin.ResponseWriter
+	minBytes int
+	buffer   bytes.Buffer
+	// decided is set once the response is committed to being compressed or passed through
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		w.buffer.Write(data)
+		if w.buffer.Len() < w.minBytes {
+			return len(data), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *gzipResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Written reports buffered output as written so gin doesn't send a second header
+func (w *gzipResponseWriter) Written() bool {
+	return w.buffer.Len() > 0 || w.ResponseWriter.Written()
+}
+
+// Flush sends what is buffered. A handler flushing before the threshold is streaming,
+// so its response is passed through uncompressed rather than delayed.
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Helper function to commit to compressing the response or not and send the buffered start
+func (w *gzipResponseWriter) decide(compress bool) error {
+	w.decided = true
+	header := w.Header()
+	header.Add("Vary", "Accept-Encoding")
+	if compress && compressible(w.Status(), header.Get("Content-Type"), header.Get("Content-Encoding")) {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		// The compressed body is a different representation, so a strong ETag becomes weak
+		if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			header.Set("ETag", "W/"+etag)
+		}
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+		_, err := w.gz.Write(w.buffer.Bytes())
+		w.buffer.Reset()
+		return err
+	}
+	if w.buffer.Len() == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(w.buffer.Bytes())
+	w.buffer.Reset()
+	return err
+}
+
+// Helper function to complete the response once the handlers are done
+func (w *gzipResponseWriter) finish() {
+	if !w.decided {
+		// Below the threshold: send the body as it is
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+		gzipWriters.Put(w.gz)
+		w.gz = nil
+	}
+}
+
+// Helper function to check whether a response is worth compressing
+func compressible(status int, contentType, contentEncoding string) bool {
+	// The ranges of a partial response are of the uncompressed body
+	if status < 200 || status == 204 || status == 206 || status == 304 || contentEncoding != "" {
+		return false
+	}
+	for _, prefix := range uncompressedTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Helper function to check whether an Accept-Encoding header allows gzip
+func acceptsGzip(header string) bool {
+	accepted := false
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(value, 64); err == nil {
+				quality = q
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip":
+			// An explicit entry overrides the wildcard
+			return quality > 0
+		case "*":
+			accepted = quality > 0
+		}
+	}
+	return accepted
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Helper function to build an engine serving a package list the size of a full host's
+// as GET /packages does, with its ETag
+func largePackagesEngine(names []string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(compressResponses)
+	r.GET("/packages", func(c *gin.Context) {
+		if notModified(c, entityTag("packages", "test"), time.Time{}) {
+			return
+		}
+		c.JSON(200, gin.H{"installed_packages": names})
+	})
+	r.GET("/small", func(c *gin.Context) {
+		c.JSON(200, gin.H{"name": "cosi"})
+	})
+	return r
+}
+
+// Helper function to make a list of package names like dpkg-query prints
+func packageNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("lib%s-package-%d", []string{"ssl", "gtk", "python3", "perl"}[i%4], i)
+	}
+	return names
+}
+
+func TestLargeResponseRoundTrip(t *testing.T) {
+	withConfig(t, &Config{})
+	names := packageNames(3000)
+	r := largePackagesEngine(names)
+
+	req := httptest.NewRequest("GET", "/packages", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Vary") == "" {
+		t.Fatalf("headers = %v, want a gzipped response", w.Header())
+	}
+	etag := w.Header().Get("ETag")
+	if etag != "W/"+entityTag("packages", "test") {
+		t.Errorf("ETag = %s, want the weak form of the list's tag", etag)
+	}
+	compressed := w.Body.Len()
+	reader, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response struct {
+		InstalledPackages []string `json:"installed_packages"`
+	}
+	if err := json.Unmarshal(plain, &response); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(response.InstalledPackages, names) {
+		t.Error("the decompressed list differs from the one sent")
+	}
+	if compressed*4 > len(plain) {
+		t.Errorf("compressed %d bytes to %d", len(plain), compressed)
+	}
+
+	// The weak tag of the compressed copy still validates the list
+	req = httptest.NewRequest("GET", "/packages", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 304 || w.Body.Len() != 0 || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("revalidation = %d %v with %d bytes, want an empty 304", w.Code, w.Header(), w.Body.Len())
+	}
+}
+
+// Go clients, like the client package, ask for gzip and decompress it on their own
+func TestLargeResponseThroughHTTPClient(t *testing.T) {
+	withConfig(t, &Config{})
+	names := packageNames(3000)
+	server := httptest.NewServer(largePackagesEngine(names))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var response struct {
+		InstalledPackages []string `json:"installed_packages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Uncompressed || !reflect.DeepEqual(response.InstalledPackages, names) {
+		t.Errorf("uncompressed %v, %d packages", resp.Uncompressed, len(response.InstalledPackages))
+	}
+}
+
+func TestSmallAndUnwantedResponsesUncompressed(t *testing.T) {
+	withConfig(t, &Config{})
+	r := largePackagesEngine(packageNames(3000))
+
+	for _, tt := range []struct {
+		path, acceptEncoding string
+	}{
+		{"/small", "gzip"},
+		{"/packages", ""},
+		{"/packages", "gzip;q=0, *"},
+		{"/packages", "br"},
+	} {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Header().Get("Content-Encoding") != "" || !json.Valid(w.Body.Bytes()) {
+			t.Errorf("%s with Accept-Encoding %q was compressed", tt.path, tt.acceptEncoding)
+		}
+	}
+
+	withConfig(t, &Config{Compression: CompressionConfig{Disabled: true}})
+	req := httptest.NewRequest("GET", "/packages", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Header().Get("Content-Encoding") != "" || !bytes.HasPrefix(w.Body.Bytes(), []byte("{")) {
+		t.Error("compressed with compression.disabled set")
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"gzip":                  true,
+		"GZIP":                  true,
+		"x-gzip":                true,
+		"deflate, gzip;q=0.5":   true,
+		"gzip;q=0":              false,
+		"*":                     true,
+		"*;q=0":                 false,
+		"gzip;q=0, *":           false,
+		"identity":              false,
+		"":                      false,
+		"br, *;q=0.1, gzip;q=1": true,
+	}
+	for header, want := range tests {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
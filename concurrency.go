@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Commands the agent runs at once unless configured otherwise
+	defaultMaxProcesses = 32
+	// Open /events/stream connections unless configured otherwise, and separately open
+	// /logs/tail follow streams
+	defaultMaxStreams = 16
+)
+
+// ConcurrencyConfig caps the work the agent does at once. Zero values use the defaults.
+// Package and Kubernetes jobs always run one at a time.
+type ConcurrencyConfig struct {
+	MaxProcesses int `yaml:"max_processes"`
+	MaxStreams   int `yaml:"max_streams"`
+}
+
+func (c ConcurrencyConfig) maxProcesses() int {
+	return int(orDefault(int64(c.MaxProcesses), defaultMaxProcesses))
+}
+
+func (c ConcurrencyConfig) maxStreams() int {
+	return int(orDefault(int64(c.MaxStreams), defaultMaxStreams))
+}
+
+// Function to check the concurrency settings
+func (c ConcurrencyConfig) validate() error {
+	if c.MaxProcesses < 0 || c.MaxStreams < 0 {
+		return fmt.Errorf("concurrency.max_processes and concurrency.max_streams must not be negative")
+	}
+	return nil
+}
+
+// fifoMutex is a mutex that is handed to waiters in the order they arrived, so the
+// queue positions GET /queue reports are the order jobs actually start in
+type fifoMutex struct {
+	mu      sync.Mutex
+	locked  bool
+	waiters []chan struct{}
+}
+
+func (m *fifoMutex) Lock() {
+	m.mu.Lock()
+	if !m.locked {
+		m.locked = true
+		m.mu.Unlock()
+		return
+	}
+	ready := make(chan struct{})
+	m.waiters = append(m.waiters, ready)
+	m.mu.Unlock()
+	// The lock is handed over still locked
+	<-ready
+}
+
+func (m *fifoMutex) Unlock() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.waiters) == 0 {
+		m.locked = false
+		return
+	}
+	close(m.waiters[0])
+	m.waiters = m.waiters[1:]
+}
+
+// processSlots limits the commands running at once. Commands over the limit wait in
+// order of arrival, and the waits are counted for GET /queue.
+type processSlots struct {
+	mu      sync.Mutex
+	running int
+	waiting []*slotWaiter
+	// Commands that had to wait, and the total time they waited
+	waited    int64
+	waitTotal time.Duration
+}
+
+type slotWaiter struct {
+	since time.Time
+	ready chan struct{}
+}
+
+var processes = &processSlots{}
+
+// acquire blocks until a command may start. The limit is read on every call so a
+// reloaded config applies to the next command.
+func (p *processSlots) acquire() {
+	p.acquireContext(context.Background())
+}
+
+// acquireContext is acquire that gives up once ctx is done, leaving the queue so the
+// commands behind it move up. It returns ctx.Err() without a slot in that case.
+func (p *processSlots) acquireContext(ctx context.Context) error {
+	p.mu.Lock()
+	if p.running < currentConfig().Concurrency.maxProcesses() && len(p.waiting) == 0 {
+		p.running++
+		p.mu.Unlock()
+		return nil
+	}
+	waiter := &slotWaiter{since: time.Now(), ready: make(chan struct{})}
+	p.waiting = append(p.waiting, waiter)
+	p.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+	case <-ctx.Done():
+		p.mu.Lock()
+		for i, w := range p.waiting {
+			if w == waiter {
+				p.waiting = append(p.waiting[:i], p.waiting[i+1:]...)
+				p.mu.Unlock()
+				return ctx.Err()
+			}
+		}
+		p.mu.Unlock()
+		// The slot was handed over as ctx was done, so pass it on
+		p.release()
+		return ctx.Err()
+	}
+	p.mu.Lock()
+	p.waited++
+	p.waitTotal += time.Since(waiter.since)
+	p.mu.Unlock()
+	return nil
+}
+
+// release frees the slot of a finished command and hands slots to waiting commands
+func (p *processSlots) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running--
+	limit := currentConfig().Concurrency.maxProcesses()
+	for p.running < limit && len(p.waiting) > 0 {
+		p.running++
+		close(p.waiting[0].ready)
+		p.waiting = p.waiting[1:]
+	}
+}
+
+// ProcessQueue describes the command slots for GET /queue
+type ProcessQueue struct {
+	Limit   int `json:"limit"`
+	Running int `json:"running"`
+	Waiting int `json:"waiting"`
+	// OldestWaitSeconds is how long the first waiting command has waited
+	OldestWaitSeconds float64 `json:"oldest_wait_seconds,omitempty"`
+	// Commands that had to wait since the agent started, and the total time they waited
+	WaitedTotal      int64   `json:"waited_total"`
+	WaitSecondsTotal float64 `json:"wait_seconds_total"`
+}
+
+// Status returns the state of the command slots
+func (p *processSlots) Status() ProcessQueue {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := ProcessQueue{
+		Limit:            currentConfig().Concurrency.maxProcesses(),
+		Running:          p.running,
+		Waiting:          len(p.waiting),
+		WaitedTotal:      p.waited,
+		WaitSecondsTotal: p.waitTotal.Seconds(),
+	}
+	if len(p.waiting) > 0 {
+		status.OldestWaitSeconds = time.Since(p.waiting[0].since).Seconds()
+	}
+	return status
+}
+
+// QueuedJob is a queued or running job as shown by GET /queue
+type QueuedJob struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	// Position is 1 for the next job to start; running jobs have none
+	Position int `json:"position,omitempty"`
+	// WaitSeconds is how long the job has been queued, or was queued before it started
+	WaitSeconds    float64 `json:"wait_seconds"`
+	RunningSeconds float64 `json:"running_seconds,omitempty"`
+}
+
+// JobQueue describes the package and Kubernetes jobs, which run one at a time
+type JobQueue struct {
+	Limit int         `json:"limit"`
+	Jobs  []QueuedJob `json:"jobs"`
+	// Jobs started since the agent started, and the total time they were queued
+	StartedTotal     int64   `json:"started_total"`
+	WaitSecondsTotal float64 `json:"wait_seconds_total"`
+}
+
+// Queue returns the queued and running jobs in the order they run
+func (s *jobStore) Queue() JobQueue {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	queue := JobQueue{Limit: 1, Jobs: []QueuedJob{}, StartedTotal: s.started, WaitSecondsTotal: s.waitTotal.Seconds()}
+	now := time.Now()
+	for _, id := range s.order {
+		job := s.jobs[id]
+		entry := QueuedJob{ID: job.ID, Type: job.Type, Status: job.Status}
+		switch job.Status {
+		case jobQueued:
+			entry.Position = s.position(job)
+			entry.WaitSeconds = now.Sub(job.CreatedAt).Seconds()
+		case jobRunning:
+			entry.WaitSeconds = job.StartedAt.Sub(job.CreatedAt).Seconds()
+			entry.RunningSeconds = now.Sub(*job.StartedAt).Seconds()
+		default:
+			continue
+		}
+		queue.Jobs = append(queue.Jobs, entry)
+	}
+	sort.SliceStable(queue.Jobs, func(i, j int) bool {
+		return queue.Jobs[i].Position < queue.Jobs[j].Position
+	})
+	return queue
+}
+
+// position returns the place of a queued job among the queued jobs, counting from 1.
+// Jobs are created in order and wait on the same lock. Callers must hold s.mu.
+func (s *jobStore) position(job *Job) int {
+	if job.Status != jobQueued {
+		return 0
+	}
+	position := 0
+	for _, id := range s.order {
+		other := s.jobs[id]
+		if other.Status == jobQueued {
+			position++
+		}
+		if other == job {
+			return position
+		}
+	}
+	return 0
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Helper function to wait until n commands are queued for a slot of p
+func waitForWaiters(t *testing.T, p *processSlots, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); p.Status().Waiting != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d commands waiting, want %d", p.Status().Waiting, n)
+		}
+	}
+}
+
+// A command whose request goes away while it waits leaves the queue, so it neither
+// starts later nor holds up the commands behind it
+func TestProcessSlotWaiterLeavesOnCancel(t *testing.T) {
+	withConfig(t, &Config{Concurrency: ConcurrencyConfig{MaxProcesses: 1}})
+	p := &processSlots{}
+	p.acquire()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned := make(chan error, 1)
+	go func() { abandoned <- p.acquireContext(ctx) }()
+	waitForWaiters(t, p, 1)
+	acquired := make(chan error, 1)
+	go func() { acquired <- p.acquireContext(context.Background()) }()
+	waitForWaiters(t, p, 2)
+
+	cancel()
+	select {
+	case err := <-abandoned:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled acquireContext = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled acquireContext is still waiting")
+	}
+	waitForWaiters(t, p, 1)
+
+	// The slot goes to the command behind the one that left
+	p.release()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Errorf("acquireContext = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the next command never got the slot")
+	}
+	if status := p.Status(); status.Running != 1 || status.Waiting != 0 || status.WaitedTotal != 1 {
+		t.Errorf("status = %+v, want one running and one wait counted", status)
+	}
+}
+
+// A read whose request is cancelled while all slots are busy is never started
+func TestCancelledReadWaitingForSlot(t *testing.T) {
+	withConfig(t, &Config{Concurrency: ConcurrencyConfig{MaxProcesses: 1}})
+	processes.acquire()
+	defer processes.release()
+
+	marker := filepath.Join(t.TempDir(), "started")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := runTrackedContext(ctx, exec.Command("/bin/touch", marker)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("runTrackedContext = %v, want context.DeadlineExceeded", err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("the command started after its request was gone")
+	}
+	if status := processes.Status(); status.Running != 1 || status.Waiting != 0 {
+		t.Errorf("status = %+v, want the cancelled read out of the queue", status)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Condition is the `when:` of a manifest entry or group. It is written as one clause
+// like "memory_gb >= 16", several joined with "and", or a list of clauses; all of
+// them must hold.
+type Condition struct {
+	Clauses []conditionClause
+}
+
+// conditionClause compares one host fact with a value
+type conditionClause struct {
+	Fact  string
+	Op    string
+	Value string
+}
+
+// How the facts of a condition compare: as plain strings, numbers, or dotted versions
+const (
+	factString  = "string"
+	factNumber  = "number"
+	factVersion = "version"
+)
+
+// Facts a condition can test, and how each compares
+var conditionFacts = map[string]string{
+	"os_id":         factString,
+	"os_version_id": factVersion,
+	"arch":          factString,
+	"memory_gb":     factNumber,
+	"hostname":      factString,
+}
+
+var conditionClausePattern = regexp.MustCompile(`^([a-z_]+)\s*(==|!=|>=|<=|>|<|\bmatches\b)\s*(.+)$`)
+
+func (c *Condition) UnmarshalYAML(node *yaml.Node) error {
+	var expressions []string
+	switch node.Kind {
+	case yaml.ScalarNode:
+		expressions = []string{node.Value}
+	case yaml.SequenceNode:
+		if err := node.Decode(&expressions); err != nil {
+			return err
+		}
+	default:
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: when must be a condition or a list of conditions", node.Line)}}
+	}
+
+	parsed, err := parseCondition(expressions)
+	if err != nil {
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: invalid condition: %v", node.Line, err)}}
+	}
+	*c = parsed
+	return nil
+}
+
+// Function to parse condition expressions, checking facts, operators, and values up front
+// so a manifest with a bad condition is refused before anything is installed
+func parseCondition(expressions []string) (Condition, error) {
+	var condition Condition
+	for _, expression := range expressions {
+		for _, text := range strings.Split(expression, " and ") {
+			clause, err := parseClause(strings.TrimSpace(text))
+			if err != nil {
+				return condition, err
+			}
+			condition.Clauses = append(condition.Clauses, clause)
+		}
+	}
+	if len(condition.Clauses) == 0 {
+		return condition, fmt.Errorf("condition is empty")
+	}
+	return condition, nil
+}
+
+// Helper function to parse one "fact op value" clause
+func parseClause(text string) (conditionClause, error) {
+	match := conditionClausePattern.FindStringSubmatch(text)
+	if match == nil {
+		return conditionClause{}, fmt.Errorf("%q is not of the form fact operator value", text)
+	}
+	clause := conditionClause{Fact: match[1], Op: match[2], Value: strings.Trim(strings.TrimSpace(match[3]), `"'`)}
+
+	kind, ok := conditionFacts[clause.Fact]
+	if !ok {
+		return clause, fmt.Errorf("unknown fact %s in %q: must be one of %s", clause.Fact, text, strings.Join(conditionFactNames(), ", "))
+	}
+	switch clause.Op {
+	case "matches":
+		if _, err := path.Match(clause.Value, ""); err != nil {
+			return clause, fmt.Errorf("invalid pattern in %q: %v", text, err)
+		}
+	case "<", "<=", ">", ">=":
+		if kind == factString {
+			return clause, fmt.Errorf("%s in %q needs a numeric or version fact", clause.Op, text)
+		}
+	}
+	if kind == factNumber && clause.Op != "matches" {
+		if _, err := strconv.ParseFloat(clause.Value, 64); err != nil {
+			return clause, fmt.Errorf("%s in %q must be compared with a number", clause.Fact, text)
+		}
+	}
+	return clause, nil
+}
+
+// Helper function to list the fact names for error messages
+func conditionFactNames() []string {
+	names := make([]string, 0, len(conditionFacts))
+	for name := range conditionFacts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// String writes the condition the way it can be given in a manifest
+func (c Condition) String() string {
+	clauses := make([]string, len(c.Clauses))
+	for i, clause := range c.Clauses {
+		clauses[i] = clause.String()
+	}
+	return strings.Join(clauses, " and ")
+}
+
+func (c conditionClause) String() string {
+	return c.Fact + " " + c.Op + " " + c.Value
+}
+
+// Function to evaluate a condition against the host facts. When it's false the failing
+// clause is described along with the value the host has.
+func (c Condition) evaluate(facts map[string]string) (bool, string) {
+	for _, clause := range c.Clauses {
+		actual, ok := facts[clause.Fact]
+		if !ok {
+			return false, fmt.Sprintf("%s is false: %s is unknown on this host", clause, clause.Fact)
+		}
+		if !clause.holds(actual) {
+			return false, fmt.Sprintf("%s is false: %s is %s", clause, clause.Fact, actual)
+		}
+	}
+	return true, ""
+}
+
+// Helper function to check one clause against the host's value of its fact
+func (c conditionClause) holds(actual string) bool {
+	if c.Op == "matches" {
+		matched, _ := path.Match(c.Value, actual)
+		return matched
+	}
+
+	var cmp int
+	switch conditionFacts[c.Fact] {
+	case factNumber:
+		a, err := strconv.ParseFloat(actual, 64)
+		if err != nil {
+			return false
+		}
+		b, _ := strconv.ParseFloat(c.Value, 64)
+		switch {
+		case a < b:
+			cmp = -1
+		case a > b:
+			cmp = 1
+		}
+	case factVersion:
+		cmp = compareDottedVersions(actual, c.Value)
+	default:
+		cmp = strings.Compare(actual, c.Value)
+	}
+
+	switch c.Op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// Helper function to compare dotted versions like 22.04 and 24.04 part by part, numerically
+// where both parts are numbers
+func compareDottedVersions(a, b string) int {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var x, y string
+		if i < len(aParts) {
+			x = aParts[i]
+		}
+		if i < len(bParts) {
+			y = bParts[i]
+		}
+		xn, xErr := strconv.Atoi(x)
+		yn, yErr := strconv.Atoi(y)
+		if xErr == nil && yErr == nil {
+			if xn != yn {
+				if xn < yn {
+					return -1
+				}
+				return 1
+			}
+			continue
+		}
+		if c := strings.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// Function to gather the facts conditions are evaluated against
+func conditionHostFacts(osRelease map[string]string) map[string]string {
+	facts := map[string]string{
+		"os_id":         osRelease["ID"],
+		"os_version_id": osRelease["VERSION_ID"],
+	}
+	if output, err := outputTracked(newCommand("uname", "-m")); err == nil {
+		facts["arch"] = strings.TrimSpace(string(output))
+	}
+	if memory, err := collectMemory(); err == nil {
+		facts["memory_gb"] = strconv.FormatFloat(float64(memory.TotalBytes)/(1<<30), 'f', 1, 64)
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		facts["hostname"] = hostname
+	}
+	for name, value := range facts {
+		if value == "" {
+			delete(facts, name)
+		}
+	}
+	return facts
+}
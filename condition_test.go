@@ -0,0 +1,165 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Facts of a 16 GB Ubuntu 22.04 worker
+var workerFacts = map[string]string{
+	"os_id":         "ubuntu",
+	"os_version_id": "22.04",
+	"arch":          "x86_64",
+	"memory_gb":     "15.6",
+	"hostname":      "worker-3",
+}
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		expressions []string
+		want        string // the condition written back, or the error
+		wantErr     bool
+	}{
+		{[]string{"memory_gb >= 16"}, "memory_gb >= 16", false},
+		{[]string{"os_id == ubuntu and os_version_id >= 22.04"}, "os_id == ubuntu and os_version_id >= 22.04", false},
+		{[]string{"arch==aarch64", "hostname matches 'gpu-*'"}, "arch == aarch64 and hostname matches gpu-*", false},
+		{[]string{`os_id != "debian"`}, "os_id != debian", false},
+		{[]string{"memory_gb matches 1*"}, "memory_gb matches 1*", false},
+
+		{[]string{}, "condition is empty", true},
+		{[]string{"kernel == 6.1"}, "unknown fact kernel", true},
+		{[]string{"os_id"}, "is not of the form fact operator value", true},
+		{[]string{"os_id > ubuntu"}, "needs a numeric or version fact", true},
+		{[]string{"memory_gb >= lots"}, "must be compared with a number", true},
+		{[]string{"hostname matches [worker"}, "invalid pattern", true},
+		{[]string{"os_id == ubuntu and  and arch == x86_64"}, "is not of the form", true},
+	}
+	for _, tt := range tests {
+		condition, err := parseCondition(tt.expressions)
+		if tt.wantErr {
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseCondition(%q) = %v, want an error containing %q", tt.expressions, err, tt.want)
+			}
+			continue
+		}
+		if err != nil || condition.String() != tt.want {
+			t.Errorf("parseCondition(%q) = %q, %v, want %q", tt.expressions, condition, err, tt.want)
+		}
+	}
+}
+
+func TestConditionEvaluate(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       bool
+		reason     string
+	}{
+		{"os_id == ubuntu", true, ""},
+		{"os_id != ubuntu", false, "os_id != ubuntu is false: os_id is ubuntu"},
+		// Versions compare part by part, so 22.04 is newer than 9.10
+		{"os_version_id >= 22.04", true, ""},
+		{"os_version_id > 9.10", true, ""},
+		{"os_version_id < 22.10", true, ""},
+		{"os_version_id == 22.4", true, ""},
+		{"os_version_id >= 24.04", false, "os_version_id >= 24.04 is false: os_version_id is 22.04"},
+		// Memory compares as a number, not a string
+		{"memory_gb >= 8", true, ""},
+		{"memory_gb >= 16", false, "memory_gb >= 16 is false: memory_gb is 15.6"},
+		{"memory_gb < 100", true, ""},
+		{"hostname matches worker-*", true, ""},
+		{"hostname matches gpu-*", false, "hostname matches gpu-* is false: hostname is worker-3"},
+		{"arch == x86_64 and memory_gb > 32", false, "memory_gb > 32 is false: memory_gb is 15.6"},
+	}
+	for _, tt := range tests {
+		condition, err := parseCondition([]string{tt.expression})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expression, err)
+		}
+		ok, reason := condition.evaluate(workerFacts)
+		if ok != tt.want || reason != tt.reason {
+			t.Errorf("%s = %v %q, want %v %q", tt.expression, ok, reason, tt.want, tt.reason)
+		}
+	}
+
+	// Facts the host couldn't collect make the condition false
+	condition, _ := parseCondition([]string{"memory_gb >= 1"})
+	if ok, reason := condition.evaluate(map[string]string{"os_id": "ubuntu"}); ok || reason != "memory_gb >= 1 is false: memory_gb is unknown on this host" {
+		t.Errorf("missing fact = %v %q", ok, reason)
+	}
+}
+
+func TestCompareDottedVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"22.04", "22.04", 0},
+		{"22.04", "24.04", -1},
+		{"9", "10", -1},
+		{"8.10", "8.9", 1},
+		{"2023", "2", 1},
+		{"12", "12.0", -1},
+		{"rolling", "rolling", 0},
+		{"39", "rawhide", -1},
+	}
+	for _, tt := range tests {
+		if got := compareDottedVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareDottedVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// Conditions on entries and groups decide what a manifest installs on a host
+func TestManifestConditions(t *testing.T) {
+	manifest := `
+packages:
+  installed:
+    - curl
+    - name: nvidia-driver-535
+      when: hostname matches gpu-*
+    - name: zram-tools
+      when: [memory_gb < 32, os_id == ubuntu]
+groups:
+  - when: os_version_id >= 22.04
+    installed: [containerd]
+  - when: os_version_id < 22.04
+    installed: [docker.io]
+    uninstalled: [containerd]
+`
+	var document manifestDocument
+	if err := yaml.Unmarshal([]byte(manifest), &document); err != nil {
+		t.Fatal(err)
+	}
+	config, _, problems := document.resolve(manifestHost{Families: []string{"ubuntu", "debian"}, Facts: workerFacts}, "")
+	if len(problems) != 0 {
+		t.Errorf("problems = %+v", problems)
+	}
+	if want := []string{"curl", "zram-tools", "containerd"}; !reflect.DeepEqual(config.Packages.Installed, want) {
+		t.Errorf("installed = %q, want %q", config.Packages.Installed, want)
+	}
+	if len(config.Packages.Uninstalled) != 0 {
+		t.Errorf("uninstalled = %q", config.Packages.Uninstalled)
+	}
+
+	var skipped []string
+	for _, entry := range config.Skipped {
+		skipped = append(skipped, entry.Field+": "+entry.Reason)
+	}
+	want := []string{
+		"packages.installed[1]: condition hostname matches gpu-* is false: hostname is worker-3",
+		"groups[1].installed[0]: group condition os_version_id < 22.04 is false: os_version_id is 22.04",
+		"groups[1].uninstalled[0]: group condition os_version_id < 22.04 is false: os_version_id is 22.04",
+	}
+	if !reflect.DeepEqual(skipped, want) {
+		t.Errorf("skipped = %q\nwant %q", skipped, want)
+	}
+
+	// A bad condition refuses the manifest with the line it's on
+	err := yaml.Unmarshal([]byte("packages:\n  installed:\n    - name: curl\n      when: cpus > 4\n"), &document)
+	if err == nil || !strings.Contains(err.Error(), "line 4: invalid condition: unknown fact cpus") {
+		t.Errorf("err = %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// packageCache keeps the last installed package list so polling clients don't run the
+// package manager on every request. A list belongs to a generation, which changes when the
+// agent changes packages and when the package database is modified outside the agent.
+type packageCache struct {
+	mu sync.Mutex
+	// Number of package transactions run by the agent
+	changes     uint64
+	generation  string
+	packages    []string
+	collectedAt time.Time
+}
+
+var installedPackages packageCache
+
+// Invalidate drops the cached list after the agent changed packages
+func (p *packageCache) Invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.changes++
+	p.generation, p.packages = "", nil
+}
+
+// Generation returns the key of the current package state. It only stats the package
+// database, so it is cheap enough to compute on every request.
+func (p *packageCache) Generation(pm packageManager) string {
+	p.mu.Lock()
+	changes := p.changes
+	p.mu.Unlock()
+	stamp, _ := fileStamp(pm.DatabasePaths()...)
+	return pm.Name() + ":" + strconv.FormatUint(changes, 10) + ":" + stamp
+}
+
+// CollectedAt returns when the list of a generation was collected, or the zero time
+// when it isn't cached
+func (p *packageCache) CollectedAt(generation string) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.packages == nil || p.generation != generation {
+		return time.Time{}
+	}
+	return p.collectedAt
+}
+
+// List returns the installed packages, running the package manager only when the
+// generation changed since the last call
+func (p *packageCache) List(ctx context.Context, pm packageManager) ([]string, time.Time, error) {
+	generation := p.Generation(pm)
+	p.mu.Lock()
+	if p.packages != nil && p.generation == generation {
+		packages, collectedAt := p.packages, p.collectedAt
+		p.mu.Unlock()
+		return packages, collectedAt, nil
+	}
+	p.mu.Unlock()
+
+	packages, err := listInstalledPackages(ctx, pm)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	collectedAt := time.Now().UTC()
+
+	// The list is stored under the generation read before listing, so a change that
+	// landed meanwhile leaves it unused instead of served as current
+	p.mu.Lock()
+	p.generation, p.packages, p.collectedAt = generation, packages, collectedAt
+	p.mu.Unlock()
+	return packages, collectedAt, nil
+}
+
+// Helper function to summarize the size and modification time of files into a key that
+// changes when any of them is rewritten. Missing files are part of the key too. The
+// latest modification time is returned alongside.
+func fileStamp(paths ...string) (string, time.Time) {
+	var parts []string
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			parts = append(parts, "-")
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%d.%d", info.ModTime().UnixNano(), info.Size()))
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return strings.Join(parts, ","), latest
+}
+
+// Helper function to build a strong entity tag from the parts identifying a representation
+func entityTag(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Helper function to answer a conditional GET. It sets the validators of the response and
+// sends 304 when If-None-Match names the current tag, in which case the handler is done.
+func notModified(c *gin.Context, etag string, modified time.Time) bool {
+	c.Header("ETag", etag)
+	c.Header("Vary", "Accept")
+	if !modified.IsZero() {
+		c.Header("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if !etagMatches(c.GetHeader("If-None-Match"), etag) {
+		return false
+	}
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+// Helper function to check an If-None-Match header against a tag. Weak tags compare equal
+// to their strong counterparts as RFC 9110 requires for If-None-Match.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
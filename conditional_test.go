@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Helper function to fake dpkg-query and apt-get, returning the file dpkg-query logs each run to
+func fakeDpkgQueryCounter(t *testing.T) string {
+	t.Helper()
+	calls := filepath.Join(t.TempDir(), "dpkg-query.calls")
+	fakeCommand(t, "dpkg-query", `echo run >> `+calls+`
+printf 'curl\nkubelet\nvim\n'`)
+	fakeCommand(t, "apt-get", `exit 0`)
+	installedPackages.Invalidate()
+	t.Cleanup(installedPackages.Invalidate)
+	return calls
+}
+
+// Helper function to count the runs logged to calls
+func countRuns(t *testing.T, calls string) int {
+	t.Helper()
+	data, err := os.ReadFile(calls)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "run\n")
+}
+
+// A client polling GET /packages with If-None-Match used to cost one dpkg-query per
+// request. Now the list is collected once per generation, and the ETag of the
+// generation answers the polls that match it with a 304 before anything runs.
+func TestPackageCacheListsOncePerGeneration(t *testing.T) {
+	calls := fakeDpkgQueryCounter(t)
+	pm := aptManager{}
+	ctx := context.Background()
+
+	generation := installedPackages.Generation(pm)
+	etag := entityTag("packages", generation, "json", "false")
+	for i := 0; i < 20; i++ {
+		packages, _, err := installedPackages.List(ctx, pm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(packages, []string{"curl", "kubelet", "vim"}) {
+			t.Fatalf("packages = %q", packages)
+		}
+	}
+	if runs := countRuns(t, calls); runs != 1 {
+		t.Errorf("20 listings ran dpkg-query %d times, want once", runs)
+	}
+	if installedPackages.CollectedAt(generation).IsZero() {
+		t.Error("the generation's list isn't cached")
+	}
+	if again := entityTag("packages", installedPackages.Generation(pm), "json", "false"); again != etag {
+		t.Errorf("ETag changed from %s to %s without a package change", etag, again)
+	}
+
+	// POST /packages applies manifests through applyPackages, which bumps the generation
+	var config PackageConfig
+	config.Packages.Installed = []string{"htop"}
+	if _, err := applyPackages(pm, config, nil); err != nil {
+		t.Fatal(err)
+	}
+	changed := installedPackages.Generation(pm)
+	if changed == generation {
+		t.Fatal("applying packages left the generation unchanged")
+	}
+	if entityTag("packages", changed, "json", "false") == etag {
+		t.Error("applying packages left the ETag unchanged")
+	}
+	if !installedPackages.CollectedAt(changed).IsZero() {
+		t.Error("the list from before the change is still served")
+	}
+	if _, _, err := installedPackages.List(ctx, pm); err != nil {
+		t.Fatal(err)
+	}
+	if runs := countRuns(t, calls); runs != 2 {
+		t.Errorf("dpkg-query ran %d times, want once more after the change", runs)
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	etag := `"abc"`
+	tests := map[string]bool{
+		`"abc"`:          true,
+		`W/"abc"`:        true,
+		`"x", "abc"`:     true,
+		`*`:              true,
+		`"abd"`:          false,
+		``:               false,
+		`abc`:            false,
+		`"x",W/"abc" , `: true,
+	}
+	for header, want := range tests {
+		if got := etagMatches(header, etag); got != want {
+			t.Errorf("etagMatches(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for header, want := range map[string]bool{`"abc"`: true, `"old"`: false, ``: false} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/packages", nil)
+		if header != "" {
+			c.Request.Header.Set("If-None-Match", header)
+		}
+		if got := notModified(c, `"abc"`, time.Date(2024, 3, 4, 10, 12, 9, 0, time.UTC)); got != want {
+			t.Errorf("If-None-Match %q: notModified = %v, want %v", header, got, want)
+		}
+		c.Writer.WriteHeaderNow()
+		if want && w.Code != 304 {
+			t.Errorf("If-None-Match %q: status %d, want 304", header, w.Code)
+		}
+		if w.Header().Get("ETag") != `"abc"` || w.Header().Get("Last-Modified") == "" {
+			t.Errorf("If-None-Match %q: validators missing from %v", header, w.Header())
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the optional agent configuration file passed with --config
+type Config struct {
+	Reconcile ReconcileConfig `yaml:"reconcile"`
+	Webhooks  []WebhookConfig `yaml:"webhooks"`
+	// Registration announces the agent to a central controller
+	Registration RegistrationConfig `yaml:"registration"`
+	Update       UpdateConfig       `yaml:"update"`
+	Auth         AuthConfig         `yaml:"auth"`
+	Certificates CertificatesConfig `yaml:"certificates"`
+	Files        FilesConfig        `yaml:"files"`
+	Compression  CompressionConfig  `yaml:"compression"`
+	Limits       LimitsConfig       `yaml:"limits"`
+	Jobs         JobsConfig         `yaml:"jobs"`
+	Concurrency  ConcurrencyConfig  `yaml:"concurrency"`
+	Schedules    SchedulesConfig    `yaml:"schedules"`
+	Allowlist    AllowlistConfig    `yaml:"allowlist"`
+	Tracing      TracingConfig      `yaml:"tracing"`
+	AccessLog    AccessLogConfig    `yaml:"access_log"`
+	Network      NetworkConfig      `yaml:"network"`
+	Proxy        ProxyConfig        `yaml:"proxy"`
+	Signatures   SignaturesConfig   `yaml:"signatures"`
+	Fleet        FleetConfig        `yaml:"fleet"`
+	Discovery    DiscoveryConfig    `yaml:"discovery"`
+	GRPC         GRPCConfig         `yaml:"grpc"`
+	Osquery      OsqueryConfig      `yaml:"osquery"`
+	Metrics      MetricsConfig      `yaml:"metrics"`
+	Logs         LogsConfig         `yaml:"logs"`
+	Plugins      PluginsConfig      `yaml:"plugins"`
+	Scripts      ScriptsConfig      `yaml:"scripts"`
+	Etcd         EtcdConfig         `yaml:"etcd"`
+	Redaction    RedactionConfig    `yaml:"redaction"`
+}
+
+// ReconcileConfig enables the pull-based package reconciliation loop
+type ReconcileConfig struct {
+	// SourceURL is the HTTP(S) location of the desired package manifest
+	SourceURL string        `yaml:"source_url"`
+	Interval  time.Duration `yaml:"interval"`
+	// SignatureURL is a minisign signature of the manifest, checked against the trusted keys
+	SignatureURL string `yaml:"signature_url"`
+}
+
+// RegistrationConfig enables registration and heartbeats to a central controller
+type RegistrationConfig struct {
+	ControllerURL string        `yaml:"controller_url"`
+	Token         string        `yaml:"token"`
+	Interval      time.Duration `yaml:"interval"`
+	// AdvertiseAddress is reported instead of --listen when the controller must use another address
+	AdvertiseAddress string `yaml:"advertise_address"`
+}
+
+// UpdateConfig controls how POST /update verifies and restarts into a new binary
+type UpdateConfig struct {
+	// PublicKey is a base64 Ed25519 key; when set every update must carry a matching signature
+	PublicKey string `yaml:"public_key"`
+	// Restart is "exec" (default) to re-exec in place or "exit" to exit with code 75 for systemd
+	Restart string `yaml:"restart"`
+}
+
+// Placeholder shown by GET /config instead of secrets
+const redacted = "REDACTED"
+
+// ConfigStatus describes where the active configuration came from
+type ConfigStatus struct {
+	Path     string     `json:"path,omitempty"`
+	LoadedAt *time.Time `json:"loaded_at,omitempty"`
+	// Outcome of the last SIGHUP reload; a failed reload keeps the previous config
+	LastReloadAt    *time.Time `json:"last_reload_at,omitempty"`
+	LastReloadError string     `json:"last_reload_error,omitempty"`
+	// Sections changed in the file that only take effect after a restart
+	RestartRequired []string `json:"restart_required,omitempty"`
+}
+
+var (
+	// activeConfig holds the loaded configuration and is swapped as a whole on reload
+	activeConfig atomic.Pointer[Config]
+
+	configMu     sync.Mutex
+	configStatus ConfigStatus
+)
+
+// Function to return the active configuration; it is empty when no file was given
+func currentConfig() *Config {
+	if cfg := activeConfig.Load(); cfg != nil {
+		return cfg
+	}
+	return &Config{}
+}
+
+// Function to install a configuration loaded from path at startup
+func setConfig(path string, cfg *Config) {
+	now := time.Now().UTC()
+	configMu.Lock()
+	configStatus.Path = path
+	configStatus.LoadedAt = &now
+	configMu.Unlock()
+	activeConfig.Store(cfg)
+}
+
+// Function to re-read the configuration file and swap in the sections that are safe
+// to change at runtime. Sections that need a restart keep their old values and are
+// logged. An invalid file leaves the active configuration untouched.
+func reloadConfig() error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	now := time.Now().UTC()
+	configStatus.LastReloadAt = &now
+	if configStatus.Path == "" {
+		configStatus.LastReloadError = "no --config file to reload"
+		return errors.New(configStatus.LastReloadError)
+	}
+
+	cfg, err := loadConfig(configStatus.Path)
+	if err != nil {
+		configStatus.LastReloadError = err.Error()
+		return err
+	}
+
+	old := currentConfig()
+	var restart []string
+	if !reflect.DeepEqual(cfg.Reconcile, old.Reconcile) {
+		restart = append(restart, "reconcile")
+		cfg.Reconcile = old.Reconcile
+	}
+	if !reflect.DeepEqual(cfg.Registration, old.Registration) {
+		restart = append(restart, "registration")
+		cfg.Registration = old.Registration
+	}
+	if cfg.GRPC != old.GRPC {
+		restart = append(restart, "grpc")
+		cfg.GRPC = old.GRPC
+	}
+	if !reflect.DeepEqual(cfg.Tracing, old.Tracing) {
+		restart = append(restart, "tracing")
+		cfg.Tracing = old.Tracing
+	}
+	if cfg.AccessLog.Destination != old.AccessLog.Destination {
+		restart = append(restart, "access_log.destination")
+		cfg.AccessLog.Destination = old.AccessLog.Destination
+	}
+	// gin reads the trusted proxies once, when the server is set up
+	if cfg.Allowlist.TrustForwardedFor != old.Allowlist.TrustForwardedFor || !reflect.DeepEqual(cfg.Allowlist.TrustedProxies, old.Allowlist.TrustedProxies) {
+		restart = append(restart, "allowlist.trusted_proxies")
+		cfg.Allowlist.TrustForwardedFor = old.Allowlist.TrustForwardedFor
+		cfg.Allowlist.TrustedProxies = old.Allowlist.TrustedProxies
+	}
+	for _, section := range restart {
+		log.Printf("Config section %q changed; restart the agent to apply it", section)
+	}
+
+	activeConfig.Store(cfg)
+	webhooks.Configure(cfg.Webhooks)
+	configStatus.LoadedAt = &now
+	configStatus.LastReloadError = ""
+	configStatus.RestartRequired = restart
+	return nil
+}
+
+// Function to return a copy of the configuration status
+func currentConfigStatus() ConfigStatus {
+	configMu.Lock()
+	defer configMu.Unlock()
+	return configStatus
+}
+
+// Function to copy the configuration with every secret replaced by a placeholder
+func (c *Config) redacted() *Config {
+	copied := *c
+	if copied.Registration.Token != "" {
+		copied.Registration.Token = redacted
+	}
+	copied.Webhooks = make([]WebhookConfig, len(c.Webhooks))
+	for i, webhook := range c.Webhooks {
+		if webhook.Secret != "" {
+			webhook.Secret = redacted
+		}
+		copied.Webhooks[i] = webhook
+	}
+	if len(c.Tracing.Headers) > 0 {
+		copied.Tracing.Headers = make(map[string]string, len(c.Tracing.Headers))
+		for name := range c.Tracing.Headers {
+			copied.Tracing.Headers[name] = redacted
+		}
+	}
+	copied.Proxy.HTTPProxy = redactProxy(c.Proxy.HTTPProxy)
+	copied.Proxy.HTTPSProxy = redactProxy(c.Proxy.HTTPSProxy)
+	copied.Fleet.Agents = make([]FleetAgent, len(c.Fleet.Agents))
+	for i, agent := range c.Fleet.Agents {
+		if agent.Token != "" {
+			agent.Token = redacted
+		}
+		copied.Fleet.Agents[i] = agent
+	}
+	copied.Auth.Tokens = make([]TokenConfig, len(c.Auth.Tokens))
+	for i, token := range c.Auth.Tokens {
+		token.Token = redacted
+		copied.Auth.Tokens[i] = token
+	}
+	return &copied
+}
+
+// Helper function to convert the configuration to a document keyed like the YAML file
+func configDocument(cfg *Config) (map[string]interface{}, error) {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]interface{}{}
+	return doc, yaml.Unmarshal(data, &doc)
+}
+
+// Function to read and validate the configuration file
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Function to check the configuration for invalid values and apply defaults
+func (c *Config) validate() error {
+	if c.Reconcile.SourceURL != "" && c.Reconcile.Interval == 0 {
+		c.Reconcile.Interval = 15 * time.Minute
+	}
+	if c.Reconcile.Interval < 0 {
+		return fmt.Errorf("reconcile.interval must be positive")
+	}
+	if c.Registration.ControllerURL != "" {
+		if !strings.HasPrefix(c.Registration.ControllerURL, "http://") && !strings.HasPrefix(c.Registration.ControllerURL, "https://") {
+			return fmt.Errorf("registration.controller_url must be http or https")
+		}
+		if c.Registration.Interval == 0 {
+			c.Registration.Interval = time.Minute
+		}
+	}
+	if c.Registration.Interval < 0 {
+		return fmt.Errorf("registration.interval must be positive")
+	}
+	switch c.Update.Restart {
+	case "":
+		c.Update.Restart = "exec"
+	case "exec", "exit":
+	default:
+		return fmt.Errorf("update.restart must be exec or exit")
+	}
+	if c.Compression.MinBytes < 0 {
+		return fmt.Errorf("compression.min_bytes must not be negative")
+	}
+	if err := c.Limits.validate(); err != nil {
+		return err
+	}
+	if err := c.Jobs.validate(); err != nil {
+		return err
+	}
+	if err := c.Concurrency.validate(); err != nil {
+		return err
+	}
+	if err := c.Schedules.validate(); err != nil {
+		return err
+	}
+	if err := c.Allowlist.validate(); err != nil {
+		return err
+	}
+	if err := c.Tracing.validate(); err != nil {
+		return err
+	}
+	if err := c.AccessLog.validate(); err != nil {
+		return err
+	}
+	if err := c.Network.validate(); err != nil {
+		return err
+	}
+	if err := c.Proxy.validate(); err != nil {
+		return err
+	}
+	if err := c.Fleet.validate(); err != nil {
+		return err
+	}
+	if err := c.Discovery.validate(); err != nil {
+		return err
+	}
+	if err := c.GRPC.validate(); err != nil {
+		return err
+	}
+	if err := c.Osquery.validate(); err != nil {
+		return err
+	}
+	if err := c.Metrics.validate(); err != nil {
+		return err
+	}
+	if err := c.Logs.validate(); err != nil {
+		return err
+	}
+	if err := c.Plugins.validate(); err != nil {
+		return err
+	}
+	if err := c.Scripts.validate(); err != nil {
+		return err
+	}
+	if err := c.Etcd.validate(); err != nil {
+		return err
+	}
+	if err := c.Redaction.validate(); err != nil {
+		return err
+	}
+	for _, token := range c.Auth.Tokens {
+		if err := token.validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.Auth.HMAC.validate(c.Auth.Tokens); err != nil {
+		return err
+	}
+	for _, webhook := range c.Webhooks {
+		if err := webhook.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Function to reload the configuration whenever the agent receives SIGHUP
+func watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			err := reloadConfig()
+			events.Emit(eventOutcome("config.reload", "configuration reloaded on SIGHUP", map[string]interface{}{"path": currentConfigStatus().Path}, err))
+			if err != nil {
+				log.Printf("Config reload failed, keeping the previous config: %v", err)
+				continue
+			}
+			log.Printf("Config reloaded from %s", currentConfigStatus().Path)
+			// Endpoint availability depends on the config, e.g. auth tokens
+			capabilities.Refresh()
+		}
+	}()
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	systemCrontab = "/etc/crontab"
+	cronDropInDir = "/etc/cron.d"
+)
+
+// Spool directories holding per-user crontabs on Debian and Red Hat family hosts
+var cronSpoolDirs = []string{"/var/spool/cron/crontabs", "/var/spool/cron"}
+
+// Directories run by run-parts, and the schedule each one represents
+var cronPeriodicDirs = []struct {
+	Dir      string
+	Schedule string
+}{
+	{"/etc/cron.hourly", "@hourly"},
+	{"/etc/cron.daily", "@daily"},
+	{"/etc/cron.weekly", "@weekly"},
+	{"/etc/cron.monthly", "@monthly"},
+}
+
+// Directories systemd timer units are installed to
+var systemdUnitDirs = []string{"/etc/systemd/system", "/run/systemd/system", "/usr/lib/systemd/system", "/lib/systemd/system"}
+
+// run-parts on Debian only runs files whose names match this, so editor backups
+// and dpkg leftovers in the cron directories never run
+var runPartsName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+var cronEnvLine = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*=\s*(.*)$`)
+
+// CronEntry is one scheduled job, normalized across the places cron reads jobs from
+type CronEntry struct {
+	Schedule string `json:"schedule"` // five fields or a special string such as @reboot
+	User     string `json:"user"`
+	Command  string `json:"command"`
+	Source   string `json:"source"`
+	Line     int    `json:"line,omitempty"`
+	Kind     string `json:"kind"` // system, cron.d, user, or periodic
+	// Environment set by variable lines above the entry in the same file
+	Environment map[string]string `json:"environment,omitempty"`
+	// SystemdTimer names a timer unit doing the same job. Entries that also have a
+	// timer are usually guarded so only one of the two runs on systemd hosts.
+	SystemdTimer string `json:"systemd_timer,omitempty"`
+	// SkippedUnderSystemd is set when the command checks for systemd and exits, so
+	// the job only runs on hosts without it
+	SkippedUnderSystemd bool `json:"skipped_under_systemd,omitempty"`
+}
+
+// CronNote explains a file that couldn't be read or a line that couldn't be parsed
+type CronNote struct {
+	Source string `json:"source"`
+	Line   int    `json:"line,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// CronReport is the response of GET /cron
+type CronReport struct {
+	Entries []CronEntry `json:"entries"`
+	Errors  []CronNote  `json:"errors"`
+}
+
+// Function to collect every cron job on the host
+func listCronJobs(ctx context.Context) *CronReport {
+	report := &CronReport{Entries: []CronEntry{}, Errors: []CronNote{}}
+	add := func(entries []CronEntry, notes []CronNote) {
+		report.Entries = append(report.Entries, entries...)
+		report.Errors = append(report.Errors, notes...)
+	}
+
+	if data, err := os.ReadFile(systemCrontab); err == nil {
+		add(parseCrontab(string(data), systemCrontab, "system", ""))
+	} else if !os.IsNotExist(err) {
+		report.Errors = append(report.Errors, CronNote{Source: systemCrontab, Reason: err.Error()})
+	}
+
+	if names, err := os.ReadDir(cronDropInDir); err == nil {
+		for _, name := range names {
+			path := filepath.Join(cronDropInDir, name.Name())
+			if name.IsDir() || !runPartsName.MatchString(name.Name()) {
+				continue
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				report.Errors = append(report.Errors, CronNote{Source: path, Reason: err.Error()})
+				continue
+			}
+			add(parseCrontab(string(data), path, "cron.d", ""))
+		}
+	}
+
+	for _, user := range crontabUsers() {
+		output, err := outputTrackedContext(ctx, newCommand("crontab", "-l", "-u", user))
+		source := "crontab -l -u " + user
+		if err != nil {
+			report.Errors = append(report.Errors, CronNote{Source: source, Reason: err.Error()})
+			continue
+		}
+		add(parseCrontab(string(output), source, "user", user))
+	}
+
+	for _, periodic := range cronPeriodicDirs {
+		names, err := os.ReadDir(periodic.Dir)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			path := filepath.Join(periodic.Dir, name.Name())
+			info, err := name.Info()
+			if err != nil || !info.Mode().IsRegular() || info.Mode()&0111 == 0 || !runPartsName.MatchString(name.Name()) {
+				continue // run-parts skips these as well
+			}
+			report.Entries = append(report.Entries, CronEntry{
+				Schedule: periodic.Schedule,
+				User:     "root",
+				Command:  path,
+				Source:   path,
+				Kind:     "periodic",
+			})
+		}
+	}
+
+	timers := systemdTimers()
+	for i := range report.Entries {
+		markSystemdOverlap(&report.Entries[i], timers)
+	}
+	return report
+}
+
+// Function to parse a crontab. System crontabs have a user field after the
+// schedule; per-user crontabs don't, and every entry belongs to owner.
+func parseCrontab(content, source, kind, owner string) ([]CronEntry, []CronNote) {
+	var entries []CronEntry
+	var notes []CronNote
+	env := map[string]string{}
+
+	for i, raw := range strings.Split(content, "\n") {
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if match := cronEnvLine.FindStringSubmatch(line); match != nil {
+			// A copy so entries keep the environment that applied where they were defined
+			next := make(map[string]string, len(env)+1)
+			for k, v := range env {
+				next[k] = v
+			}
+			next[match[1]] = unquoteCronValue(match[2])
+			env = next
+			continue
+		}
+
+		scheduleFields := 5
+		if strings.HasPrefix(line, "@") {
+			scheduleFields = 1
+		}
+		userFields := 0
+		if owner == "" {
+			userFields = 1
+		}
+		fields, command := splitFields(line, scheduleFields+userFields)
+		if command == "" {
+			notes = append(notes, CronNote{Source: source, Line: i + 1, Reason: "incomplete entry"})
+			continue
+		}
+		if scheduleFields == 1 && !validCronSpecial(fields[0]) {
+			notes = append(notes, CronNote{Source: source, Line: i + 1, Reason: "unknown schedule " + fields[0]})
+			continue
+		}
+
+		entry := CronEntry{
+			Schedule: strings.Join(fields[:scheduleFields], " "),
+			User:     owner,
+			Command:  command,
+			Source:   source,
+			Line:     i + 1,
+			Kind:     kind,
+		}
+		if owner == "" {
+			entry.User = fields[scheduleFields]
+		}
+		if len(env) > 0 {
+			entry.Environment = env
+		}
+		entries = append(entries, entry)
+	}
+	return entries, notes
+}
+
+// Helper function to split off the first n whitespace separated fields, leaving
+// the rest of the line, spacing included, as the remainder
+func splitFields(line string, n int) ([]string, string) {
+	fields := make([]string, 0, n)
+	rest := line
+	for len(fields) < n {
+		rest = strings.TrimLeft(rest, " \t")
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			if rest != "" {
+				fields = append(fields, rest)
+			}
+			return fields, ""
+		}
+		fields = append(fields, rest[:end])
+		rest = rest[end:]
+	}
+	return fields, strings.TrimSpace(rest)
+}
+
+// Helper function to check a special schedule string understood by cron
+func validCronSpecial(schedule string) bool {
+	switch schedule {
+	case "@reboot", "@yearly", "@annually", "@monthly", "@weekly", "@daily", "@midnight", "@hourly":
+		return true
+	}
+	return false
+}
+
+// Helper function to strip the matching quotes cron allows around variable values
+func unquoteCronValue(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// Function to find the users with a crontab in the spool
+func crontabUsers() []string {
+	seen := map[string]bool{}
+	var users []string
+	for _, dir := range cronSpoolDirs {
+		names, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			if name.IsDir() || strings.HasPrefix(name.Name(), ".") || seen[name.Name()] {
+				continue
+			}
+			seen[name.Name()] = true
+			users = append(users, name.Name())
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Function to list the names of installed systemd timers without the .timer suffix
+func systemdTimers() map[string]string {
+	timers := map[string]string{}
+	for _, dir := range systemdUnitDirs {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.timer"))
+		for _, match := range matches {
+			unit := filepath.Base(match)
+			timers[strings.TrimSuffix(unit, ".timer")] = unit
+		}
+	}
+	return timers
+}
+
+// Function to flag entries that a systemd timer also covers. Packages shipping both
+// name the timer after the cron file or script, and guard the cron side with a
+// check for /run/systemd/system.
+func markSystemdOverlap(entry *CronEntry, timers map[string]string) {
+	if entry.Kind == "cron.d" || entry.Kind == "periodic" {
+		entry.SystemdTimer = timers[filepath.Base(entry.Source)]
+	}
+	entry.SkippedUnderSystemd = strings.Contains(entry.Command, "/run/systemd/system")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseSystemCrontab(t *testing.T) {
+	entries, notes := parseCrontab(string(readFixture(t, "cron", "crontab")), systemCrontab, "system", "")
+	if len(notes) != 0 {
+		t.Errorf("notes = %+v", notes)
+	}
+	// The commented out PATH doesn't apply
+	shell := map[string]string{"SHELL": "/bin/sh"}
+	want := []CronEntry{
+		{Schedule: "17 * * * *", User: "root", Command: "cd / && run-parts --report /etc/cron.hourly", Line: 19},
+		{Schedule: "25 6 * * *", User: "root", Command: "test -x /usr/sbin/anacron || { cd / && run-parts --report /etc/cron.daily; }", Line: 20},
+		{Schedule: "47 6 * * 7", User: "root", Command: "test -x /usr/sbin/anacron || { cd / && run-parts --report /etc/cron.weekly; }", Line: 21},
+		{Schedule: "52 6 1 * *", User: "root", Command: "test -x /usr/sbin/anacron || { cd / && run-parts --report /etc/cron.monthly; }", Line: 22},
+	}
+	for i := range want {
+		want[i].Source, want[i].Kind, want[i].Environment = systemCrontab, "system", shell
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries = %+v\nwant %+v", entries, want)
+	}
+}
+
+func TestParseUserCrontab(t *testing.T) {
+	source := "/var/spool/cron/crontabs/deploy"
+	entries, notes := parseCrontab(string(readFixture(t, "cron", "user-deploy")), source, "user", "deploy")
+
+	base := map[string]string{"MAILTO": "", "PATH": "/home/deploy/bin:/usr/local/bin:/usr/bin:/bin"}
+	greeting := map[string]string{"MAILTO": "", "PATH": base["PATH"], "GREETING": "hello world"}
+	want := []CronEntry{
+		// Spacing inside the command is kept as written
+		{Schedule: "@reboot", Command: "/home/deploy/bin/start-agent --foreground   >> /var/log/deploy/agent.log 2>&1", Line: 6, Environment: base},
+		{Schedule: "*/15 * * * *", Command: "/home/deploy/bin/sync-assets", Line: 7, Environment: base},
+		// Variables only apply to the entries below them
+		{Schedule: "0 2 * * mon-fri", Command: "cd /srv/app && ./backup.sh --keep 7 # nightly", Line: 9, Environment: greeting},
+	}
+	for i := range want {
+		want[i].User, want[i].Source, want[i].Kind = "deploy", source, "user"
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries = %+v\nwant %+v", entries, want)
+	}
+
+	wantNotes := []CronNote{
+		{Source: source, Line: 10, Reason: "unknown schedule @every"},
+		{Source: source, Line: 11, Reason: "incomplete entry"},
+		{Source: source, Line: 12, Reason: "incomplete entry"},
+	}
+	if !reflect.DeepEqual(notes, wantNotes) {
+		t.Errorf("notes = %+v\nwant %+v", notes, wantNotes)
+	}
+}
+
+func TestMarkSystemdOverlap(t *testing.T) {
+	source := filepath.Join(cronDropInDir, "e2scrub_all")
+	entries, _ := parseCrontab(string(readFixture(t, "cron", "e2scrub_all")), source, "cron.d", "")
+	if len(entries) != 2 {
+		t.Fatalf("entries = %+v", entries)
+	}
+	timers := map[string]string{"e2scrub_all": "e2scrub_all.timer"}
+	for _, entry := range entries {
+		markSystemdOverlap(&entry, timers)
+		if entry.SystemdTimer != "e2scrub_all.timer" || !entry.SkippedUnderSystemd {
+			t.Errorf("entry = %+v, want the timer and the systemd guard noted", entry)
+		}
+	}
+
+	// User crontabs aren't named after a package's timer
+	entry := CronEntry{Kind: "user", Source: "/var/spool/cron/crontabs/e2scrub_all", Command: "/bin/true"}
+	markSystemdOverlap(&entry, timers)
+	if entry.SystemdTimer != "" || entry.SkippedUnderSystemd {
+		t.Errorf("user entry = %+v", entry)
+	}
+}
+
+func TestSplitFields(t *testing.T) {
+	fields, rest := splitFields("  0\t2 * *  mon   echo  a\tb  ", 5)
+	if !reflect.DeepEqual(fields, []string{"0", "2", "*", "*", "mon"}) || rest != "echo  a\tb" {
+		t.Errorf("splitFields = %q, %q", fields, rest)
+	}
+}
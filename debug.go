@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http/pprof"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Set with --enable-debug; the /debug endpoints aren't registered without it
+var debugEnabled bool
+
+// RuntimeInfo is the snapshot returned by /debug/runtime
+type RuntimeInfo struct {
+	Goroutines     int          `json:"goroutines"`
+	Heap           HeapInfo     `json:"heap"`
+	GC             GCInfo       `json:"gc"`
+	ChildProcesses ChildProcess `json:"child_processes"`
+	// DeniedRequests counts requests refused by the allowlist
+	DeniedRequests int64  `json:"denied_requests"`
+	Uptime         string `json:"uptime"`
+}
+
+// HeapInfo summarizes runtime.MemStats
+type HeapInfo struct {
+	AllocBytes    uint64 `json:"alloc_bytes"`
+	InUseBytes    uint64 `json:"in_use_bytes"`
+	ObjectCount   uint64 `json:"object_count"`
+	SysBytes      uint64 `json:"sys_bytes"`
+	NextGCTrigger uint64 `json:"next_gc_bytes"`
+}
+
+// GCInfo summarizes garbage collection pauses
+type GCInfo struct {
+	Count          uint32  `json:"count"`
+	PauseTotalMS   float64 `json:"pause_total_ms"`
+	LastPauseMS    float64 `json:"last_pause_ms"`
+	RecentMedianMS float64 `json:"recent_median_ms"`
+	RecentMaxMS    float64 `json:"recent_max_ms"`
+}
+
+// ChildProcess counts commands exec'd by the agent
+type ChildProcess struct {
+	InFlight int64 `json:"in_flight"`
+	Started  int64 `json:"started"`
+	// Waiting counts commands held back by concurrency.max_processes
+	Waiting int `json:"waiting"`
+}
+
+var startTime = time.Now()
+
+// Function to collect the runtime snapshot
+func runtimeInfo() RuntimeInfo {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	info := RuntimeInfo{
+		Goroutines: runtime.NumGoroutine(),
+		Heap: HeapInfo{
+			AllocBytes:    mem.HeapAlloc,
+			InUseBytes:    mem.HeapInuse,
+			ObjectCount:   mem.HeapObjects,
+			SysBytes:      mem.Sys,
+			NextGCTrigger: mem.NextGC,
+		},
+		GC: GCInfo{
+			Count:        mem.NumGC,
+			PauseTotalMS: float64(mem.PauseTotalNs) / 1e6,
+		},
+		ChildProcesses: ChildProcess{
+			InFlight: childProcesses.Load(),
+			Started:  childStarted.Load(),
+			Waiting:  processes.Status().Waiting,
+		},
+		DeniedRequests: deniedRequests.Load(),
+		Uptime:         time.Since(startTime).Round(time.Second).String(),
+	}
+
+	// PauseNs is a ring buffer of the most recent pauses
+	recent := int(min(mem.NumGC, uint32(len(mem.PauseNs))))
+	if recent > 0 {
+		info.GC.LastPauseMS = float64(mem.PauseNs[(mem.NumGC+255)%256]) / 1e6
+		pauses := make([]uint64, recent)
+		copy(pauses, mem.PauseNs[:recent])
+		slices.Sort(pauses)
+		info.GC.RecentMedianMS = float64(pauses[recent/2]) / 1e6
+		info.GC.RecentMaxMS = float64(pauses[recent-1]) / 1e6
+	}
+	return info
+}
+
+// Function to register the pprof and runtime endpoints under /debug, behind the admin scope
+func registerDebugRoutes(r *gin.Engine) {
+	debug := r.Group("/debug", requireScope(scopeAdmin))
+
+	// Define the /debug/pprof/ endpoints; Index serves the named profiles like heap and goroutine
+	debug.GET("/pprof/*profile", func(c *gin.Context) {
+		switch c.Param("profile") {
+		case "/cmdline":
+			pprof.Cmdline(c.Writer, c.Request)
+		case "/profile":
+			pprof.Profile(c.Writer, c.Request)
+		case "/symbol":
+			pprof.Symbol(c.Writer, c.Request)
+		case "/trace":
+			pprof.Trace(c.Writer, c.Request)
+		default:
+			pprof.Index(c.Writer, c.Request)
+		}
+	})
+	debug.POST("/pprof/symbol", gin.WrapF(pprof.Symbol))
+
+	// Define the /debug/runtime endpoint
+	debug.GET("/runtime", func(c *gin.Context) {
+		c.JSON(200, runtimeInfo())
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Echo requests GET /network/ping sends unless count asks for another number, and the most it may ask for
+	defaultPingCount = 4
+	maxPingCount     = 10
+	// Interval between echo requests, and how long each waits for its reply
+	pingInterval = time.Second
+	pingTimeout  = time.Second
+	// Hops GET /network/traceroute tries unless max_hops asks for fewer, the requests sent
+	// to each, and how long each waits for an answer
+	maxTracerouteHops = 30
+	tracerouteQueries = 3
+	tracerouteTimeout = time.Second
+	// Budget of a whole traceroute; hops past it aren't tried
+	tracerouteBudget = 30 * time.Second
+	// Ping and traceroute runs the agent does at once
+	maxDiagnostics = 2
+)
+
+// Slots of the ping and traceroute runs in progress
+var diagnosticSlots = make(chan struct{}, maxDiagnostics)
+
+// PingProbe is one echo request of a ping. RTTMS is null when no reply came in time.
+type PingProbe struct {
+	Seq   int      `json:"seq"`
+	RTTMS *float64 `json:"rtt_ms"`
+	Error string   `json:"error,omitempty"`
+}
+
+// PingResult is the response of GET /network/ping. The round trip statistics are left
+// out when no reply came back.
+type PingResult struct {
+	Host        string      `json:"host"`
+	Address     string      `json:"address"`
+	Sent        int         `json:"sent"`
+	Received    int         `json:"received"`
+	LossPercent float64     `json:"loss_percent"`
+	MinMS       *float64    `json:"min_ms,omitempty"`
+	AvgMS       *float64    `json:"avg_ms,omitempty"`
+	MaxMS       *float64    `json:"max_ms,omitempty"`
+	JitterMS    *float64    `json:"jitter_ms,omitempty"`
+	Probes      []PingProbe `json:"probes"`
+}
+
+// TracerouteHop is one hop of a traceroute. Address is empty when nothing answered, and
+// the round trip times of requests without an answer are null.
+type TracerouteHop struct {
+	TTL     int        `json:"ttl"`
+	Address string     `json:"address,omitempty"`
+	RTTsMS  []*float64 `json:"rtts_ms"`
+}
+
+// TracerouteResult is the response of GET /network/traceroute
+type TracerouteResult struct {
+	Host    string `json:"host"`
+	Address string `json:"address"`
+	// Reached is set when the target answered; Unreachable when a router reported it
+	// can't be reached
+	Reached     bool            `json:"reached"`
+	Unreachable bool            `json:"unreachable,omitempty"`
+	Hops        []TracerouteHop `json:"hops"`
+}
+
+// Function to take a diagnostic slot, or report false when all are in use
+func acquireDiagnosticSlot() (func(), bool) {
+	select {
+	case diagnosticSlots <- struct{}{}:
+		return func() { <-diagnosticSlots }, true
+	default:
+		return nil, false
+	}
+}
+
+// Helper function to open an ICMP socket to host for the diagnostics, turning a host that
+// can't be used or a missing capability into request errors
+func openDiagnosticICMP(ctx context.Context, host string) (*icmpConn, error) {
+	ip, err := resolveProbeHost(ctx, host, currentConfig().Network.AllowLinkLocal)
+	if err != nil {
+		var forbidden *forbiddenAddressError
+		if errors.As(err, &forbidden) {
+			return nil, &requestError{Status: 403, Code: "forbidden_address", Message: forbidden.Error()}
+		}
+		return nil, &requestError{Status: 400, Code: "unresolvable_host", Message: fmt.Sprintf("Unable to resolve %s: %v", host, err)}
+	}
+	conn, err := openICMP(ip)
+	if err != nil {
+		var skipped *skippedProbeError
+		if errors.As(err, &skipped) {
+			return nil, &requestError{Status: 503, Code: "raw_sockets_unavailable", Message: skipped.Error()}
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Function to ping host with count echo requests, one a second
+func ping(ctx context.Context, host string, count int) (*PingResult, error) {
+	conn, err := openDiagnosticICMP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	result := &PingResult{Host: host, Address: conn.ip.String(), Probes: []PingProbe{}}
+	var rtts []float64
+	next := time.Now()
+	for seq := 1; seq <= count; seq++ {
+		// Requests go out once an interval, whether or not the last one was answered
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Until(next)):
+		}
+		next = time.Now().Add(pingInterval)
+
+		probe := PingProbe{Seq: seq}
+		probeCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+		rtt, err := conn.Echo(probeCtx, uint16(seq))
+		cancel()
+		result.Sent++
+		if err != nil {
+			probe.Error = err.Error()
+		} else {
+			ms := milliseconds(rtt)
+			probe.RTTMS = &ms
+			rtts = append(rtts, ms)
+			result.Received++
+		}
+		result.Probes = append(result.Probes, probe)
+	}
+
+	result.LossPercent = math.Round(float64(result.Sent-result.Received)/float64(result.Sent)*1000) / 10
+	if len(rtts) > 0 {
+		minimum, maximum, sum := rtts[0], rtts[0], 0.0
+		for _, rtt := range rtts {
+			minimum, maximum, sum = math.Min(minimum, rtt), math.Max(maximum, rtt), sum+rtt
+		}
+		average := roundMS(sum / float64(len(rtts)))
+		result.MinMS, result.AvgMS, result.MaxMS = &minimum, &average, &maximum
+		// Jitter is the mean difference between consecutive round trip times
+		var jitter float64
+		for i := 1; i < len(rtts); i++ {
+			jitter += math.Abs(rtts[i] - rtts[i-1])
+		}
+		if len(rtts) > 1 {
+			jitter = roundMS(jitter / float64(len(rtts)-1))
+		}
+		result.JitterMS = &jitter
+	}
+	return result, nil
+}
+
+// Helper function to round milliseconds to microseconds
+func roundMS(ms float64) float64 {
+	return math.Round(ms*1000) / 1000
+}
+
+// Function to trace the route to host with echo requests of increasing time to live
+func traceroute(ctx context.Context, host string, maxHops int) (*TracerouteResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, tracerouteBudget)
+	defer cancel()
+	conn, err := openDiagnosticICMP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	result := &TracerouteResult{Host: host, Address: conn.ip.String(), Hops: []TracerouteHop{}}
+	for ttl := 1; ttl <= maxHops && !result.Reached && !result.Unreachable && ctx.Err() == nil; ttl++ {
+		if err := conn.SetTTL(ttl); err != nil {
+			return nil, err
+		}
+		hop := TracerouteHop{TTL: ttl, RTTsMS: []*float64{}}
+		for query := 0; query < tracerouteQueries && ctx.Err() == nil; query++ {
+			queryCtx, cancel := context.WithTimeout(ctx, tracerouteTimeout)
+			reply, err := conn.exchange(queryCtx, uint16(ttl*tracerouteQueries+query))
+			cancel()
+			if err != nil {
+				hop.RTTsMS = append(hop.RTTsMS, nil)
+				continue
+			}
+			ms := milliseconds(reply.RTT)
+			hop.RTTsMS = append(hop.RTTsMS, &ms)
+			if hop.Address == "" {
+				hop.Address = reply.From.String()
+			}
+			result.Reached = result.Reached || reply.Reached
+			result.Unreachable = result.Unreachable || reply.Unreachable
+		}
+		result.Hops = append(result.Hops, hop)
+	}
+	return result, nil
+}
+
+// Helper function to read a count query parameter between 1 and max. When it returns
+// false an error response has already been sent.
+func countParam(c *gin.Context, name string, fallback, max int) (int, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return fallback, true
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 || count > max {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("%s must be a number between 1 and %d", name, max), "code": "invalid_parameter"})
+		return 0, false
+	}
+	return count, true
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+// PackageDiff describes what applying a manifest would change on this host
+type PackageDiff struct {
+	PackageManager  string             `json:"package_manager"`
+	InSync          bool               `json:"in_sync"`
+	ToInstall       []PackageDiffEntry `json:"to_install"`
+	ToRemove        []PackageDiffEntry `json:"to_remove"`
+	VersionMismatch []PackageDiffEntry `json:"version_mismatch"`
+	InDesiredState  []PackageDiffEntry `json:"in_desired_state"`
+	Unavailable     []PackageDiffEntry `json:"unavailable"`
+	Summary         map[string]int     `json:"summary"`
+	// Skipped lists the manifest entries that don't apply to this host
+	Skipped []SkippedEntry `json:"skipped,omitempty"`
+	// EffectiveManifest is the result of merging a multi-document manifest
+	EffectiveManifest *PackageConfig `json:"effective_manifest,omitempty"`
+}
+
+// PackageDiffEntry is one package in a diff
+type PackageDiffEntry struct {
+	Name             string `json:"name"`
+	DesiredVersion   string `json:"desired_version,omitempty"`
+	InstalledVersion string `json:"installed_version,omitempty"`
+	Candidate        string `json:"candidate,omitempty"` // Version the repositories would install
+}
+
+// Function to split a pinned apt spec ("name=version", optionally "name:arch=version")
+func parseAptSpec(spec string) (string, string) {
+	name, version, _ := strings.Cut(spec, "=")
+	name, _, _ = strings.Cut(name, ":")
+	return name, version
+}
+
+// Function to split a pinned rpm spec. A spec is treated as name-version-release when its
+// last two dash-separated parts start with a digit, or name-version when only the last
+// one does, so names like java-17-openjdk stay intact.
+func parseRPMSpec(spec string) (string, string) {
+	parts := strings.Split(spec, "-")
+	startsWithDigit := func(s string) bool {
+		return s != "" && unicode.IsDigit(rune(s[0]))
+	}
+	n := len(parts)
+	if n >= 3 && startsWithDigit(parts[n-1]) && startsWithDigit(parts[n-2]) {
+		return strings.Join(parts[:n-2], "-"), parts[n-2] + "-" + parts[n-1]
+	}
+	if n >= 2 && startsWithDigit(parts[n-1]) {
+		return strings.Join(parts[:n-1], "-"), parts[n-1]
+	}
+	return spec, ""
+}
+
+// Helper function to compare an installed version with a pinned one, ignoring a zero or omitted epoch
+func versionMatches(installed, desired string) bool {
+	if installed == desired {
+		return true
+	}
+	if _, rest, ok := strings.Cut(installed, ":"); ok && rest == desired {
+		return true
+	}
+	return false
+}
+
+// Function to compare a manifest against the installed packages without changing anything
+func diffPackages(ctx context.Context, pm packageManager, config PackageConfig) (*PackageDiff, error) {
+	installed, err := installedVersions(ctx, pm)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &PackageDiff{
+		PackageManager:  pm.Name(),
+		ToInstall:       []PackageDiffEntry{},
+		ToRemove:        []PackageDiffEntry{},
+		VersionMismatch: []PackageDiffEntry{},
+		InDesiredState:  []PackageDiffEntry{},
+		Unavailable:     []PackageDiffEntry{},
+		Skipped:         config.Skipped,
+	}
+
+	var missing []PackageDiffEntry
+	for _, spec := range config.Packages.Installed {
+		name, version := pm.ParseSpec(spec)
+		entry := PackageDiffEntry{Name: name, DesiredVersion: version}
+		current, ok := installed[name]
+		switch {
+		case !ok:
+			missing = append(missing, entry)
+		case version != "" && !versionMatches(current, version):
+			entry.InstalledVersion = current
+			diff.VersionMismatch = append(diff.VersionMismatch, entry)
+		default:
+			entry.InstalledVersion = current
+			diff.InDesiredState = append(diff.InDesiredState, entry)
+		}
+	}
+
+	for _, spec := range config.Packages.Uninstalled {
+		name, _ := pm.ParseSpec(spec)
+		if current, ok := installed[name]; ok {
+			diff.ToRemove = append(diff.ToRemove, PackageDiffEntry{Name: name, InstalledVersion: current})
+		} else {
+			diff.InDesiredState = append(diff.InDesiredState, PackageDiffEntry{Name: name})
+		}
+	}
+
+	// Check the repositories only for the packages that would have to be installed
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for _, entry := range missing {
+			names = append(names, entry.Name)
+		}
+		candidates, err := pm.Candidates(ctx, names)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range missing {
+			if candidate, ok := candidates[entry.Name]; ok {
+				entry.Candidate = candidate
+				diff.ToInstall = append(diff.ToInstall, entry)
+			} else {
+				diff.Unavailable = append(diff.Unavailable, entry)
+			}
+		}
+	}
+
+	diff.InSync = len(diff.ToInstall) == 0 && len(diff.ToRemove) == 0 &&
+		len(diff.VersionMismatch) == 0 && len(diff.Unavailable) == 0
+	diff.Summary = map[string]int{
+		"to_install":       len(diff.ToInstall),
+		"to_remove":        len(diff.ToRemove),
+		"version_mismatch": len(diff.VersionMismatch),
+		"in_desired_state": len(diff.InDesiredState),
+		"unavailable":      len(diff.Unavailable),
+	}
+	return diff, nil
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// Service type the agent announces over mDNS
+	discoveryService = "_cosi._tcp.local."
+	// Name DNS-SD browsers query to list the service types on a network
+	discoveryServicesQuery = "_services._dns-sd._udp.local."
+	// Seconds the records of an announcement may be cached
+	discoveryTTL = 120
+	// How long GET /discover listens for answers unless timeout_ms says otherwise, and the longest it may
+	defaultDiscoverTimeout = 3 * time.Second
+	maxDiscoverTimeout     = 30 * time.Second
+)
+
+// mDNS multicast group and port
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// DiscoveryConfig controls the mDNS announcements of the agent and GET /discover
+type DiscoveryConfig struct {
+	// Announce answers mDNS queries for _cosi._tcp and announces the agent at startup. The
+	// announcement only carries the instance name, port, version, hostname, and OS ID.
+	Announce bool `yaml:"announce"`
+	// Interfaces limits announcing and browsing to these network interfaces. Every
+	// interface that is up and supports multicast is used when it's empty.
+	Interfaces []string `yaml:"interfaces"`
+	// Instance is the name the agent announces, the hostname by default
+	Instance string `yaml:"instance"`
+}
+
+// Function to check the discovery settings
+func (d DiscoveryConfig) validate() error {
+	for _, name := range d.Interfaces {
+		if name == "" {
+			return fmt.Errorf("discovery.interfaces must not contain empty names")
+		}
+	}
+	if len(d.Instance) > 63 || strings.Contains(d.Instance, ".") {
+		return fmt.Errorf("discovery.instance must be at most 63 characters without dots")
+	}
+	return nil
+}
+
+// Helper function to return the instance name, defaulting to the short hostname
+func (d DiscoveryConfig) instance() string {
+	if d.Instance != "" {
+		return d.Instance
+	}
+	return shortHostname()
+}
+
+// Helper function to return the hostname up to its first dot
+func shortHostname() string {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		return "cosi"
+	}
+	return strings.SplitN(hostname, ".", 2)[0]
+}
+
+// Function to resolve the interfaces to announce and browse on. Named interfaces must
+// exist; without names every multicast interface that is up is used, except loopback.
+func (d DiscoveryConfig) interfaces() ([]net.Interface, error) {
+	if len(d.Interfaces) > 0 {
+		ifaces := make([]net.Interface, 0, len(d.Interfaces))
+		for _, name := range d.Interfaces {
+			iface, err := net.InterfaceByName(name)
+			if err != nil {
+				return nil, fmt.Errorf("discovery interface %s: %w", name, err)
+			}
+			ifaces = append(ifaces, *iface)
+		}
+		return ifaces, nil
+	}
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ifaces []net.Interface
+	for _, iface := range all {
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 && iface.Flags&net.FlagLoopback == 0 {
+			ifaces = append(ifaces, iface)
+		}
+	}
+	if len(ifaces) == 0 {
+		return nil, fmt.Errorf("no network interface is up with multicast support")
+	}
+	return ifaces, nil
+}
+
+// Helper function to list the IPv4 addresses of an interface
+func interfaceIPv4(iface net.Interface) []net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			ips = append(ips, ipNet.IP.To4())
+		}
+	}
+	return ips
+}
+
+// discoveryResponder answers mDNS queries for the agent on the configured interfaces
+type discoveryResponder struct {
+	conn     *ipv4.PacketConn
+	ifaces   map[int]net.Interface
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	port     uint16
+	txt      []string
+}
+
+// Function to start answering mDNS queries and announce the agent, which serves on port.
+// The socket shares port 5353 with any other responder on the host, like avahi.
+func startDiscovery(cfg DiscoveryConfig, port int) (*discoveryResponder, error) {
+	ifaces, err := cfg.interfaces()
+	if err != nil {
+		return nil, err
+	}
+	instance, err := dnsmessage.NewName(cfg.instance() + "." + discoveryService)
+	if err != nil {
+		return nil, err
+	}
+	host, err := dnsmessage.NewName(shortHostname() + ".local.")
+	if err != nil {
+		return nil, err
+	}
+	listenConfig := net.ListenConfig{Control: reuseMDNSPort}
+	packetConn, err := listenConfig.ListenPacket(context.Background(), "udp4", fmt.Sprintf("0.0.0.0:%d", mdnsGroup.Port))
+	if err != nil {
+		return nil, err
+	}
+	conn := ipv4.NewPacketConn(packetConn)
+	responder := &discoveryResponder{conn: conn, ifaces: make(map[int]net.Interface), instance: instance, host: host, port: uint16(port), txt: discoveryTXT()}
+	for _, iface := range ifaces {
+		if err := conn.JoinGroup(&iface, mdnsGroup); err != nil {
+			packetConn.Close()
+			return nil, fmt.Errorf("joining the mDNS group on %s: %w", iface.Name, err)
+		}
+		responder.ifaces[iface.Index] = iface
+	}
+	// The interface a query arrived on decides which addresses are answered and
+	// whether the query is answered at all
+	if err := conn.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		packetConn.Close()
+		return nil, err
+	}
+	conn.SetMulticastTTL(255)
+	conn.SetMulticastLoopback(true)
+
+	go responder.serve()
+	go responder.announce()
+	return responder, nil
+}
+
+// Helper function to let the mDNS socket share its port with other responders, which on
+// Linux set SO_REUSEADDR as well
+func reuseMDNSPort(network, address string, raw syscall.RawConn) error {
+	var sockErr error
+	err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// Function to build the TXT record of the announcement. It is public to anyone on the
+// network, so it only carries what GET /version and GET /os already serve.
+func discoveryTXT() []string {
+	txt := []string{"version=" + version, "hostname=" + shortHostname()}
+	if osRelease, err := readOSReleaseFile("/etc/os-release"); err == nil && osRelease["ID"] != "" {
+		txt = append(txt, "os="+osRelease["ID"])
+	}
+	return txt
+}
+
+// Function to send the unsolicited announcements of RFC 6762: twice, a second apart
+func (d *discoveryResponder) announce() {
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+		for _, iface := range d.ifaces {
+			message := dnsmessage.Message{
+				Header:  dnsmessage.Header{Response: true, Authoritative: true},
+				Answers: d.records(iface),
+			}
+			if err := d.send(message, iface, mdnsGroup); err != nil {
+				log.Printf("Warning: unable to announce the agent on %s: %v", iface.Name, err)
+			}
+		}
+	}
+}
+
+// Function to answer queries until the socket fails
+func (d *discoveryResponder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, cm, src, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("Warning: mDNS responder stopped: %v", err)
+			return
+		}
+		if cm == nil {
+			continue
+		}
+		iface, ok := d.ifaces[cm.IfIndex]
+		if !ok {
+			continue
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || query.Header.Response {
+			continue
+		}
+		var message dnsmessage.Message
+		for _, question := range query.Questions {
+			message = d.answer(question, iface)
+			if len(message.Answers) > 0 {
+				break
+			}
+		}
+		if len(message.Answers) == 0 {
+			continue
+		}
+		// Queries from a port other than 5353 come from simple resolvers and browsers like
+		// GET /discover, which expect a unicast answer that repeats the query
+		target := mdnsGroup
+		if udp, ok := src.(*net.UDPAddr); ok && udp.Port != mdnsGroup.Port {
+			message.Header.ID = query.Header.ID
+			message.Questions = query.Questions
+			target = udp
+		}
+		if err := d.send(message, iface, target); err != nil {
+			log.Printf("Warning: unable to answer an mDNS query on %s: %v", iface.Name, err)
+		}
+	}
+}
+
+// Function to answer a question with the records it asks for, and the other records of
+// the agent as additional records. The answer is empty when the question isn't for the agent.
+func (d *discoveryResponder) answer(question dnsmessage.Question, iface net.Interface) dnsmessage.Message {
+	message := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+	name := strings.ToLower(question.Name.String())
+	if name == discoveryServicesQuery && (question.Type == dnsmessage.TypePTR || question.Type == dnsmessage.TypeALL) {
+		message.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: discoveryTTL},
+			Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(discoveryService)},
+		}}
+		return message
+	}
+	for _, record := range d.records(iface) {
+		owner := strings.ToLower(record.Header.Name.String())
+		if owner == name && (question.Type == record.Header.Type || question.Type == dnsmessage.TypeALL) {
+			message.Answers = append(message.Answers, record)
+		} else {
+			message.Additionals = append(message.Additionals, record)
+		}
+	}
+	return message
+}
+
+// Function to build the records of the agent with the addresses of iface
+func (d *discoveryResponder) records(iface net.Interface) []dnsmessage.Resource {
+	service := dnsmessage.MustNewName(discoveryService)
+	// Records only this agent owns set the cache-flush bit of their class
+	unique := dnsmessage.ClassINET | 1<<15
+	records := []dnsmessage.Resource{
+		{
+			Header: dnsmessage.ResourceHeader{Name: service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: discoveryTTL},
+			Body:   &dnsmessage.PTRResource{PTR: d.instance},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Name: d.instance, Type: dnsmessage.TypeSRV, Class: unique, TTL: discoveryTTL},
+			Body:   &dnsmessage.SRVResource{Target: d.host, Port: d.port},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Name: d.instance, Type: dnsmessage.TypeTXT, Class: unique, TTL: discoveryTTL},
+			Body:   &dnsmessage.TXTResource{TXT: d.txt},
+		},
+	}
+	for _, ip := range interfaceIPv4(iface) {
+		var a [4]byte
+		copy(a[:], ip)
+		records = append(records, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: d.host, Type: dnsmessage.TypeA, Class: unique, TTL: discoveryTTL},
+			Body:   &dnsmessage.AResource{A: a},
+		})
+	}
+	return records
+}
+
+// Helper function to send a message out of iface
+func (d *discoveryResponder) send(message dnsmessage.Message, iface net.Interface, target *net.UDPAddr) error {
+	packet, err := message.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteTo(packet, &ipv4.ControlMessage{IfIndex: iface.Index}, target)
+	return err
+}
+
+// DiscoveredAgent is an agent that answered a discovery browse
+type DiscoveredAgent struct {
+	Instance  string   `json:"instance"`
+	Host      string   `json:"host,omitempty"`
+	Addresses []string `json:"addresses"`
+	Port      int      `json:"port,omitempty"`
+	// URL is the first address and port, for clients to call the agent with
+	URL string `json:"url,omitempty"`
+	// Version, Hostname, and OS are from the agent's TXT record
+	Version   string `json:"version,omitempty"`
+	Hostname  string `json:"hostname,omitempty"`
+	OS        string `json:"os,omitempty"`
+	Interface string `json:"interface"`
+}
+
+// DiscoveryReport is the outcome of a discovery browse
+type DiscoveryReport struct {
+	Agents     []DiscoveredAgent `json:"agents"`
+	Interfaces []string          `json:"interfaces"`
+	DurationMS float64           `json:"duration_ms"`
+}
+
+// Function to browse the network for agents for the length of timeout. The query is
+// sent on every discovery interface, twice in case the first is lost.
+func discoverAgents(ctx context.Context, cfg DiscoveryConfig, timeout time.Duration) (*DiscoveryReport, error) {
+	ifaces, err := cfg.interfaces()
+	if err != nil {
+		return nil, err
+	}
+	packetConn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	defer packetConn.Close()
+	conn := ipv4.NewPacketConn(packetConn)
+	if err := conn.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		return nil, err
+	}
+	conn.SetMulticastLoopback(true)
+	query, err := (&dnsmessage.Message{Questions: []dnsmessage.Question{
+		{Name: dnsmessage.MustNewName(discoveryService), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET},
+	}}).Pack()
+	if err != nil {
+		return nil, err
+	}
+	report := &DiscoveryReport{Agents: []DiscoveredAgent{}}
+	for _, iface := range ifaces {
+		report.Interfaces = append(report.Interfaces, iface.Name)
+	}
+
+	started := time.Now()
+	deadline := started.Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	sendQuery := func() {
+		for _, iface := range ifaces {
+			if _, err := conn.WriteTo(query, &ipv4.ControlMessage{IfIndex: iface.Index}, mdnsGroup); err != nil {
+				log.Printf("Warning: unable to send an mDNS query on %s: %v", iface.Name, err)
+			}
+		}
+	}
+	sendQuery()
+	resent := false
+
+	browse := newDiscoveryBrowse()
+	buf := make([]byte, 9000)
+	for ctx.Err() == nil {
+		readDeadline := deadline
+		if !resent && time.Until(deadline) > 2*time.Second {
+			readDeadline = started.Add(time.Second)
+		}
+		conn.SetReadDeadline(readDeadline)
+		n, cm, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if !resent && time.Now().Before(deadline) {
+					resent = true
+					sendQuery()
+					continue
+				}
+				break
+			}
+			return nil, err
+		}
+		var message dnsmessage.Message
+		if message.Unpack(buf[:n]) != nil || !message.Header.Response {
+			continue
+		}
+		ifaceName := ""
+		if cm != nil {
+			if iface, err := net.InterfaceByIndex(cm.IfIndex); err == nil {
+				ifaceName = iface.Name
+			}
+		}
+		browse.add(message, ifaceName)
+	}
+	report.Agents = browse.agents()
+	report.DurationMS = milliseconds(time.Since(started))
+	return report, nil
+}
+
+// discoveryBrowse collects the records of the answers to a browse
+type discoveryBrowse struct {
+	instances map[string]string
+	srv       map[string]dnsmessage.SRVResource
+	txt       map[string][]string
+	addresses map[string][]string
+}
+
+func newDiscoveryBrowse() *discoveryBrowse {
+	return &discoveryBrowse{
+		instances: make(map[string]string),
+		srv:       make(map[string]dnsmessage.SRVResource),
+		txt:       make(map[string][]string),
+		addresses: make(map[string][]string),
+	}
+}
+
+// Function to record the records of one answer, received on ifaceName
+func (b *discoveryBrowse) add(message dnsmessage.Message, ifaceName string) {
+	for _, record := range append(message.Answers, message.Additionals...) {
+		name := strings.ToLower(record.Header.Name.String())
+		switch body := record.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name == discoveryService {
+				b.instances[strings.ToLower(body.PTR.String())] = ifaceName
+			}
+		case *dnsmessage.SRVResource:
+			b.srv[name] = *body
+		case *dnsmessage.TXTResource:
+			b.txt[name] = body.TXT
+		case *dnsmessage.AResource:
+			address := net.IP(body.A[:]).String()
+			if !containsString(b.addresses[name], address) {
+				b.addresses[name] = append(b.addresses[name], address)
+			}
+		}
+	}
+}
+
+// Function to combine the records into the agents found, sorted by instance name
+func (b *discoveryBrowse) agents() []DiscoveredAgent {
+	agents := []DiscoveredAgent{}
+	for name, ifaceName := range b.instances {
+		agent := DiscoveredAgent{
+			Instance:  strings.TrimSuffix(name, "."+discoveryService),
+			Addresses: []string{},
+			Interface: ifaceName,
+		}
+		if srv, ok := b.srv[name]; ok {
+			agent.Host = strings.TrimSuffix(srv.Target.String(), ".")
+			agent.Port = int(srv.Port)
+			if addresses, ok := b.addresses[strings.ToLower(srv.Target.String())]; ok {
+				agent.Addresses = addresses
+			}
+		}
+		for _, entry := range b.txt[name] {
+			key, value, _ := strings.Cut(entry, "=")
+			switch key {
+			case "version":
+				agent.Version = value
+			case "hostname":
+				agent.Hostname = value
+			case "os":
+				agent.OS = value
+			}
+		}
+		if len(agent.Addresses) > 0 && agent.Port != 0 {
+			agent.URL = "http://" + net.JoinHostPort(agent.Addresses[0], strconv.Itoa(agent.Port))
+		}
+		agents = append(agents, agent)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Instance < agents[j].Instance })
+	return agents
+}
+
+// Function to handle "cosi discover", printing the agents found as JSON
+func runDiscover(args []string) error {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	timeout := fs.Duration("timeout", defaultDiscoverTimeout, "How long to listen for agents")
+	var ifaces stringList
+	fs.Var(&ifaces, "interface", "Network interface to browse on; repeat for several (default: every multicast interface)")
+	fs.Parse(args)
+
+	report, err := discoverAgents(context.Background(), DiscoveryConfig{Interfaces: ifaces}, *timeout)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// stringList is a flag that may be repeated
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
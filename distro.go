@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rothgar/cosi/api"
+	"gopkg.in/yaml.v3"
+)
+
+// Family of each package manager, tried after the os-release ID and ID_LIKE so that
+// e.g. Fedora, which has no ID_LIKE, still matches rhel entries
+var packageManagerFamilies = map[string]string{
+	"apt":     "debian",
+	"dnf":     "rhel",
+	"yum":     "rhel",
+	"portage": "gentoo",
+	"nix":     "nixos",
+}
+
+// PackageEntry is one package in a manifest list: a plain name, or a name per
+// distribution, as in `- name: {debian: apache2, rhel: httpd}`
+type PackageEntry struct {
+	Name string
+	// ByFamily maps an os-release ID or ID_LIKE family to the package name there
+	ByFamily map[string]string
+	// When limits the entry to hosts matching the condition
+	When *Condition
+}
+
+// SkippedEntry is a manifest entry left out on this host
+type SkippedEntry = api.SkippedEntry
+
+func (e *PackageEntry) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&e.Name)
+	}
+	if node.Kind != yaml.MappingNode {
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: entry must be a package name or a mapping with name", node.Line)}}
+	}
+
+	// Decoding a node doesn't inherit KnownFields, so the keys are checked here
+	var nameNode *yaml.Node
+	var problems []string
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		switch key.Value {
+		case "name":
+			nameNode = node.Content[i+1]
+		case "when":
+			e.When = &Condition{}
+			if err := node.Content[i+1].Decode(e.When); err != nil {
+				var typeErr *yaml.TypeError
+				if !errors.As(err, &typeErr) {
+					return err
+				}
+				problems = append(problems, typeErr.Errors...)
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("line %d: field %s not found in type main.PackageEntry", key.Line, key.Value))
+		}
+	}
+	if nameNode == nil {
+		problems = append(problems, fmt.Sprintf("line %d: entry has no name", node.Line))
+	}
+	if len(problems) > 0 {
+		return &yaml.TypeError{Errors: problems}
+	}
+
+	if nameNode.Kind == yaml.ScalarNode {
+		return nameNode.Decode(&e.Name)
+	}
+	if nameNode.Kind != yaml.MappingNode {
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: name must be a package name or a map of distribution to name", nameNode.Line)}}
+	}
+	return nameNode.Decode(&e.ByFamily)
+}
+
+// String shows the name of the entry the way it was written, for messages
+func (e PackageEntry) String() string {
+	if e.ByFamily == nil {
+		return e.Name
+	}
+	families := make([]string, 0, len(e.ByFamily))
+	for family, name := range e.ByFamily {
+		families = append(families, family+": "+name)
+	}
+	sort.Strings(families)
+	return "{" + strings.Join(families, ", ") + "}"
+}
+
+// Function to pick the package name of an entry on a host, trying its families in order.
+// It returns false when the entry has no name for any of them.
+func (e PackageEntry) resolve(families []string) (string, bool) {
+	if e.ByFamily == nil {
+		return e.Name, true
+	}
+	for _, family := range families {
+		if name, ok := e.ByFamily[family]; ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Function to list the names a host's packages may be mapped under, most specific first:
+// the os-release ID, each ID_LIKE entry, then the family of its package manager
+func hostFamilies(osRelease map[string]string) []string {
+	var families []string
+	add := func(family string) {
+		for _, existing := range families {
+			if existing == family {
+				return
+			}
+		}
+		families = append(families, family)
+	}
+	if id := osRelease["ID"]; id != "" {
+		add(id)
+	}
+	for _, like := range strings.Fields(osRelease["ID_LIKE"]) {
+		add(like)
+	}
+	// The image manager of image-based hosts has no family
+	if pm := packageManagerFor(osRelease); pm != nil && packageManagerFamilies[pm.Name()] != "" {
+		add(packageManagerFamilies[pm.Name()])
+	}
+	return families
+}
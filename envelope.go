@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Header clients send to ask for enveloped responses; ?envelope=true does the same
+const envelopeHeader = "X-Cosi-Envelope"
+
+// EnvelopeHost identifies the agent that produced an enveloped response
+type EnvelopeHost struct {
+	Hostname     string `json:"hostname"`
+	MachineID    string `json:"machine_id"`
+	AgentVersion string `json:"agent_version"`
+}
+
+// Envelope wraps a JSON response body with the host and time it came from, so responses
+// collected from many agents stay attributable
+type Envelope struct {
+	Host        EnvelopeHost    `json:"host"`
+	CollectedAt time.Time       `json:"collected_at"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// Helper function to check if a request asks for an enveloped response
+func wantsEnvelope(c *gin.Context) bool {
+	for _, value := range []string{c.GetHeader(envelopeHeader), c.Query("envelope")} {
+		if enabled, err := strconv.ParseBool(value); err == nil && enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware to wrap JSON responses, errors included, in an Envelope for clients that ask
+// for it. Other responses, like streams and downloads, are passed through unchanged, and
+// clients that don't ask get the usual body.
+func envelopeResponses(c *gin.Context) {
+	if c.Request.Method == "HEAD" || !wantsEnvelope(c) {
+		c.Next()
+		return
+	}
+	writer := &envelopeWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	defer writer.finish()
+	c.Next()
+}
+
+// envelopeWriter holds back a JSON response body until the handler is done to wrap it
+type envelopeWriter struct {
+	gin.ResponseWriter
+	buffer bytes.Buffer
+	// decided is set on the first write, once the content type says whether to wrap the body
+	decided  bool
+	wrapping bool
+}
+
+func (w *envelopeWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		w.decided = true
+		w.wrapping = strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+	}
+	if w.wrapping {
+		return w.buffer.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *envelopeWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Written reports buffered output as written so gin doesn't send a second header
+func (w *envelopeWriter) Written() bool {
+	return w.buffer.Len() > 0 || w.ResponseWriter.Written()
+}
+
+// Flush sends the body as it is: a handler that flushes is streaming, and the stream
+// would otherwise be held back until it ends
+func (w *envelopeWriter) Flush() {
+	if w.wrapping {
+		w.wrapping = false
+		w.ResponseWriter.Write(w.buffer.Bytes())
+		w.buffer.Reset()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Helper function to send the wrapped body once the handlers are done
+func (w *envelopeWriter) finish() {
+	if !w.wrapping {
+		return
+	}
+	hostname, _ := os.Hostname()
+	envelope := Envelope{
+		Host:        EnvelopeHost{Hostname: hostname, MachineID: machineID(), AgentVersion: version},
+		CollectedAt: time.Now().UTC(),
+		Data:        json.RawMessage(bytes.TrimSpace(w.buffer.Bytes())),
+	}
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		// Not valid JSON after all, so it goes out as the handler wrote it
+		body = w.buffer.Bytes()
+	} else {
+		header := w.Header()
+		header.Add("Vary", envelopeHeader)
+		header.Del("Content-Length")
+		// The envelope differs on every request, so a strong ETag becomes weak
+		if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			header.Set("ETag", "W/"+etag)
+		}
+	}
+	w.ResponseWriter.Write(body)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Mount point of the cgroup hierarchies
+const cgroupRoot = "/sys/fs/cgroup"
+
+// Controllers a cgroup v1 mount can carry in its options, as listed in /proc/cgroups
+var cgroupV1Controllers = map[string]bool{
+	"cpuset": true, "cpu": true, "cpuacct": true, "blkio": true, "memory": true, "devices": true,
+	"freezer": true, "net_cls": true, "perf_event": true, "net_prio": true, "hugetlb": true,
+	"pids": true, "rdma": true, "misc": true,
+}
+
+// Parts of the agent's cgroup path that container runtimes create
+var containerCgroup = regexp.MustCompile(`(?:^|/)(docker|kubepods|containerd|cri-containerd|crio|libpod|lxc|buildkit)[-/.:]`)
+
+// RuntimeEnvironment describes where the agent runs, for GET /runtime-environment
+type RuntimeEnvironment struct {
+	// CgroupVersion is unified (v2 only), hybrid (v1 with a v2 mount for systemd), or
+	// legacy (v1 only), or unknown when /sys/fs/cgroup isn't mounted
+	CgroupVersion string   `json:"cgroup_version"`
+	Controllers   []string `json:"controllers"`
+	// Containerized is set when the agent looks like it runs in a container, with the
+	// signs in Evidence
+	Containerized bool     `json:"containerized"`
+	Evidence      []string `json:"evidence"`
+	// Systemd is set when systemd is PID 1 of the agent's PID namespace
+	Systemd bool `json:"systemd"`
+	// CgroupDriver is the driver kubelet and the container runtimes should use, systemd
+	// when systemd manages the cgroups and cgroupfs otherwise
+	CgroupDriver string `json:"cgroup_driver"`
+	// ConfiguredDrivers are the cgroup drivers the installed kubelet and containerd
+	// are configured with, when they are
+	ConfiguredDrivers map[string]string `json:"configured_drivers,omitempty"`
+}
+
+// environmentProbe holds what the environment is detected from, so the detection can
+// run on captured layouts as well as the live host
+type environmentProbe struct {
+	// Mountinfo is /proc/self/mountinfo and SelfCgroup is /proc/self/cgroup
+	Mountinfo  string
+	SelfCgroup string
+	// UnifiedControllers is cgroup.controllers of the v2 root, when mounted
+	UnifiedControllers string
+	// ContainerEnv is the container variable set by systemd-nspawn, podman, and others
+	ContainerEnv string
+	// Files are the marker files that exist, like /.dockerenv
+	Files map[string]bool
+	// InitComm is the command name of PID 1
+	InitComm string
+}
+
+// Function to read the probe of the running host
+func liveEnvironmentProbe() environmentProbe {
+	read := func(path string) string {
+		data, _ := os.ReadFile(path)
+		return string(data)
+	}
+	probe := environmentProbe{
+		Mountinfo:          read("/proc/self/mountinfo"),
+		SelfCgroup:         read("/proc/self/cgroup"),
+		UnifiedControllers: read(cgroupRoot + "/cgroup.controllers"),
+		ContainerEnv:       os.Getenv("container"),
+		Files:              make(map[string]bool),
+		InitComm:           strings.TrimSpace(read("/proc/1/comm")),
+	}
+	// The agent's own environment may have been cleaned; PID 1's is the reliable copy
+	for _, variable := range strings.Split(read("/proc/1/environ"), "\x00") {
+		if value, ok := strings.CutPrefix(variable, "container="); ok {
+			probe.ContainerEnv = value
+		}
+	}
+	if probe.UnifiedControllers == "" {
+		probe.UnifiedControllers = read(cgroupRoot + "/unified/cgroup.controllers")
+	}
+	for _, path := range []string{"/.dockerenv", "/run/.containerenv", "/run/systemd/system"} {
+		if _, err := os.Stat(path); err == nil {
+			probe.Files[path] = true
+		}
+	}
+	return probe
+}
+
+// Function to detect the cgroup layout and containerization from a probe
+func detectEnvironment(probe environmentProbe) RuntimeEnvironment {
+	env := RuntimeEnvironment{CgroupVersion: "unknown", Controllers: []string{}, Evidence: []string{}}
+
+	// mountinfo lines are "id parent dev root mountpoint options [optional...] - fstype source superoptions"
+	unifiedRoot, unifiedNested, legacy := false, false, false
+	controllers := make(map[string]bool)
+	for _, line := range strings.Split(probe.Mountinfo, "\n") {
+		before, after, ok := strings.Cut(line, " - ")
+		fields, tail := strings.Fields(before), strings.Fields(after)
+		if !ok || len(fields) < 5 || len(tail) < 3 {
+			continue
+		}
+		mountpoint, fstype := fields[4], tail[0]
+		if mountpoint != cgroupRoot && !strings.HasPrefix(mountpoint, cgroupRoot+"/") {
+			continue
+		}
+		switch fstype {
+		case "cgroup2":
+			if mountpoint == cgroupRoot {
+				unifiedRoot = true
+			} else {
+				unifiedNested = true
+			}
+		case "cgroup":
+			legacy = true
+			for _, option := range strings.Split(tail[2], ",") {
+				if cgroupV1Controllers[option] {
+					controllers[option] = true
+				}
+			}
+		}
+	}
+	switch {
+	case unifiedRoot:
+		env.CgroupVersion = "unified"
+	case legacy && unifiedNested:
+		env.CgroupVersion = "hybrid"
+	case legacy:
+		env.CgroupVersion = "legacy"
+	}
+	// On hybrid hosts the v2 mount has no controllers; the v1 ones do the work
+	if env.CgroupVersion == "unified" {
+		for _, controller := range strings.Fields(probe.UnifiedControllers) {
+			controllers[controller] = true
+		}
+	}
+	for controller := range controllers {
+		env.Controllers = append(env.Controllers, controller)
+	}
+	sort.Strings(env.Controllers)
+
+	if probe.ContainerEnv != "" {
+		env.Evidence = append(env.Evidence, "container environment variable is "+probe.ContainerEnv)
+	}
+	for _, marker := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if probe.Files[marker] {
+			env.Evidence = append(env.Evidence, marker+" exists")
+		}
+	}
+	for _, line := range strings.Split(probe.SelfCgroup, "\n") {
+		// Lines are "id:controllers:path"
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) == 3 && containerCgroup.MatchString(parts[2]) {
+			env.Evidence = append(env.Evidence, "cgroup path "+parts[2]+" belongs to a container runtime")
+			break
+		}
+	}
+	env.Containerized = len(env.Evidence) > 0
+
+	// systemd checks for /run/systemd/system the same way in sd_booted()
+	env.Systemd = probe.InitComm == "systemd" || probe.Files["/run/systemd/system"]
+	env.CgroupDriver = "cgroupfs"
+	if env.Systemd {
+		env.CgroupDriver = "systemd"
+	}
+	return env
+}
+
+var (
+	kubeletCgroupDriver     = regexp.MustCompile(`(?m)^cgroupDriver:\s*"?(\w+)"?`)
+	containerdSystemdCgroup = regexp.MustCompile(`(?m)^\s*SystemdCgroup\s*=\s*(true|false)`)
+)
+
+// Function to detect the runtime environment of the agent, with the cgroup drivers the
+// installed Kubernetes components are configured with
+func runtimeEnvironment() RuntimeEnvironment {
+	env := detectEnvironment(liveEnvironmentProbe())
+	drivers := make(map[string]string)
+	if data, err := os.ReadFile("/var/lib/kubelet/config.yaml"); err == nil {
+		if match := kubeletCgroupDriver.FindSubmatch(data); match != nil {
+			drivers["kubelet"] = string(match[1])
+		}
+	}
+	if data, err := os.ReadFile("/etc/containerd/config.toml"); err == nil {
+		if match := containerdSystemdCgroup.FindSubmatch(data); match != nil {
+			drivers["containerd"] = map[string]string{"true": "systemd", "false": "cgroupfs"}[string(match[1])]
+		}
+	}
+	if len(drivers) > 0 {
+		env.ConfiguredDrivers = drivers
+	}
+	return env
+}
+
+// Function to refuse bootstrapping Kubernetes from a container that can't reach the
+// host's systemd, where the installer would fail only at enabling kubelet
+func checkKubernetesEnvironment(env RuntimeEnvironment) error {
+	if env.Containerized && !env.Systemd {
+		return &requestError{
+			Status: 400,
+			Code:   "container_without_systemd",
+			Message: "The agent runs in a container without the host's systemd (" + strings.Join(env.Evidence, "; ") + "), " +
+				"so Kubernetes can't be installed from here; run the agent on the host",
+		}
+	}
+	return nil
+}
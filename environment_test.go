@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Helper function to load a cgroup layout captured in testdata/cgroup: mountinfo,
+// cgroup, and cgroup.controllers of the root v2 mount where there is one
+func cgroupProbe(t *testing.T, layout string) environmentProbe {
+	t.Helper()
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join("testdata", "cgroup", layout, name))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	mountinfo := read("mountinfo")
+	if mountinfo == "" {
+		t.Fatalf("layout %s has no mountinfo", layout)
+	}
+	return environmentProbe{
+		Mountinfo:          mountinfo,
+		SelfCgroup:         read("cgroup"),
+		UnifiedControllers: read("cgroup.controllers"),
+		Files:              map[string]bool{},
+	}
+}
+
+func TestDetectEnvironment(t *testing.T) {
+	systemdHost := map[string]bool{"/run/systemd/system": true}
+	tests := []struct {
+		layout       string
+		containerEnv string
+		files        map[string]bool
+		initComm     string
+		want         RuntimeEnvironment
+	}{
+		{"unified", "", systemdHost, "systemd", RuntimeEnvironment{
+			CgroupVersion: "unified",
+			Controllers:   []string{"cpu", "cpuset", "hugetlb", "io", "memory", "misc", "pids", "rdma"},
+			Evidence:      []string{},
+			Systemd:       true,
+			CgroupDriver:  "systemd",
+		}},
+		// name=systemd is a named hierarchy, not a controller
+		{"legacy", "", systemdHost, "systemd", RuntimeEnvironment{
+			CgroupVersion: "legacy",
+			Controllers:   []string{"blkio", "cpu", "cpuacct", "cpuset", "devices", "freezer", "hugetlb", "memory", "net_cls", "net_prio", "perf_event", "pids"},
+			Evidence:      []string{},
+			Systemd:       true,
+			CgroupDriver:  "systemd",
+		}},
+		{"hybrid", "", systemdHost, "systemd", RuntimeEnvironment{
+			CgroupVersion: "hybrid",
+			Controllers:   []string{"cpu", "cpuacct", "devices", "memory", "pids"},
+			Evidence:      []string{},
+			Systemd:       true,
+			CgroupDriver:  "systemd",
+		}},
+		// A private cgroup namespace hides the container's path; the marker file gives it away
+		{"docker-v2", "", map[string]bool{"/.dockerenv": true}, "cosi", RuntimeEnvironment{
+			CgroupVersion: "unified",
+			Controllers:   []string{"cpu", "cpuset", "hugetlb", "io", "memory", "pids", "rdma"},
+			Containerized: true,
+			Evidence:      []string{"/.dockerenv exists"},
+			CgroupDriver:  "cgroupfs",
+		}},
+		{"docker-v1", "", map[string]bool{"/.dockerenv": true}, "cosi", RuntimeEnvironment{
+			CgroupVersion: "legacy",
+			Controllers:   []string{"cpu", "cpuacct", "memory", "pids"},
+			Containerized: true,
+			Evidence:      []string{"/.dockerenv exists", "cgroup path /docker/9c2e0d7a5b1f belongs to a container runtime"},
+			CgroupDriver:  "cgroupfs",
+		}},
+		{"kubepods-v1", "", nil, "pause", RuntimeEnvironment{
+			CgroupVersion: "legacy",
+			Controllers:   []string{"cpu", "cpuacct", "memory", "pids"},
+			Containerized: true,
+			Evidence:      []string{"cgroup path /kubepods/burstable/pod7d4c1e2a-5f3b-4c1d-9e8f-0a1b2c3d4e5f/4b8e2f belongs to a container runtime"},
+			CgroupDriver:  "cgroupfs",
+		}},
+		// A system container runs its own systemd, so it is containerized but can manage units
+		{"podman-systemd", "podman", map[string]bool{"/run/.containerenv": true, "/run/systemd/system": true}, "systemd", RuntimeEnvironment{
+			CgroupVersion: "unified",
+			Controllers:   []string{"cpu", "io", "memory", "pids"},
+			Containerized: true,
+			Evidence:      []string{"container environment variable is podman", "/run/.containerenv exists"},
+			Systemd:       true,
+			CgroupDriver:  "systemd",
+		}},
+	}
+	for _, tt := range tests {
+		probe := cgroupProbe(t, tt.layout)
+		probe.ContainerEnv, probe.InitComm = tt.containerEnv, tt.initComm
+		if tt.files != nil {
+			probe.Files = tt.files
+		}
+		if got := detectEnvironment(probe); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", tt.layout, got, tt.want)
+		}
+	}
+
+	// Without /sys/fs/cgroup mounted nothing is known about the cgroups
+	env := detectEnvironment(environmentProbe{Mountinfo: "28 1 253:0 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n"})
+	if env.CgroupVersion != "unknown" || len(env.Controllers) != 0 || env.Containerized {
+		t.Errorf("no cgroup mounts = %+v", env)
+	}
+}
+
+func TestCheckKubernetesEnvironment(t *testing.T) {
+	tests := []struct {
+		layout   string
+		files    map[string]bool
+		initComm string
+		wantErr  bool
+	}{
+		{"unified", map[string]bool{"/run/systemd/system": true}, "systemd", false},
+		{"docker-v2", map[string]bool{"/.dockerenv": true}, "cosi", true},
+		{"kubepods-v1", nil, "pause", true},
+		{"podman-systemd", map[string]bool{"/run/.containerenv": true, "/run/systemd/system": true}, "systemd", false},
+	}
+	for _, tt := range tests {
+		probe := cgroupProbe(t, tt.layout)
+		probe.InitComm = tt.initComm
+		if tt.files != nil {
+			probe.Files = tt.files
+		}
+		err := checkKubernetesEnvironment(detectEnvironment(probe))
+		if !tt.wantErr {
+			if err != nil {
+				t.Errorf("%s: %v", tt.layout, err)
+			}
+			continue
+		}
+		reqErr, ok := err.(*requestError)
+		if !ok || reqErr.Code != "container_without_systemd" || !strings.Contains(reqErr.Message, "belongs to a container runtime") && !strings.Contains(reqErr.Message, "/.dockerenv") {
+			t.Errorf("%s: err = %v, want container_without_systemd with the evidence", tt.layout, err)
+		}
+	}
+}
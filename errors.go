@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// commandFailure describes how a failed command should be reported to the client
+type commandFailure struct {
+	Status     int
+	Code       string
+	RetryAfter int // Seconds, only set for transient failures
+}
+
+// failurePattern maps a stderr pattern from a tool onto a failure. ExitCode 0 matches any exit code.
+type failurePattern struct {
+	ExitCode int
+	Pattern  *regexp.Regexp
+	Failure  commandFailure
+}
+
+var (
+	permissionFailure = commandFailure{Status: 403, Code: "permission_denied"}
+	lockFailure       = commandFailure{Status: 409, Code: "package_manager_locked", RetryAfter: 30}
+	timeoutFailure    = commandFailure{Status: 504, Code: "timeout"}
+	// The client went away before the read finished, so nobody gets the response; 499 is
+	// what proxies log for a request the client closed
+	cancelledFailure  = commandFailure{Status: 499, Code: "request_cancelled"}
+	unexpectedFailure = commandFailure{Status: 500, Code: "command_failed"}
+	missingFailure    = commandFailure{Status: 500, Code: "command_not_found"}
+	sudoFailure       = commandFailure{Status: 403, Code: "sudo_password_required"}
+)
+
+// Patterns are checked in order, so permission errors come before lock errors
+// ("Could not open lock file ... (13: Permission denied)" mentions both).
+var failurePatterns = map[string][]failurePattern{
+	"apt-get": {
+		{Pattern: regexp.MustCompile(`(?i)permission denied|are you root\?`), Failure: permissionFailure},
+		{Pattern: regexp.MustCompile(`Could not get lock|Unable to acquire the dpkg frontend lock|is another process using it\?`), Failure: lockFailure},
+		{Pattern: regexp.MustCompile(`Unable to locate package|has no installation candidate`), Failure: commandFailure{Status: 422, Code: "package_not_found"}},
+	},
+	"dnf": {
+		{Pattern: regexp.MustCompile(`has to be run with superuser privileges|(?i)permission denied`), Failure: permissionFailure},
+		{Pattern: regexp.MustCompile(`Failed to obtain the transaction lock|Waiting for process with pid`), Failure: lockFailure},
+		{Pattern: regexp.MustCompile(`Unable to find a match|No match for argument|No packages marked for removal`), Failure: commandFailure{Status: 422, Code: "package_not_found"}},
+	},
+	"yum": {
+		{Pattern: regexp.MustCompile(`You need to be root|(?i)permission denied`), Failure: permissionFailure},
+		{Pattern: regexp.MustCompile(`Existing lock /var/run/yum.pid|Another app is currently holding the yum lock`), Failure: lockFailure},
+		{Pattern: regexp.MustCompile(`No package \S+ available|No Match for argument|No Packages marked for removal`), Failure: commandFailure{Status: 422, Code: "package_not_found"}},
+	},
+	"emerge": {
+		{Pattern: regexp.MustCompile(`requires superuser access|(?i)permission denied`), Failure: permissionFailure},
+		{Pattern: regexp.MustCompile(`there are no ebuilds to satisfy|there are no ebuilds built with USE flags`), Failure: commandFailure{Status: 422, Code: "package_not_found"}},
+	},
+	"dpkg-query": {
+		{ExitCode: 1, Pattern: regexp.MustCompile(`no packages found matching`), Failure: commandFailure{Status: 404, Code: "package_not_found"}},
+	},
+	"snap": {
+		{Pattern: regexp.MustCompile(`access denied|(?i)permission denied`), Failure: permissionFailure},
+		{Pattern: regexp.MustCompile(`has "[^"]*" change in progress`), Failure: commandFailure{Status: 409, Code: "snap_change_in_progress", RetryAfter: 30}},
+		{Pattern: regexp.MustCompile(`snap "[^"]*" not found`), Failure: commandFailure{Status: 422, Code: "package_not_found"}},
+	},
+	"flatpak": {
+		{Pattern: regexp.MustCompile(`(?i)permission denied|Not allowed`), Failure: permissionFailure},
+		{Pattern: regexp.MustCompile(`Nothing matches|No remote refs found`), Failure: commandFailure{Status: 422, Code: "package_not_found"}},
+	},
+	"systemctl": {
+		{Pattern: regexp.MustCompile(`Access denied|Interactive authentication required`), Failure: permissionFailure},
+		{ExitCode: 4, Pattern: regexp.MustCompile(`could not be found|not loaded|No such file`), Failure: commandFailure{Status: 404, Code: "unit_not_found"}},
+	},
+}
+
+// commandError carries the output of a failed command so handlers further up can classify it
+type commandError struct {
+	Tool   string
+	Result CommandResult
+	Err    error
+}
+
+func (e *commandError) Error() string {
+	return e.Tool + ": " + e.Err.Error()
+}
+
+func (e *commandError) Unwrap() error {
+	return e.Err
+}
+
+// Function to interpret a failed command from its tool, exit code, and stderr
+func classifyFailure(tool string, result CommandResult, err error) commandFailure {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return timeoutFailure
+	}
+	if errors.Is(err, context.Canceled) {
+		return cancelledFailure
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return missingFailure
+	}
+	if isSudoPasswordFailure(result) {
+		return sudoFailure
+	}
+
+	exitCode := -1
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+
+	for _, p := range failurePatterns[tool] {
+		if p.ExitCode != 0 && p.ExitCode != exitCode {
+			continue
+		}
+		if p.Pattern.MatchString(result.Stderr) || p.Pattern.MatchString(result.Stdout) {
+			return p.Failure
+		}
+	}
+	return unexpectedFailure
+}
+
+// Helper function to respond to a failed command with a status that matches the failure
+func respondCommandError(c *gin.Context, tool, message string, result CommandResult, err error) {
+	failure, response := commandErrorResponse(tool, message, result, err)
+	if failure.RetryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(failure.RetryAfter))
+	}
+	c.JSON(failure.Status, response)
+}
+
+// Helper function to build the response to a failed command
+func commandErrorResponse(tool, message string, result CommandResult, err error) (commandFailure, gin.H) {
+	failure := classifyFailure(tool, result, err)
+	response := gin.H{
+		"error":     message + ": " + err.Error(),
+		"code":      failure.Code,
+		"exit_code": result.ExitCode,
+		"output":    result.Output,
+		"stdout":    result.Stdout,
+		"stderr":    result.Stderr,
+	}
+	if failure == sudoFailure {
+		response["sudoers"] = sudoersLine(tool)
+	}
+	return failure, response
+}
+
+// requestError is a failure with the HTTP status and code to report, for errors that
+// don't come from a command, such as a failed checksum or precondition
+type requestError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *requestError) Error() string {
+	return e.Message
+}
+
+// responseError is a failure that comes with the complete response to send, for errors
+// with fields of their own like the problems of an invalid manifest
+type responseError struct {
+	Status   int
+	Response gin.H
+}
+
+func (e *responseError) Error() string {
+	message, _ := e.Response["error"].(string)
+	return message
+}
+
+// operationError is the failure of an operation shared by the REST and gRPC APIs, with
+// the message the REST endpoint reports it under
+type operationError struct {
+	Message string
+	Err     error
+}
+
+func (e *operationError) Error() string {
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *operationError) Unwrap() error {
+	return e.Err
+}
+
+// Helper function to respond to an error that may wrap a failed command or carry its own status
+func respondFailure(c *gin.Context, message string, err error) {
+	var opErr *operationError
+	if errors.As(err, &opErr) {
+		message, err = opErr.Message, opErr.Err
+	}
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		respondCommandError(c, cmdErr.Tool, message, cmdErr.Result, cmdErr.Err)
+		return
+	}
+	c.JSON(failureResponse(message, err))
+}
+
+// Helper function to build the status and body of the response to an error, for
+// respondFailure and the gRPC API
+func failureResponse(message string, err error) (int, gin.H) {
+	if errors.Is(err, context.Canceled) {
+		return cancelledFailure.Status, gin.H{"error": message + ": " + err.Error(), "code": cancelledFailure.Code}
+	}
+	var opErr *operationError
+	if errors.As(err, &opErr) {
+		message, err = opErr.Message, opErr.Err
+	}
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		failure, response := commandErrorResponse(cmdErr.Tool, message, cmdErr.Result, cmdErr.Err)
+		return failure.Status, response
+	}
+	var lockErr *lockHeldError
+	if errors.As(err, &lockErr) {
+		return 409, gin.H{"error": message + ": " + lockErr.Error(), "code": "package_manager_busy", "holders": lockErr.Holders, "waited_seconds": lockErr.Waited.Seconds()}
+	}
+	var bootstrapErr *bootstrapFailure
+	if errors.As(err, &bootstrapErr) {
+		return bootstrapErr.response()
+	}
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		response := gin.H{"error": reqErr.Message}
+		if reqErr.Code != "" {
+			response["code"] = reqErr.Code
+		}
+		return reqErr.Status, response
+	}
+	var respErr *responseError
+	if errors.As(err, &respErr) {
+		return respErr.Status, respErr.Response
+	}
+	return 500, gin.H{"error": message + ": " + err.Error()}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Helper function to get the error of a command that exits with code
+func exitError(t *testing.T, code int) error {
+	t.Helper()
+	err := exec.Command("sh", "-c", fmt.Sprintf("exit %d", code)).Run()
+	if err == nil {
+		t.Fatalf("exit %d succeeded", code)
+	}
+	return err
+}
+
+// Helper function to read the captured output of a tool from testdata/failures/<tool>/<name>.std{out,err}
+func failureFixture(t *testing.T, tool, name string) CommandResult {
+	t.Helper()
+	var result CommandResult
+	found := false
+	for _, stream := range []struct {
+		ext string
+		dst *string
+	}{{".stdout", &result.Stdout}, {".stderr", &result.Stderr}} {
+		data, err := os.ReadFile(filepath.Join("testdata", "failures", tool, name+stream.ext))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		*stream.dst = string(data)
+		found = true
+	}
+	if !found {
+		t.Fatalf("no fixture for %s %s", tool, name)
+	}
+	result.Output = result.Stdout + result.Stderr
+	return result
+}
+
+func TestClassifyFailureFixtures(t *testing.T) {
+	tests := []struct {
+		tool     string
+		fixture  string
+		exitCode int
+		want     commandFailure
+	}{
+		{"apt-get", "not-root", 100, permissionFailure},
+		{"apt-get", "locked", 100, lockFailure},
+		{"apt-get", "not-found", 100, commandFailure{Status: 422, Code: "package_not_found"}},
+		{"apt-get", "no-candidate", 100, commandFailure{Status: 422, Code: "package_not_found"}},
+		{"apt-get", "dpkg-error", 100, unexpectedFailure},
+		{"dnf", "not-root", 1, permissionFailure},
+		{"dnf", "locked", 1, lockFailure},
+		{"dnf", "not-found", 1, commandFailure{Status: 422, Code: "package_not_found"}},
+		{"dnf", "remove-missing", 1, commandFailure{Status: 422, Code: "package_not_found"}},
+		{"dnf", "repo-down", 1, unexpectedFailure},
+		{"yum", "not-root", 1, permissionFailure},
+		{"yum", "locked", 1, lockFailure},
+		{"yum", "not-found", 1, commandFailure{Status: 422, Code: "package_not_found"}},
+		{"yum", "remove-missing", 1, commandFailure{Status: 422, Code: "package_not_found"}},
+		{"emerge", "not-root", 1, permissionFailure},
+		{"emerge", "not-found", 1, commandFailure{Status: 422, Code: "package_not_found"}},
+		{"emerge", "use-flags", 1, commandFailure{Status: 422, Code: "package_not_found"}},
+		{"emerge", "slot-conflict", 1, unexpectedFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tool+"/"+tt.fixture, func(t *testing.T) {
+			result := failureFixture(t, tt.tool, tt.fixture)
+			if got := classifyFailure(tt.tool, result, exitError(t, tt.exitCode)); got != tt.want {
+				t.Errorf("classifyFailure = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyFailureExitCode(t *testing.T) {
+	result := CommandResult{Stderr: "dpkg-query: no packages found matching kubelett\n"}
+	if got := classifyFailure("dpkg-query", result, exitError(t, 1)); got.Status != 404 {
+		t.Errorf("exit 1: status %d, want 404", got.Status)
+	}
+	// The pattern only counts with the exit code it was seen with
+	if got := classifyFailure("dpkg-query", result, exitError(t, 2)); got != unexpectedFailure {
+		t.Errorf("exit 2: %+v, want %+v", got, unexpectedFailure)
+	}
+}
+
+func TestClassifyFailureErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		result CommandResult
+		err    error
+		want   commandFailure
+	}{
+		{"timeout", CommandResult{}, fmt.Errorf("apt-get: %w", context.DeadlineExceeded), timeoutFailure},
+		{"cancelled", CommandResult{}, context.Canceled, cancelledFailure},
+		{"missing", CommandResult{}, &exec.Error{Name: "apt-get", Err: exec.ErrNotFound}, missingFailure},
+		{"sudo", CommandResult{Stderr: "sudo: a password is required\n"}, errors.New("exit status 1"), sudoFailure},
+	}
+	for _, tt := range tests {
+		if got := classifyFailure("apt-get", tt.result, tt.err); got != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRespondCommandErrorRetryAfter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	result := failureFixture(t, "apt-get", "locked")
+	respondCommandError(c, "apt-get", "Failed to install packages", result, exitError(t, 100))
+	if w.Code != 409 {
+		t.Errorf("status %d, want 409", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After %q, want 30", got)
+	}
+}
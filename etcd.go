@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultEtcdBackupDir  = "/var/backups/etcd"
+	defaultEtcdBackupKeep = 7
+	// How long the health and status queries may take together
+	etcdStatusTimeout = 30 * time.Second
+	// How long a snapshot may take, which grows with the database
+	etcdBackupTimeout = 10 * time.Minute
+	// kubeadm's defaults, used when the manifest doesn't say otherwise
+	defaultEtcdEndpoint = "https://127.0.0.1:2379"
+	defaultEtcdPKIDir   = "/etc/kubernetes/pki/etcd"
+	defaultEtcdDataDir  = "/var/lib/etcd"
+)
+
+// Snapshots are named after when they were taken, so they sort oldest first
+const etcdSnapshotPrefix, etcdSnapshotSuffix = "etcd-snapshot-", ".db"
+
+// Only one snapshot is taken at a time
+var etcdBackingUp sync.Mutex
+
+// EtcdConfig sets where POST /kubernetes/etcd/backup keeps snapshots and how many
+type EtcdConfig struct {
+	BackupDir string `yaml:"backup_dir"`
+	// Keep is how many snapshots to keep; older ones are removed after each backup
+	Keep int `yaml:"keep"`
+	// MaxAge removes snapshots older than this after each backup, when set. The newest
+	// snapshot is always kept.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// Function to check the etcd settings
+func (e EtcdConfig) validate() error {
+	if e.BackupDir != "" && !filepath.IsAbs(e.BackupDir) {
+		return fmt.Errorf("etcd.backup_dir must be an absolute path")
+	}
+	if e.Keep < 0 || e.MaxAge < 0 {
+		return fmt.Errorf("etcd.keep and etcd.max_age must not be negative")
+	}
+	return nil
+}
+
+func (e EtcdConfig) backupDir() string {
+	if e.BackupDir != "" {
+		return e.BackupDir
+	}
+	return defaultEtcdBackupDir
+}
+
+func (e EtcdConfig) keep() int {
+	return int(orDefault(int64(e.Keep), defaultEtcdBackupKeep))
+}
+
+// EtcdStatus is the response of GET /kubernetes/etcd
+type EtcdStatus struct {
+	Endpoint string `json:"endpoint"`
+	// Via is how etcdctl was run: on the host, or in the etcd container through crictl
+	Via     string `json:"via"`
+	Healthy bool   `json:"healthy"`
+	Took    string `json:"took,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	Version          string   `json:"version,omitempty"`
+	ClusterID        string   `json:"cluster_id,omitempty"`
+	MemberID         string   `json:"member_id,omitempty"`
+	LeaderID         string   `json:"leader_id,omitempty"`
+	IsLeader         bool     `json:"is_leader"`
+	IsLearner        bool     `json:"is_learner"`
+	DBSizeBytes      int64    `json:"db_size_bytes,omitempty"`
+	DBSizeInUseBytes int64    `json:"db_size_in_use_bytes,omitempty"`
+	Revision         int64    `json:"revision,omitempty"`
+	RaftTerm         uint64   `json:"raft_term,omitempty"`
+	RaftIndex        uint64   `json:"raft_index,omitempty"`
+	Errors           []string `json:"errors,omitempty"`
+
+	// Backups are the snapshots in the backup directory, newest first
+	Backups []EtcdBackup `json:"backups"`
+}
+
+// EtcdBackup is a snapshot of the etcd database
+type EtcdBackup struct {
+	Path      string    `json:"path"`
+	SizeBytes int64     `json:"size_bytes"`
+	SHA256    string    `json:"sha256,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Revision, TotalKeys and Hash are what etcdctl snapshot status read from the file
+	Revision  int64  `json:"revision,omitempty"`
+	TotalKeys int64  `json:"total_keys,omitempty"`
+	Hash      uint32 `json:"hash,omitempty"`
+}
+
+// etcdctl runs etcdctl against the local member, either from the host or inside the
+// etcd container. kubeadm mounts the certificates and data directory into the container
+// at their host paths, so the same paths work both ways.
+type etcdctl struct {
+	Endpoint string
+	PKIDir   string
+	DataDir  string
+	// Container is the etcd container, when there's no etcdctl on the host
+	Container       string
+	RuntimeEndpoint string
+}
+
+// Function to describe how etcdctl is run
+func (e etcdctl) via() string {
+	if e.Container != "" {
+		return "crictl exec " + e.Container
+	}
+	return "etcdctl"
+}
+
+// Function to build an etcdctl command, authenticating with the health check client
+// certificate kubeadm creates for the etcd probes
+func (e etcdctl) command(args ...string) *exec.Cmd {
+	args = append([]string{
+		"--endpoints=" + e.Endpoint,
+		"--cacert=" + filepath.Join(e.PKIDir, "ca.crt"),
+		"--cert=" + filepath.Join(e.PKIDir, "healthcheck-client.crt"),
+		"--key=" + filepath.Join(e.PKIDir, "healthcheck-client.key"),
+		"--dial-timeout=5s",
+	}, args...)
+	if e.Container == "" {
+		cmd := newCommand("etcdctl", args...)
+		cmd.Env = append(cmd.Env, "ETCDCTL_API=3")
+		return cmd
+	}
+	execArgs := append([]string{"exec", e.Container, "etcdctl"}, args...)
+	if e.RuntimeEndpoint != "" {
+		execArgs = append([]string{"--runtime-endpoint", e.RuntimeEndpoint}, execArgs...)
+	}
+	return newCommand("crictl", execArgs...)
+}
+
+// Function to run etcdctl, returning its output even when it fails since the JSON
+// output of an unhealthy endpoint still says why
+func (e etcdctl) run(ctx context.Context, args ...string) (CommandResult, error) {
+	cmd := e.command(args...)
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return result, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	return result, nil
+}
+
+// Function to find the local etcd member from its static pod. A node without one is
+// a worker, or a control plane node of a cluster with external etcd.
+func localEtcd(ctx context.Context) (*etcdctl, error) {
+	path, err := findStaticPod("etcd")
+	var reqErr *requestError
+	if errors.As(err, &reqErr) && reqErr.Code == "manifest_not_found" {
+		return nil, &requestError{409, "not_a_control_plane", fmt.Sprintf("There is no etcd static pod in %s; this node is not a kubeadm control plane node with local etcd", staticPodDir())}
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &etcdctl{Endpoint: defaultEtcdEndpoint, PKIDir: defaultEtcdPKIDir, DataDir: defaultEtcdDataDir}
+	manifest := describeStaticPod("etcd", path, data)
+	for _, container := range manifest.Containers {
+		if container.Name != "etcd" {
+			continue
+		}
+		var listen, advertise []string
+		for _, flag := range container.Flags {
+			if flag.Value == nil {
+				continue
+			}
+			switch flag.Flag {
+			case "--listen-client-urls":
+				listen = strings.Split(*flag.Value, ",")
+			case "--advertise-client-urls":
+				advertise = strings.Split(*flag.Value, ",")
+			case "--trusted-ca-file":
+				e.PKIDir = filepath.Dir(*flag.Value)
+			case "--data-dir":
+				e.DataDir = *flag.Value
+			}
+		}
+		// Loopback is preferred since the health check certificate is only valid for it
+		loopback := false
+		for _, endpoint := range append(listen, advertise...) {
+			if u, err := url.Parse(endpoint); err == nil && (u.Hostname() == "127.0.0.1" || u.Hostname() == "localhost") {
+				e.Endpoint, loopback = endpoint, true
+				break
+			}
+		}
+		if !loopback && len(advertise) > 0 {
+			e.Endpoint = advertise[0]
+		}
+	}
+
+	if _, err := exec.LookPath("etcdctl"); err == nil {
+		return e, nil
+	}
+	if _, err := exec.LookPath("crictl"); err != nil {
+		return nil, &requestError{501, "etcdctl_missing", "Neither etcdctl nor crictl is installed, so etcd can't be queried"}
+	}
+	var spec staticPodSpec
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return nil, &requestError{422, "invalid_manifest", "the etcd manifest is not valid YAML: " + err.Error()}
+	}
+	e.RuntimeEndpoint = readKubeletConfig().ContainerRuntimeEndpoint
+	sandboxes, err := staticPodSandboxes(ctx, e.RuntimeEndpoint, spec)
+	if err != nil {
+		return nil, err
+	}
+	for _, sandbox := range sandboxes {
+		if sandbox.State != "SANDBOX_READY" {
+			continue
+		}
+		var output struct {
+			Containers []criContainer `json:"containers"`
+		}
+		if err := runCrictl(ctx, e.RuntimeEndpoint, &output, "ps", "--pod", sandbox.ID, "--state", "running", "-o", "json"); err != nil {
+			return nil, err
+		}
+		for _, container := range output.Containers {
+			if container.Metadata.Name == "etcd" {
+				e.Container = container.ID
+				return e, nil
+			}
+		}
+	}
+	return nil, &requestError{503, "etcd_not_running", "The etcd container is not running, and there is no etcdctl on the host to reach it with"}
+}
+
+// Function to query the health and status of the local etcd member. An unhealthy member
+// is reported in the status rather than as an error.
+func etcdStatus(ctx context.Context) (*EtcdStatus, error) {
+	e, err := localEtcd(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, etcdStatusTimeout)
+	defer cancel()
+	status := &EtcdStatus{Endpoint: e.Endpoint, Via: e.via()}
+
+	result, err := e.run(ctx, "endpoint", "health", "-w", "json")
+	var health []struct {
+		Health bool   `json:"health"`
+		Took   string `json:"took"`
+		Error  string `json:"error"`
+	}
+	if json.Unmarshal([]byte(result.Stdout), &health) == nil && len(health) > 0 {
+		status.Healthy, status.Took, status.Error = health[0].Health, health[0].Took, health[0].Error
+	} else if err != nil {
+		status.Error = strings.TrimSpace(result.Stderr)
+		if status.Error == "" {
+			status.Error = err.Error()
+		}
+	}
+
+	if status.Healthy {
+		result, err := e.run(ctx, "endpoint", "status", "-w", "json")
+		var statuses []struct {
+			Status struct {
+				Header struct {
+					ClusterID uint64 `json:"cluster_id"`
+					MemberID  uint64 `json:"member_id"`
+					Revision  int64  `json:"revision"`
+				} `json:"header"`
+				Version     string   `json:"version"`
+				DBSize      int64    `json:"dbSize"`
+				DBSizeInUse int64    `json:"dbSizeInUse"`
+				Leader      uint64   `json:"leader"`
+				RaftIndex   uint64   `json:"raftIndex"`
+				RaftTerm    uint64   `json:"raftTerm"`
+				IsLearner   bool     `json:"isLearner"`
+				Errors      []string `json:"errors"`
+			} `json:"Status"`
+		}
+		switch {
+		case err != nil:
+			status.Error = "endpoint status: " + strings.TrimSpace(result.Stderr)
+		case json.Unmarshal([]byte(result.Stdout), &statuses) != nil || len(statuses) == 0:
+			status.Error = "endpoint status: unexpected output from etcdctl"
+		default:
+			s := statuses[0].Status
+			// IDs are shown in hex, as etcdctl's tables show them
+			status.ClusterID = fmt.Sprintf("%x", s.Header.ClusterID)
+			status.MemberID = fmt.Sprintf("%x", s.Header.MemberID)
+			status.LeaderID = fmt.Sprintf("%x", s.Leader)
+			status.IsLeader = s.Leader != 0 && s.Leader == s.Header.MemberID
+			status.IsLearner = s.IsLearner
+			status.Version = s.Version
+			status.DBSizeBytes, status.DBSizeInUseBytes = s.DBSize, s.DBSizeInUse
+			status.Revision, status.RaftTerm, status.RaftIndex = s.Header.Revision, s.RaftTerm, s.RaftIndex
+			status.Errors = s.Errors
+		}
+	}
+
+	status.Backups, err = listEtcdBackups(currentConfig().Etcd.backupDir())
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Function to list the snapshots in the backup directory, newest first
+func listEtcdBackups(dir string) ([]EtcdBackup, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []EtcdBackup{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	backups := []EtcdBackup{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, etcdSnapshotPrefix) || !strings.HasSuffix(name, etcdSnapshotSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		created := info.ModTime().UTC()
+		if taken, err := time.Parse("20060102T150405Z", strings.TrimSuffix(strings.TrimPrefix(name, etcdSnapshotPrefix), etcdSnapshotSuffix)); err == nil {
+			created = taken
+		}
+		backups = append(backups, EtcdBackup{Path: filepath.Join(dir, name), SizeBytes: info.Size(), CreatedAt: created})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+// Function to remove the snapshots past the configured count and age, never the newest
+func pruneEtcdBackups(config EtcdConfig) ([]string, error) {
+	backups, err := listEtcdBackups(config.backupDir())
+	if err != nil {
+		return nil, err
+	}
+	pruned := []string{}
+	for i, backup := range backups {
+		if i == 0 {
+			continue
+		}
+		if i < config.keep() && (config.MaxAge == 0 || time.Since(backup.CreatedAt) <= config.MaxAge) {
+			continue
+		}
+		if err := os.Remove(backup.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return pruned, err
+		}
+		pruned = append(pruned, backup.Path)
+	}
+	return pruned, nil
+}
+
+// Helper function to move a file, copying it when it's on another filesystem
+func moveFile(from, to string) error {
+	err := os.Rename(from, to)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(target, source)
+	if err == nil {
+		err = target.Sync()
+	}
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Remove(from)
+}
+
+// Function to take a snapshot of the local etcd member, check it with etcdctl
+// snapshot status, and prune the old ones. Through crictl the snapshot is written into
+// the data directory, the one host path the container can write to, then moved.
+func backupEtcd(ctx context.Context) (*EtcdBackup, []string, error) {
+	e, err := localEtcd(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !etcdBackingUp.TryLock() {
+		return nil, nil, &requestError{409, "etcd_backup_running", "An etcd backup is already running"}
+	}
+	defer etcdBackingUp.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, etcdBackupTimeout)
+	defer cancel()
+
+	config := currentConfig().Etcd
+	if err := os.MkdirAll(config.backupDir(), 0700); err != nil {
+		return nil, nil, err
+	}
+	taken := time.Now().UTC()
+	name := etcdSnapshotPrefix + taken.Format("20060102T150405Z") + etcdSnapshotSuffix
+	final := filepath.Join(config.backupDir(), name)
+	if _, err := os.Stat(final); err == nil {
+		return nil, nil, &requestError{409, "etcd_backup_running", "A snapshot was taken less than a second ago"}
+	}
+	// Hidden until verified, so a failed snapshot is never listed or kept by pruning
+	staged := filepath.Join(config.backupDir(), ".cosi-"+name)
+	if e.Container != "" {
+		staged = filepath.Join(e.DataDir, ".cosi-"+name)
+	}
+	defer os.Remove(staged)
+
+	if _, err := e.run(ctx, "snapshot", "save", staged); err != nil {
+		return nil, nil, err
+	}
+	result, err := e.run(ctx, "snapshot", "status", staged, "-w", "json")
+	var snapshot struct {
+		Hash      uint32 `json:"hash"`
+		Revision  int64  `json:"revision"`
+		TotalKey  int64  `json:"totalKey"`
+		TotalSize int64  `json:"totalSize"`
+	}
+	if err != nil || json.Unmarshal([]byte(result.Stdout), &snapshot) != nil || snapshot.TotalKey == 0 {
+		message := "etcdctl snapshot status could not read the snapshot"
+		if stderr := strings.TrimSpace(result.Stderr); stderr != "" {
+			message += ": " + stderr
+		}
+		return nil, nil, &requestError{502, "etcd_snapshot_invalid", message}
+	}
+	if err := os.Chmod(staged, 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := moveFile(staged, final); err != nil {
+		return nil, nil, err
+	}
+	syncDir(config.backupDir())
+
+	backup := &EtcdBackup{Path: final, CreatedAt: taken, Revision: snapshot.Revision, TotalKeys: snapshot.TotalKey, Hash: snapshot.Hash}
+	if info, err := os.Stat(final); err == nil {
+		backup.SizeBytes = info.Size()
+	}
+	if backup.SHA256, err = fileSHA256(final); err != nil {
+		return nil, nil, err
+	}
+	pruned, err := pruneEtcdBackups(config)
+	if err != nil {
+		return backup, pruned, fmt.Errorf("the snapshot was saved to %s, but pruning old snapshots failed: %w", final, err)
+	}
+	return backup, pruned, nil
+}
+
+// Function to register the etcd endpoints
+func registerEtcdRoutes(r *gin.Engine) {
+	// Define the /kubernetes/etcd endpoint that reports the health of the local etcd
+	// member, its database size, whether it leads the cluster, and the stored snapshots
+	r.GET("/kubernetes/etcd", func(c *gin.Context) {
+		status, err := etcdStatus(c.Request.Context())
+		if err != nil {
+			respondFailure(c, "Failed to query etcd", err)
+			return
+		}
+		c.JSON(200, status)
+	})
+
+	// Define the /kubernetes/etcd/backup endpoint that snapshots the etcd database into
+	// the backup directory
+	r.POST("/kubernetes/etcd/backup", func(c *gin.Context) {
+		// A snapshot can take minutes; one the client gives up on is still finished and
+		// checked rather than left half written
+		backup, pruned, err := backupEtcd(context.WithoutCancel(c.Request.Context()))
+		details := map[string]interface{}{}
+		if backup != nil {
+			details["path"] = backup.Path
+			details["sha256"] = backup.SHA256
+			details["pruned"] = pruned
+		}
+		audit.Record(auditOutcome("kubernetes.etcd.backup", c.ClientIP(), details, err))
+		if err != nil {
+			respondFailure(c, "Failed to back up etcd", err)
+			return
+		}
+		c.JSON(201, gin.H{"backup": backup, "pruned": pruned})
+	})
+}
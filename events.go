@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rothgar/cosi/api"
+)
+
+const (
+	// Number of events kept, in memory and in <state dir>/events.json
+	maxEventHistory = 500
+	// Most events GET /events returns by default
+	defaultEventLimit = 100
+	// Interval of the keepalive comments on /events/stream, so proxies keep it open
+	eventStreamKeepalive = 30 * time.Second
+)
+
+// Event is an entry of the host timeline. IDs increase by one with every event and
+// carry on across restarts, so clients can resume from the last one they saw.
+type Event = api.Event
+
+// eventLog keeps a bounded ring of recent events and fans new ones out to streams
+type eventLog struct {
+	mu          sync.Mutex
+	events      []Event
+	nextID      int64
+	subscribers map[chan Event]bool
+}
+
+var events = &eventLog{nextID: 1, subscribers: make(map[chan Event]bool)}
+
+// Function to load the events persisted by a previous run of the agent
+func loadEvents() {
+	data, err := os.ReadFile(filepath.Join(stateDir, "events.json"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: unable to read the event history: %v", err)
+		}
+		return
+	}
+	var saved []Event
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("Warning: ignoring the unreadable event history: %v", err)
+		return
+	}
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	if len(saved) > maxEventHistory {
+		saved = saved[len(saved)-maxEventHistory:]
+	}
+	events.events = saved
+	if len(saved) > 0 {
+		events.nextID = saved[len(saved)-1].ID + 1
+	}
+}
+
+// Emit adds an event to the history, persists it, and sends it to open streams.
+// The history is a small file, so it is rewritten as a whole each time.
+func (l *eventLog) Emit(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	event.Message = redactText(event.Message)
+	event.Details = redactDetails(event.Details)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	event.ID = l.nextID
+	l.nextID++
+	l.events = append(l.events, event)
+	if len(l.events) > maxEventHistory {
+		l.events = l.events[len(l.events)-maxEventHistory:]
+	}
+
+	data, err := json.Marshal(l.events)
+	if err == nil {
+		err = writeStateFile(filepath.Join(stateDir, "events.json"), data)
+	}
+	if err != nil {
+		log.Printf("Warning: unable to persist event %d: %v", event.ID, err)
+	}
+
+	// A stream that can't keep up misses events rather than holding up the agent
+	for subscriber := range l.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// Helper function to build an event from the outcome of an operation
+func eventOutcome(eventType, message string, details map[string]interface{}, err error) Event {
+	event := Event{Type: eventType, Message: message, Outcome: "succeeded", Details: details}
+	if err != nil {
+		event.Outcome = "failed"
+		event.Details = make(map[string]interface{}, len(details)+1)
+		for k, v := range details {
+			event.Details[k] = v
+		}
+		event.Details["error"] = err.Error()
+	}
+	return event
+}
+
+// eventFilter selects events by position and type
+type eventFilter struct {
+	// AfterID and After select events newer than an event ID or a time
+	AfterID int64
+	After   time.Time
+	// Types are categories like job or full types like job.finished
+	Types []string
+}
+
+// Function to parse the since and type query parameters of the event endpoints.
+// since is an event ID or an RFC 3339 time.
+func parseEventFilter(c *gin.Context) (eventFilter, error) {
+	var filter eventFilter
+	if since := c.Query("since"); since != "" {
+		if id, err := strconv.ParseInt(since, 10, 64); err == nil {
+			filter.AfterID = id
+		} else if t, err := time.Parse(time.RFC3339, since); err == nil {
+			filter.After = t
+		} else {
+			return filter, fmt.Errorf("since must be an event ID or an RFC 3339 time")
+		}
+	}
+	for _, t := range strings.Split(c.Query("type"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			filter.Types = append(filter.Types, t)
+		}
+	}
+	return filter, nil
+}
+
+func (f eventFilter) matches(event Event) bool {
+	if event.ID <= f.AfterID || !event.Time.After(f.After) {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if event.Type == t || strings.HasPrefix(event.Type, t+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns up to limit events matching the filter, newest first
+func (l *eventLog) List(filter eventFilter, limit int) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	matched := []Event{}
+	for i := len(l.events) - 1; i >= 0 && len(matched) < limit; i-- {
+		if filter.matches(l.events[i]) {
+			matched = append(matched, l.events[i])
+		}
+	}
+	return matched
+}
+
+var errTooManyStreams = errors.New("too many open event streams")
+
+// Subscribe returns the stored events matching the filter, oldest first, and a channel
+// receiving every event emitted after them. Call the returned function to stop. It fails
+// once concurrency.max_streams streams are open.
+func (l *eventLog) Subscribe(filter eventFilter) ([]Event, chan Event, func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.subscribers) >= currentConfig().Concurrency.maxStreams() {
+		return nil, nil, nil, errTooManyStreams
+	}
+	var backlog []Event
+	for _, event := range l.events {
+		if filter.matches(event) {
+			backlog = append(backlog, event)
+		}
+	}
+	subscriber := make(chan Event, 64)
+	l.subscribers[subscriber] = true
+	return backlog, subscriber, func() {
+		l.mu.Lock()
+		delete(l.subscribers, subscriber)
+		l.mu.Unlock()
+	}, nil
+}
+
+// Streams returns the number of open event streams
+func (l *eventLog) Streams() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.subscribers)
+}
+
+// Function to serve events as server-sent events until the client goes away. A
+// reconnecting client's Last-Event-ID takes the place of since.
+func streamEvents(c *gin.Context, filter eventFilter) {
+	if last := c.GetHeader("Last-Event-ID"); last != "" {
+		if id, err := strconv.ParseInt(last, 10, 64); err == nil {
+			filter.AfterID, filter.After = id, time.Time{}
+		}
+	}
+	backlog, subscriber, unsubscribe, err := events.Subscribe(filter)
+	if err != nil {
+		limit := currentConfig().Concurrency.maxStreams()
+		c.Header("Retry-After", "30")
+		c.JSON(429, gin.H{"error": fmt.Sprintf("Too many open event streams; the limit is %d", limit), "code": "too_many_streams", "limit": limit})
+		return
+	}
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+
+	send := func(event Event) bool {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return true
+		}
+		_, err = fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		c.Writer.Flush()
+		return err == nil
+	}
+	for _, event := range backlog {
+		if !send(event) {
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event := <-subscriber:
+			if filter.matches(event) && !send(event) {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(c.Writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
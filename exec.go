@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rothgar/cosi/api"
+)
+
+// Environment pinned on every command so output parsing does not depend on the host locale,
+// and so tools that honour the terminal type don't draw colors or progress bars
+var commandEnv = []string{"LC_ALL=C", "LANG=C", "TERM=dumb", "NO_COLOR=1"}
+
+// Arguments that turn off color for the tools that ignore TERM, added right after the tool
+var noColorArgs = map[string][]string{
+	"dnf":     {"--color=never"},
+	"yum":     {"--color=never"},
+	"apt-get": {"-o", "APT::Color=0"},
+	"emerge":  {"--color=n"},
+}
+
+// Helper function to add the no-color arguments of a tool to its arguments
+func colorlessArgs(name string, args []string) []string {
+	if extra, ok := noColorArgs[filepath.Base(name)]; ok {
+		return append(append([]string{}, extra...), args...)
+	}
+	return args
+}
+
+// Helper function to create a command with a stable locale and no stdin
+func newCommand(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, colorlessArgs(name, args)...)
+	cmd.Env = append(append(os.Environ(), commandEnv...), proxyEnv()...)
+	return cmd
+}
+
+// Helper function to build a command like newCommand that is killed when ctx is done
+func newCommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, colorlessArgs(name, args)...)
+	cmd.Env = append(append(os.Environ(), commandEnv...), proxyEnv()...)
+	return cmd
+}
+
+// rawOutput is set by --raw-output: command output is kept byte for byte instead of
+// having escape sequences stripped and progress lines collapsed
+var rawOutput bool
+
+// ANSI control sequences: CSI sequences like colors and cursor movement, OSC sequences
+// like window titles, and the two-byte escapes
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+// Helper function to clean a complete line of output: escape sequences are stripped and a
+// line redrawn with carriage returns, like a progress bar, is reduced to what it ended as
+func cleanLine(line []byte) []byte {
+	line = ansiEscape.ReplaceAll(line, nil)
+	body, newline := bytes.CutSuffix(line, []byte("\n"))
+	body = bytes.TrimRight(body, "\r")
+	if i := bytes.LastIndexByte(body, '\r'); i >= 0 {
+		body = body[i+1:]
+	}
+	if newline {
+		return append(body, '\n')
+	}
+	return body
+}
+
+// Helper function to clean output made of complete lines
+func cleanOutput(data []byte) []byte {
+	var cleaned []byte
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		cleaned = append(cleaned, cleanLine(line)...)
+		data = data[len(line):]
+	}
+	return cleaned
+}
+
+// CommandResult holds the separated and merged output of one or more commands
+type CommandResult = api.CommandResult
+
+// tailBuffer keeps what is written to it, or only the last limit bytes when limit is set
+type tailBuffer struct {
+	data    []byte
+	limit   int
+	dropped bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	// Trimming only once twice the limit is held keeps long outputs from being copied for every line
+	if b.limit > 0 && len(b.data) > 2*b.limit {
+		b.data = append(b.data[:0], b.data[len(b.data)-b.limit:]...)
+		b.dropped = true
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	if b.limit > 0 && len(b.data) > b.limit {
+		return string(b.data[len(b.data)-b.limit:])
+	}
+	return string(b.data)
+}
+
+// Truncated reports whether the start of the output was dropped
+func (b *tailBuffer) Truncated() bool {
+	return b.dropped || (b.limit > 0 && len(b.data) > b.limit)
+}
+
+// transcript is a mutex-protected buffer shared by the stdout and stderr
+// writers of a command so complete lines are kept in the order they arrived
+type transcript struct {
+	mu  sync.Mutex
+	buf tailBuffer
+	// job, when set, receives each line as it arrives in its output file
+	job *jobControl
+}
+
+func (t *transcript) write(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf.Write(p)
+	t.job.Write(p)
+}
+
+func (t *transcript) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.buf.String()
+}
+
+// streamWriter captures a single output stream and forwards it to the shared
+// transcript one complete line at a time. Unless raw is set, lines are cleaned
+// before they are kept. Secrets are redacted either way.
+type streamWriter struct {
+	own      tailBuffer
+	partial  []byte
+	shared   *transcript
+	raw      bool
+	redactor redactor
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.raw {
+		w.own.Write(p)
+	}
+	w.partial = append(w.partial, p...)
+	if i := bytes.LastIndexByte(w.partial, '\n'); i >= 0 {
+		lines := w.partial[:i+1]
+		if !w.raw {
+			lines = cleanOutput(lines)
+		}
+		lines = w.redactor.redact(lines)
+		if !w.raw {
+			w.own.Write(lines)
+		}
+		w.shared.write(lines)
+		w.partial = append([]byte(nil), w.partial[i+1:]...)
+	}
+	// A progress bar redraws one line without ever ending it; only its latest state is
+	// kept, minus a trailing carriage return that may be the start of a line ending
+	if !w.raw {
+		if i := bytes.LastIndexByte(bytes.TrimRight(w.partial, "\r"), '\r'); i >= 0 {
+			w.partial = append([]byte(nil), w.partial[i+1:]...)
+		}
+	}
+	return len(p), nil
+}
+
+// flush writes any trailing partial line to the transcript
+func (w *streamWriter) flush() {
+	if len(w.partial) > 0 {
+		line := append(w.partial, '\n')
+		if !w.raw {
+			line = cleanLine(line)
+		}
+		line = w.redactor.redact(line)
+		if !w.raw {
+			w.own.Write(line[:len(line)-1])
+		}
+		w.shared.write(line)
+		w.partial = nil
+	}
+}
+
+// commandOutput collects stdout and stderr of one or more commands
+// independently while also building a merged transcript
+type commandOutput struct {
+	transcript transcript
+	stdout     streamWriter
+	stderr     streamWriter
+}
+
+// newCommandOutput creates a collector; lines are also copied to the output of job
+// unless it is nil. Once they are in the job's output file, only the end of the output
+// is kept in memory.
+func newCommandOutput(job *jobControl) *commandOutput {
+	o := &commandOutput{}
+	o.transcript.job = job
+	if job.spooled() {
+		o.transcript.buf.limit = maxOutputTail
+		o.stdout.own.limit = maxOutputTail
+		o.stderr.own.limit = maxOutputTail
+	}
+	o.stdout.shared = &o.transcript
+	o.stderr.shared = &o.transcript
+	o.stdout.raw = rawOutput
+	o.stderr.raw = rawOutput
+	return o
+}
+
+// attach wires the command's stdout and stderr into the collector
+func (o *commandOutput) attach(cmd *exec.Cmd) {
+	cmd.Stdout = &o.stdout
+	cmd.Stderr = &o.stderr
+}
+
+// flush must be called after each command exits so partial lines are not lost
+func (o *commandOutput) flush() {
+	o.stdout.flush()
+	o.stderr.flush()
+}
+
+// Result returns the captured output collected so far
+func (o *commandOutput) Result() CommandResult {
+	o.transcript.mu.Lock()
+	truncated := o.transcript.buf.Truncated()
+	o.transcript.mu.Unlock()
+	stdout, stderr := o.stdout.own.String(), o.stderr.own.String()
+	// Raw streams are kept as they arrived, so their secrets are only redacted here
+	if rawOutput {
+		stdout, stderr = redactText(stdout), redactText(stderr)
+	}
+	return CommandResult{
+		Stdout:    stdout,
+		Stderr:    stderr,
+		Output:    o.transcript.String(),
+		Truncated: truncated || o.stdout.own.Truncated() || o.stderr.own.Truncated(),
+	}
+}
+
+// Counters for exec'd child processes, reported by /debug/runtime
+var (
+	childProcesses atomic.Int64 // currently running
+	childStarted   atomic.Int64 // started since the agent started
+)
+
+// Helper function to run a command while counting it as an in-flight child process.
+// Every command the agent runs should go through here.
+func runTracked(cmd *exec.Cmd) error {
+	return runTrackedContext(context.Background(), cmd)
+}
+
+// Helper function like runTracked that kills the command once ctx is done, so a read
+// whose client went away stops instead of running for nobody. A command whose ctx is
+// done while it waits for a process slot leaves the queue without being started.
+func runTrackedContext(ctx context.Context, cmd *exec.Cmd) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := processes.acquireContext(ctx); err != nil {
+		return err
+	}
+	defer processes.release()
+	if ctx.Done() != nil {
+		// A process group of its own, so the kill reaches the children it forks too
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Setpgid = true
+		if cmd.WaitDelay == 0 {
+			// Don't wait on the pipes for long once the command is killed
+			cmd.WaitDelay = time.Second
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) })
+	err := waitTracked(cmd)
+	if !stop() && err != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Helper function to wait for a started command while counting it as in flight.
+// The command must have been started holding a process slot.
+func waitTracked(cmd *exec.Cmd) error {
+	childStarted.Add(1)
+	childProcesses.Add(1)
+	defer childProcesses.Add(-1)
+	return cmd.Wait()
+}
+
+// Helper function like cmd.Output that goes through runTracked
+func outputTracked(cmd *exec.Cmd) ([]byte, error) {
+	return outputTrackedContext(context.Background(), cmd)
+}
+
+// Helper function like outputTracked that kills the command once ctx is done
+func outputTrackedContext(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := runTrackedContext(ctx, cmd)
+	return stdout.Bytes(), err
+}
+
+// Helper function to run a command and capture its output
+func runCommand(cmd *exec.Cmd) (CommandResult, error) {
+	return runJobCommand(cmd, nil)
+}
+
+// Helper function like runCommand that kills the command once ctx is done. Reads pass
+// the request's context; changes run in jobs, which outlive their request.
+func runCommandContext(ctx context.Context, cmd *exec.Cmd) (CommandResult, error) {
+	return captureCommand(cmd, nil, func() error { return runTrackedContext(ctx, cmd) })
+}
+
+// Helper function like runCommand for the commands of a job, which can be cancelled
+// and get their output copied to the job's output file as it arrives
+func runJobCommand(cmd *exec.Cmd, job *jobControl) (CommandResult, error) {
+	return captureCommand(cmd, job, func() error { return job.run(cmd) })
+}
+
+// Helper function to capture the output of cmd while run runs it
+func captureCommand(cmd *exec.Cmd, job *jobControl, run func() error) (CommandResult, error) {
+	output := newCommandOutput(job)
+	output.attach(cmd)
+	err := run()
+	output.flush()
+	result := output.Result()
+	result.ExitCode = -1
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	return result, err
+}
+
+// Helper function to name the tool behind a command for error classification,
+// looking past a `sudo -n VAR=value` prefix
+func commandTool(cmd *exec.Cmd) string {
+	args := cmd.Args
+	if filepath.Base(args[0]) == "sudo" {
+		args = args[1:]
+		for len(args) > 1 && (strings.HasPrefix(args[0], "-") || strings.Contains(args[0], "=")) {
+			args = args[1:]
+		}
+	}
+	return filepath.Base(args[0])
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Helper function to put a shell script called name first on PATH for the rest of the test
+func fakeCommand(t *testing.T, name, script string) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "bin")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return path
+}
+
+// A command that reads stdin, like a package manager stopping at a prompt, must see
+// end of file instead of waiting on the agent's stdin
+func TestCommandStdinIsEmpty(t *testing.T) {
+	fakeCommand(t, "prompt", `printf 'Do you want to continue? [Y/n] '; read answer; echo "answer=$answer"`)
+
+	// The agent's own stdin is a pipe nobody writes to, which is what a hang needs
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	done := make(chan CommandResult, 1)
+	go func() {
+		result, err := runCommand(newCommand("prompt"))
+		if err != nil {
+			t.Errorf("prompt failed: %v", err)
+		}
+		done <- result
+	}()
+	select {
+	case result := <-done:
+		if !strings.HasSuffix(result.Stdout, "answer=\n") {
+			t.Errorf("stdout = %q, want an empty answer", result.Stdout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("command reading stdin did not finish")
+	}
+}
+
+func TestCommandEnvironment(t *testing.T) {
+	fakeCommand(t, "locale-check", `echo "$LC_ALL $LANG $TERM"`)
+	t.Setenv("LC_ALL", "de_DE.UTF-8")
+	t.Setenv("LANG", "de_DE.UTF-8")
+
+	result, err := runCommand(newCommand("locale-check"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(result.Stdout); got != "C C dumb" {
+		t.Errorf("environment = %q, want %q", got, "C C dumb")
+	}
+}
+
+func TestAptArgsConffilePolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{"", "Dpkg::Options::=--force-confold"},
+		{"keep", "Dpkg::Options::=--force-confold"},
+		{"new", "Dpkg::Options::=--force-confnew"},
+	}
+	for _, tt := range tests {
+		args := aptArgs("install", tt.policy, []string{"curl"})
+		if !containsString(args, tt.want) || !containsString(args, "Dpkg::Options::=--force-confdef") {
+			t.Errorf("policy %q: args %q lack %s", tt.policy, args, tt.want)
+		}
+		if !containsString(args, "-y") || args[len(args)-1] != "curl" {
+			t.Errorf("policy %q: args %q", tt.policy, args)
+		}
+	}
+}
+
+func TestAptCommandIsNonInteractive(t *testing.T) {
+	cmd := aptCommand(PackageConfig{}, "install", []string{"curl"})
+	for _, want := range append(append([]string{}, commandEnv...), aptEnv...) {
+		if !containsString(cmd.Env, want) {
+			t.Errorf("apt-get environment lacks %s", want)
+		}
+	}
+}
+
+// A dnf install with colors and progress bars comes out as plain lines, each bar
+// reduced to its final state
+func TestCleanOutputDnfTranscript(t *testing.T) {
+	transcript := readFixture(t, "output", "dnf-install.txt")
+	cleaned := cleanOutput(transcript)
+	if bytes.ContainsAny(cleaned, "\x1b\r") {
+		t.Errorf("escape sequences or carriage returns survived:\n%q", cleaned)
+	}
+	if len(cleaned) > len(transcript)/4 {
+		t.Errorf("cleaned output is %d of %d bytes; progress bars weren't collapsed", len(cleaned), len(transcript))
+	}
+	checkGolden(t, "output/dnf-install.golden", string(cleaned))
+}
+
+// Output arrives in arbitrary chunks; the streamed result must match cleaning the whole
+// transcript, and a progress bar must not pile up while its line is unfinished
+func TestStreamWriterCleansChunks(t *testing.T) {
+	transcript := readFixture(t, "output", "dnf-install.txt")
+	want := string(cleanOutput(transcript))
+	for _, size := range []int{1, 7, 64, 4096, len(transcript)} {
+		output := newCommandOutput(nil)
+		longest := 0
+		for rest := transcript; len(rest) > 0; {
+			chunk := rest[:min(size, len(rest))]
+			rest = rest[len(chunk):]
+			output.stdout.Write(chunk)
+			longest = max(longest, len(output.stdout.partial))
+		}
+		output.flush()
+		if result := output.Result(); result.Stdout != want || result.Output != want {
+			t.Errorf("%d byte chunks: output differs from cleanOutput:\n%s", size, lineDiff(want, result.Stdout))
+		}
+		// The longest line of the cleaned transcript, with room for one chunk
+		if size < 4096 && longest > 200+size {
+			t.Errorf("%d byte chunks: %d bytes of an unfinished line were held", size, longest)
+		}
+	}
+}
+
+// --raw-output keeps the bytes as the command wrote them
+func TestRawOutputKeepsTranscript(t *testing.T) {
+	rawOutput = true
+	defer func() { rawOutput = false }()
+	transcript := readFixture(t, "output", "dnf-install.txt")
+	output := newCommandOutput(nil)
+	output.stdout.Write(transcript)
+	output.flush()
+	if result := output.Result(); result.Stdout != string(transcript) {
+		t.Errorf("raw stdout differs from the transcript:\n%s", lineDiff(string(transcript), result.Stdout))
+	}
+}
+
+// A real dnf run is asked for no colors and its transcript cleaned on the way in
+func TestDnfOutputThroughCommand(t *testing.T) {
+	transcript := filepath.Join("testdata", "output", "dnf-install.txt")
+	abs, err := filepath.Abs(transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeCommand(t, "dnf", `echo "args: $*" >&2; echo "TERM=$TERM" >&2; cat `+abs)
+	output := newCommandOutput(nil)
+	cmd := newCommand("dnf", "install", "-y", "kubelet")
+	output.attach(cmd)
+	if err := runTracked(cmd); err != nil {
+		t.Fatal(err)
+	}
+	output.flush()
+	result := output.Result()
+	if result.Stderr != "args: --color=never install -y kubelet\nTERM=dumb\n" {
+		t.Errorf("stderr = %q", result.Stderr)
+	}
+	if want := string(cleanOutput(readFixture(t, "output", "dnf-install.txt"))); result.Stdout != want {
+		t.Errorf("stdout differs from cleanOutput:\n%s", lineDiff(want, result.Stdout))
+	}
+}
+
+// Helper function to report whether pid has exited. A killed child of a killed shell
+// may be left a zombie when nothing reaps orphans, which counts as exited.
+func processExited(pid int) bool {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return true
+	}
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && (fields[0] == "Z" || fields[0] == "X")
+}
+
+// A client that gives up on a read stops the command behind it, including the children
+// the command forked
+func TestCancelledReadKillsProcessGroup(t *testing.T) {
+	withConfig(t, &Config{})
+	withInitSystem(t, InitSystem{Name: "systemd", PID1: "systemd", Systemctl: true, State: "running", Systemd: true})
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	fakeCommand(t, "localectl", `/bin/sleep 30 &
+echo $! > `+pidFile+`
+wait`)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerLocaleRoutes(r)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/locale", nil).WithContext(ctx))
+	}()
+
+	var pid int
+	for deadline := time.Now().Add(5 * time.Second); pid == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("localectl never started its child")
+		}
+		data, _ := os.ReadFile(pidFile)
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("GET /locale is still running after its request was cancelled")
+	}
+	if w.Code != 499 || !strings.Contains(w.Body.String(), "request_cancelled") {
+		t.Errorf("cancelled GET /locale = %d %s, want 499 request_cancelled", w.Code, w.Body)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !processExited(pid); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatal("the child of localectl outlived the cancelled request")
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"strings"
+)
+
+// Ansible's names for the distributions we know, keyed by os-release ID
+var ansibleDistributions = map[string]string{
+	"ubuntu": "Ubuntu",
+	"debian": "Debian",
+	"fedora": "Fedora",
+	"centos": "CentOS",
+	"rhel":   "RedHat",
+}
+
+// Ansible's os family, keyed by os-release ID
+var ansibleOSFamilies = map[string]string{
+	"ubuntu": "Debian",
+	"debian": "Debian",
+	"fedora": "RedHat",
+	"centos": "RedHat",
+	"rhel":   "RedHat",
+}
+
+// Function to map an inventory document onto Ansible's setup module fact names.
+// Facts we can't populate are left out rather than guessed.
+func ansibleFacts(inventory map[string]interface{}) map[string]interface{} {
+	facts := make(map[string]interface{})
+
+	if osRelease, ok := inventory["os"].(map[string]string); ok {
+		id := osRelease["ID"]
+		if name, ok := ansibleDistributions[id]; ok {
+			facts["ansible_distribution"] = name
+		} else if osRelease["NAME"] != "" {
+			facts["ansible_distribution"] = osRelease["NAME"]
+		}
+		if family, ok := ansibleOSFamilies[id]; ok {
+			facts["ansible_os_family"] = family
+		}
+		if version := osRelease["VERSION_ID"]; version != "" {
+			facts["ansible_distribution_version"] = version
+			facts["ansible_distribution_major_version"] = strings.SplitN(version, ".", 2)[0]
+		}
+		if codename := osRelease["VERSION_CODENAME"]; codename != "" {
+			facts["ansible_distribution_release"] = codename
+		}
+		if pm := packageManagerFor(osRelease); pm != nil {
+			facts["ansible_pkg_mgr"] = pm.Name()
+		}
+	}
+
+	if uname, ok := inventory["uname"].(map[string]string); ok {
+		facts["ansible_system"] = uname["kernel_name"]
+		facts["ansible_kernel"] = uname["kernel_release"]
+		facts["ansible_kernel_version"] = uname["kernel_version"]
+		facts["ansible_architecture"] = uname["machine"]
+		facts["ansible_machine"] = uname["machine"]
+		facts["ansible_nodename"] = uname["nodename"]
+		facts["ansible_hostname"] = strings.SplitN(uname["nodename"], ".", 2)[0]
+	}
+
+	if memory, ok := inventory["memory"].(*MemoryInfo); ok {
+		facts["ansible_memtotal_mb"] = memory.TotalBytes / (1024 * 1024)
+		facts["ansible_swaptotal_mb"] = memory.SwapTotalBytes / (1024 * 1024)
+		facts["ansible_swapfree_mb"] = memory.SwapFreeBytes / (1024 * 1024)
+	}
+
+	if cpu, ok := inventory["cpu"].(*CPUInfo); ok {
+		facts["ansible_processor_vcpus"] = cpu.Count
+	}
+
+	if disks, ok := inventory["disks"].([]DiskInfo); ok {
+		mounts := make([]map[string]interface{}, 0, len(disks))
+		for _, disk := range disks {
+			mounts = append(mounts, map[string]interface{}{
+				"mount":          disk.MountPoint,
+				"device":         disk.Device,
+				"fstype":         disk.FSType,
+				"size_total":     disk.TotalBytes,
+				"size_available": disk.FreeBytes,
+			})
+		}
+		facts["ansible_mounts"] = mounts
+	}
+
+	if interfaces, ok := inventory["network"].([]InterfaceInfo); ok {
+		addNetworkFacts(facts, interfaces)
+	}
+
+	if host := capabilities.Get().InitSystem; host.Systemd {
+		facts["ansible_service_mgr"] = "systemd"
+	} else if host.Name != "systemd" && host.Name != "unknown" {
+		facts["ansible_service_mgr"] = host.Name
+	}
+
+	return map[string]interface{}{"ansible_facts": facts}
+}
+
+// Function to add the interface, address, and default route facts
+func addNetworkFacts(facts map[string]interface{}, interfaces []InterfaceInfo) {
+	names := make([]string, 0, len(interfaces))
+	ipv4 := []string{}
+	ipv6 := []string{}
+	for _, iface := range interfaces {
+		names = append(names, iface.Name)
+		for _, addr := range iface.Addresses {
+			ip, _, err := net.ParseCIDR(addr)
+			if err != nil || ip.IsLoopback() {
+				continue
+			}
+			if ip.To4() != nil {
+				ipv4 = append(ipv4, ip.String())
+			} else {
+				ipv6 = append(ipv6, ip.String())
+			}
+		}
+	}
+	facts["ansible_interfaces"] = names
+	facts["ansible_all_ipv4_addresses"] = ipv4
+	facts["ansible_all_ipv6_addresses"] = ipv6
+
+	ifaceName, gateway, ok := defaultIPv4Route()
+	if !ok {
+		return
+	}
+	for _, iface := range interfaces {
+		if iface.Name != ifaceName {
+			continue
+		}
+		for _, addr := range iface.Addresses {
+			ip, network, err := net.ParseCIDR(addr)
+			if err != nil || ip.To4() == nil {
+				continue
+			}
+			facts["ansible_default_ipv4"] = map[string]interface{}{
+				"address":    ip.String(),
+				"interface":  iface.Name,
+				"gateway":    gateway.String(),
+				"macaddress": iface.MAC,
+				"mtu":        iface.MTU,
+				"netmask":    net.IP(network.Mask).String(),
+				"network":    network.IP.String(),
+			}
+			return
+		}
+	}
+}
+
+// Function to find the interface and gateway of the IPv4 default route in /proc/net/route
+func defaultIPv4Route() (string, net.IP, bool) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return "", nil, false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // Skip the header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		// The kernel prints the gateway in host byte order
+		gateway := make(net.IP, 4)
+		binary.BigEndian.PutUint32(gateway, binary.LittleEndian.Uint32(raw))
+		return fields[0], gateway, true
+	}
+	return "", nil, false
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Inventory of the host testdata/ansible/ubuntu-22.04-setup.json was captured on
+func ubuntuInventory() map[string]interface{} {
+	return map[string]interface{}{
+		"os": map[string]string{
+			"ID":               "ubuntu",
+			"NAME":             "Ubuntu",
+			"VERSION_ID":       "22.04",
+			"VERSION_CODENAME": "jammy",
+		},
+		"uname": map[string]string{
+			"kernel_name":    "Linux",
+			"kernel_release": "6.5.0-1018-aws",
+			"kernel_version": "#18~22.04.1-Ubuntu SMP Fri Apr  5 17:44:33 UTC 2024",
+			"machine":        "x86_64",
+			"nodename":       "ip-10-0-1-23",
+		},
+		"memory": &MemoryInfo{TotalBytes: 8234524672},
+		"cpu":    &CPUInfo{Model: "Intel(R) Xeon(R) Platinum 8259CL CPU @ 2.50GHz", Count: 2},
+		"disks": []DiskInfo{
+			{Device: "/dev/root", MountPoint: "/", FSType: "ext4", TotalBytes: 31026491392, FreeBytes: 21716557824},
+			{Device: "/dev/nvme0n1p15", MountPoint: "/boot/efi", FSType: "vfat", TotalBytes: 109395456, FreeBytes: 108482560},
+		},
+		"network": []InterfaceInfo{
+			{Name: "docker0", MAC: "02:42:5e:1c:9a:04", MTU: 1500, Addresses: []string{"172.17.0.1/16"}},
+			{Name: "lo", MTU: 65536, Up: true, Addresses: []string{"127.0.0.1/8", "::1/128"}},
+			{Name: "ens5", MAC: "0a:ff:2b:5c:1a:3d", MTU: 9001, Up: true, Addresses: []string{"10.0.1.23/24", "fe80::8ff:2bff:fe5c:1a3d/64"}},
+		},
+	}
+}
+
+// Helper function to check that every value in got is in want. Maps may have more keys
+// in want, and each element of a list in got must match some element of want's list.
+func factSubset(got, want interface{}) bool {
+	switch got := got.(type) {
+	case map[string]interface{}:
+		want, ok := want.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range got {
+			if !factSubset(v, want[k]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		want, ok := want.([]interface{})
+		if !ok {
+			return false
+		}
+	elements:
+		for _, g := range got {
+			for _, w := range want {
+				if factSubset(g, w) {
+					continue elements
+				}
+			}
+			return false
+		}
+		return true
+	}
+	return reflect.DeepEqual(got, want)
+}
+
+func TestAnsibleFactsMatchSetupModule(t *testing.T) {
+	data, err := os.ReadFile("testdata/ansible/ubuntu-22.04-setup.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var setup map[string]interface{}
+	if err := json.Unmarshal(data, &setup); err != nil {
+		t.Fatal(err)
+	}
+	want := setup["ansible_facts"].(map[string]interface{})
+
+	// Compare what a client sees after JSON encoding
+	encoded, err := json.Marshal(ansibleFacts(ubuntuInventory()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(encoded, &document); err != nil {
+		t.Fatal(err)
+	}
+	got := document["ansible_facts"].(map[string]interface{})
+
+	// These come from the host running the test rather than the inventory
+	delete(got, "ansible_service_mgr")
+	delete(got, "ansible_default_ipv4")
+
+	for _, name := range []string{"ansible_distribution", "ansible_kernel", "ansible_architecture", "ansible_memtotal_mb", "ansible_processor_vcpus", "ansible_mounts", "ansible_all_ipv4_addresses"} {
+		if _, ok := got[name]; !ok {
+			t.Errorf("%s is missing", name)
+		}
+	}
+	for name, value := range got {
+		if _, ok := want[name]; !ok {
+			t.Errorf("%s is not an ansible fact", name)
+			continue
+		}
+		if !factSubset(value, want[name]) {
+			t.Errorf("%s = %v, ansible has %v", name, value, want[name])
+		}
+	}
+}
+
+// Facts without a source in the inventory are left out rather than faked
+func TestAnsibleFactsOmitUnknown(t *testing.T) {
+	facts := ansibleFacts(map[string]interface{}{
+		"os": map[string]string{"ID": "plan9", "NAME": "Plan 9"},
+	})["ansible_facts"].(map[string]interface{})
+
+	if facts["ansible_distribution"] != "Plan 9" {
+		t.Errorf("ansible_distribution = %v, want the os-release name", facts["ansible_distribution"])
+	}
+	for _, name := range []string{"ansible_os_family", "ansible_pkg_mgr", "ansible_distribution_version", "ansible_kernel", "ansible_memtotal_mb", "ansible_mounts"} {
+		if value, ok := facts[name]; ok {
+			t.Errorf("%s = %v, want it left out", name, value)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// task is one independent unit of work run by fanOut
+type task struct {
+	Name string
+	Run  func(ctx context.Context) (interface{}, error)
+}
+
+// taskResult is the outcome of a task
+type taskResult struct {
+	Name  string
+	Value interface{}
+	Err   error
+}
+
+// Function to run tasks with at most limit in flight, giving each its own timeout.
+// Results are returned in the order of tasks regardless of which finishes first. A
+// task that overruns its timeout is reported as failed and its result is abandoned;
+// tasks should honor ctx (e.g. via newCommandContext) so their work stops too.
+func fanOut(ctx context.Context, tasks []task, limit int, timeout time.Duration) []taskResult {
+	results := make([]taskResult, len(tasks))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, limit)
+
+	for i, t := range tasks {
+		results[i].Name = t.Name
+		wg.Add(1)
+		go func(i int, t task) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i].Value, results[i].Err = runTask(ctx, t, timeout)
+		}(i, t)
+	}
+	wg.Wait()
+	return results
+}
+
+// Helper function to run one task, returning early when its timeout expires
+func runTask(ctx context.Context, t task, timeout time.Duration) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan taskResult, 1)
+	go func() {
+		value, err := t.Run(ctx)
+		done <- taskResult{Value: value, Err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.Value, result.Err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%s: %w", t.Name, ctx.Err())
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFanOutKeepsTaskOrder(t *testing.T) {
+	// Later tasks finish first
+	var tasks []task
+	for i := 0; i < 20; i++ {
+		delay := time.Duration(20-i) * time.Millisecond
+		value := i
+		tasks = append(tasks, task{Name: fmt.Sprint("task", i), Run: func(ctx context.Context) (interface{}, error) {
+			time.Sleep(delay)
+			return value, nil
+		}})
+	}
+
+	results := fanOut(context.Background(), tasks, 20, time.Second)
+	if len(results) != len(tasks) {
+		t.Fatalf("%d results for %d tasks", len(results), len(tasks))
+	}
+	for i, result := range results {
+		if result.Name != tasks[i].Name || result.Value != i || result.Err != nil {
+			t.Errorf("result %d = %+v", i, result)
+		}
+	}
+}
+
+func TestFanOutLimit(t *testing.T) {
+	var running, peak atomic.Int32
+	var tasks []task
+	for i := 0; i < 12; i++ {
+		tasks = append(tasks, task{Name: fmt.Sprint("task", i), Run: func(ctx context.Context) (interface{}, error) {
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			running.Add(-1)
+			return nil, nil
+		}})
+	}
+
+	fanOut(context.Background(), tasks, 3, time.Second)
+	if p := peak.Load(); p > 3 || p < 1 {
+		t.Errorf("%d tasks ran at once, want at most 3", p)
+	}
+}
+
+func TestFanOutSlowTaskTimesOut(t *testing.T) {
+	// The stuck task ignores its context, so it is abandoned rather than stopped
+	release := make(chan struct{})
+	defer close(release)
+	tasks := []task{
+		{Name: "fast", Run: func(ctx context.Context) (interface{}, error) { return "ok", nil }},
+		{Name: "stuck", Run: func(ctx context.Context) (interface{}, error) {
+			<-release
+			return "late", nil
+		}},
+		{Name: "failing", Run: func(ctx context.Context) (interface{}, error) { return nil, errors.New("broken") }},
+		{Name: "honors-context", Run: func(ctx context.Context) (interface{}, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}},
+	}
+
+	start := time.Now()
+	results := fanOut(context.Background(), tasks, len(tasks), 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("fanOut took %v with a 50ms timeout", elapsed)
+	}
+
+	if results[0].Value != "ok" || results[0].Err != nil {
+		t.Errorf("fast = %+v", results[0])
+	}
+	if !errors.Is(results[1].Err, context.DeadlineExceeded) || results[1].Value != nil {
+		t.Errorf("stuck = %+v, want a deadline error", results[1])
+	}
+	if results[2].Err == nil || results[2].Err.Error() != "broken" {
+		t.Errorf("failing = %+v", results[2])
+	}
+	if !errors.Is(results[3].Err, context.DeadlineExceeded) {
+		t.Errorf("honors-context = %+v, want a deadline error", results[3])
+	}
+}
+
+func TestFanOutParentCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results := fanOut(ctx, []task{{Name: "wait", Run: func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}}}, 1, time.Minute)
+	if !errors.Is(results[0].Err, context.Canceled) {
+		t.Errorf("result = %+v, want cancelled", results[0])
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// Default cap on the content returned by GET /files
+const defaultMaxFileReadBytes = 1 << 20
+
+// Scope of the tokens that may write files with PUT /files
+const scopeFiles = "files"
+
+// Patterns used when files.allow / files.deny aren't configured. Deny wins over allow.
+// The default allowlist is the node configuration a cluster needs rather than all of
+// /etc, where credentials like kubeconfigs and the agent's own tokens live.
+var (
+	defaultFileAllow = []string{
+		"/etc/hosts", "/etc/hostname", "/etc/resolv.conf", "/etc/fstab",
+		"/etc/sysctl.conf", "/etc/sysctl.d/**", "/etc/modules-load.d/**",
+		"/etc/containerd/**", "/etc/crictl.yaml", "/etc/default/kubelet",
+		"/etc/kubernetes/manifests/**", "/etc/systemd/system/kubelet.service.d/**",
+		"/var/log/**",
+	}
+	defaultFileDeny = []string{
+		"/etc/shadow*", "/etc/gshadow*", "/etc/security/opasswd",
+		"/etc/ssh/ssh_host_*_key", "/etc/ssl/private/**", "/etc/kubernetes/pki/**.key",
+		"/etc/sudoers", "/etc/sudoers.d/**",
+	}
+)
+
+// FilesConfig controls which paths the /files endpoints may touch. Patterns are
+// globs where ** matches any number of path segments.
+type FilesConfig struct {
+	Allow        []string `yaml:"allow"`
+	Deny         []string `yaml:"deny"`
+	MaxReadBytes int64    `yaml:"max_read_bytes"`
+}
+
+// FileInfo is the response of GET /files
+type FileInfo struct {
+	Path         string      `json:"path"`
+	ResolvedPath string      `json:"resolved_path,omitempty"` // set when path is a symlink
+	Type         string      `json:"type"`                    // file or directory
+	Size         int64       `json:"size"`
+	Mode         string      `json:"mode"`
+	Owner        string      `json:"owner"`
+	Group        string      `json:"group"`
+	ModTime      time.Time   `json:"mtime"`
+	SHA256       string      `json:"sha256,omitempty"`
+	Encoding     string      `json:"encoding,omitempty"` // text or base64
+	Content      string      `json:"content,omitempty"`
+	Truncated    bool        `json:"truncated,omitempty"`
+	Entries      []FileEntry `json:"entries,omitempty"`
+}
+
+// FileEntry is one item of a directory listing
+type FileEntry struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"` // file, directory, symlink, or other
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mtime"`
+	Allowed bool      `json:"allowed"` // whether GET /files may read it
+}
+
+// errFileNotAllowed is returned for paths outside the allowlist
+type errFileNotAllowed struct {
+	Path string
+}
+
+func (e *errFileNotAllowed) Error() string {
+	return e.Path + " is not allowed by the files allowlist"
+}
+
+// Function to check a path against the files allowlist and denylist
+func fileAllowed(p string) bool {
+	cfg := currentConfig().Files
+	allow, deny := cfg.Allow, cfg.Deny
+	if len(allow) == 0 {
+		allow = defaultFileAllow
+	}
+	if deny == nil {
+		deny = defaultFileDeny
+	}
+	for _, pattern := range deny {
+		if globMatch(pattern, p) {
+			return false
+		}
+	}
+	for _, pattern := range allow {
+		if globMatch(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to match a slash-separated path against a glob where a ** segment
+// matches zero or more whole segments and other segments use path.Match
+func globMatch(pattern, p string) bool {
+	return matchSegments(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(strings.Trim(p, "/"), "/"))
+}
+
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		// A trailing "**.ext" style segment matches that suffix in any subdirectory
+		if strings.HasPrefix(pattern[0], "**") && len(pattern) == 1 {
+			suffix := strings.TrimPrefix(pattern[0], "**")
+			return len(segments) > 0 && strings.HasSuffix(segments[len(segments)-1], suffix)
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// Function to validate a requested path: it must be absolute and allowed both as
+// given and after resolving symlinks. It returns the resolved path.
+func resolveAllowedFile(requested string) (string, error) {
+	if !filepath.IsAbs(requested) {
+		return "", fmt.Errorf("%s is not an absolute path", requested)
+	}
+	cleaned := filepath.Clean(requested)
+	if !fileAllowed(cleaned) {
+		return "", &errFileNotAllowed{Path: cleaned}
+	}
+	resolved, err := filepath.EvalSymlinks(cleaned)
+	if err != nil {
+		return "", err
+	}
+	if !fileAllowed(resolved) {
+		return "", &errFileNotAllowed{Path: resolved}
+	}
+	return resolved, nil
+}
+
+// Function to read an allowed file, or list an allowed directory
+func readAllowedFile(requested string) (*FileInfo, error) {
+	resolved, err := resolveAllowedFile(requested)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(resolved)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &FileInfo{
+		Path:    filepath.Clean(requested),
+		Size:    stat.Size(),
+		Mode:    fmt.Sprintf("%04o", stat.Mode().Perm()),
+		ModTime: stat.ModTime().UTC(),
+	}
+	if resolved != info.Path {
+		info.ResolvedPath = resolved
+	}
+	info.Owner, info.Group = fileOwner(stat)
+
+	if stat.IsDir() {
+		info.Type = "directory"
+		info.Entries, err = listDirectory(resolved)
+		return info, err
+	}
+	if !stat.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file or directory", resolved)
+	}
+	info.Type = "file"
+
+	maxBytes := currentConfig().Files.MaxReadBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxFileReadBytes
+	}
+	file, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Hash the whole file but only keep the first maxBytes of it
+	hash := sha256.New()
+	content, err := io.ReadAll(io.LimitReader(io.TeeReader(file, hash), maxBytes))
+	if err != nil {
+		return nil, err
+	}
+	rest, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	info.Truncated = rest > 0
+	info.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	if utf8.Valid(content) && !strings.ContainsRune(string(content), 0) {
+		info.Encoding = "text"
+		info.Content = string(content)
+	} else {
+		info.Encoding = "base64"
+		info.Content = base64.StdEncoding.EncodeToString(content)
+	}
+	return info, nil
+}
+
+// Helper function to list a directory without following symlinks
+func listDirectory(dir string) ([]FileEntry, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]FileEntry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		stat, err := dirEntry.Info()
+		if err != nil {
+			continue // removed while listing
+		}
+		entry := FileEntry{
+			Name:    dirEntry.Name(),
+			Type:    "other",
+			Size:    stat.Size(),
+			Mode:    fmt.Sprintf("%04o", stat.Mode().Perm()),
+			ModTime: stat.ModTime().UTC(),
+			Allowed: fileAllowed(filepath.Join(dir, dirEntry.Name())),
+		}
+		switch {
+		case stat.Mode().IsRegular():
+			entry.Type = "file"
+		case stat.IsDir():
+			entry.Type = "directory"
+		case stat.Mode()&os.ModeSymlink != 0:
+			entry.Type = "symlink"
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Helper function to name the owner and group of a file, falling back to numeric IDs
+func fileOwner(stat os.FileInfo) (string, string) {
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", ""
+	}
+	owner := strconv.Itoa(int(sys.Uid))
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	group := strconv.Itoa(int(sys.Gid))
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+	return owner, group
+}
+
+// Largest file PUT /files accepts
+const maxFileWriteBytes = 10 << 20
+
+// Validators PUT /files may run against the new content before it's moved into place.
+// "{}" is replaced by the path of the staged file.
+var fileValidators = map[string][]string{
+	"sshd":            {"sshd", "-t", "-f", "{}"},
+	"nginx":           {"nginx", "-t", "-c", "{}"},
+	"visudo":          {"visudo", "-c", "-f", "{}"},
+	"nft":             {"nft", "-c", "-f", "{}"},
+	"haproxy":         {"haproxy", "-c", "-f", "{}"},
+	"named-checkconf": {"named-checkconf", "{}"},
+	"chronyd":         {"chronyd", "-p", "-f", "{}"},
+	"containerd":      {"containerd", "--config", "{}", "config", "dump"},
+}
+
+// fileWriteLock serializes writes so a precondition check and the rename that follows can't interleave
+var fileWriteLock sync.Mutex
+
+// FileWriteRequest is the body of PUT /files
+type FileWriteRequest struct {
+	Path          string `json:"path" binding:"required"`
+	ContentBase64 string `json:"content_base64"`
+	Mode          string `json:"mode"`  // octal, e.g. "0644"; defaults to the existing mode or 0644
+	Owner         string `json:"owner"` // user:group; defaults to the existing owner
+	Backup        bool   `json:"backup"`
+	// ExpectedSHA256Before makes the write conditional on the current content
+	ExpectedSHA256Before string `json:"expected_sha256_before"`
+	// ValidateCmd names one of fileValidators to run against the new content
+	ValidateCmd string `json:"validate_cmd"`
+}
+
+// FileWriteResult is the response of PUT /files
+type FileWriteResult struct {
+	Path             string         `json:"path"`
+	SHA256           string         `json:"sha256"`
+	PreviousSHA256   string         `json:"previous_sha256,omitempty"`
+	Size             int            `json:"size"`
+	Mode             string         `json:"mode"`
+	BackupPath       string         `json:"backup_path,omitempty"`
+	Validation       *CommandResult `json:"validation,omitempty"`
+	Created          bool           `json:"created"`
+	ResolvedFromLink string         `json:"resolved_from_link,omitempty"`
+}
+
+// Function to resolve the target of a write. Unlike reads the file may not exist
+// yet, in which case its parent directory is resolved instead.
+func resolveWritableFile(requested string) (string, error) {
+	resolved, err := resolveAllowedFile(requested)
+	if !errors.Is(err, os.ErrNotExist) {
+		return resolved, err
+	}
+	cleaned := filepath.Clean(requested)
+	dir, err := filepath.EvalSymlinks(filepath.Dir(cleaned))
+	if err != nil {
+		return "", err
+	}
+	resolved = filepath.Join(dir, filepath.Base(cleaned))
+	if !fileAllowed(resolved) {
+		return "", &errFileNotAllowed{Path: resolved}
+	}
+	return resolved, nil
+}
+
+// Function to write an allowlisted file atomically: the content is staged next to
+// the target, validated, and renamed over it so readers never see a partial file
+func writeAllowedFile(request FileWriteRequest) (*FileWriteResult, error) {
+	content, err := base64.StdEncoding.DecodeString(request.ContentBase64)
+	if err != nil {
+		return nil, &requestError{400, "invalid_content", "content_base64 is not valid base64"}
+	}
+	if len(content) > maxFileWriteBytes {
+		return nil, &requestError{413, "file_too_large", fmt.Sprintf("content is larger than %d bytes", maxFileWriteBytes)}
+	}
+	var validator []string
+	if request.ValidateCmd != "" {
+		if validator = fileValidators[request.ValidateCmd]; validator == nil {
+			return nil, &requestError{400, "unknown_validator", fmt.Sprintf("validate_cmd must be one of %s", strings.Join(validatorNames(), ", "))}
+		}
+	}
+
+	target, err := resolveWritableFile(request.Path)
+	if err != nil {
+		return nil, err
+	}
+	result := &FileWriteResult{Path: target, Size: len(content)}
+	if cleaned := filepath.Clean(request.Path); cleaned != target {
+		result.ResolvedFromLink = cleaned
+	}
+
+	fileWriteLock.Lock()
+	defer fileWriteLock.Unlock()
+
+	// Start from the existing file's metadata, then apply what was asked for
+	mode := os.FileMode(0644)
+	uid, gid := os.Getuid(), os.Getgid()
+	existing, err := os.Stat(target)
+	switch {
+	case err == nil:
+		if !existing.Mode().IsRegular() {
+			return nil, &requestError{409, "not_a_file", target + " is not a regular file"}
+		}
+		mode = existing.Mode().Perm()
+		if sys, ok := existing.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(sys.Uid), int(sys.Gid)
+		}
+		if result.PreviousSHA256, err = fileSHA256(target); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, os.ErrNotExist):
+		result.Created = true
+	default:
+		return nil, err
+	}
+
+	if expected := strings.TrimPrefix(request.ExpectedSHA256Before, "sha256:"); expected != "" && !strings.EqualFold(expected, result.PreviousSHA256) {
+		current := result.PreviousSHA256
+		if result.Created {
+			current = "(file does not exist)"
+		}
+		return nil, &requestError{412, "precondition_failed", fmt.Sprintf("current sha256 is %s, expected %s", current, expected)}
+	}
+	if request.Mode != "" {
+		parsed, err := strconv.ParseUint(request.Mode, 8, 32)
+		if err != nil || parsed > 0777 {
+			return nil, &requestError{400, "invalid_mode", "mode must be octal permissions such as 0644"}
+		}
+		mode = os.FileMode(parsed)
+	}
+	if request.Owner != "" {
+		if uid, gid, err = lookupOwner(request.Owner); err != nil {
+			return nil, &requestError{400, "invalid_owner", err.Error()}
+		}
+	}
+	result.Mode = fmt.Sprintf("%04o", mode)
+
+	staged, err := stageFile(target, content, mode, uid, gid)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(staged) // no-op once renamed into place
+
+	if validator != nil {
+		args := make([]string, len(validator))
+		for i, arg := range validator {
+			args[i] = strings.ReplaceAll(arg, "{}", staged)
+		}
+		output, err := runCommand(newCommand(args[0], args[1:]...))
+		result.Validation = &output
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return result, &requestError{422, "validation_failed", request.ValidateCmd + " rejected the new content"}
+		}
+		if err != nil {
+			return nil, &commandError{Tool: args[0], Result: output, Err: err}
+		}
+	}
+
+	if request.Backup && !result.Created {
+		result.BackupPath = target + ".bak." + time.Now().UTC().Format("20060102T150405Z")
+		// A hard link keeps the old inode as the backup once the new file is renamed over it
+		if err := os.Link(target, result.BackupPath); err != nil {
+			return nil, fmt.Errorf("creating backup: %w", err)
+		}
+	}
+	if err := os.Rename(staged, target); err != nil {
+		return nil, err
+	}
+	syncDir(filepath.Dir(target))
+
+	sum := sha256.Sum256(content)
+	result.SHA256 = hex.EncodeToString(sum[:])
+	return result, nil
+}
+
+// Helper function to write content to a temporary file beside target with the final metadata
+func stageFile(target string, content []byte, mode os.FileMode, uid, gid int) (string, error) {
+	file, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".cosi-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(content)
+	if err == nil {
+		err = file.Chmod(mode)
+	}
+	if err == nil {
+		err = file.Chown(uid, gid)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// Helper function to flush a rename to disk by syncing the directory
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Helper function to hash a whole file
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Helper function to resolve "user:group" (or just "user") to numeric IDs
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName, hasGroup := strings.Cut(owner, ":")
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	if hasGroup {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return 0, 0, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+// Helper function to list the validator names in a stable order
+func validatorNames() []string {
+	names := make([]string, 0, len(fileValidators))
+	for name := range fileValidators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDefaultFileAllowlist(t *testing.T) {
+	withConfig(t, &Config{})
+	tests := map[string]bool{
+		"/etc/hosts":                                    true,
+		"/etc/containerd/config.toml":                   true,
+		"/etc/sysctl.d/99-kubernetes.conf":              true,
+		"/etc/kubernetes/manifests/kube-apiserver.yaml": true,
+		"/var/log/syslog":                               true,
+		// Credentials outside the denylist stay out of reach by default
+		"/etc/kubernetes/admin.conf":  false,
+		"/etc/cosi/config.yaml":       false,
+		"/etc/passwd":                 false,
+		"/etc/ssh/sshd_config":        false,
+		"/etc/shadow":                 false,
+		"/etc/kubernetes/pki/ca.key":  false,
+		"/etc/sudoers.d/cosi-managed": false,
+		"/root/.ssh/authorized_keys":  false,
+	}
+	for path, want := range tests {
+		if got := fileAllowed(path); got != want {
+			t.Errorf("fileAllowed(%q) = %v, want %v", path, got, want)
+		}
+	}
+
+	withConfig(t, &Config{Files: FilesConfig{Allow: []string{"/etc/**"}}})
+	if !fileAllowed("/etc/ssh/sshd_config") || fileAllowed("/etc/shadow") {
+		t.Error("a configured allowlist should replace the default and keep the default denylist")
+	}
+}
+
+// PUT /files has the same operation in POST /batch, which needs the same scope
+func TestBatchFileWriteRequiresScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerBatchRoutes(r)
+	// The timeout fails validation once the request is let through, so nothing runs
+	body := `{"operations": [{"op": "files.write", "body": {"path": "/etc/hosts", "content": ""}}], "timeout_seconds": -1}`
+	checkScopeRequired(t, r, scopeFiles, "POST", "/batch", body)
+
+	withScopedTokens(t, scopeFiles)
+	if w := serveWithToken(r, "POST", "/batch", `{"operations": [{"op": "packages.repair"}], "timeout_seconds": -1}`, ""); w.Code != 400 {
+		t.Errorf("batch without scoped operations = %d %s, want it checked without a token", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FirewallStatus is the normalized view of the host firewall returned by GET /firewall
+type FirewallStatus struct {
+	Backend string         `json:"backend"` // ufw, firewalld, nftables, iptables, or none
+	Enabled bool           `json:"enabled"`
+	Default string         `json:"default_policy,omitempty"`
+	Zones   []FirewallZone `json:"zones,omitempty"`
+	Rules   []FirewallRule `json:"rules"`
+}
+
+// FirewallZone is a firewalld zone
+type FirewallZone struct {
+	Name       string   `json:"name"`
+	Active     bool     `json:"active"`
+	Default    bool     `json:"default"`
+	Target     string   `json:"target,omitempty"`
+	Interfaces []string `json:"interfaces"`
+	Sources    []string `json:"sources"`
+}
+
+// FirewallRule is one rule in a backend-independent form. Port is a single port or a
+// "low-high" range and is empty for rules that aren't port based.
+type FirewallRule struct {
+	Port     string `json:"port,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Service  string `json:"service,omitempty"`
+	Action   string `json:"action"` // allow, deny, reject
+	Source   string `json:"source,omitempty"`
+	Zone     string `json:"zone,omitempty"`
+	Chain    string `json:"chain,omitempty"`
+	IPv6     bool   `json:"ipv6,omitempty"`
+	Raw      string `json:"raw"`
+}
+
+// FirewallRuleRequest is the body of POST /firewall/rules
+type FirewallRuleRequest struct {
+	Port      int    `json:"port" binding:"required"`
+	Protocol  string `json:"protocol"`
+	Permanent bool   `json:"permanent"`
+}
+
+// Function to validate a rule request and apply defaults
+func (r *FirewallRuleRequest) validate() error {
+	if r.Port < 1 || r.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535")
+	}
+	switch r.Protocol {
+	case "":
+		r.Protocol = "tcp"
+	case "tcp", "udp":
+	default:
+		return fmt.Errorf("protocol must be tcp or udp")
+	}
+	return nil
+}
+
+// errPermanentUnsupported is returned when a backend can't persist a rule
+var errPermanentUnsupported = fmt.Errorf("this firewall backend can't persist rules; open the port without permanent and persist it with the distribution's tooling")
+
+// firewallBackend abstracts over the firewall frontends the agent understands
+type firewallBackend interface {
+	Name() string
+	// Tool is the command that needs root, for sudoers hints
+	Tool() string
+	Status(ctx context.Context) (*FirewallStatus, error)
+	OpenPort(request FirewallRuleRequest) (CommandResult, error)
+}
+
+// Function to pick the firewall frontend managing the host. An active frontend wins;
+// otherwise the first installed one is reported as disabled. nil means no tooling.
+func detectFirewall() firewallBackend {
+	var installed []firewallBackend
+	for _, backend := range []firewallBackend{ufwBackend{}, firewalldBackend{}, nftablesBackend{}, iptablesBackend{}} {
+		if _, err := exec.LookPath(backend.Tool()); err == nil {
+			installed = append(installed, backend)
+		}
+	}
+	for _, backend := range installed {
+		if status, err := backend.Status(context.Background()); err == nil && status.Enabled {
+			return backend
+		}
+	}
+	if len(installed) > 0 {
+		return installed[0]
+	}
+	return nil
+}
+
+// Helper function to run a privileged firewall command and wrap its failure
+func runFirewallCommand(tool string, args ...string) (CommandResult, error) {
+	return runFirewallCommandContext(context.Background(), tool, args...)
+}
+
+// Helper function like runFirewallCommand that kills the command once ctx is done
+func runFirewallCommandContext(ctx context.Context, tool string, args ...string) (CommandResult, error) {
+	cmd := newPrivilegedCommand(nil, tool, args...)
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return result, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	return result, nil
+}
+
+// ufw
+
+type ufwBackend struct{}
+
+func (ufwBackend) Name() string { return "ufw" }
+
+func (ufwBackend) Tool() string { return "ufw" }
+
+func (ufwBackend) Status(ctx context.Context) (*FirewallStatus, error) {
+	result, err := runFirewallCommandContext(ctx, "ufw", "status", "verbose")
+	if err != nil {
+		return nil, err
+	}
+	return parseUFWStatus(result.Stdout), nil
+}
+
+func (ufwBackend) OpenPort(request FirewallRuleRequest) (CommandResult, error) {
+	// ufw rules are always persistent
+	return runFirewallCommand("ufw", "allow", fmt.Sprintf("%d/%s", request.Port, request.Protocol))
+}
+
+var ufwColumns = regexp.MustCompile(`\s{2,}`)
+
+// Function to parse `ufw status verbose`
+func parseUFWStatus(output string) *FirewallStatus {
+	status := &FirewallStatus{Backend: "ufw", Rules: []FirewallRule{}}
+	inTable := false
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case strings.HasPrefix(line, "Status:"):
+			status.Enabled = strings.TrimSpace(strings.TrimPrefix(line, "Status:")) == "active"
+		case strings.HasPrefix(line, "Default:"):
+			status.Default = strings.TrimSpace(strings.TrimPrefix(line, "Default:"))
+		case strings.HasPrefix(line, "--"):
+			inTable = true
+		case inTable && strings.TrimSpace(line) != "":
+			columns := ufwColumns.Split(strings.TrimSpace(line), -1)
+			if len(columns) < 3 {
+				continue
+			}
+			rule := FirewallRule{Raw: strings.TrimSpace(line), Source: columns[2]}
+			// Rules for one interface read "8080/tcp on eth0" or "8080/tcp (v6) on eth0"
+			to, _, _ := strings.Cut(columns[0], " on ")
+			if strings.HasSuffix(to, " (v6)") {
+				rule.IPv6 = true
+				to = strings.TrimSuffix(to, " (v6)")
+				rule.Source = strings.TrimSuffix(rule.Source, " (v6)")
+			}
+			if port, proto, ok := strings.Cut(to, "/"); ok {
+				rule.Port, rule.Protocol = strings.ReplaceAll(port, ":", "-"), proto
+			} else if _, err := strconv.Atoi(strings.Split(to, ":")[0]); err == nil {
+				rule.Port = strings.ReplaceAll(to, ":", "-")
+			} else {
+				rule.Service = to // an application profile such as OpenSSH
+			}
+			action := strings.Fields(columns[1])
+			rule.Action = normalizeAction(action[0])
+			if rule.Source == "Anywhere" {
+				rule.Source = ""
+			}
+			status.Rules = append(status.Rules, rule)
+		}
+	}
+	return status
+}
+
+// firewalld
+
+type firewalldBackend struct{}
+
+func (firewalldBackend) Name() string { return "firewalld" }
+
+func (firewalldBackend) Tool() string { return "firewall-cmd" }
+
+func (firewalldBackend) Status(ctx context.Context) (*FirewallStatus, error) {
+	// --state exits non-zero when firewalld isn't running, which is a status, not an error
+	if _, err := runFirewallCommandContext(ctx, "firewall-cmd", "--state"); err != nil {
+		return &FirewallStatus{Backend: "firewalld", Rules: []FirewallRule{}}, nil
+	}
+	result, err := runFirewallCommandContext(ctx, "firewall-cmd", "--list-all-zones")
+	if err != nil {
+		return nil, err
+	}
+	status := parseFirewalldZones(result.Stdout)
+	status.Enabled = true
+	return status, nil
+}
+
+func (firewalldBackend) OpenPort(request FirewallRuleRequest) (CommandResult, error) {
+	spec := fmt.Sprintf("--add-port=%d/%s", request.Port, request.Protocol)
+	result, err := runFirewallCommand("firewall-cmd", spec)
+	if err != nil || !request.Permanent {
+		return result, err
+	}
+	return runFirewallCommand("firewall-cmd", "--permanent", spec)
+}
+
+// Function to parse `firewall-cmd --list-all-zones`. Only active zones contribute rules.
+func parseFirewalldZones(output string) *FirewallStatus {
+	status := &FirewallStatus{Backend: "firewalld", Rules: []FirewallRule{}}
+	var zone *FirewallZone
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			name, flags, _ := strings.Cut(line, " ")
+			status.Zones = append(status.Zones, FirewallZone{
+				Name:       name,
+				Active:     strings.Contains(flags, "active"),
+				Default:    strings.Contains(flags, "default"),
+				Interfaces: []string{},
+				Sources:    []string{},
+			})
+			zone = &status.Zones[len(status.Zones)-1]
+			continue
+		}
+		if zone == nil {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		values := strings.Fields(value)
+		switch key {
+		case "target":
+			zone.Target = strings.TrimSpace(value)
+			if zone.Default {
+				status.Default = zone.Target
+			}
+		case "interfaces":
+			zone.Interfaces = append(zone.Interfaces, values...)
+		case "sources":
+			zone.Sources = append(zone.Sources, values...)
+		case "services":
+			if zone.Active {
+				for _, service := range values {
+					status.Rules = append(status.Rules, FirewallRule{Service: service, Action: "allow", Zone: zone.Name, Raw: "service " + service})
+				}
+			}
+		case "ports":
+			if zone.Active {
+				for _, port := range values {
+					number, proto, _ := strings.Cut(port, "/")
+					status.Rules = append(status.Rules, FirewallRule{Port: number, Protocol: proto, Action: "allow", Zone: zone.Name, Raw: "port " + port})
+				}
+			}
+		}
+	}
+	return status
+}
+
+// nftables
+
+type nftablesBackend struct{}
+
+func (nftablesBackend) Name() string { return "nftables" }
+
+func (nftablesBackend) Tool() string { return "nft" }
+
+func (nftablesBackend) Status(ctx context.Context) (*FirewallStatus, error) {
+	result, err := runFirewallCommandContext(ctx, "nft", "-j", "list", "ruleset")
+	if err != nil {
+		return nil, err
+	}
+	return parseNftRuleset([]byte(result.Stdout))
+}
+
+func (b nftablesBackend) OpenPort(request FirewallRuleRequest) (CommandResult, error) {
+	if request.Permanent {
+		return CommandResult{}, errPermanentUnsupported
+	}
+	result, err := runFirewallCommand("nft", "-j", "list", "ruleset")
+	if err != nil {
+		return result, err
+	}
+	chain, err := nftInputChain([]byte(result.Stdout))
+	if err != nil {
+		return CommandResult{}, err
+	}
+	// Insert at the top of the chain so a trailing drop rule doesn't shadow it
+	return runFirewallCommand("nft", "insert", "rule", chain.Family, chain.Table, chain.Name,
+		request.Protocol, "dport", strconv.Itoa(request.Port), "accept")
+}
+
+// nftRuleset is the subset of `nft -j list ruleset` the agent reads
+type nftRuleset struct {
+	Nftables []struct {
+		Chain *nftChain `json:"chain"`
+		Rule  *struct {
+			Family string                       `json:"family"`
+			Table  string                       `json:"table"`
+			Chain  string                       `json:"chain"`
+			Expr   []map[string]json.RawMessage `json:"expr"`
+		} `json:"rule"`
+	} `json:"nftables"`
+}
+
+type nftChain struct {
+	Family string `json:"family"`
+	Table  string `json:"table"`
+	Name   string `json:"name"`
+	Hook   string `json:"hook"`
+	Policy string `json:"policy"`
+}
+
+// nftMatch is a "match" expression such as `tcp dport 22` or `ip saddr 10.0.0.0/8`
+type nftMatch struct {
+	Left struct {
+		Payload *struct {
+			Protocol string `json:"protocol"`
+			Field    string `json:"field"`
+		} `json:"payload"`
+	} `json:"left"`
+	Right json.RawMessage `json:"right"`
+}
+
+// Function to parse `nft -j list ruleset` into rules from the input hook chains
+func parseNftRuleset(data []byte) (*FirewallStatus, error) {
+	var ruleset nftRuleset
+	if err := json.Unmarshal(data, &ruleset); err != nil {
+		return nil, fmt.Errorf("parsing nft ruleset: %w", err)
+	}
+	status := &FirewallStatus{Backend: "nftables", Rules: []FirewallRule{}}
+
+	inputChains := make(map[string]bool)
+	for _, item := range ruleset.Nftables {
+		if item.Chain != nil && item.Chain.Hook == "input" {
+			inputChains[item.Chain.Family+" "+item.Chain.Table+" "+item.Chain.Name] = true
+			status.Enabled = true
+			if item.Chain.Policy != "" {
+				status.Default = item.Chain.Policy
+			}
+		}
+	}
+
+	for _, item := range ruleset.Nftables {
+		rule := item.Rule
+		if rule == nil || !inputChains[rule.Family+" "+rule.Table+" "+rule.Chain] {
+			continue
+		}
+		normalized := FirewallRule{Chain: rule.Chain, IPv6: rule.Family == "ip6"}
+		var raw []string
+		for _, expr := range rule.Expr {
+			for kind, body := range expr {
+				switch kind {
+				case "accept":
+					normalized.Action = "allow"
+					raw = append(raw, kind)
+				case "drop":
+					normalized.Action = "deny"
+					raw = append(raw, kind)
+				case "reject":
+					normalized.Action = "reject"
+					raw = append(raw, kind)
+				case "match":
+					var match nftMatch
+					if json.Unmarshal(body, &match) != nil || match.Left.Payload == nil {
+						raw = append(raw, kind)
+						continue
+					}
+					value := nftValue(match.Right)
+					raw = append(raw, match.Left.Payload.Protocol+" "+match.Left.Payload.Field+" "+value)
+					switch match.Left.Payload.Field {
+					case "dport":
+						normalized.Protocol = match.Left.Payload.Protocol
+						normalized.Port = value
+					case "saddr":
+						normalized.Source = value
+					}
+				default:
+					raw = append(raw, kind)
+				}
+			}
+		}
+		if normalized.Action == "" {
+			continue // counters, jumps, and other non-verdict rules
+		}
+		normalized.Raw = strings.Join(raw, " ")
+		status.Rules = append(status.Rules, normalized)
+	}
+	return status, nil
+}
+
+// Helper function to render the right-hand side of an nft match as text
+func nftValue(raw json.RawMessage) string {
+	var number int
+	if json.Unmarshal(raw, &number) == nil {
+		return strconv.Itoa(number)
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return text
+	}
+	var rng struct {
+		Range []int `json:"range"`
+	}
+	if json.Unmarshal(raw, &rng) == nil && len(rng.Range) == 2 {
+		return fmt.Sprintf("%d-%d", rng.Range[0], rng.Range[1])
+	}
+	var prefix struct {
+		Prefix struct {
+			Addr string `json:"addr"`
+			Len  int    `json:"len"`
+		} `json:"prefix"`
+	}
+	if json.Unmarshal(raw, &prefix) == nil && prefix.Prefix.Addr != "" {
+		return fmt.Sprintf("%s/%d", prefix.Prefix.Addr, prefix.Prefix.Len)
+	}
+	var set struct {
+		Set []json.RawMessage `json:"set"`
+	}
+	if json.Unmarshal(raw, &set) == nil && len(set.Set) > 0 {
+		values := make([]string, len(set.Set))
+		for i, element := range set.Set {
+			values[i] = nftValue(element)
+		}
+		return strings.Join(values, ",")
+	}
+	return string(raw)
+}
+
+// Function to find the chain attached to the input hook where ports are opened
+func nftInputChain(data []byte) (*nftChain, error) {
+	var ruleset nftRuleset
+	if err := json.Unmarshal(data, &ruleset); err != nil {
+		return nil, fmt.Errorf("parsing nft ruleset: %w", err)
+	}
+	for _, item := range ruleset.Nftables {
+		if item.Chain != nil && item.Chain.Hook == "input" && (item.Chain.Family == "inet" || item.Chain.Family == "ip") {
+			return item.Chain, nil
+		}
+	}
+	return nil, fmt.Errorf("no nftables chain is attached to the input hook")
+}
+
+// iptables
+
+type iptablesBackend struct{}
+
+func (iptablesBackend) Name() string { return "iptables" }
+
+func (iptablesBackend) Tool() string { return "iptables" }
+
+func (iptablesBackend) Status(ctx context.Context) (*FirewallStatus, error) {
+	result, err := runFirewallCommandContext(ctx, "iptables", "-S", "INPUT")
+	if err != nil {
+		return nil, err
+	}
+	return parseIptablesRules(result.Stdout), nil
+}
+
+func (iptablesBackend) OpenPort(request FirewallRuleRequest) (CommandResult, error) {
+	_, persistErr := exec.LookPath("netfilter-persistent")
+	if request.Permanent && persistErr != nil {
+		return CommandResult{}, errPermanentUnsupported
+	}
+	result, err := runFirewallCommand("iptables", "-I", "INPUT", "-p", request.Protocol,
+		"--dport", strconv.Itoa(request.Port), "-j", "ACCEPT")
+	if err != nil || !request.Permanent {
+		return result, err
+	}
+	return runFirewallCommand("netfilter-persistent", "save")
+}
+
+// Function to parse `iptables -S INPUT`
+func parseIptablesRules(output string) *FirewallStatus {
+	status := &FirewallStatus{Backend: "iptables", Rules: []FirewallRule{}}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		if fields[0] == "-P" {
+			status.Default = strings.ToLower(fields[2])
+			status.Enabled = status.Enabled || fields[2] != "ACCEPT"
+			continue
+		}
+		if fields[0] != "-A" {
+			continue
+		}
+		status.Enabled = true
+		rule := FirewallRule{Chain: fields[1], Raw: line}
+		for i := 2; i < len(fields)-1; i++ {
+			switch fields[i] {
+			case "-p":
+				rule.Protocol = fields[i+1]
+			case "--dport", "--dports":
+				rule.Port = strings.ReplaceAll(fields[i+1], ":", "-")
+			case "-s":
+				rule.Source = fields[i+1]
+			case "-j":
+				rule.Action = normalizeAction(fields[i+1])
+			}
+		}
+		if rule.Action == "" {
+			continue // jumps to user chains aren't verdicts
+		}
+		status.Rules = append(status.Rules, rule)
+	}
+	return status
+}
+
+// Helper function to map backend verdicts onto allow, deny, and reject
+func normalizeAction(action string) string {
+	switch strings.ToUpper(action) {
+	case "ALLOW", "ACCEPT", "LIMIT":
+		return "allow"
+	case "DENY", "DROP":
+		return "deny"
+	case "REJECT":
+		return "reject"
+	}
+	return ""
+}
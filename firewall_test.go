@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Helper function to read a captured file from testdata/<dir>
+func readFixture(t *testing.T, dir, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Helper function to compare parsed rules with the expected ones, ignoring the raw text
+func checkRules(t *testing.T, got, want []FirewallRule) {
+	t.Helper()
+	stripped := make([]FirewallRule, len(got))
+	for i, rule := range got {
+		if rule.Raw == "" {
+			t.Errorf("rule %d has no raw text: %+v", i, rule)
+		}
+		rule.Raw = ""
+		stripped[i] = rule
+	}
+	if len(stripped) != len(want) {
+		t.Fatalf("got %d rules, want %d:\n%+v", len(stripped), len(want), stripped)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(stripped[i], want[i]) {
+			t.Errorf("rule %d = %+v, want %+v", i, stripped[i], want[i])
+		}
+	}
+}
+
+func TestParseUFWStatus(t *testing.T) {
+	status := parseUFWStatus(string(readFixture(t, "firewall", "ufw-status-verbose.txt")))
+	if !status.Enabled || status.Default != "deny (incoming), allow (outgoing), disabled (routed)" {
+		t.Errorf("status = %+v", status)
+	}
+	checkRules(t, status.Rules, []FirewallRule{
+		{Port: "22", Protocol: "tcp", Action: "allow"},
+		{Port: "6443", Protocol: "tcp", Action: "allow", Source: "10.0.0.0/8"},
+		{Service: "OpenSSH", Action: "allow"},
+		{Port: "30000-32767", Protocol: "tcp", Action: "allow"},
+		{Port: "80", Protocol: "tcp", Action: "allow"},
+		{Port: "53", Action: "deny", Source: "192.168.1.5"},
+		{Port: "8080", Protocol: "tcp", Action: "allow"},
+		{Port: "22", Protocol: "tcp", Action: "allow", IPv6: true},
+		{Service: "OpenSSH", Action: "allow", IPv6: true},
+	})
+
+	inactive := parseUFWStatus(string(readFixture(t, "firewall", "ufw-status-inactive.txt")))
+	if inactive.Enabled || len(inactive.Rules) != 0 {
+		t.Errorf("inactive ufw = %+v", inactive)
+	}
+}
+
+func TestParseFirewalldZones(t *testing.T) {
+	status := parseFirewalldZones(string(readFixture(t, "firewall", "firewalld-list-all-zones.txt")))
+	if status.Default != "default" {
+		t.Errorf("default policy = %q, want the public zone's target", status.Default)
+	}
+	wantZones := []FirewallZone{
+		{Name: "block", Target: "%%REJECT%%", Interfaces: []string{}, Sources: []string{}},
+		{Name: "drop", Target: "DROP", Interfaces: []string{}, Sources: []string{}},
+		{Name: "public", Active: true, Default: true, Target: "default", Interfaces: []string{"eth0"}, Sources: []string{}},
+		{Name: "trusted", Active: true, Target: "ACCEPT", Interfaces: []string{"cni0", "flannel.1"}, Sources: []string{"10.244.0.0/16"}},
+	}
+	if !reflect.DeepEqual(status.Zones, wantZones) {
+		t.Errorf("zones = %+v\nwant %+v", status.Zones, wantZones)
+	}
+	// The inactive drop zone's ssh and 8080 don't apply to any traffic
+	checkRules(t, status.Rules, []FirewallRule{
+		{Service: "cockpit", Action: "allow", Zone: "public"},
+		{Service: "dhcpv6-client", Action: "allow", Zone: "public"},
+		{Service: "ssh", Action: "allow", Zone: "public"},
+		{Port: "6443", Protocol: "tcp", Action: "allow", Zone: "public"},
+		{Port: "10250", Protocol: "tcp", Action: "allow", Zone: "public"},
+		{Port: "30000-32767", Protocol: "tcp", Action: "allow", Zone: "public"},
+		{Port: "8472", Protocol: "udp", Action: "allow", Zone: "trusted"},
+	})
+}
+
+func TestParseNftRuleset(t *testing.T) {
+	status, err := parseNftRuleset(readFixture(t, "firewall", "nft-ruleset.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Enabled || status.Default != "drop" {
+		t.Errorf("status = %+v", status)
+	}
+	// Counter-only and jump rules aren't verdicts, and the forward chain isn't input
+	checkRules(t, status.Rules, []FirewallRule{
+		{Action: "allow", Chain: "input"},
+		{Action: "allow", Chain: "input"},
+		{Port: "22", Protocol: "tcp", Action: "allow", Chain: "input"},
+		{Port: "6443", Protocol: "tcp", Action: "allow", Source: "10.0.0.0/8", Chain: "input"},
+		{Port: "30000-32767", Protocol: "tcp", Action: "allow", Chain: "input"},
+		{Port: "53,123", Protocol: "udp", Action: "allow", Chain: "input"},
+		{Port: "23", Protocol: "tcp", Action: "reject", Chain: "input"},
+	})
+
+	chain, err := nftInputChain(readFixture(t, "firewall", "nft-ruleset.json"))
+	if err != nil || chain.Family != "inet" || chain.Table != "filter" || chain.Name != "input" {
+		t.Errorf("input chain = %+v, %v", chain, err)
+	}
+	if _, err := parseNftRuleset([]byte("not json")); err == nil {
+		t.Error("parsed invalid JSON")
+	}
+}
+
+func TestParseIptablesRules(t *testing.T) {
+	status := parseIptablesRules(string(readFixture(t, "firewall", "iptables-s-input.txt")))
+	if !status.Enabled || status.Default != "drop" {
+		t.Errorf("status = %+v", status)
+	}
+	checkRules(t, status.Rules, []FirewallRule{
+		{Action: "allow", Chain: "INPUT"},
+		{Action: "allow", Chain: "INPUT"},
+		{Port: "22", Protocol: "tcp", Action: "allow", Chain: "INPUT"},
+		{Port: "6443", Protocol: "tcp", Action: "allow", Source: "10.0.0.0/8", Chain: "INPUT"},
+		{Port: "30000-32767", Protocol: "tcp", Action: "allow", Chain: "INPUT"},
+		{Port: "53", Protocol: "udp", Action: "deny", Chain: "INPUT"},
+		{Protocol: "icmp", Action: "reject", Chain: "INPUT"},
+	})
+
+	open := parseIptablesRules(string(readFixture(t, "firewall", "iptables-s-input-open.txt")))
+	if open.Enabled || open.Default != "accept" || len(open.Rules) != 0 {
+		t.Errorf("accept-all iptables = %+v", open)
+	}
+}
+
+// A host with none of the tools reports no backend rather than an error
+func TestDetectFirewallWithoutTooling(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	if backend := detectFirewall(); backend != nil {
+		t.Errorf("detected %s without any firewall tools", backend.Name())
+	}
+}
+
+// An inactive frontend loses to the backend actually filtering traffic
+func TestDetectFirewallPrefersActive(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	rules, err := filepath.Abs(filepath.Join("testdata", "firewall", "iptables-s-input.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeCommand(t, "ufw", `echo "Status: inactive"`)
+	fakeCommand(t, "iptables", `/bin/cat `+rules)
+
+	if backend := detectFirewall(); backend == nil || backend.Name() != "iptables" {
+		t.Errorf("detected %v, want the active iptables", backend)
+	}
+}
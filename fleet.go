@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rothgar/cosi/api"
+	"github.com/rothgar/cosi/signing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	// Requests a fleet operation has in flight at once unless fleet.concurrency says otherwise
+	defaultFleetConcurrency = 8
+	// Time each agent gets to answer, per attempt, for quick operations and for those that run as jobs
+	defaultFleetTimeout    = 30 * time.Second
+	defaultFleetJobTimeout = 30 * time.Minute
+	// Delay before the first retry, doubled for every further one, and the most retries fleet.retries may ask for
+	defaultFleetRetryBackoff = time.Second
+	maxFleetRetries          = 5
+	// Most of an agent's response body kept in a fleet report
+	maxFleetResponseBytes = 1 << 20
+)
+
+// Scope of the tokens that may use the /fleet endpoints
+const scopeFleet = "fleet"
+
+// Job status of fleet jobs where some agents succeeded and others failed, and of batches
+// where some operations did
+const jobPartiallySucceeded = api.JobPartiallySucceeded
+
+// States of one agent in a fleet report
+const (
+	fleetPending   = "pending"
+	fleetRunning   = "running"
+	fleetSucceeded = "succeeded"
+	fleetFailed    = "failed"
+	fleetCancelled = "cancelled"
+)
+
+// FleetConfig lets the agent act as a gateway that fans requests out to other agents.
+// Targets must be listed here, and the credentials sent to them come only from here.
+type FleetConfig struct {
+	Agents []FleetAgent `yaml:"agents"`
+	// Concurrency is the number of agents called at once
+	Concurrency int `yaml:"concurrency"`
+	// Timeout is how long each agent has to answer a quick operation, per attempt, and
+	// JobTimeout one that runs as a job on the agent
+	Timeout    time.Duration `yaml:"timeout"`
+	JobTimeout time.Duration `yaml:"job_timeout"`
+	// Retries are attempted when an agent can't be connected to or answers 502, 503, or
+	// 504. Requests that may have reached the agent aren't retried.
+	Retries      int           `yaml:"retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+}
+
+// FleetAgent is one agent fleet operations may target, by name or URL
+type FleetAgent struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Token is sent as a bearer token, or signs the requests when KeyID is set
+	Token string `yaml:"token"`
+	// KeyID is the name of the token on the agent, for agents that take signed requests
+	KeyID string `yaml:"key_id"`
+}
+
+func (f FleetConfig) concurrency() int {
+	return int(orDefault(int64(f.Concurrency), defaultFleetConcurrency))
+}
+
+func (f FleetConfig) timeout(job bool) time.Duration {
+	if job {
+		return time.Duration(orDefault(int64(f.JobTimeout), int64(defaultFleetJobTimeout)))
+	}
+	return time.Duration(orDefault(int64(f.Timeout), int64(defaultFleetTimeout)))
+}
+
+func (f FleetConfig) retryBackoff() time.Duration {
+	return time.Duration(orDefault(int64(f.RetryBackoff), int64(defaultFleetRetryBackoff)))
+}
+
+// Function to check the fleet settings
+func (f FleetConfig) validate() error {
+	names := make(map[string]bool)
+	for _, agent := range f.Agents {
+		if agent.Name == "" || agent.URL == "" {
+			return fmt.Errorf("fleet agents need a name and a url")
+		}
+		if names[agent.Name] {
+			return fmt.Errorf("fleet agent %q is listed more than once", agent.Name)
+		}
+		names[agent.Name] = true
+		if u, err := url.Parse(agent.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("fleet agent %q: url must be http or https", agent.Name)
+		}
+		if agent.KeyID != "" && agent.Token == "" {
+			return fmt.Errorf("fleet agent %q sets key_id without a token to sign with", agent.Name)
+		}
+	}
+	if f.Concurrency < 0 || f.Timeout < 0 || f.JobTimeout < 0 || f.Retries < 0 || f.RetryBackoff < 0 {
+		return fmt.Errorf("fleet.concurrency, fleet.timeout, fleet.job_timeout, fleet.retries, and fleet.retry_backoff must not be negative")
+	}
+	if f.Retries > maxFleetRetries {
+		return fmt.Errorf("fleet.retries must be at most %d", maxFleetRetries)
+	}
+	return nil
+}
+
+// fleetOperation is an endpoint of the agents that POST /fleet/{operation} calls
+type fleetOperation struct {
+	Method string
+	Path   string
+	// Job is set for operations that run as jobs on the agents. They run in the
+	// background as a fleet job.
+	Job bool
+}
+
+// Operations the fleet endpoint fans out, by the name in its path
+var fleetOperations = map[string]fleetOperation{
+	"packages":        {Method: http.MethodPost, Path: "/packages", Job: true},
+	"packages/diff":   {Method: http.MethodPost, Path: "/packages/diff"},
+	"packages/repair": {Method: http.MethodPost, Path: "/packages/repair", Job: true},
+	"packages/list":   {Method: http.MethodGet, Path: "/packages"},
+	"kubernetes":      {Method: http.MethodPost, Path: "/kubernetes", Job: true},
+	"update":          {Method: http.MethodPost, Path: "/update"},
+	"reconcile/run":   {Method: http.MethodPost, Path: "/reconcile/run"},
+	"network/probe":   {Method: http.MethodPost, Path: "/network/probe"},
+	"probe/http":      {Method: http.MethodPost, Path: "/probe/http"},
+	"capabilities":    {Method: http.MethodGet, Path: "/capabilities"},
+	"inventory":       {Method: http.MethodGet, Path: "/inventory"},
+	"version":         {Method: http.MethodGet, Path: "/version"},
+}
+
+// FleetHostResult is the outcome of a fleet operation on one agent
+type FleetHostResult struct {
+	Target string `json:"target"`
+	URL    string `json:"url"`
+	// State is pending, running, succeeded when the agent answered with a 2xx status,
+	// failed, or cancelled when the fleet job was cancelled before the agent was called
+	State      string `json:"state"`
+	StatusCode int    `json:"status_code,omitempty"`
+	// Body is the agent's response: its JSON, or a string for anything else
+	Body      json.RawMessage `json:"body,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	LatencyMS float64         `json:"latency_ms,omitempty"`
+	Attempts  int             `json:"attempts,omitempty"`
+	// JobID and JobStatus are the job the operation ran as on the agent
+	JobID     string `json:"job_id,omitempty"`
+	JobStatus string `json:"job_status,omitempty"`
+}
+
+// FleetReport combines the outcomes of a fleet operation on every agent it targets
+type FleetReport struct {
+	Operation string `json:"operation"`
+	// Status is running while agents are pending, then succeeded when every agent
+	// succeeded, failed when none did, and partial otherwise
+	Status    string            `json:"status"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Pending   int               `json:"pending"`
+	Hosts     []FleetHostResult `json:"hosts"`
+}
+
+// Helper function to count the agents by state and derive the report's status
+func (r *FleetReport) tally() {
+	r.Succeeded, r.Failed, r.Pending = 0, 0, 0
+	for _, host := range r.Hosts {
+		switch host.State {
+		case fleetPending, fleetRunning:
+			r.Pending++
+		case fleetSucceeded:
+			r.Succeeded++
+		default:
+			r.Failed++
+		}
+	}
+	switch {
+	case r.Pending > 0:
+		r.Status = jobRunning
+	case r.Failed == 0:
+		r.Status = fleetSucceeded
+	case r.Succeeded == 0:
+		r.Status = fleetFailed
+	default:
+		r.Status = "partial"
+	}
+}
+
+// Helper function to return a copy of the report that later updates don't change
+func (r *FleetReport) copy() *FleetReport {
+	copied := *r
+	copied.Hosts = append([]FleetHostResult(nil), r.Hosts...)
+	return &copied
+}
+
+// fleetFailureError reports a fleet job in which some or all agents failed
+type fleetFailureError struct {
+	Failed, Total int
+}
+
+func (e *fleetFailureError) Error() string {
+	return fmt.Sprintf("the operation failed on %d of %d agents", e.Failed, e.Total)
+}
+
+// Helper function to check if err reports a fleet job that succeeded on some agents, or
+// a batch in which some operations succeeded
+func partiallySucceeded(err error) bool {
+	var fleetErr *fleetFailureError
+	var batchErr *batchFailureError
+	switch {
+	case errors.As(err, &fleetErr):
+		return fleetErr.Failed < fleetErr.Total
+	case errors.As(err, &batchErr):
+		return batchErr.Succeeded > 0
+	}
+	return false
+}
+
+// fleetRequest is an operation to send to agents, with the body and query of the
+// request that asked for it
+type fleetRequest struct {
+	Name        string
+	Operation   fleetOperation
+	Query       url.Values
+	Body        []byte
+	ContentType string
+}
+
+// Function to resolve the target query parameters, names or URLs of configured agents
+func fleetTargets(targets []string) ([]FleetAgent, error) {
+	if len(targets) == 0 {
+		return nil, &requestError{Status: 400, Code: "invalid_parameter", Message: "List the agents to call in target query parameters"}
+	}
+	agents := currentConfig().Fleet.Agents
+	var resolved []FleetAgent
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		found := false
+		for _, agent := range agents {
+			if agent.Name == target || strings.TrimSuffix(agent.URL, "/") == strings.TrimSuffix(target, "/") {
+				if !seen[agent.Name] {
+					seen[agent.Name] = true
+					resolved = append(resolved, agent)
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, &requestError{Status: 400, Code: "unknown_target", Message: fmt.Sprintf("%s is not one of the agents in fleet.agents", target)}
+		}
+	}
+	return resolved, nil
+}
+
+// Client of the fleet requests; timeouts come from the context of each request
+var fleetClient = &http.Client{Transport: proxiedTransport()}
+
+// Function to run a fleet operation on agents, calling update with a copy of the report
+// whenever an agent finishes. cancelled is checked before each agent is called.
+func runFleet(ctx context.Context, request fleetRequest, agents []FleetAgent, update func(*FleetReport), cancelled func() bool) *FleetReport {
+	cfg := currentConfig().Fleet
+	report := &FleetReport{Operation: request.Name, Hosts: make([]FleetHostResult, len(agents))}
+	for i, agent := range agents {
+		report.Hosts[i] = FleetHostResult{Target: agent.Name, URL: agent.URL, State: fleetPending}
+	}
+	report.tally()
+	var mu sync.Mutex
+	set := func(i int, result FleetHostResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		report.Hosts[i] = result
+		report.tally()
+		if update != nil {
+			update(report.copy())
+		}
+	}
+
+	tasks := make([]task, len(agents))
+	for i, agent := range agents {
+		tasks[i] = task{Name: agent.Name, Run: func(ctx context.Context) (interface{}, error) {
+			if cancelled != nil && cancelled() {
+				set(i, FleetHostResult{Target: agent.Name, URL: agent.URL, State: fleetCancelled, Error: "the fleet job was cancelled before the agent was called"})
+				return nil, nil
+			}
+			set(i, FleetHostResult{Target: agent.Name, URL: agent.URL, State: fleetRunning})
+			set(i, callAgent(ctx, cfg, agent, request))
+			return nil, nil
+		}}
+	}
+	// Every attempt has its own timeout, so the task only bounds them together
+	timeout := time.Duration(cfg.Retries+1)*cfg.timeout(request.Operation.Job) + time.Duration(1<<cfg.Retries)*cfg.retryBackoff()
+	for i, outcome := range fanOut(ctx, tasks, cfg.concurrency(), timeout) {
+		if outcome.Err != nil {
+			set(i, FleetHostResult{Target: agents[i].Name, URL: agents[i].URL, State: fleetFailed, Error: outcome.Err.Error()})
+		}
+	}
+	return report.copy()
+}
+
+// Function to send a fleet request to one agent, retrying when it couldn't be reached
+func callAgent(ctx context.Context, cfg FleetConfig, agent FleetAgent, request fleetRequest) FleetHostResult {
+	result := FleetHostResult{Target: agent.Name, URL: agent.URL, State: fleetFailed}
+	backoff := cfg.retryBackoff()
+	for attempt := 0; attempt <= cfg.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return result
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		result.Attempts++
+		started := time.Now()
+		response, body, err := sendToAgent(ctx, cfg.timeout(request.Operation.Job), agent, request.Operation.Method, request.Operation.Path, request.Query, request.Body, request.ContentType)
+		result.LatencyMS = milliseconds(time.Since(started))
+		if err != nil {
+			result.Error = err.Error()
+			var opErr *net.OpError
+			if errors.As(err, &opErr) && opErr.Op == "dial" {
+				continue
+			}
+			return result
+		}
+		result.Error = ""
+		result.StatusCode = response.StatusCode
+		result.Body = fleetBody(response.Header.Get("Content-Type"), body)
+		result.JobID = response.Header.Get("X-Cosi-Job-Id")
+		if response.StatusCode == http.StatusBadGateway || response.StatusCode == http.StatusServiceUnavailable || response.StatusCode == http.StatusGatewayTimeout {
+			continue
+		}
+		break
+	}
+	if result.StatusCode >= 200 && result.StatusCode < 300 {
+		result.State = fleetSucceeded
+	}
+	if result.StatusCode != 0 && result.Error == "" {
+		result.JobID, result.JobStatus = agentJobStatus(ctx, cfg, agent, result.JobID)
+	}
+	return result
+}
+
+// Helper function to send one request to an agent with the credentials configured for it
+func sendToAgent(ctx context.Context, timeout time.Duration, agent FleetAgent, method, path string, query url.Values, body []byte, contentType string) (*http.Response, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	target := strings.TrimSuffix(agent.URL, "/") + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", "cosi/"+version)
+	if contentType != "" && body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	switch {
+	case agent.KeyID != "":
+		if err := signing.SignRequest(req, agent.KeyID, []byte(agent.Token), time.Now()); err != nil {
+			return nil, nil, err
+		}
+	case agent.Token != "":
+		req.Header.Set("Authorization", "Bearer "+agent.Token)
+	}
+
+	response, err := fleetClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxFleetResponseBytes+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading the response: %w", err)
+	}
+	if len(data) > maxFleetResponseBytes {
+		data, _ = json.Marshal(fmt.Sprintf("the response was larger than %d bytes and was dropped", maxFleetResponseBytes))
+		response.Header.Set("Content-Type", "application/json")
+	}
+	return response, data, nil
+}
+
+// Helper function to keep a JSON response as it is and any other as a JSON string
+func fleetBody(contentType string, body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	if strings.HasPrefix(contentType, "application/json") && json.Valid(body) {
+		return body
+	}
+	encoded, _ := json.Marshal(string(body))
+	return encoded
+}
+
+// Helper function to look up the status of the job an operation ran as on an agent.
+// Failures leave the status empty; the response already says how the operation went.
+func agentJobStatus(ctx context.Context, cfg FleetConfig, agent FleetAgent, jobID string) (string, string) {
+	if jobID == "" {
+		return "", ""
+	}
+	response, body, err := sendToAgent(ctx, cfg.timeout(false), agent, http.MethodGet, "/jobs/"+url.PathEscape(jobID), nil, nil, "")
+	if err != nil || response.StatusCode != http.StatusOK {
+		return jobID, ""
+	}
+	var job struct {
+		Status string `json:"status"`
+	}
+	json.Unmarshal(body, &job)
+	return jobID, job.Status
+}
+
+// Helper function to read a fleet request. When it returns false an error response has
+// already been sent.
+func bindFleetRequest(c *gin.Context) (fleetRequest, []FleetAgent, bool) {
+	name := strings.Trim(c.Param("operation"), "/")
+	operation, ok := fleetOperations[name]
+	if !ok {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("Unknown fleet operation %q", name), "code": "unknown_operation"})
+		return fleetRequest{}, nil, false
+	}
+	query := c.Request.URL.Query()
+	agents, err := fleetTargets(query["target"])
+	if err != nil {
+		respondFailure(c, "Invalid targets", err)
+		return fleetRequest{}, nil, false
+	}
+	// Everything but the targets goes to the agents, like wait_for_lock_seconds
+	query.Del("target")
+	request := fleetRequest{Name: name, Operation: operation, Query: query, ContentType: c.GetHeader("Content-Type")}
+	if operation.Method != http.MethodGet {
+		if request.Body, err = io.ReadAll(c.Request.Body); err != nil {
+			c.JSON(400, gin.H{"error": "Unable to read request body: " + err.Error()})
+			return fleetRequest{}, nil, false
+		}
+	}
+	return request, agents, true
+}
+
+// Function to register the /fleet endpoints, behind the fleet scope. Their requests go out
+// with the credentials of fleet.agents, so they need a token of their own.
+func registerFleetRoutes(r *gin.Engine) {
+	fleet := r.Group("/fleet", requireScope(scopeFleet))
+
+	// Define the /fleet/{operation} endpoint that runs an operation on the target agents.
+	// Operations that run as jobs on the agents run as a fleet job here.
+	fleet.POST("/*operation", func(c *gin.Context) {
+		request, agents, ok := bindFleetRequest(c)
+		if !ok {
+			return
+		}
+		targets := make([]string, len(agents))
+		for i, agent := range agents {
+			targets[i] = agent.Name
+		}
+		summary := fmt.Sprintf("%s on %d agents", request.Name, len(agents))
+		details := map[string]interface{}{"client": c.ClientIP(), "operation": request.Name, "targets": targets}
+
+		if !request.Operation.Job {
+			report := runFleet(c.Request.Context(), request, agents, nil, nil)
+			details["status"] = report.Status
+			audit.Record(auditOutcome("fleet."+request.Name, c.ClientIP(), details, nil))
+			c.JSON(200, report)
+			return
+		}
+
+		// The fleet job outlives the request that started it
+		job := jobs.New(c.Request.Context(), "fleet")
+		jobs.Start(job)
+		details["job_id"] = job.ID
+		audit.Record(auditOutcome("fleet."+request.Name, c.ClientIP(), details, nil))
+		control := jobs.Control(job)
+		go func() {
+			defer control.Close()
+			cancelled := func() bool {
+				cancelled, _ := control.state()
+				return cancelled
+			}
+			update := func(report *FleetReport) {
+				jobs.SetResult(job, report)
+			}
+			report := runFleet(control.context(), request, agents, update, cancelled)
+			var err error
+			if report.Failed > 0 {
+				err = &fleetFailureError{Failed: report.Failed, Total: len(report.Hosts)}
+			}
+			jobs.Finish(job, report, summary, err)
+		}()
+		c.Header("X-Cosi-Job-Id", job.ID)
+		c.JSON(202, gin.H{"job_id": job.ID, "status_url": "/jobs/" + job.ID, "operation": request.Name, "targets": targets})
+	})
+}
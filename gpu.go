@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	pciDevicesDir = "/sys/bus/pci/devices"
+	kfdNodesDir   = "/sys/class/kfd/kfd/topology/nodes"
+
+	pciVendorNVIDIA = "10de"
+	pciVendorAMD    = "1002"
+)
+
+// PCI classes reported by GET /gpu: VGA compatible and 3D controllers
+var gpuClasses = map[string]string{"0300": "vga", "0302": "3d"}
+
+// A minimal PCI ID table covering GPU and accelerator vendors and the data center
+// parts we run. Unknown devices are reported with their IDs only.
+var pciVendors = map[string]string{
+	"10de": "NVIDIA Corporation",
+	"1002": "Advanced Micro Devices, Inc. [AMD/ATI]",
+	"8086": "Intel Corporation",
+	"1a03": "ASPEED Technology, Inc.",
+	"102b": "Matrox Electronics Systems Ltd.",
+	"1234": "QEMU",
+	"1af4": "Red Hat, Inc.",
+	"15ad": "VMware",
+	"1013": "Cirrus Logic",
+	"1d0f": "Amazon.com, Inc.",
+}
+
+var pciDevices = map[string]string{
+	"10de:1db1": "GV100GL [Tesla V100 SXM2 16GB]",
+	"10de:1db4": "GV100GL [Tesla V100 PCIe 16GB]",
+	"10de:1db6": "GV100GL [Tesla V100 PCIe 32GB]",
+	"10de:1eb8": "TU104GL [Tesla T4]",
+	"10de:20b0": "GA100 [A100 SXM4 40GB]",
+	"10de:20b2": "GA100 [A100 SXM4 80GB]",
+	"10de:20b5": "GA100 [A100 PCIe 80GB]",
+	"10de:20f1": "GA100 [A100 PCIe 40GB]",
+	"10de:2236": "GA102GL [A10]",
+	"10de:2237": "GA102GL [A10G]",
+	"10de:25b6": "GA107GL [A16]",
+	"10de:2235": "GA102GL [A40]",
+	"10de:26b5": "AD102GL [L40]",
+	"10de:26b9": "AD102GL [L40S]",
+	"10de:27b8": "AD104GL [L4]",
+	"10de:2330": "GH100 [H100 SXM5 80GB]",
+	"10de:2331": "GH100 [H100 PCIe]",
+	"10de:2335": "GH100 [H200 SXM 141GB]",
+	"1002:738c": "Arcturus GL-XL [Instinct MI100]",
+	"1002:7408": "Aldebaran [Instinct MI250X]",
+	"1002:740c": "Aldebaran [Instinct MI250X / MI250]",
+	"1002:740f": "Aldebaran [Instinct MI210]",
+	"1002:74a1": "Aqua Vanjaram [Instinct MI300X]",
+	"1a03:2000": "ASPEED Graphics Family",
+	"1234:1111": "Bochs/QEMU standard VGA",
+	"1af4:1050": "Virtio GPU",
+	"15ad:0405": "SVGA II Adapter",
+	"1013:00b8": "GD 5446",
+	"1d0f:1111": "EC2 VGA",
+}
+
+// GPUDevice is a display or compute device found on the PCI bus
+type GPUDevice struct {
+	Address  string `json:"address"` // PCI address, e.g. 0000:3b:00.0
+	Class    string `json:"class"`   // vga or 3d
+	VendorID string `json:"vendor_id"`
+	DeviceID string `json:"device_id"`
+	Vendor   string `json:"vendor,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Driver   string `json:"driver,omitempty"`
+	NUMANode *int   `json:"numa_node,omitempty"`
+	// Details from nvidia-smi, or from amdgpu's sysfs attributes
+	Model              string   `json:"model,omitempty"`
+	DriverVersion      string   `json:"driver_version,omitempty"`
+	MemoryTotalBytes   *uint64  `json:"memory_total_bytes,omitempty"`
+	MemoryUsedBytes    *uint64  `json:"memory_used_bytes,omitempty"`
+	UtilizationPercent *float64 `json:"utilization_percent,omitempty"`
+	TemperatureC       *float64 `json:"temperature_c,omitempty"`
+	ROCm               bool     `json:"rocm,omitempty"` // visible to the ROCm runtime through /dev/kfd
+	Error              string   `json:"error,omitempty"`
+}
+
+// GPUReport is the response of GET /gpu
+type GPUReport struct {
+	GPUs []GPUDevice `json:"gpus"`
+}
+
+// Function to find the GPUs on the PCI bus and add what the vendor tooling knows about them
+func collectGPUs(ctx context.Context) (*GPUReport, error) {
+	report := &GPUReport{GPUs: []GPUDevice{}}
+	entries, err := os.ReadDir(pciDevicesDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return report, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		dir := filepath.Join(pciDevicesDir, entry.Name())
+		class, err := readSysfsHex(dir, "class")
+		if err != nil || len(class) < 4 || gpuClasses[class[:4]] == "" {
+			continue
+		}
+		device := GPUDevice{Address: entry.Name(), Class: gpuClasses[class[:4]]}
+		device.VendorID, _ = readSysfsHex(dir, "vendor")
+		device.DeviceID, _ = readSysfsHex(dir, "device")
+		device.Vendor = pciVendors[device.VendorID]
+		device.Name = pciDevices[device.VendorID+":"+device.DeviceID]
+		if link, err := os.Readlink(filepath.Join(dir, "driver")); err == nil {
+			device.Driver = filepath.Base(link)
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "numa_node")); err == nil {
+			if node, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && node >= 0 {
+				device.NUMANode = &node
+			}
+		}
+		if device.Driver == "amdgpu" {
+			readAMDGPU(dir, &device)
+		}
+		report.GPUs = append(report.GPUs, device)
+	}
+
+	addNVIDIADetails(ctx, report.GPUs)
+	markROCmDevices(report.GPUs)
+	return report, nil
+}
+
+// Helper function to read a sysfs attribute such as "0x10de" as bare lowercase hex
+func readSysfsHex(dir, name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(string(data))), "0x"), nil
+}
+
+// Helper function to read a sysfs attribute holding a number
+func readSysfsUint(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// Function to read VRAM and load from the attributes the amdgpu driver exposes
+func readAMDGPU(dir string, device *GPUDevice) {
+	if total, err := readSysfsUint(filepath.Join(dir, "mem_info_vram_total")); err == nil {
+		device.MemoryTotalBytes = &total
+	}
+	if used, err := readSysfsUint(filepath.Join(dir, "mem_info_vram_used")); err == nil {
+		device.MemoryUsedBytes = &used
+	}
+	if busy, err := readSysfsUint(filepath.Join(dir, "gpu_busy_percent")); err == nil {
+		percent := float64(busy)
+		device.UtilizationPercent = &percent
+	}
+}
+
+// Function to fill in the NVIDIA devices from nvidia-smi. When it's missing the devices
+// are left as found on the bus; when it fails, typically because the driver and library
+// versions don't match, the error is reported on each NVIDIA device.
+func addNVIDIADetails(ctx context.Context, devices []GPUDevice) {
+	var nvidia []*GPUDevice
+	for i := range devices {
+		if devices[i].VendorID == pciVendorNVIDIA {
+			nvidia = append(nvidia, &devices[i])
+		}
+	}
+	if len(nvidia) == 0 {
+		return
+	}
+	if _, err := exec.LookPath("nvidia-smi"); err != nil {
+		return
+	}
+
+	cmd := newCommand("nvidia-smi", "--query-gpu=pci.bus_id,name,driver_version,memory.total,memory.used,utilization.gpu,temperature.gpu", "--format=csv,noheader,nounits")
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		message := strings.TrimSpace(result.Output)
+		if message == "" {
+			message = err.Error()
+		}
+		for _, device := range nvidia {
+			device.Error = "nvidia-smi: " + message
+		}
+		return
+	}
+
+	byAddress := map[string][]string{}
+	for _, line := range strings.Split(strings.TrimSpace(result.Stdout), "\n") {
+		fields := strings.Split(line, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if len(fields) == 7 {
+			byAddress[normalizePCIAddress(fields[0])] = fields
+		}
+	}
+	for _, device := range nvidia {
+		fields, ok := byAddress[normalizePCIAddress(device.Address)]
+		if !ok {
+			device.Error = "not reported by nvidia-smi"
+			continue
+		}
+		device.Model = fields[1]
+		device.DriverVersion = fields[2]
+		device.MemoryTotalBytes = parseMiB(fields[3])
+		device.MemoryUsedBytes = parseMiB(fields[4])
+		device.UtilizationPercent = parseOptionalFloat(fields[5])
+		device.TemperatureC = parseOptionalFloat(fields[6])
+	}
+}
+
+// Helper function to normalize a PCI address; nvidia-smi prints an eight digit
+// uppercase domain ("00000000:3B:00.0") where sysfs uses four lowercase digits
+func normalizePCIAddress(address string) string {
+	address = strings.ToLower(address)
+	domain, rest, ok := strings.Cut(address, ":")
+	if !ok {
+		return address
+	}
+	if n, err := strconv.ParseUint(domain, 16, 32); err == nil {
+		return fmt.Sprintf("%04x:%s", n, rest)
+	}
+	return address
+}
+
+// Helper function to convert a nvidia-smi value in MiB to bytes; "[N/A]" gives nil
+func parseMiB(value string) *uint64 {
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return nil
+	}
+	bytes := n << 20
+	return &bytes
+}
+
+// Helper function to parse a nvidia-smi number; "[N/A]" or "[Not Supported]" gives nil
+func parseOptionalFloat(value string) *float64 {
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil
+	}
+	return &n
+}
+
+// Function to mark the AMD devices listed in the KFD topology, which is what ROCm
+// enumerates. Nodes with gpu_id 0 are CPUs.
+func markROCmDevices(devices []GPUDevice) {
+	nodes, err := os.ReadDir(kfdNodesDir)
+	if err != nil {
+		return
+	}
+	for _, node := range nodes {
+		properties, err := os.ReadFile(filepath.Join(kfdNodesDir, node.Name(), "properties"))
+		if err != nil {
+			continue
+		}
+		values := map[string]uint64{}
+		for _, line := range strings.Split(string(properties), "\n") {
+			if fields := strings.Fields(line); len(fields) == 2 {
+				values[fields[0]], _ = strconv.ParseUint(fields[1], 10, 64)
+			}
+		}
+		if gpuID, err := readSysfsUint(filepath.Join(kfdNodesDir, node.Name(), "gpu_id")); err != nil || gpuID == 0 {
+			continue
+		}
+		// location_id packs bus, device and function as bus<<8 | device<<3 | function
+		location := values["location_id"]
+		address := fmt.Sprintf("%04x:%02x:%02x.%x", values["domain"], location>>8, (location>>3)&0x1f, location&0x7)
+		for i := range devices {
+			if devices[i].VendorID == pciVendorAMD && devices[i].Address == address {
+				devices[i].ROCm = true
+			}
+		}
+	}
+}
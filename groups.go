@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// ModuleSection changes the module streams of RPM hosts. Entries are module names or
+// name:stream specs, like nodejs:20.
+type ModuleSection struct {
+	Enable  []string `yaml:"enable,omitempty" json:"enable,omitempty"`
+	Disable []string `yaml:"disable,omitempty" json:"disable,omitempty"`
+	Reset   []string `yaml:"reset,omitempty" json:"reset,omitempty"`
+}
+
+// Helper function to check if the section has anything to do
+func (s ModuleSection) empty() bool {
+	return len(s.Enable) == 0 && len(s.Disable) == 0 && len(s.Reset) == 0
+}
+
+// groupManager is implemented by package managers with package groups and module streams
+type groupManager interface {
+	// GroupCommand installs or removes package groups, by name or ID
+	GroupCommand(action string, groups []string) *exec.Cmd
+	// ModuleCommand enables, disables, or resets module streams. It returns nil when the
+	// package manager has no modules.
+	ModuleCommand(action string, specs []string) *exec.Cmd
+	// InstalledGroups lists the names of the installed groups
+	InstalledGroups(ctx context.Context) ([]string, error)
+}
+
+// Helper function to move the @group entries of the package lists to the package_groups
+// section, keeping where they were in the manifest
+func (p *PackageConfig) routeGroupEntries() {
+	route := func(list string, entries *[]string, target *[]string, targetList string) {
+		paths := p.entryPaths(list, len(*entries))
+		var kept, keptPaths []string
+		for i, entry := range *entries {
+			if group, ok := strings.CutPrefix(entry, "@"); ok {
+				*target = append(*target, group)
+				p.paths[targetList] = append(p.paths[targetList], paths[i])
+				continue
+			}
+			kept = append(kept, entry)
+			keptPaths = append(keptPaths, paths[i])
+		}
+		*entries = kept
+		p.paths[list] = keptPaths
+	}
+	route("packages.installed", &p.Packages.Installed, &p.PackageGroups.Install, "package_groups.install")
+	route("packages.uninstalled", &p.Packages.Uninstalled, &p.PackageGroups.Remove, "package_groups.remove")
+}
+
+// Function to validate the package_groups and modules sections
+func (p PackageConfig) validateGroups() []ManifestProblem {
+	var problems []ManifestProblem
+	installPaths := p.entryPaths("package_groups.install", len(p.PackageGroups.Install))
+	removePaths := p.entryPaths("package_groups.remove", len(p.PackageGroups.Remove))
+	problems = append(problems, checkEntries(installPaths, p.PackageGroups.Install, nil)...)
+	problems = append(problems, checkEntries(removePaths, p.PackageGroups.Remove, nil)...)
+	problems = append(problems, checkConflicts(installPaths, removePaths, p.PackageGroups.Install, p.PackageGroups.Remove, nil)...)
+
+	for _, list := range []struct {
+		name    string
+		entries []string
+	}{
+		{"modules.enable", p.Modules.Enable},
+		{"modules.disable", p.Modules.Disable},
+		{"modules.reset", p.Modules.Reset},
+	} {
+		problems = append(problems, checkEntries(p.entryPaths(list.name, len(list.entries)), list.entries, validateModuleSpec)...)
+	}
+	return problems
+}
+
+// Module specs are name, name:stream, or name:stream/profile
+var moduleSpecPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*(:[A-Za-z0-9._+-]+)?(/[A-Za-z0-9._+-]+)?$`)
+
+func validateModuleSpec(spec string) error {
+	if !moduleSpecPattern.MatchString(spec) {
+		return fmt.Errorf("invalid module spec %q: must be name, name:stream, or name:stream/profile", spec)
+	}
+	return nil
+}
+
+// Function to change the module streams and then the package groups of a manifest, ahead
+// of its package lists. Package managers without groups skip the sections with a warning.
+// Callers must hold packageLock.
+func applyGroupSections(pm packageManager, config PackageConfig, result *PackageApplyResult, job *jobControl) error {
+	if config.PackageGroups.empty() && config.Modules.empty() {
+		return nil
+	}
+	manager, ok := pm.(groupManager)
+	if !ok {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("package_groups and modules are not applicable to %s; skipped them", pm.Name()))
+		return nil
+	}
+
+	steps := []struct {
+		action  string
+		entries []string
+		command func() *exec.Cmd
+	}{
+		// Streams are reset and disabled before others are enabled, so switching streams works in one manifest
+		{"module reset", config.Modules.Reset, func() *exec.Cmd { return manager.ModuleCommand("reset", config.Modules.Reset) }},
+		{"module disable", config.Modules.Disable, func() *exec.Cmd { return manager.ModuleCommand("disable", config.Modules.Disable) }},
+		{"module enable", config.Modules.Enable, func() *exec.Cmd { return manager.ModuleCommand("enable", config.Modules.Enable) }},
+		{"group install", config.PackageGroups.Install, func() *exec.Cmd { return manager.GroupCommand("install", config.PackageGroups.Install) }},
+		{"group remove", config.PackageGroups.Remove, func() *exec.Cmd { return manager.GroupCommand("remove", config.PackageGroups.Remove) }},
+	}
+	for _, step := range steps {
+		if len(step.entries) == 0 {
+			continue
+		}
+		cmd := step.command()
+		if cmd == nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s has no module streams; skipped %s of %s", pm.Name(), step.action, strings.Join(step.entries, ", ")))
+			continue
+		}
+		output, err := runJobCommand(cmd, job)
+		result.Steps = append(result.Steps, PackageStep{Manager: pm.Name(), Action: step.action, Target: strings.Join(step.entries, ", "), Result: output})
+		if err != nil {
+			result.FailedStep = step.action
+			return &commandError{Tool: commandTool(cmd), Result: output, Err: err}
+		}
+	}
+	return nil
+}
+
+func (m dnfManager) GroupCommand(action string, groups []string) *exec.Cmd {
+	return newPrivilegedCommand(nil, m.tool(), append([]string{"group", action, "-y"}, groups...)...)
+}
+
+func (m dnfManager) ModuleCommand(action string, specs []string) *exec.Cmd {
+	// Modules arrived with dnf; yum never had them
+	if m.Yum {
+		return nil
+	}
+	return newPrivilegedCommand(nil, "dnf", append([]string{"module", action, "-y"}, specs...)...)
+}
+
+// Columns of the dnf 5 group table are separated by runs of spaces
+var groupTableColumns = regexp.MustCompile(`\s{2,}`)
+
+// InstalledGroups reads the indented names under the "Installed ... Groups:" headings of
+// dnf 4 and yum, or the name column of the dnf 5 table
+func (m dnfManager) InstalledGroups(ctx context.Context) ([]string, error) {
+	cmd := newCommand("dnf", "group", "list", "--installed")
+	if m.Yum {
+		cmd = newCommand("yum", "group", "list", "installed")
+	}
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+
+	groups := []string{}
+	table := false
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		fields := groupTableColumns.Split(strings.TrimSpace(line), -1)
+		switch {
+		case strings.HasPrefix(line, "ID ") && len(fields) >= 2 && fields[1] == "Name":
+			table = true
+		case table && len(fields) >= 2:
+			groups = append(groups, fields[1])
+		case !table && strings.HasPrefix(line, " ") && strings.TrimSpace(line) != "":
+			groups = append(groups, strings.TrimSpace(line))
+		}
+	}
+	return groups, nil
+}
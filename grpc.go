@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rothgar/cosi/api/cosipb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Scope tokens need to call the gRPC API
+const scopeGRPC = "grpc"
+
+const (
+	// Interval at which progress streams look for new job output
+	grpcProgressInterval = 250 * time.Millisecond
+	// Most job output sent in one progress message
+	grpcOutputChunk = 32 << 10
+)
+
+// GRPCConfig enables the gRPC API, served next to the REST endpoints
+type GRPCConfig struct {
+	// Listen is the address of the gRPC API, like :9090; empty disables it
+	Listen string `yaml:"listen"`
+}
+
+// Function to validate the grpc section
+func (g GRPCConfig) validate() error {
+	if g.Listen == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(g.Listen); err != nil {
+		return fmt.Errorf("grpc.listen must be a host:port address: %v", err)
+	}
+	return nil
+}
+
+// grpcServer implements the Cosi service with the operations behind the REST endpoints
+type grpcServer struct {
+	cosipb.UnimplementedCosiServer
+}
+
+// Function to serve the gRPC API on the configured address until the agent exits
+func startGRPC(cfg GRPCConfig) error {
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := authorizeGRPC(ctx, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := authorizeGRPC(stream.Context(), info.FullMethod)
+			if err != nil {
+				return err
+			}
+			return handler(srv, &grpcServerStream{ServerStream: stream, ctx: ctx})
+		}),
+	)
+	cosipb.RegisterCosiServer(server, &grpcServer{})
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Printf("Warning: the gRPC API stopped: %v", err)
+		}
+	}()
+	log.Printf("Serving the gRPC API on %s", listener.Addr())
+	return nil
+}
+
+// grpcServerStream replaces the context of a stream with the authorized one
+type grpcServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *grpcServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// Function to check a call against the allowlist and its bearer token, the way
+// enforceAllowlist and requireScope check REST requests. The returned context carries
+// the call's request ID, taken from x-request-id metadata or generated.
+func authorizeGRPC(ctx context.Context, method string) (context.Context, error) {
+	client := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		client = p.Addr.String()
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+	}
+	cfg := currentConfig()
+	if len(cfg.Allowlist.prefixes) > 0 && !cfg.Allowlist.allows(client) {
+		deniedRequests.Add(1)
+		log.Printf("Denied gRPC %s from %s: address not in the allowlist", method, client)
+		return ctx, grpcError(403, gin.H{"error": "Requests from " + client + " are not allowed", "code": "address_not_allowed"})
+	}
+	if len(cfg.Auth.Tokens) == 0 {
+		return ctx, grpcError(403, gin.H{"error": "Authentication is not configured; add tokens to the auth section of the config", "code": "auth_not_configured"})
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	authorization := ""
+	if values := md.Get("authorization"); len(values) > 0 {
+		authorization = values[0]
+	}
+	token, ok := bearerToken(authorization)
+	if !ok {
+		events.Emit(Event{Type: "auth.failure", Message: "rejected a gRPC call without a valid token", Outcome: "failed", Details: map[string]interface{}{"client": client, "method": method}})
+		return ctx, grpcError(401, gin.H{"error": "A valid bearer token is required", "code": "unauthorized"})
+	}
+	if !token.allows(scopeGRPC) {
+		events.Emit(Event{Type: "auth.failure", Message: fmt.Sprintf("token %q lacks the %q scope", token.Name, scopeGRPC), Outcome: "failed", Details: map[string]interface{}{"client": client, "method": method, "token_name": token.Name}})
+		return ctx, grpcError(403, gin.H{"error": fmt.Sprintf("Token %q lacks the %q scope", token.Name, scopeGRPC), "code": "insufficient_scope"})
+	}
+
+	id := newID()
+	if values := md.Get("x-request-id"); len(values) > 0 && validRequestID(values[0]) {
+		id = values[0]
+	}
+	return context.WithValue(ctx, requestIDKey{}, id), nil
+}
+
+// Helper function to turn the REST response to a failure into a gRPC status. The
+// response's code is attached as the reason of an ErrorInfo detail.
+func grpcError(httpStatus int, response gin.H) error {
+	code := codes.Internal
+	switch httpStatus {
+	case 400, 413, 422:
+		code = codes.InvalidArgument
+	case 401:
+		code = codes.Unauthenticated
+	case 403:
+		code = codes.PermissionDenied
+	case 404:
+		code = codes.NotFound
+	case 409:
+		code = codes.Aborted
+	case 412:
+		code = codes.FailedPrecondition
+	case 429:
+		code = codes.ResourceExhausted
+	case 499:
+		code = codes.Canceled
+	case 501:
+		code = codes.Unimplemented
+	case 503:
+		code = codes.Unavailable
+	case 504:
+		code = codes.DeadlineExceeded
+	}
+	message, _ := response["error"].(string)
+	st := status.New(code, message)
+	if reason, _ := response["code"].(string); reason != "" {
+		if detailed, err := st.WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: "cosi"}); err == nil {
+			st = detailed
+		}
+	}
+	return st.Err()
+}
+
+// Helper function to report the error of an operation as a gRPC status
+func grpcFailure(message string, err error) error {
+	return grpcError(failureResponse(message, err))
+}
+
+// Helper function to read the wait_for_lock_seconds of a request, like lockWaitParam
+func grpcLockWait(seconds uint32) (time.Duration, error) {
+	wait := time.Duration(seconds) * time.Second
+	if wait > maxLockWait {
+		return 0, grpcError(400, gin.H{"error": fmt.Sprintf("wait_for_lock_seconds must be a number of seconds up to %d", int(maxLockWait.Seconds())), "code": "invalid_parameter"})
+	}
+	return wait, nil
+}
+
+func (s *grpcServer) GetOS(ctx context.Context, req *cosipb.GetOSRequest) (*cosipb.GetOSResponse, error) {
+	info, err := hostInfoCached.OS()
+	if err != nil {
+		return nil, grpcError(500, gin.H{"error": "Unable to read /etc/os-release file"})
+	}
+	return &cosipb.GetOSResponse{Fields: info.Fields}, nil
+}
+
+func (s *grpcServer) GetUname(ctx context.Context, req *cosipb.GetUnameRequest) (*cosipb.GetUnameResponse, error) {
+	info, err := hostInfoCached.Uname()
+	if err != nil {
+		return nil, grpcError(500, gin.H{"error": "Unable to get uname output"})
+	}
+	return &cosipb.GetUnameResponse{Fields: info.Fields}, nil
+}
+
+func (s *grpcServer) ListPackages(ctx context.Context, req *cosipb.ListPackagesRequest) (*cosipb.ListPackagesResponse, error) {
+	manager := req.Manager
+	if manager == "" {
+		manager = "system"
+	}
+	list, err := listPackages(ctx, manager, req.Groups)
+	if err != nil {
+		return nil, grpcFailure("Failed to get installed packages", err)
+	}
+	response := &cosipb.ListPackagesResponse{
+		InstalledPackages: list.InstalledPackages,
+		InstalledGroups:   list.InstalledGroups,
+		GroupsWarning:     list.GroupsWarning,
+		Warnings:          list.Warnings,
+	}
+	for _, packages := range [][]InstalledPackage{list.Packages, list.Snaps, list.Flatpaks} {
+		for _, p := range packages {
+			response.Packages = append(response.Packages, &cosipb.InstalledPackage{Name: p.Name, Manager: p.Manager, Version: p.Version, Channel: p.Channel})
+		}
+	}
+	return response, nil
+}
+
+func (s *grpcServer) GetKubernetesStatus(ctx context.Context, req *cosipb.GetKubernetesStatusRequest) (*cosipb.GetKubernetesStatusResponse, error) {
+	return &cosipb.GetKubernetesStatusResponse{Installed: checkKubernetesInstallation()}, nil
+}
+
+func (s *grpcServer) ApplyPackages(req *cosipb.ApplyPackagesRequest, stream cosipb.Cosi_ApplyPackagesServer) error {
+	if err := maintenance.Refusal(); err != nil {
+		return grpcFailure("", err)
+	}
+	lockWait, err := grpcLockWait(req.WaitForLockSeconds)
+	if err != nil {
+		return err
+	}
+	body, err := readManifestBody(bytes.NewReader(req.Manifest))
+	if err != nil {
+		var mErr *manifestError
+		if errors.As(err, &mErr) {
+			return grpcError(400, gin.H{"error": "Invalid manifest: " + mErr.Message, "code": mErr.Code})
+		}
+		return grpcError(400, gin.H{"error": "Unable to read the manifest: " + err.Error()})
+	}
+	packageConfig, source, err := loadManifest(body)
+	if err != nil {
+		return grpcFailure("Invalid manifest", err)
+	}
+	return streamJob(stream.Context(), stream.Send, "Failed to apply packages", func(ctx context.Context, started func(*Job)) (interface{}, *Job, error) {
+		return applyManifestJob(ctx, packageConfig, source, lockWait, started)
+	})
+}
+
+func (s *grpcServer) BootstrapKubernetes(req *cosipb.BootstrapKubernetesRequest, stream cosipb.Cosi_BootstrapKubernetesServer) error {
+	if err := maintenance.Refusal(); err != nil {
+		return grpcFailure("", err)
+	}
+	lockWait, err := grpcLockWait(req.WaitForLockSeconds)
+	if err != nil {
+		return err
+	}
+	return streamJob(stream.Context(), stream.Send, "Failed to install and bootstrap Kubernetes", func(ctx context.Context, started func(*Job)) (interface{}, *Job, error) {
+		return bootstrapKubernetesJob(ctx, lockWait, started)
+	})
+}
+
+// Function to run a job operation for a server-streaming RPC. It sends the job's ID once
+// the job exists, the job's output as it is written, and then the job's outcome with the
+// document the REST endpoint answers with. Failures end the stream with a gRPC status.
+func streamJob(ctx context.Context, send func(*cosipb.JobProgress) error, message string, run func(ctx context.Context, started func(*Job)) (interface{}, *Job, error)) error {
+	type outcome struct {
+		result interface{}
+		job    *Job
+		err    error
+	}
+	started := make(chan *Job, 1)
+	done := make(chan outcome, 1)
+	go func() {
+		result, job, err := run(ctx, func(job *Job) { started <- job })
+		done <- outcome{result, job, err}
+	}()
+
+	var output jobOutputFollower
+	// Sending stops once the client has gone away, but the operation runs to its end
+	var sendErr error
+	ticker := time.NewTicker(grpcProgressInterval)
+	defer ticker.Stop()
+	sendStarted := func(job *Job) {
+		output.id = job.ID
+		sendErr = send(&cosipb.JobProgress{Event: &cosipb.JobProgress_Started{Started: &cosipb.JobStarted{JobId: job.ID}}})
+	}
+	for {
+		select {
+		case job := <-started:
+			sendStarted(job)
+		case <-ticker.C:
+			if sendErr == nil {
+				sendErr = output.send(send)
+			}
+		case out := <-done:
+			if out.job == nil {
+				return grpcFailure(message, out.err)
+			}
+			// A job that ends quickly may not have been announced yet
+			if output.id == "" {
+				sendStarted(<-started)
+			}
+			if sendErr == nil {
+				sendErr = output.send(send)
+			}
+			httpStatus, body := 200, out.result
+			if out.err != nil {
+				httpStatus, body = failureResponse(message, out.err)
+			}
+			finished := &cosipb.JobFinished{JobId: out.job.ID}
+			if job, ok := jobs.Get(out.job.ID); ok {
+				finished.Status = job.Status
+			}
+			finished.Result, _ = json.Marshal(body)
+			if sendErr == nil {
+				sendErr = send(&cosipb.JobProgress{Event: &cosipb.JobProgress_Finished{Finished: finished}})
+			}
+			if out.err != nil {
+				return grpcError(httpStatus, body.(gin.H))
+			}
+			return sendErr
+		}
+	}
+}
+
+// jobOutputFollower sends the output of a job from where it last left off
+type jobOutputFollower struct {
+	id     string
+	offset int64
+}
+
+// Helper function to send the job output written since the last call
+func (f *jobOutputFollower) send(send func(*cosipb.JobProgress) error) error {
+	if f.id == "" {
+		return nil
+	}
+	job, ok := jobs.Get(f.id)
+	if !ok || job.OutputPath == "" {
+		return nil
+	}
+	file, err := os.Open(job.OutputPath)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	for {
+		chunk := make([]byte, grpcOutputChunk)
+		n, err := file.ReadAt(chunk, f.offset)
+		if n > 0 {
+			f.offset += int64(n)
+			if err := send(&cosipb.JobProgress{Event: &cosipb.JobProgress_Output{Output: chunk[:n]}}); err != nil {
+				return err
+			}
+		}
+		if err != nil || n < len(chunk) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	dmiDir        = "/sys/class/dmi/id"
+	deviceTreeDir = "/proc/device-tree"
+)
+
+// HardwareInfo identifies the machine for asset tracking. Fields that can't be read
+// with the agent's privileges are null and explained in Notes.
+type HardwareInfo struct {
+	Source          string            `json:"source"` // dmi, dmidecode, or device-tree
+	Vendor          *string           `json:"vendor"`
+	ProductName     *string           `json:"product_name"`
+	ProductVersion  *string           `json:"product_version"`
+	SerialNumber    *string           `json:"serial_number"`
+	UUID            *string           `json:"uuid"`
+	BoardVendor     *string           `json:"board_vendor"`
+	BoardName       *string           `json:"board_name"`
+	BoardSerial     *string           `json:"board_serial"`
+	BIOSVendor      *string           `json:"bios_vendor"`
+	BIOSVersion     *string           `json:"bios_version"`
+	BIOSDate        *string           `json:"bios_date"`
+	ChassisType     *string           `json:"chassis_type"`
+	ChassisAssetTag *string           `json:"chassis_asset_tag"`
+	Model           *string           `json:"model,omitempty"` // device tree model on boards without DMI
+	Virtualization  *string           `json:"virtualization"`  // VM technology, "none" on bare metal
+	Container       *string           `json:"container"`
+	Memory          *MemoryLayout     `json:"memory"`
+	Notes           map[string]string `json:"notes,omitempty"`
+}
+
+// MemoryLayout describes the DIMM slots reported by dmidecode
+type MemoryLayout struct {
+	Slots      int          `json:"slots"`
+	Populated  int          `json:"populated"`
+	TotalBytes uint64       `json:"total_bytes"`
+	Devices    []MemoryDIMM `json:"devices"`
+}
+
+// MemoryDIMM is one populated memory slot
+type MemoryDIMM struct {
+	Locator      string `json:"locator"`
+	Bank         string `json:"bank,omitempty"`
+	SizeBytes    uint64 `json:"size_bytes"`
+	Type         string `json:"type,omitempty"`
+	Speed        string `json:"speed,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	PartNumber   string `json:"part_number,omitempty"`
+}
+
+// dmiField maps a /sys/class/dmi/id attribute to its dmidecode -s keyword and JSON name
+type dmiField struct {
+	File    string
+	Keyword string
+	Name    string
+	Target  func(h *HardwareInfo) **string
+}
+
+var dmiFields = []dmiField{
+	{"sys_vendor", "system-manufacturer", "vendor", func(h *HardwareInfo) **string { return &h.Vendor }},
+	{"product_name", "system-product-name", "product_name", func(h *HardwareInfo) **string { return &h.ProductName }},
+	{"product_version", "system-version", "product_version", func(h *HardwareInfo) **string { return &h.ProductVersion }},
+	{"product_serial", "system-serial-number", "serial_number", func(h *HardwareInfo) **string { return &h.SerialNumber }},
+	{"product_uuid", "system-uuid", "uuid", func(h *HardwareInfo) **string { return &h.UUID }},
+	{"board_vendor", "baseboard-manufacturer", "board_vendor", func(h *HardwareInfo) **string { return &h.BoardVendor }},
+	{"board_name", "baseboard-product-name", "board_name", func(h *HardwareInfo) **string { return &h.BoardName }},
+	{"board_serial", "baseboard-serial-number", "board_serial", func(h *HardwareInfo) **string { return &h.BoardSerial }},
+	{"bios_vendor", "bios-vendor", "bios_vendor", func(h *HardwareInfo) **string { return &h.BIOSVendor }},
+	{"bios_version", "bios-version", "bios_version", func(h *HardwareInfo) **string { return &h.BIOSVersion }},
+	{"bios_date", "bios-release-date", "bios_date", func(h *HardwareInfo) **string { return &h.BIOSDate }},
+	{"chassis_asset_tag", "chassis-asset-tag", "chassis_asset_tag", func(h *HardwareInfo) **string { return &h.ChassisAssetTag }},
+}
+
+// Values firmware vendors leave in fields they never filled in
+var dmiPlaceholders = map[string]bool{
+	"to be filled by o.e.m.": true, "default string": true, "not specified": true, "not applicable": true,
+	"none": true, "system serial number": true, "system product name": true, "o.e.m.": true,
+	"0123456789": true, "00000000-0000-0000-0000-000000000000": true, "03000200-0400-0500-0006-000700080009": true,
+}
+
+// SMBIOS chassis types, indexed by the number in chassis_type
+var chassisTypes = []string{
+	"", "Other", "Unknown", "Desktop", "Low Profile Desktop", "Pizza Box", "Mini Tower", "Tower",
+	"Portable", "Laptop", "Notebook", "Hand Held", "Docking Station", "All in One", "Sub Notebook",
+	"Space-saving", "Lunch Box", "Main Server Chassis", "Expansion Chassis", "SubChassis",
+	"Bus Expansion Chassis", "Peripheral Chassis", "RAID Chassis", "Rack Mount Chassis", "Sealed-case PC",
+	"Multi-system", "CompactPCI", "AdvancedTCA", "Blade", "Blade Enclosure", "Tablet", "Convertible",
+	"Detachable", "IoT Gateway", "Embedded PC", "Mini PC", "Stick PC",
+}
+
+// Function to collect the hardware identity of the host
+func collectHardware(ctx context.Context) (*HardwareInfo, error) {
+	info := &HardwareInfo{Notes: map[string]string{}}
+
+	if _, err := os.Stat(dmiDir); err == nil {
+		info.Source = "dmi"
+		readDMI(ctx, info)
+	} else if model, err := readDeviceTreeString("model"); err == nil {
+		info.Source = "device-tree"
+		info.Model = &model
+		info.ProductName = &model
+		if serial, err := readDeviceTreeString("serial-number"); err == nil {
+			info.SerialNumber = &serial
+		}
+		if compatible, err := readDeviceTreeString("compatible"); err == nil {
+			if vendor, _, ok := strings.Cut(compatible, ","); ok {
+				info.Vendor = &vendor
+			}
+		}
+	} else {
+		info.Source = "none"
+		info.Notes["source"] = "no DMI tables or device tree model on this host"
+	}
+
+	info.Virtualization, info.Container = detectVirtualization(ctx, info.Notes)
+	if layout, note := memoryLayout(ctx); layout != nil {
+		info.Memory = layout
+	} else {
+		info.Notes["memory"] = note
+	}
+
+	if len(info.Notes) == 0 {
+		info.Notes = nil
+	}
+	return info, nil
+}
+
+// Function to read the DMI attributes from sysfs. The serial numbers and UUID are
+// only readable by root, so those come from dmidecode through sudo when allowed.
+func readDMI(ctx context.Context, info *HardwareInfo) {
+	dmidecode := !isRoot() && canRunPrivileged("dmidecode")
+	for _, field := range dmiFields {
+		value, err := readDMIFile(field.File)
+		if errors.Is(err, os.ErrPermission) && dmidecode {
+			value, err = dmidecodeString(ctx, field.Keyword)
+			if err == nil {
+				info.Source = "dmidecode"
+			}
+		}
+		switch {
+		case errors.Is(err, os.ErrPermission):
+			info.Notes[field.Name] = "requires root"
+		case errors.Is(err, os.ErrNotExist):
+			// Not reported by this firmware
+		case err != nil:
+			info.Notes[field.Name] = err.Error()
+		case dmiPlaceholders[strings.ToLower(value)] || value == "":
+			info.Notes[field.Name] = "firmware reports placeholder value " + strconv.Quote(value)
+		default:
+			*field.Target(info) = &value
+		}
+	}
+
+	if value, err := readDMIFile("chassis_type"); err == nil {
+		name := value
+		if n, err := strconv.Atoi(value); err == nil && n > 0 && n < len(chassisTypes) {
+			name = chassisTypes[n]
+		}
+		info.ChassisType = &name
+	}
+}
+
+// Helper function to read one DMI attribute
+func readDMIFile(name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dmiDir, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Helper function to read one string with `dmidecode -s`
+func dmidecodeString(ctx context.Context, keyword string) (string, error) {
+	output, err := outputTrackedContext(ctx, newPrivilegedCommand(nil, "dmidecode", "-s", keyword))
+	if err != nil {
+		return "", err
+	}
+	// Comment lines start with # when the table is only partially readable
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")), nil
+}
+
+// Helper function to read a device tree string property. Properties holding a list
+// separate the entries with NUL, so only the first one is returned.
+func readDeviceTreeString(name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(deviceTreeDir, name))
+	if err != nil {
+		return "", err
+	}
+	value, _, _ := strings.Cut(string(data), "\x00")
+	return strings.TrimSpace(value), nil
+}
+
+// Function to ask systemd-detect-virt for the VM and container technology.
+// It prints "none" and exits 1 when there is none.
+func detectVirtualization(ctx context.Context, notes map[string]string) (vm, container *string) {
+	if _, err := exec.LookPath("systemd-detect-virt"); err != nil {
+		notes["virtualization"] = "systemd-detect-virt is not installed"
+		return nil, nil
+	}
+	detect := func(flag string) *string {
+		output, _ := outputTrackedContext(ctx, newCommand("systemd-detect-virt", flag))
+		value := strings.TrimSpace(string(output))
+		if value == "" {
+			return nil
+		}
+		return &value
+	}
+	return detect("--vm"), detect("--container")
+}
+
+// Function to read the DIMM layout from `dmidecode -t 17`, returning why not when it can't
+func memoryLayout(ctx context.Context) (*MemoryLayout, string) {
+	if _, err := exec.LookPath("dmidecode"); err != nil {
+		return nil, "dmidecode is not installed"
+	}
+	if !canRunPrivileged("dmidecode") {
+		return nil, "requires root"
+	}
+	output, err := outputTrackedContext(ctx, newPrivilegedCommand(nil, "dmidecode", "-t", "17"))
+	if err != nil {
+		return nil, "dmidecode failed: " + err.Error()
+	}
+	layout := parseMemoryDevices(string(output))
+	if layout.Slots == 0 {
+		return nil, "no memory devices in the DMI tables"
+	}
+	return layout, ""
+}
+
+// Function to parse the "Memory Device" records printed by dmidecode
+func parseMemoryDevices(output string) *MemoryLayout {
+	layout := &MemoryLayout{Devices: []MemoryDIMM{}}
+	for _, record := range strings.Split(output, "\n\n") {
+		if !strings.Contains(record, "\nMemory Device") {
+			continue
+		}
+		layout.Slots++
+		values := map[string]string{}
+		for _, line := range strings.Split(record, "\n") {
+			if key, value, ok := strings.Cut(strings.TrimSpace(line), ":"); ok {
+				values[key] = strings.TrimSpace(value)
+			}
+		}
+		size := parseDMISize(values["Size"])
+		if size == 0 {
+			continue // "No Module Installed"
+		}
+		layout.Populated++
+		layout.TotalBytes += size
+		dimm := MemoryDIMM{
+			Locator:   values["Locator"],
+			Bank:      values["Bank Locator"],
+			SizeBytes: size,
+			Type:      values["Type"],
+			Speed:     values["Speed"],
+		}
+		for key, target := range map[string]*string{"Manufacturer": &dimm.Manufacturer, "Serial Number": &dimm.SerialNumber, "Part Number": &dimm.PartNumber} {
+			if value := values[key]; !dmiPlaceholders[strings.ToLower(value)] && value != "Unknown" {
+				*target = value
+			}
+		}
+		layout.Devices = append(layout.Devices, dimm)
+	}
+	return layout
+}
+
+// Helper function to convert a dmidecode size such as "16 GB" or "8192 MB" to bytes
+func parseDMISize(value string) uint64 {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return 0
+	}
+	n, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0
+	}
+	switch fields[1] {
+	case "kB", "KB":
+		return n << 10
+	case "MB":
+		return n << 20
+	case "GB":
+		return n << 30
+	case "TB":
+		return n << 40
+	}
+	return 0
+}
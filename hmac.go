@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rothgar/cosi/signing"
+)
+
+// How far a signed request's timestamp may be from the agent's clock by default
+const defaultHMACMaxSkew = 5 * time.Minute
+
+// HMACConfig enables signed requests, for networks where bearer tokens would travel
+// in cleartext. Requests are signed with the secret of one of the auth tokens; the
+// canonicalization is documented in the signing package.
+type HMACConfig struct {
+	// Required refuses every request that isn't signed
+	Required bool          `yaml:"required"`
+	MaxSkew  time.Duration `yaml:"max_skew"`
+}
+
+func (c HMACConfig) maxSkew() time.Duration {
+	return time.Duration(orDefault(int64(c.MaxSkew), int64(defaultHMACMaxSkew)))
+}
+
+// Function to check the signing settings
+func (c HMACConfig) validate(tokens []TokenConfig) error {
+	if c.MaxSkew < 0 {
+		return fmt.Errorf("auth.hmac.max_skew must not be negative")
+	}
+	if c.Required && len(tokens) == 0 {
+		return fmt.Errorf("auth.hmac.required needs auth tokens to sign requests with")
+	}
+	return nil
+}
+
+// seenSignatures remembers the signatures accepted within the skew window, so a
+// captured request can't be replayed while its timestamp is still acceptable
+type seenSignatures struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+var acceptedSignatures = &seenSignatures{seen: make(map[string]time.Time)}
+
+// Add records a signature until expiry and reports false when it was already used
+func (s *seenSignatures) Add(signature string, expiry time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for sig, until := range s.seen {
+		if now.After(until) {
+			delete(s.seen, sig)
+		}
+	}
+	if _, ok := s.seen[signature]; ok {
+		return false
+	}
+	s.seen[signature] = expiry
+	return true
+}
+
+// Middleware to verify signed requests. A valid signature authenticates the request
+// as the token that signed it; an invalid one is refused. Unsigned requests pass
+// unless auth.hmac.required is set.
+func verifySignature(c *gin.Context) {
+	cfg := currentConfig().Auth
+	signature := c.GetHeader(signing.HeaderSignature)
+	if signature == "" {
+		if cfg.HMAC.Required {
+			rejectSignature(c, "signature_required", "Requests must be signed with the X-Cosi-Key-Id, X-Cosi-Timestamp, and X-Cosi-Signature headers")
+			return
+		}
+		c.Next()
+		return
+	}
+
+	var token *TokenConfig
+	keyID := c.GetHeader(signing.HeaderKeyID)
+	for i := range cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(cfg.Tokens[i].Name), []byte(keyID)) == 1 {
+			token = &cfg.Tokens[i]
+		}
+	}
+	if token == nil {
+		rejectSignature(c, "invalid_signature", "Unknown signing key "+strconv.Quote(keyID))
+		return
+	}
+
+	timestamp := c.GetHeader(signing.HeaderTimestamp)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		rejectSignature(c, "invalid_timestamp", "X-Cosi-Timestamp must be Unix seconds")
+		return
+	}
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > cfg.HMAC.maxSkew() {
+		rejectSignature(c, "invalid_timestamp", fmt.Sprintf("X-Cosi-Timestamp is more than %s from the agent's clock", cfg.HMAC.maxSkew()))
+		return
+	}
+
+	bodyHash, cleanup, err := hashRequestBody(c)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.AbortWithStatusJSON(413, gin.H{"error": fmt.Sprintf("Request body is larger than the limit of %d bytes", maxBytesErr.Limit), "code": "body_too_large", "limit": maxBytesErr.Limit})
+			return
+		}
+		c.AbortWithStatusJSON(400, gin.H{"error": "Unable to read request body: " + err.Error()})
+		return
+	}
+	defer cleanup()
+	if !signing.VerifyBodyHash([]byte(token.Token), c.Request.Method, signing.Target(c.Request), timestamp, bodyHash, signature) {
+		rejectSignature(c, "invalid_signature", "The request signature does not match")
+		return
+	}
+	if !acceptedSignatures.Add(signature, time.Unix(seconds, 0).Add(cfg.HMAC.maxSkew())) {
+		rejectSignature(c, "replayed_signature", "The request signature was already used")
+		return
+	}
+	c.Set("signed_token", token)
+	c.Next()
+}
+
+// Helper function to refuse a request that failed signature checks
+func rejectSignature(c *gin.Context, code, message string) {
+	events.Emit(Event{Type: "auth.failure", Message: message, Outcome: "failed", Details: map[string]interface{}{"client": c.ClientIP(), "method": c.Request.Method, "path": c.Request.URL.Path, "code": code}})
+	c.AbortWithStatusJSON(401, gin.H{"error": message, "code": code})
+}
+
+// Helper function to hash the body of a signed request and leave it for the handler to
+// read. limitRequestBody has already read most bodies into memory, within their limit;
+// streamed ones are copied to an unlinked temporary file instead. cleanup closes it.
+func hashRequestBody(c *gin.Context) (string, func(), error) {
+	hash := sha256.New()
+	if c.Request.Body == nil {
+		return hex.EncodeToString(hash.Sum(nil)), func() {}, nil
+	}
+	if !streamedBodies[c.Request.Method+" "+c.FullPath()] {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			return "", nil, err
+		}
+		hash.Write(body)
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		return hex.EncodeToString(hash.Sum(nil)), func() {}, nil
+	}
+
+	spool, err := os.CreateTemp("", "cosi-body-")
+	if err != nil {
+		return "", nil, err
+	}
+	os.Remove(spool.Name())
+	if _, err := io.Copy(io.MultiWriter(spool, hash), c.Request.Body); err != nil {
+		spool.Close()
+		return "", nil, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		spool.Close()
+		return "", nil, err
+	}
+	c.Request.Body = spool
+	return hex.EncodeToString(hash.Sum(nil)), func() { spool.Close() }, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rothgar/cosi/signing"
+)
+
+// Helper function to give a test its own record of used signatures, so the same request
+// signed in another test within the same second isn't taken for a replay
+func withFreshSignatures(t *testing.T) {
+	t.Helper()
+	previous := acceptedSignatures
+	acceptedSignatures = &seenSignatures{seen: make(map[string]time.Time)}
+	t.Cleanup(func() { acceptedSignatures = previous })
+}
+
+// Helper function to build an engine checking signatures like the agent's, with an
+// endpoint that echoes the query and body it received and one that needs a scope
+func signedEngine(t *testing.T, required bool) *gin.Engine {
+	t.Helper()
+	withFreshSignatures(t)
+	withConfig(t, &Config{Auth: AuthConfig{
+		Tokens: []TokenConfig{{Name: "ci", Token: "node-secret", Scopes: []string{"things"}}},
+		HMAC:   HMACConfig{Required: required},
+	}})
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(limitRequestBody)
+	r.Use(verifySignature)
+	echo := func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.String(200, c.Request.URL.RawQuery+"|"+string(body))
+	}
+	r.GET("/events", echo)
+	r.POST("/echo", echo)
+	r.GET("/scoped", requireScope("things"), echo)
+	return r
+}
+
+// Helper function to sign and send a request, letting change alter it after signing
+func sendSigned(r http.Handler, method, target, body string, change func(*http.Request)) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	signing.SignRequest(req, "ci", []byte("node-secret"), time.Now())
+	if change != nil {
+		change(req)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestSignedQueryString(t *testing.T) {
+	r := signedEngine(t, false)
+
+	w := sendSigned(r, "GET", "/events?type=job&limit=5", "", nil)
+	if w.Code != 200 || w.Body.String() != "type=job&limit=5|" {
+		t.Fatalf("signed query = %d %s", w.Code, w.Body)
+	}
+	// Escapes are signed as sent
+	if w := sendSigned(r, "GET", "/events?path=%2Fetc%2Fhosts&q=a+b", "", nil); w.Code != 200 {
+		t.Errorf("signed escaped query = %d %s", w.Code, w.Body)
+	}
+
+	for name, change := range map[string]func(*http.Request){
+		"reordered":   func(req *http.Request) { req.URL.RawQuery = "limit=5&type=job" },
+		"changed":     func(req *http.Request) { req.URL.RawQuery = "type=job&limit=500" },
+		"dropped":     func(req *http.Request) { req.URL.RawQuery = "" },
+		"added":       func(req *http.Request) { req.URL.RawQuery += "&since=0" },
+		"re-escaped":  func(req *http.Request) { req.URL.RawQuery = "type=%6Aob&limit=5" },
+		"other path":  func(req *http.Request) { req.URL.Path = "/jobs" },
+		"bad":         func(req *http.Request) { req.Header.Set(signing.HeaderSignature, "00") },
+		"unknown key": func(req *http.Request) { req.Header.Set(signing.HeaderKeyID, "other") },
+	} {
+		w := sendSigned(r, "GET", "/events?type=job&limit=5", "", change)
+		if w.Code != 401 || !strings.Contains(w.Body.String(), "invalid_signature") {
+			t.Errorf("%s query = %d %s, want invalid_signature", name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestSignedEmptyBody(t *testing.T) {
+	r := signedEngine(t, false)
+
+	// No body, an empty body, and a body-less POST all sign the hash of nothing
+	if w := sendSigned(r, "GET", "/events", "", nil); w.Code != 200 || w.Body.String() != "|" {
+		t.Errorf("GET without a body = %d %s", w.Code, w.Body)
+	}
+	// (distinct queries, or the second would be a replay of the first)
+	if w := sendSigned(r, "POST", "/echo?empty", "", func(req *http.Request) { req.Body = http.NoBody }); w.Code != 200 {
+		t.Errorf("POST with an empty body = %d %s", w.Code, w.Body)
+	}
+	if w := sendSigned(r, "POST", "/echo?none", "", nil); w.Code != 200 {
+		t.Errorf("POST without a body = %d %s", w.Code, w.Body)
+	}
+
+	// The handler still reads the signed body
+	if w := sendSigned(r, "POST", "/echo", `{"a":1}`, nil); w.Code != 200 || w.Body.String() != `|{"a":1}` {
+		t.Errorf("POST with a body = %d %s", w.Code, w.Body)
+	}
+	// A body added to a request signed without one doesn't verify
+	w := sendSigned(r, "POST", "/echo", "", func(req *http.Request) {
+		req.Body = io.NopCloser(strings.NewReader("{}"))
+		req.ContentLength = 2
+	})
+	if w.Code != 401 {
+		t.Errorf("body added after signing = %d %s, want 401", w.Code, w.Body)
+	}
+}
+
+func TestSignatureReplayAndSkew(t *testing.T) {
+	r := signedEngine(t, false)
+
+	var signed *http.Request
+	w := sendSigned(r, "GET", "/events?replay=1", "", func(req *http.Request) { signed = req.Clone(req.Context()) })
+	if w.Code != 200 {
+		t.Fatalf("first use = %d %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, signed)
+	if w.Code != 401 || !strings.Contains(w.Body.String(), "replayed_signature") {
+		t.Errorf("replay = %d %s", w.Code, w.Body)
+	}
+
+	stale := func(req *http.Request) {
+		old := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+		req.Header.Set(signing.HeaderTimestamp, old)
+		req.Header.Set(signing.HeaderSignature, signing.Sign([]byte("node-secret"), "GET", "/events", old, nil))
+	}
+	if w := sendSigned(r, "GET", "/events", "", stale); w.Code != 401 || !strings.Contains(w.Body.String(), "invalid_timestamp") {
+		t.Errorf("stale timestamp = %d %s", w.Code, w.Body)
+	}
+}
+
+func TestSignatureAuthenticatesToken(t *testing.T) {
+	r := signedEngine(t, false)
+	if w := sendSigned(r, "GET", "/scoped", "", nil); w.Code != 200 {
+		t.Errorf("signed request to a scoped endpoint = %d %s", w.Code, w.Body)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/scoped", nil))
+	if w.Code != 401 {
+		t.Errorf("unsigned request to a scoped endpoint = %d", w.Code)
+	}
+
+	r = signedEngine(t, true)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/events", nil))
+	if w.Code != 401 || !strings.Contains(w.Body.String(), "signature_required") {
+		t.Errorf("unsigned request with auth.hmac.required = %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// File the kernel regenerates on every boot, so a new ID means a new kernel may be running
+var bootIDFile = "/proc/sys/kernel/random/boot_id"
+
+// File /os is read from
+var osReleaseFile = "/etc/os-release"
+
+// hostInfo is a cached /os or /uname result
+type hostInfo struct {
+	Fields      map[string]string
+	CollectedAt time.Time
+	key         string
+}
+
+// Response returns the fields with the time they were collected
+func (h *hostInfo) Response() map[string]string {
+	response := make(map[string]string, len(h.Fields)+1)
+	for key, value := range h.Fields {
+		response[key] = value
+	}
+	response["collected_at"] = h.CollectedAt.Format(time.RFC3339Nano)
+	return response
+}
+
+// hostInfoCache keeps /etc/os-release and the uname fields in memory. They only change on
+// an upgrade or a reboot, yet controllers ask for them on every reconcile. An entry is
+// collected again after POST /refresh, when the boot ID changes, and for /os when
+// /etc/os-release is rewritten; each check is a read of /proc or a stat.
+type hostInfoCache struct {
+	mu sync.Mutex
+	// Number of refreshes asked for through POST /refresh
+	refreshes uint64
+	os        *hostInfo
+	uname     *hostInfo
+}
+
+var hostInfoCached hostInfoCache
+
+// Helper function to read the boot ID, or "" when the kernel doesn't expose one
+func currentBootID() string {
+	data, err := os.ReadFile(bootIDFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Helper function to return the entry when it is current for key, collecting it again
+// otherwise. Callers must hold h.mu.
+func (h *hostInfoCache) get(entry **hostInfo, key string, collect func() (map[string]string, error)) (*hostInfo, error) {
+	if *entry != nil && (*entry).key == key {
+		return *entry, nil
+	}
+	fields, err := collect()
+	if err != nil {
+		return nil, err
+	}
+	*entry = &hostInfo{Fields: fields, CollectedAt: time.Now().UTC(), key: key}
+	return *entry, nil
+}
+
+// Helper function to return the key shared by both entries. Callers must hold h.mu.
+func (h *hostInfoCache) generation() string {
+	return currentBootID() + ":" + strconv.FormatUint(h.refreshes, 10)
+}
+
+// OS returns the parsed /etc/os-release
+func (h *hostInfoCache) OS() (*hostInfo, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stamp, _ := fileStamp(osReleaseFile)
+	return h.get(&h.os, h.generation()+":"+stamp, func() (map[string]string, error) {
+		return readOSReleaseFile(osReleaseFile)
+	})
+}
+
+// Uname returns the uname fields
+func (h *hostInfoCache) Uname() (*hostInfo, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.get(&h.uname, h.generation(), getUnameOutput)
+}
+
+// Refresh drops both entries and collects them again
+func (h *hostInfoCache) Refresh() (*hostInfo, *hostInfo, error) {
+	h.mu.Lock()
+	h.refreshes++
+	h.mu.Unlock()
+	osInfo, err := h.OS()
+	if err != nil {
+		return nil, nil, err
+	}
+	uname, err := h.Uname()
+	if err != nil {
+		return nil, nil, err
+	}
+	return osInfo, uname, nil
+}
+
+// Load collects both entries at startup so the first requests are served from memory
+func (h *hostInfoCache) Load() {
+	if _, err := h.OS(); err != nil {
+		log.Printf("Warning: unable to read /etc/os-release: %v", err)
+	}
+	if _, err := h.Uname(); err != nil {
+		log.Printf("Warning: unable to collect the uname fields: %v", err)
+	}
+}
+
+// Function to register the /os, /uname and /refresh endpoints
+func registerHostInfoRoutes(r *gin.Engine) {
+	// Define the /os endpoint, served from memory. Its ETag follows the cached copy so
+	// polling clients get a 304 until /etc/os-release is read again.
+	r.GET("/os", func(c *gin.Context) {
+		info, err := hostInfoCached.OS()
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Unable to read /etc/os-release file"})
+			return
+		}
+		if notModified(c, entityTag("os", info.CollectedAt.Format(time.RFC3339Nano)), info.CollectedAt) {
+			return
+		}
+		c.JSON(200, info.Response())
+	})
+
+	// Define the /uname endpoint, served from memory until the next boot
+	r.GET("/uname", func(c *gin.Context) {
+		info, err := hostInfoCached.Uname()
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Unable to get uname output"})
+			return
+		}
+		c.JSON(200, info.Response())
+	})
+
+	// Define the /refresh endpoint that reads /etc/os-release and the uname fields again
+	// instead of waiting for the next boot
+	r.POST("/refresh", func(c *gin.Context) {
+		osInfo, uname, err := hostInfoCached.Refresh()
+		if err != nil {
+			respondFailure(c, "Failed to collect the host information", err)
+			return
+		}
+		c.JSON(200, gin.H{"os": osInfo.Response(), "uname": uname.Response()})
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Helper function to point the host info cache at a temporary os-release and boot ID,
+// with a stub uname that counts its runs. It returns the three paths.
+func withHostInfo(t *testing.T) (osRelease, bootID, unameRuns string) {
+	t.Helper()
+	dir := t.TempDir()
+	osRelease = filepath.Join(dir, "os-release")
+	bootID = filepath.Join(dir, "boot_id")
+	unameRuns = filepath.Join(dir, "uname-runs")
+	writeHostFile(t, osRelease, "ID=ubuntu\nVERSION_ID=\"22.04\"\n")
+	writeHostFile(t, bootID, "6f1c2b9e-2d4a-4f7e-9a63-1b0c5d8e7f21\n")
+	fakeCommand(t, "uname", `printf '%s\n' "$1" >> `+unameRuns+`
+case "$1" in
+-s) echo Linux ;;
+-r) echo 6.5.0-1017-aws ;;
+*) echo unknown ;;
+esac`)
+
+	previousOSRelease, previousBootID := osReleaseFile, bootIDFile
+	osReleaseFile, bootIDFile = osRelease, bootID
+	hostInfoCached.mu.Lock()
+	previous := [2]*hostInfo{hostInfoCached.os, hostInfoCached.uname}
+	hostInfoCached.os, hostInfoCached.uname = nil, nil
+	hostInfoCached.mu.Unlock()
+	t.Cleanup(func() {
+		osReleaseFile, bootIDFile = previousOSRelease, previousBootID
+		hostInfoCached.mu.Lock()
+		hostInfoCached.os, hostInfoCached.uname = previous[0], previous[1]
+		hostInfoCached.mu.Unlock()
+	})
+	return osRelease, bootID, unameRuns
+}
+
+// Helper function to write a test file
+func writeHostFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Helper function to count the collections of the uname fields, each of which runs
+// uname once per field
+func unameCollections(t *testing.T, unameRuns string) int {
+	t.Helper()
+	data, err := os.ReadFile(unameRuns)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\n") / 8
+}
+
+func TestHostInfoCache(t *testing.T) {
+	osRelease, bootID, unameRuns := withHostInfo(t)
+	h := &hostInfoCached
+
+	first, err := h.OS()
+	if err != nil || first.Fields["ID"] != "ubuntu" || first.Fields["VERSION_ID"] != "22.04" {
+		t.Fatalf("OS = %+v, %v", first, err)
+	}
+	uname, err := h.Uname()
+	if err != nil || uname.Fields["kernel_release"] != "6.5.0-1017-aws" || unameCollections(t, unameRuns) != 1 {
+		t.Fatalf("Uname = %+v, %v", uname, err)
+	}
+
+	// Later calls are served from memory
+	if again, _ := h.OS(); again != first {
+		t.Error("OS was collected again without a change")
+	}
+	if again, _ := h.Uname(); again != uname || unameCollections(t, unameRuns) != 1 {
+		t.Error("Uname was collected again without a change")
+	}
+
+	// An upgrade rewrites /etc/os-release, which /os notices without waiting for a reboot
+	writeHostFile(t, osRelease, "ID=ubuntu\nVERSION_ID=\"24.04\"\n")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(osRelease, later, later); err != nil {
+		t.Fatal(err)
+	}
+	upgraded, err := h.OS()
+	if err != nil || upgraded == first || upgraded.Fields["VERSION_ID"] != "24.04" {
+		t.Errorf("OS after an upgrade = %+v, %v", upgraded, err)
+	}
+	if again, _ := h.Uname(); again != uname {
+		t.Error("rewriting /etc/os-release collected the uname fields again")
+	}
+
+	// A reboot changes the boot ID, which drops both entries
+	writeHostFile(t, bootID, "0a9d3e4f-5b6c-4d7e-8f90-a1b2c3d4e5f6\n")
+	if again, _ := h.OS(); again == upgraded {
+		t.Error("OS wasn't collected again after a reboot")
+	}
+	if again, _ := h.Uname(); again == uname || unameCollections(t, unameRuns) != 2 {
+		t.Error("Uname wasn't collected again after a reboot")
+	}
+
+	// So does a refresh
+	osInfo, refreshed, err := h.Refresh()
+	if err != nil || osInfo.Fields["VERSION_ID"] != "24.04" || unameCollections(t, unameRuns) != 3 {
+		t.Errorf("Refresh = %+v, %+v, %v", osInfo, refreshed, err)
+	}
+}
+
+func TestHostInfoRoutes(t *testing.T) {
+	osRelease, _, unameRuns := withHostInfo(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerHostInfoRoutes(r)
+
+	w := serveWithToken(r, "GET", "/os", "", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != 200 || etag == "" || !strings.Contains(w.Body.String(), `"VERSION_ID":"22.04"`) || !strings.Contains(w.Body.String(), `"collected_at"`) {
+		t.Fatalf("GET /os = %d %s", w.Code, w.Body)
+	}
+	// A controller polling with the tag gets a 304 until the file is read again
+	req := httptest.NewRequest("GET", "/os", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 304 {
+		t.Errorf("conditional GET /os = %d, want 304", w.Code)
+	}
+	writeHostFile(t, osRelease, "ID=ubuntu\nVERSION_ID=\"24.04\"\n")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(osRelease, later, later); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 200 || w.Header().Get("ETag") == etag || !strings.Contains(w.Body.String(), `"VERSION_ID":"24.04"`) {
+		t.Errorf("conditional GET /os after an upgrade = %d %s", w.Code, w.Body)
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := serveWithToken(r, "GET", "/uname", "", ""); w.Code != 200 || !strings.Contains(w.Body.String(), `"kernel_name":"Linux"`) {
+			t.Fatalf("GET /uname = %d %s", w.Code, w.Body)
+		}
+	}
+	if n := unameCollections(t, unameRuns); n != 1 {
+		t.Errorf("three GET /uname collected the fields %d times, want once", n)
+	}
+	if w := serveWithToken(r, "POST", "/refresh", "", ""); w.Code != 200 || unameCollections(t, unameRuns) != 2 {
+		t.Errorf("POST /refresh = %d %s", w.Code, w.Body)
+	}
+}
+
+// Compare reading the host info on every request, as /os and /uname used to, with
+// serving it from memory
+func BenchmarkHostInfo(b *testing.B) {
+	b.Run("os/uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := readOSReleaseFile("/etc/os-release"); err != nil {
+				b.Skip(err)
+			}
+		}
+	})
+	b.Run("os/cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := hostInfoCached.OS(); err != nil {
+				b.Skip(err)
+			}
+		}
+	})
+	b.Run("uname/uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := getUnameOutput(); err != nil {
+				b.Skip(err)
+			}
+		}
+	})
+	b.Run("uname/cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := hostInfoCached.Uname(); err != nil {
+				b.Skip(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rothgar/cosi/api"
+)
+
+const (
+	// Most of a response body an HTTP probe reads and searches
+	maxHTTPProbeBytes = 1 << 20
+	// Redirects an HTTP probe follows when asked to
+	maxHTTPProbeRedirects = 5
+)
+
+// Networks POST /probe/http may reach unless network.http_probe_networks lists others:
+// loopback, link-local, and the private ranges of RFC 1918 and RFC 4193
+var defaultHTTPProbeNetworks = []string{
+	"127.0.0.0/8", "::1/128",
+	"169.254.0.0/16", "fe80::/10",
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+}
+
+// Methods an HTTP probe may use; probes never send a body
+var httpProbeMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+// HTTPProbe checks that a service answers over HTTP as expected. It is the body of
+// POST /probe/http.
+type HTTPProbe struct {
+	URL    string `json:"url" yaml:"url"`
+	Method string `json:"method,omitempty" yaml:"method,omitempty"`
+	// ExpectedStatus is the status the service must answer with; by default any 2xx or
+	// 3xx status matches
+	ExpectedStatus int `json:"expected_status,omitempty" yaml:"expected_status,omitempty"`
+	// ExpectedBodySubstring must appear in the first megabyte of the body when set
+	ExpectedBodySubstring string `json:"expected_body_substring,omitempty" yaml:"expected_body_substring,omitempty"`
+	TimeoutMS             int    `json:"timeout_ms,omitempty" yaml:"timeout_ms,omitempty"`
+	TLSSkipVerify         bool   `json:"tls_skip_verify,omitempty" yaml:"tls_skip_verify,omitempty"`
+	FollowRedirects       bool   `json:"follow_redirects,omitempty" yaml:"follow_redirects,omitempty"`
+}
+
+// Function to validate an HTTP probe and fill in the default method
+func (p *HTTPProbe) validate() error {
+	u, err := url.Parse(p.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	p.Method = strings.ToUpper(p.Method)
+	if p.Method == "" {
+		p.Method = http.MethodGet
+	}
+	if !containsString(httpProbeMethods, p.Method) {
+		return fmt.Errorf("method must be one of %s", strings.Join(httpProbeMethods, ", "))
+	}
+	if p.ExpectedStatus != 0 && (p.ExpectedStatus < 100 || p.ExpectedStatus > 599) {
+		return fmt.Errorf("expected_status must be an HTTP status between 100 and 599")
+	}
+	if p.TimeoutMS < 0 || time.Duration(p.TimeoutMS)*time.Millisecond > maxProbeTimeout {
+		return fmt.Errorf("timeout_ms must be between 0 and %d", maxProbeTimeout.Milliseconds())
+	}
+	return nil
+}
+
+// HTTPProbeResult is the outcome of an HTTP probe. Matched is set when the service
+// answered and met every expectation; Error says why it couldn't be asked.
+type HTTPProbeResult = api.HTTPProbeResult
+
+// Function to build the address check of the HTTP probes from the configured networks.
+// The metadata services stay out of reach even inside the link-local range unless
+// network.allow_link_local is set.
+func (n NetworkConfig) httpProbeCheck() func(net.IP) error {
+	networks := n.HTTPProbeNetworks
+	if len(networks) == 0 {
+		networks = defaultHTTPProbeNetworks
+	}
+	var allowed []*net.IPNet
+	for _, cidr := range networks {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			allowed = append(allowed, network)
+		}
+	}
+	return func(ip net.IP) error {
+		if ip == nil {
+			return nil
+		}
+		if !n.AllowLinkLocal && containsIP(metadataAddresses, ip) {
+			return &forbiddenAddressError{Address: ip}
+		}
+		for _, network := range allowed {
+			if network.Contains(ip) {
+				return nil
+			}
+		}
+		return &outsideNetworksError{Address: ip}
+	}
+}
+
+// Helper function to check if ips holds ip
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, candidate := range ips {
+		if candidate.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// outsideNetworksError reports an HTTP probe of an address outside the networks it may reach
+type outsideNetworksError struct {
+	Address net.IP
+}
+
+func (e *outsideNetworksError) Error() string {
+	return fmt.Sprintf("%s is outside the networks HTTP probes may reach; see network.http_probe_networks", e.Address)
+}
+
+// Function to run an HTTP probe, with check deciding which addresses it may connect to.
+// A probe that reaches no service, or an unexpected one, is reported in the result; the
+// error is only set when check refused the address.
+func runHTTPProbe(ctx context.Context, probe HTTPProbe, check func(net.IP) error) (*HTTPProbeResult, error) {
+	timeout := defaultProbeTimeout
+	if probe.TimeoutMS > 0 {
+		timeout = time.Duration(probe.TimeoutMS) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result := &HTTPProbeResult{URL: probe.URL, Method: probe.Method}
+	redirects := 0
+	if probe.FollowRedirects {
+		redirects = maxHTTPProbeRedirects
+	}
+	client := probeClient(check, &tls.Config{InsecureSkipVerify: probe.TLSSkipVerify}, redirects)
+	request, err := http.NewRequestWithContext(ctx, probe.Method, probe.URL, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	request.Header.Set("User-Agent", "cosi/"+version)
+
+	started := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		var forbidden *forbiddenAddressError
+		var outside *outsideNetworksError
+		if errors.As(err, &forbidden) {
+			return nil, forbidden
+		}
+		if errors.As(err, &outside) {
+			return nil, outside
+		}
+		result.Error = err.Error()
+		return result, nil
+	}
+	defer response.Body.Close()
+	result.LatencyMS = milliseconds(time.Since(started))
+	result.StatusCode = response.StatusCode
+	if response.TLS != nil && len(response.TLS.PeerCertificates) > 0 {
+		expires := response.TLS.PeerCertificates[0].NotAfter.UTC()
+		result.TLSExpiresAt = &expires
+	}
+
+	// One byte past the limit tells a truncated body from one that fits exactly
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxHTTPProbeBytes+1))
+	if len(body) > maxHTTPProbeBytes {
+		body, result.Truncated = body[:maxHTTPProbeBytes], true
+	}
+	result.SizeBytes = int64(len(body))
+	if err != nil {
+		result.Error = "reading the body: " + err.Error()
+	}
+
+	if probe.ExpectedStatus != 0 {
+		result.StatusMatched = response.StatusCode == probe.ExpectedStatus
+	} else {
+		result.StatusMatched = response.StatusCode >= 200 && response.StatusCode < 400
+	}
+	result.Matched = result.StatusMatched && err == nil
+	if probe.ExpectedBodySubstring != "" {
+		matched := bytes.Contains(body, []byte(probe.ExpectedBodySubstring))
+		result.BodyMatched = &matched
+		result.Matched = result.Matched && matched
+	}
+	return result, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// The agent's own ID, generated on first start and kept in the state directory
+	instanceID string
+	// instanceIDPersisted is false when the state directory couldn't be written, in
+	// which case the ID changes on every start
+	instanceIDPersisted bool
+)
+
+var machineIDFormat = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Identity is the response of GET /identity
+type Identity struct {
+	MachineID           string  `json:"machine_id"`
+	MachineIDSuspect    bool    `json:"machine_id_suspect"`
+	MachineIDReason     string  `json:"machine_id_reason,omitempty"`
+	ProductUUID         *string `json:"product_uuid"`
+	ProductUUIDNote     string  `json:"product_uuid_note,omitempty"`
+	Hostname            string  `json:"hostname"`
+	InstanceID          string  `json:"instance_id"`
+	InstanceIDPersisted bool    `json:"instance_id_persisted"`
+	BootID              string  `json:"boot_id"`
+	// Fingerprint is a SHA-256 over the machine-id, product UUID, and instance ID,
+	// which stay the same across reboots and hostname changes
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Function to load the instance ID from the state directory, creating it on first start
+func loadInstanceID() {
+	path := filepath.Join(stateDir, "instance-id")
+	if data, err := os.ReadFile(path); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			instanceID, instanceIDPersisted = id, true
+			return
+		}
+	}
+
+	instanceID = newUUID()
+	if err := writeStateFile(path, []byte(instanceID+"\n")); err != nil {
+		log.Printf("Warning: unable to persist the instance ID, it will change on restart: %v", err)
+		return
+	}
+	instanceIDPersisted = true
+}
+
+// Helper function to write a file in the state directory atomically
+func writeStateFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Helper function to generate a random version 4 UUID
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Function to gather the identifiers of this machine
+func collectIdentity() *Identity {
+	identity := &Identity{
+		MachineID:           machineID(),
+		InstanceID:          instanceID,
+		InstanceIDPersisted: instanceIDPersisted,
+	}
+	identity.MachineIDReason = suspectMachineID(identity.MachineID)
+	identity.MachineIDSuspect = identity.MachineIDReason != ""
+
+	uuid, err := readDMIFile("product_uuid")
+	switch {
+	case os.IsPermission(err):
+		identity.ProductUUIDNote = "requires root"
+	case os.IsNotExist(err):
+		identity.ProductUUIDNote = "no DMI product UUID on this host"
+	case err != nil:
+		identity.ProductUUIDNote = err.Error()
+	default:
+		uuid = strings.ToLower(uuid)
+		identity.ProductUUID = &uuid
+	}
+
+	identity.Hostname, _ = os.Hostname()
+	if data, err := os.ReadFile("/proc/sys/kernel/random/boot_id"); err == nil {
+		identity.BootID = strings.TrimSpace(string(data))
+	}
+
+	productUUID := ""
+	if identity.ProductUUID != nil {
+		productUUID = *identity.ProductUUID
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{identity.MachineID, productUUID, identity.InstanceID}, "\n")))
+	identity.Fingerprint = "sha256:" + hex.EncodeToString(sum[:])
+	return identity
+}
+
+// Function to explain why a machine-id can't be trusted to be unique, empty when it can.
+// Images built without clearing it leave every clone with the same ID.
+func suspectMachineID(id string) string {
+	switch {
+	case id == "":
+		return "machine-id is empty or missing"
+	case id == "uninitialized":
+		return "machine-id was never initialized"
+	case !machineIDFormat.MatchString(id):
+		return "machine-id is not 32 lowercase hex characters"
+	case strings.Count(id, id[:1]) == len(id):
+		return "machine-id is a placeholder value"
+	}
+	// D-Bus keeps its own copy, which cloning tools sometimes regenerate separately
+	if data, err := os.ReadFile("/var/lib/dbus/machine-id"); err == nil {
+		if dbus := strings.TrimSpace(string(data)); dbus != "" && dbus != id {
+			return "machine-id differs from /var/lib/dbus/machine-id"
+		}
+	}
+	return ""
+}
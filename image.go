@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Marker rpm-ostree and ostree systems create at boot
+const ostreeBootedFile = "/run/ostree-booted"
+
+// os-release IDs and VARIANT_IDs of image-based operating systems, whose packages are
+// part of a read-only OS image that is replaced as a whole on update
+var imageBasedIDs = map[string]bool{
+	"bottlerocket": true,
+	"flatcar":      true,
+	"cos":          true, // Container-Optimized OS
+	"talos":        true,
+	"rhcos":        true,
+	"coreos":       true, // VARIANT_ID of Fedora CoreOS
+	"iot":          true, // VARIANT_ID of Fedora IoT
+}
+
+// Function to check if os-release describes an image-based OS. ostree hosts whose
+// os-release doesn't say so are recognized by the ostree marker.
+func imageBasedOS(osRelease map[string]string) bool {
+	if imageBasedIDs[osRelease["ID"]] || imageBasedIDs[osRelease["VARIANT_ID"]] {
+		return true
+	}
+	_, err := os.Stat(ostreeBootedFile)
+	return err == nil
+}
+
+// imageManager stands in for the package manager of an image-based OS. Packages are
+// listed from the rpm database when the image has one, and can't be changed.
+type imageManager struct {
+	// OS is the NAME of the OS, for messages
+	OS string
+}
+
+func (imageManager) Name() string { return "image" }
+
+func (imageManager) PrivilegedTools() []string { return nil }
+
+func (m imageManager) ReadOnly() (string, string) {
+	name := m.OS
+	if name == "" {
+		name = "This host"
+	}
+	return "immutable_os", name + " is an image-based OS: its packages are part of the OS image and only change when the image is updated"
+}
+
+func (imageManager) InstallCommand(config PackageConfig) *exec.Cmd { return nil }
+
+func (imageManager) RemoveCommand(config PackageConfig) *exec.Cmd { return nil }
+
+// ListCommand and VersionsCommand are unused; InstalledVersions copes with images
+// that have no package database
+func (imageManager) ListCommand() *exec.Cmd {
+	return newCommand("rpm", "-qa", "--qf", "%{NAME}\n")
+}
+
+func (imageManager) DatabasePaths() []string {
+	return []string{"/usr/share/rpm/rpmdb.sqlite", "/usr/lib/sysimage/rpm/rpmdb.sqlite"}
+}
+
+func (imageManager) RefreshCommand() *exec.Cmd { return nil }
+
+func (imageManager) RepairCommands() []*exec.Cmd { return nil }
+
+func (imageManager) ManualCommand() *exec.Cmd {
+	return newCommand("rpm", "-qa", "--qf", "%{NAME}\n")
+}
+
+func (imageManager) VersionsCommand() *exec.Cmd {
+	return newCommand("rpm", "-qa", "--qf", "%{NAME} %{VERSION}-%{RELEASE} installed\n")
+}
+
+func (imageManager) PinnedSpec(name, version string) string {
+	return name + "-" + version
+}
+
+func (imageManager) ParseSpec(spec string) (string, string) {
+	return parseRPMSpec(spec)
+}
+
+func (m imageManager) Candidates(ctx context.Context, names []string) (map[string]string, error) {
+	return nil, checkWritable(m)
+}
+
+func (m imageManager) AvailableVersions(ctx context.Context, names []string) (map[string][]string, error) {
+	return nil, checkWritable(m)
+}
+
+// InstalledVersions reads the rpm database of rpm-ostree images. Images without one,
+// like Flatcar and Bottlerocket, have no packages to list.
+func (imageManager) InstalledVersions(ctx context.Context) (map[string]string, error) {
+	versions := make(map[string]string)
+	if _, err := exec.LookPath("rpm"); err != nil {
+		return versions, nil
+	}
+	cmd := newCommand("rpm", "-qa", "--qf", "%{NAME} %{VERSION}-%{RELEASE}\n")
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		if name, version, ok := strings.Cut(line, " "); ok {
+			versions[name] = version
+		}
+	}
+	return versions, nil
+}
+
+// InstalledKernels lists the module directories of the image
+func (imageManager) InstalledKernels(ctx context.Context) ([]string, error) {
+	return moduleKernels()
+}
+
+// CheckReboot reports a staged deployment on ostree hosts, which takes effect on reboot
+func (imageManager) CheckReboot(ctx context.Context, status *RebootStatus) error {
+	if _, err := exec.LookPath("rpm-ostree"); err != nil {
+		return nil
+	}
+	result, err := runCommandContext(ctx, newCommand("rpm-ostree", "status", "--pending-exit-77"))
+	if err != nil && result.ExitCode == 77 {
+		status.addReason("packages", "rpm-ostree has a pending deployment")
+	}
+	return nil
+}
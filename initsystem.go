@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Time `systemctl is-system-running` gets to answer; without D-Bus it can hang until
+// its own timeout
+var systemctlProbeTimeout = 5 * time.Second
+
+// States `systemctl is-system-running` reports when systemd manages the host and answers
+var systemdManagerStates = map[string]bool{
+	"initializing": true,
+	"starting":     true,
+	"running":      true,
+	"degraded":     true,
+	"maintenance":  true,
+	"stopping":     true,
+}
+
+// InitSystem describes the init system of the host and whether the agent can use systemd
+type InitSystem struct {
+	// Name is systemd, sysvinit, openrc, runit, s6, or unknown
+	Name string `json:"name"`
+	// PID1 is the command name of PID 1, like tini or bash in a container
+	PID1 string `json:"pid1"`
+	// Systemctl is set when systemctl is installed, which it often is in containers
+	// without systemd
+	Systemctl bool `json:"systemctl"`
+	// State is what `systemctl is-system-running` printed, like running or offline
+	State string `json:"state,omitempty"`
+	// Systemd is set when systemd is PID 1 and answers systemctl
+	Systemd bool `json:"systemd"`
+	// ServiceCommand is set when the SysV service wrapper is installed
+	ServiceCommand bool `json:"service_command"`
+	// Reason explains why systemd can't be used
+	Reason string `json:"reason,omitempty"`
+}
+
+// Helper function to describe the init system for error messages
+func (i InitSystem) describe() string {
+	if i.Name == "unknown" {
+		return "the init system is unknown (PID 1 is " + i.PID1 + ")"
+	}
+	return "the init system is " + i.Name
+}
+
+// Helper function to name the init system from the command of PID 1
+func initSystemName(pid1 string) string {
+	switch pid1 {
+	case "systemd":
+		return "systemd"
+	case "openrc-init":
+		return "openrc"
+	case "runit", "runsvdir":
+		return "runit"
+	case "s6-svscan":
+		return "s6"
+	case "init":
+		// Alpine and Gentoo start OpenRC from busybox or SysV init
+		if _, err := os.Stat("/run/openrc"); err == nil {
+			return "openrc"
+		}
+		return "sysvinit"
+	}
+	return "unknown"
+}
+
+// Function to detect the init system: what PID 1 is, whether systemctl is installed, and
+// whether systemd answers it over D-Bus. A container often ships systemctl without
+// running systemd, so finding systemctl alone isn't enough.
+func detectInitSystem() InitSystem {
+	pid1 := "unknown"
+	if comm, err := os.ReadFile("/proc/1/comm"); err == nil {
+		pid1 = strings.TrimSpace(string(comm))
+	}
+	// systemd checks for /run/systemd/system the same way in sd_booted()
+	_, err := os.Stat("/run/systemd/system")
+	return probeInitSystem(pid1, err == nil)
+}
+
+// Function to detect the init system given the command of PID 1 and whether systemd
+// marked the host as booted with it, asking systemctl whether systemd answers
+func probeInitSystem(pid1 string, systemdBooted bool) InitSystem {
+	host := InitSystem{PID1: pid1, Name: initSystemName(pid1)}
+	_, err := exec.LookPath("service")
+	host.ServiceCommand = err == nil
+	_, err = exec.LookPath("systemctl")
+	host.Systemctl = err == nil
+
+	booted := host.Name == "systemd" && systemdBooted
+	if host.Systemctl {
+		ctx, cancel := context.WithTimeout(context.Background(), systemctlProbeTimeout)
+		defer cancel()
+		// is-system-running exits non-zero for degraded and the other states that aren't
+		// running, so the state it prints is what counts
+		output, _ := runCommand(newCommandContext(ctx, "systemctl", "is-system-running"))
+		host.State = strings.TrimSpace(output.Stdout)
+		if ctx.Err() != nil {
+			host.State = "timeout"
+		}
+	}
+
+	switch {
+	case !booted:
+		host.Reason = "systemd is not running as PID 1 (PID 1 is " + host.PID1 + ")"
+	case !host.Systemctl:
+		host.Reason = "systemctl is not installed"
+	case !systemdManagerStates[host.State]:
+		host.Reason = fmt.Sprintf("systemctl can't reach systemd over D-Bus (is-system-running reports %q)", host.State)
+	default:
+		host.Systemd = true
+	}
+	return host
+}
+
+// Function to refuse an operation that needs systemd when the host doesn't run it, with
+// the same 501 whichever endpoint asks
+func requireSystemd(operation string) error {
+	host := capabilities.Get().InitSystem
+	if host.Systemd {
+		return nil
+	}
+	return &responseError{501, gin.H{
+		"error":       operation + " requires systemd, but " + host.describe(),
+		"code":        "init_system_unsupported",
+		"init_system": host.Name,
+		"reason":      host.Reason,
+	}}
+}
+
+// SysVService is one service of `service --status-all`
+type SysVService struct {
+	Name string `json:"name"`
+	// Status is running, stopped, or unknown when the init script has no status action
+	Status string `json:"status"`
+}
+
+// Function to list the services of the SysV init scripts, for hosts without systemd
+func sysvServices(ctx context.Context) ([]SysVService, error) {
+	cmd := newCommand("service", "--status-all")
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	return parseServiceStatusAll(result.Output), nil
+}
+
+// Function to parse `service --status-all`, whose lines look like " [ + ]  cron". The
+// status goes to stdout or stderr depending on the script, so both are read.
+func parseServiceStatusAll(output string) []SysVService {
+	statuses := map[string]string{"+": "running", "-": "stopped", "?": "unknown"}
+	services := []SysVService{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "[") {
+			continue
+		}
+		end := strings.IndexByte(line, ']')
+		if end < 0 {
+			continue
+		}
+		status, ok := statuses[strings.TrimSpace(line[1:end])]
+		name := strings.TrimSpace(line[end+1:])
+		if !ok || name == "" {
+			continue
+		}
+		services = append(services, SysVService{Name: name, Status: status})
+	}
+	return services
+}
+
+// Function to check whether a service is running through its SysV init script. The
+// script's status action exits 0 when it is.
+func sysvServiceActive(ctx context.Context, name string) (bool, string) {
+	result, err := runCommand(newCommandContext(ctx, "service", name, "status"))
+	if err == nil {
+		return true, "running"
+	}
+	if detail := strings.TrimSpace(result.Output); detail != "" {
+		return false, detail
+	}
+	return false, err.Error()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// What systemctl prints in a container that ships it without running systemd
+const systemctlWithoutSystemd = `echo offline
+echo "System has not been booted with systemd as init system (PID 1). Can't operate." >&2
+echo "Failed to connect to bus: Host is down" >&2
+exit 1`
+
+// Helper function to run a test with host as the detected init system
+func withInitSystem(t *testing.T, host InitSystem) {
+	t.Helper()
+	capabilities.mu.Lock()
+	previous := capabilities.caps
+	capabilities.caps = &Capabilities{InitSystem: host}
+	capabilities.mu.Unlock()
+	t.Cleanup(func() {
+		capabilities.mu.Lock()
+		capabilities.caps = previous
+		capabilities.mu.Unlock()
+	})
+}
+
+func TestProbeInitSystem(t *testing.T) {
+	tests := []struct {
+		name      string
+		pid1      string
+		booted    bool
+		systemctl string // the fake systemctl, or none when empty
+		service   bool
+		want      InitSystem
+	}{
+		{"container with systemctl but no D-Bus", "tini", false, systemctlWithoutSystemd, false, InitSystem{
+			Name: "unknown", PID1: "tini", Systemctl: true, State: "offline",
+			Reason: "systemd is not running as PID 1 (PID 1 is tini)",
+		}},
+		// systemd started as PID 1 of a container whose bus never came up
+		{"systemd without D-Bus", "systemd", true, `echo "Failed to connect to bus: No such file or directory" >&2; exit 1`, false, InitSystem{
+			Name: "systemd", PID1: "systemd", Systemctl: true,
+			Reason: `systemctl can't reach systemd over D-Bus (is-system-running reports "")`,
+		}},
+		{"systemctl hangs", "systemd", true, `exec /bin/sleep 10`, false, InitSystem{
+			Name: "systemd", PID1: "systemd", Systemctl: true, State: "timeout",
+			Reason: `systemctl can't reach systemd over D-Bus (is-system-running reports "timeout")`,
+		}},
+		{"systemd without systemctl", "systemd", true, "", false, InitSystem{
+			Name: "systemd", PID1: "systemd",
+			Reason: "systemctl is not installed",
+		}},
+		// is-system-running exits 1 when degraded, but systemd answered
+		{"degraded systemd", "systemd", true, `echo degraded; exit 1`, false, InitSystem{
+			Name: "systemd", PID1: "systemd", Systemctl: true, State: "degraded", Systemd: true,
+		}},
+		{"Devuan", "runit", false, "", true, InitSystem{
+			Name: "runit", PID1: "runit", ServiceCommand: true,
+			Reason: "systemd is not running as PID 1 (PID 1 is runit)",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PATH", t.TempDir())
+			if tt.systemctl != "" {
+				fakeCommand(t, "systemctl", tt.systemctl)
+			}
+			if tt.service {
+				fakeCommand(t, "service", "exit 0")
+			}
+			previous := systemctlProbeTimeout
+			systemctlProbeTimeout = 200 * time.Millisecond
+			defer func() { systemctlProbeTimeout = previous }()
+
+			if got := probeInitSystem(tt.pid1, tt.booted); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("probeInitSystem(%q, %v) =\n %+v\nwant %+v", tt.pid1, tt.booted, got, tt.want)
+			}
+		})
+	}
+}
+
+// Endpoints that need systemd refuse alike, naming the init system and why
+func TestRequireSystemd(t *testing.T) {
+	withInitSystem(t, InitSystem{Name: "unknown", PID1: "tini", Systemctl: true, State: "offline", Reason: "systemd is not running as PID 1 (PID 1 is tini)"})
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	respondFailure(c, "", requireSystemd("DELETE /power/pending"))
+	body := w.Body.String()
+	for _, want := range []string{
+		`"code":"init_system_unsupported"`,
+		`"error":"DELETE /power/pending requires systemd, but the init system is unknown (PID 1 is tini)"`,
+		`"init_system":"unknown"`,
+		`"reason":"systemd is not running as PID 1 (PID 1 is tini)"`,
+	} {
+		if w.Code != 501 || !strings.Contains(body, want) {
+			t.Errorf("response = %d %s, want 501 with %s", w.Code, body, want)
+		}
+	}
+
+	withInitSystem(t, InitSystem{Name: "systemd", PID1: "systemd", Systemctl: true, State: "running", Systemd: true})
+	if err := requireSystemd("DELETE /power/pending"); err != nil {
+		t.Errorf("requireSystemd with systemd = %v", err)
+	}
+}
+
+// Without systemd, service checks go through the SysV init scripts
+func TestVerifyServiceWithoutSystemd(t *testing.T) {
+	fakeCommand(t, "service", `case "$1" in
+cron) echo " * cron is running" ;;
+*) echo " * $1 is not running"; exit 3 ;;
+esac`)
+	withInitSystem(t, InitSystem{Name: "sysvinit", PID1: "init", Systemctl: true, State: "offline", ServiceCommand: true})
+
+	if result := runVerifyCheck(context.Background(), VerifyCheck{ServiceActive: "cron"}); !result.Passed || result.Detail != "running" {
+		t.Errorf("cron = %+v", result)
+	}
+	if result := runVerifyCheck(context.Background(), VerifyCheck{ServiceActive: "nginx"}); result.Passed || result.Detail != "* nginx is not running" {
+		t.Errorf("nginx = %+v", result)
+	}
+
+	withInitSystem(t, InitSystem{Name: "unknown", PID1: "tini", Systemctl: true, State: "offline"})
+	if result := runVerifyCheck(context.Background(), VerifyCheck{ServiceActive: "cron"}); result.Passed || !strings.Contains(result.Detail, "service_active requires systemd") {
+		t.Errorf("cron without the service command = %+v", result)
+	}
+}
+
+func TestParseServiceStatusAll(t *testing.T) {
+	output := ` [ + ]  cron
+ [ - ]  hwclock.sh
+ [ ? ]  kmod
+ [ + ]  ssh
+not a service line
+ [ x ]  odd
+ [ + ]
+`
+	want := []SysVService{
+		{"cron", "running"},
+		{"hwclock.sh", "stopped"},
+		{"kmod", "unknown"},
+		{"ssh", "running"},
+	}
+	if got := parseServiceStatusAll(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseServiceStatusAll = %+v, want %+v", got, want)
+	}
+}
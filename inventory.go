@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// Maximum number of inventory collectors running at once
+	inventoryConcurrency = 4
+	// Longest a single collector may take before its section is reported as an error
+	collectorTimeout = 15 * time.Second
+)
+
+// collector gathers one section of the inventory document
+type collector struct {
+	Name    string
+	Collect func(ctx context.Context) (interface{}, error)
+}
+
+// Function to run collectors with bounded concurrency. A failing or timed out collector
+// is reported as an error object in its own section instead of failing the rest.
+func runCollectors(ctx context.Context, collectors []collector, limit int) map[string]interface{} {
+	tasks := make([]task, len(collectors))
+	for i, col := range collectors {
+		tasks[i] = task{Name: col.Name, Run: col.Collect}
+	}
+
+	results := make(map[string]interface{}, len(collectors))
+	for _, result := range fanOut(ctx, tasks, limit, collectorTimeout) {
+		if result.Err != nil {
+			results[result.Name] = map[string]string{"error": result.Err.Error()}
+			continue
+		}
+		results[result.Name] = result.Value
+	}
+	return results
+}
+
+// Function to gather a consistent snapshot of everything the agent knows about the host
+func collectInventory(ctx context.Context, fullPackages bool) map[string]interface{} {
+	collectors := []collector{
+		{Name: "os", Collect: func(context.Context) (interface{}, error) {
+			return readOSReleaseFile("/etc/os-release")
+		}},
+		{Name: "uname", Collect: func(context.Context) (interface{}, error) {
+			info, err := hostInfoCached.Uname()
+			if err != nil {
+				return nil, err
+			}
+			return info.Fields, nil
+		}},
+		{Name: "memory", Collect: func(context.Context) (interface{}, error) {
+			return collectMemory()
+		}},
+		{Name: "cpu", Collect: func(context.Context) (interface{}, error) {
+			return collectCPU()
+		}},
+		{Name: "hardware", Collect: func(ctx context.Context) (interface{}, error) {
+			return collectHardware(ctx)
+		}},
+		{Name: "disks", Collect: func(context.Context) (interface{}, error) {
+			return collectDisks()
+		}},
+		{Name: "network", Collect: func(context.Context) (interface{}, error) {
+			return collectInterfaces()
+		}},
+		{Name: "packages", Collect: func(ctx context.Context) (interface{}, error) {
+			return collectPackageSummary(ctx, fullPackages)
+		}},
+		{Name: "kubernetes", Collect: func(context.Context) (interface{}, error) {
+			return map[string]bool{"installed": checkKubernetesInstallation()}, nil
+		}},
+	}
+
+	inventory := runCollectors(ctx, collectors, inventoryConcurrency)
+	inventory["collected_at"] = time.Now().UTC()
+	return inventory
+}
+
+// Function to count the installed packages, optionally including the full list
+func collectPackageSummary(ctx context.Context, full bool) (interface{}, error) {
+	osReleaseData, err := readOSReleaseFile("/etc/os-release")
+	if err != nil {
+		return nil, err
+	}
+	pm := packageManagerFor(osReleaseData)
+	if pm == nil {
+		return nil, errors.New("unsupported operating system")
+	}
+
+	packages, _, err := installedPackages.List(ctx, pm)
+	if err != nil {
+		return nil, err
+	}
+	summary := map[string]interface{}{
+		"manager": pm.Name(),
+		"count":   len(packages),
+	}
+	if full {
+		summary["list"] = packages
+	}
+	return summary, nil
+}
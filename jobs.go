@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rothgar/cosi/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// Number of jobs kept, in memory and under <state dir>/jobs
+	maxJobHistory = 100
+	// Age after which finished jobs are removed
+	defaultJobMaxAge = 7 * 24 * time.Hour
+	// Most of a job's output that is kept in memory: the end of each command result, and
+	// of the output file in the result of an interrupted job
+	maxOutputTail = 64 << 10
+	// Total size of the job output files kept under <state dir>/jobs
+	defaultJobOutputMaxBytes = 1 << 30
+)
+
+// Job status values
+const (
+	jobQueued    = api.JobQueued
+	jobRunning   = api.JobRunning
+	jobSucceeded = api.JobSucceeded
+	jobFailed    = api.JobFailed
+	// jobInterrupted marks jobs that were queued or running when the agent stopped
+	jobInterrupted = api.JobInterrupted
+	jobCancelled   = api.JobCancelled
+)
+
+// JobsConfig controls how much job history is kept across restarts
+type JobsConfig struct {
+	MaxHistory int           `yaml:"max_history"`
+	MaxAge     time.Duration `yaml:"max_age"`
+	// RequeueQueued runs package jobs again that were still queued when the agent stopped
+	RequeueQueued bool `yaml:"requeue_queued"`
+	// CancelGrace is how long a cancelled job's command has between SIGTERM and SIGKILL
+	CancelGrace time.Duration `yaml:"cancel_grace"`
+	// OutputMaxAge and OutputMaxBytes bound the output files of finished jobs, which are
+	// removed once older than the age, oldest first while together larger than the size.
+	// The age defaults to max_age.
+	OutputMaxAge   time.Duration `yaml:"output_max_age"`
+	OutputMaxBytes int64         `yaml:"output_max_bytes"`
+}
+
+func (c JobsConfig) maxHistory() int {
+	return int(orDefault(int64(c.MaxHistory), maxJobHistory))
+}
+
+func (c JobsConfig) maxAge() time.Duration {
+	return time.Duration(orDefault(int64(c.MaxAge), int64(defaultJobMaxAge)))
+}
+
+func (c JobsConfig) cancelGrace() time.Duration {
+	return time.Duration(orDefault(int64(c.CancelGrace), int64(defaultCancelGrace)))
+}
+
+func (c JobsConfig) outputMaxAge() time.Duration {
+	return time.Duration(orDefault(int64(c.OutputMaxAge), int64(c.maxAge())))
+}
+
+func (c JobsConfig) outputMaxBytes() int64 {
+	return orDefault(c.OutputMaxBytes, defaultJobOutputMaxBytes)
+}
+
+// Function to check the job history settings
+func (c JobsConfig) validate() error {
+	if c.MaxHistory < 0 || c.MaxAge < 0 || c.CancelGrace < 0 || c.OutputMaxAge < 0 || c.OutputMaxBytes < 0 {
+		return fmt.Errorf("jobs.max_history, jobs.max_age, jobs.cancel_grace, jobs.output_max_age, and jobs.output_max_bytes must not be negative")
+	}
+	return nil
+}
+
+// Job records a long-running operation such as a package transaction or Kubernetes bootstrap
+type Job struct {
+	api.Job
+
+	// snapshot holds the package versions around a package job
+	snapshot *packageSnapshot
+	// manifest is what a package job applies, kept so a queued job can run after a restart
+	manifest *PackageConfig
+	// control runs the job's commands and stops them when the job is cancelled
+	control *jobControl
+}
+
+// jobRecord is a job as persisted to <state dir>/jobs/<id>.json
+type jobRecord struct {
+	Job
+	Snapshot        *packageSnapshot `json:"snapshot,omitempty"`
+	Manifest        *PackageConfig   `json:"manifest,omitempty"`
+	AllowDowngrades bool             `json:"allow_downgrades,omitempty"`
+}
+
+// Helper function to check whether the job is done, whatever its outcome
+func (j *Job) finished() bool {
+	return j.Status != jobQueued && j.Status != jobRunning
+}
+
+// Duration returns how long the job ran, or has been running
+func (j *Job) Duration() time.Duration {
+	if j.StartedAt == nil {
+		return 0
+	}
+	if j.FinishedAt == nil {
+		return time.Since(*j.StartedAt)
+	}
+	return j.FinishedAt.Sub(*j.StartedAt)
+}
+
+// jobStore keeps the most recent jobs in memory
+type jobStore struct {
+	mu    sync.RWMutex
+	jobs  map[string]*Job
+	order []string
+	// Jobs started since the agent started, and the total time they were queued
+	started   int64
+	waitTotal time.Duration
+}
+
+var jobs = &jobStore{jobs: make(map[string]*Job)}
+
+// Helper function to generate a random identifier
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// New records a queued job of the given type. The job's span is a child of the span
+// in ctx, usually that of the request creating the job.
+func (s *jobStore) New(ctx context.Context, jobType string) *Job {
+	return s.newJob(ctx, jobType, "")
+}
+
+// NewForSchedule records a queued job created by a schedule firing
+func (s *jobStore) NewForSchedule(jobType, scheduleID string) *Job {
+	return s.newJob(context.Background(), jobType, scheduleID)
+}
+
+func (s *jobStore) newJob(ctx context.Context, jobType, scheduleID string) *Job {
+	job := &Job{
+		Job: api.Job{
+			ID:         newID(),
+			Type:       jobType,
+			Status:     jobQueued,
+			ScheduleID: scheduleID,
+			CreatedAt:  time.Now().UTC(),
+			RequestID:  requestIDFrom(ctx),
+		},
+		// A job runs to the end once it starts, whether or not its creator is still
+		// waiting, so it keeps the request's span and ID but not its cancellation
+		control: &jobControl{ctx: context.WithoutCancel(ctx)},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job
+	s.order = append(s.order, job.ID)
+	s.prune()
+	s.persist(job)
+	return job
+}
+
+// prune drops the oldest finished jobs over the history limit and finished jobs past
+// the maximum age, along with their files. Queued and running jobs are always kept,
+// however many there are. Callers must hold s.mu.
+func (s *jobStore) prune() {
+	cfg := currentConfig().Jobs
+	cutoff := time.Now().Add(-cfg.maxAge())
+	finishedJobs := 0
+	for _, id := range s.order {
+		if s.jobs[id].finished() {
+			finishedJobs++
+		}
+	}
+	kept := s.order[:0]
+	for _, id := range s.order {
+		job := s.jobs[id]
+		if !job.finished() {
+			kept = append(kept, id)
+			continue
+		}
+		// This job and the finished jobs newer than it
+		newer := finishedJobs
+		finishedJobs--
+		if newer > cfg.maxHistory() || job.CreatedAt.Before(cutoff) {
+			delete(s.jobs, id)
+			os.Remove(jobFile(id, ".json"))
+			os.Remove(jobFile(id, ".log"))
+			continue
+		}
+		kept = append(kept, id)
+	}
+	s.order = kept
+	s.pruneOutputs()
+}
+
+// pruneOutputs removes the output files of finished jobs past jobs.output_max_age, then
+// those of the oldest finished jobs while all of them are larger than
+// jobs.output_max_bytes. Callers must hold s.mu.
+func (s *jobStore) pruneOutputs() {
+	cfg := currentConfig().Jobs
+	cutoff := time.Now().Add(-cfg.outputMaxAge())
+	sizes := make(map[string]int64)
+	var total int64
+	for _, id := range s.order {
+		if size, ok := outputSize(s.jobs[id]); ok {
+			sizes[id] = size
+			total += size
+		}
+	}
+	for _, id := range s.order {
+		job := s.jobs[id]
+		size, ok := sizes[id]
+		if !ok || job.FinishedAt == nil || (total <= cfg.outputMaxBytes() && !job.FinishedAt.Before(cutoff)) {
+			continue
+		}
+		if err := os.Remove(job.OutputPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: unable to remove the output of job %s: %v", job.ID, err)
+			continue
+		}
+		total -= size
+		job.OutputPath = ""
+		job.OutputPruned = true
+		s.persist(job)
+	}
+}
+
+// Helper function to return the size of a job's output file, or false when it has none
+func outputSize(job *Job) (int64, bool) {
+	if job.OutputPath == "" {
+		return 0, false
+	}
+	info, err := os.Stat(job.OutputPath)
+	if err != nil {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+// Helper function to name the files of a job in the state directory
+func jobFile(id, ext string) string {
+	return filepath.Join(stateDir, "jobs", id+ext)
+}
+
+// persist writes the job record atomically so a restart finds it. Callers must hold s.mu.
+func (s *jobStore) persist(job *Job) {
+	record := jobRecord{Job: *job, Snapshot: job.snapshot, Manifest: job.manifest}
+	if job.manifest != nil {
+		record.AllowDowngrades = job.manifest.AllowDowngrades
+	}
+	data, err := json.Marshal(record)
+	if err == nil {
+		err = writeStateFile(jobFile(job.ID, ".json"), data)
+	}
+	if err != nil {
+		log.Printf("Warning: unable to persist job %s: %v", job.ID, err)
+	}
+}
+
+// SetManifest records what a package job applies, so it can be requeued after a restart
+func (s *jobStore) SetManifest(job *Job, config PackageConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.manifest = &config
+	s.persist(job)
+}
+
+// Start marks a job as running. It returns false when the job was cancelled while
+// queued, in which case the caller must not run it.
+func (s *jobStore) Start(job *Job) bool {
+	// A job queued in maintenance mode waits for it to end, unless it is cancelled first
+	maintenance.Hold(func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return job.Status == jobQueued && job.Cancellation == nil
+	})
+	now := time.Now().UTC()
+	s.mu.Lock()
+	if job.Status != jobQueued || job.Cancellation != nil {
+		s.mu.Unlock()
+		return false
+	}
+	job.Status = jobRunning
+	job.StartedAt = &now
+	job.control.ctx, job.control.span = tracer.Start(job.control.context(), "job "+job.Type, trace.WithAttributes(
+		attribute.String("cosi.job.id", job.ID),
+		attribute.String("cosi.job.type", job.Type),
+	))
+	s.started++
+	s.waitTotal += now.Sub(job.CreatedAt)
+	s.persist(job)
+	s.mu.Unlock()
+
+	details := map[string]interface{}{"job_id": job.ID, "job_type": job.Type}
+	if job.RequestID != "" {
+		details["request_id"] = job.RequestID
+	}
+	events.Emit(Event{Type: "job.started", Message: job.Type + " job " + job.ID + " started", Details: details})
+	return true
+}
+
+// Finish records the outcome of a job and notifies webhook subscribers
+func (s *jobStore) Finish(job *Job, result interface{}, summary string, err error) {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	job.FinishedAt = &now
+	job.Result = result
+	job.Summary = summary
+	cancelled, signal := job.control.state()
+	switch {
+	case cancelled:
+		job.Status = jobCancelled
+		job.Error = errJobCancelled.Error()
+		if err != nil && !errors.Is(err, errJobCancelled) {
+			job.Error += ": " + err.Error()
+		}
+		job.Cancellation.Signal = signal
+	case verificationFailed(err):
+		job.Status = jobVerificationFailed
+		job.Error = err.Error()
+	case partiallySucceeded(err):
+		job.Status = jobPartiallySucceeded
+		job.Error = err.Error()
+	case err != nil:
+		job.Status = jobFailed
+		job.Error = err.Error()
+	default:
+		job.Status = jobSucceeded
+	}
+	// Errors and summaries often quote command output, and are sent on to webhooks
+	job.Error = redactText(job.Error)
+	job.Summary = redactText(summary)
+	s.persist(job)
+	s.pruneOutputs()
+	snapshot := *job
+	s.mu.Unlock()
+
+	if span := job.control.span; span != nil {
+		span.SetAttributes(attribute.String("cosi.job.status", snapshot.Status))
+		endSpan(span, err)
+	}
+	details := map[string]interface{}{"job_id": job.ID, "job_type": job.Type, "summary": summary}
+	events.Emit(eventOutcome("job.finished", job.Type+" job "+job.ID+" "+snapshot.Status, details, err))
+	webhooks.Notify(&snapshot)
+}
+
+// SetSnapshot records the package versions before and after a package job
+func (s *jobStore) SetSnapshot(job *Job, snapshot *packageSnapshot) {
+	s.mu.Lock()
+	job.snapshot = snapshot
+	job.RollbackAvailable = true
+	s.persist(job)
+	s.mu.Unlock()
+}
+
+// SetResult records the progress of a running job whose result fills in as it runs
+func (s *jobStore) SetResult(job *Job, result interface{}) {
+	s.mu.Lock()
+	job.Result = result
+	s.persist(job)
+	s.mu.Unlock()
+}
+
+// Function to reload the jobs persisted by a previous run of the agent. Jobs that were
+// running are marked interrupted with the output they had produced; queued package
+// jobs are requeued when the config allows it and marked interrupted otherwise.
+func loadJobs() {
+	paths, err := filepath.Glob(jobFile("*", ".json"))
+	if err != nil || len(paths) == 0 {
+		return
+	}
+	var records []*jobRecord
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Warning: unable to read job file %s: %v", path, err)
+			continue
+		}
+		record := &jobRecord{}
+		if err := json.Unmarshal(data, record); err != nil || record.ID == "" || record.ID != strings.TrimSuffix(filepath.Base(path), ".json") {
+			log.Printf("Warning: ignoring unreadable job file %s", path)
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+
+	cfg := currentConfig().Jobs
+	now := time.Now().UTC()
+	var requeue []*Job
+	jobs.mu.Lock()
+	for _, record := range records {
+		job := record.Job
+		job.snapshot = record.Snapshot
+		job.control = &jobControl{}
+		if record.Manifest != nil {
+			job.manifest = record.Manifest
+			job.manifest.AllowDowngrades = record.AllowDowngrades
+		}
+		switch {
+		case job.Status == jobQueued && cfg.RequeueQueued && job.manifest != nil:
+			requeue = append(requeue, &job)
+		case job.Status == jobQueued:
+			job.Status = jobInterrupted
+			job.Error = "the agent restarted before the job started"
+			job.FinishedAt = &now
+		case job.Status == jobRunning:
+			job.Status = jobInterrupted
+			job.Error = "the agent restarted while the job was running"
+			job.FinishedAt = &now
+			if output, ok := partialOutput(job.OutputPath); ok {
+				job.Result = map[string]string{"partial_output": output}
+			}
+		}
+		jobs.jobs[job.ID] = &job
+		jobs.order = append(jobs.order, job.ID)
+		jobs.persist(&job)
+	}
+	jobs.prune()
+	jobs.mu.Unlock()
+
+	for _, job := range requeue {
+		log.Printf("Requeuing job %s, which was queued when the agent stopped", job.ID)
+		go runRequeuedJob(job)
+	}
+}
+
+// Helper function to read the end of a job's output file
+func partialOutput(path string) (string, bool) {
+	if path == "" {
+		return "", false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err == nil && info.Size() > maxOutputTail {
+		file.Seek(info.Size()-maxOutputTail, io.SeekStart)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// Function to run a package job requeued after a restart
+func runRequeuedJob(job *Job) {
+	pm, err := hostPackageManager()
+	if err == nil {
+		err = checkWritable(pm)
+	}
+	if err != nil {
+		jobs.Finish(job, nil, "requeued after a restart", err)
+		return
+	}
+	packageLock.Lock()
+	if !jobs.Start(job) {
+		packageLock.Unlock()
+		return
+	}
+	result, err := applyPackagesForJob(job, pm, *job.manifest)
+	packageLock.Unlock()
+	jobs.Finish(job, result, packageSummary(*job.manifest)+" (requeued after a restart)", err)
+}
+
+// Get returns a copy of a job by ID
+func (s *jobStore) Get(id string) (Job, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	copied := *job
+	copied.QueuePosition = s.position(job)
+	copied.OutputBytes, _ = outputSize(job)
+	return copied, true
+}
+
+// List returns copies of all jobs, newest first
+func (s *jobStore) List() []Job {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Job, 0, len(s.order))
+	for i := len(s.order) - 1; i >= 0; i-- {
+		job := *s.jobs[s.order[i]]
+		job.QueuePosition = s.position(s.jobs[s.order[i]])
+		job.OutputBytes, _ = outputSize(&job)
+		list = append(list, job)
+	}
+	return list
+}
+
+// Active returns copies of the queued and running jobs of the given types
+func (s *jobStore) Active(types ...string) []Job {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var active []Job
+	for _, id := range s.order {
+		job := s.jobs[id]
+		if job.Status != jobQueued && job.Status != jobRunning {
+			continue
+		}
+		for _, t := range types {
+			if job.Type == t {
+				active = append(active, *job)
+				break
+			}
+		}
+	}
+	return active
+}
+
+// Function to register the /jobs endpoints
+func registerJobRoutes(r *gin.Engine) {
+	// Define the /jobs endpoint that lists recent jobs
+	r.GET("/jobs", func(c *gin.Context) {
+		c.JSON(200, gin.H{"jobs": jobs.List()})
+	})
+
+	// Define the /jobs/:id endpoint
+	r.GET("/jobs/:id", func(c *gin.Context) {
+		job, ok := jobs.Get(c.Param("id"))
+		if !ok {
+			c.JSON(404, gin.H{"error": "Job not found"})
+			return
+		}
+		c.JSON(200, job)
+	})
+
+	// Define the /jobs/:id/output endpoint that serves a job's output file from disk,
+	// while the job runs too. Range requests read it piece by piece.
+	r.GET("/jobs/:id/output", func(c *gin.Context) {
+		job, ok := jobs.Get(c.Param("id"))
+		if !ok {
+			c.JSON(404, gin.H{"error": "Job not found"})
+			return
+		}
+		if job.OutputPruned {
+			c.JSON(404, gin.H{"error": "The output of job " + job.ID + " was removed to stay within jobs.output_max_bytes", "code": "output_pruned"})
+			return
+		}
+		file, err := os.Open(job.OutputPath)
+		if job.OutputPath == "" || err != nil {
+			c.JSON(404, gin.H{"error": "Job " + job.ID + " has no output file", "code": "output_not_found"})
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Unable to read the output: " + err.Error()})
+			return
+		}
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.Header("X-Cosi-Job-Status", job.Status)
+		http.ServeContent(c.Writer, c.Request, "", info.ModTime(), file)
+	})
+
+	// Define the /jobs/:id DELETE endpoint that cancels a job. A queued job is cancelled
+	// right away; a running job's command is stopped and the job is marked cancelled
+	// once it has exited.
+	r.DELETE("/jobs/:id", func(c *gin.Context) {
+		job, err := jobs.Cancel(c.Param("id"))
+		switch {
+		case errors.Is(err, errJobNotFound):
+			c.JSON(404, gin.H{"error": "Job not found"})
+		case errors.Is(err, errJobNotActive):
+			c.JSON(409, gin.H{"error": "Job " + job.ID + " has already finished", "code": "job_finished", "status": job.Status})
+		case job.Status == jobRunning:
+			c.JSON(202, job)
+		default:
+			c.JSON(200, job)
+		}
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Helper function to give a test its own job store and state directory
+func withJobStore(t *testing.T) {
+	t.Helper()
+	previousJobs, previousDir := jobs, stateDir
+	jobs = &jobStore{jobs: make(map[string]*Job)}
+	stateDir = t.TempDir()
+	t.Cleanup(func() { jobs, stateDir = previousJobs, previousDir })
+}
+
+// A burst of queued jobs larger than the history must not push out jobs that
+// haven't run yet; only finished jobs count towards the limit
+func TestPruneKeepsUnfinishedJobs(t *testing.T) {
+	withJobStore(t)
+	withConfig(t, &Config{Jobs: JobsConfig{MaxHistory: 3}})
+
+	var finished []*Job
+	for i := 0; i < 4; i++ {
+		job := jobs.New(context.Background(), "packages")
+		jobs.Start(job)
+		jobs.Finish(job, nil, "done", nil)
+		finished = append(finished, job)
+	}
+	running := jobs.New(context.Background(), "packages")
+	jobs.Start(running)
+	var queued []*Job
+	for i := 0; i < 5; i++ {
+		queued = append(queued, jobs.New(context.Background(), "packages"))
+	}
+
+	for _, job := range append(queued, running) {
+		if _, ok := jobs.Get(job.ID); !ok {
+			t.Errorf("unfinished job %s (%s) was pruned", job.ID, job.Status)
+		}
+		if _, err := os.Stat(jobFile(job.ID, ".json")); err != nil {
+			t.Errorf("record of unfinished job %s: %v", job.ID, err)
+		}
+	}
+	// The oldest finished job is the one over the limit of three
+	if _, ok := jobs.Get(finished[0].ID); ok {
+		t.Error("the oldest finished job is still kept")
+	}
+	if _, err := os.Stat(jobFile(finished[0].ID, ".json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("record of the pruned job: %v", err)
+	}
+	for _, job := range finished[1:] {
+		if _, ok := jobs.Get(job.ID); !ok {
+			t.Errorf("finished job %s within the limit was pruned", job.ID)
+		}
+	}
+	if got := len(jobs.List()); got != 9 {
+		t.Errorf("%d jobs kept, want 3 finished and 6 unfinished", got)
+	}
+}
+
+func TestPruneFinishedJobsByAge(t *testing.T) {
+	withJobStore(t)
+	withConfig(t, &Config{Jobs: JobsConfig{MaxAge: time.Hour}})
+
+	old := jobs.New(context.Background(), "packages")
+	jobs.Finish(old, nil, "done", nil)
+	stuck := jobs.New(context.Background(), "packages")
+	jobs.Start(stuck)
+	jobs.mu.Lock()
+	old.CreatedAt = old.CreatedAt.Add(-2 * time.Hour)
+	stuck.CreatedAt = stuck.CreatedAt.Add(-2 * time.Hour)
+	jobs.mu.Unlock()
+
+	jobs.New(context.Background(), "packages")
+	if _, ok := jobs.Get(old.ID); ok {
+		t.Error("a finished job past jobs.max_age is still kept")
+	}
+	if _, ok := jobs.Get(stuck.ID); !ok {
+		t.Error("a running job was pruned for its age")
+	}
+}
+
+// A change keeps running after the client that asked for it disconnects, so it isn't
+// left half applied, and its outcome is recorded for whoever asks later
+func TestJobOutlivesItsRequest(t *testing.T) {
+	withJobStore(t)
+	withConfig(t, &Config{})
+	fakeCommand(t, "apt-get", `sleep 0.2; echo "Setting up nginx"`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := jobs.New(ctx, "packages")
+	control := jobs.Control(job)
+	defer control.Close()
+	jobs.Start(job)
+	cancel()
+
+	result, err := runJobCommand(newCommand("apt-get", "install", "-y", "nginx"), control)
+	jobs.Finish(job, nil, "installed", err)
+	if err != nil || !strings.Contains(result.Output, "Setting up nginx") {
+		t.Errorf("job command after its request was cancelled = %+v, %v", result, err)
+	}
+	if finished, ok := jobs.Get(job.ID); !ok || finished.Status != jobSucceeded {
+		t.Errorf("job = %+v, want it recorded as succeeded", finished)
+	}
+}
+
+// Three jobs writing several MB of output each at the same time keep only the end of it
+// in memory; the rest goes to their output files
+func TestJobOutputMemoryStaysFlat(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes 12 MB of job output")
+	}
+	withJobStore(t)
+	withConfig(t, &Config{})
+	const line = "[kubelet-check] Waiting for a healthy kubelet at http://127.0.0.1:10248/healthz. This can take up to 4m0s"
+	const lines = 40000
+	const perJob = int64(lines * (len(line) + 1))
+	fakeCommand(t, "kubeadm", `yes "`+line+`" | head -n `+strconv.Itoa(lines))
+
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapAlloc
+
+	// Sample the heap while the jobs run
+	var peak uint64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			peak = max(peak, stats.HeapAlloc)
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	results := make([]CommandResult, 3)
+	started := make([]*Job, 3)
+	for i := range started {
+		job := jobs.New(context.Background(), "kubernetes")
+		started[i] = job
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			control := jobs.Control(job)
+			defer control.Close()
+			jobs.Start(job)
+			result, err := runJobCommand(newCommand("kubeadm", "init", "--v=5"), control)
+			jobs.Finish(job, nil, "done", err)
+			results[i] = result
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-sampled
+
+	// Kept in memory the outputs would take several times what they wrote; spooled, the
+	// heap only grows by the tails and garbage not yet collected
+	if growth := int64(peak) - int64(baseline); growth > 3*perJob {
+		t.Errorf("heap grew by %d MB while the jobs wrote %d MB", growth>>20, 3*perJob>>20)
+	}
+	for i, job := range started {
+		result := results[i]
+		if !result.Truncated || len(result.Output) > maxOutputTail || len(result.Stdout) > maxOutputTail {
+			t.Errorf("job %d kept %d bytes of output in memory, truncated %v", i, len(result.Output), result.Truncated)
+		}
+		if !strings.HasSuffix(result.Output, "\n"+line+"\n") {
+			t.Errorf("job %d: output tail ends with %q", i, result.Output[max(0, len(result.Output)-200):])
+		}
+		// The list reports the size from the file without reading it
+		listed, _ := jobs.Get(job.ID)
+		if listed.Status != jobSucceeded || listed.OutputBytes != perJob {
+			t.Errorf("job %d: %s with %d bytes of output, want %d", i, listed.Status, listed.OutputBytes, perJob)
+		}
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	kubeletDir        = "/var/lib/kubelet"
+	kubeletConfigFile = "/var/lib/kubelet/config.yaml"
+	// kubeadm passes the flags that aren't in the config file here
+	kubeletFlagsFile = "/var/lib/kubelet/kubeadm-flags.env"
+	// Journal lines scanned for the kubelet's errors and warnings
+	kubeletJournalScan = 5000
+	// Most error and warning lines GET /kubernetes/kubelet returns
+	maxKubeletLogLines = 500
+	// Certificates closer than this to expiry are reported by the pki check
+	kubeletCertWarning = 7 * 24 * time.Hour
+)
+
+// klog's line header: severity, MMDD, and the time, e.g. E0612 10:11:12.123456
+var klogProblem = regexp.MustCompile(`^[EWF]\d{4} \d{2}:\d{2}:\d{2}`)
+
+// Metrics of the read-only port that are summed into the report
+var kubeletMetricNames = []string{
+	"kubelet_running_pods",
+	"kubelet_running_containers",
+	"kubelet_runtime_operations_errors_total",
+	"kubelet_node_config_error",
+}
+
+// Client for the kubelet's local ports. Proxies from the environment are ignored since
+// the kubelet listens on loopback.
+var kubeletClient = &http.Client{
+	Timeout: 2 * time.Second,
+	Transport: &http.Transport{
+		Proxy:       nil,
+		DialContext: (&net.Dialer{Timeout: time.Second}).DialContext,
+	},
+}
+
+// KubeletStatus is the response of GET /kubernetes/kubelet
+type KubeletStatus struct {
+	Unit    *KubeletUnit    `json:"unit,omitempty"`
+	Healthz KubeletProbe    `json:"healthz"`
+	Metrics *KubeletMetrics `json:"metrics,omitempty"`
+	Config  KubeletConfig   `json:"config"`
+	// Log holds the last error and warning lines of the kubelet journal
+	Log    []string       `json:"log"`
+	Checks []kubeadmCheck `json:"checks"`
+	// Healthy is set when every check passed
+	Healthy bool `json:"healthy"`
+	// Notes explain the parts that couldn't be read
+	Notes []string `json:"notes,omitempty"`
+}
+
+// KubeletUnit is the state of the kubelet systemd unit
+type KubeletUnit struct {
+	ActiveState   string `json:"active_state"`
+	SubState      string `json:"sub_state"`
+	UnitFileState string `json:"unit_file_state"`
+	MainPID       int    `json:"main_pid"`
+	Restarts      int    `json:"restarts"`
+	// Since is when the unit entered its current active state
+	Since string `json:"since,omitempty"`
+}
+
+// KubeletProbe is the outcome of an HTTP request to a local kubelet port
+type KubeletProbe struct {
+	URL        string `json:"url,omitempty"`
+	OK         bool   `json:"ok"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Body       string `json:"body,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// KubeletMetrics are read from the read-only port, when the kubelet has it enabled
+type KubeletMetrics struct {
+	KubeletProbe
+	Values map[string]float64 `json:"values,omitempty"`
+}
+
+// KubeletConfig is what the report reads from the kubelet's configuration file and flags
+type KubeletConfig struct {
+	Path                     string `json:"path"`
+	CgroupDriver             string `json:"cgroup_driver,omitempty"`
+	ContainerRuntimeEndpoint string `json:"container_runtime_endpoint,omitempty"`
+	StaticPodPath            string `json:"static_pod_path,omitempty"`
+	HealthzPort              int    `json:"healthz_port"`
+	ReadOnlyPort             int    `json:"read_only_port"`
+	FailSwapOn               bool   `json:"fail_swap_on"`
+	// EvictionHard holds the hard eviction thresholds in effect, by signal
+	EvictionHard map[string]string `json:"eviction_hard,omitempty"`
+	Error        string            `json:"error,omitempty"`
+
+	healthzBindAddress string
+}
+
+// kubeletConfigFileFields are the KubeletConfiguration fields the report reads
+type kubeletConfigFileFields struct {
+	CgroupDriver             string            `yaml:"cgroupDriver"`
+	ContainerRuntimeEndpoint string            `yaml:"containerRuntimeEndpoint"`
+	StaticPodPath            string            `yaml:"staticPodPath"`
+	HealthzPort              *int              `yaml:"healthzPort"`
+	HealthzBindAddress       string            `yaml:"healthzBindAddress"`
+	ReadOnlyPort             int               `yaml:"readOnlyPort"`
+	FailSwapOn               *bool             `yaml:"failSwapOn"`
+	EvictionHard             map[string]string `yaml:"evictionHard"`
+}
+
+// Function to read the kubelet's configuration, with the kubelet's defaults for the
+// fields left out. The runtime endpoint only moved into the file in Kubernetes 1.27, so
+// it is also looked for among the flags kubeadm writes.
+func readKubeletConfig() KubeletConfig {
+	config := KubeletConfig{
+		Path:               kubeletConfigFile,
+		HealthzPort:        10248,
+		FailSwapOn:         true,
+		healthzBindAddress: "127.0.0.1",
+		EvictionHard:       map[string]string{"memory.available": "100Mi", "nodefs.available": "10%", "nodefs.inodesFree": "5%", "imagefs.available": "15%"},
+	}
+	data, err := os.ReadFile(kubeletConfigFile)
+	if err != nil {
+		config.Error = err.Error()
+	} else {
+		var fields kubeletConfigFileFields
+		if err := yaml.Unmarshal(data, &fields); err != nil {
+			config.Error = "parsing the configuration: " + err.Error()
+		}
+		config.CgroupDriver = fields.CgroupDriver
+		config.ContainerRuntimeEndpoint = fields.ContainerRuntimeEndpoint
+		config.StaticPodPath = fields.StaticPodPath
+		config.ReadOnlyPort = fields.ReadOnlyPort
+		if fields.HealthzPort != nil {
+			config.HealthzPort = *fields.HealthzPort
+		}
+		if fields.HealthzBindAddress != "" {
+			config.healthzBindAddress = fields.HealthzBindAddress
+		}
+		if fields.FailSwapOn != nil {
+			config.FailSwapOn = *fields.FailSwapOn
+		}
+		// Setting any threshold replaces all of the defaults
+		if len(fields.EvictionHard) > 0 {
+			config.EvictionHard = fields.EvictionHard
+		}
+	}
+
+	if config.ContainerRuntimeEndpoint == "" {
+		if flags, err := readKeyValueFile(kubeletFlagsFile); err == nil {
+			for _, flag := range strings.Fields(flags["KUBELET_KUBEADM_ARGS"]) {
+				if endpoint, ok := strings.CutPrefix(flag, "--container-runtime-endpoint="); ok {
+					config.ContainerRuntimeEndpoint = endpoint
+				}
+			}
+		}
+	}
+	return config
+}
+
+// Helper function to GET a kubelet URL, keeping a short body
+func probeKubelet(ctx context.Context, url string) (KubeletProbe, []byte) {
+	probe := KubeletProbe{URL: url}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		probe.Error = err.Error()
+		return probe, nil
+	}
+	response, err := kubeletClient.Do(request)
+	if err != nil {
+		probe.Error = err.Error()
+		return probe, nil
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, 4<<20))
+	if err != nil {
+		probe.Error = err.Error()
+	}
+	probe.StatusCode = response.StatusCode
+	probe.OK = response.StatusCode == http.StatusOK && err == nil
+	return probe, body
+}
+
+// Function to sum the samples of the report's metrics in Prometheus text output
+func parseKubeletMetrics(data []byte) map[string]float64 {
+	wanted := make(map[string]bool, len(kubeletMetricNames))
+	for _, name := range kubeletMetricNames {
+		wanted[name] = true
+	}
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name := line
+		if i := strings.IndexAny(line, "{ "); i >= 0 {
+			name = line[:i]
+		}
+		if !wanted[name] {
+			continue
+		}
+		// The value follows the labels, and may itself be followed by a timestamp
+		rest := line[len(name):]
+		if i := strings.LastIndexByte(rest, '}'); i >= 0 {
+			rest = rest[i+1:]
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		if value, err := strconv.ParseFloat(fields[0], 64); err == nil {
+			values[name] += value
+		}
+	}
+	return values
+}
+
+// Function to read the kubelet unit's state
+func readKubeletUnit(ctx context.Context) (*KubeletUnit, error) {
+	values, err := unitProperties(ctx, "kubelet.service", "ActiveState", "SubState", "UnitFileState", "MainPID", "NRestarts", "StateChangeTimestamp")
+	if err != nil {
+		return nil, err
+	}
+	unit := &KubeletUnit{
+		ActiveState:   values["ActiveState"],
+		SubState:      values["SubState"],
+		UnitFileState: values["UnitFileState"],
+		Since:         values["StateChangeTimestamp"],
+	}
+	unit.MainPID, _ = strconv.Atoi(values["MainPID"])
+	unit.Restarts, _ = strconv.Atoi(values["NRestarts"])
+	return unit, nil
+}
+
+// Function to read the last error and warning lines of the kubelet journal. The kubelet
+// logs everything to stderr, which journald files at one priority, so the lines are
+// picked by their klog severity rather than with journalctl -p.
+func readKubeletLog(ctx context.Context, lines int) ([]string, error) {
+	cmd := newCommand("journalctl", "-u", "kubelet.service", "-q", "-o", "cat", "--no-pager", "-n", strconv.Itoa(kubeletJournalScan))
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	var problems []string
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		if klogProblem.MatchString(line) {
+			problems = append(problems, line)
+		}
+	}
+	if len(problems) > lines {
+		problems = problems[len(problems)-lines:]
+	}
+	return problems, nil
+}
+
+// Function to check for active swap, which the kubelet refuses to start with unless
+// failSwapOn is turned off
+func checkKubeletSwap(config KubeletConfig) kubeadmCheck {
+	check := kubeadmCheck{Name: "swap", Passed: true, Detail: "no active swap"}
+	swaps, err := readLines("/proc/swaps")
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	var devices []string
+	for _, line := range swaps[min(1, len(swaps)):] {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			devices = append(devices, fields[0])
+		}
+	}
+	if len(devices) > 0 {
+		check.Detail = "swap is active on " + strings.Join(devices, ", ")
+		if config.FailSwapOn {
+			check.Passed = false
+			check.Detail += ", and failSwapOn keeps the kubelet from starting; run swapoff -a and remove the swap from /etc/fstab"
+		} else {
+			check.Detail += ", which failSwapOn: false allows"
+		}
+	}
+	return check
+}
+
+// Function to check the certificates in the kubelet's pki directory for expiry
+func checkKubeletCertificates() kubeadmCheck {
+	check := kubeadmCheck{Name: "certificates", Passed: true}
+	paths, _ := filepath.Glob(filepath.Join(kubeletDir, "pki", "*.crt"))
+	pems, _ := filepath.Glob(filepath.Join(kubeletDir, "pki", "*.pem"))
+	now := time.Now()
+	var expired, expiring []string
+	checked := 0
+	for _, path := range append(paths, pems...) {
+		certs, _, err := readCertificateFile(path)
+		if err != nil || len(certs) == 0 {
+			continue // kubelet-client-current.pem carries the key too; others may be keys only
+		}
+		checked++
+		// The first certificate of a file is the kubelet's own; the rest are its chain
+		cert := certs[0]
+		switch {
+		case now.After(cert.NotAfter):
+			expired = append(expired, fmt.Sprintf("%s expired %s", filepath.Base(path), cert.NotAfter.UTC().Format(time.RFC3339)))
+		case cert.NotAfter.Sub(now) < kubeletCertWarning:
+			expiring = append(expiring, fmt.Sprintf("%s expires %s", filepath.Base(path), cert.NotAfter.UTC().Format(time.RFC3339)))
+		}
+	}
+	switch {
+	case len(expired) > 0:
+		check.Passed = false
+		check.Detail = strings.Join(append(expired, expiring...), "; ")
+	case len(expiring) > 0:
+		check.Detail = strings.Join(expiring, "; ")
+	case checked == 0:
+		check.Detail = "no certificates in " + filepath.Join(kubeletDir, "pki")
+	default:
+		check.Detail = fmt.Sprintf("%d certificates valid for more than %d days", checked, int(kubeletCertWarning.Hours()/24))
+	}
+	return check
+}
+
+// Helper function to parse an eviction threshold against a total: a percentage or a
+// Kubernetes quantity like 1Gi. It returns the threshold in the total's unit.
+func evictionThreshold(value string, total uint64) (uint64, bool) {
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil {
+			return 0, false
+		}
+		return uint64(float64(total) * p / 100), true
+	}
+	multipliers := []struct {
+		suffix string
+		factor uint64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+		{"k", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+	}
+	factor := uint64(1)
+	for _, m := range multipliers {
+		if number, ok := strings.CutSuffix(value, m.suffix); ok {
+			value, factor = number, m.factor
+			break
+		}
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n * factor, true
+}
+
+// Function to check the filesystem of the kubelet's directory against the nodefs hard
+// eviction thresholds, past which the node reports DiskPressure
+func checkKubeletDisk(config KubeletConfig) kubeadmCheck {
+	check := kubeadmCheck{Name: "disk_pressure", Passed: true}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(kubeletDir, &stat); err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	total := stat.Blocks * uint64(stat.Bsize)
+	available := stat.Bavail * uint64(stat.Bsize)
+	details := []string{fmt.Sprintf("%d MiB of %d MiB available", available>>20, total>>20)}
+	if value, ok := config.EvictionHard["nodefs.available"]; ok {
+		if threshold, ok := evictionThreshold(value, total); ok && available < threshold {
+			check.Passed = false
+			details = append(details, "below the nodefs.available threshold of "+value)
+		}
+	}
+	if value, ok := config.EvictionHard["nodefs.inodesFree"]; ok && stat.Files > 0 {
+		if threshold, ok := evictionThreshold(value, stat.Files); ok && stat.Ffree < threshold {
+			check.Passed = false
+			details = append(details, fmt.Sprintf("%d inodes free, below the nodefs.inodesFree threshold of %s", stat.Ffree, value))
+		}
+	}
+	check.Detail = strings.Join(details, "; ")
+	return check
+}
+
+// Function to diagnose the kubelet from the node alone: its unit, healthz and metrics
+// ports, configuration, recent complaints, and the usual reasons a node goes NotReady
+func diagnoseKubelet(ctx context.Context, lines int) (*KubeletStatus, error) {
+	_, binaryErr := exec.LookPath("kubelet")
+	if _, err := os.Stat(kubeletDir); err != nil && binaryErr != nil {
+		return nil, &requestError{404, "kubelet_not_found", "The kubelet is not installed on this host"}
+	}
+
+	status := &KubeletStatus{Log: []string{}, Config: readKubeletConfig()}
+	if err := requireSystemd("read the kubelet unit"); err != nil {
+		status.Notes = append(status.Notes, "the kubelet unit and journal can't be read without systemd")
+	} else {
+		if status.Unit, err = readKubeletUnit(ctx); err != nil {
+			status.Notes = append(status.Notes, "unit: "+err.Error())
+		}
+		if status.Log, err = readKubeletLog(ctx, lines); err != nil {
+			status.Log = []string{}
+			status.Notes = append(status.Notes, "journal: "+err.Error())
+		}
+	}
+
+	host := status.Config.healthzBindAddress
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	if status.Config.HealthzPort > 0 {
+		var body []byte
+		status.Healthz, body = probeKubelet(ctx, fmt.Sprintf("http://%s/healthz", net.JoinHostPort(host, strconv.Itoa(status.Config.HealthzPort))))
+		status.Healthz.Body = strings.TrimSpace(string(body[:min(len(body), 512)]))
+	} else {
+		status.Healthz.Error = "the healthz port is disabled"
+	}
+	if status.Config.ReadOnlyPort > 0 {
+		probe, body := probeKubelet(ctx, fmt.Sprintf("http://127.0.0.1:%d/metrics", status.Config.ReadOnlyPort))
+		status.Metrics = &KubeletMetrics{KubeletProbe: probe}
+		if probe.OK {
+			status.Metrics.Values = parseKubeletMetrics(body)
+		}
+	}
+
+	if status.Unit != nil {
+		unit := kubeadmCheck{Name: "unit_active", Passed: status.Unit.ActiveState == "active", Detail: status.Unit.ActiveState + " (" + status.Unit.SubState + ")"}
+		if status.Unit.Restarts > 0 {
+			unit.Detail += fmt.Sprintf(", restarted %d times", status.Unit.Restarts)
+		}
+		status.Checks = append(status.Checks, unit)
+	}
+	healthz := kubeadmCheck{Name: "healthz", Passed: status.Healthz.OK, Detail: status.Healthz.Body}
+	if status.Healthz.Error != "" {
+		healthz.Detail = status.Healthz.Error
+	}
+	status.Checks = append(status.Checks, healthz)
+	status.Checks = append(status.Checks, checkKubeletSwap(status.Config))
+	status.Checks = append(status.Checks, checkKubeletCertificates())
+	status.Checks = append(status.Checks, checkKubeletDisk(status.Config))
+	if runtimeDriver := runtimeEnvironment().ConfiguredDrivers["containerd"]; runtimeDriver != "" && status.Config.CgroupDriver != "" {
+		status.Checks = append(status.Checks, kubeadmCheck{
+			Name:   "cgroup_driver",
+			Passed: runtimeDriver == status.Config.CgroupDriver,
+			Detail: fmt.Sprintf("kubelet uses %s, containerd uses %s", status.Config.CgroupDriver, runtimeDriver),
+		})
+	}
+
+	status.Healthy = true
+	for _, check := range status.Checks {
+		status.Healthy = status.Healthy && check.Passed
+	}
+	return status, nil
+}
+
+// Function to register the kubelet diagnostics endpoint
+func registerKubeletRoutes(r *gin.Engine) {
+	// Define the /kubernetes/kubelet endpoint that reports the kubelet's health from the
+	// node alone. ?lines= sets how many error and warning lines of its journal to include.
+	r.GET("/kubernetes/kubelet", func(c *gin.Context) {
+		lines := 50
+		if value := c.Query("lines"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || n > maxKubeletLogLines {
+				c.JSON(400, gin.H{"error": fmt.Sprintf("lines must be a number from 0 to %d", maxKubeletLogLines)})
+				return
+			}
+			lines = n
+		}
+		status, err := diagnoseKubelet(c.Request.Context(), lines)
+		if err != nil {
+			respondFailure(c, "Failed to diagnose the kubelet", err)
+			return
+		}
+		c.JSON(200, status)
+	})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const kubernetesAptSource = "deb https://apt.kubernetes.io/ kubernetes-xenial main\n"
+
+// Repository of the Kubernetes packages for RPM hosts. The excludes keep routine
+// updates from upgrading the cluster tools.
+const kubernetesYumRepo = `[kubernetes]
+name=Kubernetes
+baseurl=https://pkgs.k8s.io/core:/stable:/v1.30/rpm/
+enabled=1
+gpgcheck=1
+gpgkey=https://pkgs.k8s.io/core:/stable:/v1.30/rpm/repodata/repomd.xml.key
+exclude=kubelet kubeadm kubectl cri-tools kubernetes-cni
+`
+
+// Function to return the URL of the repository the installer takes the Kubernetes
+// packages from with a package manager, or "" when it has none
+func kubernetesRepositoryURL(packageManager string) string {
+	switch packageManager {
+	case "apt":
+		return "https://apt.kubernetes.io/"
+	case "dnf", "yum":
+		return "https://pkgs.k8s.io/core:/stable:/v1.30/rpm/repodata/repomd.xml"
+	}
+	return ""
+}
+
+// Longest the GET /kubernetes checks may take
+const kubernetesCheckTimeout = 5 * time.Second
+
+// bootstrapStep is a single command run by the Kubernetes installer
+type bootstrapStep struct {
+	Args       []string
+	Privileged bool     // Escalated through sudo when the agent is not root
+	Env        []string // Extra environment for the command
+	Stdin      string
+}
+
+func (s bootstrapStep) String() string {
+	return strings.Join(s.Args, " ")
+}
+
+// bootstrapError records which installer step failed
+type bootstrapError struct {
+	Step bootstrapStep
+	Err  error
+}
+
+func (e *bootstrapError) Error() string {
+	return fmt.Sprintf("failed to execute: %s", e.Step)
+}
+
+func (e *bootstrapError) Unwrap() error {
+	return e.Err
+}
+
+// Function to check if Kubernetes is installed on the system
+func checkKubernetesInstallation() bool {
+	// Check if kubeadm, kubectl, and kubelet are installed
+	tools := []string{"kubeadm", "kubectl", "kubelet"}
+	tasks := make([]task, len(tools))
+	for i, tool := range tools {
+		tasks[i] = task{Name: tool, Run: func(context.Context) (interface{}, error) {
+			return exec.LookPath(tool)
+		}}
+	}
+
+	// All of them must be present
+	for _, result := range fanOut(context.Background(), tasks, len(tasks), kubernetesCheckTimeout) {
+		if result.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Function to list the steps that install and bootstrap Kubernetes on Debian-family
+// hosts, or on RPM hosts such as RHEL and Amazon Linux
+func kubernetesBootstrapSteps() []bootstrapStep {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "/root"
+	}
+	kubeconfig := filepath.Join(home, ".kube", "config")
+	owner := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+
+	var steps []bootstrapStep
+	osRelease, _ := readOSReleaseFile("/etc/os-release")
+	if dnf, ok := packageManagerFor(osRelease).(dnfManager); ok {
+		steps = kubernetesRPMSteps(dnf)
+	} else {
+		steps = kubernetesAptSteps()
+	}
+
+	return append(steps, []bootstrapStep{
+		// Disable swap
+		{Args: []string{"swapoff", "-a"}, Privileged: true},
+
+		// Initialize the Kubernetes cluster with kubeadm
+		{Args: []string{"kubeadm", "init"}, Privileged: true},
+
+		// Setup kubectl for the user running the agent
+		{Args: []string{"mkdir", "-p", filepath.Dir(kubeconfig)}},
+		{Args: []string{"cp", "/etc/kubernetes/admin.conf", kubeconfig}, Privileged: true},
+		{Args: []string{"chown", owner, kubeconfig}, Privileged: true},
+
+		// Install a pod network (flannel or weave)
+		{Args: []string{"kubectl", "apply", "-f", "https://raw.githubusercontent.com/coreos/flannel/master/Documentation/kube-flannel.yml"}},
+	}...)
+}
+
+// Function to list the steps that install kubeadm, kubelet, and kubectl with apt
+func kubernetesAptSteps() []bootstrapStep {
+	return []bootstrapStep{
+		// Update and install dependencies
+		{Args: []string{"apt-get", "update"}, Privileged: true, Env: aptEnv},
+		{Args: append([]string{"apt-get"}, aptArgs("install", "", []string{"apt-transport-https", "ca-certificates", "curl"})...), Privileged: true, Env: aptEnv},
+		{Args: []string{"apt-key", "adv", "--fetch-keys", "https://packages.cloud.google.com/apt/doc/apt-key.gpg"}, Privileged: true},
+		{Args: []string{"tee", "/etc/apt/sources.list.d/kubernetes.list"}, Privileged: true, Stdin: kubernetesAptSource},
+		{Args: []string{"apt-get", "update"}, Privileged: true, Env: aptEnv},
+
+		// Install kubeadm, kubelet, and kubectl
+		{Args: append([]string{"apt-get"}, aptArgs("install", "", []string{"kubelet", "kubeadm", "kubectl"})...), Privileged: true, Env: aptEnv},
+	}
+}
+
+// Function to list the steps that install kubeadm, kubelet, and kubectl with dnf or yum.
+// kubelet doesn't run under an enforcing SELinux policy yet, so an enforcing host is
+// switched to permissive, now and at boot. Hosts where SELinux is already permissive
+// or disabled, as on Amazon Linux by default, are left alone.
+func kubernetesRPMSteps(pm dnfManager) []bootstrapStep {
+	var steps []bootstrapStep
+	if mac := macStatus(context.Background()); mac.System == "selinux" && mac.Mode == "enforcing" {
+		steps = append(steps,
+			bootstrapStep{Args: []string{"setenforce", "0"}, Privileged: true},
+			bootstrapStep{Args: []string{"sed", "-i", "s/^SELINUX=enforcing$/SELINUX=permissive/", selinuxConfigFile}, Privileged: true},
+		)
+	}
+	return append(steps, []bootstrapStep{
+		{Args: []string{"tee", "/etc/yum.repos.d/kubernetes.repo"}, Privileged: true, Stdin: kubernetesYumRepo},
+		{Args: []string{pm.tool(), "install", "-y", "--disableexcludes=kubernetes", "kubelet", "kubeadm", "kubectl"}, Privileged: true},
+		{Args: []string{"systemctl", "enable", "--now", "kubelet"}, Privileged: true},
+	}...)
+}
+
+// Function to list the tools the Kubernetes installer runs with root privileges
+func kubernetesPrivilegedTools() []string {
+	var tools []string
+	seen := make(map[string]bool)
+	for _, step := range kubernetesBootstrapSteps() {
+		if step.Privileged && !seen[step.Args[0]] {
+			seen[step.Args[0]] = true
+			tools = append(tools, step.Args[0])
+		}
+	}
+	return tools
+}
+
+// Function to install and bootstrap Kubernetes as part of job, which may be nil
+func installAndBootstrapKubernetes(job *jobControl) (CommandResult, error) {
+	output := newCommandOutput(job)
+
+	// Execute each command and collect the output
+	for i, step := range kubernetesBootstrapSteps() {
+		fmt.Printf("Running command: %s\n", step) // Print command being executed
+		log.Printf("Executing: %s", step)
+		ctx, span := tracer.Start(job.context(), "kubernetes.step", trace.WithAttributes(
+			attribute.Int("cosi.step.index", i),
+			attribute.String("cosi.step", step.String()),
+		))
+		err := execCommand(ctx, step, output, job)
+		endSpan(span, err)
+		events.Emit(eventOutcome("kubernetes.step", step.String(), map[string]interface{}{"step": step.String()}, err))
+		if err != nil {
+			fmt.Printf("Error during command execution: %s\n", err)
+			return output.Result(), &bootstrapError{Step: step, Err: err}
+		}
+	}
+
+	return output.Result(), nil
+}
+
+// Helper function to execute an installer step and capture its output
+func execCommand(ctx context.Context, step bootstrapStep, output *commandOutput, job *jobControl) error {
+	var command *exec.Cmd
+	if step.Privileged {
+		command = newPrivilegedCommand(step.Env, step.Args[0], step.Args[1:]...)
+	} else {
+		command = newCommand(step.Args[0], step.Args[1:]...)
+		command.Env = append(command.Env, step.Env...)
+	}
+	if step.Stdin != "" {
+		command.Stdin = strings.NewReader(step.Stdin)
+	}
+	output.attach(command)
+
+	// Execute the command and capture stdout/stderr
+	err := job.runContext(ctx, command)
+	output.flush()
+
+	// Print the output to the application stdout
+	fmt.Printf("Output of command '%s':\n%s\n", step, output.transcript.String())
+	return err
+}
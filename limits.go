@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Body limit of endpoints that only take a small JSON request
+	defaultMaxBodyBytes = 64 << 10
+	// Largest manifest the agent will download or accept
+	defaultMaxManifestBytes = 1 << 20
+	// Largest PUT /files request; the content is base64 so files can be about 3/4 of this
+	defaultMaxFileBytes = 16 << 20
+	// Largest POST /packages/local upload, across all its files
+	defaultMaxUploadBytes = 512 << 20
+	// Most package entries a manifest may list across all its sections
+	defaultMaxManifestEntries = 5000
+
+	// A manifest is a few levels deep, so anything deeper than this isn't one
+	maxYAMLDepth = 32
+	// Nodes a YAML document may expand to once aliases are resolved
+	maxYAMLNodes = 100000
+)
+
+// LimitsConfig bounds the requests clients can send. Zero values use the defaults.
+type LimitsConfig struct {
+	MaxBodyBytes       int64 `yaml:"max_body_bytes"`
+	MaxManifestBytes   int64 `yaml:"max_manifest_bytes"`
+	MaxFileBytes       int64 `yaml:"max_file_bytes"`
+	MaxUploadBytes     int64 `yaml:"max_upload_bytes"`
+	MaxManifestEntries int   `yaml:"max_manifest_entries"`
+}
+
+// Routes that take larger bodies than the default, by method and path
+var bodyLimits = map[string]func(LimitsConfig) int64{
+	"POST /packages":         LimitsConfig.manifestBytes,
+	"POST /packages/diff":    LimitsConfig.manifestBytes,
+	"PUT /files":             LimitsConfig.fileBytes,
+	"POST /packages/local":   LimitsConfig.uploadBytes,
+	"POST /fleet/*operation": LimitsConfig.manifestBytes,
+	"POST /batch":            LimitsConfig.fileBytes,
+}
+
+// Routes whose bodies are too large to hold in memory. They're handed to the handler as
+// a stream, which fails once it reads past the limit.
+var streamedBodies = map[string]bool{
+	"POST /packages/local": true,
+}
+
+func (l LimitsConfig) bodyBytes() int64 {
+	return orDefault(l.MaxBodyBytes, defaultMaxBodyBytes)
+}
+
+func (l LimitsConfig) manifestBytes() int64 {
+	return orDefault(l.MaxManifestBytes, defaultMaxManifestBytes)
+}
+
+func (l LimitsConfig) fileBytes() int64 {
+	return orDefault(l.MaxFileBytes, defaultMaxFileBytes)
+}
+
+func (l LimitsConfig) uploadBytes() int64 {
+	return orDefault(l.MaxUploadBytes, defaultMaxUploadBytes)
+}
+
+func (l LimitsConfig) manifestEntries() int {
+	return int(orDefault(int64(l.MaxManifestEntries), defaultMaxManifestEntries))
+}
+
+// Helper function to use a default for limits that aren't configured
+func orDefault(value, fallback int64) int64 {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// Function to check the configured limits
+func (l LimitsConfig) validate() error {
+	if l.MaxBodyBytes < 0 || l.MaxManifestBytes < 0 || l.MaxFileBytes < 0 || l.MaxUploadBytes < 0 || l.MaxManifestEntries < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// Middleware to cap request bodies at the limit of their route. The body is read up
+// front so an oversized request gets a 413 before any handler starts decoding it.
+func limitRequestBody(c *gin.Context) {
+	if c.Request.Body == nil || c.Request.Body == http.NoBody {
+		c.Next()
+		return
+	}
+	limits := currentConfig().Limits
+	limit := limits.bodyBytes()
+	route := c.Request.Method + " " + c.FullPath()
+	if routeLimit, ok := bodyLimits[route]; ok {
+		limit = routeLimit(limits)
+	}
+
+	tooLarge := gin.H{"error": fmt.Sprintf("Request body is larger than the limit of %d bytes", limit), "code": "body_too_large", "limit": limit}
+	if c.Request.ContentLength > limit {
+		c.AbortWithStatusJSON(413, tooLarge)
+		return
+	}
+	if streamedBodies[route] {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		c.AbortWithStatusJSON(413, tooLarge)
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(400, gin.H{"error": "Unable to read request body: " + err.Error()})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Next()
+}
+
+// Function to reject YAML that would be too costly to decode. Each document is
+// parsed without resolving aliases, then walked with aliases followed until it proves
+// too deep or too large, so an alias bomb is caught after at most maxYAMLNodes steps.
+func checkYAMLComplexity(data []byte) error {
+	nodes := 0
+	var walk func(node *yaml.Node, depth int) error
+	walk = func(node *yaml.Node, depth int) error {
+		if depth > maxYAMLDepth {
+			return fmt.Errorf("document is nested more than %d levels deep", maxYAMLDepth)
+		}
+		if nodes++; nodes > maxYAMLNodes {
+			return fmt.Errorf("document expands to more than %d nodes", maxYAMLNodes)
+		}
+		if node.Kind == yaml.AliasNode && node.Alias != nil {
+			return walk(node.Alias, depth+1)
+		}
+		for _, child := range node.Content {
+			if err := walk(child, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// Every document of a stream counts towards the same budget
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var root yaml.Node
+		if err := decoder.Decode(&root); err != nil {
+			// Syntax errors are left to the decoding that follows, which reports them in context
+			return nil
+		}
+		if err := walk(&root, 0); err != nil {
+			return err
+		}
+	}
+}
+
+// Function to count the package entries of a manifest across all its sections
+func manifestEntries(config PackageConfig) int {
+	count := len(config.Packages.Installed) + len(config.Packages.Uninstalled) + len(config.Skipped)
+	count += len(config.PackageGroups.Install) + len(config.PackageGroups.Remove)
+	count += len(config.Modules.Enable) + len(config.Modules.Disable) + len(config.Modules.Reset)
+	for _, manager := range appManagers {
+		section := manager.Section(config)
+		count += len(section.Install) + len(section.Remove)
+	}
+	return count
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckYAMLComplexity(t *testing.T) {
+	tests := []struct {
+		fixture string
+		wantErr string
+	}{
+		{"alias-bomb.yaml", "expands to more than"},
+		{"deep.yaml", "nested more than"},
+		{"anchors.yaml", ""},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		err := checkYAMLComplexity(readFixture(t, "manifests", tt.fixture))
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: checking took %v", tt.fixture, elapsed)
+		}
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: err = %v, want %q", tt.fixture, err, tt.wantErr)
+		}
+	}
+
+	// Anchors still work in a manifest that isn't a bomb
+	manifest, err := parseManifest(readFixture(t, "manifests", "anchors.yaml"))
+	if err != nil || strings.Join(manifest.Snaps.Remove, ",") != "containerd" {
+		t.Errorf("manifest = %+v, %v", manifest, err)
+	}
+	var mErr *manifestError
+	if _, err := parseManifest(readFixture(t, "manifests", "alias-bomb.yaml")); !errors.As(err, &mErr) || mErr.Code != "manifest_too_complex" {
+		t.Errorf("parseManifest(alias bomb) = %v, want manifest_too_complex", err)
+	}
+}
+
+// Helper function to build an engine taking manifests like POST /packages/diff does
+func manifestEngine() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(limitRequestBody)
+	r.POST("/packages/diff", func(c *gin.Context) {
+		manifest, _, ok := bindManifest(c)
+		if !ok {
+			return
+		}
+		c.JSON(200, manifest.Packages)
+	})
+	r.GET("/version", func(c *gin.Context) {
+		c.JSON(200, gin.H{"version": version})
+	})
+	return r
+}
+
+// A burst of alias bombs is refused without tying up the agent: other requests are
+// answered promptly while the bombs are being rejected
+func TestAliasBombsKeepServerResponsive(t *testing.T) {
+	withConfig(t, &Config{})
+	server := httptest.NewServer(manifestEngine())
+	defer server.Close()
+	bomb := string(readFixture(t, "manifests", "alias-bomb.yaml"))
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 16)
+	for i := 0; i < cap(statuses); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Post(server.URL+"/packages/diff", "application/yaml", strings.NewReader(bomb))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		start := time.Now()
+		resp, err := http.Get(server.URL + "/version")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if elapsed := time.Since(start); resp.StatusCode != 200 || elapsed > time.Second {
+			t.Errorf("GET /version during the bombs: %d after %v", resp.StatusCode, elapsed)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("alias bombs were still being processed after 10s")
+	}
+	close(statuses)
+	for status := range statuses {
+		if status != 400 {
+			t.Errorf("alias bomb got %d, want 400", status)
+		}
+	}
+}
+
+func TestRequestBodyLimits(t *testing.T) {
+	withConfig(t, &Config{Limits: LimitsConfig{MaxManifestBytes: 1024}})
+	r := manifestEngine()
+
+	for _, tt := range []struct {
+		body string
+		want int
+	}{
+		{string(readFixture(t, "manifests", "anchors.yaml")), 200},
+		{"packages:\n  installed:\n" + strings.Repeat("    - curl\n", 200), 413},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/packages/diff", strings.NewReader(tt.body)))
+		if w.Code != tt.want {
+			t.Errorf("%d byte manifest = %d %s, want %d", len(tt.body), w.Code, w.Body, tt.want)
+		}
+	}
+
+	// Routes without a larger limit get the default
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/version", strings.NewReader(strings.Repeat("x", defaultMaxBodyBytes+1))))
+	if w.Code != 413 || !strings.Contains(w.Body.String(), "body_too_large") {
+		t.Errorf("oversized body = %d %s, want 413", w.Code, w.Body)
+	}
+}
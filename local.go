@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Most package files one POST /packages/local may upload
+const maxLocalPackageFiles = 32
+
+// Scope of the tokens that may install uploaded package files, whose maintainer scripts
+// run as root
+const scopeLocalPackages = "packages-local"
+
+// localInstaller is implemented by package managers that can install package files from
+// disk while still resolving their dependencies from the configured repositories
+type localInstaller interface {
+	// PackageFileExtension is the extension of the host's package files, like .deb
+	PackageFileExtension() string
+	// InspectCommand prints the name and version of a package file separated by a tab, and
+	// fails when the file isn't a valid package
+	InspectCommand(path string) *exec.Cmd
+	// LocalInstallCommand installs package files by their absolute paths
+	LocalInstallCommand(paths []string) *exec.Cmd
+}
+
+func (aptManager) PackageFileExtension() string { return ".deb" }
+
+func (aptManager) InspectCommand(path string) *exec.Cmd {
+	return newCommand("dpkg-deb", "--show", "--showformat=${Package}\t${Version}\n", path)
+}
+
+// apt-get treats arguments containing a slash as files rather than package names
+func (aptManager) LocalInstallCommand(paths []string) *exec.Cmd {
+	return aptCommand(PackageConfig{}, "install", paths)
+}
+
+func (dnfManager) PackageFileExtension() string { return ".rpm" }
+
+func (dnfManager) InspectCommand(path string) *exec.Cmd {
+	return newCommand("rpm", "-qp", "--queryformat", "%{NAME}\t%{VERSION}-%{RELEASE}\n", path)
+}
+
+func (m dnfManager) LocalInstallCommand(paths []string) *exec.Cmd {
+	return newPrivilegedCommand(nil, m.tool(), append([]string{"install", "-y"}, paths...)...)
+}
+
+// PackageFile is an uploaded package file and the outcome of its verification
+type PackageFile struct {
+	File      string `json:"file"`
+	SizeBytes int64  `json:"size_bytes"`
+	SHA256    string `json:"sha256"`
+	Valid     bool   `json:"valid"`
+	// Package and Version are read from the file's metadata
+	Package string `json:"package,omitempty"`
+	Version string `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+	path    string
+}
+
+// Function to save the files of a multipart upload to dir. Files without the host's
+// package extension are refused before anything is written; form fields that aren't
+// files are ignored.
+func receivePackageFiles(request *http.Request, dir, extension string) ([]PackageFile, error) {
+	reader, err := request.MultipartReader()
+	if err != nil {
+		return nil, &requestError{Status: 400, Code: "invalid_upload", Message: "The request must be a multipart/form-data upload of package files"}
+	}
+	var files []PackageFile
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, uploadError(err)
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		file, err := savePackageFile(part, dir, extension, files)
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		return nil, &requestError{Status: 400, Code: "invalid_upload", Message: "The upload doesn't contain any package files"}
+	}
+	return files, nil
+}
+
+// Helper function to write one uploaded file to dir, checking its name against the files
+// received before it
+func savePackageFile(part *multipart.Part, dir, extension string, received []PackageFile) (PackageFile, error) {
+	name := filepath.Base(part.FileName())
+	if name == "." || name == ".." || name == "/" || strings.HasPrefix(name, ".") {
+		return PackageFile{}, &requestError{Status: 400, Code: "invalid_upload", Message: fmt.Sprintf("Invalid file name %q", part.FileName())}
+	}
+	if !strings.EqualFold(filepath.Ext(name), extension) {
+		return PackageFile{}, &requestError{Status: 400, Code: "wrong_package_format", Message: fmt.Sprintf("%s is not a %s file, the package format of this host", name, extension)}
+	}
+	if len(received) == maxLocalPackageFiles {
+		return PackageFile{}, &requestError{Status: 400, Code: "invalid_upload", Message: fmt.Sprintf("At most %d package files can be uploaded at once", maxLocalPackageFiles)}
+	}
+	for _, file := range received {
+		if file.File == name {
+			return PackageFile{}, &requestError{Status: 400, Code: "invalid_upload", Message: fmt.Sprintf("%s is uploaded more than once", name)}
+		}
+	}
+
+	path := filepath.Join(dir, name)
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return PackageFile{}, err
+	}
+	defer out.Close()
+	digest := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, digest), part)
+	if err != nil {
+		return PackageFile{}, uploadError(err)
+	}
+	return PackageFile{File: name, SizeBytes: size, SHA256: hex.EncodeToString(digest.Sum(nil)), path: path}, nil
+}
+
+// Helper function to turn a failure to read the upload into a request error
+func uploadError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return &requestError{Status: 413, Code: "body_too_large", Message: fmt.Sprintf("Request body is larger than the limit of %d bytes", maxBytesErr.Limit)}
+	}
+	return &requestError{Status: 400, Code: "invalid_upload", Message: "Unable to read the upload: " + err.Error()}
+}
+
+// Function to read the name and version of each package file, marking the files that
+// aren't valid packages. It reports whether all of them are.
+func inspectPackageFiles(installer localInstaller, files []PackageFile) bool {
+	valid := true
+	for i := range files {
+		output, err := runCommand(installer.InspectCommand(files[i].path))
+		fields := strings.SplitN(strings.TrimSpace(output.Stdout), "\t", 2)
+		switch {
+		case err != nil:
+			files[i].Error = strings.TrimSpace(output.Stderr)
+			if files[i].Error == "" {
+				files[i].Error = err.Error()
+			}
+		case len(fields) != 2 || fields[0] == "":
+			files[i].Error = "the package metadata has no name and version"
+		default:
+			files[i].Valid = true
+			files[i].Package, files[i].Version = fields[0], fields[1]
+		}
+		valid = valid && files[i].Valid
+	}
+	return valid
+}
+
+// Function to install package files as part of a job, recording the package versions
+// before and after so the job can be rolled back. Callers must hold packageLock.
+func installPackageFilesForJob(job *Job, pm packageManager, installer localInstaller, files []PackageFile) (CommandResult, error) {
+	control := jobs.Control(job)
+	defer control.Close()
+	defer installedPackages.Invalidate()
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = file.path
+	}
+	var result CommandResult
+	var err error
+	snapshotJob(job, pm, func() {
+		cmd := installer.LocalInstallCommand(paths)
+		if result, err = runJobCommand(cmd, control); err != nil {
+			err = &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+		}
+	})
+	return result, err
+}
+
+// Helper function to describe an upload in job summaries
+func packageFilesSummary(files []PackageFile) string {
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.Package + " " + file.Version
+	}
+	return fmt.Sprintf("install %d package files: %s", len(files), strings.Join(names, ", "))
+}
+
+// Function to register the endpoint that installs uploaded package files
+func registerLocalPackageRoutes(r *gin.Engine) {
+	// Define the /packages/local endpoint that installs package files uploaded as
+	// multipart/form-data, for hosts whose repositories don't carry them. Dependencies are
+	// still resolved from the repositories, and the uploads are deleted afterwards.
+	r.POST("/packages/local", requireScope(scopeLocalPackages), func(c *gin.Context) {
+		pm, err := hostPackageManager()
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Unsupported operating system"})
+			return
+		}
+		if err := checkWritable(pm); err != nil {
+			respondFailure(c, "Unsupported operation", err)
+			return
+		}
+		installer, ok := pm.(localInstaller)
+		if !ok {
+			c.JSON(400, gin.H{"error": "Package files can't be installed with " + pm.Name(), "code": "unsupported_operation"})
+			return
+		}
+		lockWait, ok := lockWaitParam(c)
+		if !ok {
+			return
+		}
+
+		dir, err := os.MkdirTemp("", "cosi-packages-")
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Unable to store the upload: " + err.Error()})
+			return
+		}
+		defer os.RemoveAll(dir)
+		// apt reads local files as its unprivileged _apt user
+		os.Chmod(dir, 0755)
+		files, err := receivePackageFiles(c.Request, dir, installer.PackageFileExtension())
+		if err != nil {
+			respondFailure(c, "Unable to store the upload", err)
+			return
+		}
+		if !inspectPackageFiles(installer, files) {
+			c.JSON(422, gin.H{"error": "Some of the uploaded files aren't valid packages", "code": "invalid_package_file", "files": files})
+			return
+		}
+		summary := packageFilesSummary(files)
+
+		job := jobs.New(c.Request.Context(), "packages")
+		packageLock.Lock()
+		if !jobs.Start(job) {
+			packageLock.Unlock()
+			respondJobCancelled(c, job)
+			return
+		}
+		waited, err := awaitPackageManager(c.Request.Context(), job, pm, lockWait, summary)
+		if err != nil {
+			packageLock.Unlock()
+			c.Header("X-Cosi-Job-Id", job.ID)
+			respondFailure(c, "Unable to start the transaction", err)
+			return
+		}
+		result, err := installPackageFilesForJob(job, pm, installer, files)
+		packageLock.Unlock()
+		jobs.Finish(job, result, summary, err)
+		c.Header("X-Cosi-Job-Id", job.ID)
+		if err != nil {
+			respondFailure(c, "Failed to install the package files", err)
+			return
+		}
+		response := gin.H{"job_id": job.ID, "files": files, "install": result}
+		if waited != nil {
+			response["lock_wait"] = waited
+		}
+		c.JSON(200, response)
+	})
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Locales glibc can generate on Debian-family hosts, one "name charset" per line
+const supportedLocalesFile = "/usr/share/i18n/SUPPORTED"
+
+// Locales locale-gen generates, in the same format as supportedLocalesFile
+const localeGenFile = "/etc/locale.gen"
+
+// Most near matches suggested for an unknown locale or keymap
+const maxLocaleSuggestions = 5
+
+// A locale name like en_US.UTF-8 or sr_RS@latin, and a keymap name like de-latin1
+var (
+	localeNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*(\.[A-Za-z0-9-]+)?(@[A-Za-z0-9]+)?$`)
+	keymapNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+)
+
+// LocaleStatus is the system locale and keyboard configuration
+type LocaleStatus struct {
+	Lang string `json:"lang"`
+	// Variables are the other locale variables that are set, like LC_TIME
+	Variables map[string]string `json:"variables"`
+	// Keymap is the keymap of the virtual console
+	Keymap     string `json:"keymap,omitempty"`
+	X11Layout  string `json:"x11_layout,omitempty"`
+	X11Model   string `json:"x11_model,omitempty"`
+	X11Variant string `json:"x11_variant,omitempty"`
+	X11Options string `json:"x11_options,omitempty"`
+	// Source is localectl, or files when the configuration files were read directly
+	Source string `json:"source"`
+}
+
+// LocaleRequest is the body of POST /locale
+type LocaleRequest struct {
+	Lang   string `json:"lang"`
+	Keymap string `json:"keymap"`
+	// Generate generates the locale with locale-gen when it isn't available yet
+	Generate bool `json:"generate"`
+}
+
+// Function to read the locale and keyboard configuration, through localectl when systemd
+// runs and from the configuration files otherwise
+func readLocale(ctx context.Context) (*LocaleStatus, error) {
+	if capabilities.Get().InitSystem.Systemd {
+		if _, err := exec.LookPath("localectl"); err == nil {
+			cmd := newCommand("localectl", "status")
+			result, err := runCommandContext(ctx, cmd)
+			if err != nil {
+				return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+			}
+			return parseLocalectlStatus(result.Output), nil
+		}
+	}
+	return readLocaleFiles(), nil
+}
+
+// Function to parse `localectl status`, whose locale variables continue on unlabelled lines:
+//
+//	System Locale: LANG=en_US.UTF-8
+//	               LC_TIME=en_GB.UTF-8
+//	    VC Keymap: us
+func parseLocalectlStatus(output string) *LocaleStatus {
+	status := &LocaleStatus{Variables: map[string]string{}, Source: "localectl"}
+	label := ""
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		value := line
+		if name, rest, ok := strings.Cut(line, ": "); ok && !strings.Contains(name, "=") {
+			label, value = name, strings.TrimSpace(rest)
+		}
+		if value == "n/a" {
+			continue
+		}
+		switch label {
+		case "System Locale":
+			if key, v, ok := strings.Cut(value, "="); ok {
+				status.setVariable(key, v)
+			}
+		case "VC Keymap":
+			status.Keymap = value
+		case "X11 Layout":
+			status.X11Layout = value
+		case "X11 Model":
+			status.X11Model = value
+		case "X11 Variant":
+			status.X11Variant = value
+		case "X11 Options":
+			status.X11Options = value
+		}
+	}
+	return status
+}
+
+// Helper function to set LANG or another locale variable
+func (s *LocaleStatus) setVariable(key, value string) {
+	if key == "LANG" {
+		s.Lang = value
+	} else if strings.HasPrefix(key, "LC_") || key == "LANGUAGE" {
+		s.Variables[key] = value
+	}
+}
+
+// Function to read the locale from /etc/locale.conf or /etc/default/locale, and the
+// keyboard from /etc/vconsole.conf and /etc/default/keyboard. Missing files are skipped.
+func readLocaleFiles() *LocaleStatus {
+	status := &LocaleStatus{Variables: map[string]string{}, Source: "files"}
+	for _, path := range []string{"/etc/default/locale", "/etc/locale.conf"} {
+		values, err := readKeyValueFile(path)
+		if err != nil {
+			continue
+		}
+		for key, value := range values {
+			status.setVariable(key, value)
+		}
+	}
+	if values, err := readKeyValueFile("/etc/vconsole.conf"); err == nil {
+		status.Keymap = values["KEYMAP"]
+	}
+	if values, err := readKeyValueFile("/etc/default/keyboard"); err == nil {
+		status.X11Layout = values["XKBLAYOUT"]
+		status.X11Model = values["XKBMODEL"]
+		status.X11Variant = values["XKBVARIANT"]
+		status.X11Options = values["XKBOPTIONS"]
+	}
+	return status
+}
+
+// Helper function to normalize a locale name the way glibc does when looking it up, so
+// en_US.UTF-8 and en_US.utf8 compare equal
+func normalizeLocale(name string) string {
+	base, modifier, _ := strings.Cut(name, "@")
+	if lang, charset, ok := strings.Cut(base, "."); ok {
+		base = lang + "." + strings.ToLower(strings.ReplaceAll(charset, "-", ""))
+	}
+	if modifier != "" {
+		return base + "@" + modifier
+	}
+	return base
+}
+
+// Function to list the locales that are available, as `locale -a` reports them
+func availableLocales(ctx context.Context) ([]string, error) {
+	cmd := newCommand("locale", "-a")
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	return strings.Fields(result.Output), nil
+}
+
+// Function to read the locales locale-gen can generate, keyed by their normalized name,
+// with the "name charset" entry /etc/locale.gen takes. It returns nil on hosts that don't
+// generate locales with locale-gen, like Fedora, whose locales come from glibc-langpack
+// packages.
+func generatableLocales() map[string]string {
+	if _, err := exec.LookPath("locale-gen"); err != nil {
+		return nil
+	}
+	lines, err := readLines(supportedLocalesFile)
+	if err != nil {
+		return nil
+	}
+	locales := make(map[string]string)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		locales[normalizeLocale(fields[0])] = fields[0] + " " + fields[1]
+	}
+	return locales
+}
+
+// Function to check that a locale is available. When it isn't but locale-gen can generate
+// it and generate is set, it returns the /etc/locale.gen entry to generate; otherwise the
+// error suggests near matches.
+func checkLocale(ctx context.Context, lang string, generate bool) (string, error) {
+	if !localeNamePattern.MatchString(lang) {
+		return "", &requestError{Status: 400, Code: "invalid_locale", Message: fmt.Sprintf("%q is not a locale name like en_US.UTF-8", lang)}
+	}
+	available, err := availableLocales(ctx)
+	if err != nil {
+		return "", err
+	}
+	want := normalizeLocale(lang)
+	for _, name := range available {
+		if normalizeLocale(name) == want {
+			return "", nil
+		}
+	}
+
+	generatable := generatableLocales()
+	if entry, ok := generatable[want]; ok {
+		if !generate {
+			return "", &responseError{400, gin.H{
+				"error":       fmt.Sprintf("Locale %s is not generated; set generate to true to generate it", lang),
+				"code":        "locale_not_generated",
+				"locale":      lang,
+				"generatable": true,
+			}}
+		}
+		return entry, nil
+	}
+
+	candidates := available
+	for _, entry := range generatable {
+		name, _, _ := strings.Cut(entry, " ")
+		candidates = append(candidates, name)
+	}
+	return "", &responseError{400, gin.H{
+		"error":       fmt.Sprintf("Locale %s is not available on this host", lang),
+		"code":        "unknown_locale",
+		"locale":      lang,
+		"generatable": false,
+		"suggestions": nearMatches(lang, candidates, normalizeLocale),
+	}}
+}
+
+// Function to generate a locale with locale-gen, enabling its entry in /etc/locale.gen
+// first. A commented-out entry is uncommented, and a missing one appended.
+func generateLocale(ctx context.Context, entry string) error {
+	pattern := strings.ReplaceAll(entry, ".", `\.`)
+	cmd := newPrivilegedCommand(nil, "sed", "-i", "-E", `s/^#[[:space:]]*(`+pattern+`)[[:space:]]*$/\1/`, localeGenFile)
+	if result, err := runCommandContext(ctx, cmd); err != nil {
+		return &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	enabled := false
+	if lines, err := readLines(localeGenFile); err == nil {
+		for _, line := range lines {
+			if strings.Join(strings.Fields(line), " ") == entry {
+				enabled = true
+				break
+			}
+		}
+	}
+	if !enabled {
+		cmd := newPrivilegedCommand(nil, "sed", "-i", "$a "+entry, localeGenFile)
+		if result, err := runCommandContext(ctx, cmd); err != nil {
+			return &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+		}
+	}
+
+	cmd = newPrivilegedCommand(nil, "locale-gen")
+	if result, err := runCommandContext(ctx, cmd); err != nil {
+		return &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	return nil
+}
+
+// Function to check that a keymap is one localectl knows
+func checkKeymap(ctx context.Context, keymap string) error {
+	if !keymapNamePattern.MatchString(keymap) {
+		return &requestError{Status: 400, Code: "invalid_keymap", Message: fmt.Sprintf("%q is not a keymap name like de or de-latin1", keymap)}
+	}
+	cmd := newCommand("localectl", "list-keymaps", "--no-pager")
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	keymaps := strings.Fields(result.Output)
+	for _, name := range keymaps {
+		if name == keymap {
+			return nil
+		}
+	}
+	return &responseError{400, gin.H{
+		"error":       fmt.Sprintf("Keymap %s is not available on this host", keymap),
+		"code":        "unknown_keymap",
+		"keymap":      keymap,
+		"suggestions": nearMatches(keymap, keymaps, strings.ToLower),
+	}}
+}
+
+// Function to pick the candidates closest to name by edit distance after normalize, the
+// closest first. Candidates that are too far off to be a typo are left out.
+func nearMatches(name string, candidates []string, normalize func(string) string) []string {
+	type match struct {
+		name     string
+		distance int
+	}
+	want := strings.ToLower(normalize(name))
+	limit := len(want)/3 + 1
+	seen := make(map[string]bool)
+	var matches []match
+	for _, candidate := range candidates {
+		if seen[candidate] {
+			continue
+		}
+		seen[candidate] = true
+		if distance := editDistance(want, strings.ToLower(normalize(candidate))); distance <= limit {
+			matches = append(matches, match{candidate, distance})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].name < matches[j].name
+	})
+	suggestions := []string{}
+	for i := 0; i < len(matches) && i < maxLocaleSuggestions; i++ {
+		suggestions = append(suggestions, matches[i].name)
+	}
+	return suggestions
+}
+
+// Helper function to compute the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// Function to apply a locale and keymap request through localectl, generating the locale
+// first when asked to. Everything is validated before anything changes. It returns whether
+// the locale was generated.
+func applyLocale(ctx context.Context, request LocaleRequest) (bool, error) {
+	var entry string
+	if request.Lang != "" {
+		var err error
+		if entry, err = checkLocale(ctx, request.Lang, request.Generate); err != nil {
+			return false, err
+		}
+	}
+	if err := requireSystemd("setting the locale"); err != nil {
+		return false, err
+	}
+	if request.Keymap != "" {
+		if err := checkKeymap(ctx, request.Keymap); err != nil {
+			return false, err
+		}
+	}
+
+	if entry != "" {
+		if err := generateLocale(ctx, entry); err != nil {
+			return false, err
+		}
+	}
+	if request.Lang != "" {
+		cmd := newPrivilegedCommand(nil, "localectl", "set-locale", "LANG="+request.Lang)
+		if result, err := runCommandContext(ctx, cmd); err != nil {
+			return entry != "", &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+		}
+	}
+	if request.Keymap != "" {
+		cmd := newPrivilegedCommand(nil, "localectl", "set-keymap", request.Keymap)
+		if result, err := runCommandContext(ctx, cmd); err != nil {
+			return entry != "", &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+		}
+	}
+	return entry != "", nil
+}
+
+// Function to register the locale and keyboard endpoints
+func registerLocaleRoutes(r *gin.Engine) {
+	// Define the /locale endpoint that reports the system locale and keyboard layout
+	r.GET("/locale", func(c *gin.Context) {
+		status, err := readLocale(c.Request.Context())
+		if err != nil {
+			respondFailure(c, "Failed to read the locale", err)
+			return
+		}
+		c.JSON(200, status)
+	})
+
+	// Define the /locale POST endpoint that sets the system locale and console keymap. The
+	// locale must be available, or generatable when generate is set; the response reports
+	// the configuration read back after applying it.
+	r.POST("/locale", func(c *gin.Context) {
+		var request LocaleRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format"})
+			return
+		}
+		if request.Lang == "" && request.Keymap == "" {
+			c.JSON(400, gin.H{"error": "lang or keymap is required", "code": "invalid_parameter"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		previous, _ := readLocale(ctx)
+		generated, err := applyLocale(ctx, request)
+		details := map[string]interface{}{"lang": request.Lang, "keymap": request.Keymap, "generated": generated}
+		audit.Record(auditOutcome("locale.set", c.ClientIP(), details, err))
+		if err != nil {
+			respondFailure(c, "Failed to set the locale", err)
+			return
+		}
+		status, err := readLocale(ctx)
+		if err != nil {
+			respondFailure(c, "The locale was set but could not be read back", err)
+			return
+		}
+		c.JSON(200, gin.H{"locale": status, "previous": previous, "generated": generated})
+	})
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rothgar/cosi/api"
+)
+
+const (
+	// Longest wait_for_lock_seconds a request can ask for
+	maxLockWait = 15 * time.Minute
+	// Interval between checks while waiting for another package manager to finish
+	lockPollInterval = time.Second
+	// Clock ticks per second of the start times in /proc/<pid>/stat, fixed on Linux
+	procClockTicks = 100
+)
+
+// packageLocker is implemented by package managers whose transactions can be held up by
+// another process running the same tools
+type packageLocker interface {
+	// LockFiles are the files the package manager locks during a transaction
+	LockFiles() []string
+	// LockProcesses are the process names that hold the locks, as in /proc/<pid>/comm
+	LockProcesses() []string
+}
+
+// LockHolder is a process of another package manager that would block a transaction
+type LockHolder = api.LockHolder
+
+// LockWait records a transaction that had to wait for another package manager
+type LockWait = api.LockWait
+
+// lockHeldError reports another package manager still holding its locks
+type lockHeldError struct {
+	Holders []LockHolder
+	Waited  time.Duration
+}
+
+func (e *lockHeldError) Error() string {
+	holders := make([]string, len(e.Holders))
+	for i, holder := range e.Holders {
+		holders[i] = fmt.Sprintf("%s (pid %d)", holder.Command, holder.PID)
+	}
+	message := "the package manager is in use by " + strings.Join(holders, ", ")
+	if e.Waited >= time.Second {
+		message += fmt.Sprintf(" after waiting %s", e.Waited.Round(time.Second))
+	}
+	return message
+}
+
+func (aptManager) LockFiles() []string {
+	return []string{"/var/lib/dpkg/lock-frontend", "/var/lib/dpkg/lock", "/var/lib/apt/lists/lock", "/var/cache/apt/archives/lock"}
+}
+
+func (aptManager) LockProcesses() []string {
+	return []string{"apt", "apt-get", "aptitude", "dpkg", "unattended-upgr"}
+}
+
+func (dnfManager) LockFiles() []string {
+	return []string{"/usr/lib/sysimage/rpm/.rpm.lock", "/var/lib/rpm/.rpm.lock"}
+}
+
+func (dnfManager) LockProcesses() []string {
+	return []string{"dnf", "dnf5", "yum", "rpm", "dnf-automatic"}
+}
+
+func (portageManager) LockFiles() []string {
+	return nil
+}
+
+func (portageManager) LockProcesses() []string {
+	return []string{"emerge"}
+}
+
+// Function to find the processes outside the agent that would block a transaction of the
+// package manager. Lock files give the exact holder when the agent may open them; the
+// process names catch tools between taking their locks, or hosts where it may not.
+func packageLockHolders(pm packageManager) []LockHolder {
+	locker, ok := pm.(packageLocker)
+	if !ok {
+		return nil
+	}
+	var holders []LockHolder
+	seen := make(map[int]bool)
+	for _, path := range locker.LockFiles() {
+		pid := lockFileHolder(path)
+		if pid <= 0 || seen[pid] || agentDescendant(pid) {
+			continue
+		}
+		seen[pid] = true
+		holder := processHolder(pid)
+		holder.Lock = path
+		holders = append(holders, holder)
+	}
+
+	entries, _ := os.ReadDir("/proc")
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || seen[pid] {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "comm"))
+		if err != nil || !containsString(locker.LockProcesses(), strings.TrimSpace(string(comm))) || agentDescendant(pid) {
+			continue
+		}
+		seen[pid] = true
+		holders = append(holders, processHolder(pid))
+	}
+	return holders
+}
+
+// Helper function to return the process holding a POSIX lock on a file, or 0. apt, dpkg,
+// and rpm all lock with fcntl, so F_GETLK names the holder without taking the lock.
+func lockFileHolder(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 0, Len: 0}
+	if err := syscall.FcntlFlock(file.Fd(), syscall.F_GETLK, &lock); err != nil || lock.Type == syscall.F_UNLCK {
+		return 0
+	}
+	return int(lock.Pid)
+}
+
+// Helper function to check if a process was started by the agent, which runs its own
+// transactions one at a time under packageLock
+func agentDescendant(pid int) bool {
+	self := os.Getpid()
+	for pid > 1 {
+		if pid == self {
+			return true
+		}
+		parent, _, ok := procStat(pid)
+		if !ok {
+			return false
+		}
+		pid = parent
+	}
+	return false
+}
+
+// Helper function to read the parent and start time of a process from /proc/<pid>/stat
+func procStat(pid int) (int, time.Time, bool) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	// The command name can hold spaces and parentheses, so fields are counted after the last ")"
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return 0, time.Time{}, false
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 20 {
+		return 0, time.Time{}, false
+	}
+	parent, _ := strconv.Atoi(fields[1])
+	ticks, _ := strconv.ParseInt(fields[19], 10, 64)
+	boot := bootTime()
+	if boot.IsZero() {
+		return parent, time.Time{}, true
+	}
+	return parent, boot.Add(time.Duration(ticks) * time.Second / procClockTicks), true
+}
+
+// Helper function to read the boot time from /proc/stat
+func bootTime() time.Time {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "btime "); ok {
+			seconds, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			return time.Unix(seconds, 0)
+		}
+	}
+	return time.Time{}
+}
+
+// Helper function to describe a process by its command line and running time
+func processHolder(pid int) LockHolder {
+	holder := LockHolder{PID: pid}
+	if cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+		holder.Command = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+	if holder.Command == "" {
+		if comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil {
+			holder.Command = "[" + strings.TrimSpace(string(comm)) + "]"
+		}
+	}
+	if _, started, ok := procStat(pid); ok && !started.IsZero() {
+		holder.RunningSeconds = time.Since(started).Round(time.Second).Seconds()
+	}
+	return holder
+}
+
+// Function to wait up to wait for other package managers to finish. It returns the
+// holders that were waited for, or a lockHeldError when they are still running.
+func waitForPackageManager(ctx context.Context, pm packageManager, wait time.Duration) (*LockWait, error) {
+	holders := packageLockHolders(pm)
+	if len(holders) == 0 {
+		return nil, nil
+	}
+	started := time.Now()
+	deadline := started.Add(wait)
+	current := holders
+	for len(current) > 0 {
+		if !time.Now().Before(deadline) {
+			return nil, &lockHeldError{Holders: current, Waited: time.Since(started)}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, &lockHeldError{Holders: current, Waited: time.Since(started)}
+		case <-time.After(lockPollInterval):
+		}
+		current = packageLockHolders(pm)
+	}
+	return &LockWait{Holders: holders, WaitedSeconds: time.Since(started).Seconds()}, nil
+}
+
+// Helper function to wait for other package managers once job has started, finishing the
+// job when they are still running after wait. Callers must hold packageLock.
+func awaitPackageManager(ctx context.Context, job *Job, pm packageManager, wait time.Duration, summary string) (*LockWait, error) {
+	lockWait, err := waitForPackageManager(ctx, pm, wait)
+	if err != nil {
+		jobs.Finish(job, nil, summary, err)
+	}
+	return lockWait, err
+}
+
+// Helper function to read the wait_for_lock_seconds query parameter. When it returns false
+// an error response has already been sent.
+func lockWaitParam(c *gin.Context) (time.Duration, bool) {
+	value := c.Query("wait_for_lock_seconds")
+	if value == "" {
+		return 0, true
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxLockWait {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("wait_for_lock_seconds must be a number of seconds up to %d", int(maxLockWait.Seconds())), "code": "invalid_parameter"})
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Lines GET /logs/tail returns unless asked for another number, and the most it returns
+	defaultLogLines = 100
+	maxLogLines     = 10000
+	// Largest response GET /logs/tail builds unless configured otherwise
+	defaultLogMaxBytes = 1 << 20
+	// How far back from the end a grep looks for matches before giving up
+	maxLogScanBytes = 64 << 20
+	// Most a compressed log is decompressed, against gzip bombs
+	maxLogDecompressedBytes = 256 << 20
+	// Size of the reads from the end of a log, and of the sample checked for binary content
+	logChunkSize = 64 << 10
+	// How often a follow stream checks the file when inotify stays quiet, to catch rotations
+	// inotify can't report, like on network filesystems
+	logFollowPoll = 2 * time.Second
+)
+
+// Directories GET /logs/tail may read below unless configured otherwise
+var defaultLogDirs = []string{"/var/log"}
+
+// Open follow streams of GET /logs/tail, capped like /events/stream by concurrency.max_streams
+var logStreams atomic.Int64
+
+// LogsConfig restricts GET /logs/tail
+type LogsConfig struct {
+	// Dirs are the directories logs may be read from; the default is /var/log
+	Dirs []string `yaml:"dirs"`
+	// MaxBytes caps the lines of a response; older lines are dropped beyond it
+	MaxBytes int64 `yaml:"max_bytes"`
+}
+
+// Function to check the log directories
+func (l LogsConfig) validate() error {
+	for _, dir := range l.Dirs {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("logs.dirs: %q is not an absolute path", dir)
+		}
+	}
+	if l.MaxBytes < 0 {
+		return fmt.Errorf("logs.max_bytes must not be negative")
+	}
+	return nil
+}
+
+func (l LogsConfig) maxBytes() int64 {
+	return orDefault(l.MaxBytes, defaultLogMaxBytes)
+}
+
+// LogTail is the response of GET /logs/tail
+type LogTail struct {
+	Path       string   `json:"path"`
+	Size       int64    `json:"size"`
+	Compressed bool     `json:"compressed"`
+	Lines      []string `json:"lines"`
+	// Truncated is set when max_bytes dropped lines, or cut a single line short
+	Truncated bool `json:"truncated"`
+	// ScanLimited is set when a grep stopped looking before the start of the file
+	ScanLimited bool `json:"scan_limited,omitempty"`
+}
+
+// errBinaryLog is returned for files that don't look like text logs
+var errBinaryLog = errors.New("the file looks binary")
+
+// Function to return the directories logs may be read from
+func logDirs() []string {
+	if dirs := currentConfig().Logs.Dirs; len(dirs) > 0 {
+		return dirs
+	}
+	return defaultLogDirs
+}
+
+// Function to check that a requested log lies inside one of the allowed directories,
+// after resolving symlinks. It returns the resolved path.
+func allowedLogPath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", &requestError{Status: 400, Code: "invalid_parameter", Message: path + " is not an absolute path"}
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range logDirs() {
+		if resolvedDir, err := filepath.EvalSymlinks(dir); err == nil && withinDir(resolvedDir, resolved) {
+			return resolved, nil
+		}
+	}
+	return "", &responseError{403, gin.H{"error": path + " is outside the allowed log directories", "code": "path_not_allowed", "allowed_paths": logDirs()}}
+}
+
+// Helper function to check a sample of a file for content that isn't text. NUL bytes
+// don't occur in text logs, and neither do many invalid UTF-8 sequences.
+func looksBinary(sample []byte) bool {
+	if bytes.IndexByte(sample, 0) >= 0 {
+		return true
+	}
+	invalid := 0
+	for len(sample) > 0 {
+		r, size := utf8.DecodeRune(sample)
+		if r == utf8.RuneError && size <= 1 {
+			invalid++
+		}
+		sample = sample[size:]
+	}
+	return invalid > 16
+}
+
+// logLines collects the last lines of a log that match, within a byte budget
+type logLines struct {
+	want     int
+	budget   int64
+	used     int64
+	pattern  *regexp.Regexp
+	lines    []string
+	truncate bool
+}
+
+// Helper function to offer a line. It returns false once enough lines are collected or
+// the budget is spent.
+func (l *logLines) add(line string) bool {
+	if l.pattern != nil && !l.pattern.MatchString(line) {
+		return true
+	}
+	if int64(len(line)) > l.budget {
+		// A single line larger than the whole budget is cut short rather than dropped
+		line, l.truncate = line[:l.budget], true
+	}
+	if l.used+int64(len(line)) > l.budget {
+		l.truncate = true
+		return false
+	}
+	l.used += int64(len(line))
+	l.lines = append(l.lines, line)
+	return len(l.lines) < l.want
+}
+
+// Function to read the last lines of a plain log by reading backwards from its end in
+// chunks, so a large log costs about as much as the lines returned
+func tailPlainLog(file *os.File, size int64, collect *logLines) (bool, error) {
+	var partial []byte
+	offset := size
+	scanned := int64(0)
+	first := true
+	for offset > 0 {
+		if collect.pattern != nil && scanned >= maxLogScanBytes {
+			return true, nil
+		}
+		chunk := int64(logChunkSize)
+		if offset < chunk {
+			chunk = offset
+		}
+		offset -= chunk
+		buf := make([]byte, chunk, chunk+int64(len(partial)))
+		if _, err := file.ReadAt(buf, offset); err != nil && err != io.EOF {
+			return false, err
+		}
+		if first && looksBinary(buf) {
+			return false, errBinaryLog
+		}
+		scanned += chunk
+		buf = append(buf, partial...)
+
+		// The last line of the file may end in a newline, which doesn't start another line
+		if first {
+			buf = bytes.TrimSuffix(buf, []byte("\n"))
+			first = false
+		}
+		for {
+			i := bytes.LastIndexByte(buf, '\n')
+			if i < 0 {
+				break
+			}
+			if !collect.add(strings.TrimSuffix(string(buf[i+1:]), "\r")) {
+				return false, nil
+			}
+			buf = buf[:i]
+		}
+		partial = buf
+		if int64(len(partial)) > collect.budget {
+			// A line longer than the budget can't be returned whole; keep only its tail
+			partial = partial[int64(len(partial))-collect.budget:]
+		}
+	}
+	if len(partial) > 0 {
+		collect.add(strings.TrimSuffix(string(partial), "\r"))
+	}
+	return false, nil
+}
+
+// Function to read the last lines of a gzip compressed log. gzip can't be read
+// backwards, so the whole file is decompressed, keeping only the last lines.
+func tailCompressedLog(file *os.File, collect *logLines) error {
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return &requestError{Status: 422, Code: "invalid_gzip", Message: err.Error()}
+	}
+	defer reader.Close()
+	limited := &io.LimitedReader{R: reader, N: maxLogDecompressedBytes}
+	buffered := bufio.NewReaderSize(limited, logChunkSize)
+	if sample, _ := buffered.Peek(logChunkSize); looksBinary(sample) {
+		return errBinaryLog
+	}
+
+	// A ring of the last lines that match; the budget is applied once they are known
+	ring := make([]string, collect.want)
+	count := 0
+	scanner := bufio.NewScanner(buffered)
+	scanner.Buffer(make([]byte, logChunkSize), int(collect.budget)+1)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if collect.pattern != nil && !collect.pattern.MatchString(line) {
+			continue
+		}
+		ring[count%collect.want] = line
+		count++
+	}
+	switch err := scanner.Err(); {
+	case errors.Is(err, bufio.ErrTooLong):
+		// A line longer than the budget ends the read; the lines before it are returned
+		collect.truncate = true
+	case err != nil:
+		return err
+	}
+	if limited.N <= 0 {
+		collect.truncate = true
+	}
+
+	// Offer the newest line first, as tailPlainLog does
+	pattern := collect.pattern
+	collect.pattern = nil
+	defer func() { collect.pattern = pattern }()
+	for i := 0; i < min(count, collect.want); i++ {
+		if !collect.add(ring[(count-1-i)%collect.want]) {
+			break
+		}
+	}
+	return nil
+}
+
+// Function to read the last lines of an allowed log, optionally only those matching grep
+func tailLog(path string, lines int, grep *regexp.Regexp) (*LogTail, error) {
+	resolved, err := allowedLogPath(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, &requestError{Status: 400, Code: "not_a_file", Message: resolved + " is not a regular file"}
+	}
+
+	tail := &LogTail{Path: resolved, Size: info.Size(), Compressed: strings.HasSuffix(resolved, ".gz")}
+	collect := &logLines{want: lines, budget: currentConfig().Logs.maxBytes(), pattern: grep}
+	if tail.Compressed {
+		err = tailCompressedLog(file, collect)
+	} else {
+		tail.ScanLimited, err = tailPlainLog(file, info.Size(), collect)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The lines were collected newest first
+	tail.Lines = make([]string, len(collect.lines))
+	for i, line := range collect.lines {
+		tail.Lines[len(collect.lines)-1-i] = line
+	}
+	tail.Truncated = collect.truncate
+	return tail, nil
+}
+
+// logWatcher wakes a follow stream when its log's directory changes. The directory is
+// watched rather than the file so a rotation, which replaces the file, is seen too.
+type logWatcher struct {
+	file   *os.File
+	name   string
+	events chan struct{}
+}
+
+// Function to watch the directory of path with inotify
+func newLogWatcher(path string) (*logWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	mask := uint32(syscall.IN_MODIFY | syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE | syscall.IN_ATTRIB)
+	if _, err := syscall.InotifyAddWatch(fd, filepath.Dir(path), mask); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// A non-blocking descriptor goes through the runtime poller, so Close ends a pending Read
+	w := &logWatcher{file: os.NewFile(uintptr(fd), "inotify"), name: filepath.Base(path), events: make(chan struct{}, 1)}
+	go w.run()
+	return w, nil
+}
+
+// Function to read inotify events, signalling those about the watched file
+func (w *logWatcher) run() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			close(w.events)
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			nameLength := int(binary.NativeEndian.Uint32(buf[offset+12 : offset+16]))
+			start := offset + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[start:min(start+nameLength, n)], "\x00"))
+			offset = start + nameLength
+			if name == w.name {
+				select {
+				case w.events <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// Close stops watching
+func (w *logWatcher) Close() {
+	w.file.Close()
+}
+
+// logFollower reads what is appended to a log, reopening it when it is rotated
+type logFollower struct {
+	path    string
+	file    *os.File
+	offset  int64
+	partial []byte
+	limit   int64
+}
+
+// Function to read the complete lines appended since the last read. When the file was
+// replaced, lines holds the last lines of the old file and rotated those of the new one.
+// truncated is set when the file shrank, like with copytruncate.
+func (f *logFollower) read() (lines, rotated []string, truncated bool, err error) {
+	if info, err := f.file.Stat(); err == nil && info.Size() < f.offset {
+		f.offset, f.partial, truncated = 0, nil, true
+	}
+	lines = f.drain()
+
+	current, err := os.Stat(f.path)
+	if err != nil {
+		// Between the rename and the creation of the new file there is no file; wait
+		return lines, nil, truncated, nil
+	}
+	if opened, err := f.file.Stat(); err == nil && os.SameFile(opened, current) {
+		return lines, nil, truncated, nil
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return lines, nil, truncated, err
+	}
+	f.file.Close()
+	f.file, f.offset, f.partial = file, 0, nil
+	return lines, append([]string{}, f.drain()...), truncated, nil
+}
+
+// Helper function to read from the offset to the end, keeping an unfinished last line
+// for the next read
+func (f *logFollower) drain() []string {
+	var lines []string
+	buf := make([]byte, logChunkSize)
+	for {
+		n, err := f.file.ReadAt(buf, f.offset)
+		f.offset += int64(n)
+		data := append(f.partial, buf[:n]...)
+		for {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			lines = append(lines, strings.TrimSuffix(string(data[:i]), "\r"))
+			data = data[i+1:]
+		}
+		if int64(len(data)) > f.limit {
+			lines = append(lines, string(data[:f.limit]))
+			data = nil
+		}
+		f.partial = append([]byte(nil), data...)
+		if n < len(buf) || err != nil {
+			return lines
+		}
+	}
+}
+
+// Function to stream a log as server-sent events: the last lines first, then every line
+// appended, until the client goes away. Rotations and truncations are reported as events
+// of their own.
+func followLog(c *gin.Context, path string, lines int, grep *regexp.Regexp) {
+	tail, err := tailLog(path, lines, grep)
+	if err != nil {
+		respondLogFailure(c, err)
+		return
+	}
+	if tail.Compressed {
+		c.JSON(400, gin.H{"error": "follow is not supported for compressed logs", "code": "invalid_parameter"})
+		return
+	}
+	limit := int64(currentConfig().Concurrency.maxStreams())
+	if logStreams.Add(1) > limit {
+		logStreams.Add(-1)
+		c.Header("Retry-After", "30")
+		c.JSON(429, gin.H{"error": fmt.Sprintf("Too many open log streams; the limit is %d", limit), "code": "too_many_streams", "limit": limit})
+		return
+	}
+	defer logStreams.Add(-1)
+
+	file, err := os.Open(tail.Path)
+	if err != nil {
+		respondLogFailure(c, err)
+		return
+	}
+	follower := &logFollower{path: tail.Path, file: file, offset: tail.Size, limit: currentConfig().Logs.maxBytes()}
+	defer func() { follower.file.Close() }()
+	watcher, err := newLogWatcher(tail.Path)
+	if err != nil {
+		respondFailure(c, "Failed to watch the log", err)
+		return
+	}
+	defer watcher.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+
+	send := func(event string, value interface{}) bool {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return true
+		}
+		_, err = fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, data)
+		c.Writer.Flush()
+		return err == nil
+	}
+	sendLines := func(lines []string) bool {
+		for _, line := range lines {
+			if grep != nil && !grep.MatchString(line) {
+				continue
+			}
+			if !send("line", gin.H{"line": line}) {
+				return false
+			}
+		}
+		return true
+	}
+	if !sendLines(tail.Lines) {
+		return
+	}
+
+	poll := time.NewTicker(logFollowPoll)
+	defer poll.Stop()
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case _, ok := <-watcher.events:
+			if !ok {
+				return
+			}
+		case <-poll.C:
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(c.Writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+			continue
+		}
+
+		lines, rotated, truncated, err := follower.read()
+		if truncated && !send("truncated", gin.H{"path": follower.path}) {
+			return
+		}
+		if !sendLines(lines) {
+			return
+		}
+		if err != nil {
+			send("error", gin.H{"error": err.Error()})
+			return
+		}
+		if rotated != nil && (!send("rotated", gin.H{"path": follower.path}) || !sendLines(rotated)) {
+			return
+		}
+	}
+}
+
+// Helper function to answer a failed log read
+func respondLogFailure(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errBinaryLog):
+		c.JSON(415, gin.H{"error": "Refusing to tail a binary file", "code": "binary_file"})
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(404, gin.H{"error": err.Error(), "code": "file_not_found"})
+	case errors.Is(err, os.ErrPermission):
+		c.JSON(403, gin.H{"error": err.Error(), "code": "permission_denied"})
+	default:
+		respondFailure(c, "Failed to read the log", err)
+	}
+}
+
+// Function to register the log endpoints
+func registerLogRoutes(r *gin.Engine) {
+	// Define the /logs/tail endpoint that returns the last lines of a log file outside the
+	// journal, or streams new lines as server-sent events with follow=true
+	r.GET("/logs/tail", func(c *gin.Context) {
+		path := c.Query("path")
+		if path == "" {
+			c.JSON(400, gin.H{"error": "path is required", "code": "invalid_parameter"})
+			return
+		}
+		lines := defaultLogLines
+		if value := c.Query("lines"); value != "" {
+			var err error
+			if lines, err = strconv.Atoi(value); err != nil || lines < 1 || lines > maxLogLines {
+				c.JSON(400, gin.H{"error": fmt.Sprintf("lines must be a number from 1 to %d", maxLogLines), "code": "invalid_parameter"})
+				return
+			}
+		}
+		var grep *regexp.Regexp
+		if value := c.Query("grep"); value != "" {
+			var err error
+			if grep, err = regexp.Compile(value); err != nil {
+				c.JSON(400, gin.H{"error": "grep is not a valid regular expression: " + err.Error(), "code": "invalid_parameter"})
+				return
+			}
+		}
+
+		if c.Query("follow") == "true" {
+			followLog(c, path, lines, grep)
+			return
+		}
+		tail, err := tailLog(path, lines, grep)
+		if err != nil {
+			respondLogFailure(c, err)
+			return
+		}
+		c.JSON(200, tail)
+	})
+}
@@ -2,48 +2,132 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rothgar/cosi/api"
 )
 
-type PackageConfig struct {
-	Packages struct {
-		Installed   []string `yaml:"installed"`
-		Uninstalled []string `yaml:"uninstalled"`
-	} `yaml:"packages"`
-}
-
 func main() {
-	r := gin.Default()
-
-	// Define the /os endpoint
-	r.GET("/os", func(c *gin.Context) {
-		data, err := readOSReleaseFile("/etc/os-release")
+	// Service management subcommands run instead of the agent
+	if handled, err := runSubcommand(os.Args[1:]); handled {
 		if err != nil {
-			c.JSON(500, gin.H{"error": "Unable to read /etc/os-release file"})
-			return
+			log.Fatalf("%s: %v", os.Args[1], err)
 		}
-		c.JSON(200, data)
-	})
+		return
+	}
+
+	listenAddr := flag.String("listen", ":80", "Address the HTTP server listens on")
+	configPath := flag.String("config", "", "Path to the YAML configuration file")
+	flag.BoolVar(&sudoMode, "sudo", false, "Run commands that need root through sudo -n when not running as root")
+	flag.StringVar(&stateDir, "state-dir", stateDir, "Directory for the audit log and other persistent state")
+	flag.BoolVar(&rawOutput, "raw-output", false, "Keep command output as is instead of stripping escape sequences and collapsing progress lines")
+	flag.BoolVar(&debugEnabled, "enable-debug", false, "Serve pprof and runtime details under /debug to tokens with the admin scope")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
+	log.Printf("Starting %s", versionInfo())
 
-	// Define the /uname endpoint
-	r.GET("/uname", func(c *gin.Context) {
-		output, err := getUnameOutput()
+	if *configPath != "" {
+		cfg, err := loadConfig(*configPath)
 		if err != nil {
-			c.JSON(500, gin.H{"error": "Unable to get uname output"})
-			return
+			log.Fatalf("Failed to load config: %v", err)
 		}
-		c.JSON(200, output)
+		setConfig(*configPath, cfg)
+	}
+	config := currentConfig()
+	loadInstanceID()
+	if err := setupTracing(config.Tracing); err != nil {
+		log.Printf("Warning: tracing is disabled: %v", err)
+	}
+	loadEvents()
+	// Before the jobs, so the requeued ones are held when the agent is in maintenance mode
+	maintenance.Load()
+	loadJobs()
+	schedules.Load()
+	schedules.Start()
+	packageSnapshots.Load()
+
+	webhooks.Configure(config.Webhooks)
+	webhooks.Start()
+	watchReloadSignal()
+
+	// Start converging on the desired package manifest when one is configured
+	if config.Reconcile.SourceURL != "" {
+		reconcileLoop = newReconciler(config.Reconcile)
+		reconcileLoop.Start()
+	}
+
+	// Announce this host to the controller when one is configured
+	if config.Registration.ControllerURL != "" {
+		registration = newRegistrar(config.Registration, *listenAddr)
+		registration.Start()
+	}
+
+	// Detect what this host supports once at startup
+	capabilities.Refresh()
+	hostInfoCached.Load()
+
+	if err := openAccessLog(config.AccessLog); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	watchReopenSignal()
+
+	r := gin.New()
+	r.Use(gin.Recovery())
+	if err := configureTrustedProxies(r, currentConfig().Allowlist); err != nil {
+		log.Fatalf("Failed to set trusted proxies: %v", err)
+	}
+
+	// Log every request under an ID the client can quote
+	r.Use(assignRequestID)
+	r.Use(logRequests)
+	// Trace every request, joining the caller's trace when it sends traceparent
+	r.Use(traceRequests)
+
+	// Identify the agent build on every response
+	r.Use(func(c *gin.Context) {
+		c.Header("Server", "cosi/"+version)
+		c.Next()
 	})
 
+	// Compress large responses for clients that accept gzip
+	r.Use(compressResponses)
+	// Wrap JSON responses in the host envelope for clients that ask, refusals included
+	r.Use(envelopeResponses)
+	// Refuse addresses outside the allowlist before any handler runs
+	r.Use(enforceAllowlist)
+	// Refuse requests that could change the host while maintenance mode is on
+	r.Use(refuseInMaintenance)
+	// Refuse request bodies over the limit of their route
+	r.Use(limitRequestBody)
+	// Authenticate signed requests, and refuse unsigned ones when signing is required
+	r.Use(verifySignature)
+
+	// Define the /version endpoint
+	r.GET("/version", func(c *gin.Context) {
+		c.JSON(200, versionInfo())
+	})
+
+	registerHostInfoRoutes(r)
+
 	// Define the /systemctl/status endpoint
 	r.POST("/systemctl/status", func(c *gin.Context) {
 		var request struct {
@@ -56,24 +140,40 @@ func main() {
 			return
 		}
 
+		// Without systemd, list the SysV services when the service command is there;
+		// failed units have no SysV counterpart
+		if host := capabilities.Get().InitSystem; !host.Systemd {
+			if request.Failed || !host.ServiceCommand {
+				respondFailure(c, "", requireSystemd("POST /systemctl/status"))
+				return
+			}
+			services, err := sysvServices(c.Request.Context())
+			if err != nil {
+				respondFailure(c, "Failed to list services", err)
+				return
+			}
+			c.JSON(200, gin.H{"init_system": host.Name, "services": services})
+			return
+		}
+
 		// Prepare the systemctl command based on the request
 		var cmd *exec.Cmd
 		if request.Failed {
-			cmd = exec.Command("systemctl", "status", "--failed", "--no-pager")
+			cmd = newCommand("systemctl", "status", "--failed", "--no-pager")
 		} else {
-			cmd = exec.Command("systemctl", "status", "--no-pager")
+			cmd = newCommand("systemctl", "status", "--no-pager")
 		}
 
 		// Execute the command
-		output, err := cmd.Output()
+		result, err := runCommandContext(c.Request.Context(), cmd)
 		if err != nil {
-			c.JSON(500, gin.H{"error": "Failed to execute systemctl command"})
+			respondCommandError(c, "systemctl", "Failed to execute systemctl command", result, err)
 			return
 		}
 
 		// Parse the command output as JSON
 		var jsonResponse interface{}
-		if err := json.Unmarshal(output, &jsonResponse); err != nil {
+		if err := json.Unmarshal([]byte(result.Stdout), &jsonResponse); err != nil {
 			c.JSON(500, gin.H{"error": "Failed to parse JSON output from systemctl"})
 			return
 		}
@@ -84,98 +184,756 @@ func main() {
 
 	// Define the /packages endpoint that accepts a YAML file
 	r.POST("/packages", func(c *gin.Context) {
-		// Read the YAML file
-		var packageConfig PackageConfig
-		if err := c.ShouldBindYAML(&packageConfig); err != nil {
-			c.JSON(400, gin.H{"error": "Invalid YAML format"})
+		// Read the YAML file, or download it when the body references a source URL
+		packageConfig, source, ok := bindManifest(c)
+		if !ok {
+			return
+		}
+		lockWait, ok := lockWaitParam(c)
+		if !ok {
+			return
+		}
+		response, job, err := applyManifestJob(c.Request.Context(), packageConfig, source, lockWait, nil)
+		if job != nil {
+			c.Header("X-Cosi-Job-Id", job.ID)
+		}
+		if err != nil {
+			respondFailure(c, "Failed to apply packages", err)
+			return
+		}
+		c.JSON(200, response)
+	})
+
+	// Define the /packages GET endpoint that returns a list of installed packages.
+	// ?manager=snap or flatpak lists those instead, and all adds them to the system packages.
+	// ?groups=true adds the installed package groups on RPM hosts.
+	// The system list carries an ETag derived from the package cache generation, so a
+	// matching If-None-Match is answered without running the package manager.
+	r.GET("/packages", func(c *gin.Context) {
+		// ?since= is GET /packages/diff-since, for pollers moving to changes only
+		if since := c.Query("since"); since != "" {
+			respondDiffSince(c, since)
+			return
+		}
+		manager := c.DefaultQuery("manager", "system")
+		if manager != "system" && manager != "all" {
+			app := appManagerNamed(manager)
+			if app == nil {
+				c.JSON(400, gin.H{"error": "manager must be system, snap, flatpak, or all"})
+				return
+			}
+			if !app.Available() {
+				c.JSON(404, gin.H{"error": manager + " is not available on this host", "code": "manager_not_available"})
+				return
+			}
+			renderList(c, listView[InstalledPackage]{
+				Columns: []string{"NAME", "VERSION", "CHANNEL", "SOURCE"},
+				Cells: func(p InstalledPackage) []string {
+					return []string{p.Name, p.Version, p.Channel, p.Publisher + p.Origin}
+				},
+				Rows: func(emit func(InstalledPackage) error) error {
+					packages, err := app.List(c.Request.Context())
+					if err != nil {
+						return err
+					}
+					for _, p := range packages {
+						if err := emit(p); err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+				JSON: func(packages []InstalledPackage) {
+					c.JSON(200, gin.H{"manager": manager, "packages": packages})
+				},
+				Failure: "Failed to list " + manager + " packages",
+			})
+			return
+		}
+
+		osReleaseData, err := readOSReleaseFile("/etc/os-release")
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Unable to determine the operating system"})
+			return
+		}
+
+		pm := packageManagerFor(osReleaseData)
+		if pm == nil {
+			c.JSON(400, gin.H{"error": "Unsupported operating system"})
+			return
+		}
+
+		// Groups are listed next to the packages, or the reason they can't be
+		withGroups := c.Query("groups") == "true"
+		addGroups := func(response gin.H) {
+			if !withGroups {
+				return
+			}
+			groups, warning := packageGroups(c.Request.Context(), pm)
+			if warning != "" {
+				response["groups_warning"] = warning
+				return
+			}
+			response["installed_groups"] = groups
+		}
+
+		if manager == "system" {
+			generation := installedPackages.Generation(pm)
+			etag := entityTag("packages", generation, listFormat(c), strconv.FormatBool(withGroups))
+			if notModified(c, etag, installedPackages.CollectedAt(generation)) {
+				return
+			}
+			renderList(c, listView[InstalledPackage]{
+				Columns: []string{"NAME"},
+				Cells:   func(p InstalledPackage) []string { return []string{p.Name} },
+				Rows: func(emit func(InstalledPackage) error) error {
+					packageList, collectedAt, err := installedPackages.List(c.Request.Context(), pm)
+					if err != nil {
+						return err
+					}
+					c.Header("Last-Modified", collectedAt.Format(http.TimeFormat))
+					for _, name := range packageList {
+						if err := emit(InstalledPackage{Name: name, Manager: "system"}); err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+				JSON: func(packages []InstalledPackage) {
+					names := make([]string, len(packages))
+					for i, p := range packages {
+						names[i] = p.Name
+					}
+					response := gin.H{"installed_packages": names}
+					addGroups(response)
+					c.JSON(200, response)
+				},
+				Failure: "Failed to get installed packages",
+			})
+			return
+		}
+
+		list, err := listPackages(c.Request.Context(), manager, withGroups)
+		if err != nil {
+			respondFailure(c, "Failed to get installed packages", err)
+			return
+		}
+		c.JSON(200, list)
+	})
+
+	// Define the /packages/diff endpoint that reports what POST /packages would change
+	r.POST("/packages/diff", func(c *gin.Context) {
+		packageConfig, _, ok := bindManifest(c)
+		if !ok {
+			return
+		}
+
+		osReleaseData, err := readOSReleaseFile("/etc/os-release")
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Unable to determine the operating system"})
+			return
+		}
+
+		pm := packageManagerFor(osReleaseData)
+		if pm == nil {
+			c.JSON(400, gin.H{"error": "Unsupported operating system"})
+			return
+		}
+		if err := checkWritable(pm); err != nil {
+			respondFailure(c, "Unsupported operation", err)
+			return
+		}
+
+		diff, err := diffPackages(c.Request.Context(), pm, packageConfig)
+		if err != nil {
+			respondFailure(c, "Failed to compare packages", err)
+			return
+		}
+		if packageConfig.Documents > 1 {
+			diff.EffectiveManifest = &packageConfig
+		}
+		c.JSON(200, diff)
+	})
+
+	// Define the /packages/rollback endpoint that reverses the package changes of an earlier job.
+	// The rollback runs as a job of its own, with its own snapshot, so it can be rolled back too.
+	r.POST("/packages/rollback/:job_id", func(c *gin.Context) {
+		target, ok := jobs.Get(c.Param("job_id"))
+		if !ok {
+			c.JSON(404, gin.H{"error": "Job not found", "code": "job_not_found"})
+			return
+		}
+		if target.Status == jobQueued || target.Status == jobRunning {
+			c.JSON(409, gin.H{"error": "Job " + target.ID + " has not finished yet", "code": "job_not_finished"})
+			return
+		}
+		if target.snapshot == nil {
+			c.JSON(409, gin.H{"error": "Job " + target.ID + " has no package snapshot to roll back to", "code": "rollback_unavailable"})
+			return
+		}
+
+		osReleaseData, err := readOSReleaseFile("/etc/os-release")
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Unable to determine the operating system"})
+			return
+		}
+
+		pm := packageManagerFor(osReleaseData)
+		if pm == nil {
+			c.JSON(400, gin.H{"error": "Unsupported operating system"})
+			return
+		}
+		if err := checkWritable(pm); err != nil {
+			respondFailure(c, "Unsupported operation", err)
+			return
+		}
+
+		// Plan under the lock so no other transaction changes the packages in between
+		packageLock.Lock()
+		plan, err := planRollback(c.Request.Context(), pm, target.snapshot)
+		if err != nil {
+			packageLock.Unlock()
+			respondFailure(c, "Failed to plan the rollback", err)
+			return
+		}
+		response := gin.H{
+			"rolled_back_job": target.ID,
+			"best_effort":     true,
+			"note":            rollbackNote,
+			"remove":          plan.Remove,
+			"reinstall":       plan.Reinstall,
+			"unrecoverable":   plan.Unrecoverable,
+		}
+		if len(plan.Remove) == 0 && len(plan.Reinstall) == 0 {
+			packageLock.Unlock()
+			c.JSON(200, response)
+			return
+		}
+
+		job := jobs.New(c.Request.Context(), "packages")
+		if !jobs.Start(job) {
+			packageLock.Unlock()
+			respondJobCancelled(c, job)
+			return
+		}
+		rollback := rollbackConfig(pm, plan)
+		result, err := applyPackagesForJob(job, pm, rollback)
+		packageLock.Unlock()
+		jobs.Finish(job, result, "rollback of job "+target.ID, err)
+		c.Header("X-Cosi-Job-Id", job.ID)
+		if err != nil {
+			respondFailure(c, "Failed to "+result.FailedStep+" packages during the rollback", err)
+			return
+		}
+
+		response["job_id"] = job.ID
+		response["install"] = result.Install
+		response["uninstall"] = result.Uninstall
+		c.JSON(200, response)
+	})
+
+	// Define the /packages/repair endpoint that recovers the package database after an
+	// interrupted transaction, e.g. with dpkg --configure -a
+	r.POST("/packages/repair", func(c *gin.Context) {
+		steps, job, err := repairPackagesJob(c.Request.Context(), nil)
+		if job != nil {
+			c.Header("X-Cosi-Job-Id", job.ID)
+		}
+		if err != nil {
+			respondFailure(c, "Failed to repair the package database", err)
 			return
 		}
+		c.JSON(200, gin.H{"job_id": job.ID, "steps": steps})
+	})
 
-		// Determine the OS and package manager
+	// Define the /packages/manifest endpoint that exports the installed packages as a reusable manifest
+	r.GET("/packages/manifest", func(c *gin.Context) {
 		osReleaseData, err := readOSReleaseFile("/etc/os-release")
 		if err != nil {
 			c.JSON(500, gin.H{"error": "Unable to determine the operating system"})
 			return
 		}
 
-		var installCmd, uninstallCmd *exec.Cmd
-		switch osReleaseData["ID"] {
-		case "ubuntu", "debian":
-			if len(packageConfig.Packages.Installed) > 0 {
-				installCmd = exec.Command("apt-get", append([]string{"install", "-y"}, packageConfig.Packages.Installed...)...)
+		pm := packageManagerFor(osReleaseData)
+		if pm == nil {
+			c.JSON(400, gin.H{"error": "Unsupported operating system"})
+			return
+		}
+		if err := checkWritable(pm); err != nil {
+			respondFailure(c, "Unsupported operation", err)
+			return
+		}
+
+		manifest, err := exportManifest(c.Request.Context(), pm, c.Query("all") == "true", c.Query("pinned") == "true")
+		if err != nil {
+			respondFailure(c, "Failed to export package manifest", err)
+			return
+		}
+		c.YAML(200, manifest)
+	})
+
+	// Define the /reconcile/status endpoint
+	r.GET("/reconcile/status", func(c *gin.Context) {
+		if reconcileLoop == nil {
+			c.JSON(200, ReconcileStatus{})
+			return
+		}
+		c.JSON(200, reconcileLoop.Status())
+	})
+
+	// Define the /reconcile/run endpoint that triggers an immediate reconcile cycle
+	r.POST("/reconcile/run", func(c *gin.Context) {
+		if reconcileLoop == nil {
+			c.JSON(404, gin.H{"error": "Reconciliation is not configured"})
+			return
+		}
+		if err := reconcileLoop.Run(); err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Reconcile failed: %v", err), "status": reconcileLoop.Status()})
+			return
+		}
+		c.JSON(200, reconcileLoop.Status())
+	})
+
+	// Define the /update endpoint that replaces the agent binary and restarts into it
+	r.POST("/update", func(c *gin.Context) {
+		var request UpdateRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format: url and sha256 are required"})
+			return
+		}
+
+		result, err := applyUpdate(request)
+		details := map[string]interface{}{
+			"url":              request.URL,
+			"sha256":           request.SHA256,
+			"previous_version": result.PreviousVersion,
+			"new_version":      result.NewVersion,
+			"allow_downgrade":  request.AllowDowngrade,
+		}
+		if auditErr := audit.Record(auditOutcome("update", c.ClientIP(), details, err)); auditErr != nil {
+			log.Printf("Failed to write audit log: %v", auditErr)
+		}
+		if err != nil {
+			respondFailure(c, "Failed to install update", err)
+			return
+		}
+
+		c.JSON(200, result)
+		// Give the response a moment to reach the client before restarting
+		go func() {
+			time.Sleep(time.Second)
+			restartAgent(result.Path)
+		}()
+	})
+
+	// Define the /config endpoint that shows the effective configuration without secrets
+	r.GET("/config", func(c *gin.Context) {
+		doc, err := configDocument(currentConfig().redacted())
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to encode configuration: " + err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"status": currentConfigStatus(), "config": doc})
+	})
+
+	// Define the /power/reboot and /power/shutdown endpoints
+	for path, action := range map[string]string{"/power/reboot": "reboot", "/power/shutdown": "poweroff"} {
+		r.POST(path, func(c *gin.Context) {
+			if err := requireSystemd("POST " + c.FullPath()); err != nil {
+				respondFailure(c, "", err)
+				return
+			}
+			var request PowerRequest
+			if err := c.ShouldBindJSON(&request); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid request format"})
+				return
 			}
-			if len(packageConfig.Packages.Uninstalled) > 0 {
-				uninstallCmd = exec.Command("apt-get", append([]string{"remove", "-y"}, packageConfig.Packages.Uninstalled...)...)
+			if request.DelaySeconds < 0 {
+				c.JSON(400, gin.H{"error": "delay_seconds must not be negative"})
+				return
 			}
-		case "fedora", "centos", "rhel":
-			if len(packageConfig.Packages.Installed) > 0 {
-				installCmd = exec.Command("dnf", append([]string{"install", "-y"}, packageConfig.Packages.Installed...)...)
+			if !request.Confirm {
+				c.JSON(400, gin.H{"error": "Set confirm to true to " + action + " the host", "code": "confirmation_required"})
+				return
 			}
-			if len(packageConfig.Packages.Uninstalled) > 0 {
-				uninstallCmd = exec.Command("dnf", append([]string{"remove", "-y"}, packageConfig.Packages.Uninstalled...)...)
+			if active := jobs.Active("packages", "kubernetes", "kubernetes-node"); len(active) > 0 {
+				c.JSON(409, gin.H{"error": fmt.Sprintf("A %s job is in progress", active[0].Type), "code": "operation_in_progress", "job_id": active[0].ID})
+				return
 			}
-		default:
+			if request.DrainFirst {
+				// Draining runs kubectl against the node as POST /kubernetes/node/drain does
+				if !authorizeScope(c, scopeKubernetesNode) {
+					return
+				}
+				job, target, err := drainThenPower(c, action, request)
+				if err != nil {
+					audit.Record(auditOutcome("power."+action, c.ClientIP(), map[string]interface{}{"drain_first": true}, err))
+					respondFailure(c, "Failed to drain the node before the "+action, err)
+					return
+				}
+				c.Header("X-Cosi-Job-Id", job.ID)
+				c.JSON(202, gin.H{"job_id": job.ID, "status_url": "/jobs/" + job.ID, "node": target.Node, "action": action, "drain_first": true})
+				return
+			}
+
+			// The audit entry must be on disk before the host goes down
+			details := map[string]interface{}{"delay_seconds": request.DelaySeconds, "message": request.Message}
+			entry := AuditEntry{Action: "power." + action, Client: c.ClientIP(), Outcome: "requested", Details: details}
+			if err := audit.Record(entry); err != nil {
+				c.JSON(500, gin.H{"error": "Refusing to " + action + " without an audit record: " + err.Error(), "code": "audit_failed"})
+				return
+			}
+
+			pending, err := schedulePowerAction(action, request)
+			if err != nil {
+				audit.Record(auditOutcome("power."+action, c.ClientIP(), details, err))
+				respondFailure(c, "Failed to schedule "+action, err)
+				return
+			}
+			c.JSON(202, pending)
+		})
+	}
+
+	// Define the /power/reboot-required endpoint
+	r.GET("/power/reboot-required", func(c *gin.Context) {
+		pm, err := hostPackageManager()
+		if err != nil {
 			c.JSON(400, gin.H{"error": "Unsupported operating system"})
 			return
 		}
+		status, err := rebootRequired(c.Request.Context(), pm)
+		if err != nil {
+			respondFailure(c, "Failed to check if a reboot is required", err)
+			return
+		}
+		c.JSON(200, status)
+	})
+
+	// Define the /power/pending endpoint
+	r.GET("/power/pending", func(c *gin.Context) {
+		pending, err := pendingPowerAction()
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Unable to read the pending power action: " + err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"pending": pending})
+	})
+
+	// Define the /power/pending DELETE endpoint to cancel a scheduled reboot or shutdown
+	r.DELETE("/power/pending", func(c *gin.Context) {
+		if err := requireSystemd("DELETE /power/pending"); err != nil {
+			respondFailure(c, "", err)
+			return
+		}
+		pending, err := pendingPowerAction()
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Unable to read the pending power action: " + err.Error()})
+			return
+		}
+		if pending == nil {
+			c.JSON(404, gin.H{"error": "No reboot or shutdown is pending"})
+			return
+		}
+		err = cancelPowerAction()
+		audit.Record(auditOutcome("power.cancel", c.ClientIP(), map[string]interface{}{"action": pending.Action}, err))
+		if err != nil {
+			respondFailure(c, "Failed to cancel "+pending.Action, err)
+			return
+		}
+		c.JSON(200, gin.H{"cancelled": pending})
+	})
+
+	// Define the /firewall endpoint that reports the active firewall and its rules
+	r.GET("/firewall", func(c *gin.Context) {
+		backend := detectFirewall()
+		if backend == nil {
+			c.JSON(200, FirewallStatus{Backend: "none", Rules: []FirewallRule{}})
+			return
+		}
+		status, err := backend.Status(c.Request.Context())
+		if err != nil {
+			respondFailure(c, "Failed to read "+backend.Name()+" rules", err)
+			return
+		}
+		c.JSON(200, status)
+	})
+
+	// Define the /firewall/rules endpoint that opens a port through the detected firewall
+	r.POST("/firewall/rules", func(c *gin.Context) {
+		var request FirewallRuleRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format"})
+			return
+		}
+		response, err := openFirewallPort(request, c.ClientIP())
+		if err != nil {
+			respondFailure(c, "Failed to open port", err)
+			return
+		}
+		c.JSON(200, response)
+	})
+
+	// Define the /security/mac endpoint that reports SELinux or AppArmor status
+	r.GET("/security/mac", func(c *gin.Context) {
+		c.JSON(200, macStatus(c.Request.Context()))
+	})
+
+	// Define the /security/mac/selinux endpoint that switches between enforcing and permissive
+	r.POST("/security/mac/selinux", func(c *gin.Context) {
+		var request SELinuxModeRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format"})
+			return
+		}
+		if request.Mode != "enforcing" && request.Mode != "permissive" {
+			c.JSON(400, gin.H{"error": "mode must be enforcing or permissive"})
+			return
+		}
+		if !request.Confirm {
+			c.JSON(400, gin.H{"error": "Set confirm to true to change the SELinux mode", "code": "confirmation_required"})
+			return
+		}
+		status := macStatus(c.Request.Context())
+		if status.System != "selinux" || status.Mode == "disabled" {
+			c.JSON(409, gin.H{"error": "SELinux is not enabled on this host", "code": "selinux_unavailable", "system": status.System})
+			return
+		}
 
-		// Execute the installation and uninstallation commands
-		var installOutput, uninstallOutput bytes.Buffer
-		if installCmd != nil {
-			installCmd.Stdout = &installOutput
-			installCmd.Stderr = &installOutput
-			if err := installCmd.Run(); err != nil {
-				c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to install packages: %v", err), "output": installOutput.String()})
+		result, err := setSELinuxMode(request)
+		details := map[string]interface{}{"from": status.Mode, "to": request.Mode, "persist": request.Persist}
+		audit.Record(auditOutcome("security.selinux_mode", c.ClientIP(), details, err))
+		if err != nil {
+			respondFailure(c, "Failed to change the SELinux mode", err)
+			return
+		}
+		c.JSON(200, gin.H{"previous_mode": status.Mode, "mode": request.Mode, "persisted": request.Persist, "output": result.Output})
+	})
+
+	// Define the /certificates endpoint that reports the certificates found in allowed directories
+	r.GET("/certificates", func(c *gin.Context) {
+		var expiringWithin time.Duration
+		if value := c.Query("expiring_within"); value != "" {
+			var err error
+			if expiringWithin, err = parseDays(value); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		requested := certificateRoots()
+		if value := c.Query("paths"); value != "" {
+			requested = strings.Split(value, ",")
+		}
+		var paths []string
+		for _, path := range requested {
+			resolved, err := allowedCertificatePath(strings.TrimSpace(path))
+			if errors.Is(err, os.ErrNotExist) && c.Query("paths") == "" {
+				continue // default roots that don't exist on this host
+			}
+			if err != nil {
+				c.JSON(403, gin.H{"error": err.Error(), "code": "path_not_allowed", "allowed_paths": certificateRoots()})
 				return
 			}
+			paths = append(paths, resolved)
+		}
+		c.JSON(200, inspectCertificates(paths, expiringWithin))
+	})
+
+	// Define the /files endpoint that reads an allowlisted file or lists a directory
+	r.GET("/files", func(c *gin.Context) {
+		info, err := readAllowedFile(c.Query("path"))
+		var notAllowed *errFileNotAllowed
+		switch {
+		case errors.As(err, &notAllowed):
+			c.JSON(403, gin.H{"error": err.Error(), "code": "path_not_allowed"})
+		case errors.Is(err, os.ErrNotExist):
+			c.JSON(404, gin.H{"error": err.Error(), "code": "file_not_found"})
+		case errors.Is(err, os.ErrPermission):
+			c.JSON(403, gin.H{"error": err.Error(), "code": "permission_denied"})
+		case err != nil:
+			c.JSON(400, gin.H{"error": err.Error()})
+		default:
+			c.JSON(200, info)
+		}
+	})
+
+	// Define the /files PUT endpoint that writes an allowlisted file atomically
+	r.PUT("/files", requireScope(scopeFiles), func(c *gin.Context) {
+		var request FileWriteRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format: path is required"})
+			return
+		}
+
+		result, err := writeFile(request, c.ClientIP())
+		if err != nil {
+			respondFailure(c, "Failed to write "+request.Path, err)
+			return
+		}
+		c.JSON(200, result)
+	})
+
+	// Define the /cron endpoint that lists scheduled jobs
+	r.GET("/cron", func(c *gin.Context) {
+		c.JSON(200, listCronJobs(c.Request.Context()))
+	})
+
+	// Define the /ssh/keys endpoint that lists a user's authorized keys
+	r.GET("/ssh/keys", func(c *gin.Context) {
+		username := c.Query("user")
+		if username == "" {
+			c.JSON(400, gin.H{"error": "user is required"})
+			return
+		}
+		file, err := lookupAuthorizedKeys(username)
+		if err != nil {
+			respondFailure(c, "Failed to read authorized keys", err)
+			return
+		}
+		_, keys, err := file.read()
+		if err != nil {
+			respondFailure(c, "Failed to read authorized keys", err)
+			return
+		}
+		c.JSON(200, keys)
+	})
+
+	// Define the /ssh/keys POST endpoint that adds a key if it isn't there yet
+	r.POST("/ssh/keys", requireScope(scopeSSH), func(c *gin.Context) {
+		var request SSHKeyRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format: user and key are required"})
+			return
 		}
+		change, err := addSSHKey(request, c.ClientIP())
+		if err != nil {
+			respondFailure(c, "Failed to add key", err)
+			return
+		}
+		status := 200
+		if change.Changed {
+			status = 201
+		}
+		c.JSON(status, change)
+	})
 
-		if uninstallCmd != nil {
-			uninstallCmd.Stdout = &uninstallOutput
-			uninstallCmd.Stderr = &uninstallOutput
-			if err := uninstallCmd.Run(); err != nil {
-				c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to uninstall packages: %v", err), "output": uninstallOutput.String()})
+	// Define the /ssh/keys/{fingerprint} DELETE endpoint; fingerprints contain slashes, hence the wildcard
+	r.DELETE("/ssh/keys/*fingerprint", requireScope(scopeSSH), func(c *gin.Context) {
+		var request SSHKeyDeleteRequest
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&request); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid request format: " + err.Error()})
 				return
 			}
 		}
+		if request.User == "" {
+			request.User = c.Query("user")
+		}
+		request.Force = request.Force || c.Query("force") == "true"
+		if request.User == "" {
+			c.JSON(400, gin.H{"error": "user is required"})
+			return
+		}
 
+		fingerprint := normalizeFingerprint(c.Param("fingerprint"))
+		change, err := removeAuthorizedKey(request.User, fingerprint, request.Force)
+		audit.Record(auditOutcome("ssh.keys.remove", c.ClientIP(), map[string]interface{}{"user": request.User, "fingerprint": fingerprint, "force": request.Force}, err))
+		if err != nil {
+			respondFailure(c, "Failed to remove key", err)
+			return
+		}
+		c.JSON(200, change)
+	})
+
+	// Define the /registration endpoint
+	r.GET("/registration", func(c *gin.Context) {
+		if registration == nil {
+			c.JSON(200, RegistrationStatus{})
+			return
+		}
+		c.JSON(200, registration.Status())
+	})
+
+	registerJobRoutes(r)
+
+	// Define the /queue endpoint that shows the queued and running jobs, the commands
+	// waiting for a process slot, and the configured limits
+	r.GET("/queue", func(c *gin.Context) {
+		limits := currentConfig().Concurrency
 		c.JSON(200, gin.H{
-			"install_output":   installOutput.String(),
-			"uninstall_output": uninstallOutput.String(),
+			"jobs":      jobs.Queue(),
+			"processes": processes.Status(),
+			"streams":   gin.H{"open": events.Streams(), "limit": limits.maxStreams()},
 		})
 	})
 
-	// Define the /packages GET endpoint that returns a list of installed packages
-	r.GET("/packages", func(c *gin.Context) {
-		osReleaseData, err := readOSReleaseFile("/etc/os-release")
+	// Define the /schedules endpoint that lists the recurring jobs with their last and next runs
+	r.GET("/schedules", func(c *gin.Context) {
+		c.JSON(200, gin.H{"schedules": schedules.List()})
+	})
+
+	// Define the /schedules POST endpoint that adds a recurring job. Invalid cron
+	// expressions and parameters are refused here rather than at the first firing.
+	r.POST("/schedules", func(c *gin.Context) {
+		var request ScheduleRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format: cron and operation are required"})
+			return
+		}
+		schedule, err := newSchedule(request)
 		if err != nil {
-			c.JSON(500, gin.H{"error": "Unable to determine the operating system"})
+			c.JSON(400, gin.H{"error": err.Error(), "code": "invalid_schedule"})
 			return
 		}
+		created := schedules.Add(schedule)
+		audit.Record(auditOutcome("schedules.add", c.ClientIP(), map[string]interface{}{"id": created.ID, "cron": created.Cron, "operation": created.Operation}, nil))
+		c.JSON(201, created)
+	})
 
-		var cmd *exec.Cmd
-		switch osReleaseData["ID"] {
-		case "ubuntu", "debian":
-			cmd = exec.Command("dpkg-query", "-W", "-f=${binary:Package}\n")
-		case "fedora", "centos", "rhel":
-			cmd = exec.Command("dnf", "list", "installed")
-		default:
-			c.JSON(400, gin.H{"error": "Unsupported operating system"})
+	// Define the /schedules/:id DELETE endpoint
+	r.DELETE("/schedules/:id", func(c *gin.Context) {
+		if !schedules.Remove(c.Param("id")) {
+			c.JSON(404, gin.H{"error": "Schedule not found"})
+			return
+		}
+		audit.Record(auditOutcome("schedules.remove", c.ClientIP(), map[string]interface{}{"id": c.Param("id")}, nil))
+		c.JSON(200, gin.H{"deleted": c.Param("id")})
+	})
+
+	// Define the /events endpoint that returns recent events newest first, for timelines
+	r.GET("/events", func(c *gin.Context) {
+		filter, err := parseEventFilter(c)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
+		limit := defaultEventLimit
+		if value := c.Query("limit"); value != "" {
+			if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxEventHistory {
+				c.JSON(400, gin.H{"error": fmt.Sprintf("limit must be a number from 1 to %d", maxEventHistory)})
+				return
+			}
+		}
+		c.JSON(200, gin.H{"events": events.List(filter, limit)})
+	})
 
-		output, err := cmd.Output()
+	// Define the /events/stream endpoint that sends events as they happen
+	r.GET("/events/stream", func(c *gin.Context) {
+		filter, err := parseEventFilter(c)
 		if err != nil {
-			c.JSON(500, gin.H{"error": "Failed to get installed packages", "output": err.Error()})
+			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
+		streamEvents(c, filter)
+	})
 
-		// Parse the output into a list of packages
-		packageList := strings.Split(strings.TrimSpace(string(output)), "\n")
-		c.JSON(200, gin.H{"installed_packages": packageList})
+	// Define the /webhooks/deliveries endpoint that shows recent delivery attempts
+	r.GET("/webhooks/deliveries", func(c *gin.Context) {
+		c.JSON(200, gin.H{"deliveries": webhooks.Deliveries()})
 	})
 
-	// Define the /binaries endpoint to count binaries in $PATH
+	// Define the /binaries endpoint to count binaries in $PATH. With an NDJSON or
+	// text/plain Accept header it lists them instead, streaming as the walk finds them.
 	r.GET("/binaries", func(c *gin.Context) {
 		// Get the $PATH environment variable
 		pathEnv := os.Getenv("PATH")
@@ -184,135 +942,383 @@ func main() {
 			return
 		}
 
-		// Split $PATH into directories
-		dirs := strings.Split(pathEnv, ":")
-
-		// Count binaries in each directory
-		binaryCount := 0
-		for _, dir := range dirs {
-			files, err := os.ReadDir(dir)
-			if err != nil {
-				continue // Skip directories we can't read
-			}
-			for _, file := range files {
-				// Check if it's an executable file
-				if !file.IsDir() {
-					pathToFile := filepath.Join(dir, file.Name())
-					if isExecutable(pathToFile) {
-						binaryCount++
-					}
-				}
-			}
-		}
-
-		c.JSON(200, gin.H{"binary_count": binaryCount})
+		renderList(c, listView[BinaryEntry]{
+			Columns: []string{"NAME", "PATH"},
+			Cells:   func(b BinaryEntry) []string { return []string{b.Name, b.Path} },
+			Rows: func(emit func(BinaryEntry) error) error {
+				return walkBinaries(pathEnv, emit)
+			},
+			JSON: func(binaries []BinaryEntry) {
+				c.JSON(200, gin.H{"binary_count": len(binaries)})
+			},
+			Failure: "Failed to list binaries",
+		})
 	})
 
 	// Define the /kubernetes GET endpoint to check if Kubernetes is installed
 	r.GET("/kubernetes", func(c *gin.Context) {
-		isInstalled := checkKubernetesInstallation()
-		c.JSON(200, gin.H{
-			"installed": isInstalled,
-		})
+		c.JSON(200, api.KubernetesStatus{Installed: checkKubernetesInstallation()})
 	})
 
 	// Define the /kubernetes POST endpoint
 	r.POST("/kubernetes", func(c *gin.Context) {
-		output, err := installAndBootstrapKubernetes()
+		lockWait, ok := lockWaitParam(c)
+		if !ok {
+			return
+		}
+		result, job, err := bootstrapKubernetesJob(c.Request.Context(), lockWait, nil)
+		if job != nil {
+			c.Header("X-Cosi-Job-Id", job.ID)
+		}
 		if err != nil {
-			c.JSON(500, gin.H{
-				"error":   "Failed to install and bootstrap Kubernetes",
-				"details": err.Error(),
-				"output":  output,
-			})
+			respondFailure(c, "Failed to install and bootstrap Kubernetes", err)
 			return
 		}
-		c.JSON(200, gin.H{
-			"message": "Kubernetes successfully installed and bootstrapped",
-			"output":  output,
-		})
+		c.JSON(200, result)
 	})
 
-	// Start the Gin server
-	r.Run(":80") // Default runs on :8080
-}
+	// Define the /hardware endpoint that identifies the machine for asset tracking
+	r.GET("/hardware", func(c *gin.Context) {
+		hardware, err := collectHardware(c.Request.Context())
+		if err != nil {
+			respondFailure(c, "Failed to collect hardware information", err)
+			return
+		}
+		c.JSON(200, hardware)
+	})
 
-// Function to check if Kubernetes is installed on the system
-func checkKubernetesInstallation() bool {
-	// Check if kubeadm is installed
-	_, errKubeadm := exec.LookPath("kubeadm")
-	// Check if kubectl is installed
-	_, errKubectl := exec.LookPath("kubectl")
-	// Check if kubelet is installed
-	_, errKubelet := exec.LookPath("kubelet")
-
-	// If all are installed, return true
-	if errKubeadm == nil && errKubectl == nil && errKubelet == nil {
-		return true
-	}
+	// Define the /gpu endpoint that lists GPUs and accelerators
+	r.GET("/gpu", func(c *gin.Context) {
+		gpus, err := collectGPUs(c.Request.Context())
+		if err != nil {
+			respondFailure(c, "Failed to list GPUs", err)
+			return
+		}
+		c.JSON(200, gpus)
+	})
 
-	// Otherwise, return false
-	return false
-}
+	// Define the /sensors endpoint that reports temperatures, fans, and voltages from hwmon
+	r.GET("/sensors", func(c *gin.Context) {
+		sensors, err := collectSensors()
+		if err != nil {
+			respondFailure(c, "Failed to read sensors", err)
+			return
+		}
+		c.JSON(200, sensors)
+	})
 
-// Function to install and bootstrap Kubernetes on Ubuntu
-func installAndBootstrapKubernetes() (string, error) {
-	var outputBuffer bytes.Buffer
-
-	// Commands to install Kubernetes dependencies
-	commands := []string{
-		// Update and install dependencies
-		"sudo apt-get update",
-		"sudo apt-get install -y apt-transport-https ca-certificates curl",
-		"curl -fsSL https://packages.cloud.google.com/apt/doc/apt-key.gpg | sudo apt-key add -",
-		`sudo bash -c 'cat <<EOF >/etc/apt/sources.list.d/kubernetes.list
-deb https://apt.kubernetes.io/ kubernetes-xenial main
-EOF'`,
-		"sudo apt-get update",
-
-		// Install kubeadm, kubelet, and kubectl
-		"sudo apt-get install -y kubelet kubeadm kubectl",
-
-		// Disable swap
-		"sudo swapoff -a",
-
-		// Initialize the Kubernetes cluster with kubeadm
-		"sudo kubeadm init",
-
-		// Setup kubectl for the ubuntu user
-		"mkdir -p $HOME/.kube",
-		"sudo cp -i /etc/kubernetes/admin.conf $HOME/.kube/config",
-		"sudo chown $(id -u):$(id -g) $HOME/.kube/config",
-
-		// Install a pod network (flannel or weave)
-		"kubectl apply -f https://raw.githubusercontent.com/coreos/flannel/master/Documentation/kube-flannel.yml",
+	// Define the /boot/analyze endpoint that breaks down how long the last boot took.
+	// ?limit sets how many of the slowest units are listed.
+	r.GET("/boot/analyze", func(c *gin.Context) {
+		if err := requireSystemd("GET /boot/analyze"); err != nil {
+			respondFailure(c, "", err)
+			return
+		}
+		limit := defaultBlameLimit
+		if value := c.Query("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+				c.JSON(400, gin.H{"error": "limit must be a positive number"})
+				return
+			}
+		}
+		analysis, err := analyzeBoot(c.Request.Context(), limit)
+		if err != nil {
+			respondFailure(c, "Failed to analyze the boot", err)
+			return
+		}
+		c.JSON(200, analysis)
+	})
+
+	// Define the /runtime-environment endpoint that reports the cgroup layout and whether
+	// the agent runs in a container
+	r.GET("/runtime-environment", func(c *gin.Context) {
+		c.JSON(200, runtimeEnvironment())
+	})
+
+	// Define the /kernel/cmdline endpoint that reports the kernel parameters and their drift
+	// from the default boot entry
+	r.GET("/kernel/cmdline", func(c *gin.Context) {
+		report, err := kernelCmdline()
+		if err != nil {
+			respondFailure(c, "Failed to read the kernel command line", err)
+			return
+		}
+		c.JSON(200, report)
+	})
+
+	// Define the /disk/smart endpoint that reports the health of the physical disks
+	r.GET("/disk/smart", func(c *gin.Context) {
+		report, err := collectSmart()
+		if err != nil {
+			respondFailure(c, "Failed to read SMART data", err)
+			return
+		}
+		c.JSON(200, report)
+	})
+
+	// Define the /disk/smart/{device}/selftest endpoint that starts a short self-test
+	r.POST("/disk/smart/:device/selftest", func(c *gin.Context) {
+		device := c.Param("device")
+		response, err := startSelfTest(device)
+		audit.Record(auditOutcome("disk.selftest", c.ClientIP(), map[string]interface{}{"device": device}, err))
+		if err != nil {
+			respondFailure(c, "Failed to start self-test on "+device, err)
+			return
+		}
+		c.JSON(202, response)
+	})
+
+	// Define the /storage/raid endpoint that reports software RAID arrays from /proc/mdstat
+	r.GET("/storage/raid", func(c *gin.Context) {
+		raid, err := collectRaid()
+		if err != nil {
+			respondFailure(c, "Failed to read RAID status", err)
+			return
+		}
+		c.JSON(200, raid)
+	})
+
+	// Define the /storage/lvm endpoint that reports physical volumes, volume groups, and logical volumes
+	r.GET("/storage/lvm", func(c *gin.Context) {
+		lvm, err := collectLVM(c.Request.Context())
+		if err != nil {
+			respondFailure(c, "Failed to read LVM status", err)
+			return
+		}
+		c.JSON(200, lvm)
+	})
+
+	// Define the /network/probe endpoint that checks whether the host reaches a list of
+	// targets over TCP, HTTP, ICMP, or DNS
+	r.POST("/network/probe", func(c *gin.Context) {
+		var request ProbeRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format"})
+			return
+		}
+		if err := request.validate(); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"results": runProbes(c.Request.Context(), request.Targets, currentConfig().Network.AllowLinkLocal)})
+	})
+
+	// Define the /probe/http endpoint that checks a service on the host or its network
+	// answers over HTTP as expected
+	r.POST("/probe/http", func(c *gin.Context) {
+		var probe HTTPProbe
+		if err := c.ShouldBindJSON(&probe); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format"})
+			return
+		}
+		if err := probe.validate(); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		result, err := runHTTPProbe(c.Request.Context(), probe, currentConfig().Network.httpProbeCheck())
+		if err != nil {
+			c.JSON(403, gin.H{"error": err.Error(), "code": "forbidden_address"})
+			return
+		}
+		c.JSON(200, result)
+	})
+
+	// Define the /network/ping endpoint that sends echo requests to a host and reports the
+	// round trip times, loss, and jitter
+	r.GET("/network/ping", func(c *gin.Context) {
+		host := c.Query("host")
+		if host == "" {
+			c.JSON(400, gin.H{"error": "host is required"})
+			return
+		}
+		count, ok := countParam(c, "count", defaultPingCount, maxPingCount)
+		if !ok {
+			return
+		}
+		release, ok := acquireDiagnosticSlot()
+		if !ok {
+			c.Header("Retry-After", "10")
+			c.JSON(429, gin.H{"error": fmt.Sprintf("Too many diagnostics running; the limit is %d", maxDiagnostics), "code": "too_many_diagnostics", "limit": maxDiagnostics})
+			return
+		}
+		defer release()
+		result, err := ping(c.Request.Context(), host, count)
+		if err != nil {
+			respondFailure(c, "Failed to ping "+host, err)
+			return
+		}
+		c.JSON(200, result)
+	})
+
+	// Define the /network/traceroute endpoint that lists the hops on the way to a host
+	r.GET("/network/traceroute", func(c *gin.Context) {
+		host := c.Query("host")
+		if host == "" {
+			c.JSON(400, gin.H{"error": "host is required"})
+			return
+		}
+		maxHops, ok := countParam(c, "max_hops", maxTracerouteHops, maxTracerouteHops)
+		if !ok {
+			return
+		}
+		release, ok := acquireDiagnosticSlot()
+		if !ok {
+			c.Header("Retry-After", "30")
+			c.JSON(429, gin.H{"error": fmt.Sprintf("Too many diagnostics running; the limit is %d", maxDiagnostics), "code": "too_many_diagnostics", "limit": maxDiagnostics})
+			return
+		}
+		defer release()
+		result, err := traceroute(c.Request.Context(), host, maxHops)
+		if err != nil {
+			respondFailure(c, "Failed to trace the route to "+host, err)
+			return
+		}
+		c.JSON(200, result)
+	})
+
+	// Define the /discover endpoint that browses the local network for agents over mDNS
+	r.GET("/discover", func(c *gin.Context) {
+		timeoutMS, ok := countParam(c, "timeout_ms", int(defaultDiscoverTimeout.Milliseconds()), int(maxDiscoverTimeout.Milliseconds()))
+		if !ok {
+			return
+		}
+		release, ok := acquireDiagnosticSlot()
+		if !ok {
+			c.Header("Retry-After", "10")
+			c.JSON(429, gin.H{"error": fmt.Sprintf("Too many diagnostics running; the limit is %d", maxDiagnostics), "code": "too_many_diagnostics", "limit": maxDiagnostics})
+			return
+		}
+		defer release()
+		report, err := discoverAgents(c.Request.Context(), currentConfig().Discovery, time.Duration(timeoutMS)*time.Millisecond)
+		if err != nil {
+			respondFailure(c, "Failed to browse for agents", err)
+			return
+		}
+		c.JSON(200, report)
+	})
+
+	// Define the /cloud endpoint that detects the cloud platform and instance identity
+	r.GET("/cloud", func(c *gin.Context) {
+		c.JSON(200, detectCloud(c.Request.Context()))
+	})
+
+	// Define the /identity endpoint with the identifiers fleet tooling tracks machines by
+	r.GET("/identity", func(c *gin.Context) {
+		c.JSON(200, collectIdentity())
+	})
+
+	// Define the /inventory endpoint that gathers everything about the host in one document.
+	// The document holds live figures such as free memory, so its ETag is a hash of the
+	// content apart from collected_at; the package section comes from the package cache.
+	r.GET("/inventory", func(c *gin.Context) {
+		inventory := collectInventory(c.Request.Context(), c.Query("packages") == "full")
+		collectedAt, _ := inventory["collected_at"].(time.Time)
+		delete(inventory, "collected_at")
+		content, _ := json.Marshal(inventory)
+		inventory["collected_at"] = collectedAt
+		if notModified(c, entityTag("inventory", string(content), c.Query("format"), fmt.Sprint(wantsYAML(c))), collectedAt) {
+			return
+		}
+		if c.Query("format") == "ansible" {
+			render(c, 200, ansibleFacts(inventory))
+			return
+		}
+		render(c, 200, inventory)
+	})
+
+	// Define the /metrics/system endpoint that serves node metrics in the Prometheus text
+	// format, for hosts that can't run the node exporter itself
+	r.GET("/metrics/system", func(c *gin.Context) {
+		c.Data(200, metricsContentType, systemMetrics(currentConfig().Metrics))
+	})
+
+	// Define the /capabilities endpoint
+	r.GET("/capabilities", func(c *gin.Context) {
+		c.JSON(200, capabilities.Get())
+	})
+
+	// Define the /capabilities/refresh endpoint to recompute the capabilities on demand
+	r.POST("/capabilities/refresh", func(c *gin.Context) {
+		c.JSON(200, capabilities.Refresh())
+	})
+
+	if debugEnabled {
+		registerDebugRoutes(r)
+	}
+	registerFleetRoutes(r)
+	registerBatchRoutes(r)
+	registerOsqueryRoutes(r)
+	registerMaintenanceRoutes(r)
+	registerLocaleRoutes(r)
+	registerLimitsRoutes(r)
+	registerTimeRoutes(r)
+	registerUserRoutes(r)
+	registerSudoersRoutes(r)
+	registerLogRoutes(r)
+	registerPackageFileRoutes(r)
+	registerLocalPackageRoutes(r)
+	registerPluginRoutes(r)
+	registerSnapshotRoutes(r)
+	registerScriptRoutes(r)
+	registerKubeletRoutes(r)
+	registerStaticPodRoutes(r)
+	registerEtcdRoutes(r)
+	registerNodeRoutes(r)
+
+	// Start the Gin server
+	listener, err := agentListener(*listenAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
 	}
+	log.Printf("Listening on %s", listener.Addr())
 
-	// Execute each command and collect the output
-	for _, cmd := range commands {
-		fmt.Printf("Running command: %s\n", cmd) // Print command being executed
-		log.Printf("Executing: %s", cmd)
-		if err := execCommand(cmd, &outputBuffer); err != nil {
-			fmt.Printf("Error during command execution: %s\n", err)
-			return outputBuffer.String(), fmt.Errorf("failed to execute: %s", cmd)
+	// Serve the gRPC API next to the REST endpoints when it has an address
+	if config.GRPC.Listen != "" {
+		if err := startGRPC(config.GRPC); err != nil {
+			log.Fatalf("Failed to serve the gRPC API: %v", err)
 		}
 	}
 
-	return outputBuffer.String(), nil
+	// Announce the agent on the local network when discovery is enabled
+	if config.Discovery.Announce {
+		if addr, ok := listener.Addr().(*net.TCPAddr); !ok {
+			log.Printf("Warning: discovery announcements are disabled: %s is not a TCP address", listener.Addr())
+		} else if _, err := startDiscovery(config.Discovery, addr.Port); err != nil {
+			log.Printf("Warning: discovery announcements are disabled: %v", err)
+		}
+	}
+	r.RunListener(listener)
 }
 
-// Helper function to execute a shell command and capture its output
-func execCommand(cmd string, outputBuffer *bytes.Buffer) error {
-	command := exec.Command("bash", "-c", cmd)
-	command.Stdout = outputBuffer
-	command.Stderr = outputBuffer
-
-	// Execute the command and capture stdout/stderr
-	err := command.Run()
+// BinaryEntry is one executable found in $PATH
+type BinaryEntry struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
 
-	// Print the output to the application stdout
-	fmt.Printf("Output of command '%s':\n%s\n", cmd, outputBuffer.String())
-	return err
+// Function to walk each directory of $PATH and emit the executables in it
+func walkBinaries(pathEnv string, emit func(BinaryEntry) error) error {
+	for _, dir := range strings.Split(pathEnv, ":") {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			continue // Skip directories we can't read
+		}
+		for _, file := range files {
+			// Check if it's an executable file
+			if file.IsDir() {
+				continue
+			}
+			pathToFile := filepath.Join(dir, file.Name())
+			if !isExecutable(pathToFile) {
+				continue
+			}
+			if err := emit(BinaryEntry{Name: file.Name(), Path: pathToFile}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // Helper function to check if a file is executable
@@ -356,60 +1362,36 @@ func readOSReleaseFile(filePath string) (map[string]string, error) {
 	return result, nil
 }
 
-// Function to execute the `uname -a` command and return its output with labeled fields
+// Longest a single uname call may take
+const unameTimeout = 5 * time.Second
+
+// Function to execute the `uname` commands in parallel and return their output with labeled fields
 func getUnameOutput() (map[string]string, error) {
-	kernelNameCmd := exec.Command("uname")
-	kernelNameOutput, err := kernelNameCmd.Output()
-	if err != nil {
-		return nil, err
-	}
-	nodeNameCmd := exec.Command("uname", "-n")
-	nodeNameOutput, err := nodeNameCmd.Output()
-	if err != nil {
-		return nil, err
+	fields := []struct{ label, flag string }{
+		{"kernel_name", "-s"},
+		{"nodename", "-n"},
+		{"kernel_release", "-r"},
+		{"kernel_version", "-v"},
+		{"machine", "-m"},
+		{"processor", "-p"},
+		{"hardware", "-i"},
+		{"os", "-o"},
 	}
-	kernelReleaseCmd := exec.Command("uname", "-r")
-	kernelReleaseOutput, err := kernelReleaseCmd.Output()
-	if err != nil {
-		return nil, err
-	}
-	kernelVersionCmd := exec.Command("uname", "-v")
-	kernelVersionOutput, err := kernelVersionCmd.Output()
-	if err != nil {
-		return nil, err
-	}
-	machineCmd := exec.Command("uname", "-m")
-	machineOutput, err := machineCmd.Output()
-	if err != nil {
-		return nil, err
-	}
-	processorCmd := exec.Command("uname", "-p")
-	processorOutput, err := processorCmd.Output()
-	if err != nil {
-		return nil, err
-	}
-	hardwareCmd := exec.Command("uname", "-i")
-	hardwareOutput, err := hardwareCmd.Output()
-	if err != nil {
-		return nil, err
-	}
-	osCmd := exec.Command("uname", "-o")
-	osOutput, err := osCmd.Output()
-	if err != nil {
-		return nil, err
+	tasks := make([]task, len(fields))
+	for i, field := range fields {
+		arg := field.flag
+		tasks[i] = task{Name: field.label, Run: func(ctx context.Context) (interface{}, error) {
+			return outputTracked(newCommandContext(ctx, "uname", arg))
+		}}
 	}
 
 	// Map the fields to labels
-	result := map[string]string{
-		"kernel_name":    strings.TrimSpace(string(kernelNameOutput)),
-		"nodename":       strings.TrimSpace(string(nodeNameOutput)),
-		"kernel_release": strings.TrimSpace(string(kernelReleaseOutput)),
-		"kernel_version": strings.TrimSpace(string(kernelVersionOutput)),
-		"machine":        strings.TrimSpace(string(machineOutput)),
-		"processor":      strings.TrimSpace(string(processorOutput)),
-		"hardware":       strings.TrimSpace(string(hardwareOutput)),
-		"os":             strings.TrimSpace(string(osOutput)),
+	result := make(map[string]string, len(fields))
+	for _, output := range fanOut(context.Background(), tasks, len(tasks), unameTimeout) {
+		if output.Err != nil {
+			return nil, output.Err
+		}
+		result[output.Name] = strings.TrimSpace(string(output.Value.([]byte)))
 	}
-
 	return result, nil
 }
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How often a job held by maintenance mode checks whether it was cancelled
+const maintenanceHoldPoll = time.Second
+
+// Routes that stay open in maintenance mode although their method could change something:
+// the maintenance switch itself, cancelling jobs, and POST endpoints that only read the host
+// or back it up
+var maintenanceExempt = map[string]bool{
+	"POST /maintenance":            true,
+	"DELETE /jobs/:id":             true,
+	"POST /systemctl/status":       true,
+	"POST /packages/diff":          true,
+	"POST /packages/snapshots":     true,
+	"POST /kubernetes/etcd/backup": true,
+	"POST /network/probe":          true,
+	"POST /probe/http":             true,
+	"POST /capabilities/refresh":   true,
+	"POST /refresh":                true,
+	"POST /osquery":                true,
+	"POST /debug/pprof/symbol":     true,
+}
+
+// MaintenanceStatus is the maintenance mode of the agent, as GET /maintenance reports it
+type MaintenanceStatus struct {
+	Active    bool       `json:"active"`
+	Reason    string     `json:"reason,omitempty"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	// ExpiresAt is when maintenance ends by itself, if it does
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	StartedBy string     `json:"started_by,omitempty"`
+	// QueuedJobs are the jobs held until maintenance ends
+	QueuedJobs []string `json:"queued_jobs,omitempty"`
+}
+
+// MaintenanceRequest is the body of POST /maintenance
+type MaintenanceRequest struct {
+	// Active enters maintenance mode when true and leaves it when false
+	Active *bool  `json:"active" binding:"required"`
+	Reason string `json:"reason"`
+	// DurationSeconds ends maintenance mode by itself after that long; zero keeps it on
+	// until it is turned off
+	DurationSeconds int `json:"duration_seconds"`
+}
+
+// maintenanceMode holds the maintenance state, persisted so it survives restarts
+type maintenanceMode struct {
+	mu     sync.Mutex
+	status MaintenanceStatus
+	// ended is closed when the current maintenance ends, releasing the jobs it holds
+	ended chan struct{}
+	// expiry ends the current maintenance at its expiry
+	expiry *time.Timer
+}
+
+var maintenance = &maintenanceMode{}
+
+// Helper function to return the path of the persisted maintenance state
+func maintenanceFile() string {
+	return filepath.Join(stateDir, "maintenance.json")
+}
+
+// Load restores the maintenance mode the agent was in when it stopped, unless it has
+// expired since
+func (m *maintenanceMode) Load() {
+	data, err := os.ReadFile(maintenanceFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: unable to read the maintenance state: %v", err)
+		}
+		return
+	}
+	var status MaintenanceStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		log.Printf("Warning: ignoring the unreadable maintenance state: %v", err)
+		return
+	}
+	if !status.Active {
+		return
+	}
+	if status.ExpiresAt != nil && !time.Now().Before(*status.ExpiresAt) {
+		m.mu.Lock()
+		m.save()
+		m.mu.Unlock()
+		events.Emit(Event{Type: "maintenance.ended", Message: "maintenance mode expired while the agent was stopped", Details: map[string]interface{}{"reason": status.Reason}})
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.begin(status)
+	log.Printf("Maintenance mode is on: %s", status.Reason)
+}
+
+// Helper function to return the current maintenance state
+func (m *maintenanceMode) current() MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// Status returns the current maintenance state with the jobs it holds
+func (m *maintenanceMode) Status() MaintenanceStatus {
+	status := m.current()
+	if status.Active {
+		for _, job := range jobs.List() {
+			if job.Status == jobQueued {
+				status.QueuedJobs = append(status.QueuedJobs, job.ID)
+			}
+		}
+	}
+	return status
+}
+
+// Enter turns maintenance mode on, or changes the reason and expiry when it is on already
+func (m *maintenanceMode) Enter(reason string, duration time.Duration, client string) MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC()
+	status := MaintenanceStatus{Active: true, Reason: reason, StartedAt: &now, StartedBy: client}
+	if m.status.Active {
+		status.StartedAt, status.StartedBy = m.status.StartedAt, m.status.StartedBy
+	}
+	if duration > 0 {
+		expires := now.Add(duration)
+		status.ExpiresAt = &expires
+	}
+	m.begin(status)
+	m.save()
+	return m.status
+}
+
+// Leave turns maintenance mode off and releases the jobs it held. It returns false when
+// maintenance mode was off already.
+func (m *maintenanceMode) Leave() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.status.Active {
+		return false
+	}
+	m.end()
+	m.save()
+	return true
+}
+
+// begin makes status the current maintenance. Callers must hold m.mu.
+func (m *maintenanceMode) begin(status MaintenanceStatus) {
+	if !m.status.Active {
+		m.ended = make(chan struct{})
+	}
+	if m.expiry != nil {
+		m.expiry.Stop()
+		m.expiry = nil
+	}
+	m.status = status
+	if status.ExpiresAt != nil {
+		m.expiry = time.AfterFunc(time.Until(*status.ExpiresAt), m.expire)
+	}
+}
+
+// end ends the current maintenance. Callers must hold m.mu.
+func (m *maintenanceMode) end() {
+	if m.expiry != nil {
+		m.expiry.Stop()
+		m.expiry = nil
+	}
+	m.status = MaintenanceStatus{}
+	close(m.ended)
+}
+
+// expire ends the maintenance whose expiry has passed
+func (m *maintenanceMode) expire() {
+	m.mu.Lock()
+	status := m.status
+	if !status.Active || status.ExpiresAt == nil || time.Now().Before(*status.ExpiresAt) {
+		m.mu.Unlock()
+		return
+	}
+	m.end()
+	m.save()
+	m.mu.Unlock()
+	events.Emit(Event{Type: "maintenance.ended", Message: "maintenance mode expired", Details: map[string]interface{}{"reason": status.Reason, "started_by": status.StartedBy}})
+}
+
+// save persists the maintenance state. Callers must hold m.mu.
+func (m *maintenanceMode) save() {
+	data, err := json.Marshal(m.status)
+	if err == nil {
+		err = writeStateFile(maintenanceFile(), data)
+	}
+	if err != nil {
+		log.Printf("Warning: unable to persist the maintenance state: %v", err)
+	}
+}
+
+// Hold blocks while maintenance mode is on, so a queued job only starts once it ends.
+// It returns early once queued reports the job is no longer queued, like when it was
+// cancelled.
+func (m *maintenanceMode) Hold(queued func() bool) {
+	for {
+		m.mu.Lock()
+		active, ended := m.status.Active, m.ended
+		m.mu.Unlock()
+		if !active || !queued() {
+			return
+		}
+		select {
+		case <-ended:
+		case <-time.After(maintenanceHoldPoll):
+		}
+	}
+}
+
+// Refusal returns the error that refuses a change while maintenance mode is on, or nil
+func (m *maintenanceMode) Refusal() error {
+	status := m.current()
+	if !status.Active {
+		return nil
+	}
+	message := "The agent is in maintenance mode"
+	if status.Reason != "" {
+		message += ": " + status.Reason
+	}
+	response := gin.H{"error": message, "code": "maintenance_mode", "reason": status.Reason, "started_at": status.StartedAt}
+	if status.ExpiresAt != nil {
+		response["expires_at"] = status.ExpiresAt
+	}
+	return &responseError{503, response}
+}
+
+// Middleware to refuse the requests that could change the host while maintenance mode is
+// on. Reads keep working, and so do the routes in maintenanceExempt.
+func refuseInMaintenance(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+		return
+	}
+	if maintenanceExempt[c.Request.Method+" "+c.FullPath()] {
+		c.Next()
+		return
+	}
+	err := maintenance.Refusal()
+	if err == nil {
+		c.Next()
+		return
+	}
+	if expires := maintenance.current().ExpiresAt; expires != nil {
+		c.Header("Retry-After", fmt.Sprint(int(math.Ceil(time.Until(*expires).Seconds()))))
+	}
+	c.AbortWithStatusJSON(failureResponse("", err))
+}
+
+// Function to register the maintenance and readiness endpoints
+func registerMaintenanceRoutes(r *gin.Engine) {
+	// Define the /maintenance endpoint that reports the maintenance mode
+	r.GET("/maintenance", func(c *gin.Context) {
+		c.JSON(200, maintenance.Status())
+	})
+
+	// Define the /maintenance POST endpoint that enters or leaves maintenance mode. While
+	// it is on, requests that change the host get a 503 and queued jobs wait for it to end.
+	r.POST("/maintenance", func(c *gin.Context) {
+		var request MaintenanceRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format: active is required"})
+			return
+		}
+		if request.DurationSeconds < 0 {
+			c.JSON(400, gin.H{"error": "duration_seconds must not be negative", "code": "invalid_parameter"})
+			return
+		}
+
+		if *request.Active {
+			status := maintenance.Enter(request.Reason, time.Duration(request.DurationSeconds)*time.Second, c.ClientIP())
+			details := map[string]interface{}{"reason": status.Reason}
+			if status.ExpiresAt != nil {
+				details["expires_at"] = status.ExpiresAt
+			}
+			audit.Record(auditOutcome("maintenance.started", c.ClientIP(), details, nil))
+			c.JSON(200, maintenance.Status())
+			return
+		}
+		if maintenance.Leave() {
+			audit.Record(auditOutcome("maintenance.ended", c.ClientIP(), map[string]interface{}{}, nil))
+		}
+		c.JSON(200, maintenance.Status())
+	})
+
+	// Define the /readyz endpoint for load balancers and orchestrators, which reports the
+	// agent as not ready while it is in maintenance mode
+	r.GET("/readyz", func(c *gin.Context) {
+		status := maintenance.Status()
+		if status.Active {
+			c.JSON(503, gin.H{"ready": false, "reason": "maintenance", "maintenance": status})
+			return
+		}
+		c.JSON(200, gin.H{"ready": true})
+	})
+}
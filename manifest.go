@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rothgar/cosi/api"
+	"gopkg.in/yaml.v3"
+)
+
+// Redirects followed when downloading a manifest
+const maxManifestRedirects = 3
+
+// ManifestSource points POST /packages at a manifest stored elsewhere instead of the inline YAML
+type ManifestSource = api.ManifestSource
+
+// manifestError is a download or verification failure that is the client's to fix
+type manifestError struct {
+	Code    string
+	Message string
+}
+
+func (e *manifestError) Error() string {
+	return e.Message
+}
+
+// Client used to download manifests, with a bounded number of redirects
+var manifestClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: proxiedTransport(),
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxManifestRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxManifestRedirects)
+		}
+		return nil
+	},
+}
+
+// manifestDocument is a manifest as written. Package entries can name a package per
+// distribution and carry conditions, so they are resolved for the host into the
+// PackageConfig that is applied.
+type manifestDocument struct {
+	Packages packageLists `yaml:"packages"`
+	// Groups are package lists that share a condition
+	Groups         []PackageGroup `yaml:"groups"`
+	Snaps          AppSection     `yaml:"snaps"`
+	Flatpaks       AppSection     `yaml:"flatpaks"`
+	ConffilePolicy string         `yaml:"conffile_policy"`
+	PackageOptions `yaml:",inline"`
+	// PackageGroups are dnf groups; @group entries of the package lists are added to them
+	PackageGroups AppSection    `yaml:"package_groups"`
+	Modules       ModuleSection `yaml:"modules"`
+	Verify        []VerifyCheck `yaml:"verify"`
+	// Strict fails the manifest instead of skipping entries that have no name on this host
+	Strict bool `yaml:"strict"`
+	// RemoveFromInstalled drops packages that earlier documents of the stream install
+	RemoveFromInstalled []PackageEntry `yaml:"remove_from_installed"`
+}
+
+// packageLists are the package entries to install and remove
+type packageLists struct {
+	Installed   []PackageEntry `yaml:"installed"`
+	Uninstalled []PackageEntry `yaml:"uninstalled"`
+}
+
+// PackageGroup applies its package lists only on hosts matching When
+type PackageGroup struct {
+	When         *Condition `yaml:"when"`
+	packageLists `yaml:",inline"`
+}
+
+// manifestHost is what entries are resolved against
+type manifestHost struct {
+	// Families are tried in order to pick a name for entries mapped per distribution
+	Families []string
+	// Facts are tested by `when:` conditions
+	Facts map[string]string
+}
+
+// Function to resolve the package entries of a manifest document for a host. Entries whose
+// condition is false, or that have no name for the host, are skipped and listed. prefix
+// locates the document within a stream. The packages named by remove_from_installed are
+// returned separately for merging.
+func (d manifestDocument) resolve(host manifestHost, prefix string) (PackageConfig, []string, []ManifestProblem) {
+	config := PackageConfig{Snaps: d.Snaps, Flatpaks: d.Flatpaks, ConffilePolicy: d.ConffilePolicy, PackageOptions: d.PackageOptions, PackageGroups: d.PackageGroups, Modules: d.Modules, Verify: d.Verify, paths: map[string][]string{}, Documents: 1}
+	noName := "no package name for " + strings.Join(host.Families, ", ")
+	if len(host.Families) == 0 {
+		noName = "the distribution of this host is unknown"
+	}
+
+	var problems []ManifestProblem
+	resolveList := func(field string, entries []PackageEntry, groupSkip string) (names, paths []string) {
+		for i, entry := range entries {
+			path := fmt.Sprintf("%s%s[%d]", prefix, field, i)
+			skip := groupSkip
+			if skip == "" && entry.When != nil {
+				if ok, reason := entry.When.evaluate(host.Facts); !ok {
+					skip = "condition " + reason
+				}
+			}
+			if skip != "" {
+				config.Skipped = append(config.Skipped, SkippedEntry{Field: path, Entry: entry.String(), Reason: skip})
+				continue
+			}
+
+			name, ok := entry.resolve(host.Families)
+			switch {
+			case ok:
+				names = append(names, name)
+				paths = append(paths, path)
+			case d.Strict:
+				problems = append(problems, ManifestProblem{Field: path, Code: "no_family_mapping", Message: entry.String() + ": " + noName})
+			default:
+				config.Skipped = append(config.Skipped, SkippedEntry{Field: path, Entry: entry.String(), Reason: noName})
+			}
+		}
+		return names, paths
+	}
+	addLists := func(field string, lists packageLists, groupSkip string) {
+		names, paths := resolveList(field+".installed", lists.Installed, groupSkip)
+		config.Packages.Installed = append(config.Packages.Installed, names...)
+		config.paths["packages.installed"] = append(config.paths["packages.installed"], paths...)
+		names, paths = resolveList(field+".uninstalled", lists.Uninstalled, groupSkip)
+		config.Packages.Uninstalled = append(config.Packages.Uninstalled, names...)
+		config.paths["packages.uninstalled"] = append(config.paths["packages.uninstalled"], paths...)
+	}
+
+	addLists("packages", d.Packages, "")
+	for i, group := range d.Groups {
+		skip := ""
+		if group.When != nil {
+			if ok, reason := group.When.evaluate(host.Facts); !ok {
+				skip = "group condition " + reason
+			}
+		}
+		addLists(fmt.Sprintf("groups[%d]", i), group.packageLists, skip)
+	}
+	for _, manager := range appManagers {
+		section := manager.Section(config)
+		key := manager.Name() + "s"
+		config.paths[key+".install"] = positionalPaths(prefix+key+".install", len(section.Install))
+		config.paths[key+".remove"] = positionalPaths(prefix+key+".remove", len(section.Remove))
+	}
+	config.paths["package_groups.install"] = positionalPaths(prefix+"package_groups.install", len(d.PackageGroups.Install))
+	config.paths["package_groups.remove"] = positionalPaths(prefix+"package_groups.remove", len(d.PackageGroups.Remove))
+	config.paths["modules.enable"] = positionalPaths(prefix+"modules.enable", len(d.Modules.Enable))
+	config.paths["modules.disable"] = positionalPaths(prefix+"modules.disable", len(d.Modules.Disable))
+	config.paths["modules.reset"] = positionalPaths(prefix+"modules.reset", len(d.Modules.Reset))
+	config.paths["verify"] = positionalPaths(prefix+"verify", len(d.Verify))
+	config.routeGroupEntries()
+	removals, _ := resolveList("remove_from_installed", d.RemoveFromInstalled, "")
+	return config, removals, problems
+}
+
+// Helper function to name the entries of a list by their position
+func positionalPaths(field string, count int) []string {
+	paths := make([]string, count)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("%s[%d]", field, i)
+	}
+	return paths
+}
+
+// Function to merge the documents of a manifest stream in order. Later documents add to
+// the lists of earlier ones, and their remove_from_installed drops packages that earlier
+// documents install. Entries an earlier document already lists aren't repeated.
+func mergeManifests(configs []PackageConfig, removals [][]string) PackageConfig {
+	if len(configs) == 1 {
+		return configs[0]
+	}
+	merged := PackageConfig{paths: map[string][]string{}, Documents: len(configs)}
+	packageName := packageNameFunc()
+	appendList := func(list string, target *[]string, entries []string, paths []string) {
+		earlier := make(map[string]bool, len(*target))
+		for _, entry := range *target {
+			earlier[entry] = true
+		}
+		for i, entry := range entries {
+			if earlier[entry] {
+				continue
+			}
+			*target = append(*target, entry)
+			merged.paths[list] = append(merged.paths[list], paths[i])
+		}
+	}
+
+	for i, config := range configs {
+		if len(removals[i]) > 0 {
+			remove := make(map[string]bool)
+			for _, spec := range removals[i] {
+				remove[packageName(spec)] = true
+			}
+			var kept, keptPaths []string
+			for j, spec := range merged.Packages.Installed {
+				if !remove[packageName(spec)] {
+					kept = append(kept, spec)
+					keptPaths = append(keptPaths, merged.paths["packages.installed"][j])
+				}
+			}
+			merged.Packages.Installed, merged.paths["packages.installed"] = kept, keptPaths
+		}
+
+		appendList("packages.installed", &merged.Packages.Installed, config.Packages.Installed, config.paths["packages.installed"])
+		appendList("packages.uninstalled", &merged.Packages.Uninstalled, config.Packages.Uninstalled, config.paths["packages.uninstalled"])
+		appendList("snaps.install", &merged.Snaps.Install, config.Snaps.Install, config.paths["snaps.install"])
+		appendList("snaps.remove", &merged.Snaps.Remove, config.Snaps.Remove, config.paths["snaps.remove"])
+		appendList("flatpaks.install", &merged.Flatpaks.Install, config.Flatpaks.Install, config.paths["flatpaks.install"])
+		appendList("flatpaks.remove", &merged.Flatpaks.Remove, config.Flatpaks.Remove, config.paths["flatpaks.remove"])
+		appendList("package_groups.install", &merged.PackageGroups.Install, config.PackageGroups.Install, config.paths["package_groups.install"])
+		appendList("package_groups.remove", &merged.PackageGroups.Remove, config.PackageGroups.Remove, config.paths["package_groups.remove"])
+		appendList("modules.enable", &merged.Modules.Enable, config.Modules.Enable, config.paths["modules.enable"])
+		appendList("modules.disable", &merged.Modules.Disable, config.Modules.Disable, config.paths["modules.disable"])
+		appendList("modules.reset", &merged.Modules.Reset, config.Modules.Reset, config.paths["modules.reset"])
+		// Every document's checks run, even ones an earlier document repeats
+		merged.Verify = append(merged.Verify, config.Verify...)
+		merged.paths["verify"] = append(merged.paths["verify"], config.paths["verify"]...)
+		if config.ConffilePolicy != "" {
+			merged.ConffilePolicy = config.ConffilePolicy
+		}
+		merged.PackageOptions = merged.PackageOptions.or(config.PackageOptions)
+		merged.Skipped = append(merged.Skipped, config.Skipped...)
+	}
+	return merged
+}
+
+// ManifestProblem is one thing wrong with a manifest, located so an editor can highlight it
+type ManifestProblem struct {
+	// Field is the path of the offending value, e.g. packages.installed[2]
+	Field   string `json:"field"`
+	Line    int    `json:"line,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// manifestInvalidError lists every problem found while validating a manifest
+type manifestInvalidError struct {
+	Problems []ManifestProblem
+}
+
+func (e *manifestInvalidError) Error() string {
+	messages := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		location := problem.Field
+		if problem.Line > 0 {
+			location += fmt.Sprintf(" (line %d)", problem.Line)
+		}
+		messages[i] = strings.TrimSpace(location) + ": " + problem.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Helper function to pick the status for an invalid manifest: 409 when the only problems
+// are entries that are both installed and removed, 400 otherwise
+func (e *manifestInvalidError) status() (int, string) {
+	for _, problem := range e.Problems {
+		if problem.Code != "conflict" {
+			return 400, "invalid_manifest"
+		}
+	}
+	return 409, "conflicting_entries"
+}
+
+var (
+	yamlErrorLine    = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	yamlUnknownField = regexp.MustCompile(`^field (\S+) not found in type`)
+)
+
+// Function to parse and validate a YAML package manifest and resolve it for this host.
+// Unknown keys are rejected so a typo can't silently turn into a manifest that does nothing.
+// A stream of several documents is merged in order; fields of a stream are located with
+// a documents[i] prefix.
+func parseManifest(data []byte) (PackageConfig, error) {
+	var manifest PackageConfig
+	if err := checkYAMLComplexity(data); err != nil {
+		return manifest, &manifestError{Code: "manifest_too_complex", Message: "parsing manifest: " + err.Error()}
+	}
+
+	// The node trees give the line of every field for the problems reported below
+	var roots []*yaml.Node
+	nodes := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		root := &yaml.Node{}
+		if err := nodes.Decode(root); err == io.EOF {
+			break
+		} else if err != nil {
+			return manifest, &manifestInvalidError{Problems: []ManifestProblem{yamlProblem(err.Error(), nil)}}
+		}
+		roots = append(roots, root)
+	}
+	prefix := func(i int) string {
+		if len(roots) > 1 {
+			return fmt.Sprintf("documents[%d].", i)
+		}
+		return ""
+	}
+	lines := make(map[string]int)
+	for i, root := range roots {
+		yamlLines(root, strings.TrimSuffix(prefix(i), "."), lines)
+	}
+
+	var documents []manifestDocument
+	var problems []ManifestProblem
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	for {
+		var document manifestDocument
+		err := decoder.Decode(&document)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var typeErr *yaml.TypeError
+			if !errors.As(err, &typeErr) {
+				return manifest, fmt.Errorf("parsing manifest: %w", err)
+			}
+			for _, message := range typeErr.Errors {
+				problems = append(problems, yamlProblem(message, lines))
+			}
+		}
+		documents = append(documents, document)
+	}
+	if len(problems) > 0 {
+		return manifest, &manifestInvalidError{Problems: problems}
+	}
+	if len(documents) == 0 {
+		documents = append(documents, manifestDocument{})
+	}
+
+	var host manifestHost
+	if osRelease, err := readOSReleaseFile("/etc/os-release"); err == nil {
+		host.Families = hostFamilies(osRelease)
+		host.Facts = conditionHostFacts(osRelease)
+	}
+	configs := make([]PackageConfig, len(documents))
+	removals := make([][]string, len(documents))
+	for i, document := range documents {
+		var documentProblems []ManifestProblem
+		configs[i], removals[i], documentProblems = document.resolve(host, prefix(i))
+		problems = append(problems, documentProblems...)
+	}
+	manifest = mergeManifests(configs, removals)
+
+	if limit := currentConfig().Limits.manifestEntries(); manifestEntries(manifest) > limit {
+		return manifest, &manifestError{
+			Code:    "too_many_entries",
+			Message: fmt.Sprintf("manifest lists %d package entries, more than the limit of %d", manifestEntries(manifest), limit),
+		}
+	}
+	if problems = append(problems, manifest.validate()...); len(problems) > 0 {
+		for i := range problems {
+			problems[i].Line = lines[problems[i].Field]
+		}
+		return manifest, &manifestInvalidError{Problems: problems}
+	}
+	return manifest, nil
+}
+
+// Helper function to turn a YAML decoding message like "line 3: field instaled not found
+// in type ..." into a problem pointing at the field on that line
+func yamlProblem(message string, lines map[string]int) ManifestProblem {
+	match := yamlErrorLine.FindStringSubmatch(message)
+	if match == nil {
+		return ManifestProblem{Code: "syntax_error", Message: strings.TrimPrefix(message, "yaml: ")}
+	}
+	line, _ := strconv.Atoi(match[1])
+	problem := ManifestProblem{Line: line, Code: "invalid_value", Message: match[2]}
+	if field := yamlUnknownField.FindStringSubmatch(match[2]); field != nil {
+		problem.Code = "unknown_field"
+		problem.Message = "unknown field " + field[1]
+	}
+	if lines == nil {
+		problem.Code = "syntax_error"
+		return problem
+	}
+
+	// Point at the outermost value starting on the line; for an unknown field that is the key itself
+	unknown := ""
+	if problem.Code == "unknown_field" {
+		unknown = strings.TrimPrefix(problem.Message, "unknown field ")
+	}
+	for path, pathLine := range lines {
+		if pathLine != line {
+			continue
+		}
+		if unknown != "" && path != unknown && !strings.HasSuffix(path, "."+unknown) {
+			continue
+		}
+		if problem.Field == "" || len(path) < len(problem.Field) || (len(path) == len(problem.Field) && path < problem.Field) {
+			problem.Field = path
+		}
+	}
+	return problem
+}
+
+// Helper function to record the line of every mapping key and sequence item by its path
+func yamlLines(node *yaml.Node, path string, lines map[string]int) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			yamlLines(child, path, lines)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if path != "" {
+				key = path + "." + key
+			}
+			lines[key] = node.Content[i].Line
+			yamlLines(node.Content[i+1], key, lines)
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			item := fmt.Sprintf("%s[%d]", path, i)
+			lines[item] = child.Line
+			yamlLines(child, item, lines)
+		}
+	}
+}
+
+// Helper function to read a response body up to the manifest size limit
+func readManifestBody(body io.Reader) ([]byte, error) {
+	maxManifestBytes := currentConfig().Limits.manifestBytes()
+	data, err := io.ReadAll(io.LimitReader(body, maxManifestBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxManifestBytes {
+		return nil, &manifestError{Code: "manifest_too_large", Message: fmt.Sprintf("manifest is larger than %d bytes", maxManifestBytes)}
+	}
+	return data, nil
+}
+
+// Function to download a manifest and verify its checksum and signature when they are
+// given. It returns the manifest body and its SHA-256.
+func fetchManifest(source ManifestSource) ([]byte, string, error) {
+	if !strings.HasPrefix(source.URL, "http://") && !strings.HasPrefix(source.URL, "https://") {
+		return nil, "", &manifestError{Code: "invalid_source_url", Message: "source_url must be http or https"}
+	}
+
+	resp, err := manifestClient.Get(source.URL)
+	if err != nil {
+		return nil, "", &manifestError{Code: "manifest_fetch_failed", Message: err.Error()}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &manifestError{Code: "manifest_fetch_failed", Message: fmt.Sprintf("fetching %s: %s", source.URL, resp.Status)}
+	}
+
+	data, err := readManifestBody(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	if source.SHA256 != "" && !strings.EqualFold(strings.TrimPrefix(source.SHA256, "sha256:"), hash) {
+		return nil, hash, &manifestError{
+			Code:    "checksum_mismatch",
+			Message: fmt.Sprintf("manifest sha256 is %s, expected %s", hash, source.SHA256),
+		}
+	}
+	if _, err := verifyDetachedSignature(data, "manifest "+source.URL, source.SignatureURL, currentConfig().Signatures.Required); err != nil {
+		return nil, hash, manifestSignatureError(err)
+	}
+	return data, hash, nil
+}
+
+// Helper function to report a signature failure like the other manifest failures
+func manifestSignatureError(err error) error {
+	var sigErr *signatureError
+	if errors.As(err, &sigErr) {
+		return &manifestError{Code: sigErr.Code, Message: sigErr.Message}
+	}
+	return err
+}
+
+// Helper function to read the manifest of a POST /packages style request. The body is
+// either the manifest itself or a source_url reference that is downloaded first. When
+// it returns false an error response has already been sent.
+func bindManifest(c *gin.Context) (PackageConfig, *ManifestSource, bool) {
+	body, err := readManifestBody(c.Request.Body)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Unable to read request body: " + err.Error()})
+		return PackageConfig{}, nil, false
+	}
+	manifest, source, err := loadManifest(body)
+	if err != nil {
+		respondFailure(c, "Invalid manifest", err)
+		return PackageConfig{}, nil, false
+	}
+	return manifest, source, true
+}
+
+// Function to parse the body of a POST /packages style request, downloading the manifest
+// first when the body references a source URL. Errors carry the response to send.
+func loadManifest(body []byte) (PackageConfig, *ManifestSource, error) {
+	// Even the source_url reference is decoded as YAML, so an alias bomb is refused before that
+	if err := checkYAMLComplexity(body); err != nil {
+		return PackageConfig{}, nil, &responseError{400, gin.H{"error": "Invalid manifest: " + err.Error(), "code": "manifest_too_complex"}}
+	}
+
+	var source ManifestSource
+	if err := yaml.Unmarshal(body, &source); err == nil && source.URL != "" {
+		data, hash, err := fetchManifest(source)
+		if err != nil {
+			var mErr *manifestError
+			if errors.As(err, &mErr) {
+				return PackageConfig{}, nil, &responseError{422, gin.H{"error": mErr.Message, "code": mErr.Code, "source_url": source.URL}}
+			}
+			return PackageConfig{}, nil, &responseError{422, gin.H{"error": err.Error(), "code": "manifest_fetch_failed", "source_url": source.URL}}
+		}
+		body = data
+		source.SHA256 = hash
+	}
+
+	manifest, err := parseManifest(body)
+	if err != nil {
+		status, response := 400, gin.H{"error": "Invalid manifest: " + err.Error()}
+		var mErr *manifestError
+		var invalid *manifestInvalidError
+		switch {
+		case errors.As(err, &mErr):
+			response["code"] = mErr.Code
+		case errors.As(err, &invalid):
+			status, response["code"] = invalid.status()
+			response["problems"] = invalid.Problems
+		}
+		return PackageConfig{}, nil, &responseError{status, response}
+	}
+	if source.URL == "" {
+		return manifest, nil, nil
+	}
+	return manifest, &source, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Content type of the Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// MetricsConfig selects the collectors of GET /metrics/system
+type MetricsConfig struct {
+	// DisabledCollectors are left out of every scrape, like filesystem on hosts with
+	// mounts that are slow to stat
+	DisabledCollectors []string `yaml:"disabled_collectors"`
+}
+
+// Function to check that the disabled collectors exist
+func (c MetricsConfig) validate() error {
+	for _, name := range c.DisabledCollectors {
+		if !knownMetricsCollector(name) {
+			return fmt.Errorf("metrics.disabled_collectors: unknown collector %q; the collectors are %s", name, strings.Join(metricsCollectorNames(), ", "))
+		}
+	}
+	return nil
+}
+
+// Helper function to check if a collector is disabled
+func (c MetricsConfig) disabled(name string) bool {
+	for _, disabled := range c.DisabledCollectors {
+		if disabled == name {
+			return true
+		}
+	}
+	return false
+}
+
+// metricsCollector writes one group of node metrics. The names follow the Prometheus node
+// exporter, so dashboards built for it mostly work against the agent.
+type metricsCollector struct {
+	Name    string
+	Collect func(w *metricsWriter) error
+}
+
+// Collectors of GET /metrics/system. They read /proc and statfs through the collectors of
+// /inventory and never run a command, so a scrape stays cheap.
+var systemMetricsCollectors = []metricsCollector{
+	{Name: "meminfo", Collect: collectMemoryMetrics},
+	{Name: "loadavg", Collect: collectLoadMetrics},
+	{Name: "filesystem", Collect: collectFilesystemMetrics},
+	{Name: "netdev", Collect: collectNetworkMetrics},
+	{Name: "uptime", Collect: collectUptimeMetrics},
+}
+
+// Helper function to check if a collector of GET /metrics/system has name
+func knownMetricsCollector(name string) bool {
+	for _, collector := range systemMetricsCollectors {
+		if collector.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function to list the collectors of GET /metrics/system
+func metricsCollectorNames() []string {
+	names := make([]string, len(systemMetricsCollectors))
+	for i, collector := range systemMetricsCollectors {
+		names[i] = collector.Name
+	}
+	return names
+}
+
+// metricsWriter builds metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+// Helper function to start a metric family with its help text and type
+func (w *metricsWriter) family(name, help, kind string) {
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Helper function to write a sample of the current family. labels are name, value pairs.
+func (w *metricsWriter) sample(name string, value float64, labels ...string) {
+	w.buf.WriteString(name)
+	if len(labels) > 0 {
+		w.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			w.buf.WriteString(labels[i] + `="` + escapeLabelValue(labels[i+1]) + `"`)
+		}
+		w.buf.WriteByte('}')
+	}
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(formatMetricValue(value))
+	w.buf.WriteByte('\n')
+}
+
+// Helper function to escape a label value for the text format
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Helper function to format a sample value for the text format
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Function to write the memory metrics from /proc/meminfo
+func collectMemoryMetrics(w *metricsWriter) error {
+	memory, err := collectMemory()
+	if err != nil {
+		return err
+	}
+	for _, field := range []struct {
+		name  string
+		value uint64
+	}{
+		{"MemTotal", memory.TotalBytes},
+		{"MemAvailable", memory.AvailableBytes},
+		{"SwapTotal", memory.SwapTotalBytes},
+		{"SwapFree", memory.SwapFreeBytes},
+	} {
+		name := "node_memory_" + field.name + "_bytes"
+		w.family(name, "Memory information field "+field.name+"_bytes.", "gauge")
+		w.sample(name, float64(field.value))
+	}
+	return nil
+}
+
+// Function to write the load averages from /proc/loadavg
+func collectLoadMetrics(w *metricsWriter) error {
+	cpu, err := collectCPU()
+	if err != nil {
+		return err
+	}
+	for i, minutes := range []string{"1", "5", "15"} {
+		if i >= len(cpu.LoadAvg) {
+			break
+		}
+		name := "node_load" + minutes
+		w.family(name, minutes+"m load average.", "gauge")
+		w.sample(name, cpu.LoadAvg[i])
+	}
+	return nil
+}
+
+// Function to write the size and free space of every mounted block device
+func collectFilesystemMetrics(w *metricsWriter) error {
+	disks, err := collectDisks()
+	if err != nil {
+		return err
+	}
+	for _, family := range []struct {
+		name, help string
+		value      func(DiskInfo) uint64
+	}{
+		{"node_filesystem_size_bytes", "Filesystem size in bytes.", func(d DiskInfo) uint64 { return d.TotalBytes }},
+		{"node_filesystem_free_bytes", "Filesystem free space in bytes.", func(d DiskInfo) uint64 { return d.TotalBytes - d.UsedBytes }},
+		{"node_filesystem_avail_bytes", "Filesystem space available to non-root users in bytes.", func(d DiskInfo) uint64 { return d.FreeBytes }},
+	} {
+		w.family(family.name, family.help, "gauge")
+		for _, disk := range disks {
+			w.sample(family.name, float64(family.value(disk)), "device", disk.Device, "fstype", disk.FSType, "mountpoint", disk.MountPoint)
+		}
+	}
+	return nil
+}
+
+// Function to write the traffic counters of every network interface
+func collectNetworkMetrics(w *metricsWriter) error {
+	interfaces, err := collectInterfaceCounters()
+	if err != nil {
+		return err
+	}
+	for _, family := range []struct {
+		name, help string
+		value      func(InterfaceCounters) uint64
+	}{
+		{"node_network_receive_bytes_total", "Network device statistic receive_bytes.", func(i InterfaceCounters) uint64 { return i.ReceiveBytes }},
+		{"node_network_receive_packets_total", "Network device statistic receive_packets.", func(i InterfaceCounters) uint64 { return i.ReceivePackets }},
+		{"node_network_receive_errs_total", "Network device statistic receive_errs.", func(i InterfaceCounters) uint64 { return i.ReceiveErrors }},
+		{"node_network_transmit_bytes_total", "Network device statistic transmit_bytes.", func(i InterfaceCounters) uint64 { return i.TransmitBytes }},
+		{"node_network_transmit_packets_total", "Network device statistic transmit_packets.", func(i InterfaceCounters) uint64 { return i.TransmitPackets }},
+		{"node_network_transmit_errs_total", "Network device statistic transmit_errs.", func(i InterfaceCounters) uint64 { return i.TransmitErrors }},
+	} {
+		w.family(family.name, family.help, "counter")
+		for _, iface := range interfaces {
+			w.sample(family.name, float64(family.value(iface)), "device", iface.Name)
+		}
+	}
+	return nil
+}
+
+// Function to write the boot time and the current time, whose difference is the uptime
+func collectUptimeMetrics(w *metricsWriter) error {
+	boot := bootTime()
+	if boot.IsZero() {
+		return fmt.Errorf("unable to read the boot time from /proc/stat")
+	}
+	w.family("node_boot_time_seconds", "Node boot time, in unixtime.", "gauge")
+	w.sample("node_boot_time_seconds", float64(boot.Unix()))
+	w.family("node_time_seconds", "System time in seconds since epoch (1970).", "gauge")
+	w.sample("node_time_seconds", float64(time.Now().UnixNano())/1e9)
+	return nil
+}
+
+// Function to gather the enabled node metrics, followed by whether each collector
+// succeeded and how long it took. A failing collector leaves out its metrics only.
+func systemMetrics(cfg MetricsConfig) []byte {
+	type outcome struct {
+		name     string
+		duration time.Duration
+		err      error
+	}
+	var out metricsWriter
+	var outcomes []outcome
+	for _, collector := range systemMetricsCollectors {
+		if cfg.disabled(collector.Name) {
+			continue
+		}
+		var w metricsWriter
+		started := time.Now()
+		err := collector.Collect(&w)
+		outcomes = append(outcomes, outcome{collector.Name, time.Since(started), err})
+		if err == nil {
+			out.buf.Write(w.buf.Bytes())
+		}
+	}
+
+	out.family("node_scrape_collector_duration_seconds", "Duration of a collector scrape.", "gauge")
+	for _, o := range outcomes {
+		out.sample("node_scrape_collector_duration_seconds", o.duration.Seconds(), "collector", o.name)
+	}
+	out.family("node_scrape_collector_success", "Whether a collector succeeded.", "gauge")
+	for _, o := range outcomes {
+		success := 1.0
+		if o.err != nil {
+			success = 0
+		}
+		out.sample("node_scrape_collector_success", success, "collector", o.name)
+	}
+	return out.buf.Bytes()
+}
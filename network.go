@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// Most targets one POST /network/probe may list, and how many run at a time
+	maxProbeTargets  = 32
+	probeConcurrency = 8
+	// Timeout of a probe that doesn't set one, the longest one may set, and the budget
+	// of a whole request
+	defaultProbeTimeout = 2 * time.Second
+	maxProbeTimeout     = 10 * time.Second
+	probeRequestTimeout = 15 * time.Second
+)
+
+// Addresses of the cloud metadata services: the link-local one most clouds share, AWS over
+// IPv6, and Alibaba Cloud
+var metadataAddresses = []net.IP{net.ParseIP(metadataAddress), net.ParseIP("fd00:ec2::254"), net.ParseIP("100.100.100.200")}
+
+// NetworkConfig controls what the network probes may reach
+type NetworkConfig struct {
+	// AllowLinkLocal lets probes reach link-local and metadata service addresses. They're
+	// refused by default so the agent can't be used to read instance credentials.
+	AllowLinkLocal bool `yaml:"allow_link_local"`
+	// HTTPProbeNetworks are the networks POST /probe/http may reach, in CIDR notation.
+	// They replace the loopback, link-local, and private ranges allowed by default.
+	HTTPProbeNetworks []string `yaml:"http_probe_networks"`
+}
+
+// Function to check the network settings
+func (n NetworkConfig) validate() error {
+	for _, cidr := range n.HTTPProbeNetworks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("network.http_probe_networks: %q is not a CIDR network", cidr)
+		}
+	}
+	return nil
+}
+
+// ProbeTarget is one check of POST /network/probe. Targets are host:port for tcp, a URL
+// for http, and a host name or address for icmp and dns.
+type ProbeTarget struct {
+	Type      string `json:"type"`
+	Target    string `json:"target"`
+	TimeoutMS int    `json:"timeout_ms"`
+}
+
+// ProbeRequest is the body of POST /network/probe
+type ProbeRequest struct {
+	Targets []ProbeTarget `json:"targets"`
+}
+
+// Function to validate a probe request
+func (r ProbeRequest) validate() error {
+	if len(r.Targets) == 0 {
+		return fmt.Errorf("targets must list at least one target")
+	}
+	if len(r.Targets) > maxProbeTargets {
+		return fmt.Errorf("at most %d targets can be probed at once", maxProbeTargets)
+	}
+	for i, target := range r.Targets {
+		if err := target.validate(); err != nil {
+			return fmt.Errorf("targets[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Function to validate one probe target
+func (t ProbeTarget) validate() error {
+	if t.TimeoutMS < 0 || time.Duration(t.TimeoutMS)*time.Millisecond > maxProbeTimeout {
+		return fmt.Errorf("timeout_ms must be between 0 and %d", maxProbeTimeout.Milliseconds())
+	}
+	switch t.Type {
+	case "tcp":
+		if _, _, err := net.SplitHostPort(t.Target); err != nil {
+			return fmt.Errorf("tcp target must be host:port")
+		}
+	case "http":
+		if u, err := url.Parse(t.Target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("http target must be an http or https URL")
+		}
+	case "icmp", "dns":
+		if t.Target == "" {
+			return fmt.Errorf("%s target must be a host name or address", t.Type)
+		}
+	default:
+		return fmt.Errorf("type must be tcp, http, icmp, or dns")
+	}
+	return nil
+}
+
+// Helper function to return the timeout of a target
+func (t ProbeTarget) timeout() time.Duration {
+	if t.TimeoutMS == 0 {
+		return defaultProbeTimeout
+	}
+	return time.Duration(t.TimeoutMS) * time.Millisecond
+}
+
+// ProbeResult is the outcome of one probe
+type ProbeResult struct {
+	Type   string `json:"type"`
+	Target string `json:"target"`
+	// Status is ok, failed, skipped when the agent can't run this kind of probe, or
+	// forbidden when the target resolves to an address probes may not reach
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	// Address is the address that answered
+	Address string `json:"address,omitempty"`
+	// HTTPStatus is the response status of http probes
+	HTTPStatus int `json:"http_status,omitempty"`
+	// Addresses are what dns probes resolved the name to
+	Addresses []string `json:"addresses,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// forbiddenAddressError reports a probe of an address probes may not reach
+type forbiddenAddressError struct {
+	Address net.IP
+}
+
+func (e *forbiddenAddressError) Error() string {
+	return fmt.Sprintf("%s is a link-local or metadata service address; set network.allow_link_local to probe it", e.Address)
+}
+
+// skippedProbeError reports a probe the agent can't run on this host
+type skippedProbeError struct {
+	Reason string
+}
+
+func (e *skippedProbeError) Error() string {
+	return e.Reason
+}
+
+// Helper function to refuse the addresses probes may not reach
+func checkProbeAddress(ip net.IP, allowLinkLocal bool) error {
+	if allowLinkLocal || ip == nil {
+		return nil
+	}
+	if ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || containsIP(metadataAddresses, ip) {
+		return &forbiddenAddressError{Address: ip}
+	}
+	return nil
+}
+
+// Helper function to build a dialer that checks each address right before connecting,
+// after name resolution, so neither a DNS name nor a redirect can lead to a forbidden one
+func probeDialer(check func(net.IP) error) *net.Dialer {
+	return &net.Dialer{
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return check(net.ParseIP(host))
+		},
+	}
+}
+
+// Helper function to build an HTTP client for probes, connecting through a probeDialer
+// with check. Proxies from the environment are bypassed so the checks apply to the
+// target itself, and at most maxRedirects redirects are followed.
+func probeClient(check func(net.IP) error, tlsConfig *tls.Config, maxRedirects int) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:             nil,
+			DialContext:       probeDialer(check).DialContext,
+			TLSClientConfig:   tlsConfig,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(_ *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+}
+
+// Helper function to check addresses against the link-local and metadata restriction
+func linkLocalCheck(allowLinkLocal bool) func(net.IP) error {
+	return func(ip net.IP) error {
+		return checkProbeAddress(ip, allowLinkLocal)
+	}
+}
+
+// Function to run probes concurrently, within the budget of a single request. Results
+// are in the order of targets.
+func runProbes(ctx context.Context, targets []ProbeTarget, allowLinkLocal bool) []ProbeResult {
+	ctx, cancel := context.WithTimeout(ctx, probeRequestTimeout)
+	defer cancel()
+
+	tasks := make([]task, len(targets))
+	for i, target := range targets {
+		tasks[i] = task{Name: target.Type + " " + target.Target, Run: func(ctx context.Context) (interface{}, error) {
+			return runProbe(ctx, target, allowLinkLocal), nil
+		}}
+	}
+	results := make([]ProbeResult, len(targets))
+	for i, result := range fanOut(ctx, tasks, probeConcurrency, maxProbeTimeout) {
+		if result.Err != nil {
+			// Only the request's own deadline stops a probe before it reports
+			results[i] = ProbeResult{Type: targets[i].Type, Target: targets[i].Target, Status: "failed", Error: "the request ran out of time before the probe finished"}
+			continue
+		}
+		results[i] = result.Value.(ProbeResult)
+	}
+	return results
+}
+
+// Function to run a single probe within the target's timeout
+func runProbe(ctx context.Context, target ProbeTarget, allowLinkLocal bool) ProbeResult {
+	ctx, cancel := context.WithTimeout(ctx, target.timeout())
+	defer cancel()
+
+	result := ProbeResult{Type: target.Type, Target: target.Target}
+	started := time.Now()
+	var err error
+	switch target.Type {
+	case "tcp":
+		err = probeTCP(ctx, target.Target, allowLinkLocal, &result)
+	case "http":
+		err = probeHTTP(ctx, target.Target, allowLinkLocal, &result)
+	case "icmp":
+		err = probeICMP(ctx, target.Target, allowLinkLocal, &result)
+	case "dns":
+		err = probeDNS(ctx, target.Target, &result)
+	}
+	if result.LatencyMS == 0 && err == nil {
+		result.LatencyMS = milliseconds(time.Since(started))
+	}
+
+	var forbidden *forbiddenAddressError
+	var skipped *skippedProbeError
+	switch {
+	case err == nil:
+		result.Status = "ok"
+	case errors.As(err, &forbidden):
+		result.Status = "forbidden"
+		result.Error = forbidden.Error()
+	case errors.As(err, &skipped):
+		result.Status = "skipped"
+		result.Error = skipped.Error()
+	default:
+		result.Status = "failed"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// Helper function to express a duration in fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Function to check that a TCP connection to target can be opened
+func probeTCP(ctx context.Context, target string, allowLinkLocal bool, result *ProbeResult) error {
+	conn, err := probeDialer(linkLocalCheck(allowLinkLocal)).DialContext(ctx, "tcp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	result.Address = conn.RemoteAddr().String()
+	return nil
+}
+
+// Function to check that target answers an HTTP GET. Any response counts, whatever its
+// status; redirects aren't followed and the body isn't read
+func probeHTTP(ctx context.Context, target string, allowLinkLocal bool, result *ProbeResult) error {
+	client := probeClient(linkLocalCheck(allowLinkLocal), &tls.Config{}, 0)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			result.Address = info.Conn.RemoteAddr().String()
+		},
+	}
+	request, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("User-Agent", "cosi/"+version)
+	started := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	result.LatencyMS = milliseconds(time.Since(started))
+	result.HTTPStatus = response.StatusCode
+	return nil
+}
+
+// Function to resolve target with the host's resolver
+func probeDNS(ctx context.Context, target string, result *ProbeResult) error {
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, target)
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		result.Addresses = append(result.Addresses, address.IP.String())
+	}
+	return nil
+}
+
+// Function to send target one ICMP echo request and wait for the reply
+func probeICMP(ctx context.Context, target string, allowLinkLocal bool, result *ProbeResult) error {
+	ip, err := resolveProbeHost(ctx, target, allowLinkLocal)
+	if err != nil {
+		return err
+	}
+	conn, err := openICMP(ip)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rtt, err := conn.Echo(ctx, 1)
+	if err != nil {
+		return err
+	}
+	result.Address = ip.String()
+	result.LatencyMS = milliseconds(rtt)
+	return nil
+}
+
+// Helper function to resolve a host to the address a probe should use, preferring IPv4
+func resolveProbeHost(ctx context.Context, host string, allowLinkLocal bool) (net.IP, error) {
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ip := addresses[0].IP
+	for _, address := range addresses {
+		if address.IP.To4() != nil {
+			ip = address.IP
+			break
+		}
+	}
+	return ip, checkProbeAddress(ip, allowLinkLocal)
+}
+
+// Echo identifiers of the agent's ICMP sockets; raw sockets see every reply on the host,
+// so each socket matches replies by its own identifier
+var icmpEchoID atomic.Uint32
+
+func init() {
+	icmpEchoID.Store(uint32(os.Getpid()))
+}
+
+// icmpConn is a raw ICMP socket sending echo requests to one address
+type icmpConn struct {
+	conn *net.IPConn
+	ip   net.IP
+	id   uint16
+	v6   bool
+}
+
+// Function to open a raw ICMP socket to ip. Raw sockets need CAP_NET_RAW; without it the
+// error is a skippedProbeError.
+func openICMP(ip net.IP) (*icmpConn, error) {
+	network, v6 := "ip4:icmp", ip.To4() == nil
+	if v6 {
+		network = "ip6:ipv6-icmp"
+	}
+	conn, err := net.ListenIP(network, nil)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return nil, &skippedProbeError{Reason: "ICMP probes need raw sockets, which require CAP_NET_RAW"}
+		}
+		return nil, err
+	}
+	return &icmpConn{conn: conn, ip: ip, id: uint16(icmpEchoID.Add(1)), v6: v6}, nil
+}
+
+// Close closes the socket
+func (c *icmpConn) Close() error {
+	return c.conn.Close()
+}
+
+// icmpReply is what answered an echo request: the echo reply of the target, or the error
+// message of a router on the way
+type icmpReply struct {
+	From net.IP
+	RTT  time.Duration
+	// Reached is set for the echo reply, and Unreachable for a destination unreachable
+	// message; otherwise a router reported the request's time to live exceeded
+	Reached     bool
+	Unreachable bool
+}
+
+// ICMP message types the agent sends and reads, for IPv4 and IPv6
+type icmpTypes struct {
+	EchoRequest, EchoReply, TimeExceeded, Unreachable byte
+}
+
+var (
+	icmpV4Types = icmpTypes{EchoRequest: 8, EchoReply: 0, TimeExceeded: 11, Unreachable: 3}
+	icmpV6Types = icmpTypes{EchoRequest: 128, EchoReply: 129, TimeExceeded: 3, Unreachable: 1}
+)
+
+// Echo sends one echo request with sequence number seq and returns the round trip time
+// of its reply
+func (c *icmpConn) Echo(ctx context.Context, seq uint16) (time.Duration, error) {
+	reply, err := c.exchange(ctx, seq)
+	if err != nil {
+		return 0, err
+	}
+	if !reply.Reached {
+		return 0, fmt.Errorf("%s reported %s unreachable", reply.From, c.ip)
+	}
+	return reply.RTT, nil
+}
+
+// SetTTL sets the time to live, or hop limit, of the echo requests sent afterwards
+func (c *icmpConn) SetTTL(ttl int) error {
+	level, option := syscall.IPPROTO_IP, syscall.IP_TTL
+	if c.v6 {
+		level, option = syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS
+	}
+	raw, err := c.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var optionErr error
+	if err := raw.Control(func(fd uintptr) {
+		optionErr = syscall.SetsockoptInt(int(fd), level, option, ttl)
+	}); err != nil {
+		return err
+	}
+	return optionErr
+}
+
+// Helper function to send an echo request and wait, until the deadline of ctx, for the
+// reply or a router's error message about it
+func (c *icmpConn) exchange(ctx context.Context, seq uint16) (*icmpReply, error) {
+	types := icmpV4Types
+	if c.v6 {
+		types = icmpV6Types
+	}
+	// type, code, checksum, identifier, sequence, then a payload
+	request := []byte{types.EchoRequest, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(request[4:], c.id)
+	binary.BigEndian.PutUint16(request[6:], seq)
+	request = append(request, []byte("cosi-probe")...)
+	// The kernel fills in the ICMPv6 checksum, which covers the IPv6 pseudo-header
+	if !c.v6 {
+		binary.BigEndian.PutUint16(request[2:], icmpChecksum(request))
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultProbeTimeout)
+	}
+	c.conn.SetDeadline(deadline)
+	started := time.Now()
+	if _, err := c.conn.WriteToIP(request, &net.IPAddr{IP: c.ip}); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, 1500)
+	for {
+		n, from, err := c.conn.ReadFromIP(buffer)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, fmt.Errorf("no reply from %s", c.ip)
+			}
+			return nil, err
+		}
+		message := buffer[:n]
+		if n < 8 {
+			continue
+		}
+		reply := &icmpReply{From: from.IP, RTT: time.Since(started)}
+		switch message[0] {
+		case types.EchoReply:
+			if !from.IP.Equal(c.ip) || !c.ours(message, types, seq) {
+				continue
+			}
+			reply.Reached = true
+		case types.TimeExceeded, types.Unreachable:
+			// Error messages quote the IP header of the request, then its first 8 bytes
+			quoted := message[8:]
+			if c.v6 {
+				if len(quoted) < 40 {
+					continue
+				}
+				quoted = quoted[40:]
+			} else {
+				if len(quoted) < 20 || len(quoted) < int(quoted[0]&0x0f)*4 {
+					continue
+				}
+				quoted = quoted[int(quoted[0]&0x0f)*4:]
+			}
+			if len(quoted) < 8 || quoted[0] != types.EchoRequest || !c.ours(quoted, types, seq) {
+				continue
+			}
+			reply.Unreachable = message[0] == types.Unreachable
+		default:
+			continue
+		}
+		return reply, nil
+	}
+}
+
+// Helper function to check if an echo message carries the socket's identifier and seq
+func (c *icmpConn) ours(message []byte, types icmpTypes, seq uint16) bool {
+	return binary.BigEndian.Uint16(message[4:]) == c.id && binary.BigEndian.Uint16(message[6:]) == seq
+}
+
+// Helper function to compute the Internet checksum of an ICMPv4 message
+func icmpChecksum(message []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(message); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(message[i:]))
+	}
+	if len(message)%2 == 1 {
+		sum += uint32(message[len(message)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
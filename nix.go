@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Profiles of NixOS: the system generation and root's nix-env profile
+const (
+	nixSystemProfile = "/nix/var/nix/profiles/system"
+	nixUserProfile   = "/nix/var/nix/profiles/default"
+)
+
+// Reason returned for every operation that would change packages on NixOS
+const nixReadOnlyReason = "NixOS is configured declaratively: packages come from configuration.nix " +
+	"and nixos-rebuild, and imperative installs would be lost on the next rebuild. " +
+	"The agent only lists packages on NixOS."
+
+var errNixReadOnly = errors.New(nixReadOnlyReason)
+
+// nixManager lists the packages of a NixOS host: those of the system generation and
+// those installed with nix-env. It doesn't change packages.
+type nixManager struct{}
+
+func (nixManager) Name() string { return "nix" }
+
+func (nixManager) PrivilegedTools() []string { return nil }
+
+func (nixManager) ReadOnly() (string, string) { return "unsupported_operation", nixReadOnlyReason }
+
+func (nixManager) InstallCommand(config PackageConfig) *exec.Cmd { return nil }
+
+func (nixManager) RemoveCommand(config PackageConfig) *exec.Cmd { return nil }
+
+// ListCommand and VersionsCommand only cover nix-env; the full list comes from
+// InstalledVersions
+func (nixManager) ListCommand() *exec.Cmd {
+	return newCommand("nix-env", "-q")
+}
+
+func (nixManager) DatabasePaths() []string {
+	// Both profiles are symlinks that move to a new generation on every change
+	return []string{nixSystemProfile, nixUserProfile}
+}
+
+func (nixManager) RefreshCommand() *exec.Cmd { return nil }
+
+func (nixManager) RepairCommands() []*exec.Cmd { return nil }
+
+func (nixManager) ManualCommand() *exec.Cmd {
+	return newCommand("nix-env", "-q")
+}
+
+func (nixManager) VersionsCommand() *exec.Cmd {
+	return newCommand("nix-env", "-q")
+}
+
+func (nixManager) PinnedSpec(name, version string) string {
+	return name + "-" + version
+}
+
+func (nixManager) ParseSpec(spec string) (string, string) {
+	return parseNixName(spec)
+}
+
+func (nixManager) Candidates(ctx context.Context, names []string) (map[string]string, error) {
+	return nil, errNixReadOnly
+}
+
+func (nixManager) AvailableVersions(ctx context.Context, names []string) (map[string][]string, error) {
+	return nil, errNixReadOnly
+}
+
+// InstalledVersions reads the packages of the current system generation from its
+// store references, and adds those of root's nix-env profile
+func (nixManager) InstalledVersions(ctx context.Context) (map[string]string, error) {
+	versions := make(map[string]string)
+	cmd := newCommand("nix-store", "--query", "--references", "/run/current-system/sw")
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	for _, path := range strings.Fields(result.Stdout) {
+		// Store paths are /nix/store/<hash>-<name>-<version>
+		_, nameVersion, ok := strings.Cut(filepath.Base(path), "-")
+		if !ok {
+			continue
+		}
+		name, version := parseNixName(nameVersion)
+		versions[name] = version
+	}
+
+	cmd = newCommand("nix-env", "-q")
+	result, err = runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	for _, line := range strings.Fields(result.Stdout) {
+		name, version := parseNixName(line)
+		versions[name] = version
+	}
+	return versions, nil
+}
+
+// InstalledKernels returns the kernel of the current system generation, which is the
+// one the host boots into next
+func (nixManager) InstalledKernels(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir("/run/current-system/kernel-modules/lib/modules")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var kernels []string
+	for _, entry := range entries {
+		kernels = append(kernels, entry.Name())
+	}
+	return kernels, nil
+}
+
+// CheckReboot compares the booted generation with the current one. A switch that
+// changed the kernel, initrd, or modules only takes effect after a reboot.
+func (nixManager) CheckReboot(ctx context.Context, status *RebootStatus) error {
+	for _, part := range []string{"kernel", "initrd", "kernel-modules"} {
+		booted, err := filepath.EvalSymlinks(filepath.Join("/run/booted-system", part))
+		if err != nil {
+			continue
+		}
+		current, err := filepath.EvalSymlinks(filepath.Join("/run/current-system", part))
+		if err == nil && booted != current {
+			status.addReason("kernel", "the current system generation has a different "+part+" than the booted one")
+		}
+	}
+	return nil
+}
+
+// Helper function to split a Nix package name like hello-2.12.1 at the first dash
+// followed by a digit, which is where Nix starts the version
+func parseNixName(nameVersion string) (string, string) {
+	for i := 0; i+1 < len(nameVersion); i++ {
+		if nameVersion[i] == '-' && nameVersion[i+1] >= '0' && nameVersion[i+1] <= '9' {
+			return nameVersion[:i], nameVersion[i+1:]
+		}
+	}
+	return nameVersion, ""
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// The kubeconfig kubeadm writes on control plane nodes
+	adminKubeconfig = "/etc/kubernetes/admin.conf"
+	// The kubelet's own kubeconfig, whose client certificate names the node
+	kubeletKubeconfig = "/etc/kubernetes/kubelet.conf"
+	// How long a drain may take by default, and at most
+	defaultDrainTimeout = 5 * time.Minute
+	maxDrainTimeout     = time.Hour
+	// Requests of cordon and uncordon to the API server
+	nodeRequestTimeout = "30s"
+)
+
+// Scope of the tokens that may cordon, uncordon and drain the node
+const scopeKubernetesNode = "kubernetes-node"
+
+// The only ways a supplied kubeconfig may authenticate. The others run a command
+// (exec, auth-provider) or read a file of this host (tokenFile, client-certificate,
+// client-key), as the agent.
+var kubeconfigUserFields = map[string]bool{"client-certificate-data": true, "client-key-data": true, "token": true}
+
+// Only one node operation runs at a time, held from the request until its job finishes
+var nodeOperationRunning sync.Mutex
+
+var (
+	nodeNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+	// Lines of kubectl drain's output that report its progress
+	drainEvicting  = regexp.MustCompile(`^evicting pod (\S+/\S+)$`)
+	drainEvicted   = regexp.MustCompile(`^pod/(\S+) evicted$`)
+	drainPDB       = regexp.MustCompile(`error when evicting pods/"([^"]+)" -n "([^"]+)".*disruption budget`)
+	drainIgnored   = regexp.MustCompile(`ignoring DaemonSet-managed Pods: (.+)$`)
+	drainCannot    = regexp.MustCompile(`^(.+?) \(use (--[a-z-]+) to \w+\): (.+)$`)
+	drainPodListed = regexp.MustCompile(`^[a-z0-9][-a-z0-9.]*/[a-z0-9][-a-z0-9.]*$`)
+)
+
+// The options of POST /kubernetes/node/drain that lift what kubectl drain refuses by default
+var drainOverrides = map[string]string{
+	"--delete-emptydir-data": "delete_emptydir_data",
+	"--ignore-daemonsets":    "ignore_daemonsets",
+	"--force":                "force",
+}
+
+// NodeRequest is the body of POST /kubernetes/node/cordon and /uncordon
+type NodeRequest struct {
+	// Node defaults to the node of the local kubelet
+	Node string `json:"node"`
+	// Kubeconfig is a kubeconfig to use instead of /etc/kubernetes/admin.conf
+	Kubeconfig string `json:"kubeconfig"`
+}
+
+// DrainRequest is the body of POST /kubernetes/node/drain, and the drain options of a
+// reboot or shutdown with drain_first
+type DrainRequest struct {
+	NodeRequest
+	// GracePeriodSeconds replaces the pods' own termination grace period when set
+	GracePeriodSeconds *int `json:"grace_period_seconds"`
+	DeleteEmptyDirData bool `json:"delete_emptydir_data"`
+	// IgnoreDaemonSets defaults to true: DaemonSet pods come back on the node anyway
+	IgnoreDaemonSets *bool `json:"ignore_daemonsets"`
+	// Force also deletes pods that no controller manages, which won't be recreated
+	Force          bool `json:"force"`
+	TimeoutSeconds int  `json:"timeout_seconds"`
+}
+
+// NodeOperation is the result of a kubernetes-node job, filled in as kubectl reports
+// its progress
+type NodeOperation struct {
+	Node   string `json:"node"`
+	Action string `json:"action"`
+	// EvictingPods are pods whose eviction was requested but not yet confirmed
+	EvictingPods []string `json:"evicting_pods"`
+	EvictedPods  []string `json:"evicted_pods"`
+	// IgnoredPods are the DaemonSet pods the drain leaves in place
+	IgnoredPods []string `json:"ignored_pods,omitempty"`
+	// BlockingPods are the pods that kept the drain from finishing
+	BlockingPods []BlockingPod `json:"blocking_pods,omitempty"`
+	ExitCode     int           `json:"exit_code"`
+	// PowerAction is the reboot or shutdown scheduled once the drain succeeded
+	PowerAction *PendingPowerAction `json:"power_action,omitempty"`
+}
+
+// BlockingPod is a pod kubectl drain couldn't evict
+type BlockingPod struct {
+	Pod    string `json:"pod"`
+	Reason string `json:"reason"`
+	// Option is the drain option that would let the drain remove the pod, if any
+	Option string `json:"option,omitempty"`
+}
+
+// nodeTarget is the node a job acts on and how to reach the API server
+type nodeTarget struct {
+	Node       string
+	Kubeconfig string
+	// cleanup removes a supplied kubeconfig once the job is done
+	cleanup func()
+}
+
+// Function to find the name of the local node from the client certificate of the
+// kubelet, which is issued to system:node:<name>. The hostname is the fallback, which
+// is what the kubelet registers as unless it was told otherwise.
+func localNodeName() string {
+	var kubeconfig struct {
+		Users []struct {
+			User struct {
+				ClientCertificate string `yaml:"client-certificate"`
+			} `yaml:"user"`
+		} `yaml:"users"`
+	}
+	if data, err := os.ReadFile(kubeletKubeconfig); err == nil && yaml.Unmarshal(data, &kubeconfig) == nil {
+		for _, user := range kubeconfig.Users {
+			if user.User.ClientCertificate == "" {
+				continue
+			}
+			if certs, _, err := readCertificateFile(user.User.ClientCertificate); err == nil && len(certs) > 0 {
+				if name, ok := strings.CutPrefix(certs[0].Subject.CommonName, "system:node:"); ok {
+					return name
+				}
+			}
+		}
+	}
+	hostname, _ := os.Hostname()
+	return strings.ToLower(hostname)
+}
+
+// Function to resolve the node and kubeconfig of a request. A supplied kubeconfig is
+// written to a private temporary file for kubectl.
+func prepareNodeTarget(request NodeRequest) (*nodeTarget, error) {
+	if _, err := exec.LookPath("kubectl"); err != nil {
+		return nil, &requestError{501, "kubectl_missing", "kubectl is not installed"}
+	}
+	target := &nodeTarget{Node: request.Node, Kubeconfig: adminKubeconfig, cleanup: func() {}}
+	if target.Node == "" {
+		target.Node = localNodeName()
+	}
+	if len(target.Node) > 253 || !nodeNamePattern.MatchString(target.Node) {
+		return nil, &requestError{400, "invalid_node_name", fmt.Sprintf("%q is not a valid node name", target.Node)}
+	}
+
+	if request.Kubeconfig == "" {
+		if _, err := os.Stat(adminKubeconfig); err != nil {
+			return nil, &requestError{400, "kubeconfig_required", adminKubeconfig + " does not exist on this node; supply a kubeconfig"}
+		}
+		return target, nil
+	}
+	if err := checkKubeconfig(request.Kubeconfig); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp("", "cosi-kubeconfig-*")
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.WriteString(request.Kubeconfig)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	target.Kubeconfig = file.Name()
+	target.cleanup = func() { os.Remove(file.Name()) }
+	return target, nil
+}
+
+// Function to check a supplied kubeconfig before kubectl reads it. Its users may only
+// carry their credentials inline, and its clusters their CA. kubectl matches the field
+// names regardless of case, so they are compared that way here too.
+func checkKubeconfig(kubeconfig string) error {
+	var parsed struct {
+		Clusters []struct {
+			Name    string                 `yaml:"name"`
+			Cluster map[string]interface{} `yaml:"cluster"`
+		} `yaml:"clusters"`
+		Users []struct {
+			Name string                 `yaml:"name"`
+			User map[string]interface{} `yaml:"user"`
+		} `yaml:"users"`
+	}
+	if err := yaml.Unmarshal([]byte(kubeconfig), &parsed); err != nil || len(parsed.Clusters) == 0 {
+		return &requestError{400, "invalid_kubeconfig", "kubeconfig must be a kubeconfig file with clusters"}
+	}
+	for _, cluster := range parsed.Clusters {
+		for field := range cluster.Cluster {
+			if strings.EqualFold(field, "certificate-authority") {
+				return &requestError{400, "invalid_kubeconfig", fmt.Sprintf("cluster %q: certificate-authority names a file on this host; use certificate-authority-data", cluster.Name)}
+			}
+		}
+	}
+	for _, user := range parsed.Users {
+		fields := make([]string, 0, len(user.User))
+		for field := range user.User {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			if !kubeconfigUserFields[field] {
+				return &requestError{400, "invalid_kubeconfig", fmt.Sprintf("user %q: %s is not allowed; a supplied kubeconfig authenticates with client-certificate-data and client-key-data, or a token", user.Name, field)}
+			}
+		}
+	}
+	return nil
+}
+
+// Function to check the options of a drain, returning its timeout
+func (r DrainRequest) validate() (time.Duration, error) {
+	timeout := defaultDrainTimeout
+	if r.TimeoutSeconds != 0 {
+		timeout = time.Duration(r.TimeoutSeconds) * time.Second
+		if timeout < 0 || timeout > maxDrainTimeout {
+			return 0, &requestError{400, "invalid_timeout", fmt.Sprintf("timeout_seconds must be between 1 and %d", int(maxDrainTimeout.Seconds()))}
+		}
+	}
+	if r.GracePeriodSeconds != nil && *r.GracePeriodSeconds < -1 {
+		return 0, &requestError{400, "invalid_grace_period", "grace_period_seconds must be -1, for the pods' own grace period, or more"}
+	}
+	return timeout, nil
+}
+
+// Function to build the kubectl arguments of a node job
+func nodeCommandArgs(action string, target *nodeTarget, request DrainRequest, timeout time.Duration) []string {
+	args := []string{"--kubeconfig", target.Kubeconfig, action, target.Node}
+	if action != "drain" {
+		return append(args, "--request-timeout="+nodeRequestTimeout)
+	}
+	if request.IgnoreDaemonSets == nil || *request.IgnoreDaemonSets {
+		args = append(args, "--ignore-daemonsets")
+	}
+	if request.DeleteEmptyDirData {
+		args = append(args, "--delete-emptydir-data")
+	}
+	if request.Force {
+		args = append(args, "--force")
+	}
+	if request.GracePeriodSeconds != nil {
+		args = append(args, "--grace-period="+strconv.Itoa(*request.GracePeriodSeconds))
+	}
+	return append(args, "--timeout="+timeout.String())
+}
+
+// nodeProgress follows kubectl's output line by line into the job's result. stdout and
+// stderr each write through their own lineWriter, sharing the lock.
+type nodeProgress struct {
+	mu        sync.Mutex
+	job       *Job
+	operation NodeOperation
+}
+
+// Function to copy the operation so the job's result isn't changed while it is read
+func (p *nodeProgress) snapshot() *NodeOperation {
+	operation := p.operation
+	operation.EvictingPods = append([]string{}, p.operation.EvictingPods...)
+	operation.EvictedPods = append([]string{}, p.operation.EvictedPods...)
+	operation.IgnoredPods = append([]string(nil), p.operation.IgnoredPods...)
+	operation.BlockingPods = append([]BlockingPod(nil), p.operation.BlockingPods...)
+	return &operation
+}
+
+// Function to add a blocking pod once
+func (p *nodeProgress) block(pod BlockingPod) {
+	for _, blocking := range p.operation.BlockingPods {
+		if blocking.Pod == pod.Pod {
+			return
+		}
+	}
+	p.operation.BlockingPods = append(p.operation.BlockingPods, pod)
+}
+
+// Function to update the operation from a line of kubectl drain. Pods are named
+// namespace/name, except in the "evicted" lines, which leave the namespace out.
+func (p *nodeProgress) line(line string) {
+	line = strings.TrimSpace(line)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	op := &p.operation
+	switch {
+	case drainEvicting.MatchString(line):
+		pod := drainEvicting.FindStringSubmatch(line)[1]
+		if !containsString(op.EvictingPods, pod) {
+			op.EvictingPods = append(op.EvictingPods, pod)
+		}
+	case drainEvicted.MatchString(line):
+		name := drainEvicted.FindStringSubmatch(line)[1]
+		pod := name
+		for i, evicting := range op.EvictingPods {
+			if strings.HasSuffix(evicting, "/"+name) {
+				pod = evicting
+				op.EvictingPods = append(op.EvictingPods[:i], op.EvictingPods[i+1:]...)
+				break
+			}
+		}
+		op.EvictedPods = append(op.EvictedPods, pod)
+	case drainPDB.MatchString(line):
+		match := drainPDB.FindStringSubmatch(line)
+		p.block(BlockingPod{Pod: match[2] + "/" + match[1], Reason: "a PodDisruptionBudget doesn't allow the eviction"})
+	case drainIgnored.MatchString(line):
+		for _, pod := range strings.Split(drainIgnored.FindStringSubmatch(line)[1], ", ") {
+			if pod = strings.TrimSpace(pod); !containsString(op.IgnoredPods, pod) {
+				op.IgnoredPods = append(op.IgnoredPods, pod)
+			}
+		}
+	case strings.Contains(line, "cannot delete "):
+		// Every kind of pod drain refuses is listed in one error, each followed by its pods
+		for _, part := range strings.Split(line, "cannot delete ")[1:] {
+			match := drainCannot.FindStringSubmatch(strings.TrimRight(strings.TrimSpace(part), ","))
+			if match == nil {
+				continue
+			}
+			for _, pod := range strings.Split(match[3], ", ") {
+				if pod = strings.Trim(pod, " []"); drainPodListed.MatchString(pod) {
+					p.block(BlockingPod{Pod: pod, Reason: "drain doesn't delete " + match[1], Option: drainOverrides[match[2]]})
+				}
+			}
+		}
+	default:
+		return
+	}
+	jobs.SetResult(p.job, p.snapshot())
+}
+
+// lineWriter hands the complete lines written to it to a nodeProgress
+type lineWriter struct {
+	progress *nodeProgress
+	partial  []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.progress.line(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Function to run a cordon, uncordon or drain as the job, returning its result
+func runNodeCommand(job *Job, control *jobControl, action string, target *nodeTarget, request DrainRequest, timeout time.Duration) (*NodeOperation, error) {
+	progress := &nodeProgress{job: job, operation: NodeOperation{Node: target.Node, Action: action, EvictingPods: []string{}, EvictedPods: []string{}}}
+	jobs.SetResult(job, progress.snapshot())
+
+	cmd := newCommand("kubectl", nodeCommandArgs(action, target, request, timeout)...)
+	output := newCommandOutput(control)
+	output.attach(cmd)
+	cmd.Stdout = io.MultiWriter(cmd.Stdout, &lineWriter{progress: progress})
+	cmd.Stderr = io.MultiWriter(cmd.Stderr, &lineWriter{progress: progress})
+	err := control.run(cmd)
+	output.flush()
+	result := output.Result()
+
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	progress.operation.ExitCode = -1
+	if cmd.ProcessState != nil {
+		progress.operation.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	operation := progress.snapshot()
+	if err == nil {
+		return operation, nil
+	}
+	if cancelled, _ := control.state(); cancelled {
+		return operation, errJobCancelled
+	}
+	var pdb, others []string
+	for _, pod := range operation.BlockingPods {
+		if strings.Contains(pod.Reason, "PodDisruptionBudget") {
+			pdb = append(pdb, pod.Pod)
+		} else {
+			others = append(others, pod.Pod)
+		}
+	}
+	switch {
+	case len(pdb) > 0:
+		return operation, fmt.Errorf("PodDisruptionBudgets kept %s from being evicted", strings.Join(pdb, ", "))
+	case len(others) > 0:
+		return operation, fmt.Errorf("kubectl drain won't remove %s; see blocking_pods for the options that allow it", strings.Join(others, ", "))
+	}
+	return operation, &commandError{Tool: "kubectl", Result: result, Err: err}
+}
+
+// Function to start a kubernetes-node job that runs action against the node, then
+// next if it succeeded. It returns once the job exists; the job reports the progress.
+func startNodeJob(c *gin.Context, action string, request DrainRequest, next func(*NodeOperation) error) (*Job, *nodeTarget, error) {
+	timeout, err := request.validate()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !nodeOperationRunning.TryLock() {
+		response := gin.H{"error": "Another node operation is in progress", "code": "operation_in_progress"}
+		if active := jobs.Active("kubernetes-node"); len(active) > 0 {
+			response["job_id"] = active[0].ID
+		}
+		return nil, nil, &responseError{409, response}
+	}
+	target, err := prepareNodeTarget(request.NodeRequest)
+	if err != nil {
+		nodeOperationRunning.Unlock()
+		return nil, nil, err
+	}
+
+	// The job outlives the request that started it
+	job := jobs.New(c.Request.Context(), "kubernetes-node")
+	go func() {
+		defer nodeOperationRunning.Unlock()
+		defer target.cleanup()
+		if !jobs.Start(job) {
+			return
+		}
+		control := jobs.Control(job)
+		defer control.Close()
+		operation, err := runNodeCommand(job, control, action, target, request, timeout)
+		if err == nil && next != nil {
+			err = next(operation)
+		}
+		jobs.Finish(job, operation, action+" "+target.Node, err)
+	}()
+	return job, target, nil
+}
+
+// Function to drain the node and then reboot or power it off, the work of a power
+// request with drain_first. The node stays cordoned afterwards; it is uncordoned with
+// POST /kubernetes/node/uncordon once it is back.
+func drainThenPower(c *gin.Context, action string, request PowerRequest) (*Job, *nodeTarget, error) {
+	client := c.ClientIP()
+	details := map[string]interface{}{"delay_seconds": request.DelaySeconds, "message": request.Message, "drain_first": true}
+	return startNodeJob(c, "drain", request.Drain, func(operation *NodeOperation) error {
+		// A package or kubeadm job may have started while the node drained
+		if active := jobs.Active("packages", "kubernetes"); len(active) > 0 {
+			return &requestError{409, "operation_in_progress", fmt.Sprintf("the node was drained, but a %s job (%s) started meanwhile; refusing to %s", active[0].Type, active[0].ID, action)}
+		}
+		// The audit entry must be on disk before the host goes down
+		entry := AuditEntry{Action: "power." + action, Client: client, Outcome: "requested", Details: details}
+		if err := audit.Record(entry); err != nil {
+			return fmt.Errorf("refusing to %s without an audit record: %w", action, err)
+		}
+		pending, err := schedulePowerAction(action, request)
+		if err != nil {
+			audit.Record(auditOutcome("power."+action, client, details, err))
+			return err
+		}
+		operation.PowerAction = pending
+		return nil
+	})
+}
+
+// Function to register the node cordon, uncordon and drain endpoints
+func registerNodeRoutes(r *gin.Engine) {
+	// Define the /kubernetes/node/{cordon,uncordon,drain} endpoints that run kubectl
+	// against this node, or the one named, as a kubernetes-node job
+	for _, action := range []string{"cordon", "uncordon", "drain"} {
+		r.POST("/kubernetes/node/"+action, requireScope(scopeKubernetesNode), func(c *gin.Context) {
+			var request DrainRequest
+			if c.Request.ContentLength != 0 {
+				if err := c.ShouldBindJSON(&request); err != nil {
+					c.JSON(400, gin.H{"error": "Invalid request format: " + err.Error()})
+					return
+				}
+			}
+			job, target, err := startNodeJob(c, action, request, nil)
+			details := map[string]interface{}{"node": request.Node, "supplied_kubeconfig": request.Kubeconfig != ""}
+			if target != nil {
+				details["node"] = target.Node
+			}
+			if action == "drain" {
+				details["timeout_seconds"] = request.TimeoutSeconds
+				details["delete_emptydir_data"] = request.DeleteEmptyDirData
+				details["force"] = request.Force
+			}
+			if job != nil {
+				details["job_id"] = job.ID
+			}
+			audit.Record(auditOutcome("kubernetes.node."+action, c.ClientIP(), details, err))
+			if err != nil {
+				respondFailure(c, "Failed to "+action+" the node", err)
+				return
+			}
+			c.Header("X-Cosi-Job-Id", job.ID)
+			c.JSON(202, gin.H{"job_id": job.ID, "status_url": "/jobs/" + job.ID, "node": target.Node, "action": action})
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Helper function to build a kubeconfig with one cluster and user, the fields of each
+// given as YAML lines
+func testKubeconfig(cluster, user string) string {
+	return `apiVersion: v1
+kind: Config
+clusters:
+- name: kubernetes
+  cluster:
+    server: https://10.0.0.10:6443
+` + cluster + `contexts:
+- name: admin@kubernetes
+  context:
+    cluster: kubernetes
+    user: admin
+current-context: admin@kubernetes
+users:
+- name: admin
+  user:
+` + user
+}
+
+func TestCheckKubeconfig(t *testing.T) {
+	const ca = "    certificate-authority-data: LS0tLS1CRUdJTg==\n"
+	tests := []struct {
+		name    string
+		config  string
+		problem string // part of the error, or empty when the kubeconfig is allowed
+	}{
+		{"client certificate", testKubeconfig(ca, "    client-certificate-data: LS0tLS1CRUdJTg==\n    client-key-data: LS0tLS1CRUdJTg==\n"), ""},
+		{"token", testKubeconfig(ca, "    token: 9a08jv.c0izixklcxtmnze7\n"), ""},
+		{"exec plugin", testKubeconfig(ca, "    exec:\n      apiVersion: client.authentication.k8s.io/v1\n      command: /bin/sh\n      args: [-c, id > /tmp/pwned]\n"), "exec is not allowed"},
+		// kubectl reads the fields regardless of case
+		{"exec plugin in capitals", testKubeconfig(ca, "    Exec:\n      command: /bin/sh\n"), "Exec is not allowed"},
+		{"auth provider", testKubeconfig(ca, "    auth-provider:\n      name: oidc\n      config:\n        cmd-path: /bin/sh\n"), "auth-provider is not allowed"},
+		{"token file", testKubeconfig(ca, "    tokenFile: /etc/kubernetes/pki/sa.key\n"), "tokenFile is not allowed"},
+		{"client key file", testKubeconfig(ca, "    client-certificate-data: LS0tLS1CRUdJTg==\n    client-key: /etc/kubernetes/pki/apiserver.key\n"), "client-key is not allowed"},
+		{"client certificate file", testKubeconfig(ca, "    client-certificate: /etc/kubernetes/pki/apiserver.crt\n"), "client-certificate is not allowed"},
+		{"CA file", testKubeconfig("    certificate-authority: /etc/kubernetes/pki/ca.crt\n", "    token: abc\n"), "certificate-authority names a file"},
+		{"no clusters", "apiVersion: v1\nkind: Config\nusers: []\n", "with clusters"},
+		{"not YAML", "clusters: [", "with clusters"},
+	}
+	for _, tt := range tests {
+		err := checkKubeconfig(tt.config)
+		var reqErr *requestError
+		switch {
+		case tt.problem == "" && err != nil:
+			t.Errorf("%s: checkKubeconfig = %v, want it allowed", tt.name, err)
+		case tt.problem != "" && (!errors.As(err, &reqErr) || reqErr.Status != 400 || reqErr.Code != "invalid_kubeconfig" || !strings.Contains(reqErr.Message, tt.problem)):
+			t.Errorf("%s: checkKubeconfig = %v, want invalid_kubeconfig with %q", tt.name, err, tt.problem)
+		}
+	}
+}
+
+// The node endpoints need the kubernetes-node scope, and a kubeconfig that would have
+// kubectl run a command is refused before kubectl starts
+func TestNodeRoutesRequireScope(t *testing.T) {
+	withJobStore(t)
+	ran := filepath.Join(t.TempDir(), "ran")
+	fakeCommand(t, "kubectl", `touch `+ran)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerNodeRoutes(r)
+
+	exec := toJSON(map[string]string{
+		"node":       "worker-1",
+		"kubeconfig": testKubeconfig("", "    exec:\n      apiVersion: client.authentication.k8s.io/v1\n      command: /bin/touch\n      args: ["+ran+"]\n"),
+	})
+	for _, action := range []string{"cordon", "uncordon", "drain"} {
+		checkScopeRequired(t, r, scopeKubernetesNode, "POST", "/kubernetes/node/"+action, exec)
+	}
+
+	withScopedTokens(t, scopeKubernetesNode)
+	w := serveWithToken(r, "POST", "/kubernetes/node/drain", exec, "ops-token")
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "invalid_kubeconfig") {
+		t.Errorf("drain with an exec plugin = %d %s, want 400 invalid_kubeconfig", w.Code, w.Body)
+	}
+	if len(jobs.List()) != 0 {
+		t.Errorf("jobs = %+v, want none started", jobs.List())
+	}
+	if _, err := os.Stat(ran); err == nil {
+		t.Error("kubectl or the exec plugin ran")
+	}
+}
+
+// Helper function to put a kubectl on PATH that writes a captured transcript from
+// testdata/kubectl to stderr, as kubectl drain does, after waiting delay
+func fakeKubectl(t *testing.T, transcript string, exitCode int, delay string) {
+	t.Helper()
+	path, err := filepath.Abs(filepath.Join("testdata", "kubectl", transcript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeCommand(t, "kubectl", "sleep "+delay+"\ncat "+path+" >&2\nexit "+strconv.Itoa(exitCode))
+}
+
+// Helper function to wait for a node job to finish and let go of the node
+func waitForNodeJob(t *testing.T, id string) Job {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		job, ok := jobs.Get(id)
+		if !ok || job.Status == jobQueued || job.Status == jobRunning || !nodeOperationRunning.TryLock() {
+			continue
+		}
+		nodeOperationRunning.Unlock()
+		return job
+	}
+	t.Fatalf("job %s never finished", id)
+	return Job{}
+}
+
+// Drains that finish, that PodDisruptionBudgets hold up, and that kubectl refuses
+// report their pods as kubectl goes
+func TestDrainProgress(t *testing.T) {
+	ignored := []string{"kube-system/calico-node-9dfl4", "kube-system/kube-proxy-7x2kq"}
+	tests := []struct {
+		transcript string
+		exitCode   int
+		want       NodeOperation
+		err        string
+	}{
+		{"drain.txt", 0, NodeOperation{
+			EvictingPods: []string{},
+			EvictedPods:  []string{"default/web-7d4b9c8f6d-4kq2m", "kube-system/coredns-7db6d8ff4d-h8w2n"},
+			IgnoredPods:  ignored,
+		}, ""},
+		// db-0 is retried until the timeout; it is reported once
+		{"drain-pdb.txt", 1, NodeOperation{
+			EvictingPods: []string{"default/db-0"},
+			EvictedPods:  []string{"default/web-7d4b9c8f6d-4kq2m", "kube-system/coredns-7db6d8ff4d-h8w2n"},
+			IgnoredPods:  ignored,
+			BlockingPods: []BlockingPod{{Pod: "default/db-0", Reason: "a PodDisruptionBudget doesn't allow the eviction"}},
+			ExitCode:     1,
+		}, "PodDisruptionBudgets kept default/db-0 from being evicted"},
+		{"drain-refused.txt", 1, NodeOperation{
+			EvictingPods: []string{},
+			EvictedPods:  []string{},
+			BlockingPods: []BlockingPod{
+				{Pod: "default/cache-5f6d7c8b9-x2x7q", Reason: "drain doesn't delete Pods with local storage", Option: "delete_emptydir_data"},
+				{Pod: "monitoring/prometheus-0", Reason: "drain doesn't delete Pods with local storage", Option: "delete_emptydir_data"},
+				{Pod: "default/debug", Reason: "drain doesn't delete Pods that declare no controller", Option: "force"},
+			},
+			ExitCode: 1,
+		}, "kubectl drain won't remove default/cache-5f6d7c8b9-x2x7q, monitoring/prometheus-0, default/debug"},
+	}
+	for _, tt := range tests {
+		withJobStore(t)
+		withConfig(t, &Config{})
+		fakeKubectl(t, tt.transcript, tt.exitCode, "0")
+		job := jobs.New(context.Background(), "kubernetes-node")
+		control := jobs.Control(job)
+		jobs.Start(job)
+		target := &nodeTarget{Node: "worker-1", Kubeconfig: "/dev/null", cleanup: func() {}}
+		operation, err := runNodeCommand(job, control, "drain", target, DrainRequest{}, time.Minute)
+		control.Close()
+
+		tt.want.Node, tt.want.Action = "worker-1", "drain"
+		if !reflect.DeepEqual(operation, &tt.want) {
+			t.Errorf("%s:\n got %s\nwant %s", tt.transcript, toJSON(operation), toJSON(tt.want))
+		}
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: err = %v, want %q", tt.transcript, err, tt.err)
+		}
+		// The job's result follows the drain as it goes; the exit code comes at the end
+		running, _ := jobs.Get(job.ID)
+		if progress, ok := running.Result.(*NodeOperation); !ok || progress.ExitCode != 0 || !reflect.DeepEqual(progress.BlockingPods, operation.BlockingPods) || !reflect.DeepEqual(progress.EvictedPods, operation.EvictedPods) {
+			t.Errorf("%s: job result = %s", tt.transcript, toJSON(running.Result))
+		}
+	}
+}
+
+// Concurrent node requests start one job; the others are refused until it finishes
+func TestNodeOperationsOneAtATime(t *testing.T) {
+	withJobStore(t)
+	fakeKubectl(t, "drain.txt", 0, "0.3")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerNodeRoutes(r)
+	withScopedTokens(t, scopeKubernetesNode)
+	body := toJSON(map[string]string{"node": "worker-1", "kubeconfig": testKubeconfig("", "    token: abc\n")})
+
+	codes := make([]int, 8)
+	var wg sync.WaitGroup
+	for i := range codes {
+		action := []string{"cordon", "drain"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = serveWithToken(r, "POST", "/kubernetes/node/"+action, body, "ops-token").Code
+		}()
+	}
+	wg.Wait()
+	started := 0
+	for _, code := range codes {
+		switch code {
+		case 202:
+			started++
+		case 409:
+		default:
+			t.Errorf("concurrent node request = %d", code)
+		}
+	}
+	listed := jobs.List()
+	if started != 1 || len(listed) != 1 {
+		t.Fatalf("codes = %v, jobs = %d; want one job started", codes, len(listed))
+	}
+
+	// Once the job is done the next one may start
+	waitForNodeJob(t, listed[0].ID)
+	w := serveWithToken(r, "POST", "/kubernetes/node/uncordon", body, "ops-token")
+	if w.Code != 202 {
+		t.Fatalf("uncordon after the job finished = %d %s", w.Code, w.Body)
+	}
+	waitForNodeJob(t, w.Header().Get("X-Cosi-Job-Id"))
+}
+
+// A package job that starts while the node drains keeps the reboot from being scheduled
+func TestDrainThenPowerRechecksJobs(t *testing.T) {
+	withJobStore(t)
+	withConfig(t, &Config{})
+	calls := fakeSystemctl(t)
+	fakeKubectl(t, "drain.txt", 0, "0")
+	packages := jobs.New(context.Background(), "packages")
+	jobs.Start(packages)
+	defer jobs.Finish(packages, nil, "done", nil)
+
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/power/reboot", nil)
+	request := PowerRequest{DrainFirst: true, Drain: DrainRequest{NodeRequest: NodeRequest{Node: "worker-1", Kubeconfig: testKubeconfig("", "    token: abc\n")}}}
+	job, _, err := drainThenPower(c, "reboot", request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finished := waitForNodeJob(t, job.ID)
+	operation, _ := finished.Result.(*NodeOperation)
+	if finished.Status != jobFailed || !strings.Contains(finished.Error, "a packages job ("+packages.ID+") started meanwhile; refusing to reboot") || operation == nil || operation.PowerAction != nil {
+		t.Errorf("drain then reboot = %s", toJSON(finished))
+	}
+	immediatePowerMu.Lock()
+	pending := immediatePower
+	immediatePowerMu.Unlock()
+	if pending != nil {
+		t.Errorf("a reboot was scheduled: %+v", pending)
+	}
+	if data, err := os.ReadFile(calls); err == nil {
+		t.Errorf("systemctl ran: %q", data)
+	}
+}
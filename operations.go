@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rothgar/cosi/api"
+)
+
+// The operations below do the work of the endpoints that are also served by the gRPC API
+// or run in batches. Failures are returned as errors that failureResponse turns into the
+// REST response, leaving each caller to report them its own way. Operations that take
+// packageLock leave it alone when ctx says their caller holds it.
+
+// Function to detect the package manager of the host for an operation that changes packages
+func writablePackageManager() (packageManager, error) {
+	osReleaseData, err := readOSReleaseFile("/etc/os-release")
+	if err != nil {
+		return nil, &requestError{Status: 500, Message: "Unable to determine the operating system"}
+	}
+	pm := packageManagerFor(osReleaseData)
+	if pm == nil {
+		return nil, &requestError{Status: 400, Message: "Unsupported operating system"}
+	}
+	if err := checkWritable(pm); err != nil {
+		return nil, &operationError{Message: "Unsupported operation", Err: err}
+	}
+	return pm, nil
+}
+
+// Function to list the installed packages of manager, which is system, all, or the name
+// of an app manager like snap. withGroups adds the package groups on RPM hosts.
+func listPackages(ctx context.Context, manager string, withGroups bool) (*api.PackageList, error) {
+	if manager != "system" && manager != "all" {
+		app := appManagerNamed(manager)
+		if app == nil {
+			return nil, &requestError{Status: 400, Message: "manager must be system, snap, flatpak, or all"}
+		}
+		if !app.Available() {
+			return nil, &requestError{Status: 404, Code: "manager_not_available", Message: manager + " is not available on this host"}
+		}
+		packages, err := app.List(ctx)
+		if err != nil {
+			return nil, &operationError{Message: "Failed to list " + manager + " packages", Err: err}
+		}
+		return &api.PackageList{Manager: manager, Packages: packages}, nil
+	}
+
+	pm, err := hostPackageManager()
+	if errors.Is(err, errUnsupportedOS) {
+		return nil, &requestError{Status: 400, Message: "Unsupported operating system"}
+	}
+	if err != nil {
+		return nil, &requestError{Status: 500, Message: "Unable to determine the operating system"}
+	}
+	packageList, _, err := installedPackages.List(ctx, pm)
+	if err != nil {
+		return nil, &operationError{Message: "Failed to get installed packages", Err: err}
+	}
+	list := &api.PackageList{InstalledPackages: packageList}
+	if withGroups {
+		list.InstalledGroups, list.GroupsWarning = packageGroups(ctx, pm)
+	}
+	if manager == "all" {
+		for _, app := range appManagers {
+			if !app.Available() {
+				continue
+			}
+			packages, err := app.List(ctx)
+			if err != nil {
+				list.Warnings = append(list.Warnings, "Failed to list "+app.Name()+" packages: "+err.Error())
+				continue
+			}
+			switch app.Name() {
+			case "snap":
+				list.Snaps = packages
+			case "flatpak":
+				list.Flatpaks = packages
+			}
+		}
+	}
+	return list, nil
+}
+
+// Helper function to list the installed package groups, or say why they can't be
+func packageGroups(ctx context.Context, pm packageManager) ([]string, string) {
+	manager, ok := pm.(groupManager)
+	if !ok {
+		return nil, "package groups are not applicable to " + pm.Name()
+	}
+	groups, err := manager.InstalledGroups(ctx)
+	if err != nil {
+		return nil, "Failed to list installed groups: " + err.Error()
+	}
+	return groups, ""
+}
+
+// Function to apply a manifest as a packages job, the work of POST /packages. started is
+// called with the job as soon as it exists, while it is still queued for the package
+// lock. The job is returned once it exists, with failures too.
+func applyManifestJob(ctx context.Context, packageConfig PackageConfig, source *ManifestSource, lockWait time.Duration, started func(*Job)) (*api.ApplyPackagesResponse, *Job, error) {
+	pm, err := writablePackageManager()
+	if err != nil {
+		return nil, nil, err
+	}
+	summary := packageSummary(packageConfig)
+	if source != nil {
+		summary += " from " + source.URL + " (sha256:" + source.SHA256 + ")"
+	}
+
+	// Package transactions never run concurrently, so the job stays queued until the lock is free
+	job := jobs.New(ctx, "packages")
+	jobs.SetManifest(job, packageConfig)
+	if started != nil {
+		started(job)
+	}
+	unlock := lockPackages(ctx)
+	if !jobs.Start(job) {
+		unlock()
+		return nil, job, jobCancelledError(job)
+	}
+	// Another apt or dnf, like unattended-upgrades, would make the transaction fail on its locks
+	waited, err := awaitPackageManager(ctx, job, pm, lockWait, summary)
+	if err != nil {
+		unlock()
+		return nil, job, &operationError{Message: "Unable to start the transaction", Err: err}
+	}
+	result, err := applyPackagesForJob(job, pm, packageConfig)
+	unlock()
+	jobs.Finish(job, result, summary, err)
+	// The packages are in place even when verification failed, so that is still reported as the transaction's result
+	if err != nil && !verificationFailed(err) {
+		return nil, job, &operationError{Message: "Failed to " + result.FailedStep + " packages", Err: err}
+	}
+
+	response := &api.ApplyPackagesResponse{
+		JobID:           job.ID,
+		InstallOutput:   result.Install.Output,
+		UninstallOutput: result.Uninstall.Output,
+		Install:         result.Install,
+		Uninstall:       result.Uninstall,
+		Packages:        result.Packages,
+		LockWait:        waited,
+		UpdateCache:     result.Refresh,
+		Autoremove:      result.Autoremove,
+		Autoremoved:     result.Autoremoved,
+		Steps:           result.Steps,
+		Warnings:        result.Warnings,
+		Skipped:         result.Skipped,
+		Verification:    result.Verification,
+		Source:          source,
+	}
+	if len(result.Verification) > 0 {
+		response.Status = jobSucceeded
+		if err != nil {
+			response.Status = jobVerificationFailed
+		}
+	}
+	if packageConfig.Documents > 1 {
+		response.EffectiveManifest = packageConfig
+	}
+	return response, job, nil
+}
+
+// bootstrapFailure is a failed Kubernetes bootstrap with the output it produced
+type bootstrapFailure struct {
+	JobID  string
+	Result CommandResult
+	Err    error
+}
+
+func (e *bootstrapFailure) Error() string {
+	return "Failed to install and bootstrap Kubernetes: " + e.Err.Error()
+}
+
+// Helper function to build the response to a failed bootstrap, classified by the tool
+// of the step that failed
+func (e *bootstrapFailure) response() (int, gin.H) {
+	tool := ""
+	var stepErr *bootstrapError
+	if errors.As(e.Err, &stepErr) {
+		tool = stepErr.Step.Args[0]
+	}
+	failure := classifyFailure(tool, e.Result, e.Err)
+	response := gin.H{
+		"job_id":  e.JobID,
+		"error":   "Failed to install and bootstrap Kubernetes",
+		"code":    failure.Code,
+		"details": e.Err.Error(),
+		"output":  e.Result.Output,
+		"stdout":  e.Result.Stdout,
+		"stderr":  e.Result.Stderr,
+	}
+	if failure.Code == sudoFailure.Code {
+		response["sudoers"] = sudoersLine(kubernetesPrivilegedTools()...)
+	}
+	return failure.Status, response
+}
+
+// Function to install Kubernetes and bootstrap a cluster as a kubernetes job, the work
+// of POST /kubernetes. started is called with the job as soon as it exists. The job is
+// returned once it exists, with failures too.
+func bootstrapKubernetesJob(ctx context.Context, lockWait time.Duration, started func(*Job)) (*api.BootstrapResult, *Job, error) {
+	if err := checkKubernetesEnvironment(runtimeEnvironment()); err != nil {
+		return nil, nil, &operationError{Message: "Unable to install Kubernetes", Err: err}
+	}
+	job := jobs.New(ctx, "kubernetes")
+	if started != nil {
+		started(job)
+	}
+	unlock := lockPackages(ctx)
+	if !jobs.Start(job) {
+		unlock()
+		return nil, job, jobCancelledError(job)
+	}
+	// The first steps install packages, which fail on the locks of another package manager
+	var waited *LockWait
+	if pm, err := hostPackageManager(); err == nil {
+		if waited, err = awaitPackageManager(ctx, job, pm, lockWait, "bootstrap"); err != nil {
+			unlock()
+			return nil, job, &operationError{Message: "Unable to start the transaction", Err: err}
+		}
+	}
+	control := jobs.Control(job)
+	defer control.Close()
+	result, err := installAndBootstrapKubernetes(control)
+	installedPackages.Invalidate()
+	unlock()
+	jobs.Finish(job, result, "bootstrap", err)
+	if err != nil {
+		return nil, job, &bootstrapFailure{JobID: job.ID, Result: result, Err: err}
+	}
+	return &api.BootstrapResult{
+		JobID:    job.ID,
+		Message:  "Kubernetes successfully installed and bootstrapped",
+		Output:   result.Output,
+		Stdout:   result.Stdout,
+		Stderr:   result.Stderr,
+		LockWait: waited,
+	}, job, nil
+}
+
+// Function to run the package manager's recovery commands as a packages job, the work of
+// POST /packages/repair. started is called with the job as soon as it exists. The job is
+// returned once it exists, with failures too.
+func repairPackagesJob(ctx context.Context, started func(*Job)) ([]PackageRepairStep, *Job, error) {
+	pm, err := hostPackageManager()
+	if err != nil {
+		return nil, nil, &requestError{Status: 400, Message: "Unsupported operating system"}
+	}
+	if err := checkWritable(pm); err != nil {
+		return nil, nil, &operationError{Message: "Unsupported operation", Err: err}
+	}
+
+	job := jobs.New(ctx, "packages")
+	if started != nil {
+		started(job)
+	}
+	unlock := lockPackages(ctx)
+	if !jobs.Start(job) {
+		unlock()
+		return nil, job, jobCancelledError(job)
+	}
+	control := jobs.Control(job)
+	steps, err := repairPackages(pm, control)
+	control.Close()
+	unlock()
+	jobs.Finish(job, steps, "repair the package database", err)
+	if err != nil {
+		return nil, job, &operationError{Message: "Failed to repair the package database", Err: err}
+	}
+	return steps, job, nil
+}
+
+// Function to write an allowlisted file and audit the write on behalf of client, the
+// work of PUT /files
+func writeFile(request FileWriteRequest, client string) (*FileWriteResult, error) {
+	result, err := writeAllowedFile(request)
+	details := map[string]interface{}{"path": request.Path, "backup": request.Backup, "validate_cmd": request.ValidateCmd}
+	if result != nil {
+		details["sha256"] = result.SHA256
+		details["previous_sha256"] = result.PreviousSHA256
+	}
+	audit.Record(auditOutcome("files.write", client, details, err))
+
+	var notAllowed *errFileNotAllowed
+	switch {
+	case errors.As(err, &notAllowed):
+		return nil, &requestError{Status: 403, Code: "path_not_allowed", Message: err.Error()}
+	case errors.Is(err, os.ErrPermission):
+		return nil, &requestError{Status: 403, Code: "permission_denied", Message: err.Error()}
+	case err != nil && result != nil:
+		// The validator rejected the content; its output says why
+		return nil, &responseError{422, gin.H{"error": err.Error(), "code": "validation_failed", "validation": result.Validation}}
+	case err != nil:
+		return nil, &operationError{Message: "Failed to write " + request.Path, Err: err}
+	}
+	return result, nil
+}
+
+// Function to add a key to a user's authorized keys and audit it on behalf of client,
+// the work of POST /ssh/keys
+func addSSHKey(request SSHKeyRequest, client string) (*SSHKeyChange, error) {
+	change, err := addAuthorizedKey(request)
+	details := map[string]interface{}{"user": request.User}
+	if change != nil {
+		details["fingerprint"] = change.Key.Fingerprint
+		details["changed"] = change.Changed
+	}
+	audit.Record(auditOutcome("ssh.keys.add", client, details, err))
+	if err != nil {
+		return nil, &operationError{Message: "Failed to add key", Err: err}
+	}
+	return change, nil
+}
+
+// Function to open a port through the detected firewall and audit it on behalf of
+// client, the work of POST /firewall/rules
+func openFirewallPort(request FirewallRuleRequest, client string) (gin.H, error) {
+	if err := request.validate(); err != nil {
+		return nil, &requestError{Status: 400, Message: err.Error()}
+	}
+	backend := detectFirewall()
+	if backend == nil {
+		return nil, &requestError{Status: 422, Code: "no_firewall", Message: "No firewall tooling is installed"}
+	}
+	result, err := backend.OpenPort(request)
+	details := map[string]interface{}{"backend": backend.Name(), "port": request.Port, "protocol": request.Protocol, "permanent": request.Permanent}
+	audit.Record(auditOutcome("firewall.open_port", client, details, err))
+	if errors.Is(err, errPermanentUnsupported) {
+		return nil, &responseError{422, gin.H{"error": err.Error(), "code": "permanent_unsupported", "backend": backend.Name()}}
+	}
+	if err != nil {
+		return nil, &operationError{Message: "Failed to open port", Err: err}
+	}
+	return gin.H{"backend": backend.Name(), "rule": request, "output": result.Output}, nil
+}
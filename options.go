@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/rothgar/cosi/api"
+)
+
+// PackageOptions change how the package lists of a manifest are applied. Options the
+// host's package manager has no equivalent for are ignored with a warning.
+type PackageOptions struct {
+	// Purge removes the configuration files of uninstalled packages too
+	Purge bool `yaml:"purge,omitempty" json:"purge,omitempty"`
+	// Autoremove removes the dependencies nothing needs anymore once the lists are applied
+	Autoremove bool `yaml:"autoremove,omitempty" json:"autoremove,omitempty"`
+	// NoRecommends installs only hard dependencies, leaving out recommended packages
+	NoRecommends bool `yaml:"no_recommends,omitempty" json:"no_recommends,omitempty"`
+	// UpdateCache downloads the latest package lists before anything is installed
+	UpdateCache bool `yaml:"update_cache,omitempty" json:"update_cache,omitempty"`
+}
+
+// Helper function to combine the options of two manifest documents; an option set by
+// either is set
+func (o PackageOptions) or(other PackageOptions) PackageOptions {
+	return PackageOptions{
+		Purge:        o.Purge || other.Purge,
+		Autoremove:   o.Autoremove || other.Autoremove,
+		NoRecommends: o.NoRecommends || other.NoRecommends,
+		UpdateCache:  o.UpdateCache || other.UpdateCache,
+	}
+}
+
+// Helper function to list the options that are set, by their manifest names
+func (o PackageOptions) names() []string {
+	var names []string
+	for _, option := range []struct {
+		name string
+		set  bool
+	}{
+		{"purge", o.Purge},
+		{"autoremove", o.Autoremove},
+		{"no_recommends", o.NoRecommends},
+		{"update_cache", o.UpdateCache},
+	} {
+		if option.set {
+			names = append(names, option.name)
+		}
+	}
+	return names
+}
+
+// optionsManager is implemented by package managers that honour manifest options.
+// update_cache needs no support, as every manager has a RefreshCommand.
+type optionsManager interface {
+	// SupportedOptions lists the options that change the manager's commands
+	SupportedOptions() []string
+	// AutoremoveCommand removes the packages that were only installed as dependencies
+	// and that nothing depends on anymore
+	AutoremoveCommand(config PackageConfig) *exec.Cmd
+}
+
+// Helper function to list the options of a manifest that the package manager can't honour
+func ignoredOptions(pm packageManager, options PackageOptions) []string {
+	var supported []string
+	if manager, ok := pm.(optionsManager); ok {
+		supported = manager.SupportedOptions()
+	}
+	var ignored []string
+	for _, option := range options.names() {
+		if option != "update_cache" && !containsString(supported, option) {
+			ignored = append(ignored, option)
+		}
+	}
+	return ignored
+}
+
+// PackageOutcome is what applying a manifest did to one package
+type PackageOutcome = api.PackageOutcome
+
+// Function to describe what applying the package lists of a manifest does to each package
+func packageOutcomes(pm packageManager, config PackageConfig) []PackageOutcome {
+	ignored := ignoredOptions(pm, config.PackageOptions)
+	split := func(relevant ...string) (applied, skipped []string) {
+		for _, option := range relevant {
+			if containsString(ignored, option) {
+				skipped = append(skipped, option)
+			} else {
+				applied = append(applied, option)
+			}
+		}
+		return applied, skipped
+	}
+
+	var outcomes []PackageOutcome
+	for _, spec := range config.Packages.Installed {
+		outcome := PackageOutcome{Name: spec, Action: "install"}
+		if config.NoRecommends {
+			outcome.Options, outcome.IgnoredOptions = split("no_recommends")
+		}
+		outcomes = append(outcomes, outcome)
+	}
+	for _, spec := range config.Packages.Uninstalled {
+		outcome := PackageOutcome{Name: spec, Action: "remove"}
+		if config.Purge {
+			outcome.Options, outcome.IgnoredOptions = split("purge")
+			if len(outcome.Options) > 0 {
+				outcome.Action = "purge"
+			}
+		}
+		outcomes = append(outcomes, outcome)
+	}
+	return outcomes
+}
+
+// Function to run the package manager's autoremove and list the packages it removed,
+// found by comparing the installed versions around it. Callers must hold packageLock.
+func autoremovePackages(pm packageManager, config PackageConfig, job *jobControl) (CommandResult, []PackageOutcome, error) {
+	manager, ok := pm.(optionsManager)
+	if !ok || !containsString(manager.SupportedOptions(), "autoremove") {
+		return CommandResult{}, nil, nil
+	}
+	cmd := manager.AutoremoveCommand(config)
+	before, snapshotErr := installedVersions(job.context(), pm)
+	output, err := runJobCommand(cmd, job)
+	if err != nil {
+		return output, nil, &commandError{Tool: commandTool(cmd), Result: output, Err: err}
+	}
+	if snapshotErr != nil {
+		return output, nil, nil
+	}
+	after, snapshotErr := installedVersions(job.context(), pm)
+	if snapshotErr != nil {
+		return output, nil, nil
+	}
+
+	removed := []PackageOutcome{}
+	for name, version := range before {
+		if _, ok := after[name]; !ok {
+			outcome := PackageOutcome{Name: name, Action: "autoremove", Version: version}
+			if config.Purge && containsString(manager.SupportedOptions(), "purge") {
+				outcome.Options = []string{"purge"}
+			}
+			removed = append(removed, outcome)
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i].Name < removed[j].Name })
+	return output, removed, nil
+}
+
+// Helper function to warn about the options the package manager can't honour
+func ignoredOptionWarnings(pm packageManager, options PackageOptions) []string {
+	var warnings []string
+	for _, option := range ignoredOptions(pm, options) {
+		warnings = append(warnings, fmt.Sprintf("%s is not applicable to %s and was ignored", option, pm.Name()))
+	}
+	return warnings
+}
+
+// Helper function to describe the options of a manifest for job summaries
+func optionsSummary(options PackageOptions) string {
+	if names := options.names(); len(names) > 0 {
+		return " (" + strings.Join(names, ", ") + ")"
+	}
+	return ""
+}
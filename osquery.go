@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Time a query gets to finish, rows kept from its result, and the most output read
+	// from osqueryi, unless the osquery section says otherwise
+	defaultOsqueryTimeout  = 10 * time.Second
+	defaultOsqueryMaxRows  = 10000
+	defaultOsqueryMaxBytes = 8 << 20
+	// Longest query text accepted
+	maxOsqueryQueryBytes = 16 << 10
+)
+
+// Scope of the tokens that may run osquery queries. The tables expose a great deal of the
+// host, so reading them needs a token of its own.
+const scopeOsquery = "osquery"
+
+var errOsqueryMissing = errors.New("osqueryi is not installed")
+
+// Keywords that change something, rejected anywhere in a query outside string literals
+var osqueryMutatingKeywords = map[string]bool{
+	"INSERT": true, "UPDATE": true, "DELETE": true, "UPSERT": true,
+	"CREATE": true, "DROP": true, "ALTER": true, "ATTACH": true, "DETACH": true,
+	"VACUUM": true, "REINDEX": true, "ANALYZE": true, "SAVEPOINT": true, "RELEASE": true,
+	"BEGIN": true, "COMMIT": true, "ROLLBACK": true,
+}
+
+// Pragmas a query may run; they only describe the schema
+var osqueryReadPragmas = map[string]bool{
+	"table_info": true, "table_xinfo": true, "table_list": true, "index_list": true,
+	"index_info": true, "function_list": true, "compile_options": true,
+}
+
+// OsqueryConfig bounds the queries of POST /osquery
+type OsqueryConfig struct {
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxRows is the most rows returned; the rest are dropped and the result marked truncated
+	MaxRows int `yaml:"max_rows"`
+	// MaxOutputBytes is the most JSON read from osqueryi; a larger result fails the query
+	MaxOutputBytes int64 `yaml:"max_output_bytes"`
+}
+
+func (c OsqueryConfig) timeout() time.Duration {
+	return time.Duration(orDefault(int64(c.Timeout), int64(defaultOsqueryTimeout)))
+}
+
+func (c OsqueryConfig) maxRows() int {
+	return int(orDefault(int64(c.MaxRows), defaultOsqueryMaxRows))
+}
+
+func (c OsqueryConfig) maxOutputBytes() int64 {
+	return orDefault(c.MaxOutputBytes, defaultOsqueryMaxBytes)
+}
+
+// Function to check the osquery settings
+func (c OsqueryConfig) validate() error {
+	if c.Timeout < 0 || c.MaxRows < 0 || c.MaxOutputBytes < 0 {
+		return fmt.Errorf("osquery.timeout, osquery.max_rows, and osquery.max_output_bytes must not be negative")
+	}
+	return nil
+}
+
+// OsqueryRequest is the body of POST /osquery
+type OsqueryRequest struct {
+	Query string `json:"query" binding:"required"`
+}
+
+// OsqueryResult is the response of POST /osquery. osquery reports every column as a string.
+type OsqueryResult struct {
+	Query      string              `json:"query"`
+	Rows       []map[string]string `json:"rows"`
+	RowCount   int                 `json:"row_count"`
+	Truncated  bool                `json:"truncated,omitempty"`
+	DurationMS int64               `json:"duration_ms"`
+}
+
+// cappedBuffer keeps what is written to it until it holds limit bytes, then fails writes.
+// The buffer isn't embedded: its ReadFrom would let io.Copy read past the limit.
+type cappedBuffer struct {
+	buf      bytes.Buffer
+	limit    int64
+	exceeded bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if int64(b.buf.Len()+len(p)) > b.limit {
+		b.exceeded = true
+		return 0, fmt.Errorf("output is larger than %d bytes", b.limit)
+	}
+	return b.buf.Write(p)
+}
+
+// Bytes returns what was kept
+func (b *cappedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// Helper function to split a query into its words and punctuation, leaving out string
+// literals, quoted identifiers, and comments
+func osqueryTokens(query string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			j := strings.IndexByte(query[i+1:], end)
+			if j < 0 {
+				return nil, fmt.Errorf("the query has an unterminated quote")
+			}
+			// A quoted identifier still stands for a name, unlike a string
+			if c != '\'' {
+				tokens = append(tokens, "identifier")
+			}
+			i += j + 2
+		case strings.HasPrefix(query[i:], "--"):
+			j := strings.IndexByte(query[i:], '\n')
+			if j < 0 {
+				j = len(query) - i
+			}
+			i += j
+		case strings.HasPrefix(query[i:], "/*"):
+			j := strings.Index(query[i+2:], "*/")
+			if j < 0 {
+				return nil, fmt.Errorf("the query has an unterminated comment")
+			}
+			i += j + 4
+		case c == '_' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)):
+			j := i
+			for j < len(query) && (query[j] == '_' || unicode.IsLetter(rune(query[j])) || unicode.IsDigit(rune(query[j]))) {
+				j++
+			}
+			tokens = append(tokens, strings.ToUpper(query[i:j]))
+			i = j
+		case unicode.IsSpace(rune(c)):
+			i++
+		default:
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+// Function to check that a query only reads: one SELECT, WITH, or schema pragma, with no
+// statement that changes anything and no osqueryi dot-command
+func checkOsqueryQuery(query string) error {
+	query = strings.TrimSpace(query)
+	if len(query) > maxOsqueryQueryBytes {
+		return &requestError{413, "query_too_large", fmt.Sprintf("query is longer than %d bytes", maxOsqueryQueryBytes)}
+	}
+	if strings.HasPrefix(query, ".") {
+		return &requestError{400, "query_not_allowed", "osqueryi dot-commands are not allowed"}
+	}
+	tokens, err := osqueryTokens(query)
+	if err != nil {
+		return &requestError{400, "invalid_query", err.Error()}
+	}
+	for len(tokens) > 0 && tokens[len(tokens)-1] == ";" {
+		tokens = tokens[:len(tokens)-1]
+	}
+	if len(tokens) == 0 {
+		return &requestError{400, "invalid_query", "query is empty"}
+	}
+
+	for i, token := range tokens {
+		switch {
+		case token == ";":
+			return &requestError{400, "query_not_allowed", "only one statement may be run"}
+		case osqueryMutatingKeywords[token]:
+			return &requestError{400, "query_not_allowed", token + " statements are not allowed; queries must only read"}
+		case token == "REPLACE" && i+1 < len(tokens) && tokens[i+1] == "INTO":
+			// replace() on its own is the string function
+			return &requestError{400, "query_not_allowed", "REPLACE statements are not allowed; queries must only read"}
+		case token == "PRAGMA" && i > 0:
+			return &requestError{400, "query_not_allowed", "PRAGMA must start the query"}
+		}
+	}
+	switch tokens[0] {
+	case "SELECT", "WITH", "VALUES":
+		return nil
+	case "PRAGMA":
+		// PRAGMA name, or PRAGMA name(argument); an assignment sets the pragma
+		if len(tokens) < 2 || !osqueryReadPragmas[strings.ToLower(tokens[1])] || (len(tokens) > 2 && tokens[2] != "(") {
+			return &requestError{400, "query_not_allowed", "only the pragmas that describe the schema are allowed: " + strings.Join(osqueryPragmaNames(), ", ")}
+		}
+		return nil
+	}
+	return &requestError{400, "query_not_allowed", "queries must start with SELECT, WITH, VALUES, or PRAGMA"}
+}
+
+// Helper function to list the pragmas a query may run
+func osqueryPragmaNames() []string {
+	names := make([]string, 0, len(osqueryReadPragmas))
+	for name := range osqueryReadPragmas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Function to run a query through osqueryi and parse its rows. Callers check the query
+// first.
+func runOsquery(ctx context.Context, query string) (*OsqueryResult, error) {
+	path, err := exec.LookPath("osqueryi")
+	if err != nil {
+		return nil, &requestError{501, "osquery_not_installed", errOsqueryMissing.Error()}
+	}
+	cfg := currentConfig().Osquery
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout())
+	defer cancel()
+
+	started := time.Now()
+	cmd := newCommandContext(ctx, path, "--json", query)
+	stdout := &cappedBuffer{limit: cfg.maxOutputBytes()}
+	var stderr tailBuffer
+	stderr.limit = 4096
+	cmd.Stdout, cmd.Stderr = stdout, &stderr
+	// Don't wait on the pipes for long once osqueryi is killed at the timeout
+	cmd.WaitDelay = time.Second
+	err = runTracked(cmd)
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return nil, &requestError{504, "query_timed_out", fmt.Sprintf("the query did not finish within %s", cfg.timeout())}
+	case stdout.exceeded:
+		return nil, &requestError{413, "result_too_large", fmt.Sprintf("the result is larger than %d bytes; select fewer columns or add a LIMIT", cfg.maxOutputBytes())}
+	case err != nil:
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = err.Error()
+		}
+		return nil, &requestError{400, "query_failed", message}
+	}
+
+	// osqueryi prints nothing at all for a query without rows
+	var rows []map[string]string
+	if output := bytes.TrimSpace(stdout.Bytes()); len(output) > 0 {
+		if err := json.Unmarshal(output, &rows); err != nil {
+			return nil, fmt.Errorf("parsing the output of osqueryi: %w", err)
+		}
+	}
+	result := &OsqueryResult{Query: query, Rows: rows, DurationMS: time.Since(started).Milliseconds()}
+	if result.Rows == nil {
+		result.Rows = []map[string]string{}
+	}
+	if max := cfg.maxRows(); len(rows) > max {
+		result.Rows, result.Truncated = rows[:max], true
+	}
+	result.RowCount = len(result.Rows)
+	return result, nil
+}
+
+// Function to list the tables osquery can query on this host
+func osqueryTables(ctx context.Context) ([]string, error) {
+	result, err := runOsquery(ctx, "SELECT name FROM osquery_registry WHERE registry = 'table' AND active = 1")
+	if err != nil {
+		return nil, err
+	}
+	tables := make([]string, 0, len(result.Rows))
+	for _, row := range result.Rows {
+		tables = append(tables, row["name"])
+	}
+	sort.Strings(tables)
+	return tables, nil
+}
+
+// Function to register the /osquery endpoints, behind the osquery scope
+func registerOsqueryRoutes(r *gin.Engine) {
+	osquery := r.Group("/osquery", requireScope(scopeOsquery))
+
+	// Define the /osquery endpoint that runs a read-only query through osqueryi
+	osquery.POST("", func(c *gin.Context) {
+		var request OsqueryRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format: query is required"})
+			return
+		}
+		query := strings.TrimSpace(request.Query)
+		if err := checkOsqueryQuery(query); err != nil {
+			respondFailure(c, "Invalid query", err)
+			return
+		}
+		result, err := runOsquery(c.Request.Context(), query)
+		if err != nil {
+			respondFailure(c, "Failed to run the query", err)
+			return
+		}
+		c.JSON(200, result)
+	})
+
+	// Define the /osquery/tables endpoint that lists the tables queries can read
+	osquery.GET("/tables", func(c *gin.Context) {
+		tables, err := osqueryTables(c.Request.Context())
+		if err != nil {
+			respondFailure(c, "Failed to list osquery tables", err)
+			return
+		}
+		c.JSON(200, gin.H{"tables": tables})
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Helper function to put a stub osqueryi on PATH. It answers the table listing, prints
+// nothing for queries of the empty table, fails on syntax errors, hangs on sleep, and
+// prints the listening ports fixture for anything else.
+func fakeOsqueryi(t *testing.T) {
+	t.Helper()
+	fixture, err := filepath.Abs(filepath.Join("testdata", "osquery", "listening-ports.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeCommand(t, "osqueryi", `[ "$1" = --json ] || { echo "expected --json, got $1" >&2; exit 2; }
+case "$2" in
+*osquery_registry*) printf '[\n  {"name":"users"},\n  {"name":"processes"},\n  {"name":"listening_ports"}\n]\n' ;;
+*empty*) ;;
+*sleep*) exec sleep 10 ;;
+*bad*) echo 'Error: near "bad": syntax error' >&2; exit 1 ;;
+*) cat `+fixture+` ;;
+esac`)
+}
+
+func TestCheckOsqueryQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		code  string // empty when the query is allowed
+	}{
+		{"SELECT * FROM processes", ""},
+		{"select name, pid from processes where name = 'kubelet';", ""},
+		{"WITH p AS (SELECT pid FROM processes) SELECT count(*) FROM p", ""},
+		{"VALUES (1)", ""},
+		{"PRAGMA table_info(processes)", ""},
+		{"pragma TABLE_LIST", ""},
+		// Keywords inside strings, quoted identifiers, and comments don't count
+		{"SELECT * FROM users WHERE shell = 'DROP TABLE users; --'", ""},
+		{`SELECT "delete" FROM file`, ""},
+		{"SELECT 1 -- DELETE FROM users", ""},
+		{"SELECT replace(path, '/', '_') FROM file", ""},
+
+		{"", "invalid_query"},
+		{";", "invalid_query"},
+		{"SELECT 'unterminated", "invalid_query"},
+		{".tables", "query_not_allowed"},
+		{"SELECT 1; SELECT 2", "query_not_allowed"},
+		{"ATTACH DATABASE '/tmp/x.db' AS x", "query_not_allowed"},
+		{"SELECT 1 /* */ ; DETACH x", "query_not_allowed"},
+		{"DELETE FROM processes", "query_not_allowed"},
+		{"REPLACE INTO t VALUES (1)", "query_not_allowed"},
+		{"PRAGMA writable_schema = 1", "query_not_allowed"},
+		{"PRAGMA table_info = processes", "query_not_allowed"},
+		{"PRAGMA journal_mode", "query_not_allowed"},
+		{"SELECT * FROM pragma_table_info('x'); PRAGMA foo", "query_not_allowed"},
+		{"EXPLAIN SELECT 1", "query_not_allowed"},
+		{"SELECT '" + strings.Repeat("x", maxOsqueryQueryBytes) + "'", "query_too_large"},
+	}
+	for _, tt := range tests {
+		err := checkOsqueryQuery(tt.query)
+		var reqErr *requestError
+		switch {
+		case tt.code == "" && err != nil:
+			t.Errorf("checkOsqueryQuery(%.60q) = %v, want it allowed", tt.query, err)
+		case tt.code != "" && (!errors.As(err, &reqErr) || reqErr.Code != tt.code):
+			t.Errorf("checkOsqueryQuery(%.60q) = %v, want %s", tt.query, err, tt.code)
+		}
+	}
+}
+
+func TestRunOsquery(t *testing.T) {
+	fakeOsqueryi(t)
+	withConfig(t, &Config{})
+	ctx := context.Background()
+
+	result, err := runOsquery(ctx, "SELECT * FROM listening_ports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RowCount != 5 || result.Truncated || result.Rows[1]["name"] != "kubelet" || result.Rows[1]["port"] != "10248" {
+		t.Errorf("result = %+v", result)
+	}
+
+	// osqueryi prints nothing when there are no rows
+	if result, err := runOsquery(ctx, "SELECT * FROM empty"); err != nil || result.RowCount != 0 || result.Rows == nil {
+		t.Errorf("empty result = %+v, %v", result, err)
+	}
+
+	tables, err := osqueryTables(ctx)
+	if want := []string{"listening_ports", "processes", "users"}; err != nil || !reflect.DeepEqual(tables, want) {
+		t.Errorf("tables = %q, %v, want %q", tables, err, want)
+	}
+
+	_, err = runOsquery(ctx, "SELECT bad")
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) || reqErr.Code != "query_failed" || !strings.Contains(reqErr.Message, "syntax error") {
+		t.Errorf("failing query = %v, want query_failed with osqueryi's message", err)
+	}
+}
+
+func TestRunOsqueryLimits(t *testing.T) {
+	fakeOsqueryi(t)
+	ctx := context.Background()
+
+	withConfig(t, &Config{Osquery: OsqueryConfig{MaxRows: 2}})
+	result, err := runOsquery(ctx, "SELECT * FROM listening_ports")
+	if err != nil || result.RowCount != 2 || len(result.Rows) != 2 || !result.Truncated {
+		t.Errorf("capped rows = %+v, %v", result, err)
+	}
+
+	withConfig(t, &Config{Osquery: OsqueryConfig{MaxOutputBytes: 256}})
+	var reqErr *requestError
+	if _, err := runOsquery(ctx, "SELECT * FROM listening_ports"); !errors.As(err, &reqErr) || reqErr.Status != 413 || reqErr.Code != "result_too_large" {
+		t.Errorf("oversized result = %v, want 413 result_too_large", err)
+	}
+
+	withConfig(t, &Config{Osquery: OsqueryConfig{Timeout: 200 * time.Millisecond}})
+	start := time.Now()
+	if _, err := runOsquery(ctx, "SELECT sleep"); !errors.As(err, &reqErr) || reqErr.Status != 504 || reqErr.Code != "query_timed_out" {
+		t.Errorf("slow query = %v, want 504 query_timed_out", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("slow query took %v to be stopped", elapsed)
+	}
+}
+
+func TestOsqueryNotInstalled(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	withConfig(t, &Config{})
+	_, err := runOsquery(context.Background(), "SELECT 1")
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) || reqErr.Status != 501 || reqErr.Code != "osquery_not_installed" {
+		t.Errorf("runOsquery without osqueryi = %v, want 501 osquery_not_installed", err)
+	}
+}
+
+func TestOsqueryRoutes(t *testing.T) {
+	fakeOsqueryi(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerOsqueryRoutes(r)
+
+	checkScopeRequired(t, r, scopeOsquery, "POST", "/osquery", `{"query": "SELECT * FROM listening_ports"}`)
+	checkScopeRequired(t, r, scopeOsquery, "GET", "/osquery/tables", "")
+
+	withScopedTokens(t, scopeOsquery)
+	w := serveWithToken(r, "POST", "/osquery", `{"query": "SELECT * FROM listening_ports"}`, "ops-token")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"row_count":5`) {
+		t.Errorf("POST /osquery = %d %s", w.Code, w.Body)
+	}
+	// The query is checked before osqueryi runs
+	w = serveWithToken(r, "POST", "/osquery", `{"query": "ATTACH DATABASE '/etc/shadow' AS s"}`, "ops-token")
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "query_not_allowed") {
+		t.Errorf("POST /osquery with ATTACH = %d %s", w.Code, w.Body)
+	}
+	w = serveWithToken(r, "POST", "/osquery", `{}`, "ops-token")
+	if w.Code != 400 {
+		t.Errorf("POST /osquery without a query = %d %s", w.Code, w.Body)
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	w = serveWithToken(r, "GET", "/osquery/tables", "", "ops-token")
+	if w.Code != 501 || !strings.Contains(w.Body.String(), "osquery_not_installed") {
+		t.Errorf("GET /osquery/tables without osqueryi = %d %s", w.Code, w.Body)
+	}
+}
+
+func TestCappedBuffer(t *testing.T) {
+	b := &cappedBuffer{limit: 8}
+	if n, err := b.Write([]byte("12345")); n != 5 || err != nil {
+		t.Errorf("first write = %d, %v", n, err)
+	}
+	if _, err := b.Write([]byte("6789")); err == nil || !b.exceeded {
+		t.Error("a write past the limit succeeded")
+	}
+	if string(b.Bytes()) != "12345" {
+		t.Errorf("buffer = %q", b.Bytes())
+	}
+
+	// io.Copy, as exec uses for stdout, must go through the limit too
+	b = &cappedBuffer{limit: 8}
+	if _, err := io.Copy(b, strings.NewReader("123456789")); err == nil || !b.exceeded {
+		t.Errorf("io.Copy past the limit = %v, kept %q", err, b.Bytes())
+	}
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/rothgar/cosi/api"
+)
+
+type PackageConfig struct {
+	Packages struct {
+		Installed   []string `yaml:"installed,omitempty" json:"installed,omitempty"`
+		Uninstalled []string `yaml:"uninstalled,omitempty" json:"uninstalled,omitempty"`
+	} `yaml:"packages" json:"packages"`
+	// Snaps entries are name, name/channel, or name/classic/channel
+	Snaps AppSection `yaml:"snaps,omitempty" json:"snaps,omitempty"`
+	// Flatpaks entries are application IDs or refs installed from flathub
+	Flatpaks AppSection `yaml:"flatpaks,omitempty" json:"flatpaks,omitempty"`
+	// ConffilePolicy decides which version of a modified config file dpkg keeps: "keep" (default) or "new"
+	ConffilePolicy string `yaml:"conffile_policy,omitempty" json:"conffile_policy,omitempty"`
+	PackageOptions `yaml:",inline"`
+	// PackageGroups and Modules are only applied on RPM hosts, ahead of the package lists
+	PackageGroups AppSection    `yaml:"package_groups,omitempty" json:"package_groups,omitempty"`
+	Modules       ModuleSection `yaml:"modules,omitempty" json:"modules,omitempty"`
+	// Verify are the checks run once the transaction succeeded
+	Verify []VerifyCheck `yaml:"verify,omitempty" json:"verify,omitempty"`
+
+	// AllowDowngrades lets pinned versions older than the installed ones through, as a
+	// rollback needs. Manifests can't set it.
+	AllowDowngrades bool `yaml:"-" json:"-"`
+	// Skipped lists the entries of the manifest that don't apply to this host
+	Skipped []SkippedEntry `yaml:"-" json:"-"`
+	// Where each entry was in the manifest as written, by list such as "packages.installed".
+	// Positions shift once entries are skipped or documents merged. Unset for configs that
+	// weren't parsed from a manifest.
+	paths map[string][]string
+	// Documents is the number of YAML documents merged into the config
+	Documents int `yaml:"-" json:"-"`
+}
+
+// Helper function to return the manifest location of each entry of a list
+func (p PackageConfig) entryPaths(list string, count int) []string {
+	if paths, ok := p.paths[list]; ok && len(paths) == count {
+		return paths
+	}
+	paths := make([]string, count)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("%s[%d]", list, i)
+	}
+	return paths
+}
+
+// Helper function to map a package spec to the package it names on this host, so a pinned
+// version and the bare name count as the same package
+func packageNameFunc() func(string) string {
+	pm, err := hostPackageManager()
+	if err != nil {
+		return func(spec string) string { return spec }
+	}
+	return func(spec string) string {
+		name, _ := pm.ParseSpec(spec)
+		return name
+	}
+}
+
+// Function to validate the options and entries of a package manifest. Every problem
+// is reported rather than only the first, so a client can fix them in one go.
+func (p PackageConfig) validate() []ManifestProblem {
+	var problems []ManifestProblem
+	switch p.ConffilePolicy {
+	case "", "keep", "new":
+	default:
+		problems = append(problems, ManifestProblem{
+			Field:   "conffile_policy",
+			Code:    "invalid_value",
+			Message: fmt.Sprintf("invalid conffile_policy %q: must be keep or new", p.ConffilePolicy),
+		})
+	}
+
+	installedPaths := p.entryPaths("packages.installed", len(p.Packages.Installed))
+	uninstalledPaths := p.entryPaths("packages.uninstalled", len(p.Packages.Uninstalled))
+	problems = append(problems, checkEntries(installedPaths, p.Packages.Installed, nil)...)
+	problems = append(problems, checkEntries(uninstalledPaths, p.Packages.Uninstalled, nil)...)
+	problems = append(problems, checkConflicts(installedPaths, uninstalledPaths, p.Packages.Installed, p.Packages.Uninstalled, packageNameFunc())...)
+	problems = append(problems, p.validateGroups()...)
+	problems = append(problems, p.validateVerify()...)
+	empty := len(p.Packages.Installed) == 0 && len(p.Packages.Uninstalled) == 0 && p.PackageGroups.empty() && p.Modules.empty()
+	for _, manager := range appManagers {
+		section := manager.Section(p)
+		key := manager.Name() + "s"
+		installPaths := p.entryPaths(key+".install", len(section.Install))
+		removePaths := p.entryPaths(key+".remove", len(section.Remove))
+		problems = append(problems, checkEntries(installPaths, section.Install, manager.ValidateEntry)...)
+		problems = append(problems, checkEntries(removePaths, section.Remove, manager.ValidateEntry)...)
+		problems = append(problems, checkConflicts(installPaths, removePaths, section.Install, section.Remove, nil)...)
+		empty = empty && section.empty()
+	}
+	// A manifest whose entries are all skipped on this host simply has nothing to do here,
+	// and one that only refreshes the package lists or autoremoves still does something
+	if empty && len(p.Skipped) == 0 && !p.UpdateCache && !p.Autoremove {
+		problems = append(problems, ManifestProblem{
+			Field:   "packages",
+			Code:    "no_entries",
+			Message: "manifest has nothing to install or remove",
+		})
+	}
+	return problems
+}
+
+// Helper function to check the entries of one manifest list for blanks, duplicates, and
+// values the manager would reject. paths holds the manifest location of each entry.
+func checkEntries(paths, entries []string, validateEntry func(string) error) []ManifestProblem {
+	var problems []ManifestProblem
+	seen := make(map[string]int)
+	for i, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			problems = append(problems, ManifestProblem{Field: paths[i], Code: "empty_entry", Message: "entry is empty"})
+			continue
+		}
+		if first, ok := seen[entry]; ok {
+			problems = append(problems, ManifestProblem{
+				Field:   paths[i],
+				Code:    "duplicate_entry",
+				Message: fmt.Sprintf("%s is already listed at %s", entry, paths[first]),
+			})
+			continue
+		}
+		seen[entry] = i
+		if validateEntry != nil {
+			if err := validateEntry(entry); err != nil {
+				problems = append(problems, ManifestProblem{Field: paths[i], Code: "invalid_value", Message: err.Error()})
+			}
+		}
+	}
+	return problems
+}
+
+// Helper function to find entries that a section both installs and removes. name maps an
+// entry to the package it refers to and defaults to the entry itself.
+func checkConflicts(installPaths, removePaths, install, remove []string, name func(string) string) []ManifestProblem {
+	if name == nil {
+		name = func(entry string) string { return entry }
+	}
+	installed := make(map[string]int)
+	for i, entry := range install {
+		installed[name(entry)] = i
+	}
+	var problems []ManifestProblem
+	for i, entry := range remove {
+		if j, ok := installed[name(entry)]; ok && strings.TrimSpace(entry) != "" {
+			problems = append(problems, ManifestProblem{
+				Field:   removePaths[i],
+				Code:    "conflict",
+				Message: fmt.Sprintf("%s is also listed in %s", entry, installPaths[j]),
+			})
+		}
+	}
+	return problems
+}
+
+// packageLock serializes package transactions so manual and background applies never overlap
+var packageLock fifoMutex
+
+// packageLockHeld marks the context of work done under a packageLock its caller already
+// holds, like the operations of a batch
+type packageLockHeld struct{}
+
+// Helper function to take packageLock unless ctx says the caller holds it already. It
+// returns the function that releases it.
+func lockPackages(ctx context.Context) func() {
+	if held, _ := ctx.Value(packageLockHeld{}).(bool); held {
+		return func() {}
+	}
+	packageLock.Lock()
+	return packageLock.Unlock
+}
+
+var errUnsupportedOS = errors.New("unsupported operating system")
+
+// PackageApplyResult holds the output of applying a manifest
+type PackageApplyResult = api.PackageApplyResult
+
+// packageManager builds the commands used to query and change a host's packages
+type packageManager interface {
+	Name() string
+	// PrivilegedTools lists the binaries that change packages and therefore need root
+	PrivilegedTools() []string
+	// InstallCommand returns nil when the manifest has nothing to install
+	InstallCommand(config PackageConfig) *exec.Cmd
+	// RemoveCommand returns nil when the manifest has nothing to remove
+	RemoveCommand(config PackageConfig) *exec.Cmd
+	ListCommand() *exec.Cmd
+	// DatabasePaths are the files the package manager rewrites whenever packages change
+	DatabasePaths() []string
+	// ManualCommand lists only the packages that were explicitly installed, one name per line
+	ManualCommand() *exec.Cmd
+	// VersionsCommand lists every known package as "name version status" lines
+	// where status is "installed" for packages that are actually present
+	VersionsCommand() *exec.Cmd
+	// PinnedSpec formats a package name and version the way the install command accepts it
+	PinnedSpec(name, version string) string
+	// ParseSpec splits a manifest entry into the package name and the pinned version, if any
+	ParseSpec(spec string) (name, version string)
+	// Candidates returns the version the repositories offer for each of the named packages
+	Candidates(ctx context.Context, names []string) (map[string]string, error)
+	// AvailableVersions returns every version the repositories offer for each of the named packages
+	AvailableVersions(ctx context.Context, names []string) (map[string][]string, error)
+	// InstalledKernels returns the kernel releases (as in `uname -r`) of the installed kernel packages
+	InstalledKernels(ctx context.Context) ([]string, error)
+	// CheckReboot adds the distribution's own reboot-required signals and restartable services to status
+	CheckReboot(ctx context.Context, status *RebootStatus) error
+	// RepairCommands recover the package database after an interrupted transaction, in order
+	RepairCommands() []*exec.Cmd
+	// RefreshCommand downloads the latest package lists from the repositories
+	RefreshCommand() *exec.Cmd
+}
+
+// Function to pick the package manager for the distribution in os-release
+func packageManagerFor(osRelease map[string]string) packageManager {
+	if imageBasedOS(osRelease) {
+		return imageManager{OS: osRelease["NAME"]}
+	}
+	switch osRelease["ID"] {
+	case "ubuntu", "debian":
+		return aptManager{}
+	case "fedora", "centos", "rhel":
+		return dnfManager{}
+	case "amzn":
+		// Amazon Linux 2 only has yum; 2023 moved to dnf
+		return dnfManager{Yum: osRelease["VERSION_ID"] == "2"}
+	case "gentoo":
+		return portageManager{}
+	case "nixos":
+		return nixManager{}
+	}
+	return nil
+}
+
+// packageCleaner is implemented by package managers whose RemoveCommand only deselects
+// packages, leaving a second command to actually remove them
+type packageCleaner interface {
+	CleanupCommand(config PackageConfig) *exec.Cmd
+}
+
+// packageQuerier is implemented by package managers whose installed packages can't be
+// listed by one command. It takes the place of ListCommand and VersionsCommand.
+type packageQuerier interface {
+	InstalledVersions(ctx context.Context) (map[string]string, error)
+}
+
+// manualQuerier is implemented by package managers whose explicitly installed packages
+// can't be read as the fields of one command's output. It takes the place of ManualCommand.
+type manualQuerier interface {
+	ManualPackages(ctx context.Context) ([]string, error)
+}
+
+// readOnlyManager is implemented by package managers that list packages but can't
+// change them. ReadOnly returns the error code and the reason to report.
+type readOnlyManager interface {
+	ReadOnly() (code, reason string)
+}
+
+// Function to refuse an operation that changes packages when the host's package
+// manager is read-only
+func checkWritable(pm packageManager) error {
+	if readOnly, ok := pm.(readOnlyManager); ok {
+		code, reason := readOnly.ReadOnly()
+		return &requestError{Status: 400, Code: code, Message: reason}
+	}
+	return nil
+}
+
+// Function to detect the package manager of the running host
+func hostPackageManager() (packageManager, error) {
+	osReleaseData, err := readOSReleaseFile("/etc/os-release")
+	if err != nil {
+		return nil, err
+	}
+	pm := packageManagerFor(osReleaseData)
+	if pm == nil {
+		return nil, errUnsupportedOS
+	}
+	return pm, nil
+}
+
+// Function to install and then uninstall the packages of a manifest as part of job,
+// which may be nil. Callers must hold packageLock.
+func applyPackages(pm packageManager, config PackageConfig, job *jobControl) (*PackageApplyResult, error) {
+	result := &PackageApplyResult{Skipped: config.Skipped, Packages: packageOutcomes(pm, config)}
+	result.Warnings = append(result.Warnings, ignoredOptionWarnings(pm, config.PackageOptions)...)
+	// Even a failed transaction may have changed some packages
+	defer installedPackages.Invalidate()
+
+	if config.UpdateCache {
+		cmd := pm.RefreshCommand()
+		output, err := runJobCommand(cmd, job)
+		result.Refresh = &output
+		if err != nil {
+			result.FailedStep = "refresh"
+			return result, &commandError{Tool: commandTool(cmd), Result: output, Err: err}
+		}
+	}
+
+	if err := applyGroupSections(pm, config, result, job); err != nil {
+		return result, err
+	}
+
+	if cmd := pm.InstallCommand(config); cmd != nil {
+		output, err := runJobCommand(cmd, job)
+		result.Install = output
+		if err != nil {
+			result.FailedStep = "install"
+			return result, &commandError{Tool: commandTool(cmd), Result: output, Err: err}
+		}
+	}
+
+	if cmd := pm.RemoveCommand(config); cmd != nil {
+		output, err := runJobCommand(cmd, job)
+		result.Uninstall = output
+		if err != nil {
+			result.FailedStep = "uninstall"
+			return result, &commandError{Tool: commandTool(cmd), Result: output, Err: err}
+		}
+	}
+	if cleaner, ok := pm.(packageCleaner); ok {
+		if cmd := cleaner.CleanupCommand(config); cmd != nil {
+			output, err := runJobCommand(cmd, job)
+			result.Uninstall = CommandResult{
+				Stdout:   result.Uninstall.Stdout + output.Stdout,
+				Stderr:   result.Uninstall.Stderr + output.Stderr,
+				Output:   result.Uninstall.Output + output.Output,
+				ExitCode: output.ExitCode,
+			}
+			if err != nil {
+				result.FailedStep = "uninstall"
+				return result, &commandError{Tool: commandTool(cmd), Result: output, Err: err}
+			}
+		}
+	}
+
+	if config.Autoremove {
+		output, removed, err := autoremovePackages(pm, config, job)
+		if output.Output != "" || err != nil {
+			result.Autoremove = &output
+		}
+		result.Autoremoved = removed
+		if err != nil {
+			result.FailedStep = "autoremove"
+			return result, err
+		}
+	}
+
+	if err := applyAppSections(config, result, job); err != nil {
+		return result, err
+	}
+
+	if len(config.Verify) > 0 {
+		var err error
+		result.Verification, err = runVerification(config.Verify)
+		return result, err
+	}
+	return result, nil
+}
+
+// Function to describe a manifest for job summaries
+func packageSummary(config PackageConfig) string {
+	summary := fmt.Sprintf("install %d, remove %d packages", len(config.Packages.Installed), len(config.Packages.Uninstalled)) + optionsSummary(config.PackageOptions)
+	if !config.PackageGroups.empty() {
+		summary += fmt.Sprintf("; install %d, remove %d groups", len(config.PackageGroups.Install), len(config.PackageGroups.Remove))
+	}
+	if modules := len(config.Modules.Enable) + len(config.Modules.Disable) + len(config.Modules.Reset); modules > 0 {
+		summary += fmt.Sprintf("; change %d module streams", modules)
+	}
+	for _, manager := range appManagers {
+		if section := manager.Section(config); !section.empty() {
+			summary += fmt.Sprintf("; install %d, remove %d %ss", len(section.Install), len(section.Remove), manager.Name())
+		}
+	}
+	if len(config.Verify) > 0 {
+		summary += fmt.Sprintf("; verify %d checks", len(config.Verify))
+	}
+	return summary
+}
+
+type aptManager struct{}
+
+func (aptManager) Name() string { return "apt" }
+
+func (aptManager) PrivilegedTools() []string { return []string{"apt-get"} }
+
+func (aptManager) InstallCommand(config PackageConfig) *exec.Cmd {
+	if len(config.Packages.Installed) == 0 {
+		return nil
+	}
+	return aptCommand(config, "install", config.Packages.Installed)
+}
+
+func (aptManager) RemoveCommand(config PackageConfig) *exec.Cmd {
+	if len(config.Packages.Uninstalled) == 0 {
+		return nil
+	}
+	action := "remove"
+	if config.Purge {
+		action = "purge"
+	}
+	return aptCommand(config, action, config.Packages.Uninstalled)
+}
+
+func (aptManager) SupportedOptions() []string {
+	return []string{"purge", "autoremove", "no_recommends"}
+}
+
+func (aptManager) AutoremoveCommand(config PackageConfig) *exec.Cmd {
+	cmd := aptCommand(config, "autoremove", nil)
+	if config.Purge {
+		cmd.Args = append(cmd.Args, "--purge")
+	}
+	return cmd
+}
+
+func (aptManager) ListCommand() *exec.Cmd {
+	return newCommand("dpkg-query", "-W", "-f=${binary:Package}\n")
+}
+
+func (aptManager) DatabasePaths() []string {
+	return []string{"/var/lib/dpkg/status"}
+}
+
+func (aptManager) RefreshCommand() *exec.Cmd {
+	return newPrivilegedCommand(aptEnv, "apt-get", "update")
+}
+
+func (aptManager) RepairCommands() []*exec.Cmd {
+	// Finish configuring unpacked packages, then fix the dependencies left broken
+	return []*exec.Cmd{
+		newPrivilegedCommand(aptEnv, "dpkg", "--configure", "-a", "--force-confdef", "--force-confold"),
+		newPrivilegedCommand(aptEnv, "apt-get", "install", "-f", "-y", "-o", "Dpkg::Options::=--force-confdef", "-o", "Dpkg::Options::=--force-confold"),
+	}
+}
+
+func (aptManager) ManualCommand() *exec.Cmd {
+	return newCommand("apt-mark", "showmanual")
+}
+
+func (aptManager) VersionsCommand() *exec.Cmd {
+	return newCommand("dpkg-query", "-W", "-f=${Package} ${Version} ${db:Status-Status}\n")
+}
+
+func (aptManager) PinnedSpec(name, version string) string {
+	return name + "=" + version
+}
+
+func (aptManager) ParseSpec(spec string) (string, string) {
+	return parseAptSpec(spec)
+}
+
+func (aptManager) Candidates(ctx context.Context, names []string) (map[string]string, error) {
+	cmd := newCommand("apt-cache", append([]string{"policy"}, names...)...)
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+
+	// apt-cache policy prints a "name:" header followed by indented fields for each known package
+	candidates := make(map[string]string)
+	current := ""
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		if line != "" && !strings.HasPrefix(line, " ") && strings.HasSuffix(line, ":") {
+			current = strings.TrimSuffix(line, ":")
+			continue
+		}
+		field := strings.TrimSpace(line)
+		if version, ok := strings.CutPrefix(field, "Candidate:"); ok && current != "" {
+			version = strings.TrimSpace(version)
+			if version != "(none)" {
+				candidates[current] = version
+			}
+		}
+	}
+	return candidates, nil
+}
+
+func (aptManager) AvailableVersions(ctx context.Context, names []string) (map[string][]string, error) {
+	cmd := newCommand("apt-cache", append([]string{"madison"}, names...)...)
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+
+	// apt-cache madison prints "name | version | source" for each version in the repositories
+	versions := make(map[string][]string)
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) == 3 {
+			name, version := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+			versions[name] = append(versions[name], version)
+		}
+	}
+	return versions, nil
+}
+
+// Helper function to build a non-interactive apt-get command that never waits on a debconf or conffile prompt
+func aptCommand(config PackageConfig, action string, packages []string) *exec.Cmd {
+	args := aptArgs(action, config.ConffilePolicy, packages)
+	if config.AllowDowngrades {
+		args = append([]string{args[0], "--allow-downgrades"}, args[1:]...)
+	}
+	if config.NoRecommends && action == "install" {
+		args = append([]string{args[0], "--no-install-recommends"}, args[1:]...)
+	}
+	return newPrivilegedCommand(aptEnv, "apt-get", args...)
+}
+
+// Helper function to build apt-get arguments that resolve conffile prompts with the given policy
+func aptArgs(action, conffilePolicy string, packages []string) []string {
+	conffile := "--force-confold"
+	if conffilePolicy == "new" {
+		conffile = "--force-confnew"
+	}
+	args := []string{
+		action, "-y",
+		"-o", "Dpkg::Options::=--force-confdef",
+		"-o", "Dpkg::Options::=" + conffile,
+	}
+	return append(args, packages...)
+}
+
+// Environment that keeps apt and debconf from prompting
+var aptEnv = []string{
+	"DEBIAN_FRONTEND=noninteractive",
+	"APT_LISTCHANGES_FRONTEND=none",
+}
+
+// dnfManager drives dnf, or yum on older RPM hosts such as Amazon Linux 2. yum takes
+// the same arguments for everything but its queries, which come from yum-utils.
+type dnfManager struct {
+	Yum bool
+}
+
+func (m dnfManager) tool() string {
+	if m.Yum {
+		return "yum"
+	}
+	return "dnf"
+}
+
+func (m dnfManager) Name() string { return m.tool() }
+
+func (m dnfManager) PrivilegedTools() []string { return []string{m.tool()} }
+
+func (m dnfManager) InstallCommand(config PackageConfig) *exec.Cmd {
+	if len(config.Packages.Installed) == 0 {
+		return nil
+	}
+	return newPrivilegedCommand(nil, m.tool(), append([]string{"install", "-y"}, config.Packages.Installed...)...)
+}
+
+func (m dnfManager) RemoveCommand(config PackageConfig) *exec.Cmd {
+	if len(config.Packages.Uninstalled) == 0 {
+		return nil
+	}
+	return newPrivilegedCommand(nil, m.tool(), append([]string{"remove", "-y"}, config.Packages.Uninstalled...)...)
+}
+
+// SupportedOptions leaves out purge, as rpm always removes unmodified config files and
+// keeps modified ones as .rpmsave, and no_recommends, which only weak dependencies have
+func (dnfManager) SupportedOptions() []string {
+	return []string{"autoremove"}
+}
+
+func (m dnfManager) AutoremoveCommand(config PackageConfig) *exec.Cmd {
+	return newPrivilegedCommand(nil, m.tool(), "autoremove", "-y")
+}
+
+func (m dnfManager) ListCommand() *exec.Cmd {
+	return newCommand(m.tool(), "list", "installed")
+}
+
+func (dnfManager) DatabasePaths() []string {
+	// The rpm database moved to /usr/lib/sysimage in newer releases and to SQLite from Berkeley DB
+	return []string{"/usr/lib/sysimage/rpm/rpmdb.sqlite", "/var/lib/rpm/rpmdb.sqlite", "/var/lib/rpm/Packages"}
+}
+
+func (m dnfManager) RefreshCommand() *exec.Cmd {
+	return newPrivilegedCommand(nil, m.tool(), "makecache")
+}
+
+func (m dnfManager) RepairCommands() []*exec.Cmd {
+	// dnf has no half-configured state; rebuild the rpm database and report what's left broken
+	return []*exec.Cmd{
+		newPrivilegedCommand(nil, "rpm", "--rebuilddb"),
+		newPrivilegedCommand(nil, m.tool(), "check"),
+	}
+}
+
+func (m dnfManager) ManualCommand() *exec.Cmd {
+	if m.Yum {
+		return newCommand("yumdb", "search", "reason", "user")
+	}
+	return newCommand("dnf", "repoquery", "--userinstalled", "--qf", "%{name}\n")
+}
+
+// ManualPackages reads yumdb's "name-version-release.arch" headers on yum hosts, where
+// repoquery can't tell which packages were installed explicitly
+func (m dnfManager) ManualPackages(ctx context.Context) ([]string, error) {
+	cmd := m.ManualCommand()
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	if !m.Yum {
+		return strings.Fields(result.Stdout), nil
+	}
+	var names []string
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		// Each package is followed by indented "reason = user" lines
+		if line == "" || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "Loaded plugins") {
+			continue
+		}
+		name, _ := parseRPMSpec(strings.TrimSpace(line))
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (dnfManager) VersionsCommand() *exec.Cmd {
+	return newCommand("rpm", "-qa", "--qf", "%{NAME} %|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE} installed\n")
+}
+
+func (dnfManager) PinnedSpec(name, version string) string {
+	return name + "-" + version
+}
+
+func (dnfManager) ParseSpec(spec string) (string, string) {
+	return parseRPMSpec(spec)
+}
+
+func (m dnfManager) Candidates(ctx context.Context, names []string) (map[string]string, error) {
+	cmd := newCommand("dnf", append([]string{"repoquery", "--latest-limit", "1", "--qf", "%{name} %{evr}\n"}, names...)...)
+	if m.Yum {
+		// yum-utils repoquery shows only the newest version unless asked for duplicates
+		cmd = newCommand("repoquery", append([]string{"--qf", "%{name} %{version}-%{release}"}, names...)...)
+	}
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+
+	candidates := make(map[string]string)
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			candidates[fields[0]] = fields[1]
+		}
+	}
+	return candidates, nil
+}
+
+func (m dnfManager) AvailableVersions(ctx context.Context, names []string) (map[string][]string, error) {
+	cmd := newCommand("dnf", append([]string{"repoquery", "--showduplicates", "--qf", "%{name} %{evr}\n"}, names...)...)
+	if m.Yum {
+		cmd = newCommand("repoquery", append([]string{"--show-duplicates", "--qf", "%{name} %{version}-%{release}"}, names...)...)
+	}
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+
+	versions := make(map[string][]string)
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			versions[fields[0]] = append(versions[fields[0]], fields[1])
+		}
+	}
+	return versions, nil
+}
+
+// Function to list the installed packages with the host's package manager
+func listInstalledPackages(ctx context.Context, pm packageManager) ([]string, error) {
+	if querier, ok := pm.(packageQuerier); ok {
+		versions, err := querier.InstalledVersions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(versions))
+		for name := range versions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	cmd := pm.ListCommand()
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+
+	// Parse the output into a list of packages
+	return strings.Split(strings.TrimSpace(result.Stdout), "\n"), nil
+}
+
+// Function to map each installed package to its version
+func installedVersions(ctx context.Context, pm packageManager) (map[string]string, error) {
+	if querier, ok := pm.(packageQuerier); ok {
+		return querier.InstalledVersions(ctx)
+	}
+	cmd := pm.VersionsCommand()
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+
+	versions := make(map[string]string)
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		// Skip packages that were removed but still have config files around
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[2] == "installed" {
+			versions[fields[0]] = fields[1]
+		}
+	}
+	return versions, nil
+}
+
+// Function to export the installed packages as a manifest that POST /packages accepts.
+// Unless all is set only explicitly installed packages are included, so the manifest
+// doesn't list every base package; pinned embeds the current versions.
+func exportManifest(ctx context.Context, pm packageManager, all, pinned bool) (PackageConfig, error) {
+	var config PackageConfig
+
+	var names []string
+	if all {
+		versions, err := installedVersions(ctx, pm)
+		if err != nil {
+			return config, err
+		}
+		for name := range versions {
+			names = append(names, name)
+		}
+	} else if querier, ok := pm.(manualQuerier); ok {
+		manual, err := querier.ManualPackages(ctx)
+		if err != nil {
+			return config, err
+		}
+		names = manual
+	} else {
+		cmd := pm.ManualCommand()
+		result, err := runCommandContext(ctx, cmd)
+		if err != nil {
+			return config, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+		}
+		names = strings.Fields(result.Stdout)
+	}
+	sort.Strings(names)
+
+	if pinned {
+		versions, err := installedVersions(ctx, pm)
+		if err != nil {
+			return config, err
+		}
+		for i, name := range names {
+			if version, ok := versions[name]; ok {
+				names[i] = pm.PinnedSpec(name, version)
+			}
+		}
+	}
+
+	config.Packages.Installed = names
+	return config, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// Helper function to fake a Debian host's package database: three packages installed by
+// hand, a library pulled in by them, and a removed package that left its config files
+func fakeDpkg(t *testing.T) {
+	t.Helper()
+	fakeCommand(t, "apt-mark", `printf 'vim\ncurl\nkubelet\n'`)
+	fakeCommand(t, "dpkg-query", `printf '%s\n' \
+	'curl 7.81.0-1ubuntu1.16 installed' \
+	'kubelet 1.30.2-1.1 installed' \
+	'libc6 2.35-0ubuntu3.8 installed' \
+	'vim 2:8.2.3995-1ubuntu2.17 installed' \
+	'old-kernel 5.15.0-91.101 config-files'`)
+}
+
+func TestExportManifestRoundTrip(t *testing.T) {
+	fakeDpkg(t)
+	tests := []struct {
+		name        string
+		all, pinned bool
+		want        []string
+	}{
+		{"manual", false, false, []string{"curl", "kubelet", "vim"}},
+		{"pinned", false, true, []string{"curl=7.81.0-1ubuntu1.16", "kubelet=1.30.2-1.1", "vim=2:8.2.3995-1ubuntu2.17"}},
+		{"all", true, false, []string{"curl", "kubelet", "libc6", "vim"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			manifest, err := exportManifest(ctx, aptManager{}, tt.all, tt.pinned)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(manifest.Packages.Installed, tt.want) {
+				t.Fatalf("exported %q, want %q", manifest.Packages.Installed, tt.want)
+			}
+
+			// GET /packages/manifest renders the manifest as YAML for POST /packages
+			data, err := yaml.Marshal(manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := parseManifest(data)
+			if err != nil {
+				t.Fatalf("exported manifest doesn't parse: %v\n%s", err, data)
+			}
+			if !reflect.DeepEqual(parsed.Packages.Installed, tt.want) {
+				t.Errorf("round trip gave %q, want %q", parsed.Packages.Installed, tt.want)
+			}
+
+			// Applied to the host it came from, the manifest changes nothing
+			diff, err := diffPackages(ctx, aptManager{}, parsed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !diff.InSync {
+				t.Errorf("diff against the same host isn't in sync: %+v", diff.Summary)
+			}
+		})
+	}
+}
+
+// Detection of the package manager from real os-release files in testdata/os-release
+func TestPackageManagerForOSRelease(t *testing.T) {
+	tests := []struct {
+		fixture  string
+		manager  string
+		families []string
+		readOnly string // the error code of changes, if refused
+	}{
+		{"ubuntu-22.04", "apt", []string{"ubuntu", "debian"}, ""},
+		// Amazon Linux 2 only has yum, 2023 has dnf; both take rhel entries
+		{"amzn-2", "yum", []string{"amzn", "centos", "rhel", "fedora"}, ""},
+		{"amzn-2023", "dnf", []string{"amzn", "fedora", "rhel"}, ""},
+		{"bottlerocket", "image", []string{"bottlerocket"}, "immutable_os"},
+		{"fedora-coreos", "image", []string{"fedora"}, "immutable_os"},
+	}
+	for _, tt := range tests {
+		osRelease, err := readOSReleaseFile(filepath.Join("testdata", "os-release", tt.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pm := packageManagerFor(osRelease)
+		if pm == nil || pm.Name() != tt.manager {
+			t.Errorf("%s: package manager = %v, want %s", tt.fixture, pm, tt.manager)
+			continue
+		}
+		if got := hostFamilies(osRelease); !reflect.DeepEqual(got, tt.families) {
+			t.Errorf("%s: families = %q, want %q", tt.fixture, got, tt.families)
+		}
+
+		err = checkWritable(pm)
+		var reqErr *requestError
+		if tt.readOnly == "" && err != nil || tt.readOnly != "" && (!errors.As(err, &reqErr) || reqErr.Code != tt.readOnly) {
+			t.Errorf("%s: checkWritable = %v, want %q", tt.fixture, err, tt.readOnly)
+		}
+		if tt.readOnly != "" {
+			if _, err := pm.Candidates(context.Background(), []string{"kubelet"}); !errors.As(err, &reqErr) || reqErr.Code != tt.readOnly {
+				t.Errorf("%s: Candidates = %v, want %s", tt.fixture, err, tt.readOnly)
+			}
+			if !strings.HasPrefix(reqErr.Message, osRelease["NAME"]+" is an image-based OS") {
+				t.Errorf("%s: message = %q", tt.fixture, reqErr.Message)
+			}
+		}
+	}
+}
+
+// Kubernetes is installed with the host's own tool on Amazon Linux
+func TestKubernetesRPMStepsOnAmazonLinux(t *testing.T) {
+	for fixture, tool := range map[string]string{"amzn-2": "yum", "amzn-2023": "dnf"} {
+		osRelease, err := readOSReleaseFile(filepath.Join("testdata", "os-release", fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dnf, ok := packageManagerFor(osRelease).(dnfManager)
+		if !ok {
+			t.Fatalf("%s: not an rpm host", fixture)
+		}
+		var installs []string
+		for _, step := range kubernetesRPMSteps(dnf) {
+			if len(step.Args) > 1 && step.Args[1] == "install" {
+				installs = append(installs, step.String())
+			}
+		}
+		want := tool + " install -y --disableexcludes=kubernetes kubelet kubeadm kubectl"
+		if len(installs) != 1 || installs[0] != want {
+			t.Errorf("%s: install steps = %q, want %q", fixture, installs, want)
+		}
+	}
+}
+
+// Installing uploaded package files runs their maintainer scripts as root, so it needs
+// the packages-local scope
+func TestLocalPackageRoutesRequireScope(t *testing.T) {
+	withJobStore(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerLocalPackageRoutes(r)
+
+	// Without an upload, the requests let through are refused before anything is installed
+	checkScopeRequired(t, r, scopeLocalPackages, "POST", "/packages/local", "")
+	if listed := jobs.List(); len(listed) != 0 {
+		t.Errorf("jobs = %+v, want none started", listed)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Package names dpkg and rpm accept, with dpkg's :arch qualifier. The leading character
+// keeps names from being read as options.
+var packageFileName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9+._:~-]*$`)
+
+// fileQuerier is implemented by package managers whose database records the files of
+// each package
+type fileQuerier interface {
+	// OwnedFiles lists the paths a package installed, in the database's order
+	OwnedFiles(ctx context.Context, name string) ([]string, error)
+	// VerifyFiles checks a package's files against the database, returning the ones
+	// that differ
+	VerifyFiles(ctx context.Context, name string) ([]FileVerification, error)
+	// FileOwners names the packages that own path, and is empty when none does
+	FileOwners(ctx context.Context, path string) ([]string, error)
+}
+
+// PackageFileEntry is one path of GET /packages/:name/files
+type PackageFileEntry struct {
+	Path    string `json:"path"`
+	Type    string `json:"type,omitempty"` // file, directory, symlink, or other
+	Size    int64  `json:"size"`
+	Mode    string `json:"mode,omitempty"`
+	Missing bool   `json:"missing,omitempty"`
+}
+
+// FileVerification is a file of a package that doesn't match the package database.
+// Checks the package manager can't perform, like everything but the checksum on dpkg
+// hosts, are reported as passed.
+type FileVerification struct {
+	Path   string `json:"path"`
+	Config bool   `json:"config"`
+	// Flags is the package manager's own status column, like S.5....T.
+	Flags            string `json:"flags,omitempty"`
+	Missing          bool   `json:"missing"`
+	SizeChanged      bool   `json:"size_changed"`
+	ModeChanged      bool   `json:"mode_changed"`
+	ChecksumMismatch bool   `json:"checksum_mismatch"` // md5 on dpkg hosts, the file digest on RPM hosts
+	LinkChanged      bool   `json:"link_changed"`
+	OwnerChanged     bool   `json:"owner_changed"`
+	GroupChanged     bool   `json:"group_changed"`
+	MtimeChanged     bool   `json:"mtime_changed"`
+	// Error is set when the file couldn't be checked, e.g. because it isn't readable
+	Error string `json:"error,omitempty"`
+}
+
+func (aptManager) OwnedFiles(ctx context.Context, name string) ([]string, error) {
+	result, err := runCommandContext(ctx, newCommand("dpkg-query", "--listfiles", name))
+	if err != nil {
+		if strings.Contains(result.Output, "is not installed") {
+			return nil, packageNotInstalled(name)
+		}
+		return nil, &commandError{Tool: "dpkg-query", Result: result, Err: err}
+	}
+	return parseFileList(result.Stdout), nil
+}
+
+// dpkg exits 1 when some files differ, so only output on stderr is a failure
+func (aptManager) VerifyFiles(ctx context.Context, name string) ([]FileVerification, error) {
+	result, err := runCommandContext(ctx, newCommand("dpkg", "--verify", "--verify-format=rpm", name))
+	if strings.Contains(result.Stderr, "is not installed") {
+		return nil, packageNotInstalled(name)
+	}
+	if err != nil && (result.ExitCode != 1 || result.Stdout == "") {
+		return nil, &commandError{Tool: "dpkg", Result: result, Err: err}
+	}
+	return parseVerifyOutput(result.Stdout), nil
+}
+
+func (aptManager) FileOwners(ctx context.Context, path string) ([]string, error) {
+	result, err := runCommandContext(ctx, newCommand("dpkg-query", "--search", path))
+	if err != nil {
+		if strings.Contains(result.Output, "no path found matching") {
+			return nil, nil
+		}
+		return nil, &commandError{Tool: "dpkg-query", Result: result, Err: err}
+	}
+	return parseDpkgSearch(result.Stdout, path), nil
+}
+
+// The queries go to rpm itself, which yum and dnf hosts both have
+func (dnfManager) OwnedFiles(ctx context.Context, name string) ([]string, error) {
+	result, err := runCommandContext(ctx, newCommand("rpm", "--query", "--list", name))
+	if err != nil {
+		if strings.Contains(result.Output, "is not installed") {
+			return nil, packageNotInstalled(name)
+		}
+		return nil, &commandError{Tool: "rpm", Result: result, Err: err}
+	}
+	return parseFileList(result.Stdout), nil
+}
+
+// rpm exits 1 when some files differ, so only output on stderr is a failure
+func (dnfManager) VerifyFiles(ctx context.Context, name string) ([]FileVerification, error) {
+	result, err := runCommandContext(ctx, newCommand("rpm", "--verify", name))
+	if strings.Contains(result.Output, "is not installed") {
+		return nil, packageNotInstalled(name)
+	}
+	if err != nil && (result.ExitCode != 1 || result.Stdout == "") {
+		return nil, &commandError{Tool: "rpm", Result: result, Err: err}
+	}
+	return parseVerifyOutput(result.Stdout), nil
+}
+
+func (dnfManager) FileOwners(ctx context.Context, path string) ([]string, error) {
+	result, err := runCommandContext(ctx, newCommand("rpm", "--query", "--file", "--queryformat", "%{NAME}\n", path))
+	if err != nil {
+		if strings.Contains(result.Output, "is not owned by any package") || strings.Contains(result.Output, "No such file or directory") {
+			return nil, nil
+		}
+		return nil, &commandError{Tool: "rpm", Result: result, Err: err}
+	}
+	return uniqueSorted(strings.Fields(result.Stdout)), nil
+}
+
+// Helper function to build the error for a package that isn't installed
+func packageNotInstalled(name string) error {
+	return &requestError{Status: 404, Code: "package_not_installed", Message: fmt.Sprintf("Package %s is not installed", name)}
+}
+
+// Function to read the paths of dpkg -L or rpm -ql, skipping dpkg's "/." root entry,
+// its diversion notes, and rpm's "(contains no files)". Packages installed for several
+// architectures or versions list their shared files more than once.
+func parseFileList(output string) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, "/") || line == "/." || seen[line] {
+			continue
+		}
+		seen[line] = true
+		paths = append(paths, line)
+	}
+	return paths
+}
+
+// Function to parse the output of dpkg -S for one literal path, e.g.
+//
+//	libc6:amd64, libc6:i386: /usr/share/doc/libc6
+//	diversion by dash from: /bin/sh
+//
+// Diversion lines name the package that moved the file, not the one that owns it, so
+// they are skipped.
+func parseDpkgSearch(output, path string) []string {
+	var owners []string
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "diversion by ") || strings.HasPrefix(line, "local diversion ") {
+			continue
+		}
+		packages, file, ok := strings.Cut(line, ": ")
+		if !ok || file != path {
+			continue
+		}
+		for _, name := range strings.Split(packages, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				owners = append(owners, name)
+			}
+		}
+	}
+	return uniqueSorted(owners)
+}
+
+// Function to parse the output of rpm -V, or dpkg --verify in its rpm format, which
+// have one line per differing file, e.g.
+//
+//	S.5....T.  c /etc/ssh/sshd_config
+//	??5??????   /usr/bin/ls
+//	missing   c /etc/default/useradd
+//
+// The status column has a letter for every failed check and a dot for every passed
+// one, in the order size, mode, digest, device, link, user, group, mtime, and
+// capabilities; ? marks a check that couldn't be run.
+func parseVerifyOutput(output string) []FileVerification {
+	var files []FileVerification
+	for _, line := range strings.Split(output, "\n") {
+		flags, rest, ok := strings.Cut(strings.TrimRight(line, " "), " ")
+		if !ok || flags == "" {
+			continue
+		}
+		file := FileVerification{}
+		if flags == "missing" {
+			file.Missing = true
+		} else if len(flags) >= 8 {
+			file.Flags = flags
+			file.SizeChanged = flags[0] == 'S'
+			file.ModeChanged = flags[1] == 'M'
+			file.ChecksumMismatch = flags[2] == '5'
+			file.LinkChanged = flags[4] == 'L'
+			file.OwnerChanged = flags[5] == 'U'
+			file.GroupChanged = flags[6] == 'G'
+			file.MtimeChanged = flags[7] == 'T'
+		} else {
+			continue
+		}
+
+		// The status column is followed by an attribute letter, c for config files,
+		// or a blank, and then the path
+		rest = strings.TrimLeft(rest, " ")
+		if len(rest) > 2 && rest[0] != '/' && rest[1] == ' ' {
+			file.Config = rest[0] == 'c'
+			rest = strings.TrimLeft(rest[2:], " ")
+		}
+		if !strings.HasPrefix(rest, "/") {
+			continue
+		}
+		file.Path = rest
+		// rpm appends why a check failed, like "(Permission denied)"
+		if open := strings.LastIndex(rest, " ("); open > 0 && strings.HasSuffix(rest, ")") {
+			file.Path = rest[:open]
+			file.Error = rest[open+2 : len(rest)-1]
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// Helper function to sort names and drop the duplicates
+func uniqueSorted(names []string) []string {
+	sort.Strings(names)
+	unique := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+// Function to list a package's files with their size and mode as they are on disk now
+func packageFiles(ctx context.Context, querier fileQuerier, name string) ([]PackageFileEntry, error) {
+	paths, err := querier.OwnedFiles(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]PackageFileEntry, 0, len(paths))
+	for _, path := range paths {
+		entry := PackageFileEntry{Path: path}
+		stat, err := os.Lstat(path)
+		if err != nil {
+			entry.Missing = true
+			entries = append(entries, entry)
+			continue
+		}
+		entry.Size = stat.Size()
+		entry.Mode = fmt.Sprintf("%04o", stat.Mode().Perm())
+		switch {
+		case stat.Mode().IsRegular():
+			entry.Type = "file"
+		case stat.IsDir():
+			entry.Type = "directory"
+		case stat.Mode()&os.ModeSymlink != 0:
+			entry.Type = "symlink"
+		default:
+			entry.Type = "other"
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Function to find the packages owning path. Package databases record paths as the
+// package shipped them, so a path under a symlinked directory, like /bin on merged-/usr
+// hosts, is looked up again with the symlinks resolved.
+func fileOwners(ctx context.Context, querier fileQuerier, path string) ([]string, string, error) {
+	owners, err := querier.FileOwners(ctx, path)
+	if err != nil || len(owners) > 0 {
+		return owners, "", err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil || resolved == path {
+		return nil, "", nil
+	}
+	owners, err = querier.FileOwners(ctx, resolved)
+	return owners, resolved, err
+}
+
+// Helper function to get the host's package manager as a fileQuerier, or respond with
+// why it can't be done
+func hostFileQuerier(c *gin.Context) (fileQuerier, bool) {
+	pm, err := hostPackageManager()
+	if errors.Is(err, errUnsupportedOS) {
+		c.JSON(400, gin.H{"error": "Unsupported operating system"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Unable to determine the operating system"})
+		return nil, false
+	}
+	querier, ok := pm.(fileQuerier)
+	if !ok {
+		c.JSON(400, gin.H{"error": "Package files can't be queried with " + pm.Name(), "code": "unsupported_operation"})
+		return nil, false
+	}
+	return querier, true
+}
+
+// Helper function to read the :name parameter, or respond that it isn't a package name
+func packageNameParam(c *gin.Context) (string, bool) {
+	name := c.Param("name")
+	if !packageFileName.MatchString(name) {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid package name %q", name), "code": "invalid_package_name"})
+		return "", false
+	}
+	return name, true
+}
+
+func registerPackageFileRoutes(r *gin.Engine) {
+	// Define the /packages/:name/files endpoint that lists the files a package installed
+	r.GET("/packages/:name/files", func(c *gin.Context) {
+		name, ok := packageNameParam(c)
+		if !ok {
+			return
+		}
+		querier, ok := hostFileQuerier(c)
+		if !ok {
+			return
+		}
+		files, err := packageFiles(c.Request.Context(), querier, name)
+		if err != nil {
+			respondFailure(c, "Failed to list the files of "+name, err)
+			return
+		}
+		c.JSON(200, gin.H{"package": name, "files": files})
+	})
+
+	// Define the /packages/:name/verify endpoint that compares a package's files with
+	// the package database
+	r.GET("/packages/:name/verify", func(c *gin.Context) {
+		name, ok := packageNameParam(c)
+		if !ok {
+			return
+		}
+		querier, ok := hostFileQuerier(c)
+		if !ok {
+			return
+		}
+		files, err := querier.VerifyFiles(c.Request.Context(), name)
+		if err != nil {
+			respondFailure(c, "Failed to verify "+name, err)
+			return
+		}
+		if files == nil {
+			files = []FileVerification{}
+		}
+		c.JSON(200, gin.H{"package": name, "ok": len(files) == 0, "files": files})
+	})
+
+	// Define the /files/owner endpoint that finds the package a file belongs to
+	r.GET("/files/owner", func(c *gin.Context) {
+		path := c.Query("path")
+		// dpkg -S reads its argument as a pattern
+		if !filepath.IsAbs(path) || strings.ContainsAny(path, "*?[]\\") {
+			c.JSON(400, gin.H{"error": "path must be an absolute path without wildcards"})
+			return
+		}
+		path = filepath.Clean(path)
+		querier, ok := hostFileQuerier(c)
+		if !ok {
+			return
+		}
+		owners, resolved, err := fileOwners(c.Request.Context(), querier, path)
+		if err != nil {
+			respondFailure(c, "Failed to look up the owner of "+path, err)
+			return
+		}
+		if len(owners) == 0 {
+			c.JSON(404, gin.H{"error": path + " is not owned by any package", "code": "file_not_owned"})
+			return
+		}
+		response := gin.H{"path": path, "packages": owners}
+		if resolved != "" {
+			response["resolved_path"] = resolved
+		}
+		c.JSON(200, response)
+	})
+}
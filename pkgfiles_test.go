@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Helper function to return the absolute path of a fixture, for fake commands to cat
+func pkgfilesFixturePath(t *testing.T, name string) string {
+	t.Helper()
+	path, err := filepath.Abs(filepath.Join("testdata", "pkgfiles", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseFileList(t *testing.T) {
+	// dpkg -L starts with the root and notes diversions after the paths
+	got := parseFileList(string(readFixture(t, "pkgfiles", "dpkg-listfiles.txt")))
+	if len(got) != 16 || got[0] != "/etc" || got[len(got)-1] != "/usr/share/man/man8/sshd.8.gz" {
+		t.Errorf("dpkg -L = %q", got)
+	}
+	got = parseFileList(string(readFixture(t, "pkgfiles", "rpm-list.txt")))
+	if len(got) != 9 || got[0] != "/etc/pam.d/sshd" || got[8] != "/var/empty/sshd" {
+		t.Errorf("rpm -ql = %q", got)
+	}
+	if got := parseFileList("(contains no files)\n"); len(got) != 0 {
+		t.Errorf("rpm -ql of a package without files = %q", got)
+	}
+	// Packages installed for two architectures list their shared files twice
+	if got := parseFileList("/usr/share/doc/libc6\n/usr/share/doc/libc6\n"); !reflect.DeepEqual(got, []string{"/usr/share/doc/libc6"}) {
+		t.Errorf("repeated paths = %q", got)
+	}
+}
+
+func TestParseVerifyOutput(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    []FileVerification
+	}{
+		// dpkg can only check the digest, so everything else is ?
+		{"dpkg-verify.txt", []FileVerification{
+			{Path: "/etc/ssh/sshd_config", Config: true, Flags: "??5??????", ChecksumMismatch: true},
+			{Path: "/usr/sbin/sshd", Flags: "??5??????", ChecksumMismatch: true},
+			{Path: "/usr/share/man/man8/sshd.8.gz", Missing: true},
+			{Path: "/etc/default/ssh", Config: true, Missing: true, Error: "Permission denied"},
+		}},
+		{"rpm-verify.txt", []FileVerification{
+			{Path: "/etc/ssh/sshd_config", Config: true, Flags: "S.5....T.", SizeChanged: true, ChecksumMismatch: true, MtimeChanged: true},
+			{Path: "/usr/libexec/openssh/sshd-keygen", Flags: ".M.......", ModeChanged: true},
+			{Path: "/usr/sbin/sshd", Flags: "SM5..UGT.", SizeChanged: true, ModeChanged: true, ChecksumMismatch: true, OwnerChanged: true, GroupChanged: true, MtimeChanged: true},
+			{Path: "/usr/lib/systemd/system/sshd@.service", Flags: "....L....", LinkChanged: true},
+			{Path: "/etc/sysconfig/sshd", Config: true, Missing: true},
+			{Path: "/usr/share/man/man8/sshd.8.gz", Missing: true},
+			// d marks documentation, which isn't configuration
+			{Path: "/usr/share/doc/openssh/README", Flags: ".......T.", MtimeChanged: true},
+		}},
+	}
+	for _, tt := range tests {
+		if got := parseVerifyOutput(string(readFixture(t, "pkgfiles", tt.fixture))); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n got %s\nwant %s", tt.fixture, toJSON(got), toJSON(tt.want))
+		}
+	}
+	if got := parseVerifyOutput("\nnot verify output\n"); len(got) != 0 {
+		t.Errorf("noise = %+v", got)
+	}
+}
+
+func TestParseDpkgSearch(t *testing.T) {
+	// The diversion lines name dash as the package that moved /bin/sh, and it also owns it
+	if got := parseDpkgSearch(string(readFixture(t, "pkgfiles", "dpkg-search.txt")), "/bin/sh"); !reflect.DeepEqual(got, []string{"dash"}) {
+		t.Errorf("diverted file = %q", got)
+	}
+	if got := parseDpkgSearch(string(readFixture(t, "pkgfiles", "dpkg-search-multiarch.txt")), "/usr/share/doc/libc6"); !reflect.DeepEqual(got, []string{"libc6:amd64", "libc6:i386"}) {
+		t.Errorf("multiarch file = %q", got)
+	}
+	// Only lines for the path asked about count
+	if got := parseDpkgSearch("kubelet: /usr/bin/kubelet-extra\n", "/usr/bin/kubelet"); len(got) != 0 {
+		t.Errorf("other path = %q", got)
+	}
+}
+
+func TestFileOwnersDpkg(t *testing.T) {
+	fakeCommand(t, "dpkg-query", `[ "$1" = --search ] || exit 2
+case "$2" in
+/bin/sh) cat `+pkgfilesFixturePath(t, "dpkg-search.txt")+` ;;
+/usr/share/doc/libc6) cat `+pkgfilesFixturePath(t, "dpkg-search-multiarch.txt")+` ;;
+*/real/kubelet) echo "kubelet: $2" ;;
+*) echo "dpkg-query: no path found matching pattern $2" >&2; exit 1 ;;
+esac`)
+	ctx := context.Background()
+
+	for path, want := range map[string][]string{
+		"/bin/sh":              {"dash"},
+		"/usr/share/doc/libc6": {"libc6:amd64", "libc6:i386"},
+		"/usr/local/bin/tool":  nil,
+	} {
+		owners, resolved, err := fileOwners(ctx, aptManager{}, path)
+		if err != nil || resolved != "" || !reflect.DeepEqual(owners, want) {
+			t.Errorf("fileOwners(%s) = %q, %q, %v, want %q", path, owners, resolved, err, want)
+		}
+	}
+
+	// A path through a symlinked directory, like /bin on merged-/usr hosts, is looked up
+	// again with the link resolved
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "real"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "real", "kubelet"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	owners, resolved, err := fileOwners(ctx, aptManager{}, filepath.Join(dir, "link", "kubelet"))
+	if err != nil || resolved != filepath.Join(dir, "real", "kubelet") || !reflect.DeepEqual(owners, []string{"kubelet"}) {
+		t.Errorf("fileOwners through a symlink = %q, %q, %v", owners, resolved, err)
+	}
+}
+
+func TestFileOwnersRPM(t *testing.T) {
+	fakeCommand(t, "rpm", `[ "$1 $2" = "--query --file" ] || exit 2
+case "$5" in
+/usr/lib/locale/C.utf8) cat `+pkgfilesFixturePath(t, "rpm-query-file-multilib.txt")+` ;;
+/usr/local/bin/tool) echo "file $5 is not owned by any package"; exit 1 ;;
+*) echo "error: file $5: No such file or directory" >&2; exit 1 ;;
+esac`)
+	ctx := context.Background()
+
+	for path, want := range map[string][]string{
+		"/usr/lib/locale/C.utf8": {"glibc-langpack-en"},
+		"/usr/local/bin/tool":    nil,
+		"/does/not/exist":        nil,
+	} {
+		owners, err := dnfManager{}.FileOwners(ctx, path)
+		if err != nil || !reflect.DeepEqual(owners, want) {
+			t.Errorf("FileOwners(%s) = %q, %v, want %q", path, owners, err, want)
+		}
+	}
+
+	// Any other failure is an error
+	fakeCommand(t, "rpm", `echo "error: rpmdb: BDB0113 Thread/process 1234 failed" >&2; exit 1`)
+	var cmdErr *commandError
+	if _, err := (dnfManager{}).FileOwners(ctx, "/usr/bin/ls"); !errors.As(err, &cmdErr) {
+		t.Errorf("FileOwners with a broken database = %v, want a command error", err)
+	}
+}
+
+func TestVerifyFiles(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		querier fileQuerier
+		command string
+		script  string
+	}{
+		{"dpkg", aptManager{}, "dpkg", `case "$3" in
+openssh-server) cat ` + pkgfilesFixturePath(t, "dpkg-verify.txt") + `; exit 1 ;;
+coreutils) ;;
+*) echo "dpkg: package '$3' is not installed" >&2; exit 1 ;;
+esac`},
+		{"rpm", dnfManager{}, "rpm", `case "$2" in
+openssh-server) cat ` + pkgfilesFixturePath(t, "rpm-verify.txt") + `; exit 1 ;;
+coreutils) ;;
+*) echo "package $2 is not installed"; exit 1 ;;
+esac`},
+	}
+	for _, tt := range tests {
+		fakeCommand(t, tt.command, tt.script)
+
+		// Both exit 1 when files differ, which isn't a failure
+		files, err := tt.querier.VerifyFiles(ctx, "openssh-server")
+		if err != nil || len(files) != len(parseVerifyOutput(string(readFixture(t, "pkgfiles", tt.name+"-verify.txt")))) {
+			t.Errorf("%s: VerifyFiles = %+v, %v", tt.name, files, err)
+		}
+		if files, err := tt.querier.VerifyFiles(ctx, "coreutils"); err != nil || len(files) != 0 {
+			t.Errorf("%s: VerifyFiles of an intact package = %+v, %v", tt.name, files, err)
+		}
+		var reqErr *requestError
+		if _, err := tt.querier.VerifyFiles(ctx, "not-a-package"); !errors.As(err, &reqErr) || reqErr.Code != "package_not_installed" {
+			t.Errorf("%s: VerifyFiles of a missing package = %v, want package_not_installed", tt.name, err)
+		}
+	}
+}
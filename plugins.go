@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Directory plugins are read from, the time a run gets, and the most JSON read from
+	// it, unless the plugins section says otherwise
+	defaultPluginDir      = "/etc/cosi/plugins"
+	defaultPluginTimeout  = 30 * time.Second
+	defaultPluginMaxBytes = 1 << 20
+	// Longest query parameter value passed to a plugin
+	maxPluginParamBytes = 1024
+)
+
+var (
+	// Plugin names are their file names, with no extension
+	pluginName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+	// Parameters a plugin or script may take, and the environment variables they are passed as
+	paramName    = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	paramEnvName = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+)
+
+// Environment variables a parameter can't set, because they change how the plugin or
+// script, or its interpreter, runs rather than what it is asked to do
+var reservedParamEnv = map[string]bool{
+	"PATH": true, "IFS": true, "ENV": true, "BASH_ENV": true, "SHELLOPTS": true,
+	"HOME": true, "LC_ALL": true, "LANG": true, "TERM": true, "NO_COLOR": true,
+	"COSI_PLUGIN": true, "COSI_SCRIPT": true,
+}
+
+// Helper function to check that a parameter may be passed in the environment variable env
+func paramEnvAllowed(env string) bool {
+	return paramEnvName.MatchString(env) && !reservedParamEnv[env] && !strings.HasPrefix(env, "LD_")
+}
+
+// PluginsConfig exposes executables in a directory as GET /plugins/:name. Plugins run
+// with the agent's privileges, so only the ones listed in Enabled are run.
+type PluginsConfig struct {
+	Dir            string        `yaml:"dir"`
+	Timeout        time.Duration `yaml:"timeout"`
+	MaxOutputBytes int64         `yaml:"max_output_bytes"`
+	// Enabled maps the names of the plugins that may run to their settings, which may be empty
+	Enabled map[string]PluginConfig `yaml:"enabled"`
+}
+
+// PluginConfig enables one plugin
+type PluginConfig struct {
+	// Timeout replaces plugins.timeout for this plugin
+	Timeout time.Duration `yaml:"timeout"`
+	// Params maps the query parameters the plugin takes to the environment variables
+	// they are passed in. Any other parameter is rejected.
+	Params map[string]string `yaml:"params"`
+	// SHA256 pins the plugin's file; a plugin whose hash differs isn't run
+	SHA256 string `yaml:"sha256"`
+}
+
+// Function to check the plugin settings
+func (p PluginsConfig) validate() error {
+	if p.Dir != "" && !filepath.IsAbs(p.Dir) {
+		return fmt.Errorf("plugins.dir must be an absolute path")
+	}
+	if p.Timeout < 0 || p.MaxOutputBytes < 0 {
+		return fmt.Errorf("plugins.timeout and plugins.max_output_bytes must not be negative")
+	}
+	for name, plugin := range p.Enabled {
+		if !pluginName.MatchString(name) {
+			return fmt.Errorf("plugins.enabled: %q is not a valid plugin name", name)
+		}
+		if plugin.Timeout < 0 {
+			return fmt.Errorf("plugins.enabled.%s.timeout must not be negative", name)
+		}
+		if plugin.SHA256 != "" {
+			if _, err := hex.DecodeString(plugin.SHA256); err != nil || len(plugin.SHA256) != 64 {
+				return fmt.Errorf("plugins.enabled.%s.sha256 must be a hex SHA-256 digest", name)
+			}
+		}
+		for param, env := range plugin.Params {
+			if !paramName.MatchString(param) {
+				return fmt.Errorf("plugins.enabled.%s.params: %q is not a valid parameter name", name, param)
+			}
+			if !paramEnvAllowed(env) {
+				return fmt.Errorf("plugins.enabled.%s.params.%s: %q can't be used as an environment variable", name, param, env)
+			}
+		}
+	}
+	return nil
+}
+
+func (p PluginsConfig) dir() string {
+	if p.Dir != "" {
+		return p.Dir
+	}
+	return defaultPluginDir
+}
+
+func (p PluginsConfig) timeout(name string) time.Duration {
+	if timeout := p.Enabled[name].Timeout; timeout > 0 {
+		return timeout
+	}
+	return time.Duration(orDefault(int64(p.Timeout), int64(defaultPluginTimeout)))
+}
+
+func (p PluginsConfig) maxOutputBytes() int64 {
+	return orDefault(p.MaxOutputBytes, defaultPluginMaxBytes)
+}
+
+// Plugin is an executable in the plugins directory, as listed by GET /plugins
+type Plugin struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Enabled bool      `json:"enabled"`
+	// Params are the query parameters the plugin takes
+	Params []string `json:"params,omitempty"`
+	// Problem is why the plugin can't run even when enabled, like a world-writable file
+	Problem string `json:"problem,omitempty"`
+	// Missing is set for an enabled plugin that isn't in the directory
+	Missing bool `json:"missing,omitempty"`
+}
+
+// PluginList is the response of GET /plugins
+type PluginList struct {
+	Dir     string   `json:"dir"`
+	Plugins []Plugin `json:"plugins"`
+}
+
+// Helper function to explain why an executable, or the directory holding it, can't be
+// trusted to run: anyone but root and the agent's user could change what it does
+func executableProblem(stat os.FileInfo) string {
+	if stat.Mode().Perm()&0022 != 0 {
+		return "writable by users other than its owner"
+	}
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok && sys.Uid != 0 && int(sys.Uid) != os.Geteuid() {
+		return fmt.Sprintf("owned by uid %d rather than root or the agent's user", sys.Uid)
+	}
+	return ""
+}
+
+// Function to describe the plugin name in dir, hashing its file. It returns an error
+// wrapping os.ErrNotExist when there is no such plugin.
+func inspectPlugin(dir, name string) (Plugin, error) {
+	plugin := Plugin{Name: name, Path: filepath.Join(dir, name)}
+	enabled, ok := currentConfig().Plugins.Enabled[name]
+	plugin.Enabled = ok
+	for param := range enabled.Params {
+		plugin.Params = append(plugin.Params, param)
+	}
+	sort.Strings(plugin.Params)
+
+	// A symlink is checked as the file it points to, which is what runs
+	stat, err := os.Stat(plugin.Path)
+	if err != nil {
+		return plugin, err
+	}
+	plugin.Size, plugin.ModTime = stat.Size(), stat.ModTime().UTC()
+	switch {
+	case !stat.Mode().IsRegular():
+		plugin.Problem = "not a regular file"
+		return plugin, nil
+	case stat.Mode().Perm()&0111 == 0:
+		plugin.Problem = "not executable"
+	default:
+		plugin.Problem = executableProblem(stat)
+	}
+	if dirStat, err := os.Stat(dir); err == nil && plugin.Problem == "" {
+		if problem := executableProblem(dirStat); problem != "" {
+			plugin.Problem = "the plugins directory is " + problem
+		}
+	}
+
+	file, err := os.Open(plugin.Path)
+	if err != nil {
+		plugin.Problem = err.Error()
+		return plugin, nil
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		plugin.Problem = err.Error()
+		return plugin, nil
+	}
+	plugin.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	if enabled.SHA256 != "" && !strings.EqualFold(enabled.SHA256, plugin.SHA256) && plugin.Problem == "" {
+		plugin.Problem = "the file doesn't match the sha256 pinned in the config"
+	}
+	return plugin, nil
+}
+
+// Function to list the plugins in the plugins directory, and the enabled ones missing
+// from it
+func listPlugins() (PluginList, error) {
+	cfg := currentConfig().Plugins
+	list := PluginList{Dir: cfg.dir(), Plugins: []Plugin{}}
+	entries, err := os.ReadDir(list.Dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return list, err
+	}
+	found := make(map[string]bool)
+	for _, entry := range entries {
+		// Leave out editor backups and package manager leftovers, like raid.dpkg-old
+		if !pluginName.MatchString(entry.Name()) {
+			continue
+		}
+		plugin, err := inspectPlugin(list.Dir, entry.Name())
+		if err != nil {
+			continue // removed while listing
+		}
+		found[plugin.Name] = true
+		list.Plugins = append(list.Plugins, plugin)
+	}
+	for name := range cfg.Enabled {
+		if !found[name] {
+			plugin, _ := inspectPlugin(list.Dir, name)
+			plugin.Missing = true
+			list.Plugins = append(list.Plugins, plugin)
+		}
+	}
+	sort.Slice(list.Plugins, func(i, j int) bool { return list.Plugins[i].Name < list.Plugins[j].Name })
+	return list, nil
+}
+
+// Function to turn the query of a plugin request into the environment variables its
+// config maps the parameters to
+func pluginParams(name string, query url.Values) ([]string, error) {
+	params := currentConfig().Plugins.Enabled[name].Params
+	var env []string
+	for param, values := range query {
+		variable, ok := params[param]
+		if !ok {
+			allowed := make([]string, 0, len(params))
+			for param := range params {
+				allowed = append(allowed, param)
+			}
+			sort.Strings(allowed)
+			return nil, &responseError{400, gin.H{"error": fmt.Sprintf("Plugin %s doesn't take the %s parameter", name, param), "code": "unknown_parameter", "params": allowed}}
+		}
+		if len(values) != 1 {
+			return nil, &requestError{400, "invalid_parameter", param + " must be given once"}
+		}
+		if len(values[0]) > maxPluginParamBytes || strings.ContainsRune(values[0], 0) {
+			return nil, &requestError{400, "invalid_parameter", fmt.Sprintf("%s must be at most %d bytes of text", param, maxPluginParamBytes)}
+		}
+		env = append(env, variable+"="+values[0])
+	}
+	sort.Strings(env)
+	return env, nil
+}
+
+// Function to run an enabled plugin and return the JSON it printed
+func runPlugin(ctx context.Context, name string, query url.Values) (json.RawMessage, Plugin, error) {
+	cfg := currentConfig().Plugins
+	plugin, err := inspectPlugin(cfg.dir(), name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, plugin, &requestError{404, "plugin_not_found", fmt.Sprintf("There is no plugin %s in %s", name, cfg.dir())}
+	}
+	if err != nil {
+		return nil, plugin, err
+	}
+	if !plugin.Enabled {
+		return nil, plugin, &requestError{403, "plugin_disabled", fmt.Sprintf("Plugin %s is not enabled; add it to plugins.enabled in the config", name)}
+	}
+	if plugin.Problem != "" {
+		return nil, plugin, &requestError{403, "plugin_rejected", fmt.Sprintf("Plugin %s can't be run: %s", name, plugin.Problem)}
+	}
+	env, err := pluginParams(name, query)
+	if err != nil {
+		return nil, plugin, err
+	}
+
+	timeout := cfg.timeout(name)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := newCommand(plugin.Path)
+	cmd.Env = append(append(cmd.Env, "COSI_PLUGIN="+name), env...)
+	cmd.Dir = "/"
+	stdout := &cappedBuffer{limit: cfg.maxOutputBytes()}
+	var stderr tailBuffer
+	stderr.limit = 4096
+	cmd.Stdout, cmd.Stderr = stdout, &stderr
+	err = runTrackedContext(ctx, cmd)
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return nil, plugin, &requestError{504, "plugin_timed_out", fmt.Sprintf("Plugin %s did not finish within %s", name, timeout)}
+	case stdout.exceeded:
+		return nil, plugin, &requestError{502, "plugin_output_too_large", fmt.Sprintf("Plugin %s printed more than %d bytes", name, cfg.maxOutputBytes())}
+	case err != nil:
+		exitCode := -1
+		if cmd.ProcessState != nil {
+			exitCode = cmd.ProcessState.ExitCode()
+		}
+		return nil, plugin, &responseError{502, gin.H{
+			"error":     fmt.Sprintf("Plugin %s failed: %v", name, err),
+			"code":      "plugin_failed",
+			"exit_code": exitCode,
+			"stderr":    strings.TrimSpace(stderr.String()),
+		}}
+	}
+
+	output := bytes.TrimSpace(stdout.Bytes())
+	if !json.Valid(output) {
+		return nil, plugin, &responseError{502, gin.H{
+			"error":  fmt.Sprintf("Plugin %s didn't print valid JSON", name),
+			"code":   "plugin_invalid_output",
+			"stderr": strings.TrimSpace(stderr.String()),
+		}}
+	}
+	return output, plugin, nil
+}
+
+// Function to register the /plugins endpoints
+func registerPluginRoutes(r *gin.Engine) {
+	// Define the /plugins endpoint that lists the plugins and whether they may run
+	r.GET("/plugins", func(c *gin.Context) {
+		list, err := listPlugins()
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Unable to read the plugins directory: " + err.Error()})
+			return
+		}
+		c.JSON(200, list)
+	})
+
+	// Define the /plugins/:name endpoint that runs an enabled plugin and relays its JSON
+	r.GET("/plugins/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		if !pluginName.MatchString(name) {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid plugin name %q", name), "code": "invalid_plugin_name"})
+			return
+		}
+		started := time.Now()
+		output, plugin, err := runPlugin(c.Request.Context(), name, c.Request.URL.Query())
+		details := map[string]interface{}{"plugin": name, "sha256": plugin.SHA256, "duration_ms": time.Since(started).Milliseconds()}
+		if query := c.Request.URL.Query(); len(query) > 0 {
+			details["params"] = query
+		}
+		audit.Record(auditOutcome("plugins.run", c.ClientIP(), details, err))
+		if err != nil {
+			respondFailure(c, "Failed to run plugin "+name, err)
+			return
+		}
+		c.Data(200, "application/json; charset=utf-8", output)
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Packages explicitly installed on Gentoo, one atom per line
+const portageWorldFile = "/var/lib/portage/world"
+
+// Version at the end of a Gentoo atom, like the 1.2.3-r1 of dev-lang/foo-1.2.3-r1
+var portageVersioned = regexp.MustCompile(`^(.+?)-(\d[^-/]*(?:-r\d+)?)$`)
+
+// portageManager drives emerge on Gentoo. Packages are named by category/name atoms
+// like app-editors/vim.
+type portageManager struct{}
+
+func (portageManager) Name() string { return "portage" }
+
+func (portageManager) PrivilegedTools() []string { return []string{"emerge"} }
+
+func (portageManager) InstallCommand(config PackageConfig) *exec.Cmd {
+	if len(config.Packages.Installed) == 0 {
+		return nil
+	}
+	// --noreplace keeps emerge from rebuilding packages that are already installed
+	return newPrivilegedCommand(nil, "emerge", append([]string{"--ask=n", "--quiet-build=y", "--noreplace"}, config.Packages.Installed...)...)
+}
+
+// RemoveCommand only drops the packages from the world set; CleanupCommand then
+// unmerges them, unless other installed packages still depend on them
+func (portageManager) RemoveCommand(config PackageConfig) *exec.Cmd {
+	if len(config.Packages.Uninstalled) == 0 {
+		return nil
+	}
+	return newPrivilegedCommand(nil, "emerge", append([]string{"--ask=n", "--deselect"}, config.Packages.Uninstalled...)...)
+}
+
+func (portageManager) SupportedOptions() []string {
+	return []string{"autoremove"}
+}
+
+// AutoremoveCommand runs a full depclean, which unmerges every package outside the world set
+// that nothing depends on
+func (portageManager) AutoremoveCommand(config PackageConfig) *exec.Cmd {
+	return newPrivilegedCommand(nil, "emerge", "--ask=n", "--depclean")
+}
+
+func (portageManager) CleanupCommand(config PackageConfig) *exec.Cmd {
+	if len(config.Packages.Uninstalled) == 0 {
+		return nil
+	}
+	return newPrivilegedCommand(nil, "emerge", append([]string{"--ask=n", "--depclean"}, config.Packages.Uninstalled...)...)
+}
+
+func (portageManager) ListCommand() *exec.Cmd {
+	return newCommand("qlist", "-I")
+}
+
+func (portageManager) DatabasePaths() []string {
+	// /var/db/pkg gets a directory per installed category
+	return []string{"/var/db/pkg", portageWorldFile}
+}
+
+func (portageManager) RefreshCommand() *exec.Cmd {
+	return newPrivilegedCommand(nil, "emerge", "--sync", "--quiet")
+}
+
+func (portageManager) RepairCommands() []*exec.Cmd {
+	// emaint cleans up failed merges, the resume list, and the world file
+	return []*exec.Cmd{newPrivilegedCommand(nil, "emaint", "--fix", "all")}
+}
+
+func (portageManager) ManualCommand() *exec.Cmd {
+	return newCommand("cat", portageWorldFile)
+}
+
+func (portageManager) VersionsCommand() *exec.Cmd {
+	return newCommand("qlist", "-I", "-F", "%{CATEGORY}/%{PN} %{PVR} installed")
+}
+
+func (portageManager) PinnedSpec(name, version string) string {
+	return "=" + name + "-" + version
+}
+
+func (portageManager) ParseSpec(spec string) (string, string) {
+	return parsePortageSpec(spec)
+}
+
+func (portageManager) Candidates(ctx context.Context, names []string) (map[string]string, error) {
+	// portageq takes one atom at a time and prints nothing for unknown packages
+	candidates := make(map[string]string)
+	for _, name := range names {
+		cmd := newCommand("portageq", "best_visible", "/", name)
+		result, err := runCommandContext(ctx, cmd)
+		if err != nil && result.ExitCode != 1 {
+			return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+		}
+		if match := portageVersioned.FindStringSubmatch(strings.TrimSpace(result.Stdout)); match != nil {
+			candidates[name] = match[2]
+		}
+	}
+	return candidates, nil
+}
+
+func (portageManager) AvailableVersions(ctx context.Context, names []string) (map[string][]string, error) {
+	cmd := newCommand("portageq", "get_repo_path", "/", "--all")
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		// Older portage has no --all; the main tree is still in the default place
+		result.Stdout = "/var/db/repos/gentoo\n/usr/portage\n"
+	}
+
+	// Every ebuild in the repositories is a version that can be installed
+	versions := make(map[string][]string)
+	for _, repo := range strings.Fields(result.Stdout) {
+		for _, name := range names {
+			atom := name
+			if !strings.Contains(atom, "/") {
+				atom = "*/" + atom
+			}
+			pn := filepath.Base(atom)
+			ebuilds, _ := filepath.Glob(filepath.Join(repo, atom, pn+"-*.ebuild"))
+			for _, ebuild := range ebuilds {
+				version := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(ebuild), pn+"-"), ".ebuild")
+				if version != "" && version[0] >= '0' && version[0] <= '9' {
+					versions[name] = append(versions[name], version)
+				}
+			}
+		}
+	}
+	return versions, nil
+}
+
+// InstalledKernels lists the module directories, since Gentoo kernels are often built
+// by hand rather than installed as packages
+func (portageManager) InstalledKernels(ctx context.Context) ([]string, error) {
+	return moduleKernels()
+}
+
+// CheckReboot has nothing to add on Gentoo, which keeps no reboot-required marker
+func (portageManager) CheckReboot(ctx context.Context, status *RebootStatus) error {
+	return nil
+}
+
+// Helper function to split a versioned atom like =app-editors/vim-9.0.1-r1 into the
+// package and its version. Atoms without an operator name the package alone.
+func parsePortageSpec(spec string) (string, string) {
+	atom := strings.TrimLeft(spec, "<>=~")
+	if atom == spec {
+		return spec, ""
+	}
+	if match := portageVersioned.FindStringSubmatch(strings.TrimSuffix(atom, "*")); match != nil {
+		return match[1], match[2]
+	}
+	return atom, ""
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File where systemd-logind keeps a shutdown scheduled with `shutdown +N`
+const scheduledShutdownFile = "/run/systemd/shutdown/scheduled"
+
+// Delay before an immediate reboot or shutdown fires, so the HTTP response gets out first
+const immediatePowerDelay = time.Second
+
+// PowerRequest is the body of POST /power/reboot and POST /power/shutdown
+type PowerRequest struct {
+	DelaySeconds int    `json:"delay_seconds"`
+	Message      string `json:"message"`
+	Confirm      bool   `json:"confirm"`
+	// DrainFirst drains the node with the Drain options before the action is scheduled
+	DrainFirst bool         `json:"drain_first"`
+	Drain      DrainRequest `json:"drain"`
+}
+
+// PendingPowerAction is a scheduled reboot or shutdown
+type PendingPowerAction struct {
+	Action       string    `json:"action"` // reboot or poweroff
+	ScheduledFor time.Time `json:"scheduled_for"`
+	Message      string    `json:"message,omitempty"`
+}
+
+var (
+	// An immediate action waiting for immediatePowerDelay; scheduled ones live in systemd.
+	// The timer is nil once the action has fired and can no longer be cancelled.
+	immediatePowerMu    sync.Mutex
+	immediatePower      *PendingPowerAction
+	immediatePowerTimer *time.Timer
+)
+
+// Function to report the pending reboot or shutdown, if any
+func pendingPowerAction() (*PendingPowerAction, error) {
+	immediatePowerMu.Lock()
+	pending := immediatePower
+	immediatePowerMu.Unlock()
+	if pending != nil {
+		return pending, nil
+	}
+
+	file, err := os.Open(scheduledShutdownFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	action := &PendingPowerAction{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "USEC":
+			usec, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", scheduledShutdownFile, err)
+			}
+			action.ScheduledFor = time.UnixMicro(usec).UTC()
+		case "MODE":
+			action.Action = value
+		case "WALL_MESSAGE":
+			action.Message = value
+		}
+	}
+	return action, scanner.Err()
+}
+
+// Function to reboot or power off the host. Without a delay the action fires shortly
+// after returning; otherwise it is scheduled with `shutdown +minutes` so users get wall
+// messages and it can be cancelled.
+func schedulePowerAction(action string, request PowerRequest) (*PendingPowerAction, error) {
+	if request.DelaySeconds == 0 {
+		pending := &PendingPowerAction{
+			Action:       action,
+			ScheduledFor: time.Now().Add(immediatePowerDelay).UTC(),
+			Message:      request.Message,
+		}
+		immediatePowerMu.Lock()
+		defer immediatePowerMu.Unlock()
+		if immediatePowerTimer != nil {
+			immediatePowerTimer.Stop()
+		}
+		immediatePower = pending
+		immediatePowerTimer = time.AfterFunc(immediatePowerDelay, func() {
+			// A cancel or a newer action may have replaced this one while the timer fired
+			immediatePowerMu.Lock()
+			if immediatePower != pending {
+				immediatePowerMu.Unlock()
+				return
+			}
+			immediatePowerTimer = nil
+			immediatePowerMu.Unlock()
+
+			args := []string{action}
+			if request.Message != "" {
+				args = append(args, "--message="+request.Message)
+			}
+			if result, err := runCommand(newPrivilegedCommand(nil, "systemctl", args...)); err != nil {
+				log.Printf("systemctl %s failed: %v: %s", action, err, result.Output)
+				immediatePowerMu.Lock()
+				if immediatePower == pending {
+					immediatePower = nil
+				}
+				immediatePowerMu.Unlock()
+			}
+		})
+		return pending, nil
+	}
+
+	// shutdown only schedules in whole minutes, so round the delay up
+	minutes := (request.DelaySeconds + 59) / 60
+	flag := "-r"
+	if action == "poweroff" {
+		flag = "-P"
+	}
+	args := []string{flag, "+" + strconv.Itoa(minutes)}
+	if request.Message != "" {
+		args = append(args, request.Message)
+	}
+	cmd := newPrivilegedCommand(nil, "shutdown", args...)
+	if result, err := runCommand(cmd); err != nil {
+		return nil, &commandError{Tool: "shutdown", Result: result, Err: err}
+	}
+
+	pending, err := pendingPowerAction()
+	if err != nil || pending == nil {
+		// Older systemd doesn't expose the schedule; report what was asked for
+		pending = &PendingPowerAction{
+			Action:       action,
+			ScheduledFor: time.Now().Add(time.Duration(minutes) * time.Minute).UTC(),
+			Message:      request.Message,
+		}
+	}
+	return pending, nil
+}
+
+// Function to cancel a pending reboot or shutdown. An immediate one can only be
+// cancelled before its delay is up; after that systemctl is already running it.
+func cancelPowerAction() error {
+	immediatePowerMu.Lock()
+	pending, timer := immediatePower, immediatePowerTimer
+	if pending != nil && timer != nil {
+		timer.Stop()
+		immediatePower, immediatePowerTimer = nil, nil
+	}
+	immediatePowerMu.Unlock()
+	if pending != nil {
+		if timer == nil {
+			return &requestError{409, "power_action_started", "The " + pending.Action + " has already started"}
+		}
+		return nil
+	}
+
+	cmd := newPrivilegedCommand(nil, "shutdown", "-c")
+	if result, err := runCommand(cmd); err != nil {
+		return &commandError{Tool: "shutdown", Result: result, Err: err}
+	}
+	return nil
+}
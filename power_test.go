@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Helper function to fake systemctl, returning the file it records its arguments in
+func fakeSystemctl(t *testing.T) string {
+	t.Helper()
+	calls := filepath.Join(t.TempDir(), "systemctl.calls")
+	fakeCommand(t, "systemctl", `echo "$@" >> `+calls)
+	t.Cleanup(func() {
+		immediatePowerMu.Lock()
+		if immediatePowerTimer != nil {
+			immediatePowerTimer.Stop()
+		}
+		immediatePower, immediatePowerTimer = nil, nil
+		immediatePowerMu.Unlock()
+	})
+	return calls
+}
+
+func TestCancelImmediatePowerAction(t *testing.T) {
+	calls := fakeSystemctl(t)
+
+	if _, err := schedulePowerAction("reboot", PowerRequest{Message: "kernel update"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cancelPowerAction(); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	time.Sleep(immediatePowerDelay + 500*time.Millisecond)
+
+	if data, err := os.ReadFile(calls); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("systemctl ran after the reboot was cancelled: %q", data)
+	}
+	immediatePowerMu.Lock()
+	pending := immediatePower
+	immediatePowerMu.Unlock()
+	if pending != nil {
+		t.Errorf("cancelled reboot is still pending: %+v", pending)
+	}
+}
+
+func TestImmediatePowerActionFires(t *testing.T) {
+	calls := fakeSystemctl(t)
+
+	if _, err := schedulePowerAction("poweroff", PowerRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(immediatePowerDelay + 2*time.Second)
+	var data []byte
+	for time.Now().Before(deadline) {
+		if data, _ = os.ReadFile(calls); len(data) > 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if string(data) != "poweroff\n" {
+		t.Fatalf("systemctl calls = %q, want poweroff", data)
+	}
+
+	// Once systemctl runs it is too late to cancel
+	var reqErr *requestError
+	if err := cancelPowerAction(); !errors.As(err, &reqErr) || reqErr.Status != 409 {
+		t.Errorf("cancel after firing = %v, want a 409", err)
+	}
+}
+
+func TestPowerActionReplacedBeforeFiring(t *testing.T) {
+	calls := fakeSystemctl(t)
+
+	if _, err := schedulePowerAction("poweroff", PowerRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := schedulePowerAction("reboot", PowerRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(immediatePowerDelay + 500*time.Millisecond)
+	if data, _ := os.ReadFile(calls); string(data) != "reboot\n" {
+		t.Errorf("systemctl calls = %q, want only the reboot", data)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+)
+
+// sudoMode is set by --sudo: commands that need root are run through `sudo -n`
+// when the agent itself is not running as root
+var sudoMode bool
+
+// Function to check if the agent is running as root
+func isRoot() bool {
+	return os.Geteuid() == 0
+}
+
+// Helper function to create a command that needs root privileges. When the agent is
+// unprivileged and sudo mode is enabled the command is escalated with `sudo -n` so a
+// missing sudoers rule fails immediately instead of waiting for a password.
+func newPrivilegedCommand(env []string, name string, args ...string) *exec.Cmd {
+	return newPrivilegedCommandContext(context.Background(), env, name, args...)
+}
+
+// Helper function to build a command like newPrivilegedCommand that is killed when ctx is done
+func newPrivilegedCommandContext(ctx context.Context, env []string, name string, args ...string) *exec.Cmd {
+	if isRoot() || !sudoMode {
+		cmd := newCommandContext(ctx, name, args...)
+		cmd.Env = append(cmd.Env, env...)
+		return cmd
+	}
+
+	// sudo resets the environment, so the variables are passed as arguments (needs SETENV)
+	sudoArgs := []string{"-n"}
+	sudoArgs = append(sudoArgs, commandEnv...)
+	sudoArgs = append(sudoArgs, proxyEnv()...)
+	sudoArgs = append(sudoArgs, env...)
+	sudoArgs = append(sudoArgs, name)
+	cmd := newCommandContext(ctx, "sudo", append(sudoArgs, colorlessArgs(name, args)...)...)
+	cmd.Env = append(cmd.Env, env...)
+	return cmd
+}
+
+// Function to check if a privileged tool can be run under the current privileges
+func canRunPrivileged(tool string) bool {
+	if isRoot() {
+		return true
+	}
+	if !sudoMode {
+		return false
+	}
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return false
+	}
+	// `sudo -l <command>` succeeds only when the command is allowed, and -n fails instead of prompting
+	return runTracked(newCommand("sudo", "-n", "-l", path)) == nil
+}
+
+// Helper function to build the sudoers line that grants the agent user the given tools
+func sudoersLine(tools ...string) string {
+	username := "cosi"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+
+	paths := make([]string, 0, len(tools))
+	for _, tool := range tools {
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			path = "/usr/bin/" + tool
+		}
+		paths = append(paths, path)
+	}
+	return fmt.Sprintf("%s ALL=(root) NOPASSWD:SETENV: %s", username, strings.Join(paths, ", "))
+}
+
+// Helper function to check if a command failed because sudo wanted a password
+func isSudoPasswordFailure(result CommandResult) bool {
+	return strings.Contains(result.Stderr, "sudo: a password is required") ||
+		strings.Contains(result.Stderr, "sudo: a terminal is required")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// ProxyConfig routes the agent's outbound HTTP through a proxy. Settings left out fall
+// back to the standard http_proxy, https_proxy, and no_proxy environment variables.
+type ProxyConfig struct {
+	HTTPProxy  string `yaml:"http_proxy"`
+	HTTPSProxy string `yaml:"https_proxy"`
+	NoProxy    string `yaml:"no_proxy"`
+}
+
+// Function to check the proxy settings
+func (p ProxyConfig) validate() error {
+	for name, value := range map[string]string{"proxy.http_proxy": p.HTTPProxy, "proxy.https_proxy": p.HTTPSProxy} {
+		if value == "" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+			return fmt.Errorf("%s must be an http, https, or socks5 URL", name)
+		}
+	}
+	return nil
+}
+
+// Function to merge the configured proxy settings over the environment's
+func (p ProxyConfig) effective() *httpproxy.Config {
+	proxy := httpproxy.FromEnvironment()
+	if p.HTTPProxy != "" {
+		proxy.HTTPProxy = p.HTTPProxy
+	}
+	if p.HTTPSProxy != "" {
+		proxy.HTTPSProxy = p.HTTPSProxy
+	}
+	if p.NoProxy != "" {
+		proxy.NoProxy = p.NoProxy
+	}
+	return proxy
+}
+
+// Function to pick the proxy of an outbound request from the active configuration, so a
+// reload applies to the next request. Loopback addresses are never proxied.
+func agentProxy(req *http.Request) (*url.URL, error) {
+	return currentConfig().Proxy.effective().ProxyFunc()(req.URL)
+}
+
+// Helper function to build a transport for the agent's own downloads and deliveries
+func proxiedTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = agentProxy
+	return transport
+}
+
+// Function to list the proxy variables for the commands the agent runs: curl, kubectl,
+// and the package managers. apt and dnf prefer a proxy set in their own configuration,
+// so a host that already has one keeps using it.
+func proxyEnv() []string {
+	proxy := currentConfig().Proxy.effective()
+	var env []string
+	for _, variable := range []struct{ name, value string }{
+		{"http_proxy", proxy.HTTPProxy},
+		{"https_proxy", proxy.HTTPSProxy},
+		{"no_proxy", proxy.NoProxy},
+	} {
+		if variable.value != "" {
+			// Tools disagree on the case they read, so both are set
+			env = append(env, variable.name+"="+variable.value, strings.ToUpper(variable.name)+"="+variable.value)
+		}
+	}
+	return env
+}
+
+// ProxyReport is the effective proxy configuration in GET /capabilities, with passwords
+// replaced by a placeholder
+type ProxyReport struct {
+	HTTPProxy  string `json:"http_proxy,omitempty"`
+	HTTPSProxy string `json:"https_proxy,omitempty"`
+	NoProxy    string `json:"no_proxy,omitempty"`
+	// Source is config when the config file sets any of the settings, environment otherwise
+	Source string `json:"source"`
+}
+
+// Function to report the effective proxy configuration, or nil when there is none
+func proxyReport() *ProxyReport {
+	configured := currentConfig().Proxy
+	proxy := configured.effective()
+	if proxy.HTTPProxy == "" && proxy.HTTPSProxy == "" {
+		return nil
+	}
+	report := &ProxyReport{HTTPProxy: redactProxy(proxy.HTTPProxy), HTTPSProxy: redactProxy(proxy.HTTPSProxy), NoProxy: proxy.NoProxy, Source: "environment"}
+	if configured != (ProxyConfig{}) {
+		report.Source = "config"
+	}
+	return report
+}
+
+// Helper function to hide the password of a proxy URL
+func redactProxy(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
+
+// Function to check that target can be fetched through the configured proxy. Any HTTP
+// response counts, as for the http probes.
+func probeThroughProxy(ctx context.Context, target string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	transport := proxiedTransport()
+	transport.DisableKeepAlives = true
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("User-Agent", "cosi/"+version)
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Files written by update-notifier/unattended-upgrades on Debian-family hosts
+const (
+	rebootRequiredFile     = "/var/run/reboot-required"
+	rebootRequiredPkgsFile = "/var/run/reboot-required.pkgs"
+)
+
+// RebootStatus is the response of GET /power/reboot-required
+type RebootStatus struct {
+	RebootRequired bool           `json:"reboot_required"`
+	Reasons        []RebootReason `json:"reasons"`
+	Packages       []string       `json:"packages,omitempty"`
+	RunningKernel  string         `json:"running_kernel"`
+	NewestKernel   string         `json:"newest_kernel,omitempty"`
+	// Services that could be restarted instead of rebooting for non-kernel updates
+	Services       []string `json:"services_to_restart"`
+	ServicesSource string   `json:"services_source,omitempty"`
+}
+
+// RebootReason explains one reason a reboot is needed
+type RebootReason struct {
+	Type   string `json:"type"` // kernel, libc, or packages
+	Detail string `json:"detail"`
+}
+
+// Function to check if the host needs a reboot and which services could be restarted instead
+func rebootRequired(ctx context.Context, pm packageManager) (*RebootStatus, error) {
+	status := &RebootStatus{Reasons: []RebootReason{}, Services: []string{}}
+
+	running, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return nil, err
+	}
+	status.RunningKernel = strings.TrimSpace(string(running))
+
+	kernels, err := pm.InstalledKernels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, kernel := range kernels {
+		if status.NewestKernel == "" || compareNatural(kernel, status.NewestKernel) > 0 {
+			status.NewestKernel = kernel
+		}
+	}
+	if status.NewestKernel != "" && status.NewestKernel != status.RunningKernel {
+		status.addReason("kernel", "running "+status.RunningKernel+" but "+status.NewestKernel+" is installed")
+	}
+
+	if err := pm.CheckReboot(ctx, status); err != nil {
+		return nil, err
+	}
+	status.RebootRequired = len(status.Reasons) > 0
+	return status, nil
+}
+
+// Helper function to add a reason, skipping duplicates of the same type
+func (s *RebootStatus) addReason(reasonType, detail string) {
+	for _, reason := range s.Reasons {
+		if reason.Type == reasonType {
+			return
+		}
+	}
+	s.Reasons = append(s.Reasons, RebootReason{Type: reasonType, Detail: detail})
+}
+
+// Helper function to classify a package that asked for a reboot
+func rebootReasonType(pkg string) string {
+	switch {
+	case strings.HasPrefix(pkg, "linux-image") || pkg == "kernel" || strings.HasPrefix(pkg, "kernel-"):
+		return "kernel"
+	case pkg == "libc6" || pkg == "glibc":
+		return "libc"
+	}
+	return "packages"
+}
+
+func (aptManager) InstalledKernels(ctx context.Context) ([]string, error) {
+	cmd := newCommand("dpkg-query", "-W", "-f=${Package} ${db:Status-Status}\n", "linux-image-[0-9]*")
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil && result.ExitCode != 1 { // 1 means no kernel packages matched, e.g. in containers
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	var kernels []string
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == "installed" {
+			kernels = append(kernels, strings.TrimPrefix(fields[0], "linux-image-"))
+		}
+	}
+	return kernels, nil
+}
+
+func (aptManager) CheckReboot(ctx context.Context, status *RebootStatus) error {
+	if _, err := os.Stat(rebootRequiredFile); err == nil {
+		packages, err := readLines(rebootRequiredPkgsFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		status.Packages = packages
+		for _, pkg := range packages {
+			status.addReason(rebootReasonType(pkg), rebootRequiredPkgsFile+" lists "+pkg)
+		}
+		if len(packages) == 0 {
+			status.addReason("packages", rebootRequiredFile+" exists")
+		}
+	}
+
+	// needrestart -b prints "NEEDRESTART-SVC: <unit>" for every service using stale libraries
+	if _, err := exec.LookPath("needrestart"); err == nil {
+		result, err := runCommandContext(ctx, newPrivilegedCommand(nil, "needrestart", "-b"))
+		if err == nil {
+			status.ServicesSource = "needrestart"
+			for _, line := range strings.Split(result.Stdout, "\n") {
+				if unit, ok := strings.CutPrefix(line, "NEEDRESTART-SVC: "); ok {
+					status.Services = append(status.Services, strings.TrimSpace(unit))
+				}
+			}
+			return nil
+		}
+	}
+	// checkrestart (debian-goodies) suggests "service <name> restart" commands
+	if _, err := exec.LookPath("checkrestart"); err == nil {
+		result, err := runCommandContext(ctx, newPrivilegedCommand(nil, "checkrestart"))
+		if err == nil {
+			status.ServicesSource = "checkrestart"
+			for _, match := range checkrestartService.FindAllStringSubmatch(result.Stdout, -1) {
+				status.Services = append(status.Services, match[1])
+			}
+		}
+	}
+	return nil
+}
+
+var checkrestartService = regexp.MustCompile(`(?m)^\s*(?:service|systemctl restart) (\S+)(?: restart)?\s*$`)
+
+func (dnfManager) InstalledKernels(ctx context.Context) ([]string, error) {
+	cmd := newCommand("rpm", "-q", "kernel", "kernel-core", "--qf", "%{VERSION}-%{RELEASE}.%{ARCH}\n")
+	result, err := runCommandContext(ctx, cmd)
+	var kernels []string
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		// rpm prints "package kernel is not installed" to stdout for the name that's missing
+		if line = strings.TrimSpace(line); line != "" && !strings.Contains(line, " ") {
+			kernels = append(kernels, line)
+		}
+	}
+	if err != nil && len(kernels) == 0 && result.ExitCode != 1 {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	return kernels, nil
+}
+
+func (m dnfManager) CheckReboot(ctx context.Context, status *RebootStatus) error {
+	// needs-restarting -r exits 1 when a reboot is needed and lists the updated core
+	// packages. yum-utils ships it as a command of its own.
+	needsRestarting := func(privileged bool, args ...string) *exec.Cmd {
+		name, args := "dnf", append([]string{"needs-restarting"}, args...)
+		if m.Yum {
+			name, args = "needs-restarting", args[1:]
+		}
+		if privileged {
+			return newPrivilegedCommand(nil, name, args...)
+		}
+		return newCommand(name, args...)
+	}
+	cmd := needsRestarting(false, "-r")
+	result, err := runCommandContext(ctx, cmd)
+	switch {
+	case err == nil:
+	case result.ExitCode == 1:
+		for _, line := range strings.Split(result.Stdout, "\n") {
+			// dnf lists "* kernel", yum-utils "  kernel -> 4.14.355-..."
+			pkg, ok := strings.CutPrefix(strings.TrimSpace(line), "* ")
+			if before, _, found := strings.Cut(line, " -> "); !ok && found {
+				pkg, ok = strings.TrimSpace(before), true
+			}
+			if ok {
+				status.Packages = append(status.Packages, pkg)
+				status.addReason(rebootReasonType(pkg), "needs-restarting reports "+pkg+" was updated")
+			}
+		}
+		if len(status.Packages) == 0 {
+			status.addReason("packages", "needs-restarting reports a reboot is needed")
+		}
+	default:
+		return &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+
+	if result, err := runCommandContext(ctx, needsRestarting(true, "-s")); err == nil {
+		status.ServicesSource = "needs-restarting"
+		for _, line := range strings.Split(result.Stdout, "\n") {
+			if unit := strings.TrimSpace(line); unit != "" {
+				status.Services = append(status.Services, unit)
+			}
+		}
+	}
+	return nil
+}
+
+// Helper function to list the kernel releases that have modules installed
+func moduleKernels() ([]string, error) {
+	entries, err := os.ReadDir("/lib/modules")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var kernels []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			kernels = append(kernels, entry.Name())
+		}
+	}
+	return kernels, nil
+}
+
+// Helper function to read the non-empty lines of a file
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// Function to compare version-like strings, treating runs of digits as numbers
+// so that 6.1.0-13 sorts after 6.1.0-9
+func compareNatural(a, b string) int {
+	for a != "" && b != "" {
+		aNum, bNum := unicode.IsDigit(rune(a[0])), unicode.IsDigit(rune(b[0]))
+		aRun, aRest := splitRun(a, aNum)
+		bRun, bRest := splitRun(b, bNum)
+		switch {
+		case aNum && bNum:
+			x, _ := strconv.ParseUint(aRun, 10, 64)
+			y, _ := strconv.ParseUint(bRun, 10, 64)
+			if x != y {
+				if x < y {
+					return -1
+				}
+				return 1
+			}
+		case aRun != bRun:
+			return strings.Compare(aRun, bRun)
+		}
+		a, b = aRest, bRest
+	}
+	return strings.Compare(a, b)
+}
+
+// Helper function to split off the leading run of digits or non-digits
+func splitRun(s string, digits bool) (string, string) {
+	i := 0
+	for i < len(s) && unicode.IsDigit(rune(s[i])) == digits {
+		i++
+	}
+	return s[:i], s[i:]
+}
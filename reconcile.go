@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// First retry delay after a failed cycle, doubled on every further failure
+	reconcileRetryBase = 30 * time.Second
+	reconcileRetryMax  = time.Hour
+)
+
+// ReconcileStatus reports the state of the pull-based reconciliation loop
+type ReconcileStatus struct {
+	Enabled             bool         `json:"enabled"`
+	SourceURL           string       `json:"source_url,omitempty"`
+	Interval            string       `json:"interval,omitempty"`
+	Running             bool         `json:"running"`
+	LastFetch           *time.Time   `json:"last_fetch,omitempty"`
+	ManifestHash        string       `json:"manifest_hash,omitempty"`
+	LastRun             *time.Time   `json:"last_run,omitempty"`
+	LastResult          string       `json:"last_result,omitempty"` // in_sync, applied, or failed
+	LastError           string       `json:"last_error,omitempty"`
+	DriftDetected       bool         `json:"drift_detected"`
+	LastDiff            *PackageDiff `json:"last_diff,omitempty"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	NextRun             *time.Time   `json:"next_run,omitempty"`
+}
+
+// reconciler periodically converges the installed packages on a remote manifest
+type reconciler struct {
+	cfg    ReconcileConfig
+	client *http.Client
+
+	// cycle is held for the duration of a reconcile cycle
+	cycle sync.Mutex
+
+	mu           sync.Mutex
+	status       ReconcileStatus
+	etag         string
+	lastModified string
+	manifest     *PackageConfig
+}
+
+var reconcileLoop *reconciler
+
+func newReconciler(cfg ReconcileConfig) *reconciler {
+	return &reconciler{
+		cfg:    cfg,
+		client: manifestClient,
+		status: ReconcileStatus{
+			Enabled:   true,
+			SourceURL: cfg.SourceURL,
+			Interval:  cfg.Interval.String(),
+		},
+	}
+}
+
+// Status returns a copy of the current status
+func (r *reconciler) Status() ReconcileStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// Start runs reconcile cycles forever, backing off exponentially after failures
+func (r *reconciler) Start() {
+	go func() {
+		for {
+			delay := r.cfg.Interval
+			if err := r.Run(); err != nil {
+				log.Printf("Reconcile failed: %v", err)
+				failures := r.Status().ConsecutiveFailures
+				delay = reconcileRetryBase << (failures - 1)
+				if delay > reconcileRetryMax || delay <= 0 {
+					delay = reconcileRetryMax
+				}
+			}
+
+			next := time.Now().Add(delay)
+			r.mu.Lock()
+			r.status.NextRun = &next
+			r.mu.Unlock()
+			time.Sleep(delay)
+		}
+	}()
+}
+
+// Run performs one reconcile cycle: fetch, diff, and apply the differences
+func (r *reconciler) Run() error {
+	r.cycle.Lock()
+	defer r.cycle.Unlock()
+
+	r.mu.Lock()
+	r.status.Running = true
+	r.mu.Unlock()
+
+	diff, applied, err := r.reconcile()
+
+	now := time.Now().UTC()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.Running = false
+	r.status.LastRun = &now
+	if diff != nil {
+		r.status.LastDiff = diff
+		r.status.DriftDetected = !diff.InSync
+	}
+	switch {
+	case err != nil:
+		r.status.LastResult = "failed"
+		r.status.LastError = err.Error()
+		r.status.ConsecutiveFailures++
+	case applied:
+		r.status.LastResult = "applied"
+		r.status.LastError = ""
+		r.status.ConsecutiveFailures = 0
+	default:
+		r.status.LastResult = "in_sync"
+		r.status.LastError = ""
+		r.status.ConsecutiveFailures = 0
+	}
+	return err
+}
+
+func (r *reconciler) reconcile() (*PackageDiff, bool, error) {
+	manifest, err := r.fetch()
+	if err != nil {
+		return nil, false, err
+	}
+	pm, err := hostPackageManager()
+	if err == nil {
+		err = checkWritable(pm)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Hold the package lock across diff and apply so a manual POST /packages can't interleave
+	packageLock.Lock()
+	defer packageLock.Unlock()
+
+	diff, err := diffPackages(context.Background(), pm, *manifest)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(diff.Unavailable) > 0 {
+		return diff, false, fmt.Errorf("%d packages are not available in the repositories", len(diff.Unavailable))
+	}
+	if diff.InSync {
+		return diff, false, nil
+	}
+
+	// Apply only what differs, keeping pinned versions from the manifest
+	changes := PackageConfig{ConffilePolicy: manifest.ConffilePolicy, PackageOptions: manifest.PackageOptions, Verify: manifest.Verify}
+	for _, entry := range append(diff.ToInstall, diff.VersionMismatch...) {
+		spec := entry.Name
+		if entry.DesiredVersion != "" {
+			spec = pm.PinnedSpec(entry.Name, entry.DesiredVersion)
+		}
+		changes.Packages.Installed = append(changes.Packages.Installed, spec)
+	}
+	for _, entry := range diff.ToRemove {
+		changes.Packages.Uninstalled = append(changes.Packages.Uninstalled, entry.Name)
+	}
+
+	job := jobs.New(context.Background(), "packages")
+	if !jobs.Start(job) {
+		return diff, false, errJobCancelled
+	}
+	// The next cycle tries again, so another package manager isn't waited for
+	if _, err := awaitPackageManager(context.Background(), job, pm, 0, "reconcile from "+r.cfg.SourceURL); err != nil {
+		return diff, false, err
+	}
+	result, err := applyPackagesForJob(job, pm, changes)
+	jobs.Finish(job, result, "reconcile from "+r.cfg.SourceURL+": "+packageSummary(changes), err)
+	if err != nil {
+		return diff, false, err
+	}
+	return diff, true, nil
+}
+
+// fetch downloads the manifest, reusing the previous copy when the server reports it unchanged
+func (r *reconciler) fetch() (*PackageConfig, error) {
+	req, err := http.NewRequest("GET", r.cfg.SourceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	if r.manifest != nil {
+		if r.etag != "" {
+			req.Header.Set("If-None-Match", r.etag)
+		}
+		if r.lastModified != "" {
+			req.Header.Set("If-Modified-Since", r.lastModified)
+		}
+	}
+	r.mu.Unlock()
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	now := time.Now().UTC()
+	r.mu.Lock()
+	r.status.LastFetch = &now
+	r.mu.Unlock()
+
+	if resp.StatusCode == http.StatusNotModified {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.manifest, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching manifest: %s", resp.Status)
+	}
+
+	body, err := readManifestBody(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := verifyDetachedSignature(body, "manifest "+r.cfg.SourceURL, r.cfg.SignatureURL, currentConfig().Signatures.Required); err != nil {
+		return nil, err
+	}
+	manifest, err := parseManifest(body)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(body)
+	r.mu.Lock()
+	r.manifest = &manifest
+	r.etag = resp.Header.Get("ETag")
+	r.lastModified = resp.Header.Get("Last-Modified")
+	r.status.ManifestHash = "sha256:" + hex.EncodeToString(sum[:])
+	r.mu.Unlock()
+	return &manifest, nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rothgar/cosi/api"
+)
+
+const (
+	// First retry delay after a failed registration or heartbeat, doubled on every further failure
+	registrationRetryBase = 5 * time.Second
+	// Heartbeat intervals are spread by up to this fraction so a fleet doesn't report in lockstep
+	heartbeatJitter = 0.2
+)
+
+// RegistrationStatus reports the state of the registration with the controller
+type RegistrationStatus struct {
+	Enabled             bool       `json:"enabled"`
+	ControllerURL       string     `json:"controller_url,omitempty"`
+	Registered          bool       `json:"registered"`
+	RegisteredAt        *time.Time `json:"registered_at,omitempty"`
+	HeartbeatInterval   string     `json:"heartbeat_interval,omitempty"`
+	LastHeartbeat       *time.Time `json:"last_heartbeat,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	NextAttempt         *time.Time `json:"next_attempt,omitempty"`
+}
+
+// registrar registers the agent with a controller and keeps it informed with heartbeats
+type registrar struct {
+	cfg        RegistrationConfig
+	listenAddr string
+	client     *http.Client
+
+	mu       sync.Mutex
+	status   RegistrationStatus
+	interval time.Duration
+}
+
+var registration *registrar
+
+func newRegistrar(cfg RegistrationConfig, listenAddr string) *registrar {
+	if cfg.AdvertiseAddress != "" {
+		listenAddr = cfg.AdvertiseAddress
+	}
+	return &registrar{
+		cfg:        cfg,
+		listenAddr: listenAddr,
+		client:     &http.Client{Timeout: 10 * time.Second, Transport: proxiedTransport()},
+		interval:   cfg.Interval,
+		status: RegistrationStatus{
+			Enabled:           true,
+			ControllerURL:     cfg.ControllerURL,
+			HeartbeatInterval: cfg.Interval.String(),
+		},
+	}
+}
+
+// Status returns a copy of the current status
+func (r *registrar) Status() RegistrationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// Start registers and then sends heartbeats forever, backing off exponentially after failures
+func (r *registrar) Start() {
+	go func() {
+		for {
+			var err error
+			if r.Status().Registered {
+				err = r.heartbeat()
+			} else {
+				err = r.register()
+			}
+
+			r.mu.Lock()
+			delay := jittered(r.interval)
+			if err != nil {
+				log.Printf("Controller registration failed: %v", err)
+				r.status.LastError = err.Error()
+				r.status.ConsecutiveFailures++
+				delay = registrationRetryBase << (r.status.ConsecutiveFailures - 1)
+				if delay > r.interval || delay <= 0 {
+					delay = jittered(r.interval)
+				}
+			} else {
+				r.status.LastError = ""
+				r.status.ConsecutiveFailures = 0
+			}
+			next := time.Now().Add(delay)
+			r.status.NextAttempt = &next
+			r.mu.Unlock()
+
+			time.Sleep(delay)
+		}
+	}()
+}
+
+// Helper function to spread an interval by up to heartbeatJitter in either direction
+func jittered(d time.Duration) time.Duration {
+	return d + time.Duration((rand.Float64()*2-1)*heartbeatJitter*float64(d))
+}
+
+// register sends the agent identity to the controller
+func (r *registrar) register() error {
+	payload, err := r.registration()
+	if err != nil {
+		return err
+	}
+	resp, err := r.post("/register", payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var answer api.RegistrationResponse
+	json.NewDecoder(resp.Body).Decode(&answer) // the body is optional
+
+	now := time.Now().UTC()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.Registered = true
+	r.status.RegisteredAt = &now
+	if interval, err := time.ParseDuration(answer.HeartbeatInterval); err == nil && interval > 0 {
+		r.interval = interval
+		r.status.HeartbeatInterval = interval.String()
+	}
+	return nil
+}
+
+// heartbeat reports the host health, registering again if the controller no longer knows the host
+func (r *registrar) heartbeat() error {
+	hostname, _ := os.Hostname()
+	payload := api.Heartbeat{
+		MachineID:    machineID(),
+		Hostname:     hostname,
+		AgentVersion: version,
+		Timestamp:    time.Now().UTC(),
+		Health:       collectHealth(),
+	}
+	resp, err := r.post("/heartbeat", payload)
+	if err != nil {
+		var ctrlErr *controllerError
+		if errors.As(err, &ctrlErr) && ctrlErr.StatusCode == http.StatusNotFound {
+			r.mu.Lock()
+			r.status.Registered = false
+			r.mu.Unlock()
+		}
+		return err
+	}
+	resp.Body.Close()
+
+	now := time.Now().UTC()
+	r.mu.Lock()
+	r.status.LastHeartbeat = &now
+	r.mu.Unlock()
+	return nil
+}
+
+// controllerError is a non-2xx answer from the controller
+type controllerError struct {
+	Path       string
+	StatusCode int
+	Status     string
+}
+
+func (e *controllerError) Error() string {
+	return fmt.Sprintf("controller returned %s for %s", e.Status, e.Path)
+}
+
+func (r *registrar) post(path string, payload interface{}) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(r.cfg.ControllerURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.cfg.Token)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, &controllerError{Path: path, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, nil
+}
+
+// Function to build the registration payload for this host
+func (r *registrar) registration() (api.Registration, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return api.Registration{}, err
+	}
+	osRelease, err := readOSReleaseFile("/etc/os-release")
+	if err != nil {
+		return api.Registration{}, err
+	}
+	return api.Registration{
+		Hostname:  hostname,
+		MachineID: machineID(),
+		OS: api.OSInfo{
+			ID:         osRelease["ID"],
+			VersionID:  osRelease["VERSION_ID"],
+			PrettyName: osRelease["PRETTY_NAME"],
+		},
+		AgentVersion:  version,
+		ListenAddress: r.listenAddr,
+	}, nil
+}
+
+// Helper function to read the systemd machine ID
+func machineID() string {
+	data, err := os.ReadFile("/etc/machine-id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Function to gather the health summary sent with heartbeats
+func collectHealth() api.Health {
+	health := api.Health{Disks: []api.DiskUsage{}}
+
+	if data, err := os.ReadFile("/proc/uptime"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 0 {
+			if uptime, err := strconv.ParseFloat(fields[0], 64); err == nil {
+				health.UptimeSeconds = int64(uptime)
+			}
+		}
+	}
+	if memory, err := collectMemory(); err == nil {
+		health.MemoryTotal = memory.TotalBytes
+		health.MemoryAvail = memory.AvailableBytes
+	}
+	if disks, err := collectDisks(); err == nil {
+		for _, disk := range disks {
+			health.Disks = append(health.Disks, api.DiskUsage{
+				MountPoint: disk.MountPoint,
+				TotalBytes: disk.TotalBytes,
+				FreeBytes:  disk.FreeBytes,
+			})
+		}
+	}
+	for _, job := range jobs.List() {
+		if job.Type == "packages" {
+			health.LastPackageJob = &api.JobStatus{
+				ID:         job.ID,
+				Status:     job.Status,
+				Error:      job.Error,
+				FinishedAt: job.FinishedAt,
+			}
+			break
+		}
+	}
+	return health
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// Helper function to check if the client asked for YAML
+func wantsYAML(c *gin.Context) bool {
+	accept := c.GetHeader("Accept")
+	return strings.Contains(accept, "application/x-yaml") ||
+		strings.Contains(accept, "application/yaml") ||
+		strings.Contains(accept, "text/yaml")
+}
+
+// Helper function to render a response as JSON, or as YAML when the client asks for it.
+// YAML is produced from the JSON encoding so both formats use the same keys; the
+// JSON is decoded with the YAML decoder so integers don't turn into floats.
+func render(c *gin.Context, status int, obj interface{}) {
+	if !wantsYAML(c) {
+		c.JSON(status, obj)
+		return
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to encode response"})
+		return
+	}
+	var generic interface{}
+	if err := yaml.Unmarshal(data, &generic); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to encode response"})
+		return
+	}
+	c.YAML(status, generic)
+}
+
+// Helper function to pick the list rendering the client asked for: "ndjson", "text", or
+// "" for the endpoint's usual JSON document
+func listFormat(c *gin.Context) string {
+	accept := c.GetHeader("Accept")
+	switch {
+	case strings.Contains(accept, "application/x-ndjson"):
+		return "ndjson"
+	case strings.Contains(accept, "text/plain"):
+		return "text"
+	}
+	return ""
+}
+
+// listView describes a list-shaped response. Handlers supply the row model and
+// renderList takes care of the format the client asked for.
+type listView[T any] struct {
+	// Columns and Cells give the header and the values of each row for text/plain
+	Columns []string
+	Cells   func(T) []string
+	// Rows produces the rows one at a time through emit
+	Rows func(emit func(T) error) error
+	// JSON writes the usual JSON document from the collected rows
+	JSON func([]T)
+	// Failure prefixes the error message when producing the rows fails
+	Failure string
+}
+
+// Helper function to render a list-shaped response. With NDJSON each row is written and
+// flushed as soon as it's produced, with text/plain the rows become aligned columns, and
+// otherwise the collected rows are handed to view.JSON so the endpoint keeps its JSON shape.
+func renderList[T any](c *gin.Context, view listView[T]) {
+	switch listFormat(c) {
+	case "ndjson":
+		c.Header("Content-Type", "application/x-ndjson")
+		started := false
+		err := view.Rows(func(row T) error {
+			line, err := json.Marshal(row)
+			if err != nil {
+				return err
+			}
+			if !started {
+				c.Status(200)
+				started = true
+			}
+			if _, err := c.Writer.Write(append(line, '\n')); err != nil {
+				return err
+			}
+			c.Writer.Flush()
+			return nil
+		})
+		switch {
+		case err != nil && !started:
+			respondFailure(c, view.Failure, err)
+		case err != nil:
+			// The status is already sent, so the failure becomes the last line
+			line, _ := json.Marshal(gin.H{"error": err.Error()})
+			c.Writer.Write(append(line, '\n'))
+		case !started:
+			c.Status(200)
+		}
+
+	case "text":
+		var buf bytes.Buffer
+		w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(view.Columns, "\t"))
+		err := view.Rows(func(row T) error {
+			_, err := fmt.Fprintln(w, strings.Join(view.Cells(row), "\t"))
+			return err
+		})
+		if err != nil {
+			respondFailure(c, view.Failure, err)
+			return
+		}
+		w.Flush()
+		c.Data(200, "text/plain; charset=utf-8", buf.Bytes())
+
+	default:
+		collected := []T{}
+		err := view.Rows(func(row T) error {
+			collected = append(collected, row)
+			return nil
+		})
+		if err != nil {
+			respondFailure(c, view.Failure, err)
+			return
+		}
+		view.JSON(collected)
+	}
+}
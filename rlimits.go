@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How long GET /limits may spend counting the open files of processes
+const fdScanTimeout = 2 * time.Second
+
+// Most processes GET /limits?top= reports
+const maxFDTop = 100
+
+// Name of the drop-in POST /limits/service/:name writes in the unit's .d directory
+const limitsDropIn = "50-cosi-limits.conf"
+
+// Directory systemd reads administrator drop-ins from
+const systemdUnitDir = "/etc/systemd/system"
+
+// A column separator of /proc/<pid>/limits, which pads its columns with spaces
+var limitsColumns = regexp.MustCompile(`\s{2,}`)
+
+// Rlimit is a soft and hard resource limit. -1 means unlimited.
+type Rlimit struct {
+	Soft  int64  `json:"soft"`
+	Hard  int64  `json:"hard"`
+	Units string `json:"units,omitempty"`
+}
+
+// FileHandles is the system-wide file handle usage from /proc/sys/fs
+type FileHandles struct {
+	// Allocated and Unused are the first fields of fs.file-nr; the handles in use are their
+	// difference
+	Allocated uint64 `json:"allocated"`
+	Unused    uint64 `json:"unused"`
+	InUse     uint64 `json:"in_use"`
+	Max       uint64 `json:"max"`
+	// NrOpen is the highest LimitNOFILE a process can be given
+	NrOpen uint64 `json:"nr_open,omitempty"`
+}
+
+// ProcessFiles is the number of files a process has open against its limit
+type ProcessFiles struct {
+	PID     int    `json:"pid"`
+	Command string `json:"command"`
+	Open    int    `json:"open"`
+	// Limit is the soft open files limit of the process, -1 when unlimited
+	Limit int64 `json:"limit"`
+}
+
+// FDScan reports how the walk of /proc for GET /limits?top= went
+type FDScan struct {
+	Scanned int `json:"scanned"`
+	// Skipped processes could not be read, because they exited or the agent may not
+	Skipped   int   `json:"skipped"`
+	Truncated bool  `json:"truncated"`
+	ElapsedMs int64 `json:"elapsed_ms"`
+}
+
+// ResourceLimits is the response of GET /limits
+type ResourceLimits struct {
+	// Agent holds the limits of the agent process, keyed like open_files
+	Agent       map[string]Rlimit `json:"agent"`
+	FileHandles FileHandles       `json:"file_handles"`
+	// DefaultLimitNOFILE is the systemd default for services, as soft:hard
+	DefaultLimitNOFILE string         `json:"default_limit_nofile,omitempty"`
+	Top                []ProcessFiles `json:"top,omitempty"`
+	Scan               *FDScan        `json:"scan,omitempty"`
+}
+
+// ServiceLimitRequest is the body of POST /limits/service/:name
+type ServiceLimitRequest struct {
+	// NOFILE is the soft open files limit, and Hard the hard one; Hard defaults to NOFILE
+	NOFILE uint64 `json:"nofile" binding:"required"`
+	Hard   uint64 `json:"hard"`
+}
+
+// Function to parse /proc/<pid>/limits into limits keyed by their name in snake case,
+// like "Max open files" as open_files
+func parseProcLimits(data string) map[string]Rlimit {
+	limits := make(map[string]Rlimit)
+	for _, line := range strings.Split(data, "\n") {
+		if !strings.HasPrefix(line, "Max ") {
+			continue
+		}
+		columns := limitsColumns.Split(strings.TrimSpace(line), -1)
+		if len(columns) < 3 {
+			continue
+		}
+		soft, err := parseLimitValue(columns[1])
+		if err != nil {
+			continue
+		}
+		hard, err := parseLimitValue(columns[2])
+		if err != nil {
+			continue
+		}
+		limit := Rlimit{Soft: soft, Hard: hard}
+		if len(columns) > 3 {
+			limit.Units = columns[3]
+		}
+		name := strings.ToLower(strings.TrimPrefix(columns[0], "Max "))
+		limits[strings.ReplaceAll(name, " ", "_")] = limit
+	}
+	return limits
+}
+
+// Helper function to parse a limit value, -1 standing for unlimited
+func parseLimitValue(value string) (int64, error) {
+	if value == "unlimited" || value == "infinity" {
+		return -1, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// Helper function to read a number from a file under /proc/sys
+func readProcSysUint(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// Function to read the system-wide file handle usage
+func readFileHandles() (FileHandles, error) {
+	var handles FileHandles
+	data, err := os.ReadFile("/proc/sys/fs/file-nr")
+	if err != nil {
+		return handles, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return handles, fmt.Errorf("unexpected /proc/sys/fs/file-nr: %q", strings.TrimSpace(string(data)))
+	}
+	handles.Allocated, _ = strconv.ParseUint(fields[0], 10, 64)
+	handles.Unused, _ = strconv.ParseUint(fields[1], 10, 64)
+	if handles.Allocated >= handles.Unused {
+		handles.InUse = handles.Allocated - handles.Unused
+	}
+	if handles.Max, err = readProcSysUint("/proc/sys/fs/file-max"); err != nil {
+		handles.Max, _ = strconv.ParseUint(fields[2], 10, 64)
+	}
+	handles.NrOpen, _ = readProcSysUint("/proc/sys/fs/nr_open")
+	return handles, nil
+}
+
+// Function to read the systemd default open files limit of services, as soft:hard
+func defaultLimitNOFILE(ctx context.Context) (string, error) {
+	cmd := newCommand("systemctl", "show", "--property", "DefaultLimitNOFILE,DefaultLimitNOFILESoft")
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return "", &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	values := make(map[string]string)
+	for _, line := range strings.Split(result.Output, "\n") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			values[key] = value
+		}
+	}
+	hard := values["DefaultLimitNOFILE"]
+	if soft := values["DefaultLimitNOFILESoft"]; soft != "" && soft != hard {
+		return soft + ":" + hard, nil
+	}
+	return hard, nil
+}
+
+// Function to count the open files of every process and return the top consumers. The
+// walk stops at ctx or fdScanTimeout, whichever is first, and skips processes that exit
+// or that the agent may not read.
+func topFileConsumers(ctx context.Context, top int) ([]ProcessFiles, FDScan) {
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, fdScanTimeout)
+	defer cancel()
+
+	var scan FDScan
+	var processes []ProcessFiles
+	entries, _ := os.ReadDir("/proc")
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			scan.Truncated = true
+			break
+		}
+		open, err := countOpenFiles(pid)
+		if err != nil {
+			scan.Skipped++
+			continue
+		}
+		scan.Scanned++
+		processes = append(processes, ProcessFiles{PID: pid, Open: open})
+	}
+
+	sort.Slice(processes, func(i, j int) bool {
+		if processes[i].Open != processes[j].Open {
+			return processes[i].Open > processes[j].Open
+		}
+		return processes[i].PID < processes[j].PID
+	})
+	if len(processes) > top {
+		processes = processes[:top]
+	}
+	for i := range processes {
+		dir := filepath.Join("/proc", strconv.Itoa(processes[i].PID))
+		if comm, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+			processes[i].Command = strings.TrimSpace(string(comm))
+		}
+		processes[i].Limit = -1
+		if data, err := os.ReadFile(filepath.Join(dir, "limits")); err == nil {
+			if limit, ok := parseProcLimits(string(data))["open_files"]; ok {
+				processes[i].Limit = limit.Soft
+			}
+		}
+	}
+	scan.ElapsedMs = time.Since(started).Milliseconds()
+	return processes, scan
+}
+
+// Helper function to count the entries of /proc/<pid>/fd without following them
+func countOpenFiles(pid int) (int, error) {
+	dir, err := os.Open(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return 0, err
+	}
+	return len(names), nil
+}
+
+// Function to collect the resource limits report, with the top open files consumers when
+// top is positive
+func collectResourceLimits(ctx context.Context, top int) (*ResourceLimits, error) {
+	data, err := os.ReadFile("/proc/self/limits")
+	if err != nil {
+		return nil, err
+	}
+	handles, err := readFileHandles()
+	if err != nil {
+		return nil, err
+	}
+	limits := &ResourceLimits{Agent: parseProcLimits(string(data)), FileHandles: handles}
+	if capabilities.Get().InitSystem.Systemd {
+		if limits.DefaultLimitNOFILE, err = defaultLimitNOFILE(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if top > 0 {
+		processes, scan := topFileConsumers(ctx, top)
+		limits.Top, limits.Scan = processes, &scan
+	}
+	return limits, nil
+}
+
+// Helper function to turn a service name into its unit name, adding .service when the
+// name has no unit suffix
+func serviceUnitName(name string) string {
+	if strings.Contains(name, ".") {
+		return name
+	}
+	return name + ".service"
+}
+
+// Function to read properties of a unit with systemctl show
+func unitProperties(ctx context.Context, unit string, properties ...string) (map[string]string, error) {
+	cmd := newCommand("systemctl", "show", "--property", strings.Join(properties, ","), unit)
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	values := make(map[string]string)
+	for _, line := range strings.Split(result.Output, "\n") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// Function to set the open files limit of a service through a drop-in and reload systemd.
+// The service keeps its old limit until it restarts, so the response says whether its
+// running process has a different limit.
+func setServiceNOFILE(ctx context.Context, name string, request ServiceLimitRequest) (gin.H, error) {
+	if !serviceNamePattern.MatchString(name) {
+		return nil, &requestError{Status: 400, Code: "invalid_parameter", Message: fmt.Sprintf("%q is not a valid service name", name)}
+	}
+	if request.Hard == 0 {
+		request.Hard = request.NOFILE
+	}
+	if request.Hard < request.NOFILE {
+		return nil, &requestError{Status: 400, Code: "invalid_parameter", Message: "hard must not be lower than nofile"}
+	}
+	if nrOpen, err := readProcSysUint("/proc/sys/fs/nr_open"); err == nil && request.Hard > nrOpen {
+		return nil, &requestError{Status: 400, Code: "invalid_parameter", Message: fmt.Sprintf("the limit can't exceed fs.nr_open (%d)", nrOpen)}
+	}
+	if err := requireSystemd("setting a service limit"); err != nil {
+		return nil, err
+	}
+
+	unit := serviceUnitName(name)
+	properties, err := unitProperties(ctx, unit, "LoadState", "ActiveState", "MainPID")
+	if err != nil {
+		return nil, err
+	}
+	if properties["LoadState"] == "not-found" {
+		return nil, &requestError{Status: 404, Code: "unit_not_found", Message: "Unit " + unit + " was not found"}
+	}
+
+	value := fmt.Sprintf("%d:%d", request.NOFILE, request.Hard)
+	path := filepath.Join(systemdUnitDir, unit+".d", limitsDropIn)
+	content := "# Written by cosi through POST /limits/service\n[Service]\nLimitNOFILE=" + value + "\n"
+	if err := writeDropIn(path, content); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return nil, &requestError{Status: 403, Code: "permission_denied", Message: err.Error()}
+		}
+		return nil, err
+	}
+	cmd := newPrivilegedCommand(nil, "systemctl", "daemon-reload")
+	if result, err := runCommandContext(ctx, cmd); err != nil {
+		return nil, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+
+	response := gin.H{"unit": unit, "drop_in": path, "limit_nofile": value, "active_state": properties["ActiveState"], "restart_required": false}
+	if pid, _ := strconv.Atoi(properties["MainPID"]); pid > 0 {
+		response["main_pid"] = pid
+		if data, err := os.ReadFile(fmt.Sprintf("/proc/%d/limits", pid)); err == nil {
+			if current, ok := parseProcLimits(string(data))["open_files"]; ok {
+				response["current"] = current
+				response["restart_required"] = current.Soft != int64(request.NOFILE) || current.Hard != int64(request.Hard)
+			}
+		}
+	}
+	return response, nil
+}
+
+// Helper function to write a drop-in, creating its directory
+func writeDropIn(path, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".cosi-tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Function to register the resource limits endpoints
+func registerLimitsRoutes(r *gin.Engine) {
+	// Define the /limits endpoint that reports the agent's resource limits and the file
+	// handle usage, with the processes holding the most open files when top is set
+	r.GET("/limits", func(c *gin.Context) {
+		top := 0
+		if value := c.Query("top"); value != "" {
+			var err error
+			if top, err = strconv.Atoi(value); err != nil || top < 1 || top > maxFDTop {
+				c.JSON(400, gin.H{"error": fmt.Sprintf("top must be a number from 1 to %d", maxFDTop), "code": "invalid_parameter"})
+				return
+			}
+		}
+		limits, err := collectResourceLimits(c.Request.Context(), top)
+		if err != nil {
+			respondFailure(c, "Failed to read the resource limits", err)
+			return
+		}
+		c.JSON(200, limits)
+	})
+
+	// Define the /limits/service/:name endpoint that sets the open files limit of a service
+	// with a systemd drop-in
+	r.POST("/limits/service/:name", func(c *gin.Context) {
+		var request ServiceLimitRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format: nofile is required"})
+			return
+		}
+		response, err := setServiceNOFILE(c.Request.Context(), c.Param("name"), request)
+		details := map[string]interface{}{"service": c.Param("name"), "nofile": request.NOFILE, "hard": request.Hard}
+		if response != nil {
+			details["restart_required"] = response["restart_required"]
+		}
+		audit.Record(auditOutcome("limits.service_nofile", c.ClientIP(), details, err))
+		if err != nil {
+			respondFailure(c, "Failed to set the service limit", err)
+			return
+		}
+		c.JSON(200, response)
+	})
+}
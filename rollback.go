@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// Shown with every rollback so nobody mistakes it for a restore
+const rollbackNote = "Rollback is best-effort: it reverses the package changes of the job using the versions recorded before it ran. " +
+	"Configuration files, data, and changes made since are not restored."
+
+// packageSnapshot holds the installed package versions around a package job
+type packageSnapshot struct {
+	Before map[string]string
+	After  map[string]string
+}
+
+// RollbackEntry is one package a rollback restores, removes, or can't recover
+type RollbackEntry struct {
+	Name string `json:"name"`
+	// Version is the version recorded before the job, empty for packages the job installed
+	Version        string `json:"version,omitempty"`
+	CurrentVersion string `json:"current_version,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+// RollbackPlan lists the reverse operations of a package job
+type RollbackPlan struct {
+	// Remove holds the packages the job installed
+	Remove []RollbackEntry `json:"remove"`
+	// Reinstall holds the packages the job removed or changed, at their recorded versions
+	Reinstall []RollbackEntry `json:"reinstall"`
+	// Unrecoverable holds packages whose recorded version the repositories no longer offer
+	Unrecoverable []RollbackEntry `json:"unrecoverable"`
+}
+
+// Function to apply a manifest as part of a job, which makes it cancellable and copies
+// the output to the job's output file, recording the package versions before and after
+// so the job can be rolled back. Callers must hold packageLock.
+func applyPackagesForJob(job *Job, pm packageManager, config PackageConfig) (*PackageApplyResult, error) {
+	control := jobs.Control(job)
+	defer control.Close()
+	var result *PackageApplyResult
+	var err error
+	snapshotJob(job, pm, func() {
+		result, err = applyPackages(pm, config, control)
+	})
+	return result, err
+}
+
+// Helper function to run change between two snapshots of the installed package versions,
+// which are recorded on the job so it can be rolled back
+func snapshotJob(job *Job, pm packageManager, change func()) {
+	ctx := jobs.Control(job).context()
+	before, snapshotErr := installedVersions(ctx, pm)
+	change()
+	if snapshotErr == nil {
+		var after map[string]string
+		if after, snapshotErr = installedVersions(ctx, pm); snapshotErr == nil {
+			jobs.SetSnapshot(job, &packageSnapshot{Before: before, After: after})
+		}
+	}
+	if snapshotErr != nil {
+		log.Printf("Warning: job %s can't be rolled back, the package snapshot failed: %v", job.ID, snapshotErr)
+	}
+}
+
+// Function to work out how to reverse what a job changed. Only packages the job touched are
+// considered, and only while they are still the way the job left them.
+func planRollback(ctx context.Context, pm packageManager, snapshot *packageSnapshot) (*RollbackPlan, error) {
+	current, err := installedVersions(ctx, pm)
+	if err != nil {
+		return nil, err
+	}
+	plan := &RollbackPlan{Remove: []RollbackEntry{}, Reinstall: []RollbackEntry{}, Unrecoverable: []RollbackEntry{}}
+
+	var reinstall []RollbackEntry
+	for name, after := range snapshot.After {
+		if _, existed := snapshot.Before[name]; !existed && current[name] == after {
+			plan.Remove = append(plan.Remove, RollbackEntry{Name: name, CurrentVersion: after})
+		}
+	}
+	for name, before := range snapshot.Before {
+		after, stillInstalled := snapshot.After[name]
+		if stillInstalled && after == before {
+			continue
+		}
+		// Leave packages alone that changed again after the job
+		if now, ok := current[name]; (ok || stillInstalled) && now != after {
+			continue
+		}
+		reinstall = append(reinstall, RollbackEntry{Name: name, Version: before, CurrentVersion: current[name]})
+	}
+
+	if len(reinstall) > 0 {
+		names := make([]string, len(reinstall))
+		for i, entry := range reinstall {
+			names[i] = entry.Name
+		}
+		available, err := pm.AvailableVersions(ctx, names)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range reinstall {
+			if containsString(available[entry.Name], entry.Version) {
+				plan.Reinstall = append(plan.Reinstall, entry)
+				continue
+			}
+			entry.Reason = fmt.Sprintf("version %s is no longer available in the repositories", entry.Version)
+			plan.Unrecoverable = append(plan.Unrecoverable, entry)
+		}
+	}
+
+	for _, list := range [][]RollbackEntry{plan.Remove, plan.Reinstall, plan.Unrecoverable} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	}
+	return plan, nil
+}
+
+// Function to turn a rollback plan into a manifest for the normal apply pipeline
+func rollbackConfig(pm packageManager, plan *RollbackPlan) PackageConfig {
+	config := PackageConfig{AllowDowngrades: true}
+	for _, entry := range plan.Reinstall {
+		config.Packages.Installed = append(config.Packages.Installed, pm.PinnedSpec(entry.Name, entry.Version))
+	}
+	for _, entry := range plan.Remove {
+		config.Packages.Uninstalled = append(config.Packages.Uninstalled, entry.Name)
+	}
+	return config
+}
+
+// Helper function to check if a list contains a string
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// What a schedule does about runs it missed while the agent was down
+const (
+	misfireSkip    = "skip"
+	misfireRunOnce = "run_once"
+)
+
+// SchedulesConfig holds the defaults of schedules created with POST /schedules
+type SchedulesConfig struct {
+	// MisfirePolicy is skip (default) or run_once for schedules that don't set their own
+	MisfirePolicy string `yaml:"misfire_policy"`
+}
+
+// Function to check the schedule defaults
+func (c SchedulesConfig) validate() error {
+	switch c.MisfirePolicy {
+	case "", misfireSkip, misfireRunOnce:
+		return nil
+	}
+	return fmt.Errorf("schedules.misfire_policy must be skip or run_once")
+}
+
+// Schedule runs an operation as a job whenever its cron expression fires
+type Schedule struct {
+	ID string `json:"id"`
+	// Cron is a five-field expression in the agent's local time, or a descriptor like @hourly
+	Cron      string            `json:"cron"`
+	Operation string            `json:"operation"`
+	Params    map[string]string `json:"params,omitempty"`
+	// Misfire is skip or run_once; empty uses schedules.misfire_policy
+	Misfire    string     `json:"misfire,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastRunAt  *time.Time `json:"last_run_at,omitempty"`
+	LastJobID  string     `json:"last_job_id,omitempty"`
+	NextRunAt  *time.Time `json:"next_run_at,omitempty"`
+	MissedRuns int        `json:"missed_runs,omitempty"`
+
+	schedule cron.Schedule
+}
+
+// ScheduleRequest is the body of POST /schedules
+type ScheduleRequest struct {
+	Cron      string            `json:"cron" binding:"required"`
+	Operation string            `json:"operation" binding:"required"`
+	Params    map[string]string `json:"params"`
+	Misfire   string            `json:"misfire"`
+}
+
+// scheduledOperation is something a schedule can run
+type scheduledOperation struct {
+	// JobType is the type of the jobs it creates
+	JobType string
+	// Params lists the parameters it takes and whether each is required
+	Params map[string]bool
+	Run    func(job *Job, params map[string]string)
+}
+
+// Operations schedules can run, by name
+var scheduledOperations = map[string]scheduledOperation{
+	"packages.apply": {
+		JobType: "packages",
+		Params:  map[string]bool{"source_url": true, "sha256": false, "signature_url": false},
+		Run:     runScheduledApply,
+	},
+	"updates.check": {
+		JobType: "updates",
+		Run:     runScheduledUpdatesCheck,
+	},
+	"binaries.rescan": {
+		JobType: "binaries",
+		Run:     runScheduledRescan,
+	},
+}
+
+// Standard cron fields plus descriptors like @daily and @every 1h
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// Function to check a schedule request and build the schedule from it
+func newSchedule(request ScheduleRequest) (*Schedule, error) {
+	parsed, err := cronParser.Parse(request.Cron)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %v", request.Cron, err)
+	}
+	operation, ok := scheduledOperations[request.Operation]
+	if !ok {
+		return nil, fmt.Errorf("unknown operation %q: must be one of %s", request.Operation, scheduledOperationNames())
+	}
+	for name := range request.Params {
+		if _, ok := operation.Params[name]; !ok {
+			return nil, fmt.Errorf("operation %s has no parameter %s", request.Operation, name)
+		}
+	}
+	for name, required := range operation.Params {
+		if required && request.Params[name] == "" {
+			return nil, fmt.Errorf("operation %s needs the %s parameter", request.Operation, name)
+		}
+	}
+	switch request.Misfire {
+	case "", misfireSkip, misfireRunOnce:
+	default:
+		return nil, fmt.Errorf("misfire must be skip or run_once")
+	}
+	return &Schedule{
+		ID:        newID(),
+		Cron:      request.Cron,
+		Operation: request.Operation,
+		Params:    request.Params,
+		Misfire:   request.Misfire,
+		CreatedAt: time.Now().UTC(),
+		schedule:  parsed,
+	}, nil
+}
+
+// Helper function to list the operation names for error messages
+func scheduledOperationNames() string {
+	names := make([]string, 0, len(scheduledOperations))
+	for name := range scheduledOperations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprint(names)
+}
+
+// scheduler fires the schedules persisted in <state dir>/schedules.json
+type scheduler struct {
+	mu        sync.Mutex
+	schedules map[string]*Schedule
+	// wake interrupts the wait for the next firing when schedules change
+	wake chan struct{}
+}
+
+var schedules = &scheduler{schedules: make(map[string]*Schedule), wake: make(chan struct{}, 1)}
+
+// Load reads the persisted schedules and applies the misfire policy to runs missed
+// while the agent was down
+func (s *scheduler) Load() {
+	data, err := os.ReadFile(filepath.Join(stateDir, "schedules.json"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: unable to read the schedules: %v", err)
+		}
+		return
+	}
+	var saved []*Schedule
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("Warning: ignoring the unreadable schedules: %v", err)
+		return
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, schedule := range saved {
+		parsed, err := cronParser.Parse(schedule.Cron)
+		if err != nil {
+			log.Printf("Warning: ignoring schedule %s: %v", schedule.ID, err)
+			continue
+		}
+		schedule.schedule = parsed
+		s.schedules[schedule.ID] = schedule
+
+		// The stored next run is when it was due before the agent stopped
+		if schedule.NextRunAt == nil {
+			s.setNext(schedule, now)
+			continue
+		}
+		if schedule.NextRunAt.After(now) {
+			continue
+		}
+		missed := 0
+		for next := *schedule.NextRunAt; !next.After(now) && missed < 1000; next = parsed.Next(next) {
+			missed++
+		}
+		schedule.MissedRuns += missed
+		policy := schedule.Misfire
+		if policy == "" {
+			policy = currentConfig().Schedules.MisfirePolicy
+		}
+		if policy == misfireRunOnce {
+			log.Printf("Schedule %s missed %d runs while the agent was down; running it once", schedule.ID, missed)
+			s.fire(schedule, now)
+		} else {
+			log.Printf("Schedule %s missed %d runs while the agent was down; skipping them", schedule.ID, missed)
+		}
+		s.setNext(schedule, now)
+	}
+	s.save()
+}
+
+// Start fires the schedules in the background
+func (s *scheduler) Start() {
+	go func() {
+		for {
+			s.mu.Lock()
+			var next time.Time
+			for _, schedule := range s.schedules {
+				if schedule.NextRunAt != nil && (next.IsZero() || schedule.NextRunAt.Before(next)) {
+					next = *schedule.NextRunAt
+				}
+			}
+			s.mu.Unlock()
+
+			wait := time.Hour
+			if !next.IsZero() {
+				wait = time.Until(next)
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+				s.fireDue(time.Now())
+			case <-s.wake:
+				timer.Stop()
+			}
+		}
+	}()
+}
+
+// fireDue runs every schedule whose next run has come
+func (s *scheduler) fireDue(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fired := false
+	for _, schedule := range s.schedules {
+		if schedule.NextRunAt != nil && !schedule.NextRunAt.After(now) {
+			s.fire(schedule, now)
+			s.setNext(schedule, now)
+			fired = true
+		}
+	}
+	if fired {
+		s.save()
+	}
+}
+
+// fire starts a job for a schedule. Callers must hold s.mu.
+func (s *scheduler) fire(schedule *Schedule, now time.Time) {
+	operation := scheduledOperations[schedule.Operation]
+	job := jobs.NewForSchedule(operation.JobType, schedule.ID)
+	ran := now.UTC()
+	schedule.LastRunAt = &ran
+	schedule.LastJobID = job.ID
+	go operation.Run(job, schedule.Params)
+}
+
+// setNext computes when a schedule fires next. Callers must hold s.mu.
+func (s *scheduler) setNext(schedule *Schedule, now time.Time) {
+	next := schedule.schedule.Next(now)
+	if next.IsZero() {
+		schedule.NextRunAt = nil
+		return
+	}
+	schedule.NextRunAt = &next
+}
+
+// save persists the schedules. Callers must hold s.mu.
+func (s *scheduler) save() {
+	data, err := json.Marshal(s.sorted())
+	if err == nil {
+		err = writeStateFile(filepath.Join(stateDir, "schedules.json"), data)
+	}
+	if err != nil {
+		log.Printf("Warning: unable to persist the schedules: %v", err)
+	}
+}
+
+// sorted returns the schedules oldest first. Callers must hold s.mu.
+func (s *scheduler) sorted() []*Schedule {
+	list := make([]*Schedule, 0, len(s.schedules))
+	for _, schedule := range s.schedules {
+		list = append(list, schedule)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// Add stores a new schedule and starts waiting for its first run
+func (s *scheduler) Add(schedule *Schedule) Schedule {
+	s.mu.Lock()
+	s.setNext(schedule, time.Now())
+	s.schedules[schedule.ID] = schedule
+	s.save()
+	copied := *schedule
+	s.mu.Unlock()
+	s.notify()
+	return copied
+}
+
+// Remove deletes a schedule; jobs it already started keep running
+func (s *scheduler) Remove(id string) bool {
+	s.mu.Lock()
+	_, ok := s.schedules[id]
+	if ok {
+		delete(s.schedules, id)
+		s.save()
+	}
+	s.mu.Unlock()
+	if ok {
+		s.notify()
+	}
+	return ok
+}
+
+// List returns copies of the schedules, oldest first
+func (s *scheduler) List() []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []Schedule{}
+	for _, schedule := range s.sorted() {
+		list = append(list, *schedule)
+	}
+	return list
+}
+
+// Helper function to make the background loop recompute its wait
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Function to download a manifest and apply it as a scheduled job
+func runScheduledApply(job *Job, params map[string]string) {
+	source := ManifestSource{URL: params["source_url"], SHA256: params["sha256"], SignatureURL: params["signature_url"]}
+	summary := "scheduled apply from " + source.URL
+	data, _, err := fetchManifest(source)
+	if err != nil {
+		jobs.Finish(job, nil, summary, err)
+		return
+	}
+	config, err := parseManifest(data)
+	if err != nil {
+		jobs.Finish(job, nil, summary, err)
+		return
+	}
+	pm, err := hostPackageManager()
+	if err == nil {
+		err = checkWritable(pm)
+	}
+	if err != nil {
+		jobs.Finish(job, nil, summary, err)
+		return
+	}
+
+	jobs.SetManifest(job, config)
+	packageLock.Lock()
+	if !jobs.Start(job) {
+		packageLock.Unlock()
+		return
+	}
+	result, err := applyPackagesForJob(job, pm, config)
+	packageLock.Unlock()
+	jobs.Finish(job, result, summary+": "+packageSummary(config), err)
+}
+
+// UpdatesCheck is the result of a scheduled updates check
+type UpdatesCheck struct {
+	Refresh    CommandResult     `json:"refresh"`
+	Upgradable []UpgradableEntry `json:"upgradable"`
+}
+
+// UpgradableEntry is an installed package the repositories offer another version of
+type UpgradableEntry struct {
+	Name      string `json:"name"`
+	Installed string `json:"installed"`
+	Candidate string `json:"candidate"`
+}
+
+// Function to refresh the package lists and list the packages with updates
+func runScheduledUpdatesCheck(job *Job, _ map[string]string) {
+	pm, err := hostPackageManager()
+	if err == nil {
+		err = checkWritable(pm)
+	}
+	if err != nil {
+		jobs.Finish(job, nil, "updates check", err)
+		return
+	}
+
+	// Refreshing the lists takes the package manager's lock, like a transaction
+	packageLock.Lock()
+	if !jobs.Start(job) {
+		packageLock.Unlock()
+		return
+	}
+	control := jobs.Control(job)
+	check, err := checkUpdates(pm, control)
+	control.Close()
+	packageLock.Unlock()
+	summary := "updates check"
+	if err == nil {
+		summary = fmt.Sprintf("updates check, %d packages upgradable", len(check.Upgradable))
+	}
+	jobs.Finish(job, check, summary, err)
+}
+
+// Helper function to refresh the package lists and compare installed versions with
+// the repository candidates
+func checkUpdates(pm packageManager, job *jobControl) (*UpdatesCheck, error) {
+	check := &UpdatesCheck{Upgradable: []UpgradableEntry{}}
+	cmd := pm.RefreshCommand()
+	result, err := runJobCommand(cmd, job)
+	check.Refresh = result
+	if err != nil {
+		return check, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+
+	installed, err := installedVersions(job.context(), pm)
+	if err != nil {
+		return check, err
+	}
+	names := make([]string, 0, len(installed))
+	for name := range installed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	candidates, err := pm.Candidates(job.context(), names)
+	if err != nil {
+		return check, err
+	}
+	for _, name := range names {
+		if candidate, ok := candidates[name]; ok && candidate != installed[name] {
+			check.Upgradable = append(check.Upgradable, UpgradableEntry{Name: name, Installed: installed[name], Candidate: candidate})
+		}
+	}
+	return check, nil
+}
+
+// Function to count the binaries in $PATH as a scheduled job
+func runScheduledRescan(job *Job, _ map[string]string) {
+	if !jobs.Start(job) {
+		return
+	}
+	count := 0
+	err := walkBinaries(os.Getenv("PATH"), func(BinaryEntry) error {
+		count++
+		return nil
+	})
+	jobs.Finish(job, map[string]int{"binary_count": count}, fmt.Sprintf("binaries rescan, %d found", count), err)
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Directory registered scripts are read from and the time a run gets, unless the
+	// scripts section says otherwise
+	defaultScriptDir     = "/etc/cosi/scripts"
+	defaultScriptTimeout = 5 * time.Minute
+	// Longest string parameter passed to a script
+	maxScriptParamBytes = 4096
+)
+
+// Scope of the tokens that may run the registered scripts
+const scopeScripts = "scripts"
+
+// Types a script parameter can be declared as
+var scriptParamTypes = map[string]bool{"string": true, "int": true, "bool": true, "enum": true}
+
+// Parameter patterns, compiled once each
+var scriptParamPatterns sync.Map
+
+// ScriptsConfig registers the scripts POST /scripts/:name may run. Only scripts listed
+// in Registered run, and only while their file still has the recorded hash.
+type ScriptsConfig struct {
+	Dir     string        `yaml:"dir"`
+	Timeout time.Duration `yaml:"timeout"`
+	// Registered maps the file names of the scripts in dir to their registrations
+	Registered map[string]ScriptConfig `yaml:"registered"`
+}
+
+// ScriptConfig registers one script
+type ScriptConfig struct {
+	// SHA256 is the hash of the script file that was reviewed
+	SHA256      string        `yaml:"sha256"`
+	Description string        `yaml:"description"`
+	Timeout     time.Duration `yaml:"timeout"`
+	// Params declares the parameters the script takes; any other is rejected
+	Params map[string]ScriptParam `yaml:"params"`
+}
+
+// ScriptParam declares a script parameter, passed to the script as an environment
+// variable
+type ScriptParam struct {
+	// Type is string, int, bool, or enum
+	Type string `yaml:"type" json:"type"`
+	// Env is the environment variable the value is passed in; the default is the
+	// parameter name in upper case
+	Env      string `yaml:"env" json:"env"`
+	Required bool   `yaml:"required" json:"required"`
+	// Default is passed when the parameter is left out
+	Default string `yaml:"default" json:"default,omitempty"`
+	// Pattern is a regular expression string values must match in full
+	Pattern string `yaml:"pattern" json:"pattern,omitempty"`
+	// Values are the values an enum may take
+	Values []string `yaml:"values" json:"values,omitempty"`
+}
+
+// Function to check the script registrations
+func (s ScriptsConfig) validate() error {
+	if s.Dir != "" && !filepath.IsAbs(s.Dir) {
+		return fmt.Errorf("scripts.dir must be an absolute path")
+	}
+	if s.Timeout < 0 {
+		return fmt.Errorf("scripts.timeout must not be negative")
+	}
+	for name, script := range s.Registered {
+		if !pluginName.MatchString(name) {
+			return fmt.Errorf("scripts.registered: %q is not a valid script name", name)
+		}
+		if _, err := hex.DecodeString(script.SHA256); err != nil || len(script.SHA256) != 64 {
+			return fmt.Errorf("scripts.registered.%s.sha256 must be the hex SHA-256 digest of the script", name)
+		}
+		if script.Timeout < 0 {
+			return fmt.Errorf("scripts.registered.%s.timeout must not be negative", name)
+		}
+		for param, declared := range script.Params {
+			field := fmt.Sprintf("scripts.registered.%s.params.%s", name, param)
+			if !paramName.MatchString(param) {
+				return fmt.Errorf("scripts.registered.%s.params: %q is not a valid parameter name", name, param)
+			}
+			if !scriptParamTypes[declared.Type] {
+				return fmt.Errorf("%s.type must be string, int, bool, or enum", field)
+			}
+			if !paramEnvAllowed(declared.env(param)) {
+				return fmt.Errorf("%s: %q can't be used as an environment variable", field, declared.env(param))
+			}
+			if declared.Type == "enum" && len(declared.Values) == 0 {
+				return fmt.Errorf("%s.values must list the values of the enum", field)
+			}
+			if declared.Pattern != "" {
+				if _, err := scriptParamPattern(declared.Pattern); err != nil {
+					return fmt.Errorf("%s.pattern: %v", field, err)
+				}
+			}
+			if declared.Default != "" {
+				if _, err := declared.parse(json.RawMessage(strconv.Quote(declared.Default)), true); err != nil {
+					return fmt.Errorf("%s.default: %v", field, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s ScriptsConfig) dir() string {
+	if s.Dir != "" {
+		return s.Dir
+	}
+	return defaultScriptDir
+}
+
+func (s ScriptsConfig) timeout(name string) time.Duration {
+	if timeout := s.Registered[name].Timeout; timeout > 0 {
+		return timeout
+	}
+	return time.Duration(orDefault(int64(s.Timeout), int64(defaultScriptTimeout)))
+}
+
+// Helper function to return the environment variable a parameter is passed in
+func (p ScriptParam) env(name string) string {
+	if p.Env != "" {
+		return p.Env
+	}
+	return strings.ToUpper(name)
+}
+
+// Function to check a parameter value against its declaration and format it for the
+// environment. fromText accepts int and bool values written as strings, as defaults are.
+func (p ScriptParam) parse(raw json.RawMessage, fromText bool) (string, error) {
+	var text string
+	if fromText || p.Type == "string" || p.Type == "enum" {
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return "", fmt.Errorf("must be a string")
+		}
+	}
+	switch p.Type {
+	case "int":
+		if fromText {
+			raw = json.RawMessage(text)
+		}
+		var value int64
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return "", fmt.Errorf("must be an integer")
+		}
+		return strconv.FormatInt(value, 10), nil
+	case "bool":
+		if fromText {
+			raw = json.RawMessage(text)
+		}
+		var value bool
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return "", fmt.Errorf("must be true or false")
+		}
+		return strconv.FormatBool(value), nil
+	case "enum":
+		if !containsString(p.Values, text) {
+			return "", fmt.Errorf("must be one of %s", strings.Join(p.Values, ", "))
+		}
+		return text, nil
+	}
+	if len(text) > maxScriptParamBytes || strings.ContainsRune(text, 0) {
+		return "", fmt.Errorf("must be at most %d bytes of text", maxScriptParamBytes)
+	}
+	if p.Pattern != "" {
+		re, err := scriptParamPattern(p.Pattern)
+		if err != nil {
+			return "", fmt.Errorf("pattern %s: %v", p.Pattern, err)
+		}
+		if !re.MatchString(text) {
+			return "", fmt.Errorf("must match %s", p.Pattern)
+		}
+	}
+	return text, nil
+}
+
+// Helper function to compile a parameter pattern to match whole values, once. A pattern
+// can compile alone and not once anchored, like \Qabc, so it is checked that way.
+func scriptParamPattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := scriptParamPatterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return nil, err
+	}
+	scriptParamPatterns.Store(pattern, re)
+	return re, nil
+}
+
+// RegisteredScript is a script of GET /scripts
+type RegisteredScript struct {
+	Name        string                 `json:"name"`
+	Path        string                 `json:"path"`
+	Description string                 `json:"description,omitempty"`
+	Params      map[string]ScriptParam `json:"params"`
+	TimeoutMS   int64                  `json:"timeout_ms"`
+	SHA256      string                 `json:"sha256"`
+	// HashStatus is ok when the file has the registered hash, mismatch when it was
+	// changed, and missing when it isn't there
+	HashStatus string `json:"hash_status"`
+	// CurrentSHA256 is the hash of the changed file when HashStatus is mismatch
+	CurrentSHA256 string `json:"current_sha256,omitempty"`
+	// Problem is why the script can't run even though its hash matches
+	Problem string `json:"problem,omitempty"`
+}
+
+// ScriptRequest is the optional body of POST /scripts/:name
+type ScriptRequest struct {
+	Params map[string]json.RawMessage `json:"params"`
+}
+
+// ScriptRun is the result of POST /scripts/:name, and of its job
+type ScriptRun struct {
+	Script   string `json:"script"`
+	SHA256   string `json:"sha256"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+	CommandResult
+	DurationMS int64 `json:"duration_ms"`
+}
+
+// Scripts running now, so a script isn't started again before it has finished
+var runningScripts sync.Map
+
+// Function to describe a registered script and compare its file with the recorded hash
+func inspectScript(name string) RegisteredScript {
+	cfg := currentConfig().Scripts
+	registered := cfg.Registered[name]
+	script := RegisteredScript{
+		Name:        name,
+		Path:        filepath.Join(cfg.dir(), name),
+		Description: registered.Description,
+		Params:      make(map[string]ScriptParam, len(registered.Params)),
+		TimeoutMS:   cfg.timeout(name).Milliseconds(),
+		SHA256:      strings.ToLower(registered.SHA256),
+		HashStatus:  "missing",
+	}
+	for param, declared := range registered.Params {
+		declared.Env = declared.env(param)
+		script.Params[param] = declared
+	}
+
+	stat, err := os.Stat(script.Path)
+	if err != nil {
+		return script
+	}
+	file, err := os.Open(script.Path)
+	if err != nil {
+		script.Problem = err.Error()
+		return script
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		script.Problem = err.Error()
+		return script
+	}
+	script.HashStatus = "ok"
+	if current := hex.EncodeToString(hash.Sum(nil)); current != script.SHA256 {
+		script.HashStatus, script.CurrentSHA256 = "mismatch", current
+	}
+
+	switch {
+	case !stat.Mode().IsRegular():
+		script.Problem = "not a regular file"
+	case stat.Mode().Perm()&0111 == 0:
+		script.Problem = "not executable"
+	default:
+		script.Problem = executableProblem(stat)
+	}
+	if dirStat, err := os.Stat(cfg.dir()); err == nil && script.Problem == "" {
+		if problem := executableProblem(dirStat); problem != "" {
+			script.Problem = "the scripts directory is " + problem
+		}
+	}
+	return script
+}
+
+// Function to list the registered scripts
+func listScripts() []RegisteredScript {
+	registered := currentConfig().Scripts.Registered
+	scripts := make([]RegisteredScript, 0, len(registered))
+	for name := range registered {
+		scripts = append(scripts, inspectScript(name))
+	}
+	sort.Slice(scripts, func(i, j int) bool { return scripts[i].Name < scripts[j].Name })
+	return scripts
+}
+
+// Function to check the parameters of a run against the script's declarations and turn
+// them into environment variables
+func scriptEnv(name string, declared map[string]ScriptParam, params map[string]json.RawMessage) ([]string, error) {
+	for param := range params {
+		if _, ok := declared[param]; !ok {
+			return nil, &requestError{400, "unknown_parameter", fmt.Sprintf("Script %s doesn't declare the %s parameter", name, param)}
+		}
+	}
+	env := []string{"COSI_SCRIPT=" + name}
+	for param, declaration := range declared {
+		raw, ok := params[param]
+		fromDefault := !ok || string(raw) == "null"
+		if fromDefault {
+			switch {
+			case declaration.Required:
+				return nil, &requestError{400, "missing_parameter", param + " is required"}
+			case declaration.Default == "":
+				continue
+			}
+			raw = json.RawMessage(strconv.Quote(declaration.Default))
+		}
+		value, err := declaration.parse(raw, fromDefault)
+		if err != nil {
+			return nil, &requestError{400, "invalid_parameter", param + " " + err.Error()}
+		}
+		env = append(env, declaration.env(param)+"="+value)
+	}
+	sort.Strings(env)
+	return env, nil
+}
+
+// Function to run a registered script as a script job, the work of POST /scripts/:name.
+// The job is returned once it exists, with failures too.
+func runScript(c *gin.Context, name string, params map[string]json.RawMessage) (*ScriptRun, *Job, error) {
+	cfg := currentConfig().Scripts
+	registered, ok := cfg.Registered[name]
+	if !ok {
+		return nil, nil, &requestError{404, "script_not_registered", fmt.Sprintf("Script %s is not registered in scripts.registered", name)}
+	}
+	script := inspectScript(name)
+	switch {
+	case script.HashStatus == "missing":
+		return nil, nil, &requestError{404, "script_missing", fmt.Sprintf("Script %s is registered but %s doesn't exist", name, script.Path)}
+	case script.HashStatus == "mismatch":
+		return nil, nil, &responseError{409, gin.H{
+			"error":          fmt.Sprintf("Script %s was changed since it was registered; update its sha256 once the change is reviewed", name),
+			"code":           "script_hash_mismatch",
+			"sha256":         script.SHA256,
+			"current_sha256": script.CurrentSHA256,
+		}}
+	case script.Problem != "":
+		return nil, nil, &requestError{403, "script_rejected", fmt.Sprintf("Script %s can't be run: %s", name, script.Problem)}
+	}
+	env, err := scriptEnv(name, registered.Params, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, running := runningScripts.LoadOrStore(name, true); running {
+		return nil, nil, &requestError{409, "script_running", fmt.Sprintf("Script %s is already running", name)}
+	}
+	defer runningScripts.Delete(name)
+
+	job := jobs.New(c.Request.Context(), "script")
+	if !jobs.Start(job) {
+		return nil, job, jobCancelledError(job)
+	}
+	control := jobs.Control(job)
+	defer control.Close()
+
+	// The timeout cancels the job like DELETE /jobs/:id, so the script gets SIGTERM and
+	// the cancellation grace period before SIGKILL
+	timeout := cfg.timeout(name)
+	var expired atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		expired.Store(true)
+		jobs.Cancel(job.ID)
+	})
+	started := time.Now()
+	cmd := newCommand(script.Path)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Dir = "/"
+	result, err := runJobCommand(cmd, control)
+	timer.Stop()
+
+	run := &ScriptRun{Script: name, SHA256: script.SHA256, TimedOut: expired.Load(), CommandResult: result, DurationMS: time.Since(started).Milliseconds()}
+	if run.TimedOut {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	jobs.Finish(job, run, "script "+name, err)
+	if err != nil {
+		status, code := 422, "script_failed"
+		if run.TimedOut {
+			status, code = 504, "script_timed_out"
+		} else if cancelled, _ := control.state(); cancelled {
+			status, code = 409, "job_cancelled"
+		}
+		return run, job, &responseError{status, gin.H{"error": fmt.Sprintf("Script %s failed: %v", name, err), "code": code, "job_id": job.ID, "result": run}}
+	}
+	return run, job, nil
+}
+
+// Function to register the /scripts endpoints
+func registerScriptRoutes(r *gin.Engine) {
+	// Define the /scripts endpoint that lists the registered scripts, their parameters,
+	// and whether their files still have the registered hash
+	r.GET("/scripts", func(c *gin.Context) {
+		c.JSON(200, gin.H{"dir": currentConfig().Scripts.dir(), "scripts": listScripts()})
+	})
+
+	// Define the /scripts/:name endpoint that runs a registered script as a job and
+	// waits for it. Parameters are passed as environment variables.
+	r.POST("/scripts/:name", requireScope(scopeScripts), func(c *gin.Context) {
+		var request ScriptRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&request); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid request format: " + err.Error()})
+				return
+			}
+		}
+		name := c.Param("name")
+		run, job, err := runScript(c, name, request.Params)
+		details := map[string]interface{}{"script": name}
+		if run != nil {
+			details["sha256"] = run.SHA256
+			details["exit_code"] = run.ExitCode
+			details["duration_ms"] = run.DurationMS
+		}
+		if len(request.Params) > 0 {
+			details["params"] = request.Params
+		}
+		if job != nil {
+			details["job_id"] = job.ID
+			c.Header("X-Cosi-Job-Id", job.ID)
+		}
+		audit.Record(auditOutcome("scripts.run", c.ClientIP(), details, err))
+		if err != nil {
+			respondFailure(c, "Failed to run script "+name, err)
+			return
+		}
+		c.JSON(200, gin.H{"job_id": job.ID, "result": run})
+	})
+}
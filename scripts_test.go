@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Running a script needs the scripts scope, even one that is registered and reviewed
+func TestScriptRoutesRequireScope(t *testing.T) {
+	withJobStore(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerScriptRoutes(r)
+
+	// No script is registered, so the requests let through are refused before anything runs
+	checkScopeRequired(t, r, scopeScripts, "POST", "/scripts/hello", "")
+
+	dir := t.TempDir()
+	script := []byte("#!/bin/sh\necho hello\n")
+	if err := os.WriteFile(filepath.Join(dir, "hello"), script, 0755); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(script)
+	withScopedTokens(t, scopeScripts)
+	cfg := *currentConfig()
+	cfg.Scripts = ScriptsConfig{Dir: dir, Registered: map[string]ScriptConfig{"hello": {SHA256: hex.EncodeToString(sum[:])}}}
+	withConfig(t, &cfg)
+
+	if w := serveWithToken(r, "POST", "/scripts/hello", "", "reader-token"); w.Code != 403 {
+		t.Errorf("POST /scripts/hello with an inventory token = %d %s, want 403", w.Code, w.Body)
+	}
+	if w := serveWithToken(r, "POST", "/scripts/hello", "", "ops-token"); w.Code != 200 || !strings.Contains(w.Body.String(), `hello\n`) {
+		t.Errorf("POST /scripts/hello = %d %s", w.Code, w.Body)
+	}
+	// Listing the scripts stays open to any client
+	if w := serveWithToken(r, "GET", "/scripts", "", ""); w.Code != 200 {
+		t.Errorf("GET /scripts = %d %s", w.Code, w.Body)
+	}
+}
+
+// Patterns are checked as they are matched, anchored to the whole value, so one that only
+// compiles alone is refused with the configuration instead of failing a request
+func TestScriptParamPattern(t *testing.T) {
+	config := func(pattern string) ScriptsConfig {
+		return ScriptsConfig{Registered: map[string]ScriptConfig{"deploy": {
+			SHA256: strings.Repeat("0", 64),
+			Params: map[string]ScriptParam{"version": {Type: "string", Pattern: pattern}},
+		}}}
+	}
+	if err := config(`v[0-9]+(\.[0-9]+)*`).validate(); err != nil {
+		t.Errorf("valid pattern = %v", err)
+	}
+	if err := config(`\Qabc`).validate(); err == nil || !strings.Contains(err.Error(), "scripts.registered.deploy.params.version.pattern") {
+		t.Errorf(`pattern \Qabc = %v, want it refused`, err)
+	}
+
+	param := ScriptParam{Type: "string", Pattern: `v[0-9]+(\.[0-9]+)*`}
+	for value, ok := range map[string]bool{`"v1.30.2"`: true, `"v1.30.2; rm -rf /"`: false, `"xv1"`: false} {
+		if _, err := param.parse(json.RawMessage(value), false); (err == nil) != ok {
+			t.Errorf("parse(%s) = %v", value, err)
+		}
+	}
+	// A declaration that skipped validation fails the value instead of the agent
+	if _, err := (ScriptParam{Type: "string", Pattern: `\Qabc`}).parse(json.RawMessage(`"abc"`), false); err == nil {
+		t.Error(`parse with pattern \Qabc succeeded`)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	selinuxFS         = "/sys/fs/selinux"
+	selinuxConfigFile = "/etc/selinux/config"
+	apparmorEnabled   = "/sys/module/apparmor/parameters/enabled"
+	apparmorProfiles  = "/sys/kernel/security/apparmor/profiles"
+	auditLogFile      = "/var/log/audit/audit.log"
+	// Window for the recent denial count
+	denialWindow = 24 * time.Hour
+)
+
+// MACStatus reports the mandatory access control system of the host
+type MACStatus struct {
+	System         string          `json:"system"` // selinux, apparmor, or none
+	Mode           string          `json:"mode,omitempty"`
+	ConfiguredMode string          `json:"configured_mode,omitempty"` // SELinux mode applied at boot
+	PolicyType     string          `json:"policy_type,omitempty"`
+	PolicyVersion  string          `json:"policy_version,omitempty"`
+	Profiles       map[string]int  `json:"profiles,omitempty"` // AppArmor profiles per mode
+	Denials        *MACDenialCount `json:"denials,omitempty"`
+}
+
+// MACDenialCount is the number of denials logged in the recent window
+type MACDenialCount struct {
+	Count  int       `json:"count"`
+	Since  time.Time `json:"since"`
+	Source string    `json:"source,omitempty"` // audit.log or journal
+	Error  string    `json:"error,omitempty"`
+}
+
+// SELinuxModeRequest is the body of POST /security/mac/selinux
+type SELinuxModeRequest struct {
+	Mode    string `json:"mode" binding:"required"` // enforcing or permissive
+	Persist bool   `json:"persist"`
+	Confirm bool   `json:"confirm"`
+}
+
+// Function to detect the active MAC system and its state
+func macStatus(ctx context.Context) *MACStatus {
+	if _, err := os.Stat(filepath.Join(selinuxFS, "enforce")); err == nil {
+		return selinuxStatus(ctx)
+	}
+	if data, err := os.ReadFile(apparmorEnabled); err == nil && strings.TrimSpace(string(data)) == "Y" {
+		return apparmorStatus(ctx)
+	}
+	// SELinux installed but disabled at boot leaves no selinuxfs, only the config
+	if config, err := readKeyValueFile(selinuxConfigFile); err == nil {
+		return &MACStatus{System: "selinux", Mode: "disabled", ConfiguredMode: config["SELINUX"], PolicyType: config["SELINUXTYPE"]}
+	}
+	return &MACStatus{System: "none"}
+}
+
+func selinuxStatus(ctx context.Context) *MACStatus {
+	status := &MACStatus{System: "selinux"}
+	if data, err := os.ReadFile(filepath.Join(selinuxFS, "enforce")); err == nil {
+		status.Mode = "permissive"
+		if strings.TrimSpace(string(data)) == "1" {
+			status.Mode = "enforcing"
+		}
+	} else if output, err := outputTrackedContext(ctx, newCommand("getenforce")); err == nil {
+		status.Mode = strings.ToLower(strings.TrimSpace(string(output)))
+	}
+	if data, err := os.ReadFile(filepath.Join(selinuxFS, "policyvers")); err == nil {
+		status.PolicyVersion = strings.TrimSpace(string(data))
+	}
+	if config, err := readKeyValueFile(selinuxConfigFile); err == nil {
+		status.ConfiguredMode = config["SELINUX"]
+		status.PolicyType = config["SELINUXTYPE"]
+	}
+	status.Denials = countDenials(ctx, selinuxDenial)
+	return status
+}
+
+func apparmorStatus(ctx context.Context) *MACStatus {
+	status := &MACStatus{System: "apparmor", Mode: "enabled"}
+	// Each line is "<profile> (<mode>)"; the file is only readable by root
+	if lines, err := readLines(apparmorProfiles); err == nil {
+		status.Profiles = make(map[string]int)
+		for _, line := range lines {
+			if open := strings.LastIndex(line, "("); open >= 0 {
+				status.Profiles[strings.TrimSuffix(line[open+1:], ")")]++
+			}
+		}
+		switch {
+		case status.Profiles["enforce"] > 0:
+			status.Mode = "enforce"
+		case status.Profiles["complain"] > 0:
+			status.Mode = "complain"
+		}
+	}
+	if data, err := os.ReadFile("/sys/kernel/security/apparmor/features/policy/versions/v8"); err == nil && strings.TrimSpace(string(data)) == "yes" {
+		status.PolicyVersion = "v8"
+	}
+	status.Denials = countDenials(ctx, apparmorDenial)
+	return status
+}
+
+var (
+	selinuxDenial  = regexp.MustCompile(`avc:\s+denied`)
+	apparmorDenial = regexp.MustCompile(`apparmor="DENIED"`)
+	// audit.log lines carry "msg=audit(<unix seconds>.<millis>:<serial>)"
+	auditTimestamp = regexp.MustCompile(`msg=audit\((\d+)\.\d+:\d+\)`)
+)
+
+// Function to count recent denials from the audit log, falling back to the journal
+func countDenials(ctx context.Context, pattern *regexp.Regexp) *MACDenialCount {
+	since := time.Now().Add(-denialWindow).UTC()
+	denials := &MACDenialCount{Since: since}
+
+	file, err := os.Open(auditLogFile)
+	if err == nil {
+		defer file.Close()
+		denials.Source = "audit.log"
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !pattern.MatchString(line) {
+				continue
+			}
+			if match := auditTimestamp.FindStringSubmatch(line); match != nil {
+				if seconds, err := strconv.ParseInt(match[1], 10, 64); err == nil && time.Unix(seconds, 0).Before(since) {
+					continue
+				}
+			}
+			denials.Count++
+		}
+		if err := scanner.Err(); err != nil {
+			denials.Error = err.Error()
+		}
+		return denials
+	}
+
+	cmd := newCommand("journalctl", "-k", "-q", "-o", "cat", "--no-pager",
+		"--since", since.Local().Format("2006-01-02 15:04:05"), "-g", pattern.String())
+	result, jErr := runCommandContext(ctx, cmd)
+	switch {
+	case jErr == nil:
+		denials.Source = "journal"
+		denials.Count = len(strings.Split(strings.TrimSpace(result.Stdout), "\n"))
+	case result.ExitCode == 1 && result.Stderr == "":
+		denials.Source = "journal" // grep found nothing
+	default:
+		denials.Error = fmt.Sprintf("neither %s nor the journal is readable: %v", auditLogFile, err)
+	}
+	return denials
+}
+
+// Function to switch SELinux between enforcing and permissive, optionally
+// persisting the mode to /etc/selinux/config
+func setSELinuxMode(request SELinuxModeRequest) (CommandResult, error) {
+	value := "0"
+	if request.Mode == "enforcing" {
+		value = "1"
+	}
+	cmd := newPrivilegedCommand(nil, "setenforce", value)
+	result, err := runCommand(cmd)
+	if err != nil {
+		return result, &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	if request.Persist {
+		if err := persistSELinuxMode(request.Mode); err != nil {
+			return result, fmt.Errorf("mode changed but not persisted: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// Helper function to rewrite the SELINUX= line of /etc/selinux/config atomically
+func persistSELinuxMode(mode string) error {
+	data, err := os.ReadFile(selinuxConfigFile)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	found := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "SELINUX=") {
+			lines[i] = "SELINUX=" + mode
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("no SELINUX= line in " + selinuxConfigFile)
+	}
+
+	info, err := os.Stat(selinuxConfigFile)
+	if err != nil {
+		return err
+	}
+	tmp := selinuxConfigFile + ".cosi-tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")), info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, selinuxConfigFile); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Helper function to read a KEY=value file such as /etc/selinux/config, ignoring comments
+func readKeyValueFile(path string) (map[string]string, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			values[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return values, nil
+}
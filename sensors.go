@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const hwmonDir = "/sys/class/hwmon"
+
+var (
+	hwmonInput = regexp.MustCompile(`^(temp|fan|in)([0-9]+)_input$`)
+	pciAddress = regexp.MustCompile(`^([0-9a-f]{4}):([0-9a-f]{2}):([0-9a-f]{2})\.([0-7])$`)
+	i2cAddress = regexp.MustCompile(`^([0-9]+)-([0-9a-f]{4})$`)
+)
+
+// hwmon reading kinds: their unit and the divisor from the raw sysfs value
+var sensorKinds = map[string]struct {
+	Unit    string
+	Divisor float64
+}{
+	"temp": {"°C", 1000}, // millidegrees
+	"fan":  {"RPM", 1},
+	"in":   {"V", 1000}, // millivolts
+}
+
+// Chip drivers whose temperatures are the CPU's own
+var cpuSensorChips = map[string]bool{"coretemp": true, "k10temp": true, "zenpower": true, "cpu_thermal": true, "soc_thermal": true}
+
+// SensorReading is one temperature, fan, or voltage input of a chip
+type SensorReading struct {
+	Label    string   `json:"label"`
+	Value    *float64 `json:"value"`
+	Unit     string   `json:"unit"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	Critical *float64 `json:"critical,omitempty"`
+	Alarm    bool     `json:"alarm,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// SensorChip is one hwmon device and its readings
+type SensorChip struct {
+	Name string `json:"name"`
+	// ID follows lm-sensors naming, e.g. coretemp-isa-0000 or nvme-pci-0100
+	ID           string          `json:"id"`
+	Kind         string          `json:"kind,omitempty"`   // cpu or nvme for the readings usually alerted on
+	Device       string          `json:"device,omitempty"` // e.g. nvme0
+	Temperatures []SensorReading `json:"temperatures"`
+	Fans         []SensorReading `json:"fans"`
+	Voltages     []SensorReading `json:"voltages"`
+	Errors       []string        `json:"errors,omitempty"`
+}
+
+// SensorReport is the response of GET /sensors
+type SensorReport struct {
+	Chips []SensorChip `json:"chips"`
+}
+
+// Function to read every hwmon chip. Attributes that can't be read are reported on
+// the reading or chip they belong to so the rest still comes through.
+func collectSensors() (*SensorReport, error) {
+	report := &SensorReport{Chips: []SensorChip{}}
+	entries, err := os.ReadDir(hwmonDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return report, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		report.Chips = append(report.Chips, readHwmonChip(filepath.Join(hwmonDir, entry.Name())))
+	}
+	sort.Slice(report.Chips, func(i, j int) bool { return report.Chips[i].ID < report.Chips[j].ID })
+	return report, nil
+}
+
+// Function to read one hwmon directory
+func readHwmonChip(dir string) SensorChip {
+	chip := SensorChip{Temperatures: []SensorReading{}, Fans: []SensorReading{}, Voltages: []SensorReading{}}
+	chip.Name = readAttribute(dir, "name")
+	if chip.Name == "" {
+		chip.Name = filepath.Base(dir)
+	}
+	chip.ID, chip.Device = sensorChipID(dir, chip.Name)
+	switch {
+	case cpuSensorChips[chip.Name]:
+		chip.Kind = "cpu"
+	case chip.Name == "nvme":
+		chip.Kind = "nvme"
+	}
+
+	// Older drivers keep their attributes on the device rather than the hwmon class directory
+	attrDir := dir
+	files, err := filepath.Glob(filepath.Join(dir, "*_input"))
+	if err == nil && len(files) == 0 {
+		attrDir = filepath.Join(dir, "device")
+		files, err = filepath.Glob(filepath.Join(attrDir, "*_input"))
+	}
+	if err != nil {
+		chip.Errors = append(chip.Errors, err.Error())
+		return chip
+	}
+
+	type input struct {
+		kind  string
+		index int
+	}
+	var inputs []input
+	for _, file := range files {
+		if match := hwmonInput.FindStringSubmatch(filepath.Base(file)); match != nil {
+			index, _ := strconv.Atoi(match[2])
+			inputs = append(inputs, input{match[1], index})
+		}
+	}
+	sort.Slice(inputs, func(i, j int) bool {
+		if inputs[i].kind != inputs[j].kind {
+			return inputs[i].kind < inputs[j].kind
+		}
+		return inputs[i].index < inputs[j].index
+	})
+
+	for _, in := range inputs {
+		reading := readSensor(attrDir, in.kind, in.index)
+		switch in.kind {
+		case "temp":
+			chip.Temperatures = append(chip.Temperatures, reading)
+		case "fan":
+			chip.Fans = append(chip.Fans, reading)
+		case "in":
+			chip.Voltages = append(chip.Voltages, reading)
+		}
+	}
+	return chip
+}
+
+// Function to read an input and its label, limits, and alarm
+func readSensor(dir, kind string, index int) SensorReading {
+	prefix := fmt.Sprintf("%s%d_", kind, index)
+	unit := sensorKinds[kind]
+	reading := SensorReading{Label: readAttribute(dir, prefix+"label"), Unit: unit.Unit}
+	if reading.Label == "" {
+		reading.Label = fmt.Sprintf("%s%d", kind, index) // the name sensors falls back to
+	}
+
+	value := func(name string) (*float64, error) {
+		data, err := os.ReadFile(filepath.Join(dir, prefix+name))
+		if err != nil {
+			return nil, err
+		}
+		raw, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+		if err != nil {
+			return nil, err
+		}
+		scaled := raw / unit.Divisor
+		return &scaled, nil
+	}
+
+	var err error
+	if reading.Value, err = value("input"); err != nil {
+		// Drivers return EIO or ENODATA for sensors that are present but not wired up
+		reading.Error = err.Error()
+	}
+	reading.Min, _ = value("min")
+	reading.Max, _ = value("max")
+	reading.Critical, _ = value("crit")
+	if alarm, _ := value("alarm"); alarm != nil && *alarm != 0 {
+		reading.Alarm = true
+	}
+	if kind == "fan" && reading.Max != nil && *reading.Max == 0 {
+		reading.Max = nil // fans report 0 when no limit is set
+	}
+	return reading
+}
+
+// Helper function to read a trimmed sysfs attribute, empty when missing or unreadable
+func readAttribute(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Function to name a chip the way lm-sensors does: the driver name, the bus, and the
+// address on it. It also returns the kernel name of the device when it isn't a bus address.
+func sensorChipID(dir, name string) (string, string) {
+	resolved, err := filepath.EvalSymlinks(filepath.Join(dir, "device"))
+	if err != nil {
+		return name + "-virtual-0", ""
+	}
+	base := filepath.Base(resolved)
+	device := ""
+	if !pciAddress.MatchString(base) && !i2cAddress.MatchString(base) {
+		device = base
+	}
+
+	// The device itself or a parent close by sits on the bus, e.g. .../0000:01:00.0/nvme/nvme0
+	path := resolved
+	for i := 0; i < 3 && path != "/"; i++ {
+		component := filepath.Base(path)
+		if match := pciAddress.FindStringSubmatch(component); match != nil {
+			bus, _ := strconv.ParseUint(match[2], 16, 8)
+			slot, _ := strconv.ParseUint(match[3], 16, 8)
+			function, _ := strconv.ParseUint(match[4], 16, 8)
+			return fmt.Sprintf("%s-pci-%04x", name, bus<<8|slot<<3|function), device
+		}
+		if match := i2cAddress.FindStringSubmatch(component); match != nil {
+			address, _ := strconv.ParseUint(match[2], 16, 16)
+			return fmt.Sprintf("%s-i2c-%s-%02x", name, match[1], address), device
+		}
+		path = filepath.Dir(path)
+	}
+
+	switch {
+	case strings.Contains(resolved, "/platform/"):
+		// Platform devices are named driver.N; sensors reports them on the isa bus
+		number := 0
+		if _, suffix, ok := strings.Cut(base, "."); ok {
+			number, _ = strconv.Atoi(suffix)
+		}
+		return fmt.Sprintf("%s-isa-%04x", name, number), device
+	case strings.HasPrefix(base, "LNXTHERM") || strings.Contains(resolved, "/ACPI") || strings.Contains(resolved, "/LNXSYSTM"):
+		return name + "-acpi-0", device
+	}
+	return name + "-" + base, device
+}
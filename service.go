@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Names of the systemd units managed by install-service and uninstall-service
+const (
+	serviceName = "cosi.service"
+	socketName  = "cosi.socket"
+)
+
+//go:embed cosi.service.tmpl
+var serviceTemplate string
+
+//go:embed cosi.socket.tmpl
+var socketTemplate string
+
+// serviceUnit holds the values rendered into the unit template
+type serviceUnit struct {
+	User            string
+	EnvironmentFile string
+	Executable      string
+	Args            []string
+	// Socket activation: the service is started by SocketName listening on ListenStream
+	Socket       bool
+	SocketName   string
+	ListenStream string
+}
+
+// Function to run a service management subcommand. handled is false when args
+// don't name one and the agent should start normally.
+func runSubcommand(args []string) (handled bool, err error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	switch args[0] {
+	case "install-service":
+		return true, installService(args[1:])
+	case "uninstall-service":
+		return true, uninstallService(args[1:])
+	case "discover":
+		return true, runDiscover(args[1:])
+	case "client":
+		os.Exit(runClient(args[1:]))
+	}
+	return false, nil
+}
+
+// Function to render a systemd unit template for the given settings
+func renderUnit(name, text string, unit serviceUnit) (string, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, unit); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Helper function to turn a --listen address into a ListenStream value; systemd
+// doesn't accept ":80", only "80" or "host:80"
+func listenStream(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return addr[1:]
+	}
+	return addr
+}
+
+// Function to handle "cosi install-service", writing the unit and enabling it
+func installService(args []string) error {
+	fs := flag.NewFlagSet("install-service", flag.ExitOnError)
+	user := fs.String("user", "root", "User the agent runs as; non-root users run privileged commands with --sudo")
+	envFile := fs.String("environment-file", "/etc/default/cosi", "Optional environment file read by the unit")
+	configPath := fs.String("config", "", "Configuration file passed to the agent with --config")
+	listen := fs.String("listen", ":80", "Address the agent listens on")
+	unitDir := fs.String("unit-dir", "/etc/systemd/system", "Directory the unit is written to")
+	force := fs.Bool("force", false, "Overwrite an existing unit that differs")
+	noStart := fs.Bool("no-start", false, "Enable the unit without starting it")
+	socket := fs.Bool("socket", false, "Also install "+socketName+" so systemd holds the port and starts the agent on the first connection")
+	fs.Parse(args)
+
+	exe, err := executablePath()
+	if err != nil {
+		return err
+	}
+	unit := serviceUnit{
+		User:            *user,
+		EnvironmentFile: *envFile,
+		Executable:      exe,
+		Args:            []string{"--listen", *listen, "--state-dir", "/var/lib/cosi"},
+		Socket:          *socket,
+		SocketName:      socketName,
+		ListenStream:    listenStream(*listen),
+	}
+	if *configPath != "" {
+		abs, err := filepath.Abs(*configPath)
+		if err != nil {
+			return err
+		}
+		unit.Args = append(unit.Args, "--config", abs)
+	}
+	if *user != "root" {
+		unit.Args = append(unit.Args, "--sudo")
+	}
+
+	content, err := renderUnit(serviceName, serviceTemplate, unit)
+	if err != nil {
+		return err
+	}
+	if err := writeUnit(filepath.Join(*unitDir, serviceName), content, *force); err != nil {
+		return err
+	}
+	if *socket {
+		content, err := renderUnit(socketName, socketTemplate, unit)
+		if err != nil {
+			return err
+		}
+		if err := writeUnit(filepath.Join(*unitDir, socketName), content, *force); err != nil {
+			return err
+		}
+	}
+
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	switch {
+	case *socket && *noStart:
+		return systemctl("enable", serviceName, socketName)
+	case *socket:
+		// The socket starts the service on demand
+		if err := systemctl("enable", serviceName); err != nil {
+			return err
+		}
+		return systemctl("enable", "--now", socketName)
+	case *noStart:
+		return systemctl("enable", serviceName)
+	default:
+		return systemctl("enable", "--now", serviceName)
+	}
+}
+
+// Function to handle "cosi uninstall-service", stopping and removing the unit
+func uninstallService(args []string) error {
+	fs := flag.NewFlagSet("uninstall-service", flag.ExitOnError)
+	unitDir := fs.String("unit-dir", "/etc/systemd/system", "Directory the unit was written to")
+	fs.Parse(args)
+
+	path := filepath.Join(*unitDir, serviceName)
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("%s is not installed: %w", serviceName, err)
+	}
+
+	units := []string{serviceName}
+	socketPath := filepath.Join(*unitDir, socketName)
+	if _, err := os.Stat(socketPath); err == nil {
+		units = append(units, socketName)
+	}
+	if err := systemctl(append([]string{"disable", "--now"}, units...)...); err != nil {
+		return err
+	}
+	for _, unit := range units {
+		unitPath := filepath.Join(*unitDir, unit)
+		if err := os.Remove(unitPath); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s\n", unitPath)
+	}
+	return systemctl("daemon-reload")
+}
+
+// Helper function to write a unit file, refusing to overwrite a different one
+// unless forced. The difference is printed so the operator can decide.
+func writeUnit(path, content string, force bool) error {
+	existing, err := os.ReadFile(path)
+	switch {
+	case err == nil && string(existing) == content:
+		fmt.Printf("%s is up to date\n", path)
+		return nil
+	case err == nil:
+		fmt.Printf("%s differs from the generated unit:\n%s", path, lineDiff(string(existing), content))
+		if !force {
+			return fmt.Errorf("not overwriting %s; rerun with --force", path)
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	fmt.Printf("Wrote %s\n", path)
+	return nil
+}
+
+// Helper function to run systemctl, passing its output through
+func systemctl(args ...string) error {
+	cmd := newCommand("systemctl", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := runTracked(cmd); err != nil {
+		return fmt.Errorf("systemctl %s: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// Function to produce a minimal line diff, prefixing removed lines with "-" and added lines with "+"
+func lineDiff(a, b string) string {
+	x := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	y := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			out.WriteString("  " + x[i] + "\n")
+			i++
+			j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			out.WriteString("- " + x[i] + "\n")
+			i++
+		default:
+			out.WriteString("+ " + y[j] + "\n")
+			j++
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// go test -run TestRenderUnit -update rewrites the golden units in testdata/units
+var updateGolden = flag.Bool("update", false, "rewrite golden files")
+
+// Helper function to compare got with a golden file in testdata
+func checkGolden(t *testing.T, path, got string) {
+	t.Helper()
+	path = filepath.Join("testdata", path)
+	if *updateGolden {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs:\n%s", path, lineDiff(string(want), got))
+	}
+}
+
+func TestRenderUnit(t *testing.T) {
+	tests := []struct {
+		golden   string
+		template string
+		unit     serviceUnit
+	}{
+		{"units/root.service", serviceTemplate, serviceUnit{
+			User:            "root",
+			EnvironmentFile: "/etc/default/cosi",
+			Executable:      "/usr/local/bin/cosi",
+			Args:            []string{"--listen", ":80", "--state-dir", "/var/lib/cosi"},
+			SocketName:      socketName,
+		}},
+		{"units/sudo-socket.service", serviceTemplate, serviceUnit{
+			User:            "cosi",
+			EnvironmentFile: "/etc/default/cosi",
+			Executable:      "/usr/local/bin/cosi",
+			Args:            []string{"--listen", ":8080", "--state-dir", "/var/lib/cosi", "--config", "/etc/cosi/config.yaml", "--sudo"},
+			Socket:          true,
+			SocketName:      socketName,
+			ListenStream:    listenStream(":8080"),
+		}},
+		{"units/cosi.socket", socketTemplate, serviceUnit{
+			Socket:       true,
+			SocketName:   socketName,
+			ListenStream: listenStream("10.0.0.5:8080"),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			got, err := renderUnit(tt.golden, tt.template, tt.unit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, tt.golden, got)
+		})
+	}
+}
+
+func TestListenStream(t *testing.T) {
+	for addr, want := range map[string]string{":80": "80", "0.0.0.0:8080": "0.0.0.0:8080", "[::1]:80": "[::1]:80"} {
+		if got := listenStream(addr); got != want {
+			t.Errorf("listenStream(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestWriteUnit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), serviceName)
+	if err := writeUnit(path, "[Unit]\nDescription=old\n", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeUnit(path, "[Unit]\nDescription=old\n", false); err != nil {
+		t.Errorf("rewriting an identical unit: %v", err)
+	}
+
+	if err := writeUnit(path, "[Unit]\nDescription=new\n", false); err == nil {
+		t.Error("overwrote a different unit without --force")
+	}
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), "old") {
+		t.Errorf("unit changed without --force: %q", data)
+	}
+
+	if err := writeUnit(path, "[Unit]\nDescription=new\n", true); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), "new") {
+		t.Errorf("unit not replaced with --force: %q", data)
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	got := lineDiff("a\nb\nc\n", "a\nB\nc\n")
+	want := "  a\n- b\n+ B\n  c\n"
+	if got != want {
+		t.Errorf("lineDiff = %q, want %q", got, want)
+	}
+}
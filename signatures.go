@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// Largest detached signature the agent will download; minisign signatures are a few hundred bytes
+	maxSignatureBytes = 4 << 10
+	// Directory of the trusted keys, next to the config file, unless signatures.trusted_keys_dir names another
+	defaultTrustedKeysDir = "trusted-keys"
+)
+
+// SignaturesConfig controls the detached signatures that remote manifests and updates
+// are checked against. Signatures are in the minisign format, and keys are minisign
+// public keys, one per *.pub file of the trusted keys directory.
+type SignaturesConfig struct {
+	// TrustedKeysDir is relative to the directory of the config file when it isn't absolute
+	TrustedKeysDir string `yaml:"trusted_keys_dir"`
+	// Required refuses manifests downloaded from a URL unless they come with a signature_url.
+	// Updates always need a signature, from update.public_key or the trusted keys.
+	Required bool `yaml:"required"`
+}
+
+// Helper function to resolve the trusted keys directory, or return "" when there is none
+func (s SignaturesConfig) keysDir() string {
+	dir := s.TrustedKeysDir
+	if dir == "" {
+		dir = defaultTrustedKeysDir
+	}
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	configPath := currentConfigStatus().Path
+	if configPath == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(configPath), dir)
+}
+
+// minisignKey is a trusted minisign public key
+type minisignKey struct {
+	ID   string
+	Key  ed25519.PublicKey
+	File string
+}
+
+// minisignSignature is a parsed minisign signature file
+type minisignSignature struct {
+	// Prehashed is set for signatures of the BLAKE2b-512 hash of the data rather than the
+	// data itself, which minisign makes of large files
+	Prehashed       bool
+	KeyID           string
+	Signature       []byte
+	TrustedComment  string
+	GlobalSignature []byte
+}
+
+// SignatureVerification describes a signature that verified
+type SignatureVerification struct {
+	KeyID string `json:"key_id"`
+	// TrustedComment is the signed comment of the signature, typically its timestamp and file name
+	TrustedComment string `json:"trusted_comment,omitempty"`
+}
+
+// signatureError reports a signature that is missing, can't be checked, or doesn't verify
+type signatureError struct {
+	Code    string
+	Message string
+}
+
+func (e *signatureError) Error() string {
+	return e.Message
+}
+
+// Helper function to format the 8-byte key ID of minisign the way minisign prints it
+func minisignKeyID(id []byte) string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id))
+}
+
+// Helper function to decode the base64 line of a minisign file, skipping its comments
+func minisignPayload(data []byte) ([]byte, error) {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		return base64.StdEncoding.DecodeString(line)
+	}
+	return nil, fmt.Errorf("no key found")
+}
+
+// Function to parse a minisign public key file
+func parseMinisignKey(data []byte) (ed25519.PublicKey, string, error) {
+	payload, err := minisignPayload(data)
+	if err != nil {
+		return nil, "", err
+	}
+	// Algorithm "Ed", key ID, then the Ed25519 key
+	if len(payload) != 2+8+ed25519.PublicKeySize || string(payload[:2]) != "Ed" {
+		return nil, "", fmt.Errorf("not a minisign Ed25519 public key")
+	}
+	return ed25519.PublicKey(payload[10:]), minisignKeyID(payload[2:10]), nil
+}
+
+// Function to parse a minisign signature file: an untrusted comment, the signature, a
+// trusted comment, and the global signature that covers the signature and trusted comment
+func parseMinisignSignature(data []byte) (*minisignSignature, error) {
+	lines := strings.Split(strings.TrimRight(string(data), "\r\n"), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "untrusted comment:") || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return nil, fmt.Errorf("not a minisign signature")
+	}
+	payload, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(payload) != 2+8+ed25519.SignatureSize {
+		return nil, fmt.Errorf("malformed signature line")
+	}
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("malformed global signature")
+	}
+	signature := &minisignSignature{
+		KeyID:           minisignKeyID(payload[2:10]),
+		Signature:       payload[10:],
+		TrustedComment:  strings.TrimRight(strings.TrimPrefix(lines[2], "trusted comment: "), "\r"),
+		GlobalSignature: global,
+	}
+	switch string(payload[:2]) {
+	case "Ed":
+	case "ED":
+		signature.Prehashed = true
+	default:
+		return nil, fmt.Errorf("unsupported signature algorithm %q", payload[:2])
+	}
+	return signature, nil
+}
+
+// Function to check a signature of data with key, including its trusted comment
+func (s *minisignSignature) verify(key ed25519.PublicKey, data []byte) bool {
+	message := data
+	if s.Prehashed {
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	}
+	if !ed25519.Verify(key, message, s.Signature) {
+		return false
+	}
+	return ed25519.Verify(key, append(append([]byte{}, s.Signature...), s.TrustedComment...), s.GlobalSignature)
+}
+
+// Function to load the trusted keys. Files that aren't minisign public keys are logged
+// and skipped, so one bad file doesn't disable the others.
+func trustedKeys() ([]minisignKey, error) {
+	dir := currentConfig().Signatures.keysDir()
+	if dir == "" {
+		return nil, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+	var keys []minisignKey
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, id, err := parseMinisignKey(data)
+		if err != nil {
+			log.Printf("Warning: skipping trusted key %s: %v", path, err)
+			continue
+		}
+		keys = append(keys, minisignKey{ID: id, Key: key, File: path})
+	}
+	return keys, nil
+}
+
+// Function to download the signature at signatureURL and check data against the trusted
+// keys. subject describes the data in errors and the audit log. Without a signatureURL
+// data is only refused when required is set. Every check that runs is audited, failures
+// with the key IDs that were trusted and the one the signature names.
+func verifyDetachedSignature(data []byte, subject, signatureURL string, required bool) (*SignatureVerification, error) {
+	if signatureURL == "" && !required {
+		return nil, nil
+	}
+	details := map[string]interface{}{"subject": subject}
+	var verified *SignatureVerification
+	var err error
+	if signatureURL == "" {
+		err = &signatureError{Code: "signature_required", Message: subject + " must be signed; set signature_url"}
+	} else {
+		details["signature_url"] = signatureURL
+		verified, err = checkDetachedSignature(data, subject, signatureURL, details)
+	}
+	if auditErr := audit.Record(auditOutcome("signature.verify", "", details, err)); auditErr != nil {
+		log.Printf("Warning: unable to audit the signature of %s: %v", subject, auditErr)
+	}
+	return verified, err
+}
+
+// Helper function to download and check a signature, filling in the audit details
+func checkDetachedSignature(data []byte, subject, signatureURL string, details map[string]interface{}) (*SignatureVerification, error) {
+	keys, err := trustedKeys()
+	if err != nil {
+		return nil, &signatureError{Code: "signature_unverifiable", Message: "Unable to load the trusted keys: " + err.Error()}
+	}
+	expected := make([]string, len(keys))
+	for i, key := range keys {
+		expected[i] = key.ID
+	}
+	sort.Strings(expected)
+	details["expected_key_ids"] = expected
+	if len(keys) == 0 {
+		return nil, &signatureError{Code: "signature_unverifiable", Message: "No trusted keys are configured; see signatures.trusted_keys_dir"}
+	}
+
+	body, err := downloadSignature(signatureURL)
+	if err != nil {
+		return nil, &signatureError{Code: "signature_fetch_failed", Message: err.Error()}
+	}
+	signature, err := parseMinisignSignature(body)
+	if err != nil {
+		return nil, &signatureError{Code: "signature_malformed", Message: fmt.Sprintf("%s: %v", signatureURL, err)}
+	}
+	details["found_key_id"] = signature.KeyID
+	for _, key := range keys {
+		if key.ID != signature.KeyID {
+			continue
+		}
+		if !signature.verify(key.Key, data) {
+			return nil, &signatureError{Code: "signature_invalid", Message: fmt.Sprintf("The signature by key %s does not match %s", key.ID, subject)}
+		}
+		details["key_file"] = key.File
+		return &SignatureVerification{KeyID: key.ID, TrustedComment: signature.TrustedComment}, nil
+	}
+	return nil, &signatureError{
+		Code:    "signature_untrusted_key",
+		Message: fmt.Sprintf("%s is signed by key %s, which is not trusted; trusted keys are %s", subject, signature.KeyID, strings.Join(expected, ", ")),
+	}
+}
+
+// Helper function to download a detached signature
+func downloadSignature(signatureURL string) ([]byte, error) {
+	if !strings.HasPrefix(signatureURL, "http://") && !strings.HasPrefix(signatureURL, "https://") {
+		return nil, fmt.Errorf("signature_url must be http or https")
+	}
+	resp, err := manifestClient.Get(signatureURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", signatureURL, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSignatureBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSignatureBytes {
+		return nil, fmt.Errorf("signature is larger than %d bytes", maxSignatureBytes)
+	}
+	return body, nil
+}
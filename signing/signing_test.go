@@ -0,0 +1,114 @@
+package signing
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const emptyBodyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Signatures computed independently of this package, so a change to the
+// canonicalization breaks every client and shows up here
+func TestSignVectors(t *testing.T) {
+	secret := []byte("node-secret")
+	tests := []struct {
+		method, target string
+		body           []byte
+		want           string
+	}{
+		{"GET", "/events?type=job&limit=5", nil, "7957d1f168d5497446eb06149e711487a07ebd48146e30e81726cee5691c70f9"},
+		{"get", "/events?type=job&limit=5", []byte{}, "7957d1f168d5497446eb06149e711487a07ebd48146e30e81726cee5691c70f9"},
+		{"POST", "/packages/diff", []byte("packages: {}\n"), "0e55e26d3c0d9ed1f62cd1c71ae432006fce8a139e9ed93c2ae93482ce0d5e11"},
+		{"GET", "/files?path=%2Fetc%2Fhosts", nil, "b0370382f47237afc83bbb78ae8a687d1a4d2e31141af646af009a5337c79f4b"},
+	}
+	for _, tt := range tests {
+		got := Sign(secret, tt.method, tt.target, "1760611200", tt.body)
+		if got != tt.want {
+			t.Errorf("Sign(%s %s) = %s, want %s", tt.method, tt.target, got, tt.want)
+		}
+		if !Verify(secret, tt.method, tt.target, "1760611200", tt.body, strings.ToUpper(got)) {
+			t.Errorf("Verify(%s %s) refused its own signature in upper case", tt.method, tt.target)
+		}
+	}
+}
+
+// The example in the package documentation
+func TestCanonicalStringExample(t *testing.T) {
+	want := "GET\n/events?type=job&limit=5\n1760611200\n" + emptyBodyHash
+	if got := CanonicalString("GET", "/events?type=job&limit=5", "1760611200", nil); got != want {
+		t.Errorf("canonical string = %q, want %q", got, want)
+	}
+}
+
+func TestTarget(t *testing.T) {
+	tests := map[string]string{
+		"http://agent/events":                      "/events",
+		"http://agent/events?":                     "/events",
+		"http://agent/events?type=job&limit=5":     "/events?type=job&limit=5",
+		"http://agent/events?limit=5&type=job":     "/events?limit=5&type=job",
+		"http://agent/files?path=%2Fetc%2Fhosts":   "/files?path=%2Fetc%2Fhosts",
+		"http://agent/ssh/keys/SHA256:abc%2Bdef=":  "/ssh/keys/SHA256:abc%2Bdef=",
+		"http://agent/search?q=a+b&q=c&flag":       "/search?q=a+b&q=c&flag",
+		"http://agent":                             "/",
+		"http://agent/packages/kube%20let/history": "/packages/kube%20let/history",
+	}
+	for url, want := range tests {
+		if got := Target(httptest.NewRequest("GET", url, nil)); got != want {
+			t.Errorf("Target(%s) = %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestVerifyRejectsChanges(t *testing.T) {
+	secret := []byte("node-secret")
+	signature := Sign(secret, "GET", "/events?type=job&limit=5", "1760611200", nil)
+	for _, tt := range []struct {
+		name                      string
+		secret                    string
+		method, target, timestamp string
+		body                      string
+	}{
+		{"secret", "other-secret", "GET", "/events?type=job&limit=5", "1760611200", ""},
+		{"method", "node-secret", "DELETE", "/events?type=job&limit=5", "1760611200", ""},
+		{"reordered query", "node-secret", "GET", "/events?limit=5&type=job", "1760611200", ""},
+		{"dropped query", "node-secret", "GET", "/events", "1760611200", ""},
+		{"empty query", "node-secret", "GET", "/events?", "1760611200", ""},
+		{"timestamp", "node-secret", "GET", "/events?type=job&limit=5", "1760611201", ""},
+		{"body", "node-secret", "GET", "/events?type=job&limit=5", "1760611200", "{}"},
+	} {
+		if Verify([]byte(tt.secret), tt.method, tt.target, tt.timestamp, []byte(tt.body), signature) {
+			t.Errorf("changed %s still verifies", tt.name)
+		}
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	now := time.Unix(1760611200, 0)
+	req := httptest.NewRequest("POST", "http://agent/packages/diff", strings.NewReader("packages: {}\n"))
+	if err := SignRequest(req, "ci", []byte("node-secret"), now); err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get(HeaderKeyID) != "ci" || req.Header.Get(HeaderTimestamp) != "1760611200" {
+		t.Errorf("headers = %v", req.Header)
+	}
+	if got := req.Header.Get(HeaderSignature); got != "0e55e26d3c0d9ed1f62cd1c71ae432006fce8a139e9ed93c2ae93482ce0d5e11" {
+		t.Errorf("signature = %s", got)
+	}
+	// The body can still be sent after signing
+	if body, _ := io.ReadAll(req.Body); string(body) != "packages: {}\n" {
+		t.Errorf("body after signing = %q", body)
+	}
+
+	// Requests without a body sign the hash of the empty body
+	req = httptest.NewRequest("GET", "http://agent/events?type=job&limit=5", nil)
+	req.Body = nil
+	if err := SignRequest(req, "ci", []byte("node-secret"), now); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get(HeaderSignature); got != "7957d1f168d5497446eb06149e711487a07ebd48146e30e81726cee5691c70f9" {
+		t.Errorf("signature without a body = %s", got)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sysBlockDir = "/sys/block"
+	// smartctl runs at once, and how long each may take; USB bridges can be slow to answer
+	smartConcurrency = 4
+	smartTimeout     = 30 * time.Second
+)
+
+// Block devices that are never physical disks
+var virtualBlockPrefixes = []string{"loop", "ram", "zram", "dm-", "md", "sr", "nbd", "zd", "rbd", "fd"}
+
+var selfTestMinutes = regexp.MustCompile(`Please wait (\d+) minutes`)
+
+// errSmartctlMissing is returned when smartmontools isn't installed
+var errSmartctlMissing = errors.New("smartctl is not installed; install smartmontools")
+
+// SmartDisk is the health summary of one physical disk
+type SmartDisk struct {
+	Device        string `json:"device"`
+	Path          string `json:"path"`
+	Transport     string `json:"transport"` // nvme, usb, ata, or virtual
+	Model         string `json:"model,omitempty"`
+	Serial        string `json:"serial,omitempty"`
+	Firmware      string `json:"firmware,omitempty"`
+	CapacityBytes uint64 `json:"capacity_bytes,omitempty"`
+	Health        string `json:"health"` // passed, failed, or unknown
+	PowerOnHours  *int64 `json:"power_on_hours,omitempty"`
+	TemperatureC  *int64 `json:"temperature_c,omitempty"`
+	// ATA attributes
+	ReallocatedSectors   *int64 `json:"reallocated_sectors,omitempty"`
+	PendingSectors       *int64 `json:"pending_sectors,omitempty"`
+	OfflineUncorrectable *int64 `json:"offline_uncorrectable,omitempty"`
+	// NVMe health log
+	MediaErrors           *int64         `json:"media_errors,omitempty"`
+	PercentageUsed        *int64         `json:"percentage_used,omitempty"`
+	AvailableSparePercent *int64         `json:"available_spare_percent,omitempty"`
+	CriticalWarning       *int64         `json:"critical_warning,omitempty"`
+	SelfTest              *SmartSelfTest `json:"self_test,omitempty"`
+	Messages              []string       `json:"messages,omitempty"`
+	Error                 string         `json:"error,omitempty"`
+}
+
+// SmartSelfTest reports the running or last self-test
+type SmartSelfTest struct {
+	Running          bool   `json:"running"`
+	Status           string `json:"status,omitempty"`
+	RemainingPercent *int64 `json:"remaining_percent,omitempty"`
+}
+
+// SmartReport is the response of GET /disk/smart
+type SmartReport struct {
+	Disks           []SmartDisk `json:"disks"`
+	SmartctlMissing bool        `json:"smartctl_missing,omitempty"`
+	Note            string      `json:"note,omitempty"`
+}
+
+// smartctlOutput holds the parts of `smartctl --json` output the agent uses
+type smartctlOutput struct {
+	Smartctl struct {
+		Messages []struct {
+			String   string `json:"string"`
+			Severity string `json:"severity"`
+		} `json:"messages"`
+	} `json:"smartctl"`
+	ModelName       string `json:"model_name"`
+	SerialNumber    string `json:"serial_number"`
+	FirmwareVersion string `json:"firmware_version"`
+	UserCapacity    struct {
+		Bytes uint64 `json:"bytes"`
+	} `json:"user_capacity"`
+	SmartStatus *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	PowerOnTime *struct {
+		Hours int64 `json:"hours"`
+	} `json:"power_on_time"`
+	Temperature *struct {
+		Current int64 `json:"current"`
+	} `json:"temperature"`
+	ATASmartAttributes struct {
+		Table []struct {
+			ID  int `json:"id"`
+			Raw struct {
+				Value int64 `json:"value"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+	ATASmartData struct {
+		SelfTest *struct {
+			Status struct {
+				Value            int    `json:"value"`
+				String           string `json:"string"`
+				RemainingPercent *int64 `json:"remaining_percent"`
+			} `json:"status"`
+		} `json:"self_test"`
+	} `json:"ata_smart_data"`
+	NVMeHealth *struct {
+		CriticalWarning int64 `json:"critical_warning"`
+		AvailableSpare  int64 `json:"available_spare"`
+		PercentageUsed  int64 `json:"percentage_used"`
+		MediaErrors     int64 `json:"media_errors"`
+	} `json:"nvme_smart_health_information_log"`
+	NVMeSelfTestLog *struct {
+		CurrentOperation struct {
+			Value  int    `json:"value"`
+			String string `json:"string"`
+		} `json:"current_self_test_operation"`
+		CompletionPercent *int64 `json:"current_self_test_completion_percent"`
+		Table             []struct {
+			Result struct {
+				String string `json:"string"`
+			} `json:"self_test_result"`
+		} `json:"table"`
+	} `json:"nvme_self_test_log"`
+}
+
+// Function to find the physical disks in /sys/block
+func physicalDisks() ([]SmartDisk, error) {
+	entries, err := os.ReadDir(sysBlockDir)
+	if err != nil {
+		return nil, err
+	}
+	var disks []SmartDisk
+	for _, entry := range entries {
+		name := entry.Name()
+		if virtualBlockDevice(name) {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(filepath.Join(sysBlockDir, name, "device"))
+		if err != nil {
+			continue // no backing device
+		}
+		disk := SmartDisk{Device: name, Path: "/dev/" + name, Health: "unknown"}
+		switch {
+		case strings.HasPrefix(name, "nvme"):
+			disk.Transport = "nvme"
+		case strings.Contains(resolved, "/usb"):
+			disk.Transport = "usb"
+		case strings.Contains(resolved, "/virtio") || strings.HasPrefix(name, "vd") || strings.HasPrefix(name, "xvd"):
+			disk.Transport = "virtual"
+		default:
+			disk.Transport = "ata"
+		}
+		disks = append(disks, disk)
+	}
+	sort.Slice(disks, func(i, j int) bool { return disks[i].Device < disks[j].Device })
+	return disks, nil
+}
+
+// Helper function to check a /sys/block name against the virtual device prefixes
+func virtualBlockDevice(name string) bool {
+	for _, prefix := range virtualBlockPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function to build the smartctl arguments for a disk. USB bridges only
+// pass SMART commands through with SAT translation.
+func smartctlArgs(disk SmartDisk, args ...string) []string {
+	switch disk.Transport {
+	case "usb":
+		args = append(args, "-d", "sat")
+	case "nvme":
+		args = append(args, "-d", "nvme")
+	}
+	return append(args, disk.Path)
+}
+
+// Function to run smartctl for a disk. Its exit status is a bit mask where only the
+// two lowest bits mean the command itself failed; the others describe the disk.
+func runSmartctl(ctx context.Context, disk SmartDisk, args ...string) (CommandResult, error) {
+	cmd := newPrivilegedCommandContext(ctx, nil, "smartctl", smartctlArgs(disk, args...)...)
+	result, err := runCommand(cmd)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode()&0x3 == 0 {
+		err = nil
+	}
+	if err != nil {
+		return result, &commandError{Tool: "smartctl", Result: result, Err: err}
+	}
+	return result, nil
+}
+
+// Function to collect SMART health for every physical disk
+func collectSmart() (*SmartReport, error) {
+	disks, err := physicalDisks()
+	if err != nil {
+		return nil, err
+	}
+	report := &SmartReport{Disks: []SmartDisk{}}
+	if _, err := exec.LookPath("smartctl"); err != nil {
+		report.SmartctlMissing = true
+		report.Note = errSmartctlMissing.Error()
+		report.Disks = append(report.Disks, disks...)
+		return report, nil
+	}
+
+	tasks := make([]task, len(disks))
+	for i, disk := range disks {
+		disk := disk
+		tasks[i] = task{Name: disk.Device, Run: func(ctx context.Context) (interface{}, error) {
+			return readSmart(ctx, disk), nil
+		}}
+	}
+	for i, result := range fanOut(context.Background(), tasks, smartConcurrency, smartTimeout) {
+		if result.Err != nil {
+			disks[i].Error = result.Err.Error()
+			report.Disks = append(report.Disks, disks[i])
+			continue
+		}
+		report.Disks = append(report.Disks, result.Value.(SmartDisk))
+	}
+	return report, nil
+}
+
+// Function to read and summarize the SMART data of one disk
+func readSmart(ctx context.Context, disk SmartDisk) SmartDisk {
+	if disk.Transport == "virtual" {
+		disk.Error = "virtual disks have no SMART data"
+		return disk
+	}
+	result, err := runSmartctl(ctx, disk, "--json=c", "-a")
+	var output smartctlOutput
+	if jsonErr := json.Unmarshal([]byte(result.Stdout), &output); jsonErr != nil {
+		if err == nil {
+			err = fmt.Errorf("parsing smartctl output: %w", jsonErr)
+		}
+		disk.Error = err.Error()
+		return disk
+	}
+	for _, message := range output.Smartctl.Messages {
+		disk.Messages = append(disk.Messages, message.String)
+	}
+	if err != nil {
+		disk.Error = err.Error()
+	}
+
+	disk.Model = output.ModelName
+	disk.Serial = output.SerialNumber
+	disk.Firmware = output.FirmwareVersion
+	disk.CapacityBytes = output.UserCapacity.Bytes
+	if output.SmartStatus != nil {
+		disk.Health = "failed"
+		if output.SmartStatus.Passed {
+			disk.Health = "passed"
+		}
+	}
+	if output.PowerOnTime != nil {
+		disk.PowerOnHours = &output.PowerOnTime.Hours
+	}
+	if output.Temperature != nil {
+		disk.TemperatureC = &output.Temperature.Current
+	}
+	for _, attribute := range output.ATASmartAttributes.Table {
+		value := attribute.Raw.Value
+		switch attribute.ID {
+		case 5:
+			disk.ReallocatedSectors = &value
+		case 197:
+			disk.PendingSectors = &value
+		case 198:
+			disk.OfflineUncorrectable = &value
+		}
+	}
+	if health := output.NVMeHealth; health != nil {
+		disk.MediaErrors = &health.MediaErrors
+		disk.PercentageUsed = &health.PercentageUsed
+		disk.AvailableSparePercent = &health.AvailableSpare
+		disk.CriticalWarning = &health.CriticalWarning
+	}
+	disk.SelfTest = selfTestStatus(&output)
+	return disk
+}
+
+// Function to describe the running or last self-test from smartctl output
+func selfTestStatus(output *smartctlOutput) *SmartSelfTest {
+	if test := output.ATASmartData.SelfTest; test != nil {
+		// Status values 0xf0 to 0xff mean a test is in progress
+		return &SmartSelfTest{
+			Running:          test.Status.Value>>4 == 0xf,
+			Status:           test.Status.String,
+			RemainingPercent: test.Status.RemainingPercent,
+		}
+	}
+	if log := output.NVMeSelfTestLog; log != nil {
+		status := &SmartSelfTest{Running: log.CurrentOperation.Value != 0}
+		if status.Running {
+			status.Status = log.CurrentOperation.String
+			if log.CompletionPercent != nil {
+				remaining := 100 - *log.CompletionPercent
+				status.RemainingPercent = &remaining
+			}
+		} else if len(log.Table) > 0 {
+			status.Status = log.Table[0].Result.String
+		}
+		return status
+	}
+	return nil
+}
+
+// Function to start a short self-test on one of the physical disks
+func startSelfTest(device string) (map[string]interface{}, error) {
+	if _, err := exec.LookPath("smartctl"); err != nil {
+		return nil, &requestError{501, "smartctl_missing", errSmartctlMissing.Error()}
+	}
+	disks, err := physicalDisks()
+	if err != nil {
+		return nil, err
+	}
+	device = strings.TrimPrefix(device, "/dev/")
+	var disk *SmartDisk
+	for i := range disks {
+		if disks[i].Device == device {
+			disk = &disks[i]
+		}
+	}
+	if disk == nil {
+		return nil, &requestError{404, "disk_not_found", device + " is not a physical disk"}
+	}
+	if disk.Transport == "virtual" {
+		return nil, &requestError{422, "smart_unsupported", "virtual disks have no SMART self-tests"}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), smartTimeout)
+	defer cancel()
+	current := readSmart(ctx, *disk)
+	if current.SelfTest != nil && current.SelfTest.Running {
+		return nil, &requestError{409, "selftest_running", "a self-test is already running on " + device}
+	}
+	result, err := runSmartctl(ctx, *disk, "-t", "short")
+	if err != nil {
+		return nil, err
+	}
+
+	response := map[string]interface{}{"device": device, "started": true, "test": "short"}
+	if match := selfTestMinutes.FindStringSubmatch(result.Stdout); match != nil {
+		minutes, _ := strconv.Atoi(match[1])
+		response["expected_minutes"] = minutes
+	}
+	return response, nil
+}
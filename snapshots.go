@@ -0,0 +1,384 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Most package snapshots kept; creating one more evicts the least recently used
+const maxPackageSnapshots = 32
+
+// Snapshot names are labels for people, like before-upgrade or 2024-06-01
+var snapshotName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,63}$`)
+
+// PackageSnapshotInfo describes a stored snapshot of the installed packages
+type PackageSnapshotInfo struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name,omitempty"`
+	PackageManager string    `json:"package_manager"`
+	CreatedAt      time.Time `json:"created_at"`
+	// LastUsedAt is when the snapshot was created or last diffed against, which decides
+	// the eviction order
+	LastUsedAt   time.Time `json:"last_used_at"`
+	PackageCount int       `json:"package_count"`
+	// Hash is the SHA-256 of the package set, equal for snapshots of the same packages
+	Hash string `json:"hash"`
+}
+
+// PackageSnapshotRequest is the optional body of POST /packages/snapshots
+type PackageSnapshotRequest struct {
+	Name string `json:"name"`
+}
+
+// SnapshotChange is a package added, removed, or changed since a snapshot. Before is
+// empty for added packages and After for removed ones.
+type SnapshotChange struct {
+	Name   string `json:"name"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// SnapshotDiff is the response of GET /packages/diff-since/:snapshot_id
+type SnapshotDiff struct {
+	Snapshot       PackageSnapshotInfo `json:"snapshot"`
+	Changed        bool                `json:"changed"`
+	CurrentHash    string              `json:"current_hash"`
+	Added          []SnapshotChange    `json:"added"`
+	Removed        []SnapshotChange    `json:"removed"`
+	VersionChanged []SnapshotChange    `json:"version_changed"`
+	Summary        map[string]int      `json:"summary"`
+}
+
+// snapshotStore keeps the package snapshots in the state directory: an index of their
+// metadata and a gzipped file of name and version pairs for each
+type snapshotStore struct {
+	mu        sync.Mutex
+	snapshots map[string]*PackageSnapshotInfo
+}
+
+var packageSnapshots = &snapshotStore{snapshots: make(map[string]*PackageSnapshotInfo)}
+
+// Helper function to return the directory holding the snapshots
+func snapshotDir() string {
+	return filepath.Join(stateDir, "snapshots")
+}
+
+// Load reads the index of the snapshots taken before the agent restarted
+func (s *snapshotStore) Load() {
+	data, err := os.ReadFile(filepath.Join(snapshotDir(), "index.json"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: unable to read the package snapshots: %v", err)
+		}
+		return
+	}
+	var saved []*PackageSnapshotInfo
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("Warning: ignoring the unreadable package snapshot index: %v", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, info := range saved {
+		s.snapshots[info.ID] = info
+	}
+}
+
+// save persists the index. Callers must hold s.mu.
+func (s *snapshotStore) save() {
+	data, err := json.Marshal(s.sorted())
+	if err == nil {
+		err = writeStateFile(filepath.Join(snapshotDir(), "index.json"), data)
+	}
+	if err != nil {
+		log.Printf("Warning: unable to persist the package snapshot index: %v", err)
+	}
+}
+
+// sorted returns the snapshots oldest first. Callers must hold s.mu.
+func (s *snapshotStore) sorted() []PackageSnapshotInfo {
+	list := make([]PackageSnapshotInfo, 0, len(s.snapshots))
+	for _, info := range s.snapshots {
+		list = append(list, *info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// List returns the snapshots oldest first
+func (s *snapshotStore) List() []PackageSnapshotInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sorted()
+}
+
+// Create stores the package versions as a new snapshot, evicting the least recently
+// used snapshots beyond maxPackageSnapshots
+func (s *snapshotStore) Create(name, manager string, versions map[string]string) (PackageSnapshotInfo, error) {
+	now := time.Now().UTC()
+	info := &PackageSnapshotInfo{
+		ID:             newID(),
+		Name:           name,
+		PackageManager: manager,
+		CreatedAt:      now,
+		LastUsedAt:     now,
+		PackageCount:   len(versions),
+		Hash:           packageSetHash(versions),
+	}
+	if err := writeSnapshotFile(snapshotFile(info.ID), versions); err != nil {
+		return PackageSnapshotInfo{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots[info.ID] = info
+	for len(s.snapshots) > maxPackageSnapshots {
+		var oldest *PackageSnapshotInfo
+		for _, candidate := range s.snapshots {
+			if oldest == nil || candidate.LastUsedAt.Before(oldest.LastUsedAt) {
+				oldest = candidate
+			}
+		}
+		delete(s.snapshots, oldest.ID)
+		os.Remove(snapshotFile(oldest.ID))
+	}
+	s.save()
+	return *info, nil
+}
+
+// Use reads a snapshot's package versions, marking it as recently used
+func (s *snapshotStore) Use(id string) (PackageSnapshotInfo, map[string]string, error) {
+	s.mu.Lock()
+	info, ok := s.snapshots[id]
+	if !ok {
+		s.mu.Unlock()
+		return PackageSnapshotInfo{}, nil, &requestError{404, "snapshot_not_found", "Snapshot " + id + " was not found; it may have been evicted"}
+	}
+	info.LastUsedAt = time.Now().UTC()
+	s.save()
+	snapshot := *info
+	s.mu.Unlock()
+
+	versions, err := readSnapshotFile(snapshotFile(id))
+	if err != nil {
+		return snapshot, nil, fmt.Errorf("reading snapshot %s: %w", id, err)
+	}
+	return snapshot, versions, nil
+}
+
+// Delete removes a snapshot, reporting whether there was one
+func (s *snapshotStore) Delete(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.snapshots[id]; !ok {
+		return false
+	}
+	delete(s.snapshots, id)
+	os.Remove(snapshotFile(id))
+	s.save()
+	return true
+}
+
+// Helper function to return the path of a snapshot's package versions
+func snapshotFile(id string) string {
+	return filepath.Join(snapshotDir(), id+".json.gz")
+}
+
+// Helper function to write package versions gzipped, replacing the file atomically
+func writeSnapshotFile(path string, versions map[string]string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	compressed := gzip.NewWriter(file)
+	err = json.NewEncoder(compressed).Encode(versions)
+	if closeErr := compressed.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Helper function to read the package versions written by writeSnapshotFile
+func readSnapshotFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	compressed, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	var versions map[string]string
+	if err := json.NewDecoder(compressed).Decode(&versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// Helper function to hash a package set independently of map order
+func packageSetHash(versions map[string]string) string {
+	names := make([]string, 0, len(versions))
+	for name := range versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hash := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s %s\n", name, versions[name])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Function to compare the installed packages with a snapshot
+func diffSinceSnapshot(ctx context.Context, pm packageManager, id string) (*SnapshotDiff, error) {
+	snapshot, before, err := packageSnapshots.Use(id)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.PackageManager != pm.Name() {
+		return nil, &requestError{409, "snapshot_incompatible", fmt.Sprintf("Snapshot %s was taken with %s, not %s", id, snapshot.PackageManager, pm.Name())}
+	}
+	after, err := installedVersions(ctx, pm)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &SnapshotDiff{
+		Snapshot:       snapshot,
+		CurrentHash:    packageSetHash(after),
+		Added:          []SnapshotChange{},
+		Removed:        []SnapshotChange{},
+		VersionChanged: []SnapshotChange{},
+	}
+	for name, version := range after {
+		previous, ok := before[name]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, SnapshotChange{Name: name, After: version})
+		case previous != version:
+			diff.VersionChanged = append(diff.VersionChanged, SnapshotChange{Name: name, Before: previous, After: version})
+		}
+	}
+	for name, version := range before {
+		if _, ok := after[name]; !ok {
+			diff.Removed = append(diff.Removed, SnapshotChange{Name: name, Before: version})
+		}
+	}
+	for _, changes := range [][]SnapshotChange{diff.Added, diff.Removed, diff.VersionChanged} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	}
+	diff.Changed = len(diff.Added)+len(diff.Removed)+len(diff.VersionChanged) > 0
+	diff.Summary = map[string]int{
+		"added":           len(diff.Added),
+		"removed":         len(diff.Removed),
+		"version_changed": len(diff.VersionChanged),
+	}
+	return diff, nil
+}
+
+// Helper function to respond with the changes since a snapshot, for GET
+// /packages/diff-since/:snapshot_id and GET /packages?since=
+func respondDiffSince(c *gin.Context, id string) {
+	pm, err := hostPackageManager()
+	if errors.Is(err, errUnsupportedOS) {
+		c.JSON(400, gin.H{"error": "Unsupported operating system"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Unable to determine the operating system"})
+		return
+	}
+	diff, err := diffSinceSnapshot(c.Request.Context(), pm, id)
+	if err != nil {
+		respondFailure(c, "Failed to compare the packages with snapshot "+id, err)
+		return
+	}
+	c.JSON(200, diff)
+}
+
+// Function to register the package snapshot endpoints
+func registerSnapshotRoutes(r *gin.Engine) {
+	// Define the /packages/snapshots endpoint that records the installed packages and
+	// their versions for later comparison
+	r.POST("/packages/snapshots", func(c *gin.Context) {
+		var request PackageSnapshotRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&request); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid request format: " + err.Error()})
+				return
+			}
+		}
+		if request.Name != "" && !snapshotName.MatchString(request.Name) {
+			c.JSON(400, gin.H{"error": "name must be up to 64 letters, digits, and . _ : -", "code": "invalid_snapshot_name"})
+			return
+		}
+		pm, err := hostPackageManager()
+		if errors.Is(err, errUnsupportedOS) {
+			c.JSON(400, gin.H{"error": "Unsupported operating system"})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Unable to determine the operating system"})
+			return
+		}
+		versions, err := installedVersions(c.Request.Context(), pm)
+		if err != nil {
+			respondFailure(c, "Failed to get installed packages", err)
+			return
+		}
+		info, err := packageSnapshots.Create(request.Name, pm.Name(), versions)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Unable to store the snapshot: " + err.Error()})
+			return
+		}
+		c.JSON(201, info)
+	})
+
+	// Define the /packages/snapshots endpoint that lists the stored snapshots
+	r.GET("/packages/snapshots", func(c *gin.Context) {
+		c.JSON(200, gin.H{"snapshots": packageSnapshots.List(), "max_snapshots": maxPackageSnapshots})
+	})
+
+	// Define the /packages/snapshots/:id endpoint that deletes a snapshot
+	r.DELETE("/packages/snapshots/:id", func(c *gin.Context) {
+		if !packageSnapshots.Delete(c.Param("id")) {
+			c.JSON(404, gin.H{"error": "Snapshot " + c.Param("id") + " was not found", "code": "snapshot_not_found"})
+			return
+		}
+		c.JSON(200, gin.H{"deleted": c.Param("id")})
+	})
+
+	// Define the /packages/diff-since endpoint that reports the packages added, removed,
+	// and changed since a snapshot
+	r.GET("/packages/diff-since/:snapshot_id", func(c *gin.Context) {
+		respondDiffSince(c, c.Param("snapshot_id"))
+	})
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Scope of the tokens that may add and remove authorized keys
+const scopeSSH = "ssh"
+
+// sshKeysLock serializes changes to authorized_keys files
+var sshKeysLock sync.Mutex
+
+// AuthorizedKey is one parsed line of an authorized_keys file
+type AuthorizedKey struct {
+	Type        string   `json:"type"`
+	Key         string   `json:"key"` // base64 public key blob
+	Comment     string   `json:"comment,omitempty"`
+	Options     []string `json:"options,omitempty"`
+	Fingerprint string   `json:"fingerprint"`
+	Line        int      `json:"line"`
+}
+
+// AuthorizedKeys is the response of GET /ssh/keys
+type AuthorizedKeys struct {
+	User string          `json:"user"`
+	Path string          `json:"path"`
+	Keys []AuthorizedKey `json:"keys"`
+	// Lines that aren't comments but couldn't be parsed; they are kept as they are on writes
+	UnparsedLines []int `json:"unparsed_lines,omitempty"`
+}
+
+// SSHKeyRequest is the body of POST /ssh/keys
+type SSHKeyRequest struct {
+	User string `json:"user" binding:"required"`
+	// Key is an authorized_keys line: optional options, type, key, and comment
+	Key string `json:"key" binding:"required"`
+}
+
+// SSHKeyChange is the response of POST /ssh/keys and DELETE /ssh/keys
+type SSHKeyChange struct {
+	User    string        `json:"user"`
+	Path    string        `json:"path"`
+	Key     AuthorizedKey `json:"key"`
+	Changed bool          `json:"changed"`
+}
+
+// authorizedKeysFile locates a user's authorized_keys and who owns it
+type authorizedKeysFile struct {
+	User string
+	Dir  string
+	Path string
+	UID  int
+	GID  int
+}
+
+// Function to look up the authorized_keys file of a user
+func lookupAuthorizedKeys(username string) (*authorizedKeysFile, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, &requestError{404, "user_not_found", err.Error()}
+	}
+	if u.HomeDir == "" || u.HomeDir == "/" || u.HomeDir == "/nonexistent" {
+		return nil, &requestError{422, "no_home_directory", username + " has no home directory"}
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	dir := filepath.Join(u.HomeDir, ".ssh")
+	return &authorizedKeysFile{User: username, Dir: dir, Path: filepath.Join(dir, "authorized_keys"), UID: uid, GID: gid}, nil
+}
+
+// Function to read and parse the file. A missing file has no keys.
+func (f *authorizedKeysFile) read() ([]string, *AuthorizedKeys, error) {
+	result := &AuthorizedKeys{User: f.User, Path: f.Path, Keys: []AuthorizedKey{}}
+	if err := f.checkNotSymlink(); err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil, result, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		key, err := parseAuthorizedKey(trimmed)
+		if err != nil {
+			result.UnparsedLines = append(result.UnparsedLines, i+1)
+			continue
+		}
+		key.Line = i + 1
+		result.Keys = append(result.Keys, *key)
+	}
+	return lines, result, nil
+}
+
+// Function to write the lines back atomically, creating ~/.ssh with the
+// permissions sshd insists on when it's missing
+func (f *authorizedKeysFile) write(lines []string) error {
+	if _, err := os.Lstat(f.Dir); os.IsNotExist(err) {
+		if err := os.Mkdir(f.Dir, 0700); err != nil {
+			return err
+		}
+		if err := os.Chown(f.Dir, f.UID, f.GID); err != nil {
+			return err
+		}
+	}
+	if err := f.checkNotSymlink(); err != nil {
+		return err
+	}
+
+	content := ""
+	if len(lines) > 0 {
+		content = strings.Join(lines, "\n") + "\n"
+	}
+	staged, err := stageFile(f.Path, []byte(content), 0600, f.UID, f.GID)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(staged, f.Path); err != nil {
+		os.Remove(staged)
+		return err
+	}
+	syncDir(f.Dir)
+	return nil
+}
+
+// Helper function to refuse symlinks, which would let the user point the
+// agent's writes at a file they don't own
+func (f *authorizedKeysFile) checkNotSymlink() error {
+	for _, path := range []string{f.Dir, f.Path} {
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return &requestError{409, "symlink_refused", path + " is a symlink"}
+		}
+	}
+	return nil
+}
+
+// Function to parse one authorized_keys line
+func parseAuthorizedKey(line string) (*AuthorizedKey, error) {
+	publicKey, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(rest))) > 0 {
+		return nil, fmt.Errorf("expected a single key")
+	}
+	return &AuthorizedKey{
+		Type:        publicKey.Type(),
+		Key:         base64.StdEncoding.EncodeToString(publicKey.Marshal()),
+		Comment:     comment,
+		Options:     options,
+		Fingerprint: ssh.FingerprintSHA256(publicKey),
+	}, nil
+}
+
+// Helper function to accept fingerprints with or without the SHA256: prefix
+func normalizeFingerprint(fingerprint string) string {
+	return "SHA256:" + strings.TrimPrefix(strings.TrimPrefix(fingerprint, "/"), "SHA256:")
+}
+
+// Function to add a key to a user's authorized_keys unless one with the same fingerprint is there
+func addAuthorizedKey(request SSHKeyRequest) (*SSHKeyChange, error) {
+	line := strings.TrimSpace(request.Key)
+	if strings.Contains(line, "\n") {
+		return nil, &requestError{400, "invalid_key", "key must be a single authorized_keys line"}
+	}
+	key, err := parseAuthorizedKey(line)
+	if err != nil {
+		return nil, &requestError{400, "invalid_key", err.Error()}
+	}
+	file, err := lookupAuthorizedKeys(request.User)
+	if err != nil {
+		return nil, err
+	}
+
+	sshKeysLock.Lock()
+	defer sshKeysLock.Unlock()
+
+	lines, current, err := file.read()
+	if err != nil {
+		return nil, err
+	}
+	change := &SSHKeyChange{User: file.User, Path: file.Path, Key: *key}
+	for _, existing := range current.Keys {
+		if existing.Fingerprint == key.Fingerprint {
+			change.Key = existing
+			return change, nil
+		}
+	}
+
+	change.Key.Line = len(lines) + 1
+	if err := file.write(append(lines, line)); err != nil {
+		return nil, err
+	}
+	change.Changed = true
+	return change, nil
+}
+
+// Function to remove every line holding the key with the given fingerprint. Removing
+// the last key is refused without force so the user isn't locked out.
+func removeAuthorizedKey(username, fingerprint string, force bool) (*SSHKeyChange, error) {
+	file, err := lookupAuthorizedKeys(username)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint = normalizeFingerprint(fingerprint)
+
+	sshKeysLock.Lock()
+	defer sshKeysLock.Unlock()
+
+	lines, current, err := file.read()
+	if err != nil {
+		return nil, err
+	}
+	change := &SSHKeyChange{User: file.User, Path: file.Path}
+	remove := map[int]bool{}
+	for _, key := range current.Keys {
+		if key.Fingerprint == fingerprint {
+			remove[key.Line] = true
+			change.Key = key
+		}
+	}
+	if len(remove) == 0 {
+		return nil, &requestError{404, "key_not_found", fmt.Sprintf("%s has no key with fingerprint %s", username, fingerprint)}
+	}
+	if len(remove) == len(current.Keys) && !force {
+		return nil, &requestError{409, "last_key", "refusing to remove the last key of " + username + "; set force to remove it anyway"}
+	}
+
+	kept := make([]string, 0, len(lines))
+	for i, line := range lines {
+		if !remove[i+1] {
+			kept = append(kept, line)
+		}
+	}
+	if err := file.write(kept); err != nil {
+		return nil, err
+	}
+	change.Changed = true
+	return change, nil
+}
+
+// SSHKeyDeleteRequest is the optional body of DELETE /ssh/keys; user and force may also be query parameters
+type SSHKeyDeleteRequest struct {
+	User  string `json:"user"`
+	Force bool   `json:"force"`
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// POST /ssh/keys has the same operation in POST /batch, which needs the same scope
+func TestBatchSSHKeyRequiresScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerBatchRoutes(r)
+	// The timeout fails validation once the request is let through, so nothing runs
+	body := `{"operations": [{"op": "ssh.keys.add", "body": {"user": "root", "key": "ssh-ed25519 AAAA"}}], "timeout_seconds": -1}`
+	checkScopeRequired(t, r, scopeSSH, "POST", "/batch", body)
+
+	// A token for files doesn't cover keys in the same batch
+	withScopedTokens(t, scopeFiles)
+	body = `{"operations": [{"op": "files.write", "body": {"path": "/etc/hosts"}}, {"op": "ssh.keys.add", "body": {"user": "root", "key": "ssh-ed25519 AAAA"}}]}`
+	if w := serveWithToken(r, "POST", "/batch", body, "ops-token"); w.Code != 403 {
+		t.Errorf("batch with a files token adding a key = %d %s, want 403", w.Code, w.Body)
+	}
+}
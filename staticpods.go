@@ -0,0 +1,821 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Where kubeadm writes the control plane's static pods, unless the kubelet's
+	// staticPodPath says otherwise
+	defaultStaticPodPath = "/etc/kubernetes/manifests"
+	// How long a patched static pod has to come back healthy by default, and at most
+	defaultStaticPodTimeout = 3 * time.Minute
+	maxStaticPodTimeout     = 15 * time.Minute
+	// How often the runtime is asked about the restarted pod
+	staticPodPollInterval = 2 * time.Second
+	// How long the restarted pod must stay running and pass its probes, so a component
+	// that starts and then crashes isn't taken for healthy
+	staticPodSettle = 10 * time.Second
+)
+
+// Scope of the tokens that may patch static pods, which can change how the API server
+// authorizes requests
+const scopeStaticPods = "static-pods"
+
+var (
+	// Manifest names are file names without their extension, as kubeadm writes them
+	staticPodName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	// Flags are given with their dashes, as they appear in the command
+	staticPodFlag = regexp.MustCompile(`^--?[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	envVarName    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Only one manifest is patched at a time, since the control plane's components depend
+// on each other while they restart
+var staticPodPatching sync.Mutex
+
+// StaticPodManifest is a static pod manifest as GET /kubernetes/manifests reports it
+type StaticPodManifest struct {
+	Name       string               `json:"name"`
+	Path       string               `json:"path"`
+	SHA256     string               `json:"sha256"`
+	Pod        string               `json:"pod,omitempty"`
+	Namespace  string               `json:"namespace,omitempty"`
+	Containers []StaticPodContainer `json:"containers"`
+	// Error says why the manifest couldn't be parsed
+	Error string `json:"error,omitempty"`
+}
+
+// StaticPodContainer is a container of a static pod with its command line split into flags
+type StaticPodContainer struct {
+	Name    string            `json:"name"`
+	Image   string            `json:"image"`
+	Command []string          `json:"command,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	Flags   []StaticPodFlag   `json:"flags"`
+	Env     map[string]string `json:"env,omitempty"`
+}
+
+// StaticPodFlag is a --flag or --flag=value of a container's command or args
+type StaticPodFlag struct {
+	Flag  string  `json:"flag"`
+	Value *string `json:"value,omitempty"`
+}
+
+// StaticPodPatchRequest is the body of PATCH /kubernetes/manifests/:name
+type StaticPodPatchRequest struct {
+	// Container is the container to change; it may be left out when the pod has only one
+	Container  string               `json:"container"`
+	Operations []StaticPodOperation `json:"operations" binding:"required"`
+	// ExpectedSHA256 makes the patch fail if the manifest changed since it was read
+	ExpectedSHA256 string `json:"expected_sha256"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+}
+
+// StaticPodOperation is one change to a container: add_flag, remove_flag and
+// replace_flag take a flag and, except for remove_flag, an optional value; set_env takes
+// a name and a value
+type StaticPodOperation struct {
+	Op    string  `json:"op"`
+	Flag  string  `json:"flag,omitempty"`
+	Name  string  `json:"name,omitempty"`
+	Value *string `json:"value,omitempty"`
+}
+
+// StaticPodPatchResult is the response of PATCH /kubernetes/manifests/:name
+type StaticPodPatchResult struct {
+	Manifest       *StaticPodManifest `json:"manifest"`
+	Changed        bool               `json:"changed"`
+	PreviousSHA256 string             `json:"previous_sha256"`
+	BackupPath     string             `json:"backup_path,omitempty"`
+	Pod            *StaticPodState    `json:"pod,omitempty"`
+	WaitedMS       float64            `json:"waited_ms"`
+}
+
+// StaticPodState is the pod the container runtime runs for a static pod manifest
+type StaticPodState struct {
+	SandboxID  string                    `json:"sandbox_id"`
+	UID        string                    `json:"uid"`
+	Containers []StaticPodContainerState `json:"containers"`
+}
+
+// StaticPodContainerState is a container of a running static pod. Probe is the pod's
+// own HTTP probe of the container, run by the agent.
+type StaticPodContainerState struct {
+	Name    string           `json:"name"`
+	ID      string           `json:"id,omitempty"`
+	State   string           `json:"state"`
+	Attempt int              `json:"attempt"`
+	Probe   *HTTPProbeResult `json:"probe,omitempty"`
+}
+
+// staticPodSpec holds the parts of a pod manifest the agent reads
+type staticPodSpec struct {
+	Metadata struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+	Spec struct {
+		HostNetwork bool                     `yaml:"hostNetwork"`
+		Containers  []staticPodContainerSpec `yaml:"containers"`
+	} `yaml:"spec"`
+}
+
+type staticPodContainerSpec struct {
+	Name    string   `yaml:"name"`
+	Image   string   `yaml:"image"`
+	Command []string `yaml:"command"`
+	Args    []string `yaml:"args"`
+	Env     []struct {
+		Name  string `yaml:"name"`
+		Value string `yaml:"value"`
+	} `yaml:"env"`
+	Ports []struct {
+		Name          string `yaml:"name"`
+		ContainerPort int    `yaml:"containerPort"`
+	} `yaml:"ports"`
+	ReadinessProbe *staticPodProbe `yaml:"readinessProbe"`
+	StartupProbe   *staticPodProbe `yaml:"startupProbe"`
+	LivenessProbe  *staticPodProbe `yaml:"livenessProbe"`
+}
+
+type staticPodProbe struct {
+	HTTPGet *struct {
+		Host   string `yaml:"host"`
+		Path   string `yaml:"path"`
+		Scheme string `yaml:"scheme"`
+		// Port is a number or the name of one of the container's ports
+		Port string `yaml:"port"`
+	} `yaml:"httpGet"`
+}
+
+// Function to find the directory the kubelet reads static pods from
+func staticPodDir() string {
+	if path := readKubeletConfig().StaticPodPath; path != "" {
+		return path
+	}
+	return defaultStaticPodPath
+}
+
+// Helper function to split a command line argument into its flag and value
+func splitFlag(arg string) (string, *string) {
+	if flag, value, ok := strings.Cut(arg, "="); ok {
+		return flag, &value
+	}
+	return arg, nil
+}
+
+// Function to describe a manifest from its content
+func describeStaticPod(name, path string, data []byte) *StaticPodManifest {
+	sum := sha256.Sum256(data)
+	manifest := &StaticPodManifest{Name: name, Path: path, SHA256: hex.EncodeToString(sum[:]), Containers: []StaticPodContainer{}}
+	var spec staticPodSpec
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		manifest.Error = err.Error()
+		return manifest
+	}
+	manifest.Pod, manifest.Namespace = spec.Metadata.Name, spec.Metadata.Namespace
+	for _, c := range spec.Spec.Containers {
+		container := StaticPodContainer{Name: c.Name, Image: c.Image, Command: c.Command, Args: c.Args, Flags: []StaticPodFlag{}}
+		// The first word of the command is the binary; flags may follow it or be in args
+		words := append([]string{}, c.Args...)
+		if len(c.Command) > 1 {
+			words = append(append([]string{}, c.Command[1:]...), c.Args...)
+		}
+		for _, word := range words {
+			if strings.HasPrefix(word, "-") {
+				flag, value := splitFlag(word)
+				container.Flags = append(container.Flags, StaticPodFlag{Flag: flag, Value: value})
+			}
+		}
+		if len(c.Env) > 0 {
+			container.Env = make(map[string]string, len(c.Env))
+			for _, env := range c.Env {
+				container.Env[env.Name] = env.Value
+			}
+		}
+		manifest.Containers = append(manifest.Containers, container)
+	}
+	return manifest
+}
+
+// Function to list the static pod manifests. Like the kubelet, it skips hidden files,
+// which is also where the agent stages the manifests it writes.
+func listStaticPods() ([]*StaticPodManifest, error) {
+	dir := staticPodDir()
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &requestError{404, "static_pods_not_found", dir + " does not exist; this host is not a kubeadm control plane node"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	manifests := []*StaticPodManifest{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			manifests = append(manifests, &StaticPodManifest{Name: entry.Name(), Path: path, Containers: []StaticPodContainer{}, Error: err.Error()})
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		manifests = append(manifests, describeStaticPod(name, path, data))
+	}
+	return manifests, nil
+}
+
+// Function to find the file of a manifest by its name, with or without its extension
+func findStaticPod(name string) (string, error) {
+	if !staticPodName.MatchString(name) {
+		return "", &requestError{400, "invalid_manifest_name", "manifest names may only contain letters, digits, '.', '_' and '-'"}
+	}
+	dir := staticPodDir()
+	for _, file := range []string{name + ".yaml", name + ".yml", name + ".json", name} {
+		path := filepath.Join(dir, file)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path, nil
+		}
+	}
+	return "", &requestError{404, "manifest_not_found", fmt.Sprintf("No static pod manifest named %s in %s", name, dir)}
+}
+
+// Helper function to look up a key of a YAML mapping
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Helper function to build a YAML string that stays a string, quoted if it would
+// otherwise read as a number or boolean
+func stringNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// Function to find the container a patch applies to in a parsed manifest
+func patchedContainer(root *yaml.Node, name string) (*yaml.Node, error) {
+	doc := root
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) == 1 {
+		doc = doc.Content[0]
+	}
+	containers := mappingValue(mappingValue(doc, "spec"), "containers")
+	if containers == nil || containers.Kind != yaml.SequenceNode || len(containers.Content) == 0 {
+		return nil, &requestError{422, "invalid_manifest", "the manifest has no spec.containers"}
+	}
+	if name == "" {
+		if len(containers.Content) > 1 {
+			return nil, &requestError{400, "container_required", "the pod has several containers; name one in container"}
+		}
+		return containers.Content[0], nil
+	}
+	for _, container := range containers.Content {
+		if n := mappingValue(container, "name"); n != nil && n.Value == name {
+			return container, nil
+		}
+	}
+	return nil, &requestError{404, "container_not_found", "the pod has no container named " + name}
+}
+
+// flagLocation is where a flag appears among a container's command and args
+type flagLocation struct {
+	list  *yaml.Node
+	index int
+}
+
+// Function to find every occurrence of a flag in a container's command and args. The
+// first word of the command is the binary and is never taken for a flag.
+func findFlag(container *yaml.Node, flag string) []flagLocation {
+	var found []flagLocation
+	for _, key := range []string{"command", "args"} {
+		list := mappingValue(container, key)
+		if list == nil || list.Kind != yaml.SequenceNode {
+			continue
+		}
+		for i, item := range list.Content {
+			if key == "command" && i == 0 {
+				continue
+			}
+			if name, _ := splitFlag(item.Value); name == flag {
+				found = append(found, flagLocation{list, i})
+			}
+		}
+	}
+	return found
+}
+
+// Helper function to format a flag with its value, if it has one
+func flagArgument(flag string, value *string) string {
+	if value == nil {
+		return flag
+	}
+	return flag + "=" + *value
+}
+
+// Function to apply one operation to a container, reporting whether it changed anything
+func applyStaticPodOperation(container *yaml.Node, op StaticPodOperation) (bool, error) {
+	invalid := func(message string) error {
+		return &requestError{400, "invalid_operation", op.Op + ": " + message}
+	}
+	switch op.Op {
+	case "add_flag", "remove_flag", "replace_flag":
+		if !staticPodFlag.MatchString(op.Flag) {
+			return false, invalid("flag must be a flag name with its dashes, such as --v")
+		}
+		if op.Value != nil && strings.ContainsAny(*op.Value, "\n\r\x00") {
+			return false, invalid("value may not contain line breaks")
+		}
+	case "set_env":
+		if !envVarName.MatchString(op.Name) {
+			return false, invalid("name must be an environment variable name")
+		}
+		if op.Value == nil {
+			return false, invalid("value is required")
+		}
+	default:
+		return false, invalid("op must be add_flag, remove_flag, replace_flag or set_env")
+	}
+
+	found := findFlag(container, op.Flag)
+	switch op.Op {
+	case "add_flag":
+		if len(found) > 0 {
+			return false, &requestError{409, "flag_exists", op.Flag + " is already set; use replace_flag to change it"}
+		}
+		// Follow the manifest: flags go into args when it has them, otherwise after the
+		// binary in command, as kubeadm writes them
+		list := mappingValue(container, "args")
+		if list == nil || list.Kind != yaml.SequenceNode || len(list.Content) == 0 {
+			list = mappingValue(container, "command")
+		}
+		if list == nil || list.Kind != yaml.SequenceNode {
+			return false, &requestError{422, "invalid_manifest", "the container has no command or args to add the flag to"}
+		}
+		list.Content = append(list.Content, stringNode(flagArgument(op.Flag, op.Value)))
+		return true, nil
+	case "remove_flag":
+		if len(found) == 0 {
+			return false, &requestError{409, "flag_not_found", op.Flag + " is not set"}
+		}
+		// Backwards, so the indexes of the remaining occurrences stay valid
+		for i := len(found) - 1; i >= 0; i-- {
+			location := found[i]
+			location.list.Content = append(location.list.Content[:location.index], location.list.Content[location.index+1:]...)
+		}
+		return true, nil
+	case "replace_flag":
+		if len(found) == 0 {
+			return false, &requestError{409, "flag_not_found", op.Flag + " is not set; use add_flag to set it"}
+		}
+		if len(found) > 1 {
+			return false, &requestError{409, "flag_repeated", op.Flag + " is given more than once; remove it and add it back"}
+		}
+		item := found[0].list.Content[found[0].index]
+		argument := flagArgument(op.Flag, op.Value)
+		if item.Value == argument {
+			return false, nil
+		}
+		*item = *stringNode(argument)
+		return true, nil
+	}
+
+	// set_env replaces a value or valueFrom of the variable, or adds the variable
+	env := mappingValue(container, "env")
+	if env == nil {
+		env = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		container.Content = append(container.Content, stringNode("env"), env)
+	}
+	if env.Kind != yaml.SequenceNode {
+		return false, &requestError{422, "invalid_manifest", "the container's env is not a list"}
+	}
+	for _, variable := range env.Content {
+		if n := mappingValue(variable, "name"); n == nil || n.Value != op.Name {
+			continue
+		}
+		if value := mappingValue(variable, "value"); value != nil && mappingValue(variable, "valueFrom") == nil {
+			if value.Value == *op.Value {
+				return false, nil
+			}
+			*value = *stringNode(*op.Value)
+			return true, nil
+		}
+		variable.Content = []*yaml.Node{stringNode("name"), stringNode(op.Name), stringNode("value"), stringNode(*op.Value)}
+		return true, nil
+	}
+	env.Content = append(env.Content, &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+		stringNode("name"), stringNode(op.Name), stringNode("value"), stringNode(*op.Value),
+	}})
+	return true, nil
+}
+
+// Function to apply a patch to a manifest's content. Comments and the order of keys
+// are kept, though the YAML is re-indented.
+func patchStaticPod(data []byte, request StaticPodPatchRequest) ([]byte, bool, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, false, &requestError{422, "invalid_manifest", "the manifest is not valid YAML: " + err.Error()}
+	}
+	if root.Kind != yaml.DocumentNode {
+		return nil, false, &requestError{422, "invalid_manifest", "the manifest is empty"}
+	}
+	container, err := patchedContainer(&root, request.Container)
+	if err != nil {
+		return nil, false, err
+	}
+	changed := false
+	for _, op := range request.Operations {
+		opChanged, err := applyStaticPodOperation(container, op)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = changed || opChanged
+	}
+	if !changed {
+		return data, false, nil
+	}
+
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&root); err != nil {
+		return nil, false, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, false, err
+	}
+	// Make sure the result still reads as a pod before the kubelet sees it
+	var spec staticPodSpec
+	if err := yaml.Unmarshal(buffer.Bytes(), &spec); err != nil {
+		return nil, false, fmt.Errorf("the patched manifest doesn't parse: %w", err)
+	}
+	return buffer.Bytes(), true, nil
+}
+
+// criPod and criContainer are the parts of crictl's JSON output the agent reads
+type criPod struct {
+	ID       string `json:"id"`
+	Metadata struct {
+		Name      string `json:"name"`
+		UID       string `json:"uid"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	State       string            `json:"state"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type criContainer struct {
+	ID       string `json:"id"`
+	Metadata struct {
+		Name    string `json:"name"`
+		Attempt int    `json:"attempt"`
+	} `json:"metadata"`
+	State string `json:"state"`
+}
+
+// Helper function to run crictl against the kubelet's runtime, decoding its JSON output
+func runCrictl(ctx context.Context, endpoint string, out interface{}, args ...string) error {
+	if endpoint != "" {
+		args = append([]string{"--runtime-endpoint", endpoint}, args...)
+	}
+	cmd := newCommand("crictl", args...)
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return &commandError{Tool: "crictl", Result: result, Err: err}
+	}
+	if err := json.Unmarshal([]byte(result.Stdout), out); err != nil {
+		return fmt.Errorf("parsing crictl output: %w", err)
+	}
+	return nil
+}
+
+// Function to find the sandboxes of a static pod. The kubelet names the pod after the
+// manifest's pod and the node, and marks it as coming from a file.
+func staticPodSandboxes(ctx context.Context, endpoint string, spec staticPodSpec) ([]criPod, error) {
+	namespace := spec.Metadata.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	var output struct {
+		Items []criPod `json:"items"`
+	}
+	if err := runCrictl(ctx, endpoint, &output, "pods", "--namespace", namespace, "-o", "json"); err != nil {
+		return nil, err
+	}
+	var pods []criPod
+	for _, pod := range output.Items {
+		if pod.Metadata.Namespace == namespace && pod.Annotations["kubernetes.io/config.source"] == "file" &&
+			strings.HasPrefix(pod.Metadata.Name, spec.Metadata.Name+"-") {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// Function to build the pod's own HTTP probe of a container, preferring the readiness
+// probe. Ports given by name are looked up among the container's ports. Without a host,
+// a host-network pod is probed on loopback; other pods can't be reached from the node
+// this way and are only checked for running.
+func containerProbe(container staticPodContainerSpec, hostNetwork bool) *HTTPProbe {
+	for _, probe := range []*staticPodProbe{container.ReadinessProbe, container.StartupProbe, container.LivenessProbe} {
+		if probe == nil || probe.HTTPGet == nil {
+			continue
+		}
+		get := probe.HTTPGet
+		port, err := strconv.Atoi(get.Port)
+		if err != nil {
+			for _, p := range container.Ports {
+				if p.Name == get.Port {
+					port = p.ContainerPort
+				}
+			}
+		}
+		host := get.Host
+		if host == "" && hostNetwork {
+			host = "127.0.0.1"
+		}
+		if port == 0 || host == "" {
+			return nil
+		}
+		scheme := strings.ToLower(get.Scheme)
+		if scheme == "" {
+			scheme = "http"
+		}
+		path := get.Path
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		// The kubelet doesn't verify the certificates of the probes it runs either
+		return &HTTPProbe{URL: fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, strconv.Itoa(port)), path), Method: "GET", TimeoutMS: 2000, TLSSkipVerify: true}
+	}
+	return nil
+}
+
+// Function to check once on the pod of a patched manifest. It returns the pod with
+// what's keeping it from being healthy, if anything.
+func observeStaticPod(ctx context.Context, endpoint string, spec staticPodSpec, previous map[string]bool) (*StaticPodState, string) {
+	sandboxes, err := staticPodSandboxes(ctx, endpoint, spec)
+	if err != nil {
+		return nil, err.Error()
+	}
+	var sandbox *criPod
+	for i, pod := range sandboxes {
+		if pod.State == "SANDBOX_READY" && !previous[pod.Metadata.UID] {
+			sandbox = &sandboxes[i]
+		}
+	}
+	if sandbox == nil {
+		return nil, "the kubelet hasn't started the new pod yet"
+	}
+
+	var output struct {
+		Containers []criContainer `json:"containers"`
+	}
+	if err := runCrictl(ctx, endpoint, &output, "ps", "-a", "--pod", sandbox.ID, "-o", "json"); err != nil {
+		return nil, err.Error()
+	}
+	state := &StaticPodState{SandboxID: sandbox.ID, UID: sandbox.Metadata.UID, Containers: []StaticPodContainerState{}}
+	var problems []string
+	for _, container := range spec.Spec.Containers {
+		current := StaticPodContainerState{Name: container.Name, State: "CONTAINER_UNKNOWN"}
+		// Restarts leave the exited attempts behind; the latest one counts
+		for _, c := range output.Containers {
+			if c.Metadata.Name == container.Name && (current.ID == "" || c.Metadata.Attempt > current.Attempt) {
+				current.ID, current.State, current.Attempt = c.ID, c.State, c.Metadata.Attempt
+			}
+		}
+		switch {
+		case current.State != "CONTAINER_RUNNING":
+			problems = append(problems, fmt.Sprintf("container %s is %s", container.Name, current.State))
+		case current.Attempt > 0:
+			problems = append(problems, fmt.Sprintf("container %s restarted %d times", container.Name, current.Attempt))
+		default:
+			if probe := containerProbe(container, spec.Spec.HostNetwork); probe != nil {
+				current.Probe, err = runHTTPProbe(ctx, *probe, linkLocalCheck(false))
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("container %s can't be probed: %s", container.Name, err))
+				} else if !current.Probe.Matched {
+					problems = append(problems, fmt.Sprintf("container %s fails its probe of %s", container.Name, probe.URL))
+				}
+			}
+		}
+		state.Containers = append(state.Containers, current)
+	}
+	return state, strings.Join(problems, "; ")
+}
+
+// Function to wait for the kubelet to replace a static pod with one that stays healthy
+// for staticPodSettle. The error says what was still wrong when time ran out.
+func waitForStaticPod(ctx context.Context, endpoint string, spec staticPodSpec, previous map[string]bool, timeout time.Duration) (*StaticPodState, error) {
+	deadline := time.Now().Add(timeout)
+	var healthySince time.Time
+	var healthyIDs string
+	for {
+		state, problem := observeStaticPod(ctx, endpoint, spec, previous)
+		if problem == "" {
+			var ids []string
+			for _, c := range state.Containers {
+				ids = append(ids, c.ID)
+			}
+			// A container replaced since the last look starts the wait over
+			if joined := strings.Join(ids, ","); joined != healthyIDs || healthySince.IsZero() {
+				healthySince, healthyIDs = time.Now(), joined
+			}
+			if time.Since(healthySince) >= staticPodSettle {
+				return state, nil
+			}
+		} else {
+			healthySince = time.Time{}
+		}
+		if time.Now().After(deadline) {
+			if problem == "" {
+				problem = "it hadn't stayed healthy for long enough"
+			}
+			return state, errors.New(problem)
+		}
+		select {
+		case <-ctx.Done():
+			return state, ctx.Err()
+		case <-time.After(staticPodPollInterval):
+		}
+	}
+}
+
+// Helper function to replace a manifest atomically, keeping its mode and owner. The
+// staged file is hidden so the kubelet never reads it half-written.
+func replaceStaticPod(path string, content []byte, info os.FileInfo) error {
+	uid, gid := os.Getuid(), os.Getgid()
+	if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+		uid, gid = int(sys.Uid), int(sys.Gid)
+	}
+	staged, err := stageFile(path, content, info.Mode().Perm(), uid, gid)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged) // no-op once renamed into place
+	if err := os.Rename(staged, path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// Function to patch a static pod manifest and wait for its pod to restart healthy,
+// restoring the previous manifest if it doesn't. The backup is kept outside the
+// manifest directory, where the kubelet would run it as a second pod.
+func patchStaticPodManifest(ctx context.Context, name string, request StaticPodPatchRequest) (*StaticPodPatchResult, error) {
+	if len(request.Operations) == 0 {
+		return nil, &requestError{400, "invalid_operation", "operations must list at least one operation"}
+	}
+	timeout := defaultStaticPodTimeout
+	if request.TimeoutSeconds != 0 {
+		timeout = time.Duration(request.TimeoutSeconds) * time.Second
+		if timeout < staticPodSettle || timeout > maxStaticPodTimeout {
+			return nil, &requestError{400, "invalid_timeout", fmt.Sprintf("timeout_seconds must be between %d and %d", int(staticPodSettle.Seconds()), int(maxStaticPodTimeout.Seconds()))}
+		}
+	}
+	if _, err := exec.LookPath("crictl"); err != nil {
+		return nil, &requestError{501, "crictl_missing", "crictl is not installed, so the restarted pod can't be checked"}
+	}
+	path, err := findStaticPod(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !staticPodPatching.TryLock() {
+		return nil, &requestError{409, "manifest_patch_running", "Another static pod manifest is being patched"}
+	}
+	defer staticPodPatching.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	original, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(original)
+	result := &StaticPodPatchResult{PreviousSHA256: hex.EncodeToString(sum[:])}
+	if expected := strings.TrimPrefix(request.ExpectedSHA256, "sha256:"); expected != "" && !strings.EqualFold(expected, result.PreviousSHA256) {
+		return nil, &requestError{412, "precondition_failed", fmt.Sprintf("current sha256 is %s, expected %s", result.PreviousSHA256, expected)}
+	}
+	patched, changed, err := patchStaticPod(original, request)
+	if err != nil {
+		return nil, err
+	}
+	manifestName := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	result.Manifest = describeStaticPod(manifestName, path, patched)
+	if !changed {
+		return result, nil
+	}
+	var spec staticPodSpec
+	yaml.Unmarshal(patched, &spec) // parsed by patchStaticPod already
+
+	endpoint := readKubeletConfig().ContainerRuntimeEndpoint
+	before, err := staticPodSandboxes(ctx, endpoint, spec)
+	if err != nil {
+		return nil, err
+	}
+	previous := make(map[string]bool, len(before))
+	for _, pod := range before {
+		previous[pod.Metadata.UID] = true
+	}
+
+	result.BackupPath = filepath.Join(stateDir, "static-pod-backups", filepath.Base(path)+"."+time.Now().UTC().Format("20060102T150405Z"))
+	if err := writeStateFile(result.BackupPath, original); err != nil {
+		return nil, fmt.Errorf("creating backup: %w", err)
+	}
+	if err := replaceStaticPod(path, patched, info); err != nil {
+		return nil, err
+	}
+	result.Changed = true
+
+	started := time.Now()
+	result.Pod, err = waitForStaticPod(ctx, endpoint, spec, previous, timeout)
+	result.WaitedMS = milliseconds(time.Since(started))
+	if err == nil {
+		return result, nil
+	}
+
+	failure := gin.H{
+		"code":        "static_pod_unhealthy",
+		"rolled_back": true,
+		"backup_path": result.BackupPath,
+		"pod":         result.Pod,
+		"waited_ms":   result.WaitedMS,
+	}
+	if rollbackErr := replaceStaticPod(path, original, info); rollbackErr != nil {
+		failure["rolled_back"] = false
+		failure["error"] = fmt.Sprintf("%s did not come back healthy (%s), and restoring %s from %s failed: %s", manifestName, err, path, result.BackupPath, rollbackErr)
+		return nil, &responseError{500, failure}
+	}
+	failure["error"] = fmt.Sprintf("%s did not come back healthy within %s (%s); the previous manifest was restored", manifestName, timeout, err)
+	return nil, &responseError{504, failure}
+}
+
+// Function to register the static pod manifest endpoints
+func registerStaticPodRoutes(r *gin.Engine) {
+	// Define the /kubernetes/manifests endpoint that lists the static pod manifests with
+	// the flags and environment of their containers
+	r.GET("/kubernetes/manifests", func(c *gin.Context) {
+		manifests, err := listStaticPods()
+		if err != nil {
+			respondFailure(c, "Failed to list static pod manifests", err)
+			return
+		}
+		sort.Slice(manifests, func(i, j int) bool { return manifests[i].Name < manifests[j].Name })
+		c.JSON(200, gin.H{"path": staticPodDir(), "manifests": manifests})
+	})
+
+	// Define the /kubernetes/manifests/{name} PATCH endpoint that changes a flag or
+	// environment variable of a static pod's container. It returns once the pod has
+	// restarted healthy, and restores the previous manifest if it doesn't.
+	r.PATCH("/kubernetes/manifests/:name", requireScope(scopeStaticPods), func(c *gin.Context) {
+		var request StaticPodPatchRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format: " + err.Error()})
+			return
+		}
+		// The wait outlives a client that gives up, so a broken manifest is still rolled back
+		result, err := patchStaticPodManifest(context.WithoutCancel(c.Request.Context()), c.Param("name"), request)
+		details := map[string]interface{}{"manifest": c.Param("name"), "container": request.Container, "operations": request.Operations}
+		if result != nil {
+			details["changed"] = result.Changed
+			details["backup_path"] = result.BackupPath
+		}
+		audit.Record(auditOutcome("kubernetes.manifests.patch", c.ClientIP(), details, err))
+		if err != nil {
+			respondFailure(c, "Failed to patch static pod manifest", err)
+			return
+		}
+		c.JSON(200, result)
+	})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// Helper function to point at a string
+func str(value string) *string { return &value }
+
+// Helper function to decode a manifest with the command and env of its container taken
+// out, to check that a patch touched nothing else
+func manifestWithoutFlags(t *testing.T, data []byte) map[string]interface{} {
+	t.Helper()
+	var manifest map[string]interface{}
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	container := manifest["spec"].(map[string]interface{})["containers"].([]interface{})[0].(map[string]interface{})
+	delete(container, "command")
+	delete(container, "env")
+	return manifest
+}
+
+// Helper function to find a flag of a described container
+func describedFlag(container StaticPodContainer, flag string) (*string, bool) {
+	for _, f := range container.Flags {
+		if f.Flag == flag {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+func TestDescribeKubeadmManifests(t *testing.T) {
+	tests := []struct {
+		fixture string
+		pod     string
+		image   string
+		flags   int
+		flag    string
+		value   string
+	}{
+		{"kube-apiserver.yaml", "kube-apiserver", "registry.k8s.io/kube-apiserver:v1.30.2", 27, "--authorization-mode", "Node,RBAC"},
+		// The value keeps the = signs after the first
+		{"etcd.yaml", "etcd", "registry.k8s.io/etcd:3.5.12-0", 19, "--initial-cluster", "cp-1=https://10.0.0.10:2380"},
+		{"kube-scheduler.yaml", "kube-scheduler", "registry.k8s.io/kube-scheduler:v1.30.2", 5, "--leader-elect", "true"},
+	}
+	for _, tt := range tests {
+		manifest := describeStaticPod(strings.TrimSuffix(tt.fixture, ".yaml"), tt.fixture, readFixture(t, "staticpods", tt.fixture))
+		if manifest.Error != "" || manifest.Pod != tt.pod || manifest.Namespace != "kube-system" || len(manifest.Containers) != 1 {
+			t.Errorf("%s: %s", tt.fixture, toJSON(manifest))
+			continue
+		}
+		container := manifest.Containers[0]
+		value, ok := describedFlag(container, tt.flag)
+		if container.Name != tt.pod || container.Image != tt.image || len(container.Flags) != tt.flags || !ok || value == nil || *value != tt.value {
+			t.Errorf("%s: container %s", tt.fixture, toJSON(container))
+		}
+	}
+}
+
+// The changes the endpoint exists for, on the manifests kubeadm writes: everything but
+// the container's command and env comes out as it went in
+func TestPatchKubeadmManifests(t *testing.T) {
+	tests := []struct {
+		fixture    string
+		operations []StaticPodOperation
+		flags      map[string]string // flags to check afterwards, with "" for a flag without a value
+		removed    []string
+		env        map[string]string
+	}{
+		{"kube-apiserver.yaml", []StaticPodOperation{
+			{Op: "add_flag", Flag: "--audit-log-path", Value: str("/var/log/kubernetes/audit.log")},
+			{Op: "add_flag", Flag: "--profiling", Value: str("false")},
+			{Op: "replace_flag", Flag: "--authorization-mode", Value: str("Node,RBAC,Webhook")},
+			{Op: "remove_flag", Flag: "--enable-bootstrap-token-auth"},
+			{Op: "set_env", Name: "GOMAXPROCS", Value: str("4")},
+		}, map[string]string{
+			"--audit-log-path":     "/var/log/kubernetes/audit.log",
+			"--profiling":          "false",
+			"--authorization-mode": "Node,RBAC,Webhook",
+			"--secure-port":        "6443",
+		}, []string{"--enable-bootstrap-token-auth"}, map[string]string{"GOMAXPROCS": "4"}},
+		// Raising the etcd quota
+		{"etcd.yaml", []StaticPodOperation{
+			{Op: "add_flag", Flag: "--quota-backend-bytes", Value: str("8589934592")},
+			{Op: "replace_flag", Flag: "--snapshot-count", Value: str("5000")},
+		}, map[string]string{
+			"--quota-backend-bytes": "8589934592",
+			"--snapshot-count":      "5000",
+		}, nil, nil},
+		// A flag without a value, and set_env run twice on the same variable
+		{"kube-scheduler.yaml", []StaticPodOperation{
+			{Op: "add_flag", Flag: "--v", Value: str("4")},
+			{Op: "set_env", Name: "GODEBUG", Value: str("x509sha1=1")},
+			{Op: "set_env", Name: "GODEBUG", Value: str("gctrace=1")},
+			{Op: "remove_flag", Flag: "--leader-elect"},
+			{Op: "add_flag", Flag: "--leader-elect"},
+		}, map[string]string{
+			"--v":            "4",
+			"--leader-elect": "",
+		}, nil, map[string]string{"GODEBUG": "gctrace=1"}},
+	}
+	for _, tt := range tests {
+		data := readFixture(t, "staticpods", tt.fixture)
+		patched, changed, err := patchStaticPod(data, StaticPodPatchRequest{Operations: tt.operations})
+		if err != nil || !changed {
+			t.Errorf("%s: patchStaticPod = %v, %v", tt.fixture, changed, err)
+			continue
+		}
+		if !reflect.DeepEqual(manifestWithoutFlags(t, patched), manifestWithoutFlags(t, data)) {
+			t.Errorf("%s: the patch changed more than the command and env:\n%s", tt.fixture, patched)
+		}
+
+		container := describeStaticPod("", "", patched).Containers[0]
+		for flag, want := range tt.flags {
+			value, ok := describedFlag(container, flag)
+			if !ok || want == "" && value != nil || want != "" && (value == nil || *value != want) {
+				t.Errorf("%s: %s = %s, %v, want %q", tt.fixture, flag, toJSON(value), ok, want)
+			}
+		}
+		for _, flag := range tt.removed {
+			if _, ok := describedFlag(container, flag); ok {
+				t.Errorf("%s: %s is still set", tt.fixture, flag)
+			}
+		}
+		if tt.env != nil && !reflect.DeepEqual(container.Env, tt.env) {
+			t.Errorf("%s: env = %v, want %v", tt.fixture, container.Env, tt.env)
+		}
+		// The kubelet reads the manifest as a pod, so an env value that looks like a
+		// number must still be written as a string
+		if strings.Contains(string(patched), "value: 4\n") {
+			t.Errorf("%s: types changed in the rewrite:\n%s", tt.fixture, patched)
+		}
+	}
+}
+
+// Applying a patch the manifest already has leaves the file as it was, byte for byte
+func TestPatchKubeadmManifestUnchanged(t *testing.T) {
+	data := readFixture(t, "staticpods", "kube-apiserver.yaml")
+	patched, changed, err := patchStaticPod(data, StaticPodPatchRequest{Container: "kube-apiserver", Operations: []StaticPodOperation{
+		{Op: "replace_flag", Flag: "--secure-port", Value: str("6443")},
+	}})
+	if err != nil || changed || string(patched) != string(data) {
+		t.Errorf("no-op patch = %v, %v, changed the file: %v", changed, err, string(patched) != string(data))
+	}
+}
+
+// Only flags and environment variables can be changed; anything else is refused before
+// the manifest is touched
+func TestPatchKubeadmManifestRefused(t *testing.T) {
+	apiserver := readFixture(t, "staticpods", "kube-apiserver.yaml")
+	twoContainers := []byte(`apiVersion: v1
+kind: Pod
+metadata:
+  name: two
+spec:
+  containers:
+  - name: a
+    command: [a, --x=1, --x=2]
+  - name: b
+    command: [b]
+`)
+	tests := []struct {
+		name      string
+		data      []byte
+		container string
+		op        StaticPodOperation
+		code      string
+	}{
+		{"image", apiserver, "", StaticPodOperation{Op: "set_image", Value: str("evil.example.com/kube-apiserver:latest")}, "invalid_operation"},
+		{"volume", apiserver, "", StaticPodOperation{Op: "add_volume", Name: "host-root", Value: str("/")}, "invalid_operation"},
+		{"privileged", apiserver, "", StaticPodOperation{Op: "set_security_context", Name: "privileged", Value: str("true")}, "invalid_operation"},
+		{"empty op", apiserver, "", StaticPodOperation{Flag: "--v"}, "invalid_operation"},
+		{"flag without dashes", apiserver, "", StaticPodOperation{Op: "add_flag", Flag: "v", Value: str("4")}, "invalid_operation"},
+		{"flag with a value in its name", apiserver, "", StaticPodOperation{Op: "add_flag", Flag: "--v=4"}, "invalid_operation"},
+		{"flag that is a YAML key", apiserver, "", StaticPodOperation{Op: "add_flag", Flag: "--x\nimage: evil"}, "invalid_operation"},
+		{"value with a line break", apiserver, "", StaticPodOperation{Op: "add_flag", Flag: "--v", Value: str("4\n    image: evil")}, "invalid_operation"},
+		{"env name", apiserver, "", StaticPodOperation{Op: "set_env", Name: "1BAD", Value: str("x")}, "invalid_operation"},
+		{"env without a value", apiserver, "", StaticPodOperation{Op: "set_env", Name: "GOMAXPROCS"}, "invalid_operation"},
+		{"flag already set", apiserver, "", StaticPodOperation{Op: "add_flag", Flag: "--secure-port", Value: str("443")}, "flag_exists"},
+		{"removing a missing flag", apiserver, "", StaticPodOperation{Op: "remove_flag", Flag: "--insecure-port"}, "flag_not_found"},
+		{"replacing a missing flag", apiserver, "", StaticPodOperation{Op: "replace_flag", Flag: "--insecure-port", Value: str("0")}, "flag_not_found"},
+		// The binary is the first word of the command, not a flag
+		{"the binary", apiserver, "", StaticPodOperation{Op: "remove_flag", Flag: "kube-apiserver"}, "invalid_operation"},
+		{"unknown container", apiserver, "etcd", StaticPodOperation{Op: "add_flag", Flag: "--v", Value: str("4")}, "container_not_found"},
+		{"container left out", twoContainers, "", StaticPodOperation{Op: "add_flag", Flag: "--v"}, "container_required"},
+		{"repeated flag", twoContainers, "a", StaticPodOperation{Op: "replace_flag", Flag: "--x", Value: str("3")}, "flag_repeated"},
+		{"not YAML", []byte("spec: [unterminated"), "", StaticPodOperation{Op: "add_flag", Flag: "--v"}, "invalid_manifest"},
+		{"empty manifest", []byte(""), "", StaticPodOperation{Op: "add_flag", Flag: "--v"}, "invalid_manifest"},
+		{"no containers", []byte("apiVersion: v1\nkind: Pod\nspec: {}\n"), "", StaticPodOperation{Op: "add_flag", Flag: "--v"}, "invalid_manifest"},
+	}
+	for _, tt := range tests {
+		// A valid operation first shows that a refused one undoes the whole patch
+		operations := []StaticPodOperation{{Op: "set_env", Name: "GOMAXPROCS", Value: str("4")}, tt.op}
+		patched, changed, err := patchStaticPod(tt.data, StaticPodPatchRequest{Container: tt.container, Operations: operations})
+		var reqErr *requestError
+		if !errors.As(err, &reqErr) || reqErr.Code != tt.code || patched != nil || changed {
+			t.Errorf("%s: patchStaticPod = %v, %v, want %s", tt.name, changed, err, tt.code)
+		}
+	}
+}
+
+// One patch can open the API server to anonymous clients, so patching needs its own scope
+func TestStaticPodRoutesRequireScope(t *testing.T) {
+	withJobStore(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerStaticPodRoutes(r)
+
+	// The timeout is out of range, so the requests let through are refused before any
+	// manifest is read
+	body := `{"operations": [{"op": "add_flag", "flag": "--anonymous-auth", "value": "true"}], "timeout_seconds": 1}`
+	checkScopeRequired(t, r, scopeStaticPods, "PATCH", "/kubernetes/manifests/kube-apiserver", body)
+	if w := serveWithToken(r, "PATCH", "/kubernetes/manifests/kube-apiserver", body, "ops-token"); w.Code != 400 || !strings.Contains(w.Body.String(), "invalid_timeout") {
+		t.Errorf("PATCH with the static-pods scope = %d %s", w.Code, w.Body)
+	}
+}
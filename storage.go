@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	mdstatFile = "/proc/mdstat"
+	// Share of a volume group's extents in use above which it is flagged
+	vgAllocationWarning = 0.9
+)
+
+var (
+	mdArrayLine  = regexp.MustCompile(`^(md\S+) : (\S+)\s*(.*)$`)
+	mdMember     = regexp.MustCompile(`^(\S+)\[(\d+)\]((?:\([A-Z]\))*)$`)
+	mdStatusLine = regexp.MustCompile(`^(\d+) blocks.*\[(\d+)/(\d+)\] \[([U_]+)\]`)
+	mdBlocksLine = regexp.MustCompile(`^(\d+) blocks`)
+	mdSyncLine   = regexp.MustCompile(`(resync|recovery|reshape|check|repair)\s*=\s*([0-9.]+)%(?:.*finish=(\S+))?(?:.*speed=(\S+))?`)
+	mdSyncQueued = regexp.MustCompile(`(resync|recovery|reshape|check|repair)\s*=\s*(DELAYED|PENDING)`)
+)
+
+// RaidMember is a device in a software RAID array
+type RaidMember struct {
+	Device      string `json:"device"`
+	Role        int    `json:"role"`
+	Faulty      bool   `json:"faulty,omitempty"`
+	Spare       bool   `json:"spare,omitempty"`
+	WriteMostly bool   `json:"write_mostly,omitempty"`
+	Replacement bool   `json:"replacement,omitempty"`
+}
+
+// RaidSync is a resync, recovery, reshape, or check in progress
+type RaidSync struct {
+	Action  string   `json:"action"`
+	Percent *float64 `json:"percent,omitempty"`
+	Finish  string   `json:"finish,omitempty"` // estimate as printed by the kernel, e.g. 0.7min
+	Speed   string   `json:"speed,omitempty"`
+	Queued  string   `json:"queued,omitempty"` // DELAYED or PENDING when waiting for another array
+}
+
+// RaidArray is one md array from /proc/mdstat
+type RaidArray struct {
+	Name        string       `json:"name"`
+	State       string       `json:"state"` // active or inactive
+	ReadOnly    bool         `json:"read_only,omitempty"`
+	Level       string       `json:"level,omitempty"`
+	Members     []RaidMember `json:"members"`
+	SizeBytes   uint64       `json:"size_bytes,omitempty"`
+	RaidDisks   int          `json:"raid_disks,omitempty"`
+	ActiveDisks int          `json:"active_disks,omitempty"`
+	Status      string       `json:"status,omitempty"` // e.g. [UU_], one letter per slot
+	Degraded    bool         `json:"degraded"`
+	Sync        *RaidSync    `json:"sync,omitempty"`
+	Warning     string       `json:"warning,omitempty"`
+}
+
+// RaidReport is the response of GET /storage/raid
+type RaidReport struct {
+	Personalities []string    `json:"personalities"`
+	Arrays        []RaidArray `json:"arrays"`
+}
+
+// Function to read /proc/mdstat. Hosts without the md driver have no arrays.
+func collectRaid() (*RaidReport, error) {
+	data, err := os.ReadFile(mdstatFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return &RaidReport{Personalities: []string{}, Arrays: []RaidArray{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseMdstat(string(data)), nil
+}
+
+// Function to parse /proc/mdstat. Each array is a "mdN : ..." line followed by indented
+// lines with its size and slot status, and optionally sync progress and the bitmap.
+func parseMdstat(content string) *RaidReport {
+	report := &RaidReport{Personalities: []string{}, Arrays: []RaidArray{}}
+	var array *RaidArray
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "Personalities :"):
+			for _, p := range strings.Fields(strings.TrimPrefix(line, "Personalities :")) {
+				report.Personalities = append(report.Personalities, strings.Trim(p, "[]"))
+			}
+		case line == "" || strings.HasPrefix(line, "unused devices:"):
+			array = nil
+		case mdArrayLine.MatchString(line):
+			match := mdArrayLine.FindStringSubmatch(line)
+			report.Arrays = append(report.Arrays, RaidArray{Name: match[1], State: match[2], Members: []RaidMember{}})
+			array = &report.Arrays[len(report.Arrays)-1]
+			parseMdMembers(array, strings.Fields(match[3]))
+		case array == nil:
+			continue
+		case mdStatusLine.MatchString(line):
+			match := mdStatusLine.FindStringSubmatch(line)
+			blocks, _ := strconv.ParseUint(match[1], 10, 64)
+			array.SizeBytes = blocks * 1024
+			array.RaidDisks, _ = strconv.Atoi(match[2])
+			array.ActiveDisks, _ = strconv.Atoi(match[3])
+			array.Status = "[" + match[4] + "]"
+		case mdBlocksLine.MatchString(line):
+			// Inactive and linear arrays have no slot status
+			blocks, _ := strconv.ParseUint(mdBlocksLine.FindStringSubmatch(line)[1], 10, 64)
+			array.SizeBytes = blocks * 1024
+		case mdSyncQueued.MatchString(line):
+			match := mdSyncQueued.FindStringSubmatch(line)
+			array.Sync = &RaidSync{Action: match[1], Queued: match[2]}
+		case mdSyncLine.MatchString(line):
+			match := mdSyncLine.FindStringSubmatch(line)
+			sync := &RaidSync{Action: match[1], Finish: match[3], Speed: match[4]}
+			if percent, err := strconv.ParseFloat(match[2], 64); err == nil {
+				sync.Percent = &percent
+			}
+			array.Sync = sync
+		}
+	}
+
+	for i := range report.Arrays {
+		flagRaidArray(&report.Arrays[i])
+	}
+	return report
+}
+
+// Helper function to parse the words after the state: optional (read-only) markers,
+// the level, and the members such as sdb1[1](F)
+func parseMdMembers(array *RaidArray, words []string) {
+	for _, word := range words {
+		if word == "(read-only)" || word == "(auto-read-only)" {
+			array.ReadOnly = true
+			continue
+		}
+		match := mdMember.FindStringSubmatch(word)
+		if match == nil {
+			if array.Level == "" && len(array.Members) == 0 {
+				array.Level = word
+			}
+			continue
+		}
+		role, _ := strconv.Atoi(match[2])
+		member := RaidMember{Device: match[1], Role: role}
+		member.Faulty = strings.Contains(match[3], "(F)")
+		member.Spare = strings.Contains(match[3], "(S)")
+		member.WriteMostly = strings.Contains(match[3], "(W)")
+		member.Replacement = strings.Contains(match[3], "(R)")
+		array.Members = append(array.Members, member)
+	}
+}
+
+// Function to decide whether an array is degraded and describe why
+func flagRaidArray(array *RaidArray) {
+	var faulty []string
+	for _, member := range array.Members {
+		if member.Faulty {
+			faulty = append(faulty, member.Device)
+		}
+	}
+	missing := array.RaidDisks - array.ActiveDisks
+	array.Degraded = missing > 0 || strings.Contains(array.Status, "_") || len(faulty) > 0
+
+	var reasons []string
+	if missing > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d of %d devices missing", missing, array.RaidDisks))
+	}
+	if len(faulty) > 0 {
+		reasons = append(reasons, "faulty: "+strings.Join(faulty, ", "))
+	}
+	if array.Sync != nil && array.Degraded && array.Sync.Action == "recovery" {
+		reasons = append(reasons, "rebuilding")
+	}
+	if array.State == "inactive" {
+		reasons = append(reasons, "array is inactive")
+	}
+	array.Warning = strings.Join(reasons, "; ")
+}
+
+// PhysicalVolume is an LVM physical volume
+type PhysicalVolume struct {
+	Name        string `json:"name"`
+	VolumeGroup string `json:"volume_group,omitempty"`
+	SizeBytes   uint64 `json:"size_bytes"`
+	FreeBytes   uint64 `json:"free_bytes"`
+	Attributes  string `json:"attributes"`
+}
+
+// VolumeGroup is an LVM volume group
+type VolumeGroup struct {
+	Name               string  `json:"name"`
+	SizeBytes          uint64  `json:"size_bytes"`
+	FreeBytes          uint64  `json:"free_bytes"`
+	AllocatedPercent   float64 `json:"allocated_percent"`
+	PhysicalVolumes    int     `json:"physical_volumes"`
+	LogicalVolumes     int     `json:"logical_volumes"`
+	Attributes         string  `json:"attributes"`
+	MissingPhysVolumes bool    `json:"missing_physical_volumes,omitempty"`
+	Warning            string  `json:"warning,omitempty"`
+}
+
+// LogicalVolume is an LVM logical volume and where it is mounted
+type LogicalVolume struct {
+	Name        string   `json:"name"`
+	VolumeGroup string   `json:"volume_group"`
+	Path        string   `json:"path,omitempty"`
+	SizeBytes   uint64   `json:"size_bytes"`
+	Attributes  string   `json:"attributes"`
+	Pool        string   `json:"pool,omitempty"`
+	DataPercent *float64 `json:"data_percent,omitempty"` // thin pools and snapshots
+	MountPoints []string `json:"mount_points"`
+}
+
+// LVMReport is the response of GET /storage/lvm
+type LVMReport struct {
+	PhysicalVolumes []PhysicalVolume `json:"physical_volumes"`
+	VolumeGroups    []VolumeGroup    `json:"volume_groups"`
+	LogicalVolumes  []LogicalVolume  `json:"logical_volumes"`
+}
+
+// Function to run one of the LVM reporting tools and return its rows
+func lvmReport(ctx context.Context, tool, section, fields string) ([]map[string]string, error) {
+	cmd := newPrivilegedCommand(nil, tool, "--reportformat", "json", "--units", "b", "--nosuffix", "-o", fields)
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return nil, &commandError{Tool: tool, Result: result, Err: err}
+	}
+	var report struct {
+		Report []map[string][]map[string]string `json:"report"`
+	}
+	if err := json.Unmarshal([]byte(result.Stdout), &report); err != nil {
+		return nil, fmt.Errorf("parsing %s output: %w", tool, err)
+	}
+	var rows []map[string]string
+	for _, r := range report.Report {
+		rows = append(rows, r[section]...)
+	}
+	return rows, nil
+}
+
+// Function to combine pvs, vgs, and lvs into one view. Hosts without LVM have empty lists.
+func collectLVM(ctx context.Context) (*LVMReport, error) {
+	report := &LVMReport{PhysicalVolumes: []PhysicalVolume{}, VolumeGroups: []VolumeGroup{}, LogicalVolumes: []LogicalVolume{}}
+	if _, err := exec.LookPath("lvs"); err != nil {
+		return report, nil
+	}
+
+	pvs, err := lvmReport(ctx, "pvs", "pv", "pv_name,vg_name,pv_size,pv_free,pv_attr")
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range pvs {
+		report.PhysicalVolumes = append(report.PhysicalVolumes, PhysicalVolume{
+			Name:        row["pv_name"],
+			VolumeGroup: row["vg_name"],
+			SizeBytes:   parseLVMSize(row["pv_size"]),
+			FreeBytes:   parseLVMSize(row["pv_free"]),
+			Attributes:  row["pv_attr"],
+		})
+	}
+
+	vgs, err := lvmReport(ctx, "vgs", "vg", "vg_name,vg_size,vg_free,pv_count,lv_count,vg_attr")
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range vgs {
+		vg := VolumeGroup{
+			Name:       row["vg_name"],
+			SizeBytes:  parseLVMSize(row["vg_size"]),
+			FreeBytes:  parseLVMSize(row["vg_free"]),
+			Attributes: row["vg_attr"],
+		}
+		vg.PhysicalVolumes, _ = strconv.Atoi(row["pv_count"])
+		vg.LogicalVolumes, _ = strconv.Atoi(row["lv_count"])
+		// The fourth attribute character is p when physical volumes are missing
+		vg.MissingPhysVolumes = len(vg.Attributes) > 3 && vg.Attributes[3] == 'p'
+
+		var warnings []string
+		if vg.SizeBytes > 0 {
+			allocated := float64(vg.SizeBytes-vg.FreeBytes) / float64(vg.SizeBytes)
+			vg.AllocatedPercent = float64(int(allocated*1000)) / 10
+			if allocated > vgAllocationWarning {
+				warnings = append(warnings, fmt.Sprintf("%.1f%% allocated", vg.AllocatedPercent))
+			}
+		}
+		if vg.MissingPhysVolumes {
+			warnings = append(warnings, "physical volumes are missing")
+		}
+		vg.Warning = strings.Join(warnings, "; ")
+		report.VolumeGroups = append(report.VolumeGroups, vg)
+	}
+
+	lvs, err := lvmReport(ctx, "lvs", "lv", "lv_name,vg_name,lv_path,lv_size,lv_attr,pool_lv,data_percent")
+	if err != nil {
+		return nil, err
+	}
+	mounts := mountPointsByDevice()
+	for _, row := range lvs {
+		lv := LogicalVolume{
+			Name:        row["lv_name"],
+			VolumeGroup: row["vg_name"],
+			Path:        row["lv_path"],
+			SizeBytes:   parseLVMSize(row["lv_size"]),
+			Attributes:  row["lv_attr"],
+			Pool:        row["pool_lv"],
+			MountPoints: []string{},
+		}
+		if percent, err := strconv.ParseFloat(row["data_percent"], 64); err == nil {
+			lv.DataPercent = &percent
+		}
+		if lv.Path != "" {
+			if resolved, err := filepath.EvalSymlinks(lv.Path); err == nil && mounts[resolved] != nil {
+				lv.MountPoints = mounts[resolved]
+			}
+		}
+		report.LogicalVolumes = append(report.LogicalVolumes, lv)
+	}
+	return report, nil
+}
+
+// Helper function to parse a size printed with --units b --nosuffix
+func parseLVMSize(value string) uint64 {
+	size, _ := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+	return size
+}
+
+// Function to map each mounted block device, with symlinks resolved to the
+// /dev/dm-N node, to its mount points
+func mountPointsByDevice() map[string][]string {
+	mounts := map[string][]string{}
+	lines, err := readLines("/proc/mounts")
+	if err != nil {
+		return mounts
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		device := fields[0]
+		if resolved, err := filepath.EvalSymlinks(device); err == nil {
+			device = resolved
+		}
+		mounts[device] = append(mounts[device], fields[1])
+	}
+	return mounts
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Helper function to take the address of a percentage
+func percent(p float64) *float64 { return &p }
+
+func TestParseMdstatResync(t *testing.T) {
+	report := parseMdstat(string(readFixture(t, "mdstat", "resync.txt")))
+	wantPersonalities := []string{"raid1", "linear", "multipath", "raid0", "raid6", "raid5", "raid4", "raid10"}
+	if !reflect.DeepEqual(report.Personalities, wantPersonalities) {
+		t.Errorf("personalities = %q", report.Personalities)
+	}
+	// A resync of a healthy mirror isn't a degraded array
+	want := []RaidArray{
+		{
+			Name: "md0", State: "active", Level: "raid1",
+			Members:   []RaidMember{{Device: "sdb1", Role: 1}, {Device: "sda1", Role: 0}},
+			SizeBytes: 976630464 * 1024, RaidDisks: 2, ActiveDisks: 2, Status: "[UU]",
+			Sync: &RaidSync{Action: "resync", Percent: percent(12.6), Finish: "80.2min", Speed: "177251K/sec"},
+		},
+		{
+			Name: "md1", State: "active", Level: "raid1",
+			Members:   []RaidMember{{Device: "sdd1", Role: 1}, {Device: "sdc1", Role: 0}},
+			SizeBytes: 488254464 * 1024, RaidDisks: 2, ActiveDisks: 2, Status: "[UU]",
+			Sync: &RaidSync{Action: "resync", Queued: "DELAYED"},
+		},
+	}
+	if !reflect.DeepEqual(report.Arrays, want) {
+		t.Errorf("arrays = %+v\nwant %+v", report.Arrays, want)
+	}
+}
+
+func TestParseMdstatDegraded(t *testing.T) {
+	report := parseMdstat(string(readFixture(t, "mdstat", "degraded.txt")))
+	want := []RaidArray{
+		{
+			Name: "md127", State: "active", Level: "raid5",
+			Members: []RaidMember{
+				{Device: "sde1", Role: 4}, {Device: "sdd1", Role: 2, Faulty: true},
+				{Device: "sdc1", Role: 1}, {Device: "sdb1", Role: 0},
+			},
+			SizeBytes: 2929889280 * 1024, RaidDisks: 4, ActiveDisks: 3, Status: "[UU_U]", Degraded: true,
+			Sync:    &RaidSync{Action: "recovery", Percent: percent(8.5), Finish: "92.4min", Speed: "161120K/sec"},
+			Warning: "1 of 4 devices missing; faulty: sdd1; rebuilding",
+		},
+		{
+			Name: "md126", State: "active", ReadOnly: true, Level: "raid1",
+			Members:   []RaidMember{{Device: "sdg1", Role: 1}},
+			SizeBytes: 1047552 * 1024, RaidDisks: 2, ActiveDisks: 1, Status: "[_U]", Degraded: true,
+			Warning: "1 of 2 devices missing",
+		},
+		{
+			// Inactive arrays list no level, and their members show as spares
+			Name: "md125", State: "inactive",
+			Members:   []RaidMember{{Device: "sdh1", Role: 0, Spare: true}},
+			SizeBytes: 1047552 * 1024,
+			Warning:   "array is inactive",
+		},
+	}
+	if !reflect.DeepEqual(report.Arrays, want) {
+		t.Errorf("arrays = %+v\nwant %+v", report.Arrays, want)
+	}
+}
+
+func TestParseMdstatEmpty(t *testing.T) {
+	report := parseMdstat(string(readFixture(t, "mdstat", "empty.txt")))
+	if len(report.Personalities) != 0 || report.Arrays == nil || len(report.Arrays) != 0 {
+		t.Errorf("report = %+v, want no arrays", report)
+	}
+}
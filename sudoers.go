@@ -0,0 +1,695 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Paths of the sudo policy
+const (
+	sudoersFile = "/etc/sudoers"
+	sudoersDir  = "/etc/sudoers.d"
+)
+
+// Managed drop-ins are named with this prefix and start with sudoersManagedHeader, so the
+// agent never touches a file it didn't write
+const (
+	sudoersManagedPrefix = "cosi-"
+	sudoersManagedHeader = "# Managed by cosi through PUT /sudoers/managed; local changes are overwritten\n"
+)
+
+// How deep includes may nest before the parser gives up, like sudo's own limit
+const maxSudoersIncludeDepth = 128
+
+// Largest drop-in PUT /sudoers/managed accepts
+const maxSudoersDropInBytes = 64 << 10
+
+// Names of managed drop-ins. sudo skips files in sudoers.d whose names contain a dot or
+// end in ~, so neither is allowed.
+var sudoersNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Commas of a list with the whitespace around them
+var sudoersListSeparator = regexp.MustCompile(`\s*,\s*`)
+
+// Alias kinds of a sudoers file, keyed by the keyword that defines them
+var sudoersAliasKinds = map[string]string{
+	"User_Alias":  "user",
+	"Runas_Alias": "runas",
+	"Host_Alias":  "host",
+	"Cmnd_Alias":  "command",
+	"Cmd_Alias":   "command",
+}
+
+// Scope of the tokens that may write and delete the managed drop-ins
+const scopeSudoers = "sudoers"
+
+// sudoersLock serializes changes to the managed drop-ins
+var sudoersLock sync.Mutex
+
+// SudoCommand is one command of a rule with the run-as and tags that apply to it
+type SudoCommand struct {
+	Command string `json:"command"`
+	// RunAsUsers and RunAsGroups are from the (user:group) before the command; without one
+	// the command runs as root
+	RunAsUsers  []string `json:"runas_users"`
+	RunAsGroups []string `json:"runas_groups,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	NoPasswd    bool     `json:"nopasswd"`
+}
+
+// SudoRule is a user specification: who may run which commands on which hosts
+type SudoRule struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+	// Users are users, %groups, #uids and aliases as written; ExpandedUsers resolves the
+	// user aliases among them
+	Users         []string      `json:"users"`
+	ExpandedUsers []string      `json:"expanded_users,omitempty"`
+	Hosts         []string      `json:"hosts"`
+	Commands      []SudoCommand `json:"commands"`
+}
+
+// SudoDefault is a Defaults line
+type SudoDefault struct {
+	File  string `json:"file"`
+	Line  int    `json:"line"`
+	Value string `json:"value"`
+}
+
+// SudoersPolicy is the response of GET /sudoers
+type SudoersPolicy struct {
+	// Files are the files read, in the order sudo reads them
+	Files    []string      `json:"files"`
+	Defaults []SudoDefault `json:"defaults"`
+	// Aliases are keyed by kind (user, runas, host or command), then by name
+	Aliases  map[string]map[string][]string `json:"aliases"`
+	Rules    []SudoRule                     `json:"rules"`
+	Warnings []string                       `json:"warnings,omitempty"`
+}
+
+// SudoersDropIn is a managed drop-in in /etc/sudoers.d
+type SudoersDropIn struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	SHA256  string `json:"sha256"`
+	Content string `json:"content"`
+}
+
+// SudoersDropInRequest is the body of PUT /sudoers/managed/:name
+type SudoersDropInRequest struct {
+	Content string `json:"content" binding:"required"`
+}
+
+// SudoersDropInChange is the response of PUT and DELETE /sudoers/managed/:name
+type SudoersDropInChange struct {
+	SudoersDropIn
+	Changed bool `json:"changed"`
+}
+
+// sudoersParser reads a sudoers file and the files it includes into a policy
+type sudoersParser struct {
+	policy   *SudoersPolicy
+	seen     map[string]bool
+	hostname string
+}
+
+// Function to parse the sudo policy starting at path. Unreadable includes and lines the
+// parser doesn't understand become warnings; only an unreadable path is an error.
+func parseSudoers(path string) (*SudoersPolicy, error) {
+	p := &sudoersParser{
+		policy: &SudoersPolicy{Files: []string{}, Defaults: []SudoDefault{}, Aliases: map[string]map[string][]string{}, Rules: []SudoRule{}},
+		seen:   make(map[string]bool),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		p.hostname, _, _ = strings.Cut(hostname, ".")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p.parse(path, string(data), 0)
+	for i, rule := range p.policy.Rules {
+		p.policy.Rules[i].ExpandedUsers = p.expandUsers(rule.Users)
+	}
+	return p.policy, nil
+}
+
+// Helper function to record something the parser skipped
+func (p *sudoersParser) warn(format string, args ...interface{}) {
+	p.policy.Warnings = append(p.policy.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Function to parse one file, following its includes
+func (p *sudoersParser) parse(path, data string, depth int) {
+	if p.seen[path] {
+		p.warn("%s: skipped, already included", path)
+		return
+	}
+	p.seen[path] = true
+	p.policy.Files = append(p.policy.Files, path)
+
+	for _, line := range joinSudoersLines(data) {
+		text := strings.TrimSpace(line.text)
+		if directive, target, ok := sudoersInclude(text); ok {
+			p.include(path, directive, target, depth)
+			continue
+		}
+		text = stripSudoersComment(text)
+		if text == "" {
+			continue
+		}
+		keyword := strings.Fields(text)[0]
+		rest := strings.TrimSpace(text[len(keyword):])
+		switch {
+		case keyword == "Defaults" || strings.HasPrefix(keyword, "Defaults") && strings.ContainsAny(keyword[8:9], "@:!>"):
+			p.policy.Defaults = append(p.policy.Defaults, SudoDefault{File: path, Line: line.number, Value: text})
+		case sudoersAliasKinds[keyword] != "":
+			p.parseAliases(path, line.number, sudoersAliasKinds[keyword], rest)
+		default:
+			rules, err := parseSudoersRule(text)
+			if err != nil {
+				p.warn("%s:%d: %v", path, line.number, err)
+				continue
+			}
+			for _, rule := range rules {
+				rule.File, rule.Line = path, line.number
+				p.policy.Rules = append(p.policy.Rules, rule)
+			}
+		}
+	}
+}
+
+// Function to follow an @include or @includedir. Relative paths are relative to the
+// including file, and %h is the short hostname, as in sudo 1.9.
+func (p *sudoersParser) include(from, directive, target string, depth int) {
+	if depth >= maxSudoersIncludeDepth {
+		p.warn("%s: %s %s: includes nest too deep", from, directive, target)
+		return
+	}
+	target = strings.ReplaceAll(target, "%h", p.hostname)
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(from), target)
+	}
+	if directive == "includedir" {
+		entries, err := os.ReadDir(target)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				p.warn("%s: %v", from, err)
+			}
+			return
+		}
+		// sudo reads the directory in lexical order and skips editor backups and files
+		// with a dot, like package manager leftovers
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || strings.HasSuffix(name, "~") || strings.Contains(name, ".") {
+				continue
+			}
+			p.includeFile(from, filepath.Join(target, name), depth)
+		}
+		return
+	}
+	p.includeFile(from, target, depth)
+}
+
+// Helper function to parse an included file, warning when it can't be read
+func (p *sudoersParser) includeFile(from, path string, depth int) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		p.warn("%s: include %s: %v", from, path, err)
+		return
+	}
+	p.parse(path, string(data), depth+1)
+}
+
+// Function to parse the definitions of an alias line: NAME = a, b : NAME2 = c
+func (p *sudoersParser) parseAliases(path string, number int, kind, text string) {
+	for _, definition := range splitSudoers(text, ':') {
+		name, members, ok := strings.Cut(definition, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			p.warn("%s:%d: malformed alias %q", path, number, strings.TrimSpace(definition))
+			continue
+		}
+		if p.policy.Aliases[kind] == nil {
+			p.policy.Aliases[kind] = make(map[string][]string)
+		}
+		p.policy.Aliases[kind][name] = splitSudoersList(members)
+	}
+}
+
+// Function to resolve the user aliases of a user list, recursively and without repeats.
+// Negated entries and entries that aren't aliases are kept as they are.
+func (p *sudoersParser) expandUsers(users []string) []string {
+	aliases := p.policy.Aliases["user"]
+	expanded := []string{}
+	seen := make(map[string]bool)
+	used := false
+	var expand func(names []string, depth int)
+	expand = func(names []string, depth int) {
+		for _, name := range names {
+			if members, ok := aliases[name]; ok && depth < maxSudoersIncludeDepth {
+				used = true
+				expand(members, depth+1)
+				continue
+			}
+			if !seen[name] {
+				seen[name] = true
+				expanded = append(expanded, name)
+			}
+		}
+	}
+	expand(users, 0)
+	if !used {
+		return nil
+	}
+	return expanded
+}
+
+// sudoersLogicalLine is a logical line of a sudoers file, with continuations joined
+type sudoersLogicalLine struct {
+	number int
+	text   string
+}
+
+// Function to join lines ending in a backslash with the next, keeping the number of the
+// first
+func joinSudoersLines(data string) []sudoersLogicalLine {
+	var lines []sudoersLogicalLine
+	var current strings.Builder
+	start := 0
+	for i, line := range strings.Split(data, "\n") {
+		if current.Len() == 0 {
+			start = i + 1
+		}
+		line = strings.TrimRight(line, "\r")
+		if strings.HasSuffix(line, `\`) && !strings.HasSuffix(line, `\\`) {
+			current.WriteString(strings.TrimSuffix(line, `\`))
+			current.WriteByte(' ')
+			continue
+		}
+		current.WriteString(line)
+		lines = append(lines, sudoersLogicalLine{number: start, text: current.String()})
+		current.Reset()
+	}
+	if current.Len() > 0 {
+		lines = append(lines, sudoersLogicalLine{number: start, text: current.String()})
+	}
+	return lines
+}
+
+// Function to recognize an include directive. Both the @ spelling of sudo 1.9 and the
+// older # spelling are accepted.
+func sudoersInclude(text string) (string, string, bool) {
+	for _, prefix := range []string{"@", "#"} {
+		for _, directive := range []string{"includedir", "include"} {
+			if rest, ok := strings.CutPrefix(text, prefix+directive); ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t') {
+				target := strings.TrimSpace(rest)
+				target = strings.Trim(target, `"`)
+				return directive, target, target != ""
+			}
+		}
+	}
+	return "", "", false
+}
+
+// Function to remove a comment. A # starts one unless it is escaped or begins a #uid,
+// like "#1000 ALL = ALL".
+func stripSudoersComment(text string) string {
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '#':
+			if i+1 < len(text) && text[i+1] >= '0' && text[i+1] <= '9' && (i == 0 || strings.ContainsRune(" \t,(!:=", rune(text[i-1]))) {
+				continue
+			}
+			return strings.TrimSpace(text[:i])
+		}
+	}
+	return strings.TrimSpace(text)
+}
+
+// Function to split text on sep where it is outside parentheses and not escaped
+func splitSudoers(text string, sep byte) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+			}
+		case sep:
+			if depth == 0 {
+				parts = append(parts, text[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, text[start:])
+}
+
+// Helper function to split a comma separated list, dropping empty entries
+func splitSudoersList(text string) []string {
+	items := []string{}
+	for _, item := range splitSudoers(text, ',') {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Function to parse a user specification:
+//
+//	User_List Host_List = [(Runas)] [Tag:]... Cmnd_List [: Host_List = ...]
+//
+// Every host list after the first starts another spec for the same users, which becomes
+// a rule of its own so each host list keeps its commands.
+func parseSudoersRule(text string) ([]SudoRule, error) {
+	equals := strings.IndexByte(text, '=')
+	if equals < 0 {
+		return nil, fmt.Errorf("not a rule: %q", text)
+	}
+	// The users end at the last whitespace before the first host list
+	left := strings.Join(strings.Fields(sudoersListSeparator.ReplaceAllString(text[:equals], ",")), " ")
+	split := strings.LastIndexByte(left, ' ')
+	if split < 0 {
+		return nil, fmt.Errorf("rule without a host list: %q", text)
+	}
+	users := splitSudoersList(left[:split])
+
+	var rules []SudoRule
+	for _, spec := range splitSudoersSpecs(left[split+1:] + "=" + text[equals+1:]) {
+		hosts, commands, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed host list in %q", text)
+		}
+		parsed, err := parseSudoersCommands(commands)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, SudoRule{Users: users, Hosts: splitSudoersList(hosts), Commands: parsed})
+	}
+	return rules, nil
+}
+
+// Function to split "hosts = commands : hosts = commands" into its specs. A : ending a
+// tag like NOPASSWD: is told apart from one between specs by the word before it; any
+// other : must be escaped in a command.
+func splitSudoersSpecs(text string) []string {
+	parts := splitSudoers(text, ':')
+	specs := []string{parts[0]}
+	for _, part := range parts[1:] {
+		last := specs[len(specs)-1]
+		word := last[strings.LastIndexAny(last, " \t,)=:")+1:]
+		if isSudoersTag(word) {
+			specs[len(specs)-1] += ":" + part
+		} else {
+			specs = append(specs, part)
+		}
+	}
+	return specs
+}
+
+// Function to parse a command list, carrying the run-as and tags over to the commands
+// that follow until another sets them, as sudo does
+func parseSudoersCommands(text string) ([]SudoCommand, error) {
+	commands := []SudoCommand{}
+	runAsUsers, runAsGroups := []string{"root"}, []string(nil)
+	tags := map[string]bool{}
+	for _, item := range splitSudoersList(text) {
+		if strings.HasPrefix(item, "(") {
+			end := strings.IndexByte(item, ')')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated run-as in %q", item)
+			}
+			users, groups, hasGroups := strings.Cut(item[1:end], ":")
+			runAsUsers, runAsGroups = splitSudoersList(strings.ReplaceAll(users, " ", ",")), nil
+			if hasGroups {
+				runAsGroups = splitSudoersList(strings.ReplaceAll(groups, " ", ","))
+			}
+			// (:group) runs as the invoking user with another group
+			if len(runAsUsers) == 0 && !hasGroups {
+				runAsUsers = []string{"root"}
+			}
+			item = strings.TrimSpace(item[end+1:])
+		}
+		for {
+			tag, rest, ok := strings.Cut(item, ":")
+			if !ok || !isSudoersTag(tag) {
+				break
+			}
+			tags[tag] = true
+			if negated, isTag := strings.CutPrefix(tag, "NO"); isTag {
+				delete(tags, negated)
+			} else {
+				delete(tags, "NO"+tag)
+			}
+			item = strings.TrimSpace(rest)
+		}
+		command := SudoCommand{Command: item, RunAsUsers: runAsUsers, RunAsGroups: runAsGroups, NoPasswd: tags["NOPASSWD"]}
+		for tag := range tags {
+			command.Tags = append(command.Tags, tag)
+		}
+		sort.Strings(command.Tags)
+		commands = append(commands, command)
+	}
+	return commands, nil
+}
+
+// Helper function to check whether a word is one of sudo's command tags
+func isSudoersTag(word string) bool {
+	switch word {
+	case "PASSWD", "NOPASSWD", "EXEC", "NOEXEC", "SETENV", "NOSETENV", "LOG_INPUT", "NOLOG_INPUT",
+		"LOG_OUTPUT", "NOLOG_OUTPUT", "MAIL", "NOMAIL", "FOLLOW", "NOFOLLOW", "INTERCEPT", "NOINTERCEPT":
+		return true
+	}
+	return false
+}
+
+// Function to check the name of a managed drop-in
+func validateSudoersName(name string) error {
+	if !sudoersNamePattern.MatchString(name) {
+		return &requestError{Status: 400, Code: "invalid_name", Message: fmt.Sprintf("%q is not a valid drop-in name: use lowercase letters, digits, _ and -, up to 64 characters", name)}
+	}
+	return nil
+}
+
+// Helper function to return the path of a managed drop-in
+func sudoersDropInPath(name string) string {
+	return filepath.Join(sudoersDir, sudoersManagedPrefix+name)
+}
+
+// Helper function to read a drop-in, returning nil when it doesn't exist or isn't managed
+func readSudoersDropIn(name string) (*SudoersDropIn, error) {
+	path := sudoersDropInPath(name)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	content, managed := strings.CutPrefix(string(data), sudoersManagedHeader)
+	if !managed {
+		return nil, nil
+	}
+	sum := sha256.Sum256(data)
+	return &SudoersDropIn{Name: name, Path: path, SHA256: hex.EncodeToString(sum[:]), Content: content}, nil
+}
+
+// Function to list the drop-ins the agent manages
+func listSudoersDropIns() ([]SudoersDropIn, error) {
+	dropIns := []SudoersDropIn{}
+	entries, err := os.ReadDir(sudoersDir)
+	if os.IsNotExist(err) {
+		return dropIns, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutPrefix(entry.Name(), sudoersManagedPrefix)
+		if !ok || entry.IsDir() || !sudoersNamePattern.MatchString(name) {
+			continue
+		}
+		dropIn, err := readSudoersDropIn(name)
+		if err != nil {
+			return nil, err
+		}
+		if dropIn != nil {
+			dropIns = append(dropIns, *dropIn)
+		}
+	}
+	return dropIns, nil
+}
+
+// Function to write a managed drop-in. The content is staged next to the target, where
+// sudo ignores it because of the dot in its name, checked with `visudo -cf`, and only then
+// renamed into place, so an invalid file never becomes part of the policy.
+func writeSudoersDropIn(ctx context.Context, name, content string) (*SudoersDropInChange, error) {
+	if err := validateSudoersName(name); err != nil {
+		return nil, err
+	}
+	if len(content) > maxSudoersDropInBytes {
+		return nil, &requestError{Status: 413, Code: "content_too_large", Message: fmt.Sprintf("content is larger than %d bytes", maxSudoersDropInBytes)}
+	}
+	if _, err := exec.LookPath("visudo"); err != nil {
+		return nil, &requestError{Status: 501, Code: "visudo_missing", Message: "visudo is not installed, so the drop-in can't be validated"}
+	}
+	if !strings.HasSuffix(content, "\n") {
+		// sudo rejects a file whose last line has no newline
+		content += "\n"
+	}
+
+	sudoersLock.Lock()
+	defer sudoersLock.Unlock()
+
+	existing, err := readSudoersDropIn(name)
+	if err != nil {
+		return nil, err
+	}
+	path := sudoersDropInPath(name)
+	if existing == nil {
+		if _, err := os.Lstat(path); err == nil {
+			return nil, &requestError{Status: 409, Code: "not_managed", Message: path + " exists and is not managed by the agent"}
+		}
+	} else if existing.Content == content {
+		return &SudoersDropInChange{SudoersDropIn: *existing}, nil
+	}
+
+	if err := os.MkdirAll(sudoersDir, 0750); err != nil {
+		return nil, err
+	}
+	staged, err := stageFile(path, []byte(sudoersManagedHeader+content), 0440, 0, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return nil, &requestError{Status: 403, Code: "permission_denied", Message: err.Error()}
+		}
+		return nil, err
+	}
+	cmd := newCommand("visudo", "-c", "-f", staged)
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		os.Remove(staged)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &responseError{422, gin.H{"error": "visudo rejected the drop-in", "code": "validation_failed", "output": result.Output}}
+	}
+	if err := os.Rename(staged, path); err != nil {
+		os.Remove(staged)
+		return nil, err
+	}
+	syncDir(sudoersDir)
+
+	dropIn, err := readSudoersDropIn(name)
+	if err != nil {
+		return nil, err
+	}
+	return &SudoersDropInChange{SudoersDropIn: *dropIn, Changed: true}, nil
+}
+
+// Function to delete a managed drop-in
+func deleteSudoersDropIn(name string) (*SudoersDropInChange, error) {
+	if err := validateSudoersName(name); err != nil {
+		return nil, err
+	}
+
+	sudoersLock.Lock()
+	defer sudoersLock.Unlock()
+
+	existing, err := readSudoersDropIn(name)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return nil, &requestError{Status: 404, Code: "not_found", Message: "No managed drop-in named " + name}
+	}
+	if err := os.Remove(existing.Path); err != nil {
+		return nil, err
+	}
+	syncDir(sudoersDir)
+	return &SudoersDropInChange{SudoersDropIn: *existing, Changed: true}, nil
+}
+
+// Function to register the sudoers endpoints
+func registerSudoersRoutes(r *gin.Engine) {
+	// Define the /sudoers endpoint that reports who may run what through sudo
+	r.GET("/sudoers", func(c *gin.Context) {
+		policy, err := parseSudoers(sudoersFile)
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(404, gin.H{"error": sudoersFile + " does not exist", "code": "sudo_not_installed"})
+			return
+		case errors.Is(err, os.ErrPermission):
+			c.JSON(403, gin.H{"error": err.Error(), "code": "permission_denied"})
+			return
+		case err != nil:
+			respondFailure(c, "Failed to read the sudo policy", err)
+			return
+		}
+		c.JSON(200, policy)
+	})
+
+	// Define the /sudoers/managed endpoint that lists the drop-ins the agent manages
+	r.GET("/sudoers/managed", func(c *gin.Context) {
+		dropIns, err := listSudoersDropIns()
+		if err != nil {
+			respondFailure(c, "Failed to list the managed drop-ins", err)
+			return
+		}
+		c.JSON(200, dropIns)
+	})
+
+	// Define the /sudoers/managed/{name} PUT endpoint that writes a drop-in once visudo
+	// accepts it
+	r.PUT("/sudoers/managed/:name", requireScope(scopeSudoers), func(c *gin.Context) {
+		var request SudoersDropInRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format: content is required"})
+			return
+		}
+		change, err := writeSudoersDropIn(c.Request.Context(), c.Param("name"), request.Content)
+		details := map[string]interface{}{"name": c.Param("name")}
+		if change != nil {
+			details["sha256"] = change.SHA256
+			details["changed"] = change.Changed
+		}
+		audit.Record(auditOutcome("sudoers.write", c.ClientIP(), details, err))
+		if err != nil {
+			respondFailure(c, "Failed to write the drop-in", err)
+			return
+		}
+		c.JSON(200, change)
+	})
+
+	// Define the /sudoers/managed/{name} DELETE endpoint that removes a managed drop-in
+	r.DELETE("/sudoers/managed/:name", requireScope(scopeSudoers), func(c *gin.Context) {
+		change, err := deleteSudoersDropIn(c.Param("name"))
+		audit.Record(auditOutcome("sudoers.delete", c.ClientIP(), map[string]interface{}{"name": c.Param("name")}, err))
+		if err != nil {
+			respondFailure(c, "Failed to delete the drop-in", err)
+			return
+		}
+		c.JSON(200, change)
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testdata/sudoers is laid out like /etc: a Debian sudoers with aliases, line
+// continuations and a line sudo would reject, and a sudoers.d with a drop-in, a README,
+// an editor backup, a package leftover and a file that includes the main file again
+func TestParseSudoers(t *testing.T) {
+	dir := filepath.Join("testdata", "sudoers")
+	mainFile := filepath.Join(dir, "sudoers")
+	dropIn := filepath.Join(dir, "sudoers.d", "10-kubernetes")
+	root := []string{"root"}
+	all := []string{"ALL"}
+	want := &SudoersPolicy{
+		// The backup and the file with a dot are skipped, and the loop is read once
+		Files: []string{mainFile, dropIn, filepath.Join(dir, "sudoers.d", "30-loop"), filepath.Join(dir, "sudoers.d", "README")},
+		Defaults: []SudoDefault{
+			{mainFile, 6, "Defaults\tenv_reset"},
+			{mainFile, 7, "Defaults\tmail_badpass"},
+			{mainFile, 8, `Defaults	secure_path="/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"`},
+			{mainFile, 9, "Defaults:OPERATORS\t!lecture"},
+			{dropIn, 2, "Defaults:deploy\t!requiretty"},
+		},
+		Aliases: map[string]map[string][]string{
+			"user": {
+				"OPERATORS": {"alice", "bob", "%ops"},
+				"ADMINS":    {"OPERATORS", "carol"},
+			},
+			"command": {
+				"KUBE":     {"/usr/bin/kubectl", "/usr/bin/kubeadm", "/usr/bin/crictl"},
+				"REBOOT":   {"/sbin/reboot"},
+				"SERVICES": {"/usr/bin/systemctl restart *"},
+			},
+		},
+		Rules: []SudoRule{
+			{File: mainFile, Line: 23, Users: root, Hosts: all, Commands: []SudoCommand{
+				{Command: "ALL", RunAsUsers: all, RunAsGroups: all},
+			}},
+			// The comment after the rule is dropped
+			{File: mainFile, Line: 26, Users: []string{"%sudo"}, Hosts: all, Commands: []SudoCommand{
+				{Command: "ALL", RunAsUsers: all, RunAsGroups: all},
+			}},
+			// ADMINS expands through OPERATORS; tags carry over until another replaces them
+			{File: mainFile, Line: 28, Users: []string{"ADMINS"}, ExpandedUsers: []string{"alice", "bob", "%ops", "carol"}, Hosts: all, Commands: []SudoCommand{
+				{Command: "KUBE", RunAsUsers: root, Tags: []string{"NOPASSWD"}, NoPasswd: true},
+				{Command: "REBOOT", RunAsUsers: root, Tags: []string{"PASSWD"}},
+			}},
+			// A #uid isn't a comment, and neither is an escaped #
+			{File: mainFile, Line: 29, Users: []string{"#1001"}, Hosts: all, Commands: []SudoCommand{
+				{Command: `/usr/bin/tee /var/www/\#index.html`, RunAsUsers: []string{"www-data"}},
+			}},
+			// One logical line over three, with a second host list that becomes its own rule
+			{File: dropIn, Line: 3, Users: []string{"deploy"}, Hosts: all, Commands: []SudoCommand{
+				{Command: "/usr/bin/systemctl restart kubelet", RunAsUsers: root, Tags: []string{"NOPASSWD"}, NoPasswd: true},
+				{Command: "/usr/bin/systemctl status kubelet", RunAsUsers: root, Tags: []string{"NOPASSWD"}, NoPasswd: true},
+			}},
+			{File: dropIn, Line: 3, Users: []string{"deploy"}, Hosts: []string{"node01"}, Commands: []SudoCommand{
+				{Command: "/usr/bin/journalctl -u kubelet", RunAsUsers: root},
+			}},
+		},
+		Warnings: []string{
+			mainFile + `:30: not a rule: "this line is not sudoers"`,
+			mainFile + ": skipped, already included",
+			mainFile + ": include " + filepath.Join(dir, "missing") + ": open " + filepath.Join(dir, "missing") + ": no such file or directory",
+		},
+	}
+
+	got, err := parseSudoers(mainFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSudoers:\n got %s\nwant %s", toJSON(got), toJSON(want))
+	}
+
+	if _, err := parseSudoers(filepath.Join(dir, "does-not-exist")); err == nil {
+		t.Error("parseSudoers of a missing file succeeded")
+	}
+}
+
+func TestJoinSudoersLines(t *testing.T) {
+	data := "a \\\n  b \\\n  c\nd\n# comment \\\nstill the comment\r\ne \\\\\nf \\"
+	want := []sudoersLogicalLine{
+		{1, "a    b    c"},
+		{4, "d"},
+		{5, "# comment  still the comment"},
+		// A doubled backslash is an escaped one, not a continuation
+		{7, `e \\`},
+		{8, "f  "},
+	}
+	if got := joinSudoersLines(data); !reflect.DeepEqual(got, want) {
+		t.Errorf("joinSudoersLines = %q\nwant %q", got, want)
+	}
+}
+
+func TestStripSudoersComment(t *testing.T) {
+	tests := map[string]string{
+		"# a comment":                          "",
+		"root ALL=(ALL) ALL # trailing":        "root ALL=(ALL) ALL",
+		"#1000 ALL = ALL":                      "#1000 ALL = ALL",
+		"alice ALL = (#0) /bin/ls":             "alice ALL = (#0) /bin/ls",
+		"User_Alias U = #1000, #1001 # both":   "User_Alias U = #1000, #1001",
+		`bob ALL = /bin/echo \# not a comment`: `bob ALL = /bin/echo \# not a comment`,
+		"bob ALL = /bin/echo#comment":          "bob ALL = /bin/echo",
+	}
+	for text, want := range tests {
+		if got := stripSudoersComment(text); got != want {
+			t.Errorf("stripSudoersComment(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestParseSudoersRuleInvalid(t *testing.T) {
+	for _, text := range []string{
+		"no equals sign here",
+		"ALL = ALL",
+		"alice ALL = (root /bin/ls",
+	} {
+		if rules, err := parseSudoersRule(text); err == nil {
+			t.Errorf("parseSudoersRule(%q) = %+v, want an error", text, rules)
+		}
+	}
+}
+
+// Writing and deleting the managed drop-ins needs the sudoers scope. The name is invalid
+// so the requests let through are refused before anything is written.
+func TestSudoersRoutesRequireScope(t *testing.T) {
+	withJobStore(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerSudoersRoutes(r)
+
+	checkScopeRequired(t, r, scopeSudoers, "PUT", "/sudoers/managed/Not.Valid", `{"content": "deploy ALL = ALL"}`)
+	checkScopeRequired(t, r, scopeSudoers, "DELETE", "/sudoers/managed/Not.Valid", "")
+
+	withScopedTokens(t, scopeSudoers)
+	if w := serveWithToken(r, "PUT", "/sudoers/managed/Not.Valid", `{"content": "deploy ALL = ALL"}`, "ops-token"); w.Code != 400 {
+		t.Errorf("PUT with an invalid name = %d %s, want 400", w.Code, w.Body)
+	}
+}
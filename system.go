@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// MemoryInfo summarizes /proc/meminfo
+type MemoryInfo struct {
+	TotalBytes     uint64 `json:"total_bytes"`
+	AvailableBytes uint64 `json:"available_bytes"`
+	SwapTotalBytes uint64 `json:"swap_total_bytes"`
+	SwapFreeBytes  uint64 `json:"swap_free_bytes"`
+}
+
+// CPUInfo summarizes the processors and load of the host
+type CPUInfo struct {
+	Model   string    `json:"model,omitempty"`
+	Count   int       `json:"count"`
+	LoadAvg []float64 `json:"load_avg"`
+}
+
+// DiskInfo describes the usage of a mounted block device
+type DiskInfo struct {
+	Device     string `json:"device"`
+	MountPoint string `json:"mount_point"`
+	FSType     string `json:"fs_type"`
+	TotalBytes uint64 `json:"total_bytes"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	UsedBytes  uint64 `json:"used_bytes"`
+}
+
+// InterfaceInfo describes a network interface and its addresses
+type InterfaceInfo struct {
+	Name      string   `json:"name"`
+	MAC       string   `json:"mac,omitempty"`
+	MTU       int      `json:"mtu"`
+	Up        bool     `json:"up"`
+	Addresses []string `json:"addresses"`
+}
+
+// Function to read the memory summary from /proc/meminfo
+func collectMemory() (*MemoryInfo, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = kb * 1024
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &MemoryInfo{
+		TotalBytes:     values["MemTotal"],
+		AvailableBytes: values["MemAvailable"],
+		SwapTotalBytes: values["SwapTotal"],
+		SwapFreeBytes:  values["SwapFree"],
+	}, nil
+}
+
+// Function to read the CPU model, count, and load averages
+func collectCPU() (*CPUInfo, error) {
+	info := &CPUInfo{Count: runtime.NumCPU()}
+
+	if data, err := os.ReadFile("/proc/cpuinfo"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if key, value, ok := strings.Cut(line, ":"); ok && strings.TrimSpace(key) == "model name" {
+				info.Model = strings.TrimSpace(value)
+				break
+			}
+		}
+	}
+
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	for i := 0; i < 3 && i < len(fields); i++ {
+		load, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, err
+		}
+		info.LoadAvg = append(info.LoadAvg, load)
+	}
+	return info, nil
+}
+
+// Function to report usage for every mounted block device
+func collectDisks() ([]DiskInfo, error) {
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	disks := []DiskInfo{}
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "/dev/") || seen[fields[1]] {
+			continue
+		}
+		seen[fields[1]] = true
+
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(fields[1], &stat); err != nil {
+			continue // Skip mounts we can't stat
+		}
+		total := stat.Blocks * uint64(stat.Bsize)
+		free := stat.Bavail * uint64(stat.Bsize)
+		disks = append(disks, DiskInfo{
+			Device:     fields[0],
+			MountPoint: fields[1],
+			FSType:     fields[2],
+			TotalBytes: total,
+			FreeBytes:  free,
+			UsedBytes:  total - stat.Bfree*uint64(stat.Bsize),
+		})
+	}
+	return disks, scanner.Err()
+}
+
+// Function to list the network interfaces and their addresses
+func collectInterfaces() ([]InterfaceInfo, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]InterfaceInfo, 0, len(ifaces))
+	for _, iface := range ifaces {
+		info := InterfaceInfo{
+			Name:      iface.Name,
+			MAC:       iface.HardwareAddr.String(),
+			MTU:       iface.MTU,
+			Up:        iface.Flags&net.FlagUp != 0,
+			Addresses: []string{},
+		}
+		if addrs, err := iface.Addrs(); err == nil {
+			for _, addr := range addrs {
+				info.Addresses = append(info.Addresses, addr.String())
+			}
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+// InterfaceCounters holds the traffic counters of a network interface since boot
+type InterfaceCounters struct {
+	Name            string `json:"name"`
+	ReceiveBytes    uint64 `json:"receive_bytes"`
+	ReceivePackets  uint64 `json:"receive_packets"`
+	ReceiveErrors   uint64 `json:"receive_errors"`
+	TransmitBytes   uint64 `json:"transmit_bytes"`
+	TransmitPackets uint64 `json:"transmit_packets"`
+	TransmitErrors  uint64 `json:"transmit_errors"`
+}
+
+// Function to read the traffic counters of every network interface from /proc/net/dev
+func collectInterfaceCounters() ([]InterfaceCounters, error) {
+	data, err := os.ReadFile("/proc/net/dev")
+	if err != nil {
+		return nil, err
+	}
+
+	counters := []InterfaceCounters{}
+	for _, line := range strings.Split(string(data), "\n") {
+		// The first two lines are headers; the rest are "name: 8 receive and 8 transmit columns"
+		name, values, ok := strings.Cut(line, ":")
+		fields := strings.Fields(values)
+		if !ok || len(fields) < 16 {
+			continue
+		}
+		number := func(i int) uint64 {
+			value, _ := strconv.ParseUint(fields[i], 10, 64)
+			return value
+		}
+		counters = append(counters, InterfaceCounters{
+			Name:            strings.TrimSpace(name),
+			ReceiveBytes:    number(0),
+			ReceivePackets:  number(1),
+			ReceiveErrors:   number(2),
+			TransmitBytes:   number(8),
+			TransmitPackets: number(9),
+			TransmitErrors:  number(10),
+		})
+	}
+	return counters, nil
+}
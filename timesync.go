@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Layout of the timestamps in `timedatectl show-timesync`
+const timesyncTimestampLayout = "Mon 2006-01-02 15:04:05.999999 MST"
+
+// States of the second column of `chronyc -c sources`
+var chronySourceStates = map[string]string{
+	"*": "selected",
+	"+": "combined",
+	"-": "not_combined",
+	"?": "unreachable",
+	"x": "falseticker",
+	"~": "variable",
+}
+
+// Modes of the first column of `chronyc -c sources`
+var chronySourceModes = map[string]string{
+	"^": "server",
+	"=": "peer",
+	"#": "refclock",
+}
+
+// States of the tally code that prefixes the lines of `ntpq -pn`
+var ntpqTallyStates = map[byte]string{
+	'*': "selected",
+	'+': "candidate",
+	'-': "outlier",
+	'x': "falseticker",
+	'#': "backup",
+	'o': "selected",
+	'.': "excess",
+	' ': "rejected",
+}
+
+// TimeSource is a time source of the NTP daemon
+type TimeSource struct {
+	Address string `json:"address"`
+	// Mode is server, peer or refclock
+	Mode     string `json:"mode,omitempty"`
+	State    string `json:"state"`
+	Selected bool   `json:"selected"`
+	Stratum  int    `json:"stratum"`
+	// Reach is the octal reachability register; 377 means the last eight polls answered
+	Reach string `json:"reach,omitempty"`
+	// LastRxSeconds is how long ago the last sample was received, nil when never
+	LastRxSeconds *float64 `json:"last_rx_seconds"`
+	OffsetMs      float64  `json:"offset_ms"`
+	JitterMs      float64  `json:"jitter_ms"`
+}
+
+// TimeTracking is the state of the system clock as chronyd reports it
+type TimeTracking struct {
+	Reference      string  `json:"reference"`
+	Stratum        int     `json:"stratum"`
+	SystemOffsetMs float64 `json:"system_offset_ms"`
+	LastOffsetMs   float64 `json:"last_offset_ms"`
+	RMSOffsetMs    float64 `json:"rms_offset_ms"`
+	FrequencyPPM   float64 `json:"frequency_ppm"`
+	LeapStatus     string  `json:"leap_status"`
+}
+
+// TimeSources is the response of GET /time/sources
+type TimeSources struct {
+	// Daemon is chronyd, systemd-timesyncd or ntpd
+	Daemon   string        `json:"daemon"`
+	Sources  []TimeSource  `json:"sources"`
+	Tracking *TimeTracking `json:"tracking,omitempty"`
+	// MaxOffsetMs is the largest absolute offset of the reachable sources
+	MaxOffsetMs float64 `json:"max_offset_ms"`
+}
+
+// Helper function to check whether a process with the given command name is running
+func processRunning(name string) bool {
+	entries, _ := os.ReadDir("/proc")
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "comm"))
+		if err == nil && strings.TrimSpace(string(comm)) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to detect the NTP daemon that disciplines the clock, returning "" when none
+// runs that the agent can query. The kernel truncates command names to 15 characters.
+func detectTimeDaemon() string {
+	for _, daemon := range []struct{ name, comm, tool string }{
+		{"chronyd", "chronyd", "chronyc"},
+		{"systemd-timesyncd", "systemd-timesyn", "timedatectl"},
+		{"ntpd", "ntpd", "ntpq"},
+	} {
+		if _, err := exec.LookPath(daemon.tool); err == nil && processRunning(daemon.comm) {
+			return daemon.name
+		}
+	}
+	return ""
+}
+
+// Function to collect the time sources of the running NTP daemon
+func collectTimeSources(ctx context.Context) (*TimeSources, error) {
+	daemon := detectTimeDaemon()
+	response := &TimeSources{Daemon: daemon}
+	var err error
+	switch daemon {
+	case "chronyd":
+		response.Sources, response.Tracking, err = chronySources(ctx)
+	case "systemd-timesyncd":
+		response.Sources, err = timesyncdSources(ctx)
+	case "ntpd":
+		response.Sources, err = ntpqSources(ctx)
+	default:
+		return nil, &requestError{Status: 422, Code: "no_time_daemon", Message: "No running chronyd, systemd-timesyncd or ntpd was found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, source := range response.Sources {
+		if source.State != "unreachable" {
+			response.MaxOffsetMs = math.Max(response.MaxOffsetMs, math.Abs(source.OffsetMs))
+		}
+	}
+	return response, nil
+}
+
+// Helper function to run a command and return its output
+func timeCommandOutput(ctx context.Context, name string, args ...string) (string, error) {
+	cmd := newCommand(name, args...)
+	result, err := runCommandContext(ctx, cmd)
+	if err != nil {
+		return "", &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	return result.Output, nil
+}
+
+// Function to read the sources and tracking of chronyd. The jitter is the standard
+// deviation of `chronyc -c sourcestats`, which sources doesn't report.
+func chronySources(ctx context.Context) ([]TimeSource, *TimeTracking, error) {
+	output, err := timeCommandOutput(ctx, "chronyc", "-n", "-c", "sources")
+	if err != nil {
+		return nil, nil, err
+	}
+	sources := parseChronySources(output)
+
+	if output, err := timeCommandOutput(ctx, "chronyc", "-n", "-c", "sourcestats"); err == nil {
+		deviations := make(map[string]float64)
+		for _, line := range strings.Split(output, "\n") {
+			fields := strings.Split(strings.TrimSpace(line), ",")
+			if len(fields) >= 8 {
+				deviations[fields[0]] = parseFloat(fields[7]) * 1000
+			}
+		}
+		for i := range sources {
+			sources[i].JitterMs = deviations[sources[i].Address]
+		}
+	}
+
+	output, err = timeCommandOutput(ctx, "chronyc", "-n", "-c", "tracking")
+	if err != nil {
+		return nil, nil, err
+	}
+	return sources, parseChronyTracking(output), nil
+}
+
+// Function to parse `chronyc -c sources`, whose lines are mode, state, address, stratum,
+// poll, reach, last rx, adjusted offset, measured offset and error, in seconds
+func parseChronySources(output string) []TimeSource {
+	sources := []TimeSource{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) < 10 {
+			continue
+		}
+		stratum, _ := strconv.Atoi(fields[3])
+		source := TimeSource{
+			Address:  fields[2],
+			Mode:     chronySourceModes[fields[0]],
+			State:    chronySourceStates[fields[1]],
+			Selected: fields[1] == "*",
+			Stratum:  stratum,
+			Reach:    fields[5],
+			OffsetMs: parseFloat(fields[7]) * 1000,
+		}
+		// chronyc reports 4294967295 for a source that never answered
+		if lastRx, err := strconv.ParseFloat(fields[6], 64); err == nil && lastRx < math.MaxUint32 {
+			source.LastRxSeconds = &lastRx
+		}
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// Function to parse `chronyc -c tracking`, a single line of reference ID, reference name,
+// stratum, reference time, system offset, last offset, RMS offset, frequency, residual
+// frequency, skew, root delay, root dispersion, update interval and leap status
+func parseChronyTracking(output string) *TimeTracking {
+	fields := strings.Split(strings.TrimSpace(output), ",")
+	if len(fields) < 14 {
+		return nil
+	}
+	stratum, _ := strconv.Atoi(fields[2])
+	return &TimeTracking{
+		Reference:      fields[1],
+		Stratum:        stratum,
+		SystemOffsetMs: parseFloat(fields[4]) * 1000,
+		LastOffsetMs:   parseFloat(fields[5]) * 1000,
+		RMSOffsetMs:    parseFloat(fields[6]) * 1000,
+		FrequencyPPM:   parseFloat(fields[7]),
+		LeapStatus:     fields[13],
+	}
+}
+
+// Helper function to parse a float, returning 0 for anything unparsable
+func parseFloat(value string) float64 {
+	f, _ := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	return f
+}
+
+// Function to read the server systemd-timesyncd synchronizes with. timesyncd talks to one
+// server at a time, so there is a single source, and it reports the timestamps of the
+// last exchange rather than an offset.
+func timesyncdSources(ctx context.Context) ([]TimeSource, error) {
+	output, err := timeCommandOutput(ctx, "timedatectl", "show-timesync", "--all")
+	if err != nil {
+		return nil, err
+	}
+	return parseTimesyncd(output, time.Now()), nil
+}
+
+// Function to parse `timedatectl show-timesync --all`, computing the offset from the
+// timestamps of NTPMessage the way NTP does
+func parseTimesyncd(output string, now time.Time) []TimeSource {
+	properties := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			properties[key] = value
+		}
+	}
+	address := properties["ServerAddress"]
+	if address == "" {
+		return []TimeSource{}
+	}
+	if name := properties["ServerName"]; name != "" && name != address {
+		address = name + " (" + address + ")"
+	}
+
+	// NTPMessage={ Leap=0, Version=4, Mode=4, Stratum=2, ..., Jitter=1.234ms }
+	message := make(map[string]string)
+	body := strings.TrimSuffix(strings.TrimPrefix(properties["NTPMessage"], "{"), "}")
+	for _, field := range strings.Split(body, ",") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(field), "="); ok {
+			message[key] = value
+		}
+	}
+	stratum, _ := strconv.Atoi(message["Stratum"])
+	source := TimeSource{Address: address, Mode: "server", State: "selected", Selected: true, Stratum: stratum}
+	if jitter, err := time.ParseDuration(message["Jitter"]); err == nil {
+		source.JitterMs = float64(jitter) / float64(time.Millisecond)
+	}
+
+	var stamps [4]time.Time
+	for i, key := range []string{"OriginateTimestamp", "ReceiveTimestamp", "TransmitTimestamp", "DestinationTimestamp"} {
+		stamp, err := time.Parse(timesyncTimestampLayout, message[key])
+		if err != nil {
+			return []TimeSource{source}
+		}
+		stamps[i] = stamp
+	}
+	offset := (stamps[1].Sub(stamps[0]) + stamps[2].Sub(stamps[3])) / 2
+	source.OffsetMs = float64(offset) / float64(time.Millisecond)
+	lastRx := now.Sub(stamps[3]).Seconds()
+	source.LastRxSeconds = &lastRx
+	return []TimeSource{source}
+}
+
+// Function to read the peers of ntpd
+func ntpqSources(ctx context.Context) ([]TimeSource, error) {
+	output, err := timeCommandOutput(ctx, "ntpq", "-pn")
+	if err != nil {
+		return nil, err
+	}
+	return parseNtpqPeers(output), nil
+}
+
+// Function to parse `ntpq -pn`, whose lines after the header are a tally code followed by
+// remote, refid, stratum, type, when, poll, reach, delay, offset and jitter, in ms
+func parseNtpqPeers(output string) []TimeSource {
+	sources := []TimeSource{}
+	for _, line := range strings.Split(output, "\n") {
+		if len(line) < 2 || strings.HasPrefix(line, "=") || strings.HasPrefix(strings.TrimSpace(line), "remote") {
+			continue
+		}
+		fields := strings.Fields(line[1:])
+		if len(fields) < 10 {
+			continue
+		}
+		state, ok := ntpqTallyStates[line[0]]
+		if !ok {
+			state = "rejected"
+		}
+		stratum, _ := strconv.Atoi(fields[2])
+		mode := "server"
+		switch fields[3] {
+		case "s":
+			mode = "peer"
+		case "l":
+			mode = "refclock"
+		}
+		if fields[6] == "0" {
+			state = "unreachable"
+		}
+		source := TimeSource{
+			Address:  fields[0],
+			Mode:     mode,
+			State:    state,
+			Selected: line[0] == '*' || line[0] == 'o',
+			Stratum:  stratum,
+			Reach:    fields[6],
+			OffsetMs: parseFloat(fields[8]),
+			JitterMs: parseFloat(fields[9]),
+		}
+		if lastRx, ok := parseNtpqWhen(fields[4]); ok {
+			source.LastRxSeconds = &lastRx
+		}
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// Helper function to parse the when column of ntpq, seconds unless suffixed with m, h or d
+func parseNtpqWhen(value string) (float64, bool) {
+	unit := 1.0
+	switch {
+	case strings.HasSuffix(value, "m"):
+		unit = 60
+	case strings.HasSuffix(value, "h"):
+		unit = 3600
+	case strings.HasSuffix(value, "d"):
+		unit = 86400
+	}
+	n, err := strconv.ParseFloat(strings.TrimRight(value, "mhd"), 64)
+	if err != nil {
+		return 0, false
+	}
+	return n * unit, true
+}
+
+// Function to register the time synchronization endpoints
+func registerTimeRoutes(r *gin.Engine) {
+	// Define the /time/sources endpoint that reports the sources of the NTP daemon with
+	// their offsets, for debugging clock drift
+	r.GET("/time/sources", func(c *gin.Context) {
+		sources, err := collectTimeSources(c.Request.Context())
+		if err != nil {
+			respondFailure(c, "Failed to read the time sources", err)
+			return
+		}
+		c.JSON(200, sources)
+	})
+}
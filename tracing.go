@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingConfig exports OpenTelemetry traces of requests, jobs, and the commands they
+// run. Tracing is off without an endpoint. Changes take effect after a restart.
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP traces URL, like http://collector:4318/v1/traces
+	Endpoint string            `yaml:"endpoint"`
+	Headers  map[string]string `yaml:"headers"`
+}
+
+// Function to check the tracing settings
+func (c TracingConfig) validate() error {
+	if c.Endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("tracing.endpoint must be an http or https URL")
+	}
+	return nil
+}
+
+// Spans go to the global provider, which drops them until setupTracing installs an exporter
+var tracer = otel.Tracer("github.com/rothgar/cosi")
+
+// Function to export spans to the configured OTLP endpoint. Incoming traceparent
+// headers are honored either way, so the agent's spans join the controller's traces.
+func setupTracing(cfg TracingConfig) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if cfg.Endpoint == "" {
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(cfg.Endpoint),
+		otlptracehttp.WithHeaders(cfg.Headers),
+		otlptracehttp.WithProxy(agentProxy),
+	)
+	if err != nil {
+		return err
+	}
+	res, err := resource.New(context.Background(),
+		resource.WithHost(),
+		resource.WithAttributes(
+			attribute.String("service.name", "cosi"),
+			attribute.String("service.version", version),
+			attribute.String("service.instance.id", instanceID),
+		),
+	)
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// Follow the controller's sampling decision, and sample everything else
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+	))
+	return nil
+}
+
+// Middleware to trace each request as a server span, continuing the trace of an
+// incoming traceparent header
+func traceRequests(c *gin.Context) {
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	route := c.FullPath()
+	name := c.Request.Method + " " + route
+	if route == "" {
+		name = c.Request.Method
+	}
+	ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.request.method", c.Request.Method),
+		attribute.String("http.route", route),
+		attribute.String("url.path", c.Request.URL.Path),
+		attribute.String("client.address", c.ClientIP()),
+		attribute.String("cosi.request.id", c.GetString("request_id")),
+	))
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if jobID := c.Writer.Header().Get("X-Cosi-Job-Id"); jobID != "" {
+		span.SetAttributes(attribute.String("cosi.job.id", jobID))
+	}
+	if status >= 500 {
+		span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", status))
+	}
+}
+
+// countingWriter counts the output of a command on its way to the real writer
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return w.w.Write(p)
+}
+
+// Function to start the span of a command under ctx. It counts what the command writes
+// to stdout and stderr, so it must be called before the command starts; call the
+// returned function with the command's error once it has exited.
+func startCommandSpan(ctx context.Context, cmd *exec.Cmd) func(error) {
+	_, span := tracer.Start(ctx, "exec "+commandTool(cmd), trace.WithAttributes(
+		attribute.String("process.executable.name", commandTool(cmd)),
+		attribute.String("process.command_line", strings.Join(cmd.Args, " ")),
+	))
+	if !span.IsRecording() {
+		return func(error) {}
+	}
+
+	output := &atomic.Int64{}
+	if cmd.Stdout != nil {
+		cmd.Stdout = countingWriter{w: cmd.Stdout, n: output}
+	}
+	if cmd.Stderr != nil {
+		cmd.Stderr = countingWriter{w: cmd.Stderr, n: output}
+	}
+	return func(err error) {
+		exitCode := -1
+		if cmd.ProcessState != nil {
+			exitCode = cmd.ProcessState.ExitCode()
+		}
+		span.SetAttributes(
+			attribute.Int("process.exit.code", exitCode),
+			attribute.Int64("cosi.output.bytes", output.Load()),
+		)
+		endSpan(span, err)
+	}
+}
+
+// Helper function to end a span with the outcome of the operation it covers
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Largest agent binary POST /update will download
+	maxUpdateBytes = 256 << 20
+	// Exit code used with restart: exit so systemd restarts into the new binary,
+	// e.g. with RestartForceExitStatus=75 in the unit
+	updateExitCode = 75
+)
+
+// UpdateRequest is the body of POST /update
+type UpdateRequest struct {
+	URL    string `json:"url" binding:"required"`
+	SHA256 string `json:"sha256" binding:"required"`
+	// Signature is a base64 Ed25519 signature of the binary, checked against update.public_key
+	Signature string `json:"signature"`
+	// SignatureURL is a minisign signature of the binary, checked against the trusted keys
+	SignatureURL   string `json:"signature_url"`
+	AllowDowngrade bool   `json:"allow_downgrade"`
+}
+
+// UpdateResult describes an installed update
+type UpdateResult struct {
+	PreviousVersion string `json:"previous_version"`
+	NewVersion      string `json:"new_version"`
+	SHA256          string `json:"sha256"`
+	Path            string `json:"path"`
+	RollbackPath    string `json:"rollback_path"`
+	Restart         string `json:"restart"`
+}
+
+// Helper function to resolve the path of the running binary
+func executablePath() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// Function to download, verify, and install a new agent binary next to the running one.
+// Nothing is replaced until every check has passed.
+func applyUpdate(request UpdateRequest) (UpdateResult, error) {
+	result := UpdateResult{PreviousVersion: version, Restart: "exec"}
+	if restart := currentConfig().Update.Restart; restart != "" {
+		result.Restart = restart
+	}
+
+	exe, err := executablePath()
+	if err != nil {
+		return result, err
+	}
+	result.Path = exe
+	result.RollbackPath = exe + ".prev"
+
+	// The checksum comes from the same request as the URL, so it only catches a corrupted
+	// download; whoever built the binary is proven by a signature from a configured key
+	if currentConfig().Update.PublicKey == "" && request.SignatureURL == "" {
+		return result, &requestError{422, "signature_required", "Updates must be signed; configure update.public_key, or trusted keys with a signature_url"}
+	}
+
+	data, err := downloadUpdate(request.URL)
+	if err != nil {
+		return result, err
+	}
+
+	sum := sha256.Sum256(data)
+	result.SHA256 = hex.EncodeToString(sum[:])
+	if !strings.EqualFold(strings.TrimPrefix(request.SHA256, "sha256:"), result.SHA256) {
+		return result, &requestError{422, "checksum_mismatch", fmt.Sprintf("binary sha256 is %s, expected %s", result.SHA256, request.SHA256)}
+	}
+	if err := verifyUpdateSignature(data, request.Signature); err != nil {
+		return result, err
+	}
+	// A binary signed for update.public_key already counts as signed
+	required := currentConfig().Update.PublicKey == ""
+	if _, err := verifyDetachedSignature(data, "update "+request.URL, request.SignatureURL, required); err != nil {
+		var sigErr *signatureError
+		if errors.As(err, &sigErr) {
+			return result, &requestError{422, sigErr.Code, sigErr.Message}
+		}
+		return result, err
+	}
+
+	// Stage the binary in the same directory so the final rename is atomic
+	staged, err := stageUpdate(filepath.Dir(exe), data)
+	if err != nil {
+		return result, err
+	}
+	defer os.Remove(staged) // no-op once renamed into place
+
+	result.NewVersion, err = binaryVersion(staged)
+	if err != nil && !request.AllowDowngrade {
+		return result, &requestError{422, "unknown_version", "Unable to determine the version of the new binary: " + err.Error()}
+	}
+	if !request.AllowDowngrade {
+		if cmp, ok := compareVersions(result.NewVersion, version); ok && cmp < 0 {
+			return result, &requestError{409, "downgrade_refused", fmt.Sprintf("%s is older than the running %s; set allow_downgrade to install it", result.NewVersion, version)}
+		}
+	}
+
+	// Keep the running binary as the rollback copy, then swap the new one in
+	os.Remove(result.RollbackPath)
+	if err := os.Link(exe, result.RollbackPath); err != nil {
+		return result, fmt.Errorf("keeping rollback copy: %w", err)
+	}
+	if err := os.Rename(staged, exe); err != nil {
+		return result, fmt.Errorf("installing new binary: %w", err)
+	}
+	return result, nil
+}
+
+// Helper function to download an update, refusing bodies larger than maxUpdateBytes
+func downloadUpdate(url string) ([]byte, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, &requestError{400, "invalid_url", "url must be http or https"}
+	}
+	client := &http.Client{Timeout: 5 * time.Minute, Transport: proxiedTransport()}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, &requestError{422, "download_failed", err.Error()}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &requestError{422, "download_failed", fmt.Sprintf("fetching %s: %s", url, resp.Status)}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxUpdateBytes+1))
+	if err != nil {
+		return nil, &requestError{422, "download_failed", err.Error()}
+	}
+	if len(data) > maxUpdateBytes {
+		return nil, &requestError{422, "download_failed", fmt.Sprintf("binary is larger than %d bytes", maxUpdateBytes)}
+	}
+	return data, nil
+}
+
+// Function to check the detached signature of an update. A signature is required
+// when update.public_key is configured and rejected when it isn't.
+func verifyUpdateSignature(data []byte, signature string) error {
+	publicKey := currentConfig().Update.PublicKey
+	if publicKey == "" {
+		if signature != "" {
+			return &requestError{422, "signature_unverifiable", "A signature was given but update.public_key is not configured"}
+		}
+		return nil
+	}
+	if signature == "" {
+		return &requestError{422, "signature_required", "update.public_key is configured, so a signature is required"}
+	}
+
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return &requestError{500, "invalid_public_key", "update.public_key is not a base64 Ed25519 public key"}
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), data, sig) {
+		return &requestError{422, "signature_invalid", "The signature does not match the binary"}
+	}
+	return nil
+}
+
+// Helper function to write the new binary to a temporary executable file in dir
+func stageUpdate(dir string, data []byte) (string, error) {
+	file, err := os.CreateTemp(dir, ".cosi-update-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(file, bytes.NewReader(data)); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Chmod(0755); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// Function to ask a binary for its version with --version
+func binaryVersion(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	output, err := outputTracked(newCommandContext(ctx, path, "--version"))
+	if err != nil {
+		return "", err
+	}
+	// cosi <version> (commit ..., built ...)
+	fields := strings.Fields(string(output))
+	if len(fields) < 2 || fields[0] != "cosi" {
+		return "", fmt.Errorf("unexpected --version output %q", strings.TrimSpace(string(output)))
+	}
+	return fields[1], nil
+}
+
+// Function to compare two semantic versions. ok is false when either can't be parsed,
+// such as development builds.
+func compareVersions(a, b string) (int, bool) {
+	pa, ok := parseVersion(a)
+	if !ok {
+		return 0, false
+	}
+	pb, ok := parseVersion(b)
+	if !ok {
+		return 0, false
+	}
+	for i := range pa {
+		if pa[i] != pb[i] {
+			if pa[i] < pb[i] {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, true
+}
+
+// Helper function to parse vMAJOR.MINOR.PATCH, ignoring pre-release and build suffixes
+func parseVersion(v string) ([3]int, bool) {
+	var parts [3]int
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	fields := strings.Split(v, ".")
+	if len(fields) != 3 {
+		return parts, false
+	}
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}
+
+// Function to restart into the installed binary. It waits for any package
+// transaction to finish so one is never cut off halfway.
+func restartAgent(exe string) {
+	packageLock.Lock()
+	log.Printf("Restarting into updated binary %s", exe)
+	if currentConfig().Update.Restart == "exit" {
+		os.Exit(updateExitCode)
+	}
+	inheritActivationSocket()
+	err := syscall.Exec(exe, os.Args, os.Environ())
+	log.Printf("Failed to re-exec %s: %v", exe, err)
+	os.Exit(updateExitCode)
+}
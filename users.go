@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scope of the tokens that may create, change and delete local accounts
+const scopeUsers = "users"
+
+// Longest user or group name useradd accepts
+const maxUserNameLength = 32
+
+// The names useradd accepts by default: a lowercase letter or underscore, then lowercase
+// letters, digits, underscores and dashes, optionally ending in $ for Samba machine accounts
+var userNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*\$?$`)
+
+// usersLock serializes changes to the local accounts, so checking an account and changing
+// it happen together
+var usersLock sync.Mutex
+
+// UserAccount is a local account from /etc/passwd
+type UserAccount struct {
+	Name  string `json:"name"`
+	UID   int    `json:"uid"`
+	GID   int    `json:"gid"`
+	Home  string `json:"home"`
+	Shell string `json:"shell"`
+	// Groups are the supplementary groups, without the primary group
+	Groups []string `json:"groups"`
+	// System is true for accounts below UID_MIN of /etc/login.defs
+	System bool `json:"system"`
+}
+
+// UserRequest is the body of POST /users. Passwords are not set; access is granted with
+// keys through POST /ssh/keys.
+type UserRequest struct {
+	Name   string   `json:"name" binding:"required"`
+	System bool     `json:"system"`
+	Home   string   `json:"home"`
+	Shell  string   `json:"shell"`
+	Groups []string `json:"groups"`
+	// CreateHome creates the home directory when true and skips it when false; when unset
+	// useradd follows CREATE_HOME of /etc/login.defs
+	CreateHome *bool `json:"create_home"`
+}
+
+// UserPatchRequest is the body of PATCH /users/:name
+type UserPatchRequest struct {
+	Shell string `json:"shell"`
+	// Groups replaces the supplementary groups, or is added to them when Append is set
+	Groups *[]string `json:"groups"`
+	Append bool      `json:"append"`
+}
+
+// UserDeleteRequest is the optional body of DELETE /users/:name; remove_home may also be
+// a query parameter
+type UserDeleteRequest struct {
+	RemoveHome bool `json:"remove_home"`
+}
+
+// UserChange is the response of the /users endpoints that change an account
+type UserChange struct {
+	User    *UserAccount `json:"user"`
+	Changed bool         `json:"changed"`
+}
+
+// Function to check a user or group name against what useradd accepts
+func validateUserName(kind, name string) error {
+	if len(name) > maxUserNameLength || !userNamePattern.MatchString(name) {
+		return &requestError{Status: 400, Code: "invalid_name", Message: fmt.Sprintf("%q is not a valid %s name: use lowercase letters, digits, _ and -, starting with a letter or _, up to %d characters", name, kind, maxUserNameLength)}
+	}
+	return nil
+}
+
+// Function to check that a shell is an executable file given by its absolute path
+func validateShell(shell string) error {
+	if !filepath.IsAbs(shell) || filepath.Clean(shell) != shell || strings.ContainsAny(shell, ":\n") {
+		return &requestError{Status: 400, Code: "invalid_shell", Message: fmt.Sprintf("%q is not an absolute path", shell)}
+	}
+	info, err := os.Stat(shell)
+	if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+		return &requestError{Status: 422, Code: "invalid_shell", Message: shell + " is not an executable file"}
+	}
+	return nil
+}
+
+// Function to check that every group exists
+func validateGroups(groups []string) error {
+	known := make(map[string]bool)
+	for _, group := range readGroupFile() {
+		known[group.name] = true
+	}
+	for _, group := range groups {
+		if err := validateUserName("group", group); err != nil {
+			return err
+		}
+		if !known[group] {
+			return &requestError{Status: 422, Code: "group_not_found", Message: "Group " + group + " does not exist"}
+		}
+	}
+	return nil
+}
+
+// Function to validate the fields of POST /users
+func (r *UserRequest) validate() error {
+	if err := validateUserName("user", r.Name); err != nil {
+		return err
+	}
+	if r.Home != "" && (!filepath.IsAbs(r.Home) || filepath.Clean(r.Home) != r.Home || strings.ContainsAny(r.Home, ":\n")) {
+		return &requestError{Status: 400, Code: "invalid_home", Message: fmt.Sprintf("%q is not an absolute path", r.Home)}
+	}
+	if r.Shell != "" {
+		if err := validateShell(r.Shell); err != nil {
+			return err
+		}
+	}
+	return validateGroups(r.Groups)
+}
+
+// groupEntry is one line of /etc/group
+type groupEntry struct {
+	name    string
+	gid     int
+	members []string
+}
+
+// Function to read /etc/group, skipping lines it can't parse
+func readGroupFile() []groupEntry {
+	lines, err := readLines("/etc/group")
+	if err != nil {
+		return nil
+	}
+	var groups []groupEntry
+	for _, line := range lines {
+		fields := strings.Split(line, ":")
+		if len(fields) != 4 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		group := groupEntry{name: fields[0], gid: gid}
+		if fields[3] != "" {
+			group.members = strings.Split(fields[3], ",")
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// Helper function to read UID_MIN from /etc/login.defs, the first UID of regular accounts
+func loginDefsUIDMin() int {
+	lines, _ := readLines("/etc/login.defs")
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "UID_MIN" {
+			if uid, err := strconv.Atoi(fields[1]); err == nil {
+				return uid
+			}
+		}
+	}
+	return 1000
+}
+
+// Function to look up a local account in /etc/passwd and /etc/group, returning nil when
+// there is none. Accounts from LDAP or other directories are not local and not found.
+func lookupLocalUser(name string) (*UserAccount, error) {
+	lines, err := readLines("/etc/passwd")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		fields := strings.Split(line, ":")
+		if len(fields) != 7 || fields[0] != name {
+			continue
+		}
+		uid, _ := strconv.Atoi(fields[2])
+		gid, _ := strconv.Atoi(fields[3])
+		account := &UserAccount{Name: name, UID: uid, GID: gid, Home: fields[5], Shell: fields[6], Groups: []string{}}
+		account.System = uid < loginDefsUIDMin()
+		for _, group := range readGroupFile() {
+			if group.gid != gid && containsString(group.members, name) {
+				account.Groups = append(account.Groups, group.name)
+			}
+		}
+		sort.Strings(account.Groups)
+		return account, nil
+	}
+	return nil, nil
+}
+
+// Helper function to compare two group lists regardless of order and duplicates
+func sameGroups(a, b []string) bool {
+	set := func(groups []string) string {
+		seen := make(map[string]bool)
+		var unique []string
+		for _, group := range groups {
+			if !seen[group] {
+				seen[group] = true
+				unique = append(unique, group)
+			}
+		}
+		sort.Strings(unique)
+		return strings.Join(unique, ",")
+	}
+	return set(a) == set(b)
+}
+
+// Helper function to list how an existing account differs from a creation request
+func (r *UserRequest) differences(account *UserAccount) []string {
+	var differences []string
+	if r.System != account.System {
+		differences = append(differences, fmt.Sprintf("system is %t", account.System))
+	}
+	if r.Home != "" && r.Home != account.Home {
+		differences = append(differences, "home is "+account.Home)
+	}
+	if r.Shell != "" && r.Shell != account.Shell {
+		differences = append(differences, "shell is "+account.Shell)
+	}
+	if r.Groups != nil && !sameGroups(r.Groups, account.Groups) {
+		differences = append(differences, "groups are "+strings.Join(account.Groups, ","))
+	}
+	return differences
+}
+
+// Helper function to run useradd, usermod or userdel
+func runUserCommand(ctx context.Context, name string, args ...string) error {
+	cmd := newPrivilegedCommand(nil, name, args...)
+	if result, err := runCommandContext(ctx, cmd); err != nil {
+		return &commandError{Tool: commandTool(cmd), Result: result, Err: err}
+	}
+	return nil
+}
+
+// Function to create an account with useradd. An account that exists with the requested
+// attributes is left alone and reported unchanged; one that differs is a conflict, to be
+// changed through PATCH /users/:name.
+func createUser(ctx context.Context, request UserRequest) (*UserChange, error) {
+	if err := request.validate(); err != nil {
+		return nil, err
+	}
+
+	usersLock.Lock()
+	defer usersLock.Unlock()
+
+	existing, err := lookupLocalUser(request.Name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if differences := request.differences(existing); len(differences) > 0 {
+			return nil, &responseError{409, gin.H{
+				"error":       "User " + request.Name + " already exists with different attributes; use PATCH /users/" + request.Name + " to change them",
+				"code":        "user_exists",
+				"differences": differences,
+				"user":        existing,
+			}}
+		}
+		return &UserChange{User: existing}, nil
+	}
+
+	var args []string
+	if request.System {
+		args = append(args, "--system")
+	}
+	if request.Home != "" {
+		args = append(args, "--home-dir", request.Home)
+	}
+	if request.Shell != "" {
+		args = append(args, "--shell", request.Shell)
+	}
+	if len(request.Groups) > 0 {
+		args = append(args, "--groups", strings.Join(request.Groups, ","))
+	}
+	if request.CreateHome != nil {
+		if *request.CreateHome {
+			args = append(args, "--create-home")
+		} else {
+			args = append(args, "--no-create-home")
+		}
+	}
+	if err := runUserCommand(ctx, "useradd", append(args, "--", request.Name)...); err != nil {
+		return nil, err
+	}
+	account, err := lookupLocalUser(request.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &UserChange{User: account, Changed: true}, nil
+}
+
+// Function to change the shell or supplementary groups of an account with usermod,
+// reporting it unchanged when it already matches
+func modifyUser(ctx context.Context, name string, request UserPatchRequest) (*UserChange, error) {
+	if err := validateUserName("user", name); err != nil {
+		return nil, err
+	}
+	if request.Shell == "" && request.Groups == nil {
+		return nil, &requestError{Status: 400, Code: "invalid_parameter", Message: "shell or groups is required"}
+	}
+	if request.Shell != "" {
+		if err := validateShell(request.Shell); err != nil {
+			return nil, err
+		}
+	}
+	if request.Groups != nil {
+		if err := validateGroups(*request.Groups); err != nil {
+			return nil, err
+		}
+	}
+
+	usersLock.Lock()
+	defer usersLock.Unlock()
+
+	account, err := lookupLocalUser(name)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, &requestError{Status: 404, Code: "user_not_found", Message: "User " + name + " does not exist"}
+	}
+
+	var args []string
+	if request.Shell != "" && request.Shell != account.Shell {
+		args = append(args, "--shell", request.Shell)
+	}
+	if request.Groups != nil {
+		groups := *request.Groups
+		if request.Append {
+			groups = append(append([]string{}, account.Groups...), groups...)
+		}
+		if !sameGroups(groups, account.Groups) {
+			args = append(args, "--groups", strings.Join(groups, ","))
+		}
+	}
+	if len(args) == 0 {
+		return &UserChange{User: account}, nil
+	}
+	if err := runUserCommand(ctx, "usermod", append(args, "--", name)...); err != nil {
+		return nil, err
+	}
+	if account, err = lookupLocalUser(name); err != nil {
+		return nil, err
+	}
+	return &UserChange{User: account, Changed: true}, nil
+}
+
+// Function to delete an account with userdel, and its home directory and mail spool when
+// removeHome is set. root and the account the agent runs as are refused.
+func deleteUser(ctx context.Context, name string, removeHome bool) (*UserChange, error) {
+	if err := validateUserName("user", name); err != nil {
+		return nil, err
+	}
+
+	usersLock.Lock()
+	defer usersLock.Unlock()
+
+	account, err := lookupLocalUser(name)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, &requestError{Status: 404, Code: "user_not_found", Message: "User " + name + " does not exist"}
+	}
+	if account.UID == 0 || account.UID == os.Getuid() {
+		return nil, &requestError{Status: 409, Code: "protected_user", Message: "Refusing to delete " + name + ", which is root or the account the agent runs as"}
+	}
+
+	args := []string{"--", name}
+	if removeHome {
+		args = append([]string{"--remove"}, args...)
+	}
+	if err := runUserCommand(ctx, "userdel", args...); err != nil {
+		return nil, err
+	}
+	return &UserChange{User: account, Changed: true}, nil
+}
+
+// Function to register the user account endpoints
+func registerUserRoutes(r *gin.Engine) {
+	// Define the /users POST endpoint that creates a local account, or reports an existing
+	// one with the same attributes as unchanged
+	r.POST("/users", requireScope(scopeUsers), func(c *gin.Context) {
+		var request UserRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format: name is required"})
+			return
+		}
+		change, err := createUser(c.Request.Context(), request)
+		details := map[string]interface{}{"user": request.Name, "system": request.System, "home": request.Home, "shell": request.Shell, "groups": request.Groups}
+		if change != nil {
+			details["changed"] = change.Changed
+		}
+		audit.Record(auditOutcome("users.create", c.ClientIP(), details, err))
+		if err != nil {
+			respondFailure(c, "Failed to create user", err)
+			return
+		}
+		status := 200
+		if change.Changed {
+			status = 201
+		}
+		c.JSON(status, change)
+	})
+
+	// Define the /users/{name} PATCH endpoint that changes the shell or groups of an account
+	r.PATCH("/users/:name", requireScope(scopeUsers), func(c *gin.Context) {
+		var request UserPatchRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request format"})
+			return
+		}
+		change, err := modifyUser(c.Request.Context(), c.Param("name"), request)
+		details := map[string]interface{}{"user": c.Param("name"), "shell": request.Shell, "groups": request.Groups, "append": request.Append}
+		if change != nil {
+			details["changed"] = change.Changed
+		}
+		audit.Record(auditOutcome("users.modify", c.ClientIP(), details, err))
+		if err != nil {
+			respondFailure(c, "Failed to modify user", err)
+			return
+		}
+		c.JSON(200, change)
+	})
+
+	// Define the /users/{name} DELETE endpoint that deletes an account
+	r.DELETE("/users/:name", requireScope(scopeUsers), func(c *gin.Context) {
+		var request UserDeleteRequest
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&request); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid request format: " + err.Error()})
+				return
+			}
+		}
+		request.RemoveHome = request.RemoveHome || c.Query("remove_home") == "true"
+		change, err := deleteUser(c.Request.Context(), c.Param("name"), request.RemoveHome)
+		audit.Record(auditOutcome("users.delete", c.ClientIP(), map[string]interface{}{"user": c.Param("name"), "remove_home": request.RemoveHome}, err))
+		if err != nil {
+			respondFailure(c, "Failed to delete user", err)
+			return
+		}
+		c.JSON(200, change)
+	})
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Creating, changing and deleting accounts needs the users scope. The names are invalid
+// so the requests let through are refused before anything runs.
+func TestUserRoutesRequireScope(t *testing.T) {
+	withJobStore(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerUserRoutes(r)
+
+	checkScopeRequired(t, r, scopeUsers, "POST", "/users", `{"name": "Not-A-User"}`)
+	checkScopeRequired(t, r, scopeUsers, "PATCH", "/users/Not-A-User", `{"shell": "/bin/sh"}`)
+	checkScopeRequired(t, r, scopeUsers, "DELETE", "/users/Not-A-User", "")
+
+	withScopedTokens(t, scopeUsers)
+	if w := serveWithToken(r, "POST", "/users", `{"name": "Not-A-User"}`, "ops-token"); w.Code != 400 {
+		t.Errorf("POST /users with an invalid name = %d %s, want 400", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rothgar/cosi/api"
+)
+
+const (
+	// Timeout of a verification check that doesn't set one, and the longest one may set
+	defaultVerifyTimeout = 5 * time.Second
+	maxVerifyTimeout     = time.Minute
+	// Verification checks run at once
+	verifyConcurrency = 8
+)
+
+// Job status of package jobs whose transaction succeeded but whose verification checks failed
+const jobVerificationFailed = api.JobVerificationFailed
+
+// Unit names service_active accepts, with or without a suffix like .service
+var serviceNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9:_.@-]*$`)
+
+// VerifyCheck is one check of a manifest's verify section, run after the package
+// transaction. Exactly one kind of check is set. The kinds are a fixed vocabulary;
+// manifests can't run commands of their own.
+type VerifyCheck struct {
+	// ServiceActive is a systemd unit that must be active, or the SysV service of that name
+	// on hosts without systemd
+	ServiceActive string `yaml:"service_active,omitempty" json:"service_active,omitempty"`
+	// PortListening is a TCP port something must listen on
+	PortListening int `yaml:"port_listening,omitempty" json:"port_listening,omitempty"`
+	// HTTPProbe must match, under the same restrictions as POST /probe/http
+	HTTPProbe *HTTPProbe `yaml:"http_probe,omitempty" json:"http_probe,omitempty"`
+	// BinaryPresent is a command that must be found on the PATH, or an absolute path
+	BinaryPresent string `yaml:"binary_present,omitempty" json:"binary_present,omitempty"`
+	// FileExists is an absolute path that must exist
+	FileExists string `yaml:"file_exists,omitempty" json:"file_exists,omitempty"`
+	TimeoutMS  int    `yaml:"timeout_ms,omitempty" json:"timeout_ms,omitempty"`
+}
+
+// Helper function to name the kind of a check and what it checks
+func (v VerifyCheck) kind() (string, string) {
+	switch {
+	case v.ServiceActive != "":
+		return "service_active", v.ServiceActive
+	case v.PortListening != 0:
+		return "port_listening", strconv.Itoa(v.PortListening)
+	case v.HTTPProbe != nil:
+		return "http_probe", v.HTTPProbe.URL
+	case v.BinaryPresent != "":
+		return "binary_present", v.BinaryPresent
+	case v.FileExists != "":
+		return "file_exists", v.FileExists
+	}
+	return "", ""
+}
+
+// Function to validate one check
+func (v *VerifyCheck) validate() error {
+	kinds := 0
+	for _, set := range []bool{v.ServiceActive != "", v.PortListening != 0, v.HTTPProbe != nil, v.BinaryPresent != "", v.FileExists != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("a check must set exactly one of service_active, port_listening, http_probe, binary_present, or file_exists")
+	}
+	if v.TimeoutMS < 0 || time.Duration(v.TimeoutMS)*time.Millisecond > maxVerifyTimeout {
+		return fmt.Errorf("timeout_ms must be between 0 and %d", maxVerifyTimeout.Milliseconds())
+	}
+	switch {
+	case v.ServiceActive != "" && !serviceNamePattern.MatchString(v.ServiceActive):
+		return fmt.Errorf("invalid service name %q", v.ServiceActive)
+	case v.PortListening < 0 || v.PortListening > 65535:
+		return fmt.Errorf("port_listening must be a port between 1 and 65535")
+	case v.BinaryPresent != "" && strings.Contains(v.BinaryPresent, "/") && !filepath.IsAbs(v.BinaryPresent):
+		return fmt.Errorf("binary_present must be a command name or an absolute path")
+	case v.FileExists != "" && !filepath.IsAbs(v.FileExists):
+		return fmt.Errorf("file_exists must be an absolute path")
+	case v.HTTPProbe != nil:
+		return v.HTTPProbe.validate()
+	}
+	return nil
+}
+
+// Helper function to return the timeout of a check
+func (v VerifyCheck) timeout() time.Duration {
+	if v.TimeoutMS == 0 {
+		return defaultVerifyTimeout
+	}
+	return time.Duration(v.TimeoutMS) * time.Millisecond
+}
+
+// Function to validate the verify section of a manifest
+func (p PackageConfig) validateVerify() []ManifestProblem {
+	var problems []ManifestProblem
+	paths := p.entryPaths("verify", len(p.Verify))
+	for i := range p.Verify {
+		if err := p.Verify[i].validate(); err != nil {
+			problems = append(problems, ManifestProblem{Field: paths[i], Code: "invalid_value", Message: err.Error()})
+		}
+	}
+	return problems
+}
+
+// VerifyResult is the outcome of one verification check
+type VerifyResult = api.VerifyResult
+
+// verificationFailedError reports a package transaction that succeeded while some of its
+// verification checks failed
+type verificationFailedError struct {
+	Failed []VerifyResult
+}
+
+func (e *verificationFailedError) Error() string {
+	checks := make([]string, len(e.Failed))
+	for i, result := range e.Failed {
+		checks[i] = result.Check + " " + result.Target
+	}
+	return fmt.Sprintf("%d verification checks failed: %s", len(e.Failed), strings.Join(checks, ", "))
+}
+
+// Helper function to check if err only reports failed verification checks
+func verificationFailed(err error) bool {
+	var verifyErr *verificationFailedError
+	return errors.As(err, &verifyErr)
+}
+
+// Function to run verification checks concurrently, each within its own timeout. The
+// error lists the checks that failed.
+func runVerification(checks []VerifyCheck) ([]VerifyResult, error) {
+	tasks := make([]task, len(checks))
+	for i, check := range checks {
+		kind, target := check.kind()
+		tasks[i] = task{Name: kind + " " + target, Run: func(ctx context.Context) (interface{}, error) {
+			return runVerifyCheck(ctx, check), nil
+		}}
+	}
+	results := make([]VerifyResult, len(checks))
+	var failed []VerifyResult
+	for i, outcome := range fanOut(context.Background(), tasks, verifyConcurrency, maxVerifyTimeout) {
+		if outcome.Err != nil {
+			kind, target := checks[i].kind()
+			results[i] = VerifyResult{Check: kind, Target: target, Detail: outcome.Err.Error()}
+		} else {
+			results[i] = outcome.Value.(VerifyResult)
+		}
+		if !results[i].Passed {
+			failed = append(failed, results[i])
+		}
+	}
+	if len(failed) > 0 {
+		return results, &verificationFailedError{Failed: failed}
+	}
+	return results, nil
+}
+
+// Function to run one verification check
+func runVerifyCheck(ctx context.Context, check VerifyCheck) VerifyResult {
+	ctx, cancel := context.WithTimeout(ctx, check.timeout())
+	defer cancel()
+
+	kind, target := check.kind()
+	result := VerifyResult{Check: kind, Target: target}
+	started := time.Now()
+	switch kind {
+	case "service_active":
+		if host := capabilities.Get().InitSystem; !host.Systemd {
+			// Fall back to the SysV init script where the host has one
+			if !host.ServiceCommand {
+				result.Detail = requireSystemd("service_active").Error()
+				break
+			}
+			result.Passed, result.Detail = sysvServiceActive(ctx, check.ServiceActive)
+			break
+		}
+		cmd := newCommandContext(ctx, "systemctl", "is-active", check.ServiceActive)
+		output, _ := runCommand(cmd)
+		state := strings.TrimSpace(output.Stdout)
+		result.Passed = state == "active"
+		result.Detail = state
+		if state == "" {
+			result.Detail = strings.TrimSpace(output.Output)
+		}
+	case "port_listening":
+		result.Passed = tcpPortListening(check.PortListening)
+		if !result.Passed {
+			result.Detail = "nothing listens on TCP port " + target
+		}
+	case "http_probe":
+		probe, err := runHTTPProbe(ctx, *check.HTTPProbe, currentConfig().Network.httpProbeCheck())
+		if err != nil {
+			result.Detail = err.Error()
+			break
+		}
+		result.HTTPProbe = probe
+		result.Passed = probe.Matched
+		result.Detail = probe.Error
+		if probe.Error == "" && probe.StatusCode != 0 {
+			result.Detail = fmt.Sprintf("status %d", probe.StatusCode)
+		}
+	case "binary_present":
+		path, err := exec.LookPath(check.BinaryPresent)
+		result.Passed = err == nil
+		result.Detail = path
+		if err != nil {
+			result.Detail = err.Error()
+		}
+	case "file_exists":
+		_, err := os.Stat(check.FileExists)
+		result.Passed = err == nil
+		if err != nil {
+			result.Detail = err.Error()
+		}
+	}
+	result.DurationMS = milliseconds(time.Since(started))
+	return result
+}
+
+// Helper function to check if a socket listens on a TCP port, on any address, from the
+// socket tables of the kernel
+func tcpPortListening(port int) bool {
+	// Local addresses are hex address:port, and state 0A is LISTEN
+	suffix := fmt.Sprintf(":%04X", port)
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		data, err := os.ReadFile(table)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) > 3 && strings.HasSuffix(fields[1], suffix) && fields[3] == "0A" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/rothgar/cosi/api"
+)
+
+// Build information, injected with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// VersionInfo describes the running build of the agent
+type VersionInfo = api.VersionInfo
+
+// Function to collect the build information of the running binary
+func versionInfo() VersionInfo {
+	return VersionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Events waiting for delivery; further events are dropped while the queue is full
+	webhookQueueSize = 100
+	// Delivery attempts per target before giving up
+	webhookMaxAttempts = 5
+	webhookRetryBase   = time.Second
+	// Delivery attempts kept for GET /webhooks/deliveries
+	maxWebhookDeliveries = 100
+)
+
+// WebhookConfig is a target that receives completed-operation events
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Secret signs the body with HMAC-SHA256 in the X-Cosi-Signature header
+	Secret string `yaml:"secret"`
+	// Events filters by event type ("packages.failed") or job type ("kubernetes"); empty means all
+	Events []string `yaml:"events"`
+}
+
+// WebhookEvent is the JSON body POSTed to webhook targets
+type WebhookEvent struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"` // <job type>.<outcome>
+	JobID      string    `json:"job_id"`
+	JobType    string    `json:"job_type"`
+	Outcome    string    `json:"outcome"`
+	DurationMS int64     `json:"duration_ms"`
+	Summary    string    `json:"summary,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Hostname   string    `json:"hostname"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// WebhookDelivery records a single delivery attempt
+type WebhookDelivery struct {
+	EventID    string    `json:"event_id"`
+	EventType  string    `json:"event_type"`
+	URL        string    `json:"url"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+type webhookTask struct {
+	target WebhookConfig
+	event  WebhookEvent
+	body   []byte
+}
+
+// webhookDispatcher queues events and delivers them in the background
+type webhookDispatcher struct {
+	queue  chan webhookTask
+	client *http.Client
+
+	mu         sync.Mutex
+	targets    []WebhookConfig
+	deliveries []WebhookDelivery
+}
+
+var webhooks = &webhookDispatcher{
+	queue:  make(chan webhookTask, webhookQueueSize),
+	client: &http.Client{Timeout: 10 * time.Second, Transport: proxiedTransport()},
+}
+
+// Configure replaces the webhook targets
+func (d *webhookDispatcher) Configure(targets []WebhookConfig) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.targets = targets
+}
+
+// Start delivers queued events until the process exits
+func (d *webhookDispatcher) Start() {
+	go func() {
+		for task := range d.queue {
+			d.deliver(task)
+		}
+	}()
+}
+
+// Helper function to check if a target subscribed to an event
+func (w WebhookConfig) wants(event WebhookEvent) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, filter := range w.Events {
+		if filter == "*" || filter == event.Type || filter == event.JobType {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify queues a completed job for every subscribed target
+func (d *webhookDispatcher) Notify(job *Job) {
+	d.mu.Lock()
+	targets := d.targets
+	d.mu.Unlock()
+	if len(targets) == 0 {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	event := WebhookEvent{
+		ID:         newID(),
+		Type:       job.Type + "." + job.Status,
+		JobID:      job.ID,
+		JobType:    job.Type,
+		Outcome:    job.Status,
+		DurationMS: job.Duration().Milliseconds(),
+		Summary:    job.Summary,
+		Error:      job.Error,
+		Hostname:   hostname,
+		Timestamp:  time.Now().UTC(),
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode webhook event: %v", err)
+		return
+	}
+
+	for _, target := range targets {
+		if !target.wants(event) {
+			continue
+		}
+		select {
+		case d.queue <- webhookTask{target: target, event: event, body: body}:
+		default:
+			log.Printf("Webhook queue is full, dropping %s event for %s", event.Type, target.URL)
+		}
+	}
+}
+
+// Function to compute the X-Cosi-Signature header value for a body
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver sends one event, retrying with exponential backoff
+func (d *webhookDispatcher) deliver(task webhookTask) {
+	delay := webhookRetryBase
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		record := WebhookDelivery{
+			EventID:   task.event.ID,
+			EventType: task.event.Type,
+			URL:       task.target.URL,
+			Attempt:   attempt,
+			Time:      time.Now().UTC(),
+		}
+
+		err := d.post(task, &record)
+		d.record(record)
+		if err == nil {
+			return
+		}
+		if attempt < webhookMaxAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	log.Printf("Giving up delivering %s event to %s", task.event.Type, task.target.URL)
+}
+
+func (d *webhookDispatcher) post(task webhookTask, record *WebhookDelivery) error {
+	req, err := http.NewRequest("POST", task.target.URL, bytes.NewReader(task.body))
+	if err != nil {
+		record.Error = err.Error()
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Cosi-Event", task.event.Type)
+	if task.target.Secret != "" {
+		req.Header.Set("X-Cosi-Signature", webhookSignature(task.target.Secret, task.body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		record.Error = err.Error()
+		return err
+	}
+	resp.Body.Close()
+	record.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		record.Error = resp.Status
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (d *webhookDispatcher) record(delivery WebhookDelivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deliveries = append(d.deliveries, delivery)
+	if len(d.deliveries) > maxWebhookDeliveries {
+		d.deliveries = d.deliveries[len(d.deliveries)-maxWebhookDeliveries:]
+	}
+}
+
+// Deliveries returns the recent delivery attempts, newest first
+func (d *webhookDispatcher) Deliveries() []WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]WebhookDelivery, 0, len(d.deliveries))
+	for i := len(d.deliveries) - 1; i >= 0; i-- {
+		list = append(list, d.deliveries[i])
+	}
+	return list
+}
+
+// Function to validate a webhook target
+func (w WebhookConfig) validate() error {
+	if !strings.HasPrefix(w.URL, "http://") && !strings.HasPrefix(w.URL, "https://") {
+		return fmt.Errorf("webhook url %q must be http or https", w.URL)
+	}
+	return nil
+}